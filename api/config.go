@@ -0,0 +1,830 @@
+// Package api holds the plugin and task config of the wasmtime driver, with
+// helpers to build and validate them, for programs generating Nomad jobs and
+// client configs.
+package api
+
+import "github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+
+// OptLevel is a cranelift optimization level, numbered like wasmtime's
+type OptLevel uint8
+
+// The cranelift optimization levels
+const (
+	OptLevelNone OptLevel = iota
+	OptLevelSpeed
+	OptLevelSpeedAndSize
+)
+
+// Config contains configuration information for the plugin
+type Config struct {
+	// This struct is the decoded version of the schema defined in the
+	// ConfigSpec variable. It's used to convert the HCL configuration
+	// passed by the Nomad agent into Go constructs.
+
+	// MountTimeout is how long to wait for a volume mount, such as a CSI
+	// volume, to become available before failing the task
+	MountTimeout string `codec:"mount_timeout"`
+
+	// DataDir is where the driver keeps its artifact store. Defaults to a
+	// directory under the system temp dir.
+	DataDir string `codec:"data_dir"`
+
+	// LogLevel is the level the driver logs at, e.g. "debug". Everything is
+	// logged if unset, leaving the filtering to the Nomad agent.
+	LogLevel string `codec:"log_level"`
+
+	// ExecutionMode is where guests run: "in_process" in the plugin, or
+	// "forked" in a runner process of their own for each task, supervised
+	// by an executor like Nomad's exec driver, so a guest trap or runaway
+	// compilation can't take the plugin down. Defaults to "in_process".
+	ExecutionMode string `codec:"execution_mode"`
+
+	// StatsMinInterval is the shortest interval task stats are collected
+	// at. Shorter intervals requested by Nomad are clamped to it.
+	StatsMinInterval string `codec:"stats_min_interval"`
+
+	// ArtifactRetention is how long modules no task uses are kept in the
+	// data dir, so restarted or rescheduled tasks don't fetch them again.
+	// "0s" deletes them as soon as they're unused.
+	ArtifactRetention string `codec:"artifact_retention"`
+
+	// MaxConcurrentDownloads is the number of artifacts the driver fetches
+	// at the same time
+	MaxConcurrentDownloads int `codec:"max_concurrent_downloads"`
+
+	// DownloadBandwidthLimit is the bandwidth each download may use per
+	// second, e.g. "10MB". Downloads are not throttled if unset.
+	DownloadBandwidthLimit string `codec:"download_bandwidth_limit"`
+
+	// Proxy configures the proxies used to fetch artifacts
+	Proxy ProxyConfig `codec:"proxy"`
+
+	// Audit configures the audit log of executed modules
+	Audit AuditConfig `codec:"audit"`
+
+	// Crypto configures the wasi-crypto host functions
+	Crypto CryptoConfig `codec:"crypto"`
+
+	// MaxDecompressedSize caps the size of compressed modules once
+	// decompressed, e.g. "256MiB"
+	MaxDecompressedSize string `codec:"max_decompressed_size"`
+
+	// CompiledCodeBudget caps the compiled code of all tasks on the node,
+	// e.g. "2GiB". Tasks that would exceed it fail to start with a
+	// recoverable error and driver.wasmtime.capacity.exhausted is set, so
+	// jobs can be constrained to avoid the node. Unlimited if unset.
+	CompiledCodeBudget string `codec:"compiled_code_budget"`
+
+	// MaxInstances is the number of guests the node is meant to host, which
+	// driver.wasmtime.capacity.instances_free is estimated from along with
+	// the memory limit. It's not enforced.
+	MaxInstances int `codec:"max_instances"`
+
+	// StrictImports refuses modules importing anything but WASI and the
+	// host functions matching AllowedImports, for hardened clusters
+	StrictImports bool `codec:"strict_imports"`
+
+	// StrictForecast refuses tasks allocated less memory or fuel than their
+	// module forecasts in its nomad.resources section, rather than warning
+	StrictForecast bool `codec:"strict_forecast"`
+
+	// AllowedImports are the host functions modules may import in strict
+	// mode, as "namespace.name" glob patterns, e.g.
+	// "wasi_ephemeral_keyvalue.*"
+	AllowedImports []string `codec:"allowed_imports"`
+
+	// AllowedHostPaths are the host directories, and anything under them,
+	// tasks may preopen with mount blocks. Mount blocks are refused if
+	// empty.
+	AllowedHostPaths []string `codec:"allowed_host_paths"`
+
+	// ReadOnly designates a node for the analysis of untrusted modules:
+	// tasks with writable preopens or mounts, or host interfaces reaching
+	// off the node, are refused.
+	ReadOnly bool `codec:"read_only"`
+
+	// Blobstore configures the S3 compatible store behind the blobstore host
+	// functions. The host functions are disabled if unset.
+	Blobstore BlobstoreConfig `codec:"blobstore"`
+
+	// Messaging configures the NATS servers behind the messaging host
+	// functions. The host functions are disabled if unset.
+	Messaging MessagingConfig `codec:"messaging"`
+
+	// Limits are the default limits of tasks and the most a task may set
+	Limits TaskLimitsConfig `codec:"limits"`
+
+	// Capabilities are the default capabilities of tasks and the only ones
+	// a task may be granted. Tasks aren't restricted if empty.
+	Capabilities []string `codec:"capabilities"`
+
+	// Compiler holds the engine defaults of tasks
+	Compiler PluginCompilerConfig `codec:"compiler"`
+
+	// Status configures the listener serving the driver's health and status
+	Status StatusConfig `codec:"status"`
+
+	// PProf configures the listener serving profiles of the plugin process
+	PProf PProfConfig `codec:"pprof"`
+
+	// RegistryCache shares the modules pulled from images with co-located
+	// tooling and other nodes
+	RegistryCache RegistryCacheConfig `codec:"registry_cache"`
+
+	// Runner relaxes the hardening of the runner processes of forked tasks
+	Runner RunnerConfig `codec:"runner"`
+
+	// LeakDetection configures the sweep for wasmtime stores outliving
+	// their task
+	LeakDetection LeakDetectionConfig `codec:"leak_detection"`
+
+	// Epoch configures the interruption of guests
+	Epoch EpochConfig `codec:"epoch"`
+
+	// CPUFuel meters the fuel of guests by the cpu of their task
+	CPUFuel CPUFuelConfig `codec:"cpu_fuel"`
+
+	// DebugRetention bounds the debug artifacts, such as memory dumps, the
+	// driver writes to alloc dirs
+	DebugRetention DebugRetentionConfig `codec:"debug_retention"`
+
+	// Quarantine refuses the modules whose tasks keep failing on the node
+	Quarantine QuarantineConfig `codec:"quarantine"`
+
+	// NamespaceQuotas are the shares of the node the tasks of each Nomad
+	// namespace may use, by namespace. The "*" quota applies to the
+	// namespaces without one.
+	NamespaceQuotas map[string]NamespaceQuotaConfig `codec:"namespace_quota"`
+
+	// MemoryPressure configures the eviction of idle compiled modules when
+	// the node runs low on memory
+	MemoryPressure MemoryPressureConfig `codec:"memory_pressure"`
+
+	// Logging configures where the output of tasks goes
+	Logging LoggingConfig `codec:"logging"`
+
+	// Vault configures the Vault server behind the secrets host functions
+	Vault VaultConfig `codec:"vault"`
+
+	// KeyValue configures the backends available to the keyvalue host
+	// functions
+	KeyValue KeyValueConfig `codec:"keyvalue"`
+}
+
+// ProxyConfig holds the proxies used for artifact fetches. The values follow
+// the semantics of the HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables.
+type ProxyConfig struct {
+	HTTPProxy  string `codec:"http_proxy"`
+	HTTPSProxy string `codec:"https_proxy"`
+	NoProxy    string `codec:"no_proxy"`
+}
+
+// AuditConfig configures where the audit log of executed modules is written
+type AuditConfig struct {
+	File           string `codec:"file"`
+	Syslog         bool   `codec:"syslog"`
+	SyslogFacility string `codec:"syslog_facility"`
+}
+
+// CryptoConfig configures the wasi-crypto host functions offered to guests
+type CryptoConfig struct {
+	Enabled bool `codec:"enabled"`
+
+	// AllowedAlgorithms restricts the algorithms guests may use. All
+	// supported algorithms are allowed if empty.
+	AllowedAlgorithms []string `codec:"allowed_algorithms"`
+
+	// FIPSOnly restricts guests to FIPS approved algorithms
+	FIPSOnly bool `codec:"fips_only"`
+}
+
+// BlobstoreConfig configures the S3 compatible store backing the blobstore
+// host functions. Each task is confined to its own prefix of the bucket.
+type BlobstoreConfig struct {
+	// Endpoint is the URL of the store, defaulting to AWS S3 in Region
+	Endpoint  string `codec:"endpoint"`
+	Region    string `codec:"region"`
+	Bucket    string `codec:"bucket"`
+	AccessKey string `codec:"access_key"`
+	SecretKey string `codec:"secret_key"`
+
+	// PathStyle addresses the bucket in the URL path instead of the host
+	PathStyle bool `codec:"path_style"`
+}
+
+// MessagingConfig configures the NATS connection of the messaging host
+// functions. Each task is confined to its own subject namespace.
+type MessagingConfig struct {
+	Servers []string `codec:"servers"`
+
+	// CredentialsFile is a NATS .creds file holding a user JWT and NKey
+	CredentialsFile string `codec:"credentials_file"`
+	Token           string `codec:"token"`
+	Username        string `codec:"username"`
+	Password        string `codec:"password"`
+}
+
+// PluginCompilerConfig holds the engine settings tasks inherit
+type PluginCompilerConfig struct {
+	// Strategy is used by tasks with the "auto" strategy
+	Strategy string `codec:"strategy"`
+
+	// Cache allows tasks to use the compilation cache. Tasks can opt out but
+	// not in when it is disabled.
+	Cache bool `codec:"cache"`
+
+	// AllowPrecompiled lets tasks run the precompiled code of module
+	// bundles, and .cwasm files built by `wasmtime compile` as their file.
+	// wasmtime runs deserialized code as is, so it must only be enabled if
+	// the job submitters are trusted with native code.
+	AllowPrecompiled bool `codec:"allow_precompiled"`
+
+	// Features are the WebAssembly proposals tasks may use, defaulting to
+	// the ones wasmtime enables by default. Each task's engine only enables
+	// those its module uses.
+	Features []string `codec:"features"`
+}
+
+// StatusConfig configures the status listener
+type StatusConfig struct {
+	// Address is a host:port or a unix socket in the form unix:///path. The
+	// listener is disabled if unset.
+	Address string `codec:"address"`
+}
+
+// PProfConfig configures the pprof listener
+type PProfConfig struct {
+	// Address is a host:port or a unix socket in the form unix:///path. The
+	// listener is disabled if unset; it shouldn't be reachable from outside
+	// the node.
+	Address string `codec:"address"`
+}
+
+// RegistryCacheConfig configures the registry cache: a listener serving the
+// artifact store, and the caches of other nodes modules pulled from pinned
+// images are fetched from before their registry
+type RegistryCacheConfig struct {
+	// Address is a host:port or a unix socket in the form unix:///path. The
+	// listener is disabled if unset; its artifacts are readable by anyone
+	// reaching it.
+	Address string `codec:"address"`
+
+	// Peers are the base URLs of the registry caches of other nodes, tried
+	// in order
+	Peers []string `codec:"peers"`
+}
+
+// RunnerConfig relaxes the hardening the runner of a forked task applies to
+// itself before running its guest. On Linux runners set no_new_privs, close
+// the descriptors they inherited by executing themselves again and clear
+// their ambient capabilities.
+type RunnerConfig struct {
+	AllowNewPrivileges      bool `codec:"allow_new_privileges"`
+	KeepInheritedFDs        bool `codec:"keep_inherited_fds"`
+	KeepAmbientCapabilities bool `codec:"keep_ambient_capabilities"`
+
+	// Umask is the octal umask of runners, "077" if unset
+	Umask string `codec:"umask"`
+}
+
+// LeakDetectionConfig configures the leak detection sweep
+type LeakDetectionConfig struct {
+	// Interval is how often the sweep runs, or "0" to disable it
+	Interval string `codec:"interval"`
+
+	// ForceClose closes the orphaned stores found instead of only reporting
+	// them
+	ForceClose bool `codec:"force_close"`
+}
+
+// EpochConfig configures the epoch ticks interrupting guests at their
+// deadlines
+type EpochConfig struct {
+	// Interval is how often the epoch is incremented, which is how late a
+	// guest may be interrupted past its deadline. Longer intervals lower the
+	// ticker's overhead on very dense nodes.
+	Interval string `codec:"interval"`
+
+	// CallDeadline bounds every call into a guest, such as an iteration of
+	// :bench, e.g. "30s". Calls are only bounded by the task's deadline if
+	// unset.
+	CallDeadline string `codec:"call_deadline"`
+}
+
+// NamespaceQuotaConfig caps what the tasks of a namespace use on the node.
+// Tasks over the quota fail to start with a recoverable error. Unset
+// values are unlimited.
+type NamespaceQuotaConfig struct {
+	// MaxInstances is the number of tasks of the namespace running at once
+	MaxInstances int `codec:"max_instances"`
+
+	// CompiledCode caps the compiled code of the namespace's tasks, e.g.
+	// "512MiB". The code of forked tasks isn't counted.
+	CompiledCode string `codec:"compiled_code"`
+
+	// Cache caps the size of the modules kept in the artifact store for the
+	// namespace's tasks
+	Cache string `codec:"cache"`
+
+	// Bandwidth is the rate the namespace's guests may send and receive
+	// over HTTP, e.g. "10MB" a second. It's shared by its tasks, which are
+	// throttled rather than refused.
+	Bandwidth string `codec:"bandwidth"`
+}
+
+// CPUFuelConfig derives the fuel of guests run to completion in the plugin
+// from the cpu shares of their task, for tasks without a fuel limit
+type CPUFuelConfig struct {
+	// FuelPerMHz is the fuel a guest earns each second for every MHz of its
+	// task's cpu. Guests aren't metered by their cpu if unset.
+	FuelPerMHz int64 `codec:"fuel_per_mhz"`
+
+	// Burst is how many seconds of fuel a guest may bank, e.g. "1s"
+	Burst string `codec:"burst"`
+
+	// OnExhaustion is what happens to a guest that used up its fuel: "kill"
+	// traps it, "yield" has it wait at its next host call until it earned
+	// some back. Guests not calling the host in time trap either way.
+	OnExhaustion string `codec:"on_exhaustion"`
+}
+
+// DebugRetentionConfig bounds the debug artifacts kept in each alloc dir.
+// The oldest artifacts are deleted first; unset values don't bound them.
+type DebugRetentionConfig struct {
+	MaxCount int    `codec:"max_count"`
+	MaxSize  string `codec:"max_size"`
+	MaxAge   string `codec:"max_age"`
+}
+
+// QuarantineConfig refuses new tasks of a module for Cooldown, "30m" by
+// default, once its tasks failed Failures times within Window, "10m" by
+// default. It's disabled unless Failures is set.
+type QuarantineConfig struct {
+	Failures int    `codec:"failures"`
+	Window   string `codec:"window"`
+	Cooldown string `codec:"cooldown"`
+}
+
+// MemoryPressureConfig configures the memory pressure watch
+type MemoryPressureConfig struct {
+	// Watermark is the percentage of the node's memory in use at which idle
+	// compiled modules are evicted. The watch is disabled if unset.
+	Watermark float64 `codec:"watermark"`
+
+	// Interval is how often the node's memory usage is checked
+	Interval string `codec:"interval"`
+}
+
+// LoggingConfig configures the handling of task output
+type LoggingConfig struct {
+	// DisableCollection stops Nomad from collecting the output of tasks,
+	// for nodes shipping logs with an external agent. The output is
+	// written to plain files instead of the FIFOs read by Nomad's logmon.
+	DisableCollection bool `codec:"disable_collection"`
+
+	// StreamDir is where those files are written, as
+	// <stream_dir>/<alloc_id>/<task>.{stdout,stderr}. Defaults to the
+	// allocation's log directory.
+	StreamDir string `codec:"stream_dir"`
+}
+
+// VaultConfig configures the Vault server secrets are read from. Unset
+// values fall back to the VAULT_* environment variables.
+type VaultConfig struct {
+	Address   string `codec:"address"`
+	CACert    string `codec:"ca_cert"`
+	Namespace string `codec:"namespace"`
+
+	// CacheTTL is how long secrets without a lease are cached, e.g. "5m"
+	CacheTTL string `codec:"cache_ttl"`
+}
+
+// KeyValueConfig configures the stores tasks may select as the backend of
+// their keyvalue host functions
+type KeyValueConfig struct {
+	Consul ConsulKVConfig `codec:"consul"`
+	Redis  RedisKVConfig  `codec:"redis"`
+}
+
+// ConsulKVConfig configures the Consul agent used for Consul KV. Unset
+// values fall back to the CONSUL_HTTP_* environment variables.
+type ConsulKVConfig struct {
+	Address string `codec:"address"`
+	Token   string `codec:"token"`
+}
+
+// RedisKVConfig configures the Redis server used as a keyvalue backend
+type RedisKVConfig struct {
+	Address  string `codec:"address"`
+	Username string `codec:"username"`
+	Password string `codec:"password"`
+	DB       int    `codec:"db"`
+
+	// TLS enables TLS, verified against TLSCAFile if set or the system
+	// roots otherwise
+	TLS       bool   `codec:"tls"`
+	TLSCAFile string `codec:"tls_ca_file"`
+}
+
+type CraneLiftOptions struct {
+	DebugVerifier       bool     `codec:"debug_verifier"`
+	OptLevel            OptLevel `codec:"optimize"`
+	NANCanonicalization bool     `codec:"nan_canonicalization"`
+}
+
+type WasmTimeCompiler struct {
+	Strategy         string           `codec:"strategy"`
+	CraneLiftOptions CraneLiftOptions `codec:"cranelift_options"`
+
+	// Cache enables the compilation cache for the task's module
+	Cache bool `codec:"cache"`
+}
+
+// TaskConfig contains configuration information for a task that runs with
+// this plugin
+type TaskConfig struct {
+	// This struct is the decoded version of the schema defined in the
+	// TaskConfigSpec variable. It's used to convert the string
+	// configuration for the task into Go constructs.
+	File      string           `codec:"file"`
+	Image     string           `codec:"image"`
+	ImagePath string           `codec:"image_path"`
+	Compiler  WasmTimeCompiler `codec:"compiler"`
+	Profiler  string           `codec:"profiler"`
+
+	// Args are passed to the guest after the module name
+	Args []string `codec:"args"`
+
+	// Env is set in the guest's WASI environment
+	Env hclutils.MapStrStr `codec:"env"`
+
+	// Stdin is a file in the task dir the guest reads as its stdin, e.g. a
+	// rendered template or the dispatch payload
+	Stdin string `codec:"stdin"`
+
+	// Entrypoint is the export run instead of _start, called with CallArgs,
+	// numbers converted to its i32, i64, f32 or f64 params. What it returns
+	// is written to <alloc>/alloc/<task>.result.json and sent as an event.
+	Entrypoint string        `codec:"entrypoint"`
+	CallArgs   []interface{} `codec:"call_args"`
+
+	// MainLoop is how the module is meant to run: "oneshot" modules exit by
+	// design and can't serve, "service" ones run until stopped and fail to
+	// start if their guest, run in the plugin, exits right away. Unset,
+	// neither is checked.
+	MainLoop string `codec:"main_loop"`
+
+	// DependsOn are the wasmtime tasks of the group the task's module is
+	// only instantiated once they're ready: exited successfully, or serving
+	// for serve tasks. It waits for DependsOnTimeout, "5m" by default.
+	DependsOn        []string `codec:"depends_on"`
+	DependsOnTimeout string   `codec:"depends_on_timeout"`
+
+	// Ulimit sets the nofile, nproc and core resource limits of the runner
+	// of a forked task, as "limit" or "soft:hard", e.g.
+	// { nofile = "1024:4096", core = "0" }
+	Ulimit hclutils.MapStrStr `codec:"ulimit"`
+
+	// LogLevel raises the driver's log level for this task only, e.g.
+	// "debug" or "trace" to see how its module is compiled and run
+	LogLevel string `codec:"log_level"`
+
+	WASI   TaskWASIConfig   `codec:"wasi"`
+	Limits TaskLimitsConfig `codec:"limits"`
+	HTTP   TaskHTTPConfig   `codec:"http"`
+
+	// PreallocateMemory commits the guest's maximum linear memory when it's
+	// instantiated, so a latency sensitive guest doesn't fault pages in
+	// under load
+	PreallocateMemory bool `codec:"preallocate_memory"`
+
+	// Timezone is the IANA timezone of the guest, e.g. "Europe/Paris", set
+	// as TZ with its tzdata under /usr/share/zoneinfo. Locale is set as
+	// LANG, e.g. "fr_FR.UTF-8".
+	Timezone string `codec:"timezone"`
+	Locale   string `codec:"locale"`
+
+	// MergeStderr writes the guest's stderr to the task's stdout, so both
+	// streams are read in order from one log
+	MergeStderr bool `codec:"merge_stderr"`
+
+	Artifact TaskArtifactConfig `codec:"artifact"`
+
+	// Trace records the calls of the guest's imports to the task's trace
+	// file, alloc/logs/<task>.trace
+	Trace *TaskTraceConfig `codec:"trace"`
+
+	// HostCalls measures the latency of the guest's host calls
+	HostCalls *TaskHostCallsConfig `codec:"host_calls"`
+
+	// Notify posts a summary of the task's exit to a webhook
+	Notify *TaskNotifyConfig `codec:"notify"`
+
+	// Serve runs the module as a server handling the requests received on
+	// a port of the task
+	Serve TaskServeConfig `codec:"serve"`
+
+	// KeyValue enables the keyvalue host functions
+	KeyValue TaskKeyValueConfig `codec:"keyvalue"`
+
+	// Secrets enables the secrets host functions
+	Secrets TaskSecretsConfig `codec:"secrets"`
+
+	// Identity exposes the task's workload identity to the guest
+	Identity TaskIdentityConfig `codec:"identity"`
+
+	// SQL configures the connection pool behind the SQL host functions
+	SQL SQLConfig `codec:"sql"`
+
+	// Mounts preopen host directories for the guest, within the plugin's
+	// allowed_host_paths
+	Mounts []TaskMountConfig `codec:"mount"`
+}
+
+// TaskMountConfig preopens a host directory for the guest
+type TaskMountConfig struct {
+	HostPath  string `codec:"host_path"`
+	GuestPath string `codec:"guest_path"`
+
+	// Readonly bind mounts the directory read-only, as WASI preopens
+	// carry no rights of their own
+	Readonly bool `codec:"readonly"`
+}
+
+// TaskSecretsConfig restricts the Vault paths a task's guest may read, on
+// top of the policies of the task's Vault token
+type TaskSecretsConfig struct {
+	// Paths are path prefixes, such as "secret/data/app/"
+	Paths []string `codec:"paths"`
+}
+
+// TaskIdentityConfig selects how the guest receives the task's Nomad
+// workload identity token
+type TaskIdentityConfig struct {
+	// Env sets the token as NOMAD_TOKEN in the guest's environment
+	Env bool `codec:"env"`
+
+	// File writes the token to /secrets/nomad_token in the guest
+	File bool `codec:"file"`
+}
+
+// TaskWASIConfig configures the WASI environment of the guest
+type TaskWASIConfig struct {
+	// EnvInherit passes the task's environment to the guest, under Env.
+	// It's either a bool inheriting all or nothing, or a list of glob
+	// patterns such as ["APP_*", "LANG"] naming the variables inherited.
+	EnvInherit interface{} `codec:"env_inherit"`
+
+	// EnvAllowlist and EnvDenylist are glob patterns filtering what the
+	// driver sets in the guest's environment: the inherited variables and
+	// those it derives from the task, such as Connect upstreams. Only names
+	// matching the allowlist, if set, and not the denylist are kept. Env is
+	// never filtered. Setting the allowlist without env_inherit inherits
+	// the whole environment before filtering it.
+	EnvAllowlist []string `codec:"env_allowlist"`
+	EnvDenylist  []string `codec:"env_denylist"`
+
+	// Preopens maps guest paths to directories inside the task dir
+	Preopens hclutils.MapStrStr `codec:"preopens"`
+
+	// Capabilities restricts the host interfaces linked for the guest. All
+	// configured interfaces are linked if empty.
+	Capabilities []string `codec:"capabilities"`
+
+	// ClockOffset shifts the guest's wall clock, e.g. "-720h", for testing
+	// time dependent modules. FrozenTime stops its clocks at an RFC 3339
+	// time instead, for deterministic replays. Sleeps aren't affected.
+	ClockOffset string `codec:"clock_offset"`
+	FrozenTime  string `codec:"frozen_time"`
+}
+
+// TaskLimitsConfig bounds the resources a guest may use. Unset limits don't
+// apply.
+type TaskLimitsConfig struct {
+	// Memory caps the guest's linear memory, e.g. "64MiB". It's lowered to
+	// the task's memory resources, if they're lower.
+	Memory string `codec:"memory"`
+
+	// Fuel is the number of fuel units the guest may consume, in each call
+	// for serve tasks
+	Fuel int64 `codec:"fuel"`
+
+	// Deadline is how long the guest may run, e.g. "30s". Serve tasks are
+	// bounded by serve.request_timeout instead.
+	Deadline string `codec:"deadline"`
+
+	// MaxStackSize would cap the stack of the guest's wasm code, e.g.
+	// "512KiB". This version of wasmtime can't apply it, so it's refused.
+	MaxStackSize string `codec:"max_stack_size"`
+
+	// MaxTables is the number of tables the module may declare
+	MaxTables int `codec:"max_tables"`
+
+	// MaxTableElements caps the size of each table the module defines
+	MaxTableElements int64 `codec:"max_table_elements"`
+
+	// MaxInstances is the number of instances of the module the task may
+	// have at once, such as those of a serve task's routes and reloads
+	MaxInstances int `codec:"max_instances"`
+}
+
+// TaskHTTPConfig configures outbound HTTP from the guest
+type TaskHTTPConfig struct {
+	// AllowedHosts are the hosts the guest may connect to. Entries starting
+	// with "*." match any subdomain.
+	AllowedHosts []string `codec:"allowed_hosts"`
+
+	// TaskAPI lets the guest reach the Nomad task API at
+	// http://nomad.task.api, bridged to the task's API socket
+	TaskAPI bool `codec:"task_api"`
+
+	// ClientCert is presented to the servers requesting a client
+	// certificate
+	ClientCert *TaskHTTPClientCertConfig `codec:"client_cert"`
+
+	// Rewrite points the requests to hosts at environment specific
+	// endpoints
+	Rewrite []TaskHTTPRewriteConfig `codec:"rewrite"`
+
+	// Cache caches the responses to GETs, shared by the tasks of the same
+	// job on the node
+	Cache *TaskHTTPCacheConfig `codec:"cache"`
+}
+
+// TaskHTTPCacheConfig bounds the outbound HTTP cache
+type TaskHTTPCacheConfig struct {
+	// MaxSize caps the size of the cached responses, e.g. "16MiB"
+	MaxSize string `codec:"max_size"`
+
+	// TTL is how long responses are cached, less if their max-age is
+	// shorter
+	TTL string `codec:"ttl"`
+}
+
+// TaskHTTPRewriteConfig rewrites the requests to a host, which must still
+// be allowed
+type TaskHTTPRewriteConfig struct {
+	// Host is the hostname the guest requests, e.g. "api.internal", or
+	// host:port to only rewrite the requests to a port
+	Host string `codec:"host"`
+
+	// Address is the host:port connected to instead, e.g. "10.0.0.5:8443"
+	Address string `codec:"address"`
+
+	// SNI is the server name sent in, and verified by, TLS handshakes
+	// instead of the hostname
+	SNI string `codec:"sni"`
+
+	// HostHeader replaces the Host header of the requests
+	HostHeader string `codec:"host_header"`
+}
+
+// TaskHTTPClientCertConfig configures mutual TLS for outbound HTTP. The
+// files are relative to the task dir, typically rendered into secrets/ by a
+// template from Vault's PKI, and reloaded when they change.
+type TaskHTTPClientCertConfig struct {
+	CertFile string `codec:"cert_file"`
+	KeyFile  string `codec:"key_file"`
+
+	// CAFile, if set, replaces the system roots to verify servers
+	CAFile string `codec:"ca_file"`
+}
+
+// TaskArtifactConfig configures how the module artifact is verified
+type TaskArtifactConfig struct {
+	// Checksum is the expected digest of the module, e.g. "sha256:..."
+	Checksum string `codec:"checksum"`
+}
+
+// TaskTraceConfig configures the tracing of a task's host calls
+type TaskTraceConfig struct {
+	// SampleRate is the fraction of the calls recorded, all of them if 0
+	SampleRate float64 `codec:"sample_rate"`
+
+	// MaxFileSize caps the trace file, "10MiB" by default. Calls aren't
+	// recorded anymore once it's reached.
+	MaxFileSize string `codec:"max_file_size"`
+}
+
+// TaskHostCallsConfig configures the latency metrics of a task's host
+// calls, sampled per function as wasmtime.host_call.duration
+type TaskHostCallsConfig struct {
+	// SlowThreshold is the latency above which calls are reported in the
+	// logs and task events, "1s" by default
+	SlowThreshold string `codec:"slow_threshold"`
+}
+
+// TaskNotifyConfig configures the webhook notified of the task's exit
+type TaskNotifyConfig struct {
+	// URL is posted the exit summary as JSON
+	URL string `codec:"url"`
+
+	// Timeout bounds the request, "10s" by default
+	Timeout string `codec:"timeout"`
+}
+
+// TaskServeConfig configures serve mode
+type TaskServeConfig struct {
+	// PortLabel is the label of the port the task listens on, returned as
+	// the task's driver network. Port is its former name.
+	PortLabel string `codec:"port_label"`
+	Port      string `codec:"port"`
+
+	// IdleTimeout is how long the instance is kept without requests, e.g.
+	// "5m". The listener stays open and the next request starts a new
+	// instance. Instances are never unloaded if unset.
+	IdleTimeout string `codec:"idle_timeout"`
+
+	// Warm starts the instance before the port accepts connections, so the
+	// allocation only passes its checks once it answers without a cold
+	// start. Rolling updates gated on the checks then keep the old
+	// allocation serving until the new one is ready.
+	Warm bool `codec:"warm"`
+
+	// MaxRequestBody caps the body of requests, e.g. "1MiB". Larger
+	// requests fail with 413.
+	MaxRequestBody string `codec:"max_request_body"`
+
+	// MaxResponseSize caps the body of responses. Larger responses fail
+	// with 502, or are cut short if the guest already sent their status.
+	MaxResponseSize string `codec:"max_response_size"`
+
+	// MaxHeaderSize caps the request line and headers of requests, 1MiB if
+	// unset. Larger requests fail with 431.
+	MaxHeaderSize string `codec:"max_header_size"`
+
+	// RequestTimeout bounds how long the guest may take to answer a
+	// request, e.g. "30s". Slower requests fail with 504.
+	RequestTimeout string `codec:"request_timeout"`
+
+	// MaxConcurrentRequests caps the requests handled by the guest at once.
+	// Unlimited if unset.
+	MaxConcurrentRequests int `codec:"max_concurrent_requests"`
+
+	// QueueSize is how many requests past MaxConcurrentRequests wait for
+	// one to complete. Others fail with 503.
+	QueueSize int `codec:"queue_size"`
+
+	// QueueTimeout bounds how long requests wait in the queue before failing
+	// with 503, e.g. "1s". They wait for as long as their client if unset.
+	QueueTimeout string `codec:"queue_timeout"`
+
+	// Routes dispatch the requests under URL path prefixes to other
+	// modules, relative to the task dir, or other exports of the task's
+	// module, e.g. {"/api" = "api.wasm", "/admin" = "handle_admin"}.
+	// Requests matching no route go to the task's module.
+	Routes hclutils.MapStrStr `codec:"routes"`
+
+	// WebSocket bridges WebSocket connections to the guest's websocket
+	// export, each with an instance of its own. MaxRequestBody caps their
+	// messages, the other limits don't apply to them.
+	WebSocket bool `codec:"websocket"`
+
+	// StaticDir is the guest path of a preopen whose files are served by
+	// the driver itself, without involving the guest, for the requests
+	// under StaticPrefixes, e.g. a single page app bundled with the API
+	// handled by the guest. Missing files are answered with 404.
+	StaticDir      string   `codec:"static_dir"`
+	StaticPrefixes []string `codec:"static_prefixes"`
+
+	// ReloadFile is a JSON file, relative to the task dir, re-read when the
+	// task receives SIGHUP. Its max_concurrent_requests, queue_size,
+	// queue_timeout, request_timeout, max_request_body, max_response_size
+	// and allowed_hosts override those of the task config, without
+	// restarting the listener.
+	ReloadFile string `codec:"reload_file"`
+
+	// AccessLog logs the requests of the task, if set
+	AccessLog *TaskServeAccessLogConfig `codec:"access_log"`
+}
+
+// TaskServeAccessLogConfig configures the access log of a serve task
+type TaskServeAccessLogConfig struct {
+	// Format is "common", the Common Log Format followed by the request's
+	// latency and whether it hit a cold instance, or "json"
+	Format string `codec:"format"`
+
+	// Path is the file the log is written to, relative to the task dir. It
+	// goes to the task's stdout if unset.
+	Path string `codec:"path"`
+}
+
+// TaskKeyValueConfig selects the backend of a task's keyvalue host functions
+type TaskKeyValueConfig struct {
+	// Backend is either "consul" or "redis"
+	Backend string `codec:"backend"`
+}
+
+// SQLConfig configures the database a task's SQL host functions connect to
+type SQLConfig struct {
+	// Driver is either "postgres" or "mysql"
+	Driver string `codec:"driver"`
+
+	// DSN is the data source name. DSNFile may be used instead to read it
+	// from a file, such as one rendered from Vault by a template block.
+	DSN     string `codec:"dsn"`
+	DSNFile string `codec:"dsn_file"`
+
+	MaxOpenConns     int    `codec:"max_open_conns"`
+	StatementTimeout string `codec:"statement_timeout"`
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/hashicorp/nomad/helper/pluginutils/hclspecutils"
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/hashicorp/nomad/plugins/base"
+	"github.com/hashicorp/nomad/plugins/shared/hclspec"
+	"github.com/zclconf/go-cty/cty/msgpack"
+)
+
+// NewConfig returns the plugin config with the defaults of ConfigSpec
+func NewConfig() *Config {
+	c, err := DecodeConfig(map[string]interface{}{})
+	if err != nil {
+		panic(fmt.Sprintf("invalid plugin config defaults: %v", err))
+	}
+	return c
+}
+
+// NewTaskConfig returns the config of a task running the module file, with
+// the defaults of TaskConfigSpec
+func NewTaskConfig(file string) *TaskConfig {
+	c, err := DecodeTaskConfig(map[string]interface{}{})
+	if err != nil {
+		panic(fmt.Sprintf("invalid task config defaults: %v", err))
+	}
+	c.File = file
+	return c
+}
+
+// DecodeConfig parses raw, the config block of a plugin "wasmtime" stanza
+// decoded from HCL or JSON, the way the agent does. Strings aren't
+// interpolated.
+func DecodeConfig(raw map[string]interface{}) (*Config, error) {
+	var c Config
+	if err := decodeSpec(raw, ConfigSpec, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// DecodeTaskConfig parses raw, the config of a task such as the Config of a
+// nomad/api Task, the way the client does when the task starts. Strings
+// aren't interpolated, so they must not reference the task's environment.
+func DecodeTaskConfig(raw map[string]interface{}) (*TaskConfig, error) {
+	var c TaskConfig
+	if err := decodeSpec(raw, TaskConfigSpec, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// decodeSpec parses raw with spec into out
+func decodeSpec(raw map[string]interface{}, spec *hclspec.Spec, out interface{}) error {
+	s, diags := hclspecutils.Convert(spec)
+	if diags.HasErrors() {
+		return diags
+	}
+	val, diags, errs := hclutils.ParseHclInterface(raw, s, nil)
+	if diags.HasErrors() {
+		return diags
+	}
+	if len(errs) != 0 {
+		return errs[0]
+	}
+
+	data, err := msgpack.Marshal(val, val.Type())
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %v", err)
+	}
+	if err := base.MsgPackDecode(data, out); err != nil {
+		return fmt.Errorf("failed to decode config: %v", err)
+	}
+	return nil
+}
+
+// Map returns the plugin config as the config block of a plugin "wasmtime"
+// stanza. Unset fields and blocks are left out, so they get the defaults of
+// ConfigSpec, but the ones whose default isn't their zero value are always
+// set: build configs from NewConfig.
+func (c *Config) Map() map[string]interface{} {
+	return encodeObject(reflect.ValueOf(c).Elem(), ConfigSpec, false)
+}
+
+// Validate checks the plugin config against ConfigSpec. The driver checks
+// the values themselves when it's configured.
+func (c *Config) Validate() error {
+	_, err := DecodeConfig(encodeObject(reflect.ValueOf(c).Elem(), ConfigSpec, true))
+	return err
+}
+
+// Map returns the task config as the config of a task, such as the Config
+// of a nomad/api Task. Unset fields and blocks are left out, so they get the
+// defaults of TaskConfigSpec, but the ones whose default isn't their zero
+// value are always set: build configs from NewTaskConfig.
+func (c *TaskConfig) Map() map[string]interface{} {
+	return encodeObject(reflect.ValueOf(c).Elem(), TaskConfigSpec, false)
+}
+
+// Validate checks the task config against TaskConfigSpec, the way the
+// client parses it, without interpolating its strings. The driver checks
+// the values themselves when the task starts.
+func (c *TaskConfig) Validate() error {
+	_, err := DecodeTaskConfig(encodeObject(reflect.ValueOf(c).Elem(), TaskConfigSpec, true))
+	return err
+}
+
+// encodeObject returns the fields of the struct v with an attribute or block
+// in the object spec, by their codec tag. Strings are escaped from
+// interpolation if escape is set.
+func encodeObject(v reflect.Value, spec *hclspec.Spec, escape bool) map[string]interface{} {
+	attrs := spec.GetObject().GetAttributes()
+	m := map[string]interface{}{}
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("codec")
+		if s, ok := attrs[name]; ok {
+			if value, ok := encodeField(v.Field(i), s, escape); ok {
+				m[name] = value
+			}
+		}
+	}
+	return m
+}
+
+// encodeField returns the value of the field v with spec, and whether it's
+// set. Zero values are unset unless the spec defaults to something else,
+// which for a block is any default.
+func encodeField(v reflect.Value, spec *hclspec.Spec, escape bool) (interface{}, bool) {
+	zeroDefault := true
+	if d := spec.GetDefault(); d != nil {
+		switch d.GetDefault().GetLiteral().GetValue() {
+		case "false", "0", `""`:
+		default:
+			zeroDefault = false
+		}
+		spec = d.GetPrimary()
+	}
+
+	switch {
+	case spec.GetAttr() != nil:
+		if v.IsZero() && (zeroDefault || v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+			return nil, false
+		}
+		value := encodeValue(v, escape)
+		if strings.HasPrefix(spec.GetAttr().GetType(), "list(") && v.Kind() == reflect.Map {
+			value = []interface{}{value}
+		}
+		return value, true
+	case spec.GetBlockValue() != nil:
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return nil, false
+			}
+			v = v.Elem()
+		} else if v.IsZero() && zeroDefault {
+			return nil, false
+		}
+		return encodeObject(v, spec.GetBlockValue().GetNested(), escape), true
+	case spec.GetBlockList() != nil:
+		if v.Len() == 0 {
+			return nil, false
+		}
+		blocks := make([]interface{}, v.Len())
+		for i := range blocks {
+			blocks[i] = encodeObject(reflect.Indirect(v.Index(i)), spec.GetBlockList().GetNested(), escape)
+		}
+		return blocks, true
+	case spec.GetBlockMap() != nil:
+		if v.Len() == 0 {
+			return nil, false
+		}
+		blocks := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			blocks[iter.Key().String()] = encodeObject(reflect.Indirect(iter.Value()), spec.GetBlockMap().GetNested(), escape)
+		}
+		return blocks, true
+	}
+	return nil, false
+}
+
+// encodeValue returns the attribute value v as plain strings, numbers,
+// bools, lists and maps
+func encodeValue(v reflect.Value, escape bool) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return encodeValue(v.Elem(), escape)
+	case reflect.String:
+		s := v.String()
+		if escape {
+			s = strings.NewReplacer("${", "$${", "%{", "%%{").Replace(s)
+		}
+		return s
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = encodeValue(v.Index(i), escape)
+		}
+		return list
+	case reflect.Map:
+		m := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			m[fmt.Sprint(iter.Key().Interface())] = encodeValue(iter.Value(), escape)
+		}
+		return m
+	}
+	return v.Interface()
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTaskConfig(t *testing.T) {
+	c := NewTaskConfig("main.wasm")
+	require.Equal(t, "main.wasm", c.File)
+	require.Equal(t, "auto", c.Compiler.Strategy)
+	require.True(t, c.Compiler.Cache)
+	require.Equal(t, OptLevelSpeed, c.Compiler.CraneLiftOptions.OptLevel)
+	require.NoError(t, c.Validate())
+
+	decoded, err := DecodeTaskConfig(c.Map())
+	require.NoError(t, err)
+	require.Equal(t, c, decoded)
+}
+
+func TestTaskConfig_Map(t *testing.T) {
+	c := NewTaskConfig("${NOMAD_TASK_DIR}/main.wasm")
+	c.Args = []string{"-v"}
+	c.Env = hclutils.MapStrStr{"LOG_LEVEL": "debug"}
+	c.CallArgs = []interface{}{"a", true}
+	c.Compiler.Cache = false
+	c.Compiler.CraneLiftOptions.OptLevel = OptLevelNone
+	c.Limits = TaskLimitsConfig{Memory: "64MiB", MaxInstances: 2}
+	c.Serve = TaskServeConfig{PortLabel: "http", AccessLog: &TaskServeAccessLogConfig{}}
+	c.Trace = &TaskTraceConfig{}
+	c.Mounts = []TaskMountConfig{{HostPath: "/srv", GuestPath: "/data", Readonly: true}}
+
+	m := c.Map()
+	require.Equal(t, []interface{}{map[string]interface{}{"LOG_LEVEL": "debug"}}, m["env"])
+	require.Equal(t, map[string]interface{}{"memory": "64MiB", "max_instances": 2}, m["limits"])
+	require.Equal(t, map[string]interface{}{"port_label": "http", "access_log": map[string]interface{}{}}, m["serve"])
+	require.NotContains(t, m, "sql")
+
+	// the compiler settings differing from their defaults are kept
+	compiler := m["compiler"].(map[string]interface{})
+	require.Equal(t, false, compiler["cache"])
+	require.Equal(t, map[string]interface{}{"optimize": OptLevelNone}, compiler["cranelift_options"])
+
+	// the map decodes back to the same config, interpolations left as is
+	decoded, err := DecodeTaskConfig(map[string]interface{}{"file": "main.wasm"})
+	require.NoError(t, err)
+	require.Equal(t, OptLevelSpeed, decoded.Compiler.CraneLiftOptions.OptLevel)
+	m["file"] = "main.wasm"
+	decoded, err = DecodeTaskConfig(m)
+	require.NoError(t, err)
+	c.File = "main.wasm"
+	require.Equal(t, c, decoded)
+}
+
+func TestTaskConfig_Validate(t *testing.T) {
+	c := NewTaskConfig("${NOMAD_TASK_DIR}/main.wasm")
+	require.NoError(t, c.Validate())
+
+	// the sql block requires a driver
+	c.SQL = SQLConfig{DSN: "postgres://db"}
+	require.Error(t, c.Validate())
+	c.SQL.Driver = "postgres"
+	require.NoError(t, c.Validate())
+
+	_, err := DecodeTaskConfig(map[string]interface{}{"file": 1, "limits": "lots"})
+	require.Error(t, err)
+}
+
+func TestConfig_Map(t *testing.T) {
+	c := NewConfig()
+	require.True(t, c.Compiler.Cache)
+	require.NoError(t, c.Validate())
+
+	c.NamespaceQuotas = map[string]NamespaceQuotaConfig{"*": {MaxInstances: 10}, "batch": {Cache: "1GiB"}}
+	c.Compiler.AllowPrecompiled = true
+	m := c.Map()
+	require.Equal(t, map[string]interface{}{
+		"*":     map[string]interface{}{"max_instances": 10},
+		"batch": map[string]interface{}{"cache": "1GiB"},
+	}, m["namespace_quota"])
+	require.NoError(t, c.Validate())
+
+	decoded, err := DecodeConfig(m)
+	require.NoError(t, err)
+	require.Equal(t, c, decoded)
+}
@@ -0,0 +1,416 @@
+package api
+
+import "github.com/hashicorp/nomad/plugins/shared/hclspec"
+
+var (
+	// ConfigSpec is the specification of the plugin's configuration
+	// this is used to validate the configuration specified for the plugin
+	// on the client.
+	// this is not global, but can be specified on a per-client basis.
+	ConfigSpec = hclspec.NewObject(map[string]*hclspec.Spec{
+		// The schema should be defined using HCL specs and it will be used to
+		// validate the agent configuration provided by the user in the
+		// `plugin` stanza (https://www.nomadproject.io/docs/configuration/plugin.html).
+		//
+		// For example, for the schema below a valid configuration would be:
+		//
+		//   plugin "wasmtime" {
+		//     config {
+		//       compiler = "cranelift"
+		//		 profiler = "vtune"
+		//     }
+		//   }
+		"mount_timeout": hclspec.NewDefault(
+			hclspec.NewAttr("mount_timeout", "string", false),
+			hclspec.NewLiteral(`"30s"`),
+		),
+		"data_dir":  hclspec.NewAttr("data_dir", "string", false),
+		"log_level": hclspec.NewAttr("log_level", "string", false),
+		"execution_mode": hclspec.NewDefault(
+			hclspec.NewAttr("execution_mode", "string", false),
+			hclspec.NewLiteral(`"in_process"`),
+		),
+		"stats_min_interval": hclspec.NewDefault(
+			hclspec.NewAttr("stats_min_interval", "string", false),
+			hclspec.NewLiteral(`"1s"`),
+		),
+		"artifact_retention": hclspec.NewDefault(
+			hclspec.NewAttr("artifact_retention", "string", false),
+			hclspec.NewLiteral(`"1h"`),
+		),
+		"max_concurrent_downloads": hclspec.NewDefault(
+			hclspec.NewAttr("max_concurrent_downloads", "number", false),
+			hclspec.NewLiteral(`3`),
+		),
+		"download_bandwidth_limit": hclspec.NewAttr("download_bandwidth_limit", "string", false),
+		"proxy": hclspec.NewBlock("proxy", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"http_proxy":  hclspec.NewAttr("http_proxy", "string", false),
+			"https_proxy": hclspec.NewAttr("https_proxy", "string", false),
+			"no_proxy":    hclspec.NewAttr("no_proxy", "string", false),
+		})),
+		"audit": hclspec.NewBlock("audit", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"file":            hclspec.NewAttr("file", "string", false),
+			"syslog":          hclspec.NewAttr("syslog", "bool", false),
+			"syslog_facility": hclspec.NewAttr("syslog_facility", "string", false),
+		})),
+		"crypto": hclspec.NewBlock("crypto", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"enabled":            hclspec.NewAttr("enabled", "bool", false),
+			"allowed_algorithms": hclspec.NewAttr("allowed_algorithms", "list(string)", false),
+			"fips_only":          hclspec.NewAttr("fips_only", "bool", false),
+		})),
+		"max_decompressed_size": hclspec.NewDefault(
+			hclspec.NewAttr("max_decompressed_size", "string", false),
+			hclspec.NewLiteral(`"256MiB"`),
+		),
+		"compiled_code_budget": hclspec.NewAttr("compiled_code_budget", "string", false),
+		"max_instances":        hclspec.NewAttr("max_instances", "number", false),
+		"strict_imports":       hclspec.NewAttr("strict_imports", "bool", false),
+		"strict_forecast":      hclspec.NewAttr("strict_forecast", "bool", false),
+		"allowed_imports":      hclspec.NewAttr("allowed_imports", "list(string)", false),
+		"allowed_host_paths":   hclspec.NewAttr("allowed_host_paths", "list(string)", false),
+		"read_only":            hclspec.NewAttr("read_only", "bool", false),
+		"blobstore": hclspec.NewBlock("blobstore", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"endpoint":   hclspec.NewAttr("endpoint", "string", false),
+			"region":     hclspec.NewAttr("region", "string", false),
+			"bucket":     hclspec.NewAttr("bucket", "string", true),
+			"access_key": hclspec.NewAttr("access_key", "string", false),
+			"secret_key": hclspec.NewAttr("secret_key", "string", false),
+			"path_style": hclspec.NewAttr("path_style", "bool", false),
+		})),
+		"messaging": hclspec.NewBlock("messaging", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"servers":          hclspec.NewAttr("servers", "list(string)", true),
+			"credentials_file": hclspec.NewAttr("credentials_file", "string", false),
+			"token":            hclspec.NewAttr("token", "string", false),
+			"username":         hclspec.NewAttr("username", "string", false),
+			"password":         hclspec.NewAttr("password", "string", false),
+		})),
+		"limits": hclspec.NewBlock("limits", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"memory":             hclspec.NewAttr("memory", "string", false),
+			"fuel":               hclspec.NewAttr("fuel", "number", false),
+			"deadline":           hclspec.NewAttr("deadline", "string", false),
+			"max_stack_size":     hclspec.NewAttr("max_stack_size", "string", false),
+			"max_tables":         hclspec.NewAttr("max_tables", "number", false),
+			"max_table_elements": hclspec.NewAttr("max_table_elements", "number", false),
+			"max_instances":      hclspec.NewAttr("max_instances", "number", false),
+		})),
+		"capabilities": hclspec.NewAttr("capabilities", "list(string)", false),
+		"compiler": hclspec.NewDefault(
+			hclspec.NewBlock("compiler", false, hclspec.NewObject(map[string]*hclspec.Spec{
+				"strategy": hclspec.NewAttr("strategy", "string", false),
+				"cache": hclspec.NewDefault(
+					hclspec.NewAttr("cache", "bool", false),
+					hclspec.NewLiteral("true"),
+				),
+				"allow_precompiled": hclspec.NewAttr("allow_precompiled", "bool", false),
+				"features":          hclspec.NewAttr("features", "list(string)", false),
+			})),
+			hclspec.NewLiteral(`{
+				cache: true,
+			}`),
+		),
+		"status": hclspec.NewBlock("status", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"address": hclspec.NewAttr("address", "string", true),
+		})),
+		"pprof": hclspec.NewBlock("pprof", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"address": hclspec.NewAttr("address", "string", true),
+		})),
+		"registry_cache": hclspec.NewBlock("registry_cache", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"address": hclspec.NewAttr("address", "string", false),
+			"peers":   hclspec.NewAttr("peers", "list(string)", false),
+		})),
+		"runner": hclspec.NewBlock("runner", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"allow_new_privileges":      hclspec.NewAttr("allow_new_privileges", "bool", false),
+			"keep_inherited_fds":        hclspec.NewAttr("keep_inherited_fds", "bool", false),
+			"keep_ambient_capabilities": hclspec.NewAttr("keep_ambient_capabilities", "bool", false),
+			"umask":                     hclspec.NewAttr("umask", "string", false),
+		})),
+		"leak_detection": hclspec.NewDefault(
+			hclspec.NewBlock("leak_detection", false, hclspec.NewObject(map[string]*hclspec.Spec{
+				"interval": hclspec.NewDefault(
+					hclspec.NewAttr("interval", "string", false),
+					hclspec.NewLiteral(`"5m"`),
+				),
+				"force_close": hclspec.NewAttr("force_close", "bool", false),
+			})),
+			hclspec.NewLiteral(`{
+				interval: "5m",
+				force_close: false,
+			}`),
+		),
+		"epoch": hclspec.NewBlock("epoch", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"interval": hclspec.NewDefault(
+				hclspec.NewAttr("interval", "string", false),
+				hclspec.NewLiteral(`"10ms"`),
+			),
+			"call_deadline": hclspec.NewAttr("call_deadline", "string", false),
+		})),
+		"namespace_quota": hclspec.NewBlockMap("namespace_quota", []string{"namespace"}, hclspec.NewObject(map[string]*hclspec.Spec{
+			"max_instances": hclspec.NewAttr("max_instances", "number", false),
+			"compiled_code": hclspec.NewAttr("compiled_code", "string", false),
+			"cache":         hclspec.NewAttr("cache", "string", false),
+			"bandwidth":     hclspec.NewAttr("bandwidth", "string", false),
+		})),
+		"cpu_fuel": hclspec.NewBlock("cpu_fuel", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"fuel_per_mhz": hclspec.NewAttr("fuel_per_mhz", "number", true),
+			"burst": hclspec.NewDefault(
+				hclspec.NewAttr("burst", "string", false),
+				hclspec.NewLiteral(`"1s"`),
+			),
+			"on_exhaustion": hclspec.NewDefault(
+				hclspec.NewAttr("on_exhaustion", "string", false),
+				hclspec.NewLiteral(`"kill"`),
+			),
+		})),
+		"quarantine": hclspec.NewBlock("quarantine", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"failures": hclspec.NewAttr("failures", "number", false),
+			"window":   hclspec.NewAttr("window", "string", false),
+			"cooldown": hclspec.NewAttr("cooldown", "string", false),
+		})),
+		"debug_retention": hclspec.NewBlock("debug_retention", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"max_count": hclspec.NewAttr("max_count", "number", false),
+			"max_size":  hclspec.NewAttr("max_size", "string", false),
+			"max_age":   hclspec.NewAttr("max_age", "string", false),
+		})),
+		"logging": hclspec.NewBlock("logging", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"disable_collection": hclspec.NewAttr("disable_collection", "bool", false),
+			"stream_dir":         hclspec.NewAttr("stream_dir", "string", false),
+		})),
+		"memory_pressure": hclspec.NewBlock("memory_pressure", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"watermark": hclspec.NewAttr("watermark", "number", true),
+			"interval": hclspec.NewDefault(
+				hclspec.NewAttr("interval", "string", false),
+				hclspec.NewLiteral(`"30s"`),
+			),
+		})),
+		"vault": hclspec.NewBlock("vault", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"address":   hclspec.NewAttr("address", "string", false),
+			"ca_cert":   hclspec.NewAttr("ca_cert", "string", false),
+			"namespace": hclspec.NewAttr("namespace", "string", false),
+			"cache_ttl": hclspec.NewAttr("cache_ttl", "string", false),
+		})),
+		"keyvalue": hclspec.NewBlock("keyvalue", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"consul": hclspec.NewBlock("consul", false, hclspec.NewObject(map[string]*hclspec.Spec{
+				"address": hclspec.NewAttr("address", "string", false),
+				"token":   hclspec.NewAttr("token", "string", false),
+			})),
+			"redis": hclspec.NewBlock("redis", false, hclspec.NewObject(map[string]*hclspec.Spec{
+				"address":     hclspec.NewAttr("address", "string", true),
+				"username":    hclspec.NewAttr("username", "string", false),
+				"password":    hclspec.NewAttr("password", "string", false),
+				"db":          hclspec.NewAttr("db", "number", false),
+				"tls":         hclspec.NewAttr("tls", "bool", false),
+				"tls_ca_file": hclspec.NewAttr("tls_ca_file", "string", false),
+			})),
+		})),
+	})
+
+	// TaskConfigSpec is the specification of the plugin's configuration for
+	// a task
+	// this is used to validated the configuration specified for the plugin
+	// when a job is submitted.
+	TaskConfigSpec = hclspec.NewObject(map[string]*hclspec.Spec{
+		"file":  hclspec.NewAttr("file", "string", false),
+		"image": hclspec.NewAttr("image", "string", false),
+		"image_path": hclspec.NewDefault(
+			hclspec.NewAttr("image_path", "string", false),
+			hclspec.NewLiteral(`"/app.wasm"`),
+		),
+		"args":               hclspec.NewAttr("args", "list(string)", false),
+		"env":                hclspec.NewAttr("env", "list(map(string))", false),
+		"stdin":              hclspec.NewAttr("stdin", "string", false),
+		"entrypoint":         hclspec.NewAttr("entrypoint", "string", false),
+		"call_args":          hclspec.NewAttr("call_args", "any", false),
+		"main_loop":          hclspec.NewAttr("main_loop", "string", false),
+		"depends_on":         hclspec.NewAttr("depends_on", "list(string)", false),
+		"depends_on_timeout": hclspec.NewAttr("depends_on_timeout", "string", false),
+		"ulimit":             hclspec.NewAttr("ulimit", "list(map(string))", false),
+		"log_level":          hclspec.NewAttr("log_level", "string", false),
+		"wasi": hclspec.NewBlock("wasi", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"env_inherit":   hclspec.NewAttr("env_inherit", "any", false),
+			"env_allowlist": hclspec.NewAttr("env_allowlist", "list(string)", false),
+			"env_denylist":  hclspec.NewAttr("env_denylist", "list(string)", false),
+			"preopens":      hclspec.NewAttr("preopens", "list(map(string))", false),
+			"capabilities":  hclspec.NewAttr("capabilities", "list(string)", false),
+			"clock_offset":  hclspec.NewAttr("clock_offset", "string", false),
+			"frozen_time":   hclspec.NewAttr("frozen_time", "string", false),
+		})),
+		"limits": hclspec.NewBlock("limits", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"memory":             hclspec.NewAttr("memory", "string", false),
+			"fuel":               hclspec.NewAttr("fuel", "number", false),
+			"deadline":           hclspec.NewAttr("deadline", "string", false),
+			"max_stack_size":     hclspec.NewAttr("max_stack_size", "string", false),
+			"max_tables":         hclspec.NewAttr("max_tables", "number", false),
+			"max_table_elements": hclspec.NewAttr("max_table_elements", "number", false),
+			"max_instances":      hclspec.NewAttr("max_instances", "number", false),
+		})),
+		"preallocate_memory": hclspec.NewAttr("preallocate_memory", "bool", false),
+		"timezone":           hclspec.NewAttr("timezone", "string", false),
+		"locale":             hclspec.NewAttr("locale", "string", false),
+		"merge_stderr":       hclspec.NewAttr("merge_stderr", "bool", false),
+		"http": hclspec.NewBlock("http", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"allowed_hosts": hclspec.NewAttr("allowed_hosts", "list(string)", false),
+			"task_api":      hclspec.NewAttr("task_api", "bool", false),
+			"client_cert": hclspec.NewBlock("client_cert", false, hclspec.NewObject(map[string]*hclspec.Spec{
+				"cert_file": hclspec.NewAttr("cert_file", "string", true),
+				"key_file":  hclspec.NewAttr("key_file", "string", true),
+				"ca_file":   hclspec.NewAttr("ca_file", "string", false),
+			})),
+			"cache": hclspec.NewBlock("cache", false, hclspec.NewObject(map[string]*hclspec.Spec{
+				"max_size": hclspec.NewDefault(
+					hclspec.NewAttr("max_size", "string", false),
+					hclspec.NewLiteral(`"16MiB"`),
+				),
+				"ttl": hclspec.NewDefault(
+					hclspec.NewAttr("ttl", "string", false),
+					hclspec.NewLiteral(`"30s"`),
+				),
+			})),
+			"rewrite": hclspec.NewBlockList("rewrite", hclspec.NewObject(map[string]*hclspec.Spec{
+				"host":        hclspec.NewAttr("host", "string", true),
+				"address":     hclspec.NewAttr("address", "string", false),
+				"sni":         hclspec.NewAttr("sni", "string", false),
+				"host_header": hclspec.NewAttr("host_header", "string", false),
+			})),
+		})),
+		"artifact": hclspec.NewBlock("artifact", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"checksum": hclspec.NewAttr("checksum", "string", false),
+		})),
+		"host_calls": hclspec.NewBlock("host_calls", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"slow_threshold": hclspec.NewAttr("slow_threshold", "string", false),
+		})),
+		"trace": hclspec.NewBlock("trace", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"sample_rate":   hclspec.NewAttr("sample_rate", "number", false),
+			"max_file_size": hclspec.NewAttr("max_file_size", "string", false),
+		})),
+		"notify": hclspec.NewBlock("notify", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"url":     hclspec.NewAttr("url", "string", true),
+			"timeout": hclspec.NewAttr("timeout", "string", false),
+		})),
+		"serve": hclspec.NewBlock("serve", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"port":                    hclspec.NewAttr("port", "string", false),
+			"port_label":              hclspec.NewAttr("port_label", "string", false),
+			"idle_timeout":            hclspec.NewAttr("idle_timeout", "string", false),
+			"warm":                    hclspec.NewAttr("warm", "bool", false),
+			"max_request_body":        hclspec.NewAttr("max_request_body", "string", false),
+			"max_response_size":       hclspec.NewAttr("max_response_size", "string", false),
+			"max_header_size":         hclspec.NewAttr("max_header_size", "string", false),
+			"request_timeout":         hclspec.NewAttr("request_timeout", "string", false),
+			"max_concurrent_requests": hclspec.NewAttr("max_concurrent_requests", "number", false),
+			"queue_size":              hclspec.NewAttr("queue_size", "number", false),
+			"queue_timeout":           hclspec.NewAttr("queue_timeout", "string", false),
+			"routes":                  hclspec.NewAttr("routes", "list(map(string))", false),
+			"websocket":               hclspec.NewAttr("websocket", "bool", false),
+			"reload_file":             hclspec.NewAttr("reload_file", "string", false),
+			"static_dir":              hclspec.NewAttr("static_dir", "string", false),
+			"static_prefixes":         hclspec.NewAttr("static_prefixes", "list(string)", false),
+			"access_log": hclspec.NewBlock("access_log", false, hclspec.NewObject(map[string]*hclspec.Spec{
+				"format": hclspec.NewAttr("format", "string", false),
+				"path":   hclspec.NewAttr("path", "string", false),
+			})),
+		})),
+		"compiler": hclspec.NewDefault(
+			hclspec.NewBlock("compiler", false, hclspec.NewObject(map[string]*hclspec.Spec{
+				"strategy": hclspec.NewAttr("strategy", "string", false),
+				"cranelift_options": hclspec.NewDefault(hclspec.NewBlock("cranelift_options", false, hclspec.NewObject(map[string]*hclspec.Spec{
+					"debug_verifier": hclspec.NewDefault(
+						hclspec.NewAttr("debug_verifier", "bool", false),
+						hclspec.NewLiteral(`false`),
+					),
+					"optimize": hclspec.NewDefault(
+						hclspec.NewAttr("optimize", "number", false),
+						hclspec.NewLiteral(`1`),
+					),
+					"nan_canonicalization": hclspec.NewDefault(
+						hclspec.NewAttr("nan_canonicalization", "bool", false),
+						hclspec.NewLiteral(`false`),
+					),
+				})),
+					hclspec.NewLiteral(`{
+						optimize: 1,
+						debug_verifier: false,
+						nan_canonicalization: false,
+					}`),
+				),
+				//"debug": hclspec.NewDefault(
+				//	hclspec.NewAttr("default", "bool", false),
+				//	hclspec.NewLiteral("false"),
+				//),
+				"cache": hclspec.NewDefault(
+					hclspec.NewAttr("cache", "bool", false),
+					hclspec.NewLiteral("true"),
+				),
+				//"simd": hclspec.NewDefault(
+				//	hclspec.NewAttr("simd", "bool", false),
+				//	hclspec.NewLiteral("false"),
+				//),
+				//"reference_types": hclspec.NewDefault(
+				//	hclspec.NewAttr("reference_types", "bool", false),
+				//	hclspec.NewLiteral("false"),
+				//),
+				//"multi_value": hclspec.NewDefault(
+				//	hclspec.NewAttr("multi_value", "bool", false),
+				//	hclspec.NewLiteral("false"),
+				//),
+				//"threads": hclspec.NewDefault(
+				//	hclspec.NewAttr("threads", "bool", false),
+				//	hclspec.NewLiteral("false"),
+				//),
+				//"bulk_memory": hclspec.NewDefault(
+				//	hclspec.NewAttr("bulk_memory", "bool", false),
+				//	hclspec.NewLiteral("false"),
+				//),
+				//"multi_memory": hclspec.NewDefault(
+				//	hclspec.NewAttr("multi_memory", "bool", false),
+				//	hclspec.NewLiteral("false"),
+				//),
+			})),
+			hclspec.NewLiteral(`{
+				strategy: "auto",
+				cache: true,
+				cranelift_options: {
+					optimize: 1,
+					debug_verifier: false,
+					nan_canonicalization: false,
+				},
+			}`),
+		),
+		"profiler": hclspec.NewDefault(
+			hclspec.NewAttr("profiler", "string", false),
+			hclspec.NewLiteral(`"none"`),
+		),
+		"keyvalue": hclspec.NewBlock("keyvalue", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"backend": hclspec.NewDefault(
+				hclspec.NewAttr("backend", "string", false),
+				hclspec.NewLiteral(`"consul"`),
+			),
+		})),
+		"secrets": hclspec.NewBlock("secrets", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"paths": hclspec.NewAttr("paths", "list(string)", true),
+		})),
+		"identity": hclspec.NewBlock("identity", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"env":  hclspec.NewAttr("env", "bool", false),
+			"file": hclspec.NewAttr("file", "bool", false),
+		})),
+		"sql": hclspec.NewBlock("sql", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"driver":   hclspec.NewAttr("driver", "string", true),
+			"dsn":      hclspec.NewAttr("dsn", "string", false),
+			"dsn_file": hclspec.NewAttr("dsn_file", "string", false),
+			"max_open_conns": hclspec.NewDefault(
+				hclspec.NewAttr("max_open_conns", "number", false),
+				hclspec.NewLiteral(`4`),
+			),
+			"statement_timeout": hclspec.NewDefault(
+				hclspec.NewAttr("statement_timeout", "string", false),
+				hclspec.NewLiteral(`"30s"`),
+			),
+		})),
+		"mount": hclspec.NewBlockList("mount", hclspec.NewObject(map[string]*hclspec.Spec{
+			"host_path":  hclspec.NewAttr("host_path", "string", true),
+			"guest_path": hclspec.NewAttr("guest_path", "string", true),
+			"readonly": hclspec.NewDefault(
+				hclspec.NewAttr("readonly", "bool", false),
+				hclspec.NewLiteral(`false`),
+			),
+		})),
+	})
+)
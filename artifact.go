@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// defaultMaxDecompressedSize is used when the plugin config doesn't set
+	// max_decompressed_size
+	defaultMaxDecompressedSize = 256 << 20
+
+	// imagePullTimeout bounds how long extracting a module from a container
+	// image may take
+	imagePullTimeout = 5 * time.Minute
+)
+
+var (
+	// wasmMagic is the preamble of every binary WebAssembly module
+	wasmMagic = []byte{0x00, 'a', 's', 'm'}
+
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// moduleSource is what pulling modules depends on in the plugin config, as
+// of when a task started, so modules are pulled without holding configLock
+type moduleSource struct {
+	artifacts           *artifactStore
+	httpClient          *http.Client
+	downloads           *downloadLimiter
+	peers               []*url.URL
+	maxDecompressedSize int64
+}
+
+// moduleSource returns the current moduleSource. configLock must be held.
+func (d *Driver) moduleSource() *moduleSource {
+	return &moduleSource{
+		artifacts:           d.artifacts,
+		httpClient:          d.httpClient,
+		downloads:           d.downloads,
+		peers:               d.registryPeers,
+		maxDecompressedSize: d.maxDecompressedSize,
+	}
+}
+
+// loadModule returns the module bytes for a task, either read from the
+// task's `file` or extracted from the container image given by `image`.
+func (d *Driver) loadModule(src *moduleSource, cfg *drivers.TaskConfig, driverConfig *TaskConfig) ([]byte, error) {
+	switch {
+	case driverConfig.File != "" && driverConfig.Image != "":
+		return nil, fmt.Errorf("only one of file or image may be set")
+	case driverConfig.File != "":
+		return readArtifact(resolveArtifactPath(cfg.TaskDir().Dir, driverConfig.File), src.maxDecompressedSize)
+	case driverConfig.Image != "":
+		source, pinned := imageSource(driverConfig.Image, driverConfig.ImagePath)
+		if pinned {
+			if b, ok := src.artifacts.Cached(source); ok {
+				return b, nil
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(d.ctx, imagePullTimeout)
+		defer cancel()
+
+		// another node may have pulled the image already
+		if pinned {
+			if b, ok := d.fetchFromPeers(ctx, src, source); ok {
+				if err := src.artifacts.Remember(source, b); err != nil {
+					d.logger.Warn("failed to cache pulled module", "image", driverConfig.Image, "error", err)
+				}
+				return b, nil
+			}
+		}
+
+		b, err := newRegistryClient(src.httpClient, src.downloads).extractImageFile(ctx, driverConfig.Image, driverConfig.ImagePath, src.maxDecompressedSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pull module from image: %v", err)
+		}
+		if pinned {
+			if err := src.artifacts.Remember(source, b); err != nil {
+				d.logger.Warn("failed to cache pulled module", "image", driverConfig.Image, "error", err)
+			}
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("one of file or image is required")
+	}
+}
+
+// resolveArtifactPath returns the host path of the module referenced by the
+// task's `file` attribute. Relative paths are resolved against the task dir,
+// which is where Nomad places downloaded artifacts.
+func resolveArtifactPath(taskDir, file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(taskDir, file)
+}
+
+// readArtifact reads the module at path. gzip and zstd compressed artifacts,
+// detected either by their extension or by their magic bytes, are
+// transparently decompressed. maxSize caps the size of the resulting module
+// so a small, highly compressed artifact can't exhaust the client's memory.
+func readArtifact(path string, maxSize int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open module: %v", err)
+	}
+	defer f.Close()
+
+	return decompressArtifact(f, filepath.Base(path), maxSize)
+}
+
+// decompressArtifact reads the module from r, decompressing it if needed.
+// name is only used to detect the compression from the file extension.
+func decompressArtifact(r io.Reader, name string, maxSize int64) ([]byte, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read module: %v", err)
+	}
+
+	var src io.Reader = br
+	switch {
+	case strings.HasSuffix(name, ".gz") || bytes.HasPrefix(header, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress gzip module: %v", err)
+		}
+		defer zr.Close()
+		src = zr
+	case strings.HasSuffix(name, ".zst") || strings.HasSuffix(name, ".zstd") || bytes.HasPrefix(header, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress zstd module: %v", err)
+		}
+		defer zr.Close()
+		src = zr
+	}
+
+	// read one byte past the limit to tell a module of exactly maxSize bytes
+	// apart from one that is too big
+	b, err := io.ReadAll(io.LimitReader(src, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read module: %v", err)
+	}
+	if int64(len(b)) > maxSize {
+		return nil, fmt.Errorf("module exceeds max_decompressed_size of %d bytes", maxSize)
+	}
+	return b, nil
+}
+
+// validateModule does a cheap sanity check of the module before handing it
+// to wasmtime, so that a corrupt or mis-decompressed artifact produces a
+// readable error.
+func validateModule(b []byte) error {
+	if !bytes.HasPrefix(b, wasmMagic) {
+		return fmt.Errorf("not a WebAssembly module: missing wasm magic header")
+	}
+	return nil
+}
+
+// verifyChecksum checks the module against the digest set by
+// artifact.checksum, if any. The digest covers the decompressed module.
+func verifyChecksum(b []byte, checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+
+	expected, err := digest.Parse(checksum)
+	if err != nil {
+		return fmt.Errorf("invalid checksum %q: %v", checksum, err)
+	}
+	if actual := expected.Algorithm().FromBytes(b); actual != expected {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", expected, actual)
+	}
+	return nil
+}
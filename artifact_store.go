@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// artifactIndexFile persists the index of the store across restarts
+	artifactIndexFile = "index.json"
+
+	// defaultArtifactRetention is used when the plugin config doesn't set
+	// artifact_retention
+	defaultArtifactRetention = time.Hour
+
+	// artifactRecoveryGrace is how long the artifacts of the tasks running
+	// before a restart are kept for the tasks to be recovered
+	artifactRecoveryGrace = 10 * time.Minute
+)
+
+// artifactEntry is what the index records of an artifact
+type artifactEntry struct {
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"last_used"`
+
+	// Sources are the immutable references the artifact was fetched from,
+	// such as images pinned by digest
+	Sources []string `json:"sources,omitempty"`
+
+	// InUse is whether tasks referenced the artifact when the index was
+	// saved
+	InUse bool `json:"in_use,omitempty"`
+}
+
+// artifactStore is a content-addressed store for the artifacts used by tasks,
+// such as fetched modules. Artifacts are stored once per digest no matter how
+// many tasks use them, and each task holds a reference to the digests it
+// uses. An artifact is deleted once the last task referencing it releases it
+// and it's been unused for the retention period.
+//
+// The index of the artifacts is saved in the store, so after the plugin or
+// client restarts modules still on disk are found rather than fetched again.
+type artifactStore struct {
+	// dir is the root of the store on disk
+	dir string
+
+	logger hclog.Logger
+
+	// lock guards the maps below as well as the files in dir
+	lock sync.Mutex
+
+	// refs maps each stored digest to the set of task IDs referencing it
+	refs map[digest.Digest]map[string]struct{}
+
+	// tasks maps each task ID to the digests it references
+	tasks map[string][]digest.Digest
+
+	// index describes every artifact in the store, sources maps the
+	// sources of artifacts to their digest
+	index   map[digest.Digest]*artifactEntry
+	sources map[string]digest.Digest
+
+	// retention is how long unreferenced artifacts are kept, recovering
+	// until when the artifacts in use before a restart are
+	retention  time.Duration
+	recovering map[digest.Digest]time.Time
+
+	// now is overridden in tests
+	now func() time.Time
+}
+
+func newArtifactStore(dir string, logger hclog.Logger) (*artifactStore, error) {
+	s := &artifactStore{
+		dir:     dir,
+		logger:  logger.Named("artifacts"),
+		refs:    map[digest.Digest]map[string]struct{}{},
+		tasks:   map[string][]digest.Digest{},
+		index:   map[digest.Digest]*artifactEntry{},
+		sources: map[string]digest.Digest{},
+		now:     time.Now,
+
+		recovering: map[digest.Digest]time.Time{},
+	}
+
+	if err := os.MkdirAll(s.blobDir(), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create artifact store: %v", err)
+	}
+	if err := s.loadIndex(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadIndex reads the saved index, dropping the artifacts no longer on disk
+func (s *artifactStore) loadIndex() error {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, artifactIndexFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read artifact index: %v", err)
+	}
+
+	var index map[digest.Digest]*artifactEntry
+	if err := json.Unmarshal(data, &index); err != nil {
+		// the blobs are still usable, only what's known of them is lost
+		s.logger.Warn("discarding corrupt artifact index", "error", err)
+		return nil
+	}
+	for d, e := range index {
+		if d.Validate() != nil {
+			continue
+		}
+		if _, err := os.Stat(s.Path(d)); err != nil {
+			continue
+		}
+		s.index[d] = e
+		for _, source := range e.Sources {
+			s.sources[source] = d
+		}
+		if e.InUse {
+			s.recovering[d] = s.now().Add(artifactRecoveryGrace)
+		}
+	}
+	return nil
+}
+
+// saveIndex writes the index atomically. Callers must hold lock.
+func (s *artifactStore) saveIndex() {
+	for d, e := range s.index {
+		e.InUse = len(s.refs[d]) != 0
+	}
+	data, err := json.Marshal(s.index)
+	if err == nil {
+		path := filepath.Join(s.dir, artifactIndexFile)
+		if err = ioutil.WriteFile(path+".tmp", data, 0600); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		s.logger.Error("failed to save artifact index", "error", err)
+	}
+}
+
+// touch records that d was just used. Callers must hold lock.
+func (s *artifactStore) touch(d digest.Digest) {
+	e, ok := s.index[d]
+	if !ok {
+		e = &artifactEntry{}
+		if fi, err := os.Stat(s.Path(d)); err == nil {
+			e.Size = fi.Size()
+		}
+		s.index[d] = e
+	}
+	e.LastUsed = s.now()
+}
+
+// forget deletes d from the store. Callers must hold lock.
+func (s *artifactStore) forget(d digest.Digest) {
+	if err := os.Remove(s.Path(d)); err != nil && !os.IsNotExist(err) {
+		s.logger.Error("failed to delete unused artifact", "digest", d, "error", err)
+	}
+	if e, ok := s.index[d]; ok {
+		for _, source := range e.Sources {
+			delete(s.sources, source)
+		}
+		delete(s.index, d)
+	}
+	delete(s.recovering, d)
+}
+
+// SetRetention changes how long unreferenced artifacts are kept, deleting
+// the ones unused for longer
+func (s *artifactStore) SetRetention(retention time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.retention = retention
+	s.prune()
+	s.saveIndex()
+}
+
+// prune deletes the unreferenced artifacts unused for the retention period.
+// Callers must hold lock.
+func (s *artifactStore) prune() {
+	now := s.now()
+	for d, e := range s.index {
+		if len(s.refs[d]) != 0 || now.Sub(e.LastUsed) < s.retention {
+			continue
+		}
+		if until, ok := s.recovering[d]; ok && now.Before(until) {
+			continue
+		}
+		s.forget(d)
+	}
+}
+
+func (s *artifactStore) blobDir() string {
+	return filepath.Join(s.dir, "blobs", string(digest.Canonical))
+}
+
+// Path returns the on-disk location of the artifact with digest d.
+func (s *artifactStore) Path(d digest.Digest) string {
+	return filepath.Join(s.blobDir(), d.Encoded())
+}
+
+// Put stores b, unless an artifact with the same digest already exists, and
+// records a reference to it from taskID.
+func (s *artifactStore) Put(taskID string, b []byte) (digest.Digest, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	d, err := s.store(b)
+	if err != nil {
+		return "", err
+	}
+	s.addRef(taskID, d)
+	s.saveIndex()
+	return d, nil
+}
+
+// Remember stores b as the artifact fetched from source, an immutable
+// reference, so it's found by Cached until it's pruned. Nothing references
+// it, so it's deleted right away if artifacts aren't retained.
+func (s *artifactStore) Remember(source string, b []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.retention == 0 {
+		return nil
+	}
+	d, err := s.store(b)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.sources[source]; !ok {
+		s.index[d].Sources = append(s.index[d].Sources, source)
+		s.sources[source] = d
+	}
+	s.saveIndex()
+	return nil
+}
+
+// Cached returns the artifact fetched from source, if it's in the store
+func (s *artifactStore) Cached(source string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	d, ok := s.sources[source]
+	if !ok {
+		return nil, false
+	}
+	b, err := ioutil.ReadFile(s.Path(d))
+	if err != nil || digest.Canonical.FromBytes(b) != d {
+		s.logger.Warn("discarding unreadable cached artifact", "digest", d, "source", source)
+		if len(s.refs[d]) == 0 {
+			s.forget(d)
+		}
+		return nil, false
+	}
+	s.touch(d)
+	s.saveIndex()
+	return b, true
+}
+
+// Lookup returns the digest of the artifact fetched from source, if it's in
+// the store
+func (s *artifactStore) Lookup(source string) (digest.Digest, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	d, ok := s.sources[source]
+	return d, ok
+}
+
+// Open opens the artifact with digest d for reading, recording it as used.
+// The file stays readable if the artifact is pruned meanwhile.
+func (s *artifactStore) Open(d digest.Digest) (*os.File, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.index[d]; !ok {
+		return nil, os.ErrNotExist
+	}
+	f, err := os.Open(s.Path(d))
+	if err != nil {
+		return nil, err
+	}
+	s.touch(d)
+	s.saveIndex()
+	return f, nil
+}
+
+// artifactInfo describes an artifact of the store
+type artifactInfo struct {
+	Digest   digest.Digest `json:"digest"`
+	Size     int64         `json:"size"`
+	LastUsed time.Time     `json:"last_used"`
+	Sources  []string      `json:"sources,omitempty"`
+	Refs     int           `json:"refs"`
+}
+
+// List returns the artifacts of the store, sorted by digest
+func (s *artifactStore) List() []artifactInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	list := make([]artifactInfo, 0, len(s.index))
+	for d, e := range s.index {
+		list = append(list, artifactInfo{
+			Digest:   d,
+			Size:     e.Size,
+			LastUsed: e.LastUsed,
+			Sources:  append([]string(nil), e.Sources...),
+			Refs:     len(s.refs[d]),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Digest < list[j].Digest })
+	return list
+}
+
+// store writes b to the store unless it's already there. Callers must hold
+// lock.
+func (s *artifactStore) store(b []byte) (digest.Digest, error) {
+	d := digest.Canonical.FromBytes(b)
+
+	path := s.Path(d)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// write to a temporary file first so that a crash never leaves a
+		// truncated artifact behind under its final name
+		tmp, err := os.CreateTemp(s.blobDir(), ".tmp-")
+		if err != nil {
+			return "", fmt.Errorf("failed to store artifact: %v", err)
+		}
+		_, err = tmp.Write(b)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), path)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return "", fmt.Errorf("failed to store artifact: %v", err)
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("failed to store artifact: %v", err)
+	}
+
+	s.touch(d)
+	return d, nil
+}
+
+// Acquire records a reference from taskID to an artifact that is already in
+// the store, such as when recovering a task. It fails if the artifact has
+// been deleted in the meantime.
+func (s *artifactStore) Acquire(taskID string, d digest.Digest) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, err := os.Stat(s.Path(d)); err != nil {
+		return fmt.Errorf("artifact %s is not available: %v", d, err)
+	}
+
+	s.addRef(taskID, d)
+	s.touch(d)
+	delete(s.recovering, d)
+	s.saveIndex()
+	return nil
+}
+
+func (s *artifactStore) addRef(taskID string, d digest.Digest) {
+	tasks, ok := s.refs[d]
+	if !ok {
+		tasks = map[string]struct{}{}
+		s.refs[d] = tasks
+	}
+	if _, ok := tasks[taskID]; ok {
+		return
+	}
+
+	tasks[taskID] = struct{}{}
+	s.tasks[taskID] = append(s.tasks[taskID], d)
+}
+
+// Release drops all references held by taskID and deletes the artifacts that
+// are no longer referenced by any task.
+func (s *artifactStore) Release(taskID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, d := range s.tasks[taskID] {
+		tasks := s.refs[d]
+		delete(tasks, taskID)
+		if len(tasks) != 0 {
+			continue
+		}
+
+		delete(s.refs, d)
+		s.touch(d)
+	}
+	delete(s.tasks, taskID)
+	s.prune()
+	s.saveIndex()
+}
+
+// Refs returns the number of tasks referencing the artifact with digest d.
+func (s *artifactStore) Refs(d digest.Digest) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.refs[d])
+}
+
+// artifactStoreStats summarizes the contents of an artifact store
+type artifactStoreStats struct {
+	Artifacts int   `json:"artifacts"`
+	Tasks     int   `json:"tasks"`
+	Bytes     int64 `json:"bytes"`
+
+	// Retained are the artifacts kept while no task references them
+	Retained int `json:"retained"`
+}
+
+// Stats returns the number of artifacts stored, the number of tasks
+// referencing them and their size on disk.
+func (s *artifactStore) Stats() artifactStoreStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := artifactStoreStats{Artifacts: len(s.index), Tasks: len(s.tasks)}
+	for d, e := range s.index {
+		stats.Bytes += e.Size
+		if len(s.refs[d]) == 0 {
+			stats.Retained++
+		}
+	}
+	return stats
+}
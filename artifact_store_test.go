@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactStore_Refcount(t *testing.T) {
+	s, err := newArtifactStore(t.TempDir(), hclog.NewNullLogger())
+	require.NoError(t, err)
+
+	d1, err := s.Put("task-1", []byte("module"))
+	require.NoError(t, err)
+	d2, err := s.Put("task-2", []byte("module"))
+	require.NoError(t, err)
+	require.Equal(t, d1, d2, "identical modules must share a digest")
+	require.Equal(t, 2, s.Refs(d1))
+
+	// putting the same module twice from one task holds a single reference
+	_, err = s.Put("task-1", []byte("module"))
+	require.NoError(t, err)
+	require.Equal(t, 2, s.Refs(d1))
+
+	s.Release("task-1")
+	require.Equal(t, 1, s.Refs(d1))
+	require.FileExists(t, s.Path(d1))
+
+	s.Release("task-2")
+	require.Equal(t, 0, s.Refs(d1))
+	_, err = os.Stat(s.Path(d1))
+	require.True(t, os.IsNotExist(err), "unused artifact must be deleted")
+
+	require.Error(t, s.Acquire("task-3", d1))
+}
+
+func TestArtifactStore_Acquire(t *testing.T) {
+	s, err := newArtifactStore(t.TempDir(), hclog.NewNullLogger())
+	require.NoError(t, err)
+
+	d, err := s.Put("task-1", []byte("module"))
+	require.NoError(t, err)
+
+	// simulate a plugin restart losing the in-memory references
+	s, err = newArtifactStore(s.dir, hclog.NewNullLogger())
+	require.NoError(t, err)
+	require.NoError(t, s.Acquire("task-1", d))
+	require.Equal(t, 1, s.Refs(d))
+}
+
+func TestArtifactStore_Retention(t *testing.T) {
+	s, err := newArtifactStore(t.TempDir(), hclog.NewNullLogger())
+	require.NoError(t, err)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	s.SetRetention(time.Hour)
+
+	d, err := s.Put("task-1", []byte("module"))
+	require.NoError(t, err)
+	s.Release("task-1")
+	require.FileExists(t, s.Path(d))
+	require.Equal(t, artifactStoreStats{Artifacts: 1, Bytes: 6, Retained: 1}, s.Stats())
+
+	// a task using the module again keeps it for another period
+	now = now.Add(50 * time.Minute)
+	require.NoError(t, s.Acquire("task-2", d))
+	s.Release("task-2")
+	now = now.Add(50 * time.Minute)
+	s.Release("task-3")
+	require.FileExists(t, s.Path(d))
+
+	now = now.Add(10 * time.Minute)
+	s.Release("task-3")
+	_, err = os.Stat(s.Path(d))
+	require.True(t, os.IsNotExist(err), "expired artifact must be deleted")
+	require.Zero(t, s.Stats().Artifacts)
+}
+
+func TestArtifactStore_Index(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newArtifactStore(dir, hclog.NewNullLogger())
+	require.NoError(t, err)
+	s.SetRetention(time.Hour)
+
+	require.NoError(t, s.Remember("ghcr.io/org/app@sha256:abc//app.wasm", []byte("pulled")))
+	b, ok := s.Cached("ghcr.io/org/app@sha256:abc//app.wasm")
+	require.True(t, ok)
+	require.Equal(t, "pulled", string(b))
+	_, ok = s.Cached("ghcr.io/org/app@sha256:def//app.wasm")
+	require.False(t, ok)
+
+	running, err := s.Put("task-1", []byte("running"))
+	require.NoError(t, err)
+
+	// the index survives a restart, along with the modules it lists
+	s, err = newArtifactStore(dir, hclog.NewNullLogger())
+	require.NoError(t, err)
+	require.Equal(t, 2, s.Stats().Artifacts)
+	b, ok = s.Cached("ghcr.io/org/app@sha256:abc//app.wasm")
+	require.True(t, ok)
+	require.Equal(t, "pulled", string(b))
+
+	// tasks running before the restart have a grace period to be recovered
+	// even if their module wouldn't be retained
+	s.SetRetention(0)
+	require.FileExists(t, s.Path(running))
+	require.NoError(t, s.Acquire("task-1", running))
+	s.Release("task-1")
+	_, err = os.Stat(s.Path(running))
+	require.True(t, os.IsNotExist(err))
+
+	// nothing's remembered without retention
+	require.NoError(t, s.Remember("ghcr.io/org/app@sha256:123//app.wasm", []byte("other")))
+	_, ok = s.Cached("ghcr.io/org/app@sha256:123//app.wasm")
+	require.False(t, ok)
+
+	// a corrupt index loses what's known of the modules, not the store
+	require.NoError(t, os.WriteFile(dir+"/"+artifactIndexFile, []byte("{"), 0600))
+	s, err = newArtifactStore(dir, hclog.NewNullLogger())
+	require.NoError(t, err)
+	require.Zero(t, s.Stats().Artifacts)
+}
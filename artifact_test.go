@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifact_Decompress(t *testing.T) {
+	module := append(append([]byte{}, wasmMagic...), 0x01, 0x00, 0x00, 0x00)
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(module)
+	gw.Close()
+
+	var zs bytes.Buffer
+	zw, err := zstd.NewWriter(&zs)
+	require.NoError(t, err)
+	zw.Write(module)
+	zw.Close()
+
+	cases := []struct {
+		name  string
+		input []byte
+	}{
+		{"plain.wasm", module},
+		{"magic.wasm", gz.Bytes()},
+		{"module.wasm.gz", gz.Bytes()},
+		{"module.wasm.zst", zs.Bytes()},
+		{"magic", zs.Bytes()},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			b, err := decompressArtifact(bytes.NewReader(c.input), c.name, 1024)
+			require.NoError(t, err)
+			require.Equal(t, module, b)
+			require.NoError(t, validateModule(b))
+		})
+	}
+
+	t.Run("size guard", func(t *testing.T) {
+		_, err := decompressArtifact(bytes.NewReader(gz.Bytes()), "module.wasm.gz", int64(len(module)-1))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "max_decompressed_size")
+
+		_, err = decompressArtifact(bytes.NewReader(gz.Bytes()), "module.wasm.gz", int64(len(module)))
+		require.NoError(t, err)
+	})
+
+	t.Run("invalid module", func(t *testing.T) {
+		require.Error(t, validateModule([]byte("not wasm")))
+	})
+}
+
+func TestArtifact_VerifyChecksum(t *testing.T) {
+	wasm := []byte("\x00asm\x01\x00\x00\x00")
+
+	require.NoError(t, verifyChecksum(wasm, ""))
+	require.NoError(t, verifyChecksum(wasm, digest.FromBytes(wasm).String()))
+	require.NoError(t, verifyChecksum(wasm, digest.SHA512.FromBytes(wasm).String()))
+
+	require.Error(t, verifyChecksum(wasm, digest.FromString("other").String()))
+	require.Error(t, verifyChecksum(wasm, "md5:abc"))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// auditEventStart and auditEventExit are the audited lifecycle events
+	auditEventStart = "start"
+	auditEventExit  = "exit"
+
+	// signatureUnverified is recorded for modules whose signature wasn't
+	// checked
+	signatureUnverified = "unverified"
+
+	// defaultEntrypoint is the export invoked for WASI command modules
+	defaultEntrypoint = "_start"
+)
+
+// auditRecord is a single entry of the audit log
+type auditRecord struct {
+	Time         time.Time `json:"time"`
+	Event        string    `json:"event"`
+	ModuleDigest string    `json:"module_digest"`
+	Signature    string    `json:"signature"`
+	TaskID       string    `json:"task_id"`
+	TaskName     string    `json:"task_name"`
+	AllocID      string    `json:"alloc_id"`
+	JobID        string    `json:"job_id"`
+	Namespace    string    `json:"namespace"`
+	Entrypoint   string    `json:"entrypoint"`
+	ExitCode     *int      `json:"exit_code,omitempty"`
+	Signal       int       `json:"signal,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// auditLog is an append-only record of every module executed by the driver,
+// written as one JSON object per line to a file and/or syslog.
+type auditLog struct {
+	lock    sync.Mutex
+	writers []io.WriteCloser
+}
+
+// newAuditLog opens the configured audit sinks. It returns nil if auditing is
+// disabled, which is safe to record to.
+func newAuditLog(cfg AuditConfig) (*auditLog, error) {
+	a := &auditLog{}
+
+	if cfg.File != "" {
+		f, err := os.OpenFile(cfg.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %v", err)
+		}
+		a.writers = append(a.writers, f)
+	}
+
+	if cfg.Syslog {
+		w, err := newSyslogWriter(cfg.SyslogFacility)
+		if err != nil {
+			a.Close()
+			return nil, fmt.Errorf("failed to connect to syslog: %v", err)
+		}
+		a.writers = append(a.writers, w)
+	}
+
+	if len(a.writers) == 0 {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// record appends r to the audit log. Failing to write the audit log doesn't
+// fail the task, so errors are only returned for logging.
+func (a *auditLog) record(r *auditRecord) error {
+	if a == nil {
+		return nil
+	}
+
+	r.Time = time.Now().UTC()
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var lastErr error
+	for _, w := range a.writers {
+		if _, err := w.Write(b); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var lastErr error
+	for _, w := range a.writers {
+		if err := w.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	a.writers = nil
+	return lastErr
+}
+
+// newAuditRecord returns a record of event for the task described by cfg.
+func newAuditRecord(event string, cfg *drivers.TaskConfig, moduleDigest string) *auditRecord {
+	return &auditRecord{
+		Event:        event,
+		ModuleDigest: moduleDigest,
+		Signature:    signatureUnverified,
+		TaskID:       cfg.ID,
+		TaskName:     cfg.Name,
+		AllocID:      cfg.AllocID,
+		JobID:        cfg.JobID,
+		Namespace:    cfg.Namespace,
+		Entrypoint:   defaultEntrypoint,
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	disabled, err := newAuditLog(AuditConfig{})
+	require.NoError(t, err)
+	require.Nil(t, disabled)
+	require.NoError(t, disabled.record(&auditRecord{}))
+
+	a, err := newAuditLog(AuditConfig{File: path})
+	require.NoError(t, err)
+
+	cfg := &drivers.TaskConfig{ID: "task-id", Name: "web", AllocID: "alloc-id", JobID: "job"}
+	require.NoError(t, a.record(newAuditRecord(auditEventStart, cfg, "sha256:abc")))
+
+	exit := newAuditRecord(auditEventExit, cfg, "sha256:abc")
+	code := 3
+	exit.ExitCode = &code
+	require.NoError(t, a.record(exit))
+	require.NoError(t, a.Close())
+
+	// reopening must append rather than truncate
+	a, err = newAuditLog(AuditConfig{File: path})
+	require.NoError(t, err)
+	require.NoError(t, a.record(newAuditRecord(auditEventStart, cfg, "sha256:abc")))
+	require.NoError(t, a.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var records []auditRecord
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var r auditRecord
+		require.NoError(t, json.Unmarshal(s.Bytes(), &r))
+		records = append(records, r)
+	}
+
+	require.Len(t, records, 3)
+	require.Equal(t, auditEventStart, records[0].Event)
+	require.Equal(t, "alloc-id", records[0].AllocID)
+	require.Equal(t, defaultEntrypoint, records[0].Entrypoint)
+	require.Nil(t, records[0].ExitCode)
+	require.Equal(t, auditEventExit, records[1].Event)
+	require.Equal(t, 3, *records[1].ExitCode)
+}
@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func newSyslogWriter(facility string) (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not supported on windows")
+}
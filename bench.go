@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// benchCommand is the exec command running the benchmark
+	benchCommand = ":bench"
+
+	// maxBenchIterations bounds the iterations of a single benchmark
+	maxBenchIterations = 100000
+
+	// defaultBenchEntrypoint is the function invoked by the benchmark
+	defaultBenchEntrypoint = "_start"
+
+	// benchFuel is the fuel given to each iteration when the task has no
+	// fuel limit
+	benchFuel = unlimitedFuel
+)
+
+// wasiExitStatus matches the error returned when a guest calls proc_exit
+var wasiExitStatus = regexp.MustCompile(`exit status (\d+)`)
+
+// exitCode returns the code a guest exited with if err is the result of it
+// calling WASI's proc_exit
+func exitCode(err error) (int, bool) {
+	m := wasiExitStatus.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0, false
+	}
+	code, err := strconv.Atoi(m[1])
+	return code, err == nil
+}
+
+// benchResult is the JSON document returned by :bench
+type benchResult struct {
+	Iterations int `json:"iterations"`
+	Errors     int `json:"errors"`
+
+	// Latencies are in microseconds, measured from instantiation to the
+	// return of the entrypoint
+	P50 int64 `json:"p50_us"`
+	P90 int64 `json:"p90_us"`
+	P99 int64 `json:"p99_us"`
+	Max int64 `json:"max_us"`
+
+	// FuelPerOp is the average fuel consumed by an iteration
+	FuelPerOp uint64 `json:"fuel_per_op"`
+
+	// LastError is the error of the last failed iteration
+	LastError string `json:"last_error,omitempty"`
+}
+
+// parseBenchCommand returns the iterations of a :bench command, which may be
+// passed as one or several arguments.
+func parseBenchCommand(cmd []string) (int, bool, error) {
+	fields := strings.Fields(strings.Join(cmd, " "))
+	if len(fields) == 0 || fields[0] != benchCommand {
+		return 0, false, nil
+	}
+	if len(fields) != 2 {
+		return 0, true, fmt.Errorf("usage: %s N", benchCommand)
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n <= 0 || n > maxBenchIterations {
+		return 0, true, fmt.Errorf("invalid iterations %q: must be between 1 and %d", fields[1], maxBenchIterations)
+	}
+	return n, true, nil
+}
+
+// bench instantiates the task's module and invokes its entrypoint n times,
+// each in a fresh store with the task's host modules, until timeout.
+func (d *Driver) bench(h *TaskHandle, n int, timeout time.Duration) (*benchResult, error) {
+	var driverConfig TaskConfig
+	if err := h.taskConfig.DecodeDriverConfig(&driverConfig); err != nil {
+		return nil, fmt.Errorf("failed to decode driver config: %v", err)
+	}
+
+	d.configLock.RLock()
+	limits, err := mergeTaskConfig(d.config, &driverConfig)
+	var wasm []byte
+	if err == nil {
+		wasm, err = ioutil.ReadFile(d.artifacts.Path(h.moduleDigest))
+	}
+	var features []string
+	if err == nil {
+		features, err = taskFeatures(d.config.Compiler, wasm)
+	}
+	var hosts []hostModule
+	if err == nil {
+		hosts, err = d.newHostModules(h.taskConfig, &driverConfig)
+	}
+	d.configLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, host := range hosts {
+			host.Close()
+		}
+	}()
+
+	config, _, err := engineConfig(driverConfig.Compiler, features)
+	if err != nil {
+		return nil, err
+	}
+	var engine *wasmtime.Engine
+	var module *wasmtime.Module
+	if isPrecompiledModule(wasm) {
+		if engine, module, err = loadPrecompiledModule(config, wasm); err != nil {
+			return nil, err
+		}
+	} else {
+		engine = wasmtime.NewEngineWithConfig(config)
+		if module, err = wasmtime.NewModule(engine, wasm); err != nil {
+			return nil, fmt.Errorf("failed to compile module: %v", err)
+		}
+	}
+
+	// fail once with every missing import rather than in every iteration
+	linker, err := linkHosts(engine, hosts)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkImports(wasmtime.NewStore(engine), linker, module); err != nil {
+		return nil, err
+	}
+
+	fuel := uint64(benchFuel)
+	if limits.fuel != 0 {
+		fuel = limits.fuel
+	}
+
+	// guests still running at the call deadline, or when the command times
+	// out, are interrupted
+	d.configLock.RLock()
+	callDeadline := d.callDeadline
+	d.configLock.RUnlock()
+	deadline := time.Now().Add(timeout)
+	defer d.epochs.add(engine)()
+
+	result := &benchResult{}
+	latencies := make([]time.Duration, 0, n)
+	var totalFuel uint64
+	for i := 0; i < n; i++ {
+		if timeout > 0 && !time.Now().Before(deadline) {
+			break
+		}
+
+		callTimeout := callDeadline
+		if remaining := time.Until(deadline); timeout > 0 && (callTimeout == 0 || remaining < callTimeout) {
+			callTimeout = remaining
+		}
+
+		elapsed, consumed, err := benchIteration(engine, module, hosts, fuel, d.epochs.ticks(callTimeout))
+		result.Iterations++
+		latencies = append(latencies, elapsed)
+		totalFuel += consumed
+		if err != nil {
+			result.Errors++
+			result.LastError = err.Error()
+		}
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) int64 {
+		if len(latencies) == 0 {
+			return 0
+		}
+		i := int(p*float64(len(latencies)-1) + 0.5)
+		return latencies[i].Microseconds()
+	}
+	result.P50 = percentile(0.50)
+	result.P90 = percentile(0.90)
+	result.P99 = percentile(0.99)
+	result.Max = percentile(1)
+	if result.Iterations != 0 {
+		result.FuelPerOp = totalFuel / uint64(result.Iterations)
+	}
+	return result, nil
+}
+
+// benchIteration runs the entrypoint once, interrupting it after ticks of
+// the epoch, and returns how long it took and the fuel it consumed. Exiting
+// with code 0 isn't an error.
+func benchIteration(engine *wasmtime.Engine, module *wasmtime.Module, hosts []hostModule, fuel, ticks uint64) (time.Duration, uint64, error) {
+	store := wasmtime.NewStore(engine)
+	store.SetWasi(wasmtime.NewWasiConfig())
+	store.SetEpochDeadline(ticks)
+	if err := store.AddFuel(fuel); err != nil {
+		return 0, 0, err
+	}
+
+	linker, err := linkHosts(engine, hosts)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	start := time.Now()
+	instance, err := linker.Instantiate(store, module)
+	if err == nil {
+		entrypoint := instance.GetFunc(store, defaultBenchEntrypoint)
+		if entrypoint == nil {
+			err = fmt.Errorf("module doesn't export %q", defaultBenchEntrypoint)
+		} else if _, err = entrypoint.Call(store); err != nil {
+			if code, ok := exitCode(err); ok && code == 0 {
+				err = nil
+			}
+		}
+	}
+	elapsed := time.Since(start)
+
+	consumed, _ := store.FuelConsumed()
+	return elapsed, consumed, err
+}
+
+// linkHosts returns a linker defining WASI and the functions of hosts
+func linkHosts(engine *wasmtime.Engine, hosts []hostModule) (*wasmtime.Linker, error) {
+	linker := wasmtime.NewLinker(engine)
+	if err := linker.DefineWasi(); err != nil {
+		return nil, err
+	}
+	for _, h := range hosts {
+		if err := h.Define(linker); err != nil {
+			return nil, err
+		}
+	}
+	return linker, nil
+}
+
+// execBench runs :bench and returns its result as the command's output
+func (d *Driver) execBench(h *TaskHandle, n int, timeout time.Duration) (*drivers.ExecTaskResult, error) {
+	result, err := d.bench(h, n, timeout)
+	if err != nil {
+		return &drivers.ExecTaskResult{
+			Stderr:     []byte(err.Error() + "\n"),
+			ExitResult: &drivers.ExitResult{ExitCode: 1},
+		}, nil
+	}
+
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return &drivers.ExecTaskResult{
+		Stdout:     append(out, '\n'),
+		ExitResult: &drivers.ExitResult{},
+	}, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+// benchWat loops 1000 times and exits through proc_exit with code 0
+const benchWat = `
+(module
+  (import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+  (memory (export "memory") 1)
+  (func (export "_start")
+    (local $i i32)
+    (loop $loop
+      (local.set $i (i32.add (local.get $i) (i32.const 1)))
+      (br_if $loop (i32.lt_u (local.get $i) (i32.const 1000))))
+    (call $exit (i32.const 0)))
+)`
+
+// benchTask stores a task running wat in d
+func benchTask(t *testing.T, d *Driver, wat string, driverConfig *TaskConfig) string {
+	wasm, err := wasmtime.Wat2Wasm(wat)
+	require.NoError(t, err)
+
+	cfg := &drivers.TaskConfig{ID: "bench", Name: "task"}
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(driverConfig))
+	digest, err := d.artifacts.Put(cfg.ID, wasm)
+	require.NoError(t, err)
+
+	d.tasks.Set(cfg.ID, &TaskHandle{taskConfig: cfg, moduleDigest: digest})
+	return cfg.ID
+}
+
+func TestParseBenchCommand(t *testing.T) {
+	n, ok, err := parseBenchCommand([]string{":bench", "10"})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, 10, n)
+
+	n, ok, err = parseBenchCommand([]string{":bench 20"})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, 20, n)
+
+	_, ok, _ = parseBenchCommand([]string{"/bin/sh"})
+	require.False(t, ok)
+
+	for _, cmd := range [][]string{{":bench"}, {":bench", "0"}, {":bench", "many"}, {":bench", "1", "2"}} {
+		_, ok, err := parseBenchCommand(cmd)
+		require.True(t, ok)
+		require.Error(t, err, "%v", cmd)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	code, ok := exitCode(errors.New("Exited with i32 exit status 3"))
+	require.True(t, ok)
+	require.Equal(t, 3, code)
+
+	_, ok = exitCode(errors.New("wasm trap: unreachable"))
+	require.False(t, ok)
+}
+
+func TestExecTask_Bench(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir()}))
+	taskID := benchTask(t, d, benchWat, &TaskConfig{})
+
+	res, err := d.ExecTask(taskID, []string{":bench", "20"}, time.Minute)
+	require.NoError(t, err)
+	require.Zero(t, res.ExitResult.ExitCode, string(res.Stderr))
+
+	var result benchResult
+	require.NoError(t, json.Unmarshal(res.Stdout, &result))
+	require.Equal(t, 20, result.Iterations)
+	require.Zero(t, result.Errors, result.LastError)
+	require.NotZero(t, result.FuelPerOp)
+	require.LessOrEqual(t, result.P50, result.P90)
+	require.LessOrEqual(t, result.P90, result.P99)
+	require.LessOrEqual(t, result.P99, result.Max)
+
+	_, err = d.ExecTask(taskID, []string{"/bin/sh"}, time.Minute)
+	require.Error(t, err)
+	_, err = d.ExecTask("missing", []string{":bench", "1"}, time.Minute)
+	require.Equal(t, drivers.ErrTaskNotFound, err)
+}
+
+func TestExecTask_BenchFuelLimit(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir()}))
+	taskID := benchTask(t, d, benchWat, &TaskConfig{Limits: TaskLimitsConfig{Fuel: 100}})
+
+	res, err := d.ExecTask(taskID, []string{":bench", "3"}, time.Minute)
+	require.NoError(t, err)
+
+	var result benchResult
+	require.NoError(t, json.Unmarshal(res.Stdout, &result))
+	require.Equal(t, 3, result.Errors)
+	require.NotEmpty(t, result.LastError)
+}
+
+func TestExecTask_BenchUnsatisfiedImports(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir()}))
+	taskID := benchTask(t, d, `(module
+	  (import "wasi_ephemeral_keyvalue" "get" (func (param i32 i32) (result i32)))
+	  (func (export "_start")))`, &TaskConfig{})
+
+	res, err := d.ExecTask(taskID, []string{":bench", "3"}, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 1, res.ExitResult.ExitCode)
+	require.Contains(t, string(res.Stderr), "keyvalue.backend")
+}
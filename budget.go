@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+)
+
+// capacityError is returned by StartTask when the node can't host the task
+// until running tasks free resources. It's wrapped as recoverable, so Nomad
+// retries the task per its restart policy rather than failing it.
+type capacityError struct {
+	resource  string
+	requested int64
+	used      int64
+	limit     int64
+}
+
+func (e *capacityError) Error() string {
+	if e.limit == 0 {
+		return fmt.Sprintf("node is out of %s", e.resource)
+	}
+	return fmt.Sprintf("node is out of %s: the task needs %s, %s of %s are in use",
+		e.resource, humanize.IBytes(uint64(e.requested)), humanize.IBytes(uint64(e.used)), humanize.IBytes(uint64(e.limit)))
+}
+
+// resourceExhaustionErrors are the messages wasmtime fails with when the
+// host can't map memory for compiled code or instances
+var resourceExhaustionErrors = []string{
+	"out of memory",
+	"cannot allocate memory",
+	"mmap failed",
+	"failed to allocate",
+}
+
+// isResourceExhaustion returns whether err is wasmtime failing to allocate
+// memory on the host
+func isResourceExhaustion(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range resourceExhaustionErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// codeBudget caps the size of the compiled code of the node's tasks, set by
+// compiled_code_budget in the plugin config
+type codeBudget struct {
+	lock  sync.Mutex
+	limit int64
+	used  map[string]int64
+	total int64
+
+	// exhausted is set when a task is refused, until a task releases its
+	// code
+	exhausted bool
+}
+
+func newCodeBudget() *codeBudget {
+	return &codeBudget{used: map[string]int64{}}
+}
+
+// SetLimit sets the budget, 0 for none. Tasks already running keep their
+// code even if it exceeds a lowered budget.
+func (b *codeBudget) SetLimit(limit int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.limit = limit
+	if limit == 0 {
+		b.exhausted = false
+	}
+}
+
+// reserve accounts for size bytes of code compiled for the task, or
+// returns a capacityError if they don't fit in the budget
+func (b *codeBudget) reserve(taskID string, size int64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.limit != 0 && b.total+size > b.limit {
+		b.exhausted = true
+		return &capacityError{resource: "compiled code budget", requested: size, used: b.total, limit: b.limit}
+	}
+	b.restoreLocked(taskID, size)
+	return nil
+}
+
+// restore accounts for the code of a recovered task, regardless of the
+// budget as the task already runs
+func (b *codeBudget) restore(taskID string, size int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.restoreLocked(taskID, size)
+}
+
+func (b *codeBudget) restoreLocked(taskID string, size int64) {
+	b.total += size - b.used[taskID]
+	b.used[taskID] = size
+}
+
+// release frees the code of the task
+func (b *codeBudget) release(taskID string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if size, ok := b.used[taskID]; ok {
+		b.total -= size
+		delete(b.used, taskID)
+		b.exhausted = false
+	}
+}
+
+// isExhausted returns whether the last task started was refused, and no
+// task released its code since
+func (b *codeBudget) isExhausted() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.exhausted
+}
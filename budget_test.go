@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodeBudget(t *testing.T) {
+	b := newCodeBudget()
+
+	// no budget
+	require.NoError(t, b.reserve("a", 1<<30))
+	b.release("a")
+
+	b.SetLimit(1000)
+	require.NoError(t, b.reserve("a", 600))
+	require.False(t, b.isExhausted())
+
+	err := b.reserve("b", 600)
+	var capacity *capacityError
+	require.True(t, errors.As(err, &capacity))
+	require.EqualValues(t, 600, capacity.used)
+	require.Contains(t, err.Error(), "compiled code budget")
+	require.True(t, b.isExhausted())
+
+	// recovered tasks are accounted regardless of the budget
+	b.restore("c", 600)
+	require.Error(t, b.reserve("d", 1))
+
+	b.release("a")
+	require.False(t, b.isExhausted())
+	b.release("c")
+	require.NoError(t, b.reserve("b", 600))
+
+	// releasing unknown tasks is a no-op
+	b.release("missing")
+	require.EqualValues(t, 600, b.total)
+}
+
+func TestIsResourceExhaustion(t *testing.T) {
+	require.True(t, isResourceExhaustion(errors.New("failed to compile module: mmap failed to allocate 0x1000 bytes")))
+	require.True(t, isResourceExhaustion(errors.New("Cannot allocate memory (os error 12)")))
+	require.False(t, isResourceExhaustion(errors.New("invalid module")))
+
+	require.Equal(t, "node is out of memory for compiled code", (&capacityError{resource: "memory for compiled code"}).Error())
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"runtime"
+)
+
+// bundleManifestFile is the manifest of a module bundle
+const bundleManifestFile = "manifest.json"
+
+// bundleManifest lists the files of a module bundle: a tar carrying the
+// module and its precompiled code for any number of targets, so a single
+// artifact serves clusters mixing architectures.
+type bundleManifest struct {
+	// Module is the path of the WebAssembly module in the bundle
+	Module string `json:"module"`
+
+	// Precompiled are the paths of the .cwasm files in the bundle, by
+	// target triple such as "x86_64-unknown-linux-gnu"
+	Precompiled map[string]string `json:"precompiled"`
+}
+
+// moduleBundle is a module along with its code precompiled for the host,
+// if the bundle carries it
+type moduleBundle struct {
+	wasm        []byte
+	precompiled []byte
+	triple      string
+}
+
+// isBundle returns whether b is a tar archive rather than a module
+func isBundle(b []byte) bool {
+	return len(b) >= 262 && string(b[257:262]) == "ustar"
+}
+
+// hostTriple returns the target triple of the host, as wasmtime names the
+// targets it compiles for
+func hostTriple() string {
+	arch := runtime.GOARCH
+	switch arch {
+	case "amd64":
+		arch = "x86_64"
+	case "arm64":
+		arch = "aarch64"
+	}
+
+	switch runtime.GOOS {
+	case "darwin":
+		return arch + "-apple-darwin"
+	case "windows":
+		return arch + "-pc-windows-msvc"
+	}
+	return arch + "-unknown-" + runtime.GOOS + "-gnu"
+}
+
+// readBundle returns the module in the bundle b and its code precompiled
+// for triple. The bundle is read in memory, as b is already bounded by the
+// artifact's maximum size.
+func readBundle(b []byte, triple string) (*moduleBundle, error) {
+	files := map[string][]byte{}
+	r := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read bundle: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bundle: %v", err)
+		}
+		files[path.Clean(hdr.Name)] = data
+	}
+
+	data, ok := files[bundleManifestFile]
+	if !ok {
+		return nil, fmt.Errorf("bundle has no %s", bundleManifestFile)
+	}
+	var manifest bundleManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid bundle manifest: %v", err)
+	}
+	if manifest.Module == "" {
+		return nil, fmt.Errorf("bundle manifest doesn't name a module")
+	}
+
+	bundle := &moduleBundle{}
+	if bundle.wasm, ok = files[path.Clean(manifest.Module)]; !ok {
+		return nil, fmt.Errorf("bundle has no module %q", manifest.Module)
+	}
+	if name, ok := manifest.Precompiled[triple]; ok {
+		if bundle.precompiled, ok = files[path.Clean(name)]; !ok {
+			return nil, fmt.Errorf("bundle has no precompiled module %q for %s", name, triple)
+		}
+		bundle.triple = triple
+	}
+	return bundle, nil
+}
+
+// unbundleModule returns the module in b, and its precompiled code for the
+// host if b is a bundle carrying it
+func unbundleModule(b []byte) (*moduleBundle, error) {
+	if !isBundle(b) {
+		return &moduleBundle{wasm: b}, nil
+	}
+	return readBundle(b, hostTriple())
+}
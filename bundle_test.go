@@ -0,0 +1,88 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"runtime"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testBundle returns a bundle of files, with manifest as its manifest
+func testBundle(t *testing.T, manifest *bundleManifest, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	add := func(name string, data []byte) {
+		require.NoError(t, w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}))
+		_, err := w.Write(data)
+		require.NoError(t, err)
+	}
+	if manifest != nil {
+		data, err := json.Marshal(manifest)
+		require.NoError(t, err)
+		add(bundleManifestFile, data)
+	}
+	for name, data := range files {
+		add(name, data)
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestHostTriple(t *testing.T) {
+	if runtime.GOOS == "linux" && runtime.GOARCH == "amd64" {
+		require.Equal(t, "x86_64-unknown-linux-gnu", hostTriple())
+	}
+	require.NotEmpty(t, hostTriple())
+}
+
+func TestUnbundleModule(t *testing.T) {
+	wasm, err := wasmtime.Wat2Wasm(`(module)`)
+	require.NoError(t, err)
+
+	// plain modules are returned as is
+	bundle, err := unbundleModule(wasm)
+	require.NoError(t, err)
+	require.Equal(t, wasm, bundle.wasm)
+	require.Nil(t, bundle.precompiled)
+
+	b := testBundle(t, &bundleManifest{
+		Module: "app.wasm",
+		Precompiled: map[string]string{
+			"x86_64-unknown-linux-gnu":  "x86_64/app.cwasm",
+			"aarch64-unknown-linux-gnu": "./aarch64/app.cwasm",
+		},
+	}, map[string][]byte{
+		"app.wasm":           wasm,
+		"x86_64/app.cwasm":   []byte("x86_64"),
+		"aarch64/app.cwasm":  []byte("aarch64"),
+		"riscv64/app.cwasm":  []byte("riscv64"),
+		"docs/unrelated.txt": []byte("unused"),
+	})
+	require.True(t, isBundle(b))
+
+	bundle, err = readBundle(b, "aarch64-unknown-linux-gnu")
+	require.NoError(t, err)
+	require.Equal(t, wasm, bundle.wasm)
+	require.Equal(t, "aarch64", string(bundle.precompiled))
+	require.Equal(t, "aarch64-unknown-linux-gnu", bundle.triple)
+
+	// other targets fall back to compiling the module
+	bundle, err = readBundle(b, "riscv64gc-unknown-linux-gnu")
+	require.NoError(t, err)
+	require.Equal(t, wasm, bundle.wasm)
+	require.Nil(t, bundle.precompiled)
+
+	for name, b := range map[string][]byte{
+		"no manifest":        testBundle(t, nil, map[string][]byte{"app.wasm": wasm}),
+		"no module":          testBundle(t, &bundleManifest{}, nil),
+		"missing module":     testBundle(t, &bundleManifest{Module: "app.wasm"}, nil),
+		"missing precompile": testBundle(t, &bundleManifest{Module: "app.wasm", Precompiled: map[string]string{"x": "x.cwasm"}}, map[string][]byte{"app.wasm": wasm}),
+	} {
+		_, err := readBundle(b, "x")
+		require.Error(t, err, name)
+	}
+}
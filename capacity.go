@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+// availableMemory returns the memory of the node available for new
+// guests, overridden in tests
+var availableMemory = func() (uint64, error) {
+	v, err := mem.VirtualMemory()
+	if err != nil {
+		return 0, err
+	}
+	return v.Available, nil
+}
+
+// instancesFree estimates how many more guests the node can host, the
+// lower of max_instances less the running tasks and the available memory
+// over the plugin's memory limit, which caps the memory of every guest. It
+// returns false if neither is set. configLock must be held.
+func (d *Driver) instancesFree() (int64, bool) {
+	var free int64
+	var bounded bool
+	if d.config.MaxInstances > 0 {
+		free = int64(d.config.MaxInstances - d.tasks.Len())
+		bounded = true
+	}
+
+	if limits, err := parseTaskLimits(d.config.Limits); err == nil && limits.memory > 0 {
+		if available, err := availableMemory(); err == nil {
+			byMemory := int64(available / limits.memory)
+			if !bounded || byMemory < free {
+				free = byMemory
+			}
+			bounded = true
+		}
+	}
+
+	if free < 0 {
+		free = 0
+	}
+	return free, bounded
+}
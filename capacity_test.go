@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDriver_InstancesFree(t *testing.T) {
+	available := uint64(10 << 20)
+	defer func(f func() (uint64, error)) { availableMemory = f }(availableMemory)
+	availableMemory = func() (uint64, error) { return available, nil }
+
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir()}))
+	_, ok := d.instancesFree()
+	require.False(t, ok)
+	require.NotContains(t, d.buildFingerprint().Attributes, "driver.wasmtime.capacity.instances_free")
+
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir(), MaxInstances: 3}))
+	d.tasks.Set("a", &TaskHandle{})
+	free, ok := d.instancesFree()
+	require.True(t, ok)
+	require.EqualValues(t, 2, free)
+
+	// the memory available bounds it too
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir(), MaxInstances: 8, Limits: TaskLimitsConfig{Memory: "4MiB"}}))
+	free, _ = d.instancesFree()
+	require.EqualValues(t, 2, free)
+	require.Equal(t, pstructs.NewIntAttribute(2, ""), d.buildFingerprint().Attributes["driver.wasmtime.capacity.instances_free"])
+
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir(), Limits: TaskLimitsConfig{Memory: "1MiB"}}))
+	free, _ = d.instancesFree()
+	require.EqualValues(t, 10, free)
+
+	// never negative
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir(), MaxInstances: 1}))
+	d.tasks.Set("b", &TaskHandle{})
+	free, _ = d.instancesFree()
+	require.Zero(t, free)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/blessanabraham/nomad-driver-wasmtime/api"
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/mitchellh/mapstructure"
+)
+
+// validatePluginConfig parses and validates the plugin config in src, the
+// way the agent and SetConfig would. src is either a client's
+// plugin "wasmtime" stanza or just its config block.
+func validatePluginConfig(src []byte) (*Config, error) {
+	root, err := hcl.ParseBytes(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config: %v", err)
+	}
+	list, ok := root.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse config: file doesn't contain a root object")
+	}
+
+	// unwrap the plugin stanza when there's one
+	if plugins := list.Filter("plugin", pluginName); len(plugins.Items) != 0 {
+		if len(plugins.Items) > 1 {
+			return nil, fmt.Errorf("only one plugin %q stanza is allowed", pluginName)
+		}
+		inner, ok := plugins.Items[0].Val.(*ast.ObjectType)
+		if !ok {
+			return nil, fmt.Errorf("plugin %q stanza must be an object", pluginName)
+		}
+		list = inner.List
+	}
+
+	var raw map[string]interface{}
+	if err := hcl.DecodeObject(&raw, list); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %v", err)
+	}
+	var stanza struct {
+		Config []map[string]interface{} `mapstructure:"config"`
+	}
+	if err := mapstructure.WeakDecode(raw, &stanza); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %v", err)
+	}
+	if len(stanza.Config) > 1 {
+		return nil, fmt.Errorf("only one config block is allowed")
+	}
+	config := map[string]interface{}{}
+	if len(stanza.Config) == 1 {
+		config = stanza.Config[0]
+	}
+
+	c, err := api.DecodeConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parsePluginConfig(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatePluginConfig(t *testing.T) {
+	config, err := validatePluginConfig([]byte(`
+plugin "wasmtime" {
+  config {
+    data_dir      = "/var/lib/wasmtime"
+    mount_timeout = "10s"
+  }
+}`))
+	require.NoError(t, err)
+	require.Equal(t, "/var/lib/wasmtime", config.DataDir)
+	require.Equal(t, "10s", config.MountTimeout)
+	require.Equal(t, "1s", config.StatsMinInterval)
+
+	// the plugin stanza may be omitted
+	config, err = validatePluginConfig([]byte(`config { data_dir = "/tmp" }`))
+	require.NoError(t, err)
+	require.Equal(t, "/tmp", config.DataDir)
+
+	_, err = validatePluginConfig([]byte(``))
+	require.NoError(t, err)
+
+	for name, src := range map[string]string{
+		"syntax":              `config {`,
+		"unknown field":       `config { unknown = true }`,
+		"invalid value":       `config { mount_timeout = "soon" }`,
+		"zero interval":       `config { stats_min_interval = "0s" }`,
+		"negative retention":  `config { artifact_retention = "-1h" }`,
+		"unknown feature":     `config { compiler { features = ["teleport"] } }`,
+		"invalid import":      `config { allowed_imports = ["env"] }`,
+		"invalid code budget": `config { compiled_code_budget = "lots" }`,
+		"negative count":      `config { debug_retention { max_count = -1 } }`,
+		"invalid interval":    `config { epoch { interval = "0s" } }`,
+		"two blocks":          `config {} config {}`,
+	} {
+		_, err := validatePluginConfig([]byte(src))
+		require.Error(t, err, name)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/armon/go-metrics/prometheus"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// The phases of a task start, in order
+const (
+	startPhasePull        = "pull"
+	startPhaseCompile     = "compile"
+	startPhaseLink        = "link"
+	startPhaseInstantiate = "instantiate"
+)
+
+var startPhases = []string{startPhasePull, startPhaseCompile, startPhaseLink, startPhaseInstantiate}
+
+// metricsServiceName prefixes every metric of the driver
+const metricsServiceName = "nomad_driver"
+
+var setupMetricsOnce sync.Once
+
+// setupMetrics sends the driver's metrics to a Prometheus registry, served
+// at /metrics by the status listener. The plugin process can't use the Nomad
+// agent's telemetry sinks.
+func setupMetrics() {
+	setupMetricsOnce.Do(func() {
+		sink, err := prometheus.NewPrometheusSink()
+		if err != nil {
+			return
+		}
+		config := metrics.DefaultConfig(metricsServiceName)
+		config.EnableHostname = false
+		metrics.NewGlobal(config, sink)
+	})
+}
+
+// startTimings are the durations of the phases of a task's start, so wasm
+// cold starts can be measured. They're exported as metrics, in an event once
+// the task started and as attributes of the task's status.
+type startTimings struct {
+	labels []metrics.Label
+
+	lock      sync.Mutex
+	durations map[string]time.Duration
+}
+
+func newStartTimings(cfg *drivers.TaskConfig) *startTimings {
+	return &startTimings{
+		labels: []metrics.Label{
+			{Name: "job", Value: cfg.JobName},
+			{Name: "task_group", Value: cfg.TaskGroupName},
+			{Name: "task", Value: cfg.Name},
+		},
+		durations: map[string]time.Duration{},
+	}
+}
+
+// measure records the duration of phase, which began at start
+func (t *startTimings) measure(phase string, start time.Time) {
+	elapsed := time.Since(start)
+
+	t.lock.Lock()
+	t.durations[phase] += elapsed
+	t.lock.Unlock()
+
+	metrics.AddSampleWithLabels([]string{"wasmtime", "start", phase},
+		float32(elapsed.Seconds()*1000), t.labels)
+}
+
+// attributes returns the duration in milliseconds of every phase measured,
+// keyed by cold_start.<phase>_ms
+func (t *startTimings) attributes() map[string]string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	attrs := make(map[string]string, len(t.durations))
+	for phase, d := range t.durations {
+		attrs["cold_start."+phase+"_ms"] = strconv.FormatFloat(d.Seconds()*1000, 'f', 3, 64)
+	}
+	return attrs
+}
+
+func (t *startTimings) String() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var parts []string
+	for _, phase := range startPhases {
+		if d, ok := t.durations[phase]; ok {
+			parts = append(parts, fmt.Sprintf("%s %s", phase, d.Round(time.Microsecond)))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// emitStartTimings sends the task's start timings as a task event
+func (d *Driver) emitStartTimings(cfg *drivers.TaskConfig, timings *startTimings) {
+	err := d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:      cfg.ID,
+		AllocID:     cfg.AllocID,
+		TaskName:    cfg.Name,
+		Timestamp:   time.Now(),
+		Message:     "Module started: " + timings.String(),
+		Annotations: timings.attributes(),
+	})
+	if err != nil {
+		d.logger.Warn("failed to emit start timings", "task_id", cfg.ID, "error", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartTimings(t *testing.T) {
+	// the driver sets up the metrics sink
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+
+	cfg := &drivers.TaskConfig{ID: "id", AllocID: "alloc", Name: "task", JobName: "job", TaskGroupName: "group"}
+	timings := newStartTimings(cfg)
+	require.Empty(t, timings.String())
+
+	timings.measure(startPhaseCompile, time.Now().Add(-20*time.Millisecond))
+	timings.measure(startPhasePull, time.Now().Add(-10*time.Millisecond))
+
+	attrs := timings.attributes()
+	require.Len(t, attrs, 2)
+	pull, err := strconv.ParseFloat(attrs["cold_start.pull_ms"], 64)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, pull, 10.0)
+	require.Contains(t, attrs, "cold_start.compile_ms")
+
+	// phases are listed in the order they run
+	require.Regexp(t, `^pull \S+, compile \S+$`, timings.String())
+
+	h := &TaskHandle{taskConfig: cfg, timings: timings}
+	require.Equal(t, attrs["cold_start.pull_ms"], h.TaskStatus().DriverAttributes["cold_start.pull_ms"])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := d.TaskEvents(ctx)
+	require.NoError(t, err)
+
+	d.emitStartTimings(cfg, timings)
+	select {
+	case e := <-events:
+		require.Equal(t, "id", e.TaskID)
+		require.Equal(t, "alloc", e.AllocID)
+		require.Equal(t, "Module started: "+timings.String(), e.Message)
+		require.Equal(t, attrs, e.Annotations)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event emitted")
+	}
+
+	// the samples are exported in the Prometheus format
+	require.NoError(t, setConfig(t, d, &Config{
+		DataDir: t.TempDir(),
+		Status:  StatusConfig{Address: "127.0.0.1:0"},
+	}))
+	defer d.statusServer.Close()
+
+	resp, err := http.Get("http://" + d.statusServer.Addr().String() + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `nomad_driver_wasmtime_start_pull{job="job",task="task",task_group="group",quantile="0.5"}`)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blessanabraham/nomad-driver-wasmtime/api"
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/dustin/go-humanize"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/opencontainers/go-digest"
+)
+
+// The compiler strategies tasks may choose
+const strategyCranelift = "cranelift"
+
+// optLevelNames are the names of the cranelift optimization levels
+var optLevelNames = map[OptLevel]string{
+	api.OptLevelNone:         "none",
+	api.OptLevelSpeed:        "speed",
+	api.OptLevelSpeedAndSize: "speed_and_size",
+}
+
+// compileDiagnostics describe how a task's module was compiled, so job
+// authors can see the effect of their compiler config without node access
+type compileDiagnostics struct {
+	Strategy string `json:"strategy"`
+	OptLevel string `json:"opt_level"`
+
+	// CodeSize is the size of the compiled module, as serialized
+	CodeSize int64         `json:"code_size"`
+	Duration time.Duration `json:"duration"`
+
+	// Precompiled is set if the module's precompiled code was used rather
+	// than compiling it
+	Precompiled bool     `json:"precompiled"`
+	Warnings    []string `json:"warnings,omitempty"`
+}
+
+// engineConfig returns the engine config of a task with the compiler
+// settings of compiler, which must be merged with the plugin's, enabling
+// the proposals in features. The diagnostics are filled with the settings
+// chosen and warnings about them.
+func engineConfig(compiler WasmTimeCompiler, features []string) (*wasmtime.Config, *compileDiagnostics, error) {
+	diag := &compileDiagnostics{Strategy: compiler.Strategy}
+	config := wasmtime.NewConfig()
+	config.SetConsumeFuel(true)
+	config.SetEpochInterruption(true)
+
+	switch compiler.Strategy {
+	case "", strategyAuto:
+		diag.Strategy = strategyAuto
+		if err := config.SetStrategy(wasmtime.StrategyAuto); err != nil {
+			return nil, nil, err
+		}
+	case strategyCranelift:
+		if err := config.SetStrategy(wasmtime.StrategyCranelift); err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown compiler strategy %q", compiler.Strategy)
+	}
+	enableTaskFeatures(config, features)
+
+	opts := compiler.CraneLiftOptions
+	name, ok := optLevelNames[opts.OptLevel]
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid cranelift optimization level %d", opts.OptLevel)
+	}
+	diag.OptLevel = name
+	config.SetCraneliftOptLevel(wasmtime.OptLevel(opts.OptLevel))
+	if opts.OptLevel == api.OptLevelNone {
+		diag.Warnings = append(diag.Warnings, "optimize = 0 disables optimizations, the compiled code is slow")
+	}
+	config.SetCraneliftDebugVerifier(opts.DebugVerifier)
+	if opts.DebugVerifier {
+		diag.Warnings = append(diag.Warnings, "debug_verifier slows compilation down, it's meant for debugging the compiler")
+	}
+	if opts.NANCanonicalization {
+		diag.Warnings = append(diag.Warnings, "nan_canonicalization isn't supported by this version of wasmtime and is ignored")
+	}
+	return config, diag, nil
+}
+
+// engineKey names the engine config of a task with the compiler settings
+// of compiler, enabling the proposals in features, so tasks with the same
+// config share an engine
+func engineKey(compiler WasmTimeCompiler, features []string) string {
+	strategy := compiler.Strategy
+	if strategy == "" {
+		strategy = strategyAuto
+	}
+	features = append([]string(nil), features...)
+	sort.Strings(features)
+	opts := compiler.CraneLiftOptions
+	return fmt.Sprintf("%s/%d/%t/%s", strategy, opts.OptLevel, opts.DebugVerifier, strings.Join(features, ","))
+}
+
+// compileModule returns an engine for taskID with config and wasm compiled
+// by it, or deserialized from precompiled if set and usable by the engine,
+// recording how in diag. The compiled code is shared through modules with
+// the other tasks compiling wasm with the engine config named key, until
+// the task releases it. The memories and tables of the module are capped at
+// the task's limits; precompiled code declaring larger ones isn't used. wasm
+// may itself be precompiled, which is deserialized as is and refused if its
+// declarations exceed the limits.
+func compileModule(modules *moduleCache, taskID, key string, config *wasmtime.Config, wasm, precompiled []byte, limits *taskLimits, diag *compileDiagnostics) (*wasmtime.Engine, *wasmtime.Module, error) {
+	start := time.Now()
+	defer func() { diag.Duration = time.Since(start) }()
+
+	engine := wasmtime.NewEngineWithConfig(config)
+	if isPrecompiledModule(wasm) {
+		var module *wasmtime.Module
+		m, err := modules.Acquire(taskID, key, digest.FromBytes(wasm), func() (*compiledModule, error) {
+			var err error
+			if module, err = deserializePrecompiled(engine, wasm); err != nil {
+				return nil, err
+			}
+			return &compiledModule{code: wasm, precompiled: true}, nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if module == nil {
+			if module, err = deserializePrecompiled(engine, m.code); err != nil {
+				modules.Release(taskID)
+				return nil, nil, err
+			}
+		}
+		if err := checkPrecompiledLimits(module, limits); err != nil {
+			modules.Release(taskID)
+			return nil, nil, err
+		}
+		diag.Precompiled = true
+		diag.CodeSize = int64(len(m.code))
+		return engine, module, nil
+	}
+	module, err := compileWithEngine(modules, taskID, key, engine, wasm, precompiled, limits, diag)
+	if err != nil {
+		return nil, nil, err
+	}
+	return engine, module, nil
+}
+
+// compileWithEngine is compileModule for a module that isn't precompiled,
+// with an existing engine. The code is used by user until it's released.
+func compileWithEngine(modules *moduleCache, user, key string, engine *wasmtime.Engine, wasm, precompiled []byte, limits *taskLimits, diag *compileDiagnostics) (*wasmtime.Module, error) {
+	wasm, capped, err := limitModule(wasm, limits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile module: %v", err)
+	}
+	if capped && precompiled != nil {
+		precompiled = nil
+		diag.Warnings = append(diag.Warnings, "the precompiled code doesn't cap the module's memory and tables at their limits, the module was compiled instead")
+	}
+
+	// the module is cached as capped, so tasks with other limits don't
+	// share its code
+	var module *wasmtime.Module
+	m, err := modules.Acquire(user, key, digest.FromBytes(wasm), func() (*compiledModule, error) {
+		m := &compiledModule{}
+		if precompiled != nil {
+			if module = deserializeModule(engine, precompiled); module != nil {
+				m.precompiled = true
+			} else {
+				m.warnings = append(m.warnings, "the precompiled code was built for another target or wasmtime version, the module was compiled instead")
+			}
+		}
+		if module == nil {
+			var err error
+			if module, err = wasmtime.NewModule(engine, wasm); err != nil {
+				return nil, fmt.Errorf("failed to compile module: %v", err)
+			}
+		}
+
+		var err error
+		if m.code, err = module.Serialize(); err != nil {
+			return nil, fmt.Errorf("failed to serialize compiled module: %v", err)
+		}
+		return m, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the code compiled by another task is deserialized into this one's
+	// engine
+	if module == nil {
+		if module, err = wasmtime.NewModuleDeserialize(engine, m.code); err != nil {
+			modules.Release(user)
+			return nil, fmt.Errorf("failed to load compiled module: %v", err)
+		}
+	}
+	diag.Precompiled = m.precompiled
+	diag.CodeSize = int64(len(m.code))
+	diag.Warnings = append(diag.Warnings, m.warnings...)
+	return module, nil
+}
+
+// attributes returns the diagnostics as task attributes
+func (c *compileDiagnostics) attributes() map[string]string {
+	attrs := map[string]string{}
+	if c == nil {
+		return attrs
+	}
+	attrs["compile.strategy"] = c.Strategy
+	attrs["compile.opt_level"] = c.OptLevel
+	attrs["compile.code_size"] = strconv.FormatInt(c.CodeSize, 10)
+	attrs["compile.duration_ms"] = strconv.FormatFloat(c.Duration.Seconds()*1000, 'f', 3, 64)
+	attrs["compile.precompiled"] = strconv.FormatBool(c.Precompiled)
+	if len(c.Warnings) != 0 {
+		attrs["compile.warnings"] = strings.Join(c.Warnings, "; ")
+	}
+	return attrs
+}
+
+func (c *compileDiagnostics) String() string {
+	how := fmt.Sprintf("compiled with %s (optimize %s) in %s", c.Strategy, c.OptLevel, c.Duration.Round(time.Millisecond))
+	if c.Precompiled {
+		how = "loaded from precompiled code in " + c.Duration.Round(time.Millisecond).String()
+	}
+	s := fmt.Sprintf("Module %s, %s of code", how, humanize.IBytes(uint64(c.CodeSize)))
+	if len(c.Warnings) != 0 {
+		s += ": " + strings.Join(c.Warnings, "; ")
+	}
+	return s
+}
+
+// logCompileDiagnostics logs how the task's module was compiled, at debug
+// level
+func logCompileDiagnostics(logger hclog.Logger, taskID string, diag *compileDiagnostics) {
+	logger.Debug("compiled module", "task_id", taskID, "strategy", diag.Strategy, "opt_level", diag.OptLevel,
+		"code_size", diag.CodeSize, "duration", diag.Duration, "precompiled", diag.Precompiled, "warnings", diag.Warnings)
+}
+
+// emitCompileDiagnostics sends a "Module compiled" event for the task
+func (d *Driver) emitCompileDiagnostics(cfg *drivers.TaskConfig, diag *compileDiagnostics) {
+	err := d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:      cfg.ID,
+		AllocID:     cfg.AllocID,
+		TaskName:    cfg.Name,
+		Timestamp:   time.Now(),
+		Message:     diag.String(),
+		Annotations: diag.attributes(),
+	})
+	if err != nil {
+		d.logger.Warn("failed to emit compile diagnostics", "task_id", cfg.ID, "error", err)
+	}
+}
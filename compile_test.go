@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/blessanabraham/nomad-driver-wasmtime/api"
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/stretchr/testify/require"
+)
+
+// speed is the default compiler config of tasks
+var speed = WasmTimeCompiler{CraneLiftOptions: CraneLiftOptions{OptLevel: api.OptLevelSpeed}}
+
+func TestEngineConfig(t *testing.T) {
+	_, diag, err := engineConfig(speed, nil)
+	require.NoError(t, err)
+	require.Equal(t, strategyAuto, diag.Strategy)
+	require.Equal(t, "speed", diag.OptLevel)
+	require.Empty(t, diag.Warnings)
+
+	_, diag, err = engineConfig(WasmTimeCompiler{
+		Strategy: strategyCranelift,
+		CraneLiftOptions: CraneLiftOptions{
+			OptLevel:            api.OptLevelNone,
+			DebugVerifier:       true,
+			NANCanonicalization: true,
+		},
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, strategyCranelift, diag.Strategy)
+	require.Equal(t, "none", diag.OptLevel)
+	require.Len(t, diag.Warnings, 3)
+
+	_, _, err = engineConfig(WasmTimeCompiler{Strategy: "lightbeam"}, nil)
+	require.EqualError(t, err, `unknown compiler strategy "lightbeam"`)
+	_, _, err = engineConfig(WasmTimeCompiler{CraneLiftOptions: CraneLiftOptions{OptLevel: 7}}, nil)
+	require.Error(t, err)
+}
+
+func TestCompileModule(t *testing.T) {
+	wasm, err := wasmtime.Wat2Wasm(`(module (func (export "run")))`)
+	require.NoError(t, err)
+
+	config, diag, err := engineConfig(speed, nil)
+	require.NoError(t, err)
+	engine, module, err := compileModule(newModuleCache(), "id", engineKey(speed, nil), config, wasm, nil, &taskLimits{}, diag)
+	require.NoError(t, err)
+	require.NotNil(t, engine)
+	require.NotNil(t, module)
+	require.False(t, diag.Precompiled)
+	require.NotZero(t, diag.CodeSize)
+	require.NotZero(t, diag.Duration)
+
+	attrs := diag.attributes()
+	require.Equal(t, "auto", attrs["compile.strategy"])
+	require.Equal(t, "false", attrs["compile.precompiled"])
+	require.NotContains(t, attrs, "compile.warnings")
+	require.Contains(t, diag.String(), "Module compiled with auto")
+
+	// code compiled by an engine with the same config is deserialized
+	precompiled, err := module.Serialize()
+	require.NoError(t, err)
+	config, diag, err = engineConfig(speed, nil)
+	require.NoError(t, err)
+	_, _, err = compileModule(newModuleCache(), "id", engineKey(speed, nil), config, wasm, precompiled, &taskLimits{}, diag)
+	require.NoError(t, err)
+	require.True(t, diag.Precompiled)
+	require.Contains(t, diag.String(), "precompiled code")
+
+	// and unusable code is compiled instead
+	config, diag, err = engineConfig(speed, nil)
+	require.NoError(t, err)
+	_, _, err = compileModule(newModuleCache(), "id", engineKey(speed, nil), config, wasm, []byte("garbage"), &taskLimits{}, diag)
+	require.NoError(t, err)
+	require.False(t, diag.Precompiled)
+	require.Len(t, diag.Warnings, 1)
+
+	config, diag, err = engineConfig(speed, nil)
+	require.NoError(t, err)
+	_, _, err = compileModule(newModuleCache(), "id", engineKey(speed, nil), config, []byte("not wasm"), nil, &taskLimits{}, diag)
+	require.Error(t, err)
+
+	require.Empty(t, (*compileDiagnostics)(nil).attributes())
+}
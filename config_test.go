@@ -1,9 +1,9 @@
 package main
 
 import (
-	"github.com/bytecodealliance/wasmtime-go"
 	"testing"
 
+	"github.com/blessanabraham/nomad-driver-wasmtime/api"
 	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
 	"github.com/stretchr/testify/require"
 )
@@ -21,13 +21,17 @@ func TestConfig_ParseHCL(t *testing.T) {
 				file = "add.wasm"
 			}`,
 			&TaskConfig{
+				File:      "add.wasm",
+				ImagePath: "/app.wasm",
 				Compiler: WasmTimeCompiler{
 					Strategy: "auto",
+					Cache:    true,
 					CraneLiftOptions: CraneLiftOptions{
-						OptLevel: wasmtime.OptLevelSpeed,
+						OptLevel: api.OptLevelSpeed,
 					},
 				},
 				Profiler: "none",
+				Mounts:   []TaskMountConfig{},
 			},
 		},
 		{
@@ -39,20 +43,134 @@ func TestConfig_ParseHCL(t *testing.T) {
 				},
 			}`,
 			&TaskConfig{
+				File:      "add.wasm",
+				ImagePath: "/app.wasm",
 				Compiler: WasmTimeCompiler{
 					Strategy: "cranelift",
+					Cache:    true,
 					CraneLiftOptions: CraneLiftOptions{
 						DebugVerifier:       false,
-						OptLevel:            wasmtime.OptLevelSpeed,
+						OptLevel:            api.OptLevelSpeed,
 						NANCanonicalization: false,
 					},
 				},
 				Profiler: "none",
+				Mounts:   []TaskMountConfig{},
+			},
+		},
+		{
+			"full schema",
+			`config {
+				file = "app.wasm"
+				args = ["-v", "--color"]
+				env {
+					LOG_LEVEL = "debug"
+				}
+				wasi {
+					env_inherit  = true
+					capabilities = ["wasi", "keyvalue"]
+					preopens {
+						"/data" = "local/data"
+					}
+				}
+				limits {
+					memory   = "64MiB"
+					fuel     = 1000000
+					deadline = "30s"
+				}
+				preallocate_memory = true
+				http {
+					allowed_hosts = ["api.example.com"]
+					task_api      = true
+					client_cert {
+						cert_file = "secrets/client.crt"
+						key_file  = "secrets/client.key"
+					}
+					rewrite {
+						host    = "api.example.com"
+						address = "10.0.0.5:8443"
+					}
+				}
+				artifact {
+					checksum = "sha256:abc"
+				}
+				serve {
+					port_label   = "http"
+					idle_timeout = "5m"
+					warm         = true
+				}
+				keyvalue {}
+				identity {
+					file = true
+				}
+			}`,
+			&TaskConfig{
+				File:      "app.wasm",
+				ImagePath: "/app.wasm",
+				Compiler: WasmTimeCompiler{
+					Strategy: "auto",
+					Cache:    true,
+					CraneLiftOptions: CraneLiftOptions{
+						OptLevel: api.OptLevelSpeed,
+					},
+				},
+				Profiler: "none",
+				Args:     []string{"-v", "--color"},
+				Env:      hclutils.MapStrStr{"LOG_LEVEL": "debug"},
+				WASI: TaskWASIConfig{
+					EnvInherit:   true,
+					Preopens:     hclutils.MapStrStr{"/data": "local/data"},
+					Capabilities: []string{"wasi", "keyvalue"},
+				},
+				Limits: TaskLimitsConfig{
+					Memory:   "64MiB",
+					Fuel:     1000000,
+					Deadline: "30s",
+				},
+				PreallocateMemory: true,
+				HTTP: TaskHTTPConfig{
+					AllowedHosts: []string{"api.example.com"},
+					TaskAPI:      true,
+					ClientCert:   &TaskHTTPClientCertConfig{CertFile: "secrets/client.crt", KeyFile: "secrets/client.key"},
+					Rewrite:      []TaskHTTPRewriteConfig{{Host: "api.example.com", Address: "10.0.0.5:8443"}},
+				},
+				Artifact: TaskArtifactConfig{Checksum: "sha256:abc"},
+				Serve:    TaskServeConfig{PortLabel: "http", IdleTimeout: "5m", Warm: true},
+				KeyValue: TaskKeyValueConfig{Backend: "consul"},
+				Identity: TaskIdentityConfig{File: true},
+				Mounts:   []TaskMountConfig{},
 			},
 		},
 	}
 
 	parser := hclutils.NewConfigParser(taskConfigSpec)
+	var tc *TaskConfig
+	parser.ParseHCL(t, `config {
+		file = "app.wasm"
+		wasi {
+			env_inherit = ["APP_*", "LANG"]
+		}
+	}`, &tc)
+	require.Equal(t, []interface{}{"APP_*", "LANG"}, tc.WASI.EnvInherit)
+
+	tc = nil
+	parser.ParseHCL(t, `config {
+		file = "app.wasm"
+		mount {
+			host_path  = "/srv/data"
+			guest_path = "/data"
+		}
+		mount {
+			host_path  = "/etc/ssl/certs"
+			guest_path = "/certs"
+			readonly   = true
+		}
+	}`, &tc)
+	require.Equal(t, []TaskMountConfig{
+		{HostPath: "/srv/data", GuestPath: "/data"},
+		{HostPath: "/etc/ssl/certs", GuestPath: "/certs", Readonly: true},
+	}, tc.Mounts)
+
 	for _, c := range cases {
 		c := c
 		t.Run(c.name, func(t *testing.T) {
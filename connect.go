@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+)
+
+const (
+	// connectUpstreamAddrPrefix prefixes the variables Nomad sets to the
+	// local address of each Consul Connect upstream of the task's group,
+	// followed by the upstream's destination name
+	connectUpstreamAddrPrefix = "NOMAD_UPSTREAM_ADDR_"
+
+	connectUpstreamIPPrefix   = "NOMAD_UPSTREAM_IP_"
+	connectUpstreamPortPrefix = "NOMAD_UPSTREAM_PORT_"
+)
+
+// connectUpstream is a Consul Connect upstream, reached through the local
+// listener of the group's sidecar proxy
+type connectUpstream struct {
+	name string
+	host string
+	port string
+}
+
+// connectUpstreams returns the upstreams of the task's group, by name, from
+// the task's environment
+func connectUpstreams(env map[string]string) []connectUpstream {
+	var upstreams []connectUpstream
+	for k, v := range env {
+		if !strings.HasPrefix(k, connectUpstreamAddrPrefix) {
+			continue
+		}
+		host, port, err := net.SplitHostPort(v)
+		if err != nil || port == "" {
+			continue
+		}
+		upstreams = append(upstreams, connectUpstream{
+			name: strings.TrimPrefix(k, connectUpstreamAddrPrefix),
+			host: host,
+			port: port,
+		})
+	}
+	sort.Slice(upstreams, func(i, j int) bool { return upstreams[i].name < upstreams[j].name })
+	return upstreams
+}
+
+// addrs returns the host:port the guest may reach the upstream at. Sidecars
+// listen on loopback, which guests may also name localhost.
+func (u connectUpstream) addrs() []string {
+	addrs := []string{net.JoinHostPort(u.host, u.port)}
+	if ip := net.ParseIP(u.host); ip != nil && ip.IsLoopback() {
+		addrs = append(addrs, net.JoinHostPort("localhost", u.port))
+	}
+	return addrs
+}
+
+// upstreamEnv returns the variables locating the upstreams, which the
+// guest gets whatever wasi.env_inherit matches
+func upstreamEnv(upstreams []connectUpstream) map[string]string {
+	env := make(map[string]string, 3*len(upstreams))
+	for _, u := range upstreams {
+		env[connectUpstreamAddrPrefix+u.name] = net.JoinHostPort(u.host, u.port)
+		env[connectUpstreamIPPrefix+u.name] = u.host
+		env[connectUpstreamPortPrefix+u.name] = u.port
+	}
+	return env
+}
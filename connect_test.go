@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectUpstreams(t *testing.T) {
+	upstreams := connectUpstreams(map[string]string{
+		"NOMAD_UPSTREAM_ADDR_payments": "127.0.0.1:8081",
+		"NOMAD_UPSTREAM_ADDR_db":       "[::1]:5432",
+		"NOMAD_UPSTREAM_ADDR_broken":   "nowhere",
+		"NOMAD_UPSTREAM_IP_payments":   "127.0.0.1",
+		"NOMAD_TASK_NAME":              "task",
+	})
+	require.Equal(t, []connectUpstream{
+		{name: "db", host: "::1", port: "5432"},
+		{name: "payments", host: "127.0.0.1", port: "8081"},
+	}, upstreams)
+
+	require.Equal(t, []string{"[::1]:5432", "localhost:5432"}, upstreams[0].addrs())
+	require.Equal(t, map[string]string{
+		"NOMAD_UPSTREAM_ADDR_payments": "127.0.0.1:8081",
+		"NOMAD_UPSTREAM_IP_payments":   "127.0.0.1",
+		"NOMAD_UPSTREAM_PORT_payments": "8081",
+	}, upstreamEnv(upstreams[1:]))
+
+	// the guest gets the upstreams without inheriting the environment
+	env, err := guestEnv(&drivers.TaskConfig{Env: map[string]string{"NOMAD_UPSTREAM_ADDR_db": "127.0.0.1:5432"}}, &TaskConfig{}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "5432", env["NOMAD_UPSTREAM_PORT_db"])
+}
+
+func TestHTTPHost_ConnectUpstreams(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer srv.Close()
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	require.NoError(t, err)
+
+	cfg := &drivers.TaskConfig{
+		Name:     "task",
+		AllocDir: t.TempDir(),
+		Env:      map[string]string{"NOMAD_UPSTREAM_ADDR_api": srv.Listener.Addr().String()},
+	}
+
+	// linked without an http block, if granted
+	d := &Driver{config: &Config{}, kvBackends: map[string]kvBackend{}}
+	hosts, err := d.newHostModules(cfg, &TaskConfig{WASI: TaskWASIConfig{Capabilities: []string{capabilityWASI}}})
+	require.NoError(t, err)
+	require.Empty(t, hosts)
+	hosts, err = d.newHostModules(cfg, &TaskConfig{})
+	require.NoError(t, err)
+	require.Len(t, hosts, 1)
+	defer closeHostModules(hosts)
+
+	host := hosts[0].(*httpHost)
+	errno, _, body := httpGet(t, host, "http://localhost:"+port+"/")
+	require.Equal(t, httpSuccess, errno)
+	require.Equal(t, "upstream", body)
+
+	// only the upstream's port is allowed
+	require.True(t, host.allowedURL(&url.URL{Host: "127.0.0.1:" + port}))
+	require.False(t, host.allowedURL(&url.URL{Host: "127.0.0.1:1"}))
+	require.False(t, host.allowedURL(&url.URL{Host: "127.0.0.1"}))
+}
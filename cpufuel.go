@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// The cpu_fuel.on_exhaustion policies
+const (
+	cpuFuelKill  = "kill"
+	cpuFuelYield = "yield"
+)
+
+const (
+	// defaultCPUFuelBurst is how many seconds of fuel a guest may bank if
+	// cpu_fuel.burst isn't set
+	defaultCPUFuelBurst = time.Second
+
+	// cpuFuelYieldFraction is the share of its burst a yielding guest has
+	// refilled before it carries on
+	cpuFuelYieldFraction = 10
+)
+
+// cpuFuelSettings are the parsed cpu_fuel block of the plugin config
+type cpuFuelSettings struct {
+	fuelPerMHz uint64
+	burst      time.Duration
+	yield      bool
+}
+
+// parseCPUFuel checks the cpu_fuel block, returning nil if guests aren't
+// metered by their cpu
+func parseCPUFuel(config CPUFuelConfig) (*cpuFuelSettings, error) {
+	if config.FuelPerMHz < 0 {
+		return nil, fmt.Errorf("invalid cpu_fuel fuel_per_mhz %d: must not be negative", config.FuelPerMHz)
+	}
+	if config.FuelPerMHz == 0 {
+		return nil, nil
+	}
+	settings := &cpuFuelSettings{fuelPerMHz: uint64(config.FuelPerMHz), burst: defaultCPUFuelBurst}
+	if config.Burst != "" {
+		burst, err := time.ParseDuration(config.Burst)
+		if err != nil || burst <= 0 {
+			return nil, fmt.Errorf("invalid cpu_fuel burst %q", config.Burst)
+		}
+		settings.burst = burst
+	}
+	switch config.OnExhaustion {
+	case "", cpuFuelKill:
+	case cpuFuelYield:
+		settings.yield = true
+	default:
+		return nil, fmt.Errorf("invalid cpu_fuel on_exhaustion %q: must be %q or %q", config.OnExhaustion, cpuFuelKill, cpuFuelYield)
+	}
+	return settings, nil
+}
+
+// cpuFuel meters a guest's fuel by the cpu shares of its task: the guest
+// earns fuel at a rate of fuel_per_mhz per MHz each second, banking up to
+// its burst. Fuel is only refilled at host calls, where the store can be
+// touched, so a guest computing for longer than its burst without calling
+// the host runs out of fuel and traps. At a host call, a yielding guest
+// drained of its fuel waits until it earned some back.
+type cpuFuel struct {
+	mhz        uint64
+	fuelPerMHz uint64
+	rate       float64
+	capacity   uint64
+	yield      bool
+	now        func() time.Time
+	sleep      func(time.Duration)
+
+	// last is when fuel was last earned, credit the fraction of a unit
+	// earned since. They're only used by the guest's goroutine.
+	last   time.Time
+	credit float64
+
+	lock             sync.Mutex
+	consumed         uint64
+	throttledPeriods uint64
+	throttledTime    time.Duration
+
+	// sampledAt and sampledFuel are the time and fuel consumed of the last
+	// usage sample
+	sampledAt   time.Time
+	sampledFuel uint64
+}
+
+// newCPUFuel returns the fuel meter of the task, nil if the plugin doesn't
+// meter guests or the task has no cpu
+func newCPUFuel(settings *cpuFuelSettings, cfg *drivers.TaskConfig) *cpuFuel {
+	if settings == nil || cfg.Resources == nil || cfg.Resources.NomadResources == nil {
+		return nil
+	}
+	mhz := cfg.Resources.NomadResources.Cpu.CpuShares
+	if mhz <= 0 {
+		return nil
+	}
+	rate := float64(uint64(mhz) * settings.fuelPerMHz)
+	return &cpuFuel{
+		mhz:        uint64(mhz),
+		fuelPerMHz: settings.fuelPerMHz,
+		rate:       rate,
+		capacity:   uint64(rate * settings.burst.Seconds()),
+		yield:      settings.yield,
+		now:        time.Now,
+		sleep:      time.Sleep,
+		last:       time.Now(),
+	}
+}
+
+// earn returns the whole units of fuel earned since last
+func (f *cpuFuel) earn() uint64 {
+	now := f.now()
+	f.credit += f.rate * now.Sub(f.last).Seconds()
+	f.last = now
+	earned := uint64(f.credit)
+	f.credit -= float64(earned)
+	return earned
+}
+
+// refill gives store the fuel the guest earned since the last refill, up
+// to its burst, first waiting for it if the guest yields and is drained.
+// It must be called from the goroutine running the guest, at a host call.
+func (f *cpuFuel) refill(store *wasmtime.Store) error {
+	remaining, err := store.ConsumeFuel(0)
+	if err != nil {
+		return err
+	}
+	level := remaining + f.earn()
+	if low := f.capacity / cpuFuelYieldFraction; f.yield && level < low {
+		wait := time.Duration(float64(low-level) / f.rate * float64(time.Second))
+		f.sleep(wait)
+		level += f.earn()
+
+		f.lock.Lock()
+		f.throttledPeriods++
+		f.throttledTime += wait
+		f.lock.Unlock()
+	}
+	if level > f.capacity {
+		level = f.capacity
+	}
+	if level > remaining {
+		if err := store.AddFuel(level - remaining); err != nil {
+			return err
+		}
+	}
+	consumed, _ := store.FuelConsumed()
+	f.setConsumed(consumed)
+	return nil
+}
+
+// setConsumed records the fuel the guest consumed
+func (f *cpuFuel) setConsumed(consumed uint64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.consumed = consumed
+}
+
+// fuelConsumed returns the fuel the guest consumed, as of its last host
+// call
+func (f *cpuFuel) fuelConsumed() uint64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.consumed
+}
+
+// usage returns the cpu stats of the guest at now: the MHz its fuel
+// consumption since the last sample amounts to, and how long it yielded
+func (f *cpuFuel) usage(now time.Time) *drivers.CpuStats {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	cs := &drivers.CpuStats{
+		ThrottledPeriods: f.throttledPeriods,
+		ThrottledTime:    uint64(f.throttledTime),
+		Measured:         []string{"Throttled Periods", "Throttled Time", "Total Ticks"},
+	}
+	if elapsed := now.Sub(f.sampledAt).Seconds(); !f.sampledAt.IsZero() && elapsed > 0 {
+		cs.TotalTicks = float64(f.consumed-f.sampledFuel) / float64(f.fuelPerMHz) / elapsed
+	}
+	f.sampledAt, f.sampledFuel = now, f.consumed
+	return cs
+}
+
+// isFuelExhaustion returns whether err is the trap of a guest out of fuel
+func isFuelExhaustion(err error) bool {
+	return strings.Contains(err.Error(), "all fuel consumed")
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+// spinWat loops without calling the host
+const spinWat = `
+(module
+  (memory (export "memory") 1)
+  (func (export "_start") (loop br 0))
+)`
+
+// yieldWat calls sched_yield 5000 times
+const yieldWat = `
+(module
+  (import "wasi_snapshot_preview1" "sched_yield" (func $yield (result i32)))
+  (memory (export "memory") 1)
+  (func (export "_start") (local $i i32)
+    (loop
+      (drop (call $yield))
+      (local.set $i (i32.add (local.get $i) (i32.const 1)))
+      (br_if 0 (i32.lt_u (local.get $i) (i32.const 5000)))))
+)`
+
+// withCPU returns cfg with mhz of cpu
+func withCPU(cfg *drivers.TaskConfig, mhz int64) *drivers.TaskConfig {
+	cfg.Resources = &drivers.Resources{NomadResources: &structs.AllocatedTaskResources{
+		Cpu: structs.AllocatedCpuResources{CpuShares: mhz},
+	}}
+	return cfg
+}
+
+func TestParseCPUFuel(t *testing.T) {
+	settings, err := parseCPUFuel(CPUFuelConfig{})
+	require.NoError(t, err)
+	require.Nil(t, settings)
+	settings, err = parseCPUFuel(CPUFuelConfig{FuelPerMHz: 1000})
+	require.NoError(t, err)
+	require.Equal(t, &cpuFuelSettings{fuelPerMHz: 1000, burst: defaultCPUFuelBurst}, settings)
+	settings, err = parseCPUFuel(CPUFuelConfig{FuelPerMHz: 1000, Burst: "250ms", OnExhaustion: "yield"})
+	require.NoError(t, err)
+	require.Equal(t, &cpuFuelSettings{fuelPerMHz: 1000, burst: 250 * time.Millisecond, yield: true}, settings)
+
+	for _, config := range []CPUFuelConfig{
+		{FuelPerMHz: -1},
+		{FuelPerMHz: 1000, Burst: "soon"},
+		{FuelPerMHz: 1000, Burst: "0s"},
+		{FuelPerMHz: 1000, OnExhaustion: "pause"},
+	} {
+		_, err := parseCPUFuel(config)
+		require.Error(t, err, "%+v", config)
+	}
+}
+
+func TestNewCPUFuel(t *testing.T) {
+	settings := &cpuFuelSettings{fuelPerMHz: 1000, burst: 2 * time.Second}
+	require.Nil(t, newCPUFuel(nil, withCPU(&drivers.TaskConfig{}, 100)))
+	require.Nil(t, newCPUFuel(settings, &drivers.TaskConfig{}))
+	require.Nil(t, newCPUFuel(settings, withCPU(&drivers.TaskConfig{}, 0)))
+
+	f := newCPUFuel(settings, withCPU(&drivers.TaskConfig{}, 100))
+	require.Equal(t, 100000.0, f.rate)
+	require.Equal(t, uint64(200000), f.capacity)
+}
+
+func TestCPUFuel_Refill(t *testing.T) {
+	config := wasmtime.NewConfig()
+	config.SetConsumeFuel(true)
+	store := wasmtime.NewStore(wasmtime.NewEngineWithConfig(config))
+
+	now := time.Unix(0, 0)
+	var slept time.Duration
+	f := newCPUFuel(&cpuFuelSettings{fuelPerMHz: 1000, burst: time.Second}, withCPU(&drivers.TaskConfig{}, 1))
+	f.now = func() time.Time { return now }
+	f.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	f.last = now
+	require.NoError(t, store.AddFuel(f.capacity))
+
+	// fuel is earned back at the task's rate, up to the burst
+	_, err := store.ConsumeFuel(600)
+	require.NoError(t, err)
+	now = now.Add(250 * time.Millisecond)
+	require.NoError(t, f.refill(store))
+	remaining, _ := store.ConsumeFuel(0)
+	require.Equal(t, uint64(650), remaining)
+	require.Equal(t, uint64(600), f.fuelConsumed())
+	now = now.Add(time.Hour)
+	require.NoError(t, f.refill(store))
+	remaining, _ = store.ConsumeFuel(0)
+	require.Equal(t, uint64(1000), remaining)
+	require.Zero(t, slept)
+
+	// a drained guest only waits if it yields
+	_, err = store.ConsumeFuel(950)
+	require.NoError(t, err)
+	require.NoError(t, f.refill(store))
+	require.Zero(t, slept)
+	f.yield = true
+	require.NoError(t, f.refill(store))
+	require.Equal(t, 50*time.Millisecond, slept)
+	remaining, _ = store.ConsumeFuel(0)
+	require.Equal(t, uint64(100), remaining)
+
+	cs := f.usage(now)
+	require.Equal(t, uint64(1), cs.ThrottledPeriods)
+	require.Equal(t, uint64(50*time.Millisecond), cs.ThrottledTime)
+	require.Zero(t, cs.TotalTicks)
+
+	// the fuel consumed between two samples is reported in MHz
+	f.yield = false
+	_, err = store.ConsumeFuel(90)
+	require.NoError(t, err)
+	require.NoError(t, f.refill(store))
+	require.Equal(t, 90.0/1000, f.usage(now.Add(time.Second)).TotalTicks)
+}
+
+func TestStartTask_CPUFuelKill(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{
+		DataDir: t.TempDir(),
+		Logging: LoggingConfig{DisableCollection: true},
+		CPUFuel: CPUFuelConfig{FuelPerMHz: 1000},
+	}))
+	wasm, err := wasmtime.Wat2Wasm(spinWat)
+	require.NoError(t, err)
+	cfg := withCPU(newTestTask(t, wasm), 100)
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{File: "main.wasm"}))
+	_, _, err = d.StartTask(cfg)
+	require.NoError(t, err)
+
+	require.Equal(t, 1, waitTestTask(t, d, cfg.ID).ExitCode)
+	h, ok := d.tasks.Get(cfg.ID)
+	require.True(t, ok)
+	h.stateLock.RLock()
+	trap := h.trap
+	h.stateLock.RUnlock()
+	require.Error(t, trap)
+	require.Contains(t, trap.Error(), "guest used up the fuel of its 100 MHz of cpu")
+	require.Equal(t, "100000", h.TaskStatus().DriverAttributes["fuel_consumed"])
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
+
+func TestStartTask_CPUFuelYield(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{
+		DataDir: t.TempDir(),
+		Logging: LoggingConfig{DisableCollection: true},
+		CPUFuel: CPUFuelConfig{FuelPerMHz: 100000, Burst: "50ms", OnExhaustion: "yield"},
+	}))
+	wasm, err := wasmtime.Wat2Wasm(yieldWat)
+	require.NoError(t, err)
+	cfg := withCPU(newTestTask(t, wasm), 1)
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{File: "main.wasm"}))
+	_, _, err = d.StartTask(cfg)
+	require.NoError(t, err)
+
+	// the guest is throttled to its cpu rather than killed
+	require.Equal(t, 0, waitTestTask(t, d, cfg.ID).ExitCode)
+	h, ok := d.tasks.Get(cfg.ID)
+	require.True(t, ok)
+	require.NotZero(t, h.cpuFuel.usage(time.Now()).ThrottledPeriods)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
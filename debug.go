@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	// debugIndexFile lists the debug artifacts the driver wrote to an alloc
+	// dir, so retention only ever deletes the driver's own files
+	debugIndexFile = ".wasmtime-debug.json"
+
+	// debugJanitorInterval is how often the janitor expires old artifacts
+	debugJanitorInterval = 10 * time.Minute
+)
+
+// debugMemoryDump is the kind of the dumps written by :dump-memory
+const debugMemoryDump = "memory_dump"
+
+// debugArtifact is a file the driver wrote to an alloc dir for debugging
+type debugArtifact struct {
+	// Path is relative to the alloc dir
+	Path    string    `json:"path"`
+	Kind    string    `json:"kind"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+// debugRetention bounds the debug artifacts kept in each alloc dir. Zero
+// values don't bound them.
+type debugRetention struct {
+	maxCount int
+	maxSize  int64
+	maxAge   time.Duration
+}
+
+// parseDebugRetention parses the debug_retention block of the plugin config
+func parseDebugRetention(config DebugRetentionConfig) (debugRetention, error) {
+	r := debugRetention{maxCount: config.MaxCount}
+	if config.MaxCount < 0 {
+		return r, fmt.Errorf("invalid max_count %d: must not be negative", config.MaxCount)
+	}
+	if config.MaxSize != "" {
+		size, err := humanize.ParseBytes(config.MaxSize)
+		if err != nil {
+			return r, fmt.Errorf("invalid max_size %q: %v", config.MaxSize, err)
+		}
+		r.maxSize = int64(size)
+	}
+	if config.MaxAge != "" {
+		age, err := time.ParseDuration(config.MaxAge)
+		if err != nil || age < 0 {
+			return r, fmt.Errorf("invalid max_age %q", config.MaxAge)
+		}
+		r.maxAge = age
+	}
+	return r, nil
+}
+
+// debugArtifacts applies the retention to the debug artifacts of alloc
+// dirs. Its lock serializes the updates of the indexes.
+type debugArtifacts struct {
+	lock      sync.Mutex
+	retention debugRetention
+
+	// now is overridden in tests
+	now func() time.Time
+}
+
+func newDebugArtifacts() *debugArtifacts {
+	return &debugArtifacts{now: time.Now}
+}
+
+// SetRetention sets the retention applied from now on
+func (a *debugArtifacts) SetRetention(r debugRetention) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.retention = r
+}
+
+func loadDebugIndex(allocDir string) ([]*debugArtifact, error) {
+	b, err := ioutil.ReadFile(filepath.Join(allocDir, debugIndexFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var index []*debugArtifact
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, fmt.Errorf("invalid debug index: %v", err)
+	}
+	return index, nil
+}
+
+func saveDebugIndex(allocDir string, index []*debugArtifact) error {
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(allocDir, debugIndexFile)
+	if err := ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Record adds the artifact at path, relative to allocDir, to its index and
+// applies the retention, which may delete older artifacts
+func (a *debugArtifacts) Record(allocDir, kind, path string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	fi, err := os.Stat(filepath.Join(allocDir, path))
+	if err != nil {
+		return err
+	}
+	index, err := loadDebugIndex(allocDir)
+	if err != nil {
+		return err
+	}
+	// a path written again replaces its entry
+	kept := index[:0]
+	for _, e := range index {
+		if e.Path != path {
+			kept = append(kept, e)
+		}
+	}
+	index = append(kept, &debugArtifact{Path: path, Kind: kind, Size: fi.Size(), Created: a.now()})
+	return a.pruneLocked(allocDir, index)
+}
+
+// Prune applies the retention to the artifacts of allocDir
+func (a *debugArtifacts) Prune(allocDir string) error {
+	if allocDir == "" {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	index, err := loadDebugIndex(allocDir)
+	if err != nil || index == nil {
+		return err
+	}
+	return a.pruneLocked(allocDir, index)
+}
+
+// pruneLocked deletes the artifacts past their age and then the oldest
+// ones until the rest are within the count and size, and saves the index
+func (a *debugArtifacts) pruneLocked(allocDir string, index []*debugArtifact) error {
+	sort.SliceStable(index, func(i, j int) bool { return index[i].Created.Before(index[j].Created) })
+
+	var total int64
+	for _, e := range index {
+		total += e.Size
+	}
+
+	r := a.retention
+	now := a.now()
+	var deleted int
+	for len(index) > 0 {
+		oldest := index[0]
+		expired := r.maxAge != 0 && now.Sub(oldest.Created) > r.maxAge
+		if !expired && (r.maxCount == 0 || len(index) <= r.maxCount) && (r.maxSize == 0 || total <= r.maxSize) {
+			break
+		}
+		if err := os.Remove(filepath.Join(allocDir, oldest.Path)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= oldest.Size
+		index = index[1:]
+		deleted++
+	}
+	metrics.IncrCounter([]string{"wasmtime", "debug_artifacts", "deleted"}, float32(deleted))
+	return saveDebugIndex(allocDir, index)
+}
+
+// recordDebugArtifact records an artifact written to the alloc dir of h,
+// only logging failures as the artifact itself was written
+func (d *Driver) recordDebugArtifact(h *TaskHandle, kind, path string) {
+	if err := d.debug.Record(h.taskConfig.AllocDir, kind, path); err != nil {
+		d.logger.Warn("failed to apply debug artifact retention", "task_id", h.taskConfig.ID, "path", path, "error", err)
+	}
+}
+
+// expireDebugArtifacts applies the retention to the alloc dirs of all
+// tasks every interval until ctx is done, so artifacts expire even if no
+// new ones are written
+func (d *Driver) expireDebugArtifacts(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, h := range d.tasks.List() {
+				if err := d.debug.Prune(h.taskConfig.AllocDir); err != nil {
+					d.logger.Warn("failed to expire debug artifacts", "task_id", h.taskConfig.ID, "error", err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDebugRetention(t *testing.T) {
+	r, err := parseDebugRetention(DebugRetentionConfig{MaxCount: 3, MaxSize: "1MiB", MaxAge: "24h"})
+	require.NoError(t, err)
+	require.Equal(t, debugRetention{maxCount: 3, maxSize: 1 << 20, maxAge: 24 * time.Hour}, r)
+
+	r, err = parseDebugRetention(DebugRetentionConfig{})
+	require.NoError(t, err)
+	require.Zero(t, r)
+
+	for _, c := range []DebugRetentionConfig{{MaxCount: -1}, {MaxSize: "big"}, {MaxAge: "-1h"}} {
+		_, err := parseDebugRetention(c)
+		require.Error(t, err, "%+v", c)
+	}
+}
+
+func TestDebugArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	a := newDebugArtifacts()
+	a.now = func() time.Time { return now }
+
+	write := func(name string, size int) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), make([]byte, size), 0600))
+		require.NoError(t, a.Record(dir, debugMemoryDump, name))
+		now = now.Add(time.Minute)
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+
+	// unbounded by default
+	write("dumps/1", 10)
+	write("dumps/2", 10)
+	require.True(t, exists("dumps/1"))
+
+	// the oldest go first
+	a.SetRetention(debugRetention{maxCount: 2})
+	write("dumps/3", 10)
+	require.False(t, exists("dumps/1"))
+	require.True(t, exists("dumps/2"))
+	require.True(t, exists("dumps/3"))
+
+	a.SetRetention(debugRetention{maxSize: 25})
+	write("dumps/4", 10)
+	require.False(t, exists("dumps/2"))
+	require.True(t, exists("dumps/3"))
+
+	// files the driver didn't write are left alone
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "output"), []byte("keep"), 0600))
+
+	a.SetRetention(debugRetention{maxAge: 150 * time.Second})
+	now = now.Add(time.Minute)
+	require.NoError(t, a.Prune(dir))
+	require.False(t, exists("dumps/3"))
+	require.True(t, exists("dumps/4"))
+	require.True(t, exists("output"))
+
+	index, err := loadDebugIndex(dir)
+	require.NoError(t, err)
+	require.Len(t, index, 1)
+	require.Equal(t, "dumps/4", index[0].Path)
+	require.EqualValues(t, 10, index[0].Size)
+
+	// dirs without an index are fine
+	require.NoError(t, a.Prune(t.TempDir()))
+	require.NoError(t, a.Prune(""))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// defaultDependsOnTimeout is how long a task waits for the tasks it
+	// depends on unless depends_on_timeout is set
+	defaultDependsOnTimeout = 5 * time.Minute
+
+	// dependsOnPollInterval is how often the tasks depended on are checked
+	dependsOnPollInterval = 250 * time.Millisecond
+)
+
+// dependencyState is how far a task depended on is
+type dependencyState int
+
+const (
+	dependencyPending dependencyState = iota
+	dependencyReady
+	dependencyFailed
+)
+
+// readiness returns whether the task passed its readiness gate: a task run
+// to completion once it exited successfully, a serve task once its
+// listener accepts connections. The listener of forked serve tasks is the
+// runner's, so they're only ready once they exited.
+func (h *TaskHandle) readiness() dependencyState {
+	if res, ok := h.exited(); ok {
+		if res.Successful() {
+			return dependencyReady
+		}
+		return dependencyFailed
+	}
+	if h.serve.isReady() {
+		return dependencyReady
+	}
+	return dependencyPending
+}
+
+// groupTask returns the task of the driver named name in the allocation
+func (d *Driver) groupTask(allocID, name string) *TaskHandle {
+	for _, h := range d.tasks.List() {
+		if h.taskConfig.AllocID == allocID && h.taskConfig.Name == name {
+			return h
+		}
+	}
+	return nil
+}
+
+// waitDependencies blocks until the wasmtime tasks of the task's group
+// named in depends_on are ready. A dependency failing, or not being ready
+// within depends_on_timeout, fails the start with a recoverable error, so
+// the restart policy applies.
+func (d *Driver) waitDependencies(cfg *drivers.TaskConfig, driverConfig *TaskConfig) error {
+	if len(driverConfig.DependsOn) == 0 {
+		return nil
+	}
+	timeout := defaultDependsOnTimeout
+	if driverConfig.DependsOnTimeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(driverConfig.DependsOnTimeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid depends_on_timeout %q", driverConfig.DependsOnTimeout)
+		}
+	}
+	for _, name := range driverConfig.DependsOn {
+		if name == cfg.Name {
+			return fmt.Errorf("task can't depend on itself")
+		}
+	}
+
+	d.logger.Debug("waiting for dependencies", "task_id", cfg.ID, "depends_on", driverConfig.DependsOn)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(dependsOnPollInterval)
+	defer ticker.Stop()
+	pending := append([]string(nil), driverConfig.DependsOn...)
+	for {
+		var waiting []string
+		for _, name := range pending {
+			h := d.groupTask(cfg.AllocID, name)
+			if h == nil {
+				waiting = append(waiting, name)
+				continue
+			}
+			switch h.readiness() {
+			case dependencyPending:
+				waiting = append(waiting, name)
+			case dependencyFailed:
+				return structs.NewRecoverableError(fmt.Errorf("dependency %q failed", name), true)
+			}
+		}
+		if len(waiting) == 0 {
+			return nil
+		}
+		pending = waiting
+
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return structs.NewRecoverableError(fmt.Errorf("dependencies %v weren't ready within %s", pending, timeout), true)
+		case <-d.ctx.Done():
+			return fmt.Errorf("driver is shutting down")
+		}
+	}
+}
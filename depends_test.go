@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitDependencies(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := &drivers.TaskConfig{ID: "app", AllocID: "alloc", Name: "app"}
+	migrate := &TaskHandle{
+		taskConfig: &drivers.TaskConfig{ID: "migrate", AllocID: "alloc", Name: "migrate"},
+		procState:  drivers.TaskStateRunning,
+	}
+	// the same task of another allocation doesn't count
+	other := &TaskHandle{
+		taskConfig:  &drivers.TaskConfig{ID: "other", AllocID: "other", Name: "migrate"},
+		exitResult:  &drivers.ExitResult{},
+		completedAt: time.Now(),
+	}
+	d.tasks.Set(other.taskConfig.ID, other)
+
+	require.NoError(t, d.waitDependencies(cfg, &TaskConfig{}))
+
+	// the migrator isn't started yet, then is running
+	go func() {
+		time.Sleep(2 * dependsOnPollInterval)
+		d.tasks.Set(migrate.taskConfig.ID, migrate)
+		time.Sleep(2 * dependsOnPollInterval)
+		migrate.stateLock.Lock()
+		migrate.procState = drivers.TaskStateExited
+		migrate.exitResult = &drivers.ExitResult{}
+		migrate.completedAt = time.Now()
+		migrate.stateLock.Unlock()
+	}()
+	start := time.Now()
+	require.NoError(t, d.waitDependencies(cfg, &TaskConfig{DependsOn: []string{"migrate"}}))
+	require.True(t, time.Since(start) >= 4*dependsOnPollInterval)
+
+	migrate.stateLock.Lock()
+	migrate.exitResult = &drivers.ExitResult{ExitCode: 1}
+	migrate.stateLock.Unlock()
+	err := d.waitDependencies(cfg, &TaskConfig{DependsOn: []string{"migrate"}})
+	require.EqualError(t, err, `dependency "migrate" failed`)
+	require.True(t, structs.IsRecoverable(err))
+
+	err = d.waitDependencies(cfg, &TaskConfig{DependsOn: []string{"cache"}, DependsOnTimeout: "300ms"})
+	require.EqualError(t, err, "dependencies [cache] weren't ready within 300ms")
+
+	require.Error(t, d.waitDependencies(cfg, &TaskConfig{DependsOn: []string{"app"}}))
+	require.Error(t, d.waitDependencies(cfg, &TaskConfig{DependsOn: []string{"migrate"}, DependsOnTimeout: "soon"}))
+}
+
+func TestStartTask_DependsOn(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	migrate := startTestTask(t, d, helloWat, &TaskConfig{})
+	require.Equal(t, 3, waitTestTask(t, d, migrate.ID).ExitCode)
+
+	// the app isn't started after a failed migration
+	app := &drivers.TaskConfig{ID: "app", AllocID: migrate.AllocID, Name: "app", AllocDir: migrate.AllocDir}
+	require.NoError(t, app.EncodeConcreteDriverConfig(&TaskConfig{File: "main.wasm", DependsOn: []string{migrate.Name}}))
+	_, _, err := d.StartTask(app)
+	require.EqualError(t, err, `dependency "task" failed`)
+	_, ok := d.tasks.Get(app.ID)
+	require.False(t, ok)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// defaultMaxConcurrentDownloads is used when the plugin config doesn't
+	// set max_concurrent_downloads
+	defaultMaxConcurrentDownloads = 3
+
+	// maxThrottledRead caps the size of a single read from a throttled
+	// download, so that the rate limiter can smooth out the transfer
+	maxThrottledRead = 32 << 10
+)
+
+// newHTTPClient returns the client used for all artifact fetches. When proxy
+// settings are configured they are used instead of the environment, which is
+// often stripped for plugin processes; socks5:// proxies are supported too.
+func newHTTPClient(proxy ProxyConfig) (*http.Client, error) {
+	client := cleanhttp.DefaultPooledClient()
+	if proxy == (ProxyConfig{}) {
+		return client, nil
+	}
+
+	for _, u := range []string{proxy.HTTPProxy, proxy.HTTPSProxy} {
+		if u == "" {
+			continue
+		}
+		if _, err := url.Parse(u); err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %q: %v", u, err)
+		}
+	}
+
+	proxyFunc := (&httpproxy.Config{
+		HTTPProxy:  proxy.HTTPProxy,
+		HTTPSProxy: proxy.HTTPSProxy,
+		NoProxy:    proxy.NoProxy,
+	}).ProxyFunc()
+
+	client.Transport.(*http.Transport).Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+	return client, nil
+}
+
+// downloadLimiter bounds the number of artifact downloads the driver runs at
+// the same time and the bandwidth each of them may use, so a wave of new
+// placements can't saturate the node's network. Its limits are changed in
+// place on SetConfig, so downloads in progress keep counting against them.
+type downloadLimiter struct {
+	lock sync.Mutex
+	// limit is the number of downloads that may run at once, running the
+	// number in progress
+	limit   int
+	running int
+	// freed is closed, and replaced, when a slot may have become free
+	freed chan struct{}
+
+	// bandwidth is the per download limit in bytes per second, or 0 when
+	// downloads aren't throttled
+	bandwidth uint64
+}
+
+func newDownloadLimiter(concurrent int, bandwidth uint64) *downloadLimiter {
+	l := &downloadLimiter{freed: make(chan struct{})}
+	l.resize(concurrent, bandwidth)
+	return l
+}
+
+// resize sets the limits of the downloads started from then on. Downloads
+// above a lowered limit complete, new ones wait until they're within it.
+func (l *downloadLimiter) resize(concurrent int, bandwidth uint64) {
+	if concurrent <= 0 {
+		concurrent = defaultMaxConcurrentDownloads
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limit = concurrent
+	l.bandwidth = bandwidth
+	l.notifyLocked()
+}
+
+func (l *downloadLimiter) notifyLocked() {
+	close(l.freed)
+	l.freed = make(chan struct{})
+}
+
+// acquire blocks until a download slot is free or ctx is done. The returned
+// func must be called to release the slot once the download is complete.
+func (l *downloadLimiter) acquire(ctx context.Context) (func(), error) {
+	for {
+		l.lock.Lock()
+		if l.running < l.limit {
+			l.running++
+			l.lock.Unlock()
+			return l.release, nil
+		}
+		freed := l.freed
+		l.lock.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (l *downloadLimiter) release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.running--
+	l.notifyLocked()
+}
+
+// active returns the number of downloads in progress
+func (l *downloadLimiter) active() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.running
+}
+
+// limits returns the concurrency and bandwidth limits
+func (l *downloadLimiter) limits() (int, uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.limit, l.bandwidth
+}
+
+// reader wraps r so reading from it doesn't exceed the bandwidth limit.
+func (l *downloadLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	_, bandwidth := l.limits()
+	if bandwidth == 0 {
+		return r
+	}
+
+	burst := maxThrottledRead
+	if bandwidth < uint64(burst) {
+		burst = int(bandwidth)
+	}
+	return &throttledReader{
+		ctx:     ctx,
+		r:       r,
+		limiter: rate.NewLimiter(rate.Limit(bandwidth), burst),
+	}
+}
+
+// throttledReader is an io.Reader limited by a token bucket where each token
+// is one byte.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > t.limiter.Burst() {
+		p = p[:t.limiter.Burst()]
+	}
+
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.limiter.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
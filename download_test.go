@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadLimiter_Concurrency(t *testing.T) {
+	l := newDownloadLimiter(1, 0)
+
+	release, err := l.acquire(context.Background())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx)
+	require.Error(t, err, "second download must wait for a free slot")
+
+	release()
+	release, err = l.acquire(context.Background())
+	require.NoError(t, err)
+	release()
+}
+
+func TestDownloadLimiter_Bandwidth(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 3000)
+
+	unlimited := newDownloadLimiter(1, 0)
+	require.IsType(t, &bytes.Reader{}, unlimited.reader(context.Background(), bytes.NewReader(data)))
+
+	// with a 1000 B/s limit and a burst of 1000 bytes, reading 3000 bytes
+	// must take about two seconds
+	l := newDownloadLimiter(1, 1000)
+	start := time.Now()
+	b, err := io.ReadAll(l.reader(context.Background(), bytes.NewReader(data)))
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+	require.GreaterOrEqual(t, time.Since(start), 1500*time.Millisecond)
+}
+
+func TestHTTPClient_Proxy(t *testing.T) {
+	client, err := newHTTPClient(ProxyConfig{
+		HTTPSProxy: "socks5://proxy.internal:1080",
+		NoProxy:    "registry.internal",
+	})
+	require.NoError(t, err)
+
+	proxy := client.Transport.(*http.Transport).Proxy
+	cases := []struct {
+		url      string
+		expected string
+	}{
+		{"https://ghcr.io/v2/", "socks5://proxy.internal:1080"},
+		{"https://registry.internal/v2/", ""},
+		{"http://ghcr.io/v2/", ""},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(http.MethodGet, c.url, nil)
+		u, err := proxy(req)
+		require.NoError(t, err)
+		if c.expected == "" {
+			require.Nil(t, u, c.url)
+		} else {
+			require.Equal(t, c.expected, u.String(), c.url)
+		}
+	}
+}
+
+func TestDownloadLimiter_Resize(t *testing.T) {
+	l := newDownloadLimiter(1, 0)
+	release, err := l.acquire(context.Background())
+	require.NoError(t, err)
+
+	// raising the limit frees a slot for the waiting download
+	acquired := make(chan func())
+	go func() {
+		r, _ := l.acquire(context.Background())
+		acquired <- r
+	}()
+	l.resize(2, 1000)
+	second := <-acquired
+	require.Equal(t, 2, l.active())
+
+	// lowering it lets the downloads in progress complete, the new ones
+	// wait for them
+	l.resize(1, 0)
+	release()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx)
+	require.Error(t, err)
+
+	second()
+	release, err = l.acquire(context.Background())
+	require.NoError(t, err)
+	release()
+	limit, bandwidth := l.limits()
+	require.Equal(t, 1, limit)
+	require.Zero(t, bandwidth)
+}
@@ -3,19 +3,32 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/dustin/go-humanize"
 	"github.com/hashicorp/consul-template/signals"
+	"github.com/hashicorp/go-cleanhttp"
 	"github.com/hashicorp/go-hclog"
 	log "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad/drivers/shared/eventer"
 	"github.com/hashicorp/nomad/drivers/shared/executor"
 	shelpers "github.com/hashicorp/nomad/helper/stats"
+	"github.com/hashicorp/nomad/nomad/structs"
 	"github.com/hashicorp/nomad/plugins/base"
 	"github.com/hashicorp/nomad/plugins/drivers"
 	"github.com/hashicorp/nomad/plugins/shared/hclspec"
 	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/opencontainers/go-digest"
 )
 
 const (
@@ -28,6 +41,10 @@ const (
 	// this is used to allow modification and migration of the task schema
 	// used by the plugin
 	taskHandleVersion = 1
+
+	// defaultMountTimeout is used when the plugin config doesn't set
+	// mount_timeout
+	defaultMountTimeout = 30 * time.Second
 )
 
 // TaskState is the runtime state which is encoded in the handle returned to
@@ -48,6 +65,33 @@ type TaskState struct {
 	// in-memory representation of the running tasks using the RecoverTask()
 	// method below.
 	Pid int
+
+	// ModuleDigest is the digest of the task's module in the artifact store
+	ModuleDigest digest.Digest
+
+	// PrecompiledDigest is the digest of the module's code precompiled for
+	// the client, if its bundle carried it
+	PrecompiledDigest digest.Digest
+
+	// Preopens are the host directories exposed to the guest, including
+	// any mounts staged by the driver which need cleaning up on destroy
+	Preopens []*preopen
+
+	// LogStreams are the files the task's output is written to
+	LogStreams *logStreams
+
+	// Restart is the task's attempt in its allocation
+	Restart *restartAttempt
+
+	// Metadata is what the module records of how it was built
+	Metadata *moduleMetadata
+
+	// Compile describes how the module was compiled
+	Compile *compileDiagnostics
+
+	// Notify is the webhook posted the task's exit summary, interpolated
+	// when the task started
+	Notify *TaskNotifyConfig
 }
 
 // Driver is a driver for running WebAssembly & WASI
@@ -56,6 +100,11 @@ type Driver struct {
 	// event can be broadcast to all callers
 	eventer *eventer.Eventer
 
+	// configLock guards config and the fields derived from it, which
+	// SetConfig replaces while tasks may be starting. Tasks already running
+	// keep what they were started with.
+	configLock sync.RWMutex
+
 	// config is the plugin configuration set by the SetConfig RPC
 	config *Config
 
@@ -65,6 +114,108 @@ type Driver struct {
 	// tasks is the in memory datastore mapping taskIDs to driver handles
 	tasks *taskStore
 
+	// starting counts the tasks being started, which use the artifact store
+	// without holding configLock
+	starting int32
+
+	// artifacts is the content-addressed store holding the modules of all
+	// tasks
+	artifacts *artifactStore
+
+	// audit records every module executed, if enabled, auditUsers are the
+	// tasks recording to it
+	audit      *auditLog
+	auditUsers *sharedCloser
+
+	// httpClient is used for all artifact fetches
+	httpClient *http.Client
+
+	// httpCaches are the outbound HTTP caches shared by the tasks of a job
+	httpCaches httpCaches
+
+	// allowlists are the allowed_hosts of the tasks, as last reloaded
+	allowlists taskAllowlists
+
+	// downloads limits the concurrency and bandwidth of artifact downloads
+	downloads *downloadLimiter
+
+	// blobstore is the client of the store behind the blobstore host
+	// functions, or nil if they are disabled
+	blobstore *s3Client
+
+	// vault is the client used by the secrets host functions
+	vault *vault.Client
+
+	// secretsCacheTTL is the parsed vault.cache_ttl from the plugin config
+	secretsCacheTTL time.Duration
+
+	// statusServer serves the driver's health and status, if enabled
+	statusServer *httpListener
+
+	// pprofServer serves profiles of the plugin process, if enabled
+	pprofServer *httpListener
+
+	// registryCache serves the artifact store, if enabled, registryPeers
+	// are the registry caches of other nodes modules are fetched from
+	registryCache *httpListener
+	registryPeers []*url.URL
+
+	// instances tracks the wasmtime stores of all tasks
+	instances *instanceRegistry
+
+	// stopLeakDetection stops the sweep for orphaned stores, if running
+	stopLeakDetection context.CancelFunc
+
+	// modules caches the compiled modules of all tasks
+	modules *moduleCache
+
+	// codeBudget accounts for the compiled code of all tasks
+	codeBudget *codeBudget
+
+	// quotas accounts for what the tasks of each namespace use
+	quotas *quotaTracker
+
+	// epochs ticks the epoch of the engines of running guests
+	epochs *epochTicker
+
+	// callDeadline is the parsed epoch.call_deadline from the plugin config
+	callDeadline time.Duration
+
+	// cpuFuel is the parsed cpu_fuel block from the plugin config, nil if
+	// guests aren't metered by their cpu
+	cpuFuel *cpuFuelSettings
+
+	// debug applies the retention of the debug artifacts in alloc dirs
+	debug *debugArtifacts
+
+	// quarantine refuses the modules whose tasks keep failing
+	quarantine *moduleQuarantine
+
+	// stopDebugJanitor stops expiring debug artifacts, if running
+	stopDebugJanitor context.CancelFunc
+
+	// stopMemoryPressureWatch stops evicting modules under memory pressure,
+	// if enabled
+	stopMemoryPressureWatch context.CancelFunc
+
+	// reactor delivers the exit results and stats of all tasks
+	reactor *reactor
+
+	// startedAt is when the driver was created
+	startedAt time.Time
+
+	// kvBackends are the stores tasks may select for their keyvalue host
+	// functions, keyed by name, kvUsers are the host modules using them
+	kvBackends map[string]kvBackend
+	kvUsers    *sharedCloser
+
+	// mountTimeout is the parsed mount_timeout from the plugin config
+	mountTimeout time.Duration
+
+	// maxDecompressedSize is the parsed max_decompressed_size from the
+	// plugin config
+	maxDecompressedSize int64
+
 	// ctx is the context for the driver. It is passed to other subsystems to
 	// coordinate shutdown
 	ctx context.Context
@@ -80,15 +231,36 @@ type Driver struct {
 // NewWasmtimeDriver returns a new wasmtime driver plugin
 func NewWasmtimeDriver(logger log.Logger) drivers.DriverPlugin {
 	ctx, cancel := context.WithCancel(context.Background())
-	logger = logger.Named(pluginName)
+	logger = newLevelLogger(logger.Named(pluginName), log.Trace)
+	setupMetrics()
+
+	r := newReactor(defaultStatsMinInterval)
+	go r.run(ctx)
+	epochs := newEpochTicker(defaultEpochInterval)
+	go epochs.run(ctx)
 
 	return &Driver{
-		eventer:        eventer.NewEventer(ctx, logger),
-		config:         &Config{},
-		tasks:          newTaskStore(),
-		ctx:            ctx,
-		signalShutdown: cancel,
-		logger:         logger,
+		eventer:             eventer.NewEventer(ctx, logger),
+		config:              &Config{},
+		tasks:               newTaskStore(),
+		instances:           newInstanceRegistry(),
+		modules:             newModuleCache(),
+		auditUsers:          &sharedCloser{},
+		kvUsers:             &sharedCloser{},
+		codeBudget:          newCodeBudget(),
+		quotas:              newQuotaTracker(),
+		debug:               newDebugArtifacts(),
+		quarantine:          newModuleQuarantine(),
+		epochs:              epochs,
+		reactor:             r,
+		httpClient:          cleanhttp.DefaultPooledClient(),
+		downloads:           newDownloadLimiter(defaultMaxConcurrentDownloads, 0),
+		mountTimeout:        defaultMountTimeout,
+		maxDecompressedSize: defaultMaxDecompressedSize,
+		startedAt:           time.Now(),
+		ctx:                 ctx,
+		signalShutdown:      cancel,
+		logger:              logger,
 	}
 }
 
@@ -102,6 +274,219 @@ func (d *Driver) ConfigSchema() (*hclspec.Spec, error) {
 	return configSpec, nil
 }
 
+// pluginSettings are the values parsed from the plugin config
+type pluginSettings struct {
+	mountTimeout           time.Duration
+	maxDecompressedSize    int64
+	bandwidth              uint64
+	httpClient             *http.Client
+	blobstore              *s3Client
+	secretsCacheTTL        time.Duration
+	vault                  *vault.Client
+	leakSweepInterval      time.Duration
+	memoryPressureInterval time.Duration
+	logLevel               hclog.Level
+	statsMinInterval       time.Duration
+	artifactRetention      time.Duration
+	codeBudget             int64
+	debugRetention         debugRetention
+	quarantine             quarantinePolicy
+	epochInterval          time.Duration
+	callDeadline           time.Duration
+	cpuFuel                *cpuFuelSettings
+	quotas                 map[string]namespaceQuota
+	registryPeers          []*url.URL
+}
+
+// parsePluginConfig validates config and parses its values. It has no side
+// effects, so it's also used to validate configs outside of Nomad; what
+// opens connections, files or listeners is left to SetConfig.
+func parsePluginConfig(config *Config) (*pluginSettings, error) {
+	switch config.ExecutionMode {
+	case "", executionModeInProcess, executionModeForked:
+	default:
+		return nil, fmt.Errorf("invalid execution_mode %q: must be %q or %q", config.ExecutionMode, executionModeInProcess, executionModeForked)
+	}
+	if _, err := parseUmask(config.Runner.Umask); err != nil {
+		return nil, err
+	}
+
+	mountTimeout := defaultMountTimeout
+	if config.MountTimeout != "" {
+		var err error
+		if mountTimeout, err = time.ParseDuration(config.MountTimeout); err != nil {
+			return nil, fmt.Errorf("invalid mount_timeout %q: %v", config.MountTimeout, err)
+		}
+	}
+
+	maxDecompressedSize := int64(defaultMaxDecompressedSize)
+	if config.MaxDecompressedSize != "" {
+		size, err := humanize.ParseBytes(config.MaxDecompressedSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_decompressed_size %q: %v", config.MaxDecompressedSize, err)
+		}
+		maxDecompressedSize = int64(size)
+	}
+
+	var bandwidth uint64
+	if config.DownloadBandwidthLimit != "" {
+		var err error
+		if bandwidth, err = humanize.ParseBytes(config.DownloadBandwidthLimit); err != nil {
+			return nil, fmt.Errorf("invalid download_bandwidth_limit %q: %v", config.DownloadBandwidthLimit, err)
+		}
+	}
+
+	httpClient, err := newHTTPClient(config.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Crypto.Enabled {
+		if _, err := newCryptoHost(config.Crypto.AllowedAlgorithms, config.Crypto.FIPSOnly); err != nil {
+			return nil, fmt.Errorf("invalid crypto config: %v", err)
+		}
+	}
+
+	if err := validateImportPatterns(config.AllowedImports); err != nil {
+		return nil, fmt.Errorf("invalid allowed_imports: %v", err)
+	}
+	if _, err := allowedFeatures(config.Compiler); err != nil {
+		return nil, fmt.Errorf("invalid compiler.features: %v", err)
+	}
+
+	if _, err := parseTaskLimits(config.Limits); err != nil {
+		return nil, fmt.Errorf("invalid plugin limits: %v", err)
+	}
+	if config.MaxInstances < 0 {
+		return nil, fmt.Errorf("invalid max_instances %d: must not be negative", config.MaxInstances)
+	}
+	if _, err := newCapabilitySet(config.Capabilities); err != nil {
+		return nil, fmt.Errorf("invalid plugin capabilities: %v", err)
+	}
+
+	var blobstore *s3Client
+	if config.Blobstore.Bucket != "" {
+		if blobstore, err = newS3Client(cleanhttp.DefaultPooledClient(), config.Blobstore); err != nil {
+			return nil, fmt.Errorf("invalid blobstore config: %v", err)
+		}
+	}
+
+	secretsCacheTTL := defaultSecretsCacheTTL
+	if config.Vault.CacheTTL != "" {
+		if secretsCacheTTL, err = time.ParseDuration(config.Vault.CacheTTL); err != nil {
+			return nil, fmt.Errorf("invalid vault cache_ttl %q: %v", config.Vault.CacheTTL, err)
+		}
+	}
+
+	vaultClient, err := newVaultClient(config.Vault)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vault config: %v", err)
+	}
+
+	leakSweepInterval := defaultLeakSweepInterval
+	if config.LeakDetection.Interval != "" {
+		if leakSweepInterval, err = time.ParseDuration(config.LeakDetection.Interval); err != nil {
+			return nil, fmt.Errorf("invalid leak_detection interval %q: %v", config.LeakDetection.Interval, err)
+		}
+	}
+
+	if w := config.MemoryPressure.Watermark; w < 0 || w > 100 {
+		return nil, fmt.Errorf("invalid memory_pressure watermark %v: must be a percentage", w)
+	}
+	memoryPressureInterval := defaultMemoryPressureInterval
+	if config.MemoryPressure.Interval != "" {
+		if memoryPressureInterval, err = time.ParseDuration(config.MemoryPressure.Interval); err != nil || memoryPressureInterval <= 0 {
+			return nil, fmt.Errorf("invalid memory_pressure interval %q", config.MemoryPressure.Interval)
+		}
+	}
+
+	logLevel := hclog.Trace
+	if config.LogLevel != "" {
+		if logLevel = hclog.LevelFromString(config.LogLevel); logLevel == hclog.NoLevel {
+			return nil, fmt.Errorf("invalid log_level %q", config.LogLevel)
+		}
+	}
+
+	statsMinInterval := defaultStatsMinInterval
+	if config.StatsMinInterval != "" {
+		if statsMinInterval, err = time.ParseDuration(config.StatsMinInterval); err != nil || statsMinInterval <= 0 {
+			return nil, fmt.Errorf("invalid stats_min_interval %q", config.StatsMinInterval)
+		}
+	}
+
+	artifactRetention := defaultArtifactRetention
+	if config.ArtifactRetention != "" {
+		if artifactRetention, err = time.ParseDuration(config.ArtifactRetention); err != nil || artifactRetention < 0 {
+			return nil, fmt.Errorf("invalid artifact_retention %q", config.ArtifactRetention)
+		}
+	}
+
+	debugRetention, err := parseDebugRetention(config.DebugRetention)
+	if err != nil {
+		return nil, fmt.Errorf("invalid debug_retention: %v", err)
+	}
+	quarantine, err := parseQuarantine(config.Quarantine)
+	if err != nil {
+		return nil, fmt.Errorf("invalid quarantine: %v", err)
+	}
+
+	epochInterval := defaultEpochInterval
+	if config.Epoch.Interval != "" {
+		if epochInterval, err = time.ParseDuration(config.Epoch.Interval); err != nil || epochInterval <= 0 {
+			return nil, fmt.Errorf("invalid epoch interval %q", config.Epoch.Interval)
+		}
+	}
+	var callDeadline time.Duration
+	if config.Epoch.CallDeadline != "" {
+		if callDeadline, err = time.ParseDuration(config.Epoch.CallDeadline); err != nil || callDeadline < 0 {
+			return nil, fmt.Errorf("invalid epoch call_deadline %q", config.Epoch.CallDeadline)
+		}
+	}
+
+	cpuFuel, err := parseCPUFuel(config.CPUFuel)
+	if err != nil {
+		return nil, err
+	}
+	quotas, err := parseNamespaceQuotas(config.NamespaceQuotas)
+	if err != nil {
+		return nil, err
+	}
+	registryPeers, err := parseRegistryPeers(config.RegistryCache.Peers)
+	if err != nil {
+		return nil, err
+	}
+
+	var codeBudget uint64
+	if config.CompiledCodeBudget != "" {
+		if codeBudget, err = humanize.ParseBytes(config.CompiledCodeBudget); err != nil {
+			return nil, fmt.Errorf("invalid compiled_code_budget %q: %v", config.CompiledCodeBudget, err)
+		}
+	}
+
+	return &pluginSettings{
+		mountTimeout:           mountTimeout,
+		maxDecompressedSize:    maxDecompressedSize,
+		bandwidth:              bandwidth,
+		httpClient:             httpClient,
+		blobstore:              blobstore,
+		secretsCacheTTL:        secretsCacheTTL,
+		vault:                  vaultClient,
+		leakSweepInterval:      leakSweepInterval,
+		memoryPressureInterval: memoryPressureInterval,
+		logLevel:               logLevel,
+		statsMinInterval:       statsMinInterval,
+		artifactRetention:      artifactRetention,
+		codeBudget:             int64(codeBudget),
+		debugRetention:         debugRetention,
+		quarantine:             quarantine,
+		epochInterval:          epochInterval,
+		callDeadline:           callDeadline,
+		cpuFuel:                cpuFuel,
+		quotas:                 quotas,
+		registryPeers:          registryPeers,
+	}, nil
+}
+
 // SetConfig is called by the client to pass the configuration for the plugin.
 func (d *Driver) SetConfig(cfg *base.Config) error {
 	var config Config
@@ -111,8 +496,181 @@ func (d *Driver) SetConfig(cfg *base.Config) error {
 		}
 	}
 
+	settings, err := parsePluginConfig(&config)
+	if err != nil {
+		return err
+	}
+
+	d.configLock.Lock()
+	defer d.configLock.Unlock()
+
+	// undo closes what was opened for config if it's rejected
+	var undo []func()
+	fail := func(err error) error {
+		for _, f := range undo {
+			f()
+		}
+		return err
+	}
+
+	// connections, files and listeners are only reopened if their config
+	// changed, so reloading the agent doesn't disrupt the tasks using them
+	kvBackends := d.kvBackends
+	reopenKV := kvBackends == nil || !reflect.DeepEqual(config.KeyValue, d.config.KeyValue)
+	if reopenKV {
+		if kvBackends, err = newKVBackends(config.KeyValue); err != nil {
+			return fail(fmt.Errorf("invalid keyvalue config: %v", err))
+		}
+		undo = append(undo, func() { closeKVBackends(kvBackends) })
+	}
+
+	audit := d.audit
+	reopenAudit := audit == nil || !reflect.DeepEqual(config.Audit, d.config.Audit)
+	if reopenAudit {
+		if audit, err = newAuditLog(config.Audit); err != nil {
+			return fail(err)
+		}
+		undo = append(undo, func() { audit.Close() })
+	}
+
+	statusServer := d.statusServer
+	reopenStatus := config.Status.Address != d.config.Status.Address
+	if reopenStatus && config.Status.Address != "" {
+		if statusServer, err = newHTTPListener(config.Status.Address, d.statusHandler()); err != nil {
+			return fail(fmt.Errorf("failed to start status listener: %v", err))
+		}
+		undo = append(undo, func() { statusServer.Close() })
+	} else if reopenStatus {
+		statusServer = nil
+	}
+
+	pprofServer := d.pprofServer
+	reopenPProf := config.PProf.Address != d.config.PProf.Address
+	if reopenPProf && config.PProf.Address != "" {
+		if pprofServer, err = newHTTPListener(config.PProf.Address, pprofHandler()); err != nil {
+			return fail(fmt.Errorf("failed to start pprof listener: %v", err))
+		}
+		undo = append(undo, func() { pprofServer.Close() })
+	} else if reopenPProf {
+		pprofServer = nil
+	}
+
+	registryCache := d.registryCache
+	reopenRegistryCache := config.RegistryCache.Address != d.config.RegistryCache.Address
+	if reopenRegistryCache && config.RegistryCache.Address != "" {
+		if registryCache, err = newHTTPListener(config.RegistryCache.Address, d.registryCacheHandler()); err != nil {
+			return fail(fmt.Errorf("failed to start registry cache listener: %v", err))
+		}
+		undo = append(undo, func() { registryCache.Close() })
+	} else if reopenRegistryCache {
+		registryCache = nil
+	}
+
+	dataDir := config.DataDir
+	if dataDir == "" {
+		dataDir = filepath.Join(os.TempDir(), "nomad-driver-"+pluginName)
+	}
+	switch {
+	case d.artifacts != nil && d.artifacts.dir != dataDir && (d.tasks.Len() != 0 || atomic.LoadInt32(&d.starting) != 0):
+		// the modules of running and starting tasks are in the current store
+		d.logger.Warn("data_dir can't change while tasks are running, keeping the current one",
+			"data_dir", d.artifacts.dir)
+	case d.artifacts == nil || d.artifacts.dir != dataDir:
+		artifacts, err := newArtifactStore(dataDir, d.logger)
+		if err != nil {
+			return fail(err)
+		}
+		d.artifacts = artifacts
+	}
+	d.artifacts.SetRetention(settings.artifactRetention)
+	d.codeBudget.SetLimit(settings.codeBudget)
+	d.quotas.SetQuotas(settings.quotas)
+	d.debug.SetRetention(settings.debugRetention)
+	d.quarantine.SetPolicy(settings.quarantine)
+	d.epochs.SetInterval(settings.epochInterval)
+	d.callDeadline = settings.callDeadline
+	d.cpuFuel = settings.cpuFuel
+
 	// Save the configuration to the plugin
+	d.logger.SetLevel(settings.logLevel)
 	d.config = &config
+	d.mountTimeout = settings.mountTimeout
+	d.maxDecompressedSize = settings.maxDecompressedSize
+	d.httpClient = settings.httpClient
+	d.blobstore = settings.blobstore
+	d.vault = settings.vault
+	d.secretsCacheTTL = settings.secretsCacheTTL
+	// the replaced backends and audit log are closed once the tasks using
+	// them are done
+	if reopenKV {
+		old := d.kvBackends
+		d.kvUsers.retire(func() {
+			if err := closeKVBackends(old); err != nil {
+				d.logger.Warn("failed to close keyvalue backends", "error", err)
+			}
+		})
+		d.kvBackends = kvBackends
+		d.kvUsers = &sharedCloser{}
+	}
+	if reopenAudit {
+		old := d.audit
+		d.auditUsers.retire(func() {
+			if err := old.Close(); err != nil {
+				d.logger.Warn("failed to close audit log", "error", err)
+			}
+		})
+		d.audit = audit
+		d.auditUsers = &sharedCloser{}
+	}
+	if reopenStatus {
+		if err := d.statusServer.Close(); err != nil {
+			d.logger.Warn("failed to close status listener", "error", err)
+		}
+		d.statusServer = statusServer
+	}
+	if reopenPProf {
+		if err := d.pprofServer.Close(); err != nil {
+			d.logger.Warn("failed to close pprof listener", "error", err)
+		}
+		d.pprofServer = pprofServer
+	}
+	if reopenRegistryCache {
+		if err := d.registryCache.Close(); err != nil {
+			d.logger.Warn("failed to close registry cache listener", "error", err)
+		}
+		d.registryCache = registryCache
+	}
+	d.registryPeers = settings.registryPeers
+	d.downloads.resize(config.MaxConcurrentDownloads, settings.bandwidth)
+	d.reactor.setMinInterval(settings.statsMinInterval)
+
+	if d.stopLeakDetection != nil {
+		d.stopLeakDetection()
+		d.stopLeakDetection = nil
+	}
+	if d.stopMemoryPressureWatch != nil {
+		d.stopMemoryPressureWatch()
+		d.stopMemoryPressureWatch = nil
+	}
+	if config.MemoryPressure.Watermark > 0 {
+		ctx, cancel := context.WithCancel(d.ctx)
+		d.stopMemoryPressureWatch = cancel
+		go d.watchMemoryPressure(ctx, settings.memoryPressureInterval, config.MemoryPressure.Watermark)
+	}
+	if d.stopDebugJanitor != nil {
+		d.stopDebugJanitor()
+		d.stopDebugJanitor = nil
+	}
+	if settings.debugRetention.maxAge > 0 {
+		ctx, cancel := context.WithCancel(d.ctx)
+		d.stopDebugJanitor = cancel
+		go d.expireDebugArtifacts(ctx, debugJanitorInterval)
+	}
+	if settings.leakSweepInterval > 0 {
+		ctx, cancel := context.WithCancel(d.ctx)
+		d.stopLeakDetection = cancel
+		go d.detectLeaks(ctx, settings.leakSweepInterval, config.LeakDetection.ForceClose)
+	}
 
 	// If your driver agent configuration requires any complex validation
 	// (some dependency between attributes) or special data parsing (the
@@ -184,38 +742,44 @@ func (d *Driver) handleFingerprint(ctx context.Context, ch chan<- *drivers.Finge
 
 // buildFingerprint returns the driver's fingerprint data
 func (d *Driver) buildFingerprint() *drivers.Fingerprint {
-	var health drivers.HealthState
-	var desc string
 	attrs := map[string]*pstructs.Attribute{}
 
-	// be negative and guess that we will not be able to get a podman connection
-	health = drivers.HealthStateUndetected
-	desc = "disabled"
-
 	fp := &drivers.Fingerprint{
 		Attributes:        attrs,
-		Health:            health,
-		HealthDescription: desc,
+		Health:            drivers.HealthStateHealthy,
+		HealthDescription: drivers.DriverHealthy,
 	}
 
-	// TODO: implement fingerprinting logic to populate health and driver
-	// attributes.
-	//
-	// Fingerprinting is used by the plugin to relay two important information
-	// to Nomad: health state and node attributes.
-	//
-	// If the plugin reports to be unhealthy, or doesn't send any fingerprint
-	// data in the expected interval of time, Nomad will restart it.
-	//
-	// Node attributes can be used to report any relevant information about
-	// the node in which the plugin is running (specific library availability,
-	// installed versions of a software etc.). These attributes can then be
-	// used by an operator to set job constrains.
-	//
-	// In the example below we check if the shell specified by the user exists
-	// in the node.
+	// the proposals supported by the engine, so jobs can be constrained to
+	// nodes able to run their modules
+	for name, supported := range supportedFeatures() {
+		fp.Attributes["driver.wasmtime.feature."+name] = pstructs.NewBoolAttribute(supported)
+	}
 	fp.Attributes["driver.wasmtime"] = pstructs.NewBoolAttribute(true)
 
+	// whether the node holds modules already, which makes starting tasks
+	// using them cheaper
+	d.configLock.RLock()
+	if d.config.ReadOnly {
+		// analysis jobs are constrained to read-only nodes
+		fp.Attributes["driver.wasmtime.read_only"] = pstructs.NewBoolAttribute(true)
+	}
+	if d.artifacts != nil {
+		stats := d.artifacts.Stats()
+		fp.Attributes["driver.wasmtime.cache.artifacts"] = pstructs.NewIntAttribute(int64(stats.Artifacts), "")
+		fp.Attributes["driver.wasmtime.cache.warm"] = pstructs.NewBoolAttribute(stats.Artifacts != 0)
+	}
+
+	// how many more guests fit, for constraints to bin-pack with
+	if free, ok := d.instancesFree(); ok {
+		fp.Attributes["driver.wasmtime.capacity.instances_free"] = pstructs.NewIntAttribute(free, "")
+	}
+	d.configLock.RUnlock()
+
+	// set while tasks are refused for lack of resources, so jobs can be
+	// constrained to other nodes
+	fp.Attributes["driver.wasmtime.capacity.exhausted"] = pstructs.NewBoolAttribute(d.codeBudget.isExhausted())
+
 	return fp
 }
 
@@ -229,33 +793,433 @@ func (d *Driver) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drive
 	if err := cfg.DecodeDriverConfig(&driverConfig); err != nil {
 		return nil, nil, fmt.Errorf("failed to decode driver config: %v", err)
 	}
+	logLevel, err := parseTaskLogLevel(driverConfig.LogLevel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the config lock isn't held while waiting, so SetConfig and the tasks
+	// depended on aren't held up
+	if err := d.waitDependencies(cfg, &driverConfig); err != nil {
+		return nil, nil, err
+	}
+
+	// the module is pulled and compiled with the config as of now, without
+	// holding the config lock, so SetConfig isn't held up by slow pulls
+	d.configLock.RLock()
+	config := d.config
+	source := d.moduleSource()
+	mountTimeout := d.mountTimeout
+	atomic.AddInt32(&d.starting, 1)
+	d.configLock.RUnlock()
+	defer atomic.AddInt32(&d.starting, -1)
+	artifacts := source.artifacts
+
+	logger := d.taskLogger(logLevel)
+	logger.Info("starting task", "driver_cfg", hclog.Fmt("%+v", driverConfig))
+	interpolateTaskConfig(cfg, &driverConfig)
 
-	d.logger.Info("starting task", "driver_cfg", hclog.Fmt("%+v", driverConfig))
 	handle := drivers.NewTaskHandle(taskHandleVersion)
 	handle.Config = cfg
 
-	if driverConfig.file == "" {
-		return nil, nil, fmt.Errorf("file is required")
+	timings := newStartTimings(cfg)
+	pullStart := time.Now()
+	wasm, err := d.loadModule(source, cfg, &driverConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	timings.measure(startPhasePull, pullStart)
+	bundle, err := unbundleModule(wasm)
+	if err != nil {
+		return nil, nil, err
+	}
+	wasm = bundle.wasm
+	precompiledOnly := isPrecompiledModule(wasm)
+	if precompiledOnly && !config.Compiler.AllowPrecompiled {
+		return nil, nil, fmt.Errorf("module is precompiled, which requires compiler.allow_precompiled in the plugin config")
+	} else if !precompiledOnly {
+		if err := validateModule(wasm); err != nil {
+			return nil, nil, fmt.Errorf("invalid module: %v", err)
+		}
+	}
+	if err := verifyChecksum(wasm, driverConfig.Artifact.Checksum); err != nil {
+		return nil, nil, err
+	}
+	features, err := taskFeatures(config.Compiler, wasm)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// TODO: implement driver specific mechanism to start the task.
-	//
-	// Once the task is started you will need to store any relevant runtime
-	// information in a TaskHandle and TaskState. The TaskHandle will be
-	// stored in-memory in the plugin and will be used to interact with the
-	// task.
-	//
-	// The TaskState will be returned to the Nomad client inside a
-	// drivers.TaskHandle instance. This TaskHandle will be sent back to plugin
-	// if the task ever needs to be recovered, so the TaskState should contain
-	// enough information to handle that.
-	//
-	// In the example below we use an executor to fork a process to run our
-	// greeter. The executor is then stored in the handle so we can access it
-	// later and the the plugin.Client is used to generate a reattach
-	// configuration that can be used to recover communication with the task.
+	// a precompiled module is checked against the client before anything
+	// else, as it can only be deserialized, and has no custom sections to
+	// read metadata from
+	metadata := &moduleMetadata{}
+	if precompiledOnly {
+		checkCfg, _, err := engineConfig(driverConfig.Compiler, features)
+		if err != nil {
+			return nil, nil, err
+		}
+		_, module, err := loadPrecompiledModule(checkCfg, wasm)
+		if err != nil {
+			return nil, nil, err
+		}
+		if config.StrictImports {
+			if err := checkAllowedImports(precompiledImports(module), config.AllowedImports); err != nil {
+				return nil, nil, err
+			}
+		}
+	} else {
+		if config.StrictImports {
+			if err := checkStrictImports(wasm, config.AllowedImports); err != nil {
+				return nil, nil, err
+			}
+		}
+		if metadata, err = readModuleMetadata(wasm); err != nil {
+			return nil, nil, fmt.Errorf("invalid module: %v", err)
+		}
+	}
+
+	limits, err := mergeTaskConfig(config, &driverConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	undersized := checkForecast(cfg, limits, metadata.Forecast)
+	if len(undersized) != 0 {
+		if config.StrictForecast {
+			return nil, nil, fmt.Errorf("task is undersized for its module: %s", strings.Join(undersized, "; "))
+		}
+		logger.Warn("task is undersized for its module", "task_id", cfg.ID, "forecast", strings.Join(undersized, "; "))
+	}
+	limits.capMemory(allocatedMemory(cfg))
+
+	// the modules of serve routes are compiled with the task's engine, so
+	// the proposals they use are enabled with its own
+	var routes map[string][]byte
+	if servePortLabel(driverConfig.Serve) != "" {
+		if routes, features, err = readRouteModules(cfg, &driverConfig, config, features, source.maxDecompressedSize); err != nil {
+			return nil, nil, err
+		}
+	}
+	engineCfg, compiled, err := engineConfig(driverConfig.Compiler, features)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := validateServePort(driverConfig.Serve); err != nil {
+		return nil, nil, err
+	}
+	var network *drivers.DriverNetwork
+	if port := servePortLabel(driverConfig.Serve); port != "" {
+		if network, err = serveNetwork(cfg, port); err != nil {
+			return nil, nil, err
+		}
+		if _, err := parseServeIdleTimeout(driverConfig.Serve); err != nil {
+			return nil, nil, err
+		}
+		if _, err := parseServeLimits(driverConfig.Serve); err != nil {
+			return nil, nil, err
+		}
+		if _, err := parseServeRoutes(driverConfig.Serve.Routes); err != nil {
+			return nil, nil, err
+		}
+		if _, err := parseServeStatic(cfg.TaskDir().Dir, driverConfig.Serve, driverConfig.WASI.Preopens); err != nil {
+			return nil, nil, err
+		}
+		if access := driverConfig.Serve.AccessLog; access != nil {
+			if err := validateAccessLog(*access); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if _, err := newCapabilitySet(driverConfig.WASI.Capabilities); err != nil {
+		return nil, nil, err
+	}
+	if _, err := newClockHost(driverConfig.WASI); err != nil {
+		return nil, nil, err
+	}
+	if err := validateLocale(driverConfig.Locale); err != nil {
+		return nil, nil, err
+	}
+	if driverConfig.Notify != nil {
+		if _, err := parseNotify(driverConfig.Notify); err != nil {
+			return nil, nil, err
+		}
+	}
+	if driverConfig.Trace != nil {
+		if _, err := parseTrace(*driverConfig.Trace); err != nil {
+			return nil, nil, err
+		}
+	}
+	if driverConfig.HostCalls != nil {
+		if _, err := parseSlowCallThreshold(*driverConfig.HostCalls); err != nil {
+			return nil, nil, err
+		}
+	}
+	mounts, err := taskMounts(driverConfig.Mounts, config.AllowedHostPaths)
+	if err != nil {
+		return nil, nil, err
+	}
+	wasiPreopens, err := wasiPreopens(cfg.TaskDir().Dir, driverConfig.WASI.Preopens)
+	if err != nil {
+		return nil, nil, err
+	}
+	stdin, err := guestStdin(cfg.TaskDir().Dir, driverConfig.Stdin)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(driverConfig.CallArgs) != 0 && driverConfig.Entrypoint == "" {
+		return nil, nil, fmt.Errorf("call_args requires an entrypoint")
+	}
+	if driverConfig.Entrypoint != "" && servePortLabel(driverConfig.Serve) != "" {
+		return nil, nil, fmt.Errorf("entrypoint can't be set with serve.port_label")
+	}
+	if err := validateMainLoop(&driverConfig); err != nil {
+		return nil, nil, err
+	}
+	if err := os.Remove(entrypointResultPath(cfg)); err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("failed to remove entrypoint result: %v", err)
+	}
+	if ulimits, err := parseUlimits(driverConfig.Ulimit); err != nil {
+		return nil, nil, err
+	} else if len(ulimits) != 0 && config.ExecutionMode != executionModeForked {
+		return nil, nil, fmt.Errorf("ulimit requires the %q execution_mode", executionModeForked)
+	}
+	if config.ReadOnly {
+		if err := checkReadOnly(&driverConfig, append(append([]*drivers.MountConfig(nil), cfg.Mounts...), mounts...), wasiPreopens); err != nil {
+			return nil, nil, err
+		}
+	}
+	attempt, err := beginAttempt(cfg.TaskDir().Dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	env, err := guestEnv(cfg, &driverConfig, attempt)
+	if err != nil {
+		return nil, nil, err
+	}
+	identity, err := identityPreopen(cfg, driverConfig.Identity)
+	if err != nil {
+		return nil, nil, err
+	}
+	if identity != nil {
+		wasiPreopens = append(wasiPreopens, identity)
+	}
+	timezone, err := timezonePreopen(cfg, driverConfig.Timezone)
+	if err != nil {
+		return nil, nil, err
+	}
+	if timezone != nil {
+		wasiPreopens = append(wasiPreopens, timezone)
+	}
+
+	moduleDigest, err := artifacts.Put(cfg.ID, wasm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// from here on, what the task holds is released unless it starts
+	var h *TaskHandle
+	var preopens []*preopen
+	started := false
+	defer func() {
+		if started {
+			return
+		}
+		if h != nil {
+			h.kill()
+			h.releaseAudit()
+		}
+		d.modules.Release(cfg.ID)
+		d.codeBudget.release(cfg.ID)
+		d.quotas.release(cfg.ID)
+		d.allowlists.remove(cfg.ID)
+		d.unstageMounts(preopens)
+		artifacts.Release(cfg.ID)
+	}()
+
+	if err := d.quarantine.check(moduleDigest); err != nil {
+		return nil, nil, err
+	}
+
+	// the bundle's precompiled code is kept next to the module, and only
+	// used at all if the plugin trusts it
+	var precompiledDigest digest.Digest
+	if precompiledOnly {
+		precompiledDigest = moduleDigest
+	} else if bundle.precompiled != nil && config.Compiler.AllowPrecompiled {
+		precompiledDigest, err = artifacts.Put(cfg.ID, bundle.precompiled)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if bundle.precompiled != nil {
+		logger.Debug("ignoring precompiled module, compiler.allow_precompiled isn't set", "task_id", cfg.ID, "target", bundle.triple)
+	}
 
-	return handle, nil, nil
+	// forked tasks are compiled by their runner, whose compiled code isn't
+	// the plugin's to budget
+	forked := config.ExecutionMode == executionModeForked
+	var engine *wasmtime.Engine
+	var module *wasmtime.Module
+	var routeModules map[string]*wasmtime.Module
+	if !forked {
+		compileStart := time.Now()
+		var precompiled []byte
+		if precompiledDigest != "" {
+			precompiled = bundle.precompiled
+		}
+		key := engineKey(driverConfig.Compiler, features)
+		engine, module, err = compileModule(d.modules, cfg.ID, key, engineCfg, wasm, precompiled, limits, compiled)
+		if err != nil {
+			if isResourceExhaustion(err) {
+				err = structs.NewRecoverableError(&capacityError{resource: "memory for compiled code"}, true)
+			}
+			return nil, nil, err
+		}
+		if routeModules, err = compileRouteModules(d.modules, cfg.ID, key, engine, routes, limits, compiled); err != nil {
+			if isResourceExhaustion(err) {
+				err = structs.NewRecoverableError(&capacityError{resource: "memory for compiled code"}, true)
+			}
+			return nil, nil, err
+		}
+		timings.measure(startPhaseCompile, compileStart)
+		logCompileDiagnostics(logger, cfg.ID, compiled)
+		if err := d.codeBudget.reserve(cfg.ID, compiled.CodeSize); err != nil {
+			return nil, nil, structs.NewRecoverableError(err, true)
+		}
+	}
+
+	// the task counts against its namespace's quota once its code is known
+	usage := &taskUsage{namespace: cfg.Namespace, artifacts: map[digest.Digest]int64{moduleDigest: int64(len(wasm))}}
+	if precompiledDigest != "" && !precompiledOnly {
+		usage.artifacts[precompiledDigest] = int64(len(bundle.precompiled))
+	}
+	if !forked {
+		usage.code = compiled.CodeSize
+	}
+	if err := d.quotas.reserve(cfg.ID, usage); err != nil {
+		return nil, nil, structs.NewRecoverableError(err, true)
+	}
+
+	// mounts are staged before taking the config lock, as their sources
+	// are waited for up to mount_timeout
+	preopens, err = d.stageMounts(cfg, mounts, mountTimeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to stage mounts: %v", err)
+	}
+	preopens = append(preopens, wasiPreopens...)
+
+	// the rest of the start uses the fields derived from the config
+	d.configLock.RLock()
+	defer d.configLock.RUnlock()
+
+	streams, err := taskLogStreams(config.Logging, cfg, driverConfig.MergeStderr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	taskState := TaskState{
+		TaskConfig:        cfg,
+		StartedAt:         time.Now(),
+		ModuleDigest:      moduleDigest,
+		PrecompiledDigest: precompiledDigest,
+		Preopens:          preopens,
+		LogStreams:        streams,
+		Restart:           attempt,
+		Metadata:          metadata,
+		Compile:           compiled,
+		Notify:            driverConfig.Notify,
+	}
+	h = &TaskHandle{
+		taskConfig: cfg,
+		procState:  drivers.TaskStateRunning,
+		startedAt:  taskState.StartedAt,
+		exitResult: &drivers.ExitResult{},
+		preopens:   preopens,
+		logStreams: streams,
+		timings:    timings,
+		restart:    attempt,
+		metadata:   metadata,
+		compile:    compiled,
+		pauser:     newPauser(),
+		history:    newInvocationHistory(historySize),
+		notify:     driverConfig.Notify,
+
+		audit:             d.audit,
+		releaseAudit:      d.auditUsers.acquire(),
+		moduleDigest:      moduleDigest,
+		precompiledDigest: precompiledDigest,
+		logger:            logger,
+	}
+
+	// the runner is launched first so its state can be recovered, while
+	// guests in the plugin only start once it's saved
+	if forked {
+		spec := &runnerSpec{
+			Config:       config,
+			Task:         cfg,
+			DriverConfig: &driverConfig,
+			Module:       artifacts.Path(moduleDigest),
+			Features:     features,
+			Env:          env,
+			Preopens:     preopens,
+			LogStreams:   streams,
+		}
+		if precompiledDigest != "" {
+			spec.Precompiled = artifacts.Path(precompiledDigest)
+		}
+		if err := d.launchRunner(h, spec, &taskState); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := handle.SetDriverState(&taskState); err != nil {
+		return nil, nil, fmt.Errorf("failed to set driver state: %v", err)
+	}
+	if !forked {
+		m := &guestModule{
+			taskID:      cfg.ID,
+			engine:      engine,
+			module:      module,
+			routes:      routeModules,
+			argv:        guestArgv(cfg, &driverConfig),
+			env:         env,
+			preopens:    preopens,
+			stdin:       stdin,
+			limits:      limits,
+			preallocate: driverConfig.PreallocateMemory,
+			instances:   d.instances,
+		}
+		if err := d.startGuest(h, &driverConfig, m); err != nil {
+			return nil, nil, err
+		}
+		if driverConfig.MainLoop == mainLoopService && h.serve == nil {
+			if err := watchServiceStart(h.guest, mainLoopStartWindow); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if streams.spooled() {
+		h.logPointer, err = loadLogPointer(streams.pointerPath())
+		if err != nil {
+			return nil, nil, err
+		}
+		h.logPumps = startLogPumps(streams, h.logPointer, d.logger)
+	}
+
+	record := newAuditRecord(auditEventStart, cfg, moduleDigest.String())
+	record.Entrypoint = taskEntrypoint(&driverConfig)
+	if err := h.audit.record(record); err != nil {
+		d.logger.Error("failed to write audit log", "task_id", cfg.ID, "error", err)
+	}
+	d.emitStartTimings(cfg, timings)
+	d.emitCompileDiagnostics(cfg, compiled)
+	d.emitModuleMetadata(cfg, metadata)
+	if len(undersized) != 0 {
+		d.emitUndersized(cfg, undersized)
+	}
+
+	d.tasks.Set(cfg.ID, h)
+	started = true
+	go d.runTask(h)
+	return handle, network, nil
 }
 
 // RecoverTask recreates the in-memory state of a task from a TaskHandle.
@@ -268,47 +1232,117 @@ func (d *Driver) RecoverTask(handle *drivers.TaskHandle) error {
 		return nil
 	}
 
+	d.configLock.RLock()
+	defer d.configLock.RUnlock()
+
 	var taskState TaskState
 	if err := handle.GetDriverState(&taskState); err != nil {
 		return fmt.Errorf("failed to decode task state from handle: %v", err)
 	}
 
+	// a task that isn't recovered is never destroyed, so what its state
+	// holds is released here
+	recovered := false
+	defer func() {
+		if !recovered {
+			d.unstageMounts(taskState.Preopens)
+			d.artifacts.Release(taskState.TaskConfig.ID)
+		}
+	}()
+
+	// the driver config isn't kept in the state's copy of the task config
 	var driverConfig TaskConfig
-	if err := taskState.TaskConfig.DecodeDriverConfig(&driverConfig); err != nil {
+	if err := handle.Config.DecodeDriverConfig(&driverConfig); err != nil {
 		return fmt.Errorf("failed to decode driver config: %v", err)
 	}
+	logLevel, err := parseTaskLogLevel(driverConfig.LogLevel)
+	if err != nil {
+		return err
+	}
 
-	// TODO: implement driver specific logic to recover a task.
-	//
-	// Recovering a task involves recreating and storing a TaskHandle as if the
-	// task was just started.
-	//
-	// In the example below we use the executor to re-attach to the process
-	// that was created when the task first started.
+	if err := d.artifacts.Acquire(taskState.TaskConfig.ID, taskState.ModuleDigest); err != nil {
+		return fmt.Errorf("failed to recover module: %v", err)
+	}
+	if taskState.PrecompiledDigest != "" {
+		if err := d.artifacts.Acquire(taskState.TaskConfig.ID, taskState.PrecompiledDigest); err != nil {
+			return fmt.Errorf("failed to recover precompiled module: %v", err)
+		}
+	}
+
+	// guests run in the plugin stopped along with it
+	if taskState.ReattachConfig == nil {
+		return fmt.Errorf("task ran in the plugin and stopped when it restarted")
+	}
 	plugRC, err := pstructs.ReattachConfigToGoPlugin(taskState.ReattachConfig)
 	if err != nil {
 		return fmt.Errorf("failed to build ReattachConfig from taskConfig state: %v", err)
 	}
 
-	execImpl, _, err := executor.ReattachToExecutor(plugRC, d.logger)
+	execImpl, pluginClient, err := executor.ReattachToExecutor(plugRC, d.logger)
 	if err != nil {
 		return fmt.Errorf("failed to reattach to executor: %v", err)
 	}
 
 	h := &TaskHandle{
-		exec:       execImpl,
-		taskConfig: taskState.TaskConfig,
-		procState:  drivers.TaskStateRunning,
-		startedAt:  taskState.StartedAt,
-		exitResult: &drivers.ExitResult{},
+		exec:         execImpl,
+		pluginClient: pluginClient,
+		taskConfig:   handle.Config,
+		procState:    drivers.TaskStateRunning,
+		startedAt:    taskState.StartedAt,
+		exitResult:   &drivers.ExitResult{},
+		preopens:     taskState.Preopens,
+		logStreams:   taskState.LogStreams,
+		restart:      taskState.Restart,
+		metadata:     taskState.Metadata,
+		compile:      taskState.Compile,
+		pauser:       newPauser(),
+		history:      newInvocationHistory(historySize),
+		notify:       taskState.Notify,
+
+		audit:             d.audit,
+		releaseAudit:      d.auditUsers.acquire(),
+		moduleDigest:      taskState.ModuleDigest,
+		precompiledDigest: taskState.PrecompiledDigest,
+		logger:            d.taskLogger(logLevel),
+	}
+
+	// resume forwarding the output from where it was before the plugin
+	// stopped, which replays what the guest wrote in the meantime
+	if h.logStreams.spooled() {
+		h.logPointer, err = loadLogPointer(h.logStreams.pointerPath())
+		if err != nil {
+			h.releaseAudit()
+			return err
+		}
+		h.logPumps = startLogPumps(h.logStreams, h.logPointer, d.logger)
 	}
 
+	if h.compile != nil {
+		d.codeBudget.restore(taskState.TaskConfig.ID, h.compile.CodeSize)
+	}
+	d.quotas.restore(taskState.TaskConfig.ID, d.recoveredUsage(h))
 	d.tasks.Set(taskState.TaskConfig.ID, h)
+	recovered = true
 
-	go h.run()
+	go d.runTask(h)
 	return nil
 }
 
+// runTask waits for h to exit, forwards the rest of its output, reports
+// whether it ran out of memory, counts a failure against its module,
+// notifies its webhook and delivers its exit result
+func (d *Driver) runTask(h *TaskHandle) {
+	h.run()
+	h.logPumps.stop()
+	if cause, info := h.ranOutOfMemory(); cause != "" {
+		d.emitOOM(h.taskConfig, cause, info)
+	}
+	d.emitEntrypointResult(h.taskConfig)
+	d.recordFailure(h)
+	go d.notifyExit(h)
+	d.reactor.exited(h)
+}
+
 // WaitTask returns a channel used to notify Nomad when a task exits.
 func (d *Driver) WaitTask(ctx context.Context, taskID string) (<-chan *drivers.ExitResult, error) {
 	handle, ok := d.tasks.Get(taskID)
@@ -316,46 +1350,7 @@ func (d *Driver) WaitTask(ctx context.Context, taskID string) (<-chan *drivers.E
 		return nil, drivers.ErrTaskNotFound
 	}
 
-	ch := make(chan *drivers.ExitResult)
-	go d.handleWait(ctx, handle, ch)
-	return ch, nil
-}
-
-func (d *Driver) handleWait(ctx context.Context, handle *TaskHandle, ch chan *drivers.ExitResult) {
-	defer close(ch)
-	var result *drivers.ExitResult
-
-	// TODO: implement driver specific logic to notify Nomad the task has been
-	// completed and what was the exit result.
-	//
-	// When a result is sent in the result channel Nomad will stop the task and
-	// emit an event that an operator can use to get an insight on why the task
-	// stopped.
-	//
-	// In the example below we block and wait until the executor finishes
-	// running, at which point we send the exit code and signal in the result
-	// channel.
-	ps, err := handle.exec.Wait(ctx)
-	if err != nil {
-		result = &drivers.ExitResult{
-			Err: fmt.Errorf("executor: error waiting on process: %v", err),
-		}
-	} else {
-		result = &drivers.ExitResult{
-			ExitCode: ps.ExitCode,
-			Signal:   ps.Signal,
-		}
-	}
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-d.ctx.Done():
-			return
-		case ch <- result:
-		}
-	}
+	return d.reactor.wait(ctx, handle), nil
 }
 
 // StopTask stops a running task with the given signal and within the timeout window.
@@ -365,15 +1360,29 @@ func (d *Driver) StopTask(taskID string, timeout time.Duration, signal string) e
 		return drivers.ErrTaskNotFound
 	}
 
-	// TODO: implement driver specific logic to stop a task.
-	//
-	// The StopTask function is expected to stop a running task by sending the
-	// given signal to it. If the task does not stop during the given timeout,
-	// the driver must forcefully kill the task.
-	//
-	// In the example below we let the executor handle the task shutdown
-	// process for us, but you might need to customize this for your own
-	// implementation.
+	// Serve tasks first stop taking connections and drain the requests in
+	// flight, within the same timeout. Guests in the plugin are then
+	// interrupted at their next epoch check, and killed if they're stuck in
+	// a host call past the timeout; those run by the executor get the
+	// signal.
+	if handle.serve != nil {
+		start := time.Now()
+		if err := d.drainServe(handle, timeout); err != nil {
+			d.logger.Warn("failed to drain serve listener", "task_id", taskID, "error", err)
+		}
+		if timeout -= time.Since(start); timeout < 0 {
+			timeout = 0
+		}
+	}
+	if handle.guest != nil {
+		if handle.guest.shutdown(stopSignal(signal), timeout) {
+			d.logger.Warn("guest didn't exit within the stop timeout, killed it", "task_id", taskID, "timeout", timeout)
+		}
+		return nil
+	}
+	if handle.exec == nil {
+		return nil
+	}
 	if err := handle.exec.Shutdown(signal, timeout); err != nil {
 		if handle.pluginClient.Exited() {
 			return nil
@@ -395,21 +1404,23 @@ func (d *Driver) DestroyTask(taskID string, force bool) error {
 		return fmt.Errorf("cannot destroy running task")
 	}
 
-	// TODO: implement driver specific logic to destroy a complete task.
-	//
-	// Destroying a task includes removing any resources used by task and any
-	// local references in the plugin. If force is set to true the task should
-	// be destroyed even if it's currently running.
-	//
-	// In the example below we use the executor to force shutdown the task
-	// (timeout equals 0).
-	if !handle.pluginClient.Exited() {
-		if err := handle.exec.Shutdown("", 0); err != nil {
-			handle.logger.Error("destroying executor failed", "err", err)
-		}
+	handle.kill()
+	if handle.releaseAudit != nil {
+		handle.releaseAudit()
+	}
 
-		handle.pluginClient.Kill()
+	handle.logPumps.stop()
+	if err := d.debug.Prune(handle.taskConfig.AllocDir); err != nil {
+		d.logger.Warn("failed to apply debug artifact retention", "task_id", taskID, "error", err)
 	}
+	d.modules.Release(taskID)
+	d.codeBudget.release(taskID)
+	d.quotas.release(taskID)
+	d.allowlists.remove(taskID)
+	d.unstageMounts(handle.preopens)
+	d.configLock.RLock()
+	d.artifacts.Release(taskID)
+	d.configLock.RUnlock()
 
 	d.tasks.Delete(taskID)
 	return nil
@@ -432,15 +1443,7 @@ func (d *Driver) TaskStats(ctx context.Context, taskID string, interval time.Dur
 		return nil, drivers.ErrTaskNotFound
 	}
 
-	// TODO: implement driver specific logic to send task stats.
-	//
-	// This function returns a channel that Nomad will use to listen for task
-	// stats (e.g., CPU and memory usage) in a given interval. It should send
-	// stats until the context is canceled or the task stops running.
-	//
-	// In the example below we use the Stats function provided by the executor,
-	// but you can build a set of functions similar to the fingerprint process.
-	return handle.exec.Stats(ctx, interval)
+	return d.reactor.stats(ctx, handle, interval), nil
 }
 
 // TaskEvents returns a channel that the plugin can use to emit task related events.
@@ -456,11 +1459,25 @@ func (d *Driver) SignalTask(taskID string, signal string) error {
 		return drivers.ErrTaskNotFound
 	}
 
-	// TODO: implement driver specific signal handling logic.
-	//
-	// The given signal must be forwarded to the target taskID. If this plugin
-	// doesn't support receiving signals (capability SendSignals is set to
-	// false) you can just return nil.
+	if pause, ok := isPauseSignal(signal); ok {
+		return d.pauseTask(handle, pause)
+	}
+
+	if signal == "SIGHUP" && handle.serve != nil {
+		var driverConfig TaskConfig
+		if err := handle.taskConfig.DecodeDriverConfig(&driverConfig); err != nil {
+			return fmt.Errorf("failed to decode driver config: %v", err)
+		}
+		if driverConfig.Serve.ReloadFile != "" {
+			interpolateTaskConfig(handle.taskConfig, &driverConfig)
+			return d.reloadServe(handle, &driverConfig)
+		}
+	}
+
+	// guests in the plugin have no process to signal
+	if handle.exec == nil {
+		return fmt.Errorf("task can't receive %s, only pausing, resuming and reloading serve limits are supported", signal)
+	}
 	sig := os.Interrupt
 	if s, ok := signals.SignalLookup[signal]; ok {
 		sig = s
@@ -472,8 +1489,39 @@ func (d *Driver) SignalTask(taskID string, signal string) error {
 }
 
 // ExecTask returns the result of executing the given command inside a task.
-// This is an optional capability.
+// Guests have no shell, so only the driver's own commands are supported:
+//
+//	:bench N	invokes the module's entrypoint N times and returns
+//			latency percentiles and fuel per iteration as JSON
+//	:dump-memory PATH [--gzip] [--max-size=SIZE]
+//			writes the guest's linear memory to PATH in the alloc
+//			dir
+//	:history [N]	returns the last N invocations of the guest, calls
+//			and HTTP requests, with their durations and outcomes
+//			as JSON
 func (d *Driver) ExecTask(taskID string, cmd []string, timeout time.Duration) (*drivers.ExecTaskResult, error) {
-	// TODO: implement driver specific logic to execute commands in a task.
-	return nil, fmt.Errorf("wasmtime driver does not support exec")
+	handle, ok := d.tasks.Get(taskID)
+	if !ok {
+		return nil, drivers.ErrTaskNotFound
+	}
+
+	if n, ok, err := parseBenchCommand(cmd); ok {
+		if err != nil {
+			return nil, err
+		}
+		return d.execBench(handle, n, timeout)
+	}
+	if opts, ok, err := parseDumpCommand(cmd); ok {
+		if err != nil {
+			return nil, err
+		}
+		return d.execDumpMemory(handle, opts, timeout)
+	}
+	if n, ok, err := parseHistoryCommand(cmd); ok {
+		if err != nil {
+			return nil, err
+		}
+		return d.execHistory(handle, n)
+	}
+	return nil, fmt.Errorf("unsupported command %q, supported commands are: %s N, %s, %s", strings.Join(cmd, " "), benchCommand, dumpUsage, historyUsage)
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/base"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
+	"github.com/stretchr/testify/require"
+)
+
+func setConfig(t *testing.T, d *Driver, config *Config) error {
+	var b []byte
+	require.NoError(t, base.MsgPackEncode(&b, config))
+	return d.SetConfig(&base.Config{PluginConfig: b})
+}
+
+func TestDriver_SetConfigReload(t *testing.T) {
+	logger := hclog.New(&hclog.LoggerOptions{Output: ioutil.Discard})
+	d := NewWasmtimeDriver(logger).(*Driver)
+
+	dataDir := t.TempDir()
+	config := &Config{
+		DataDir:                dataDir,
+		LogLevel:               "info",
+		MaxConcurrentDownloads: 2,
+		KeyValue:               KeyValueConfig{Consul: ConsulKVConfig{Address: "127.0.0.1:8500"}},
+		Limits:                 TaskLimitsConfig{Memory: "64MiB"},
+	}
+	require.NoError(t, setConfig(t, d, config))
+	require.False(t, d.logger.IsDebug())
+	consul := d.kvBackends[kvBackendConsul]
+	artifacts := d.artifacts
+	downloads := d.downloads
+
+	// settings apply to the tasks started next, while unchanged backends are
+	// kept for the tasks using them
+	config.LogLevel = "debug"
+	config.MaxConcurrentDownloads = 5
+	config.Limits.Memory = "128MiB"
+	config.Capabilities = []string{capabilityWASI}
+	require.NoError(t, setConfig(t, d, config))
+	require.True(t, d.logger.IsDebug())
+	require.Same(t, downloads, d.downloads)
+	limit, _ := d.downloads.limits()
+	require.Equal(t, 5, limit)
+	require.Equal(t, "128MiB", d.config.Limits.Memory)
+	require.Equal(t, []string{capabilityWASI}, d.config.Capabilities)
+	require.Same(t, consul, d.kvBackends[kvBackendConsul])
+	require.Same(t, artifacts, d.artifacts)
+
+	config.KeyValue.Consul.Address = "127.0.0.1:8501"
+	require.NoError(t, setConfig(t, d, config))
+	require.NotSame(t, consul, d.kvBackends[kvBackendConsul])
+
+	// invalid configs leave the driver as it was
+	bad := *config
+	bad.LogLevel = "loud"
+	require.Error(t, setConfig(t, d, &bad))
+	bad = *config
+	bad.Limits.Memory = "lots"
+	require.Error(t, setConfig(t, d, &bad))
+	require.True(t, d.logger.IsDebug())
+	require.Equal(t, "128MiB", d.config.Limits.Memory)
+
+	// the data dir holds the modules of running tasks
+	d.tasks.Set("task", &TaskHandle{})
+	config.DataDir = t.TempDir()
+	require.NoError(t, setConfig(t, d, config))
+	require.Equal(t, dataDir, d.artifacts.dir)
+
+	d.tasks.Delete("task")
+	require.NoError(t, setConfig(t, d, config))
+	require.Equal(t, config.DataDir, d.artifacts.dir)
+}
+
+func TestDriver_Fingerprint(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+
+	fp := d.buildFingerprint()
+	require.Equal(t, drivers.HealthStateHealthy, fp.Health)
+	require.Equal(t, pstructs.NewBoolAttribute(true), fp.Attributes["driver.wasmtime.feature.simd"])
+	require.Equal(t, pstructs.NewBoolAttribute(false), fp.Attributes["driver.wasmtime.feature.component_model"])
+
+	// the cache warms up once modules are stored
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir()}))
+	require.Equal(t, pstructs.NewBoolAttribute(false), d.buildFingerprint().Attributes["driver.wasmtime.cache.warm"])
+	_, err := d.artifacts.Put("task", []byte("module"))
+	require.NoError(t, err)
+	fp = d.buildFingerprint()
+	require.Equal(t, pstructs.NewBoolAttribute(true), fp.Attributes["driver.wasmtime.cache.warm"])
+	require.Equal(t, pstructs.NewIntAttribute(1, ""), fp.Attributes["driver.wasmtime.cache.artifacts"])
+}
+
+func TestDriver_FingerprintCapacity(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir(), CompiledCodeBudget: "1KiB"}))
+	require.Equal(t, pstructs.NewBoolAttribute(false), d.buildFingerprint().Attributes["driver.wasmtime.capacity.exhausted"])
+
+	require.Error(t, d.codeBudget.reserve("task", 2048))
+	require.Equal(t, pstructs.NewBoolAttribute(true), d.buildFingerprint().Attributes["driver.wasmtime.capacity.exhausted"])
+}
+
+func TestDriver_SetConfigDuringStart(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	config := &Config{DataDir: t.TempDir(), Logging: LoggingConfig{DisableCollection: true}}
+	require.NoError(t, setConfig(t, d, config))
+
+	// the module is read from a FIFO, which holds up the start until it's
+	// written
+	cfg := newTestTask(t, nil)
+	pipe := filepath.Join(cfg.TaskDir().Dir, "pipe.wasm")
+	require.NoError(t, syscall.Mkfifo(pipe, 0600))
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{File: "pipe.wasm"}))
+	started := make(chan error, 1)
+	go func() {
+		_, _, err := d.StartTask(cfg)
+		started <- err
+	}()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&d.starting) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// unblocked eventually, should SetConfig wait for the start
+	var written int32
+	wasm, err := wasmtime.Wat2Wasm(helloWat)
+	require.NoError(t, err)
+	timer := time.AfterFunc(5*time.Second, func() {
+		atomic.StoreInt32(&written, 1)
+		ioutil.WriteFile(pipe, wasm, 0600)
+	})
+	defer timer.Stop()
+
+	config.LogLevel = "debug"
+	require.NoError(t, setConfig(t, d, config))
+	require.Zero(t, atomic.LoadInt32(&written), "SetConfig waited for the module to be read")
+
+	require.NoError(t, ioutil.WriteFile(pipe, wasm, 0600))
+	require.NoError(t, <-started)
+	require.Equal(t, 3, waitTestTask(t, d, cfg.ID).ExitCode)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// dumpMemoryCommand is the exec command dumping the guest's memory
+	dumpMemoryCommand = ":dump-memory"
+
+	// defaultDumpMaxSize is how much of the memory is dumped if the command
+	// doesn't set --max-size
+	defaultDumpMaxSize = 256 << 20
+
+	// defaultDumpTimeout is how long a running guest has to make the host
+	// call its memory is copied at, if the exec command has no timeout
+	defaultDumpTimeout = 30 * time.Second
+)
+
+// dumpOptions are the arguments of a :dump-memory command
+type dumpOptions struct {
+	// path is where the dump is written, relative to the alloc dir
+	path     string
+	compress bool
+	maxSize  int64
+}
+
+// dumpResult is the JSON document returned by :dump-memory
+type dumpResult struct {
+	Path string `json:"path"`
+
+	// Bytes is the size of the dump file, MemorySize the size of the memory
+	Bytes      int64 `json:"bytes"`
+	MemorySize int64 `json:"memory_size"`
+
+	// Truncated is set if the memory is larger than the maximum size and
+	// only its beginning was dumped
+	Truncated  bool `json:"truncated"`
+	Compressed bool `json:"compressed"`
+}
+
+const dumpUsage = dumpMemoryCommand + " PATH [--gzip] [--max-size=SIZE]"
+
+// parseDumpCommand returns the options of a :dump-memory command, which may
+// be passed as one or several arguments
+func parseDumpCommand(cmd []string) (*dumpOptions, bool, error) {
+	fields := strings.Fields(strings.Join(cmd, " "))
+	if len(fields) == 0 || fields[0] != dumpMemoryCommand {
+		return nil, false, nil
+	}
+
+	opts := &dumpOptions{maxSize: defaultDumpMaxSize}
+	for _, f := range fields[1:] {
+		switch {
+		case f == "--gzip":
+			opts.compress = true
+		case strings.HasPrefix(f, "--max-size="):
+			size, err := humanize.ParseBytes(strings.TrimPrefix(f, "--max-size="))
+			if err != nil || size == 0 {
+				return nil, true, fmt.Errorf("invalid %s", f)
+			}
+			opts.maxSize = int64(size)
+		case strings.HasPrefix(f, "--") || opts.path != "":
+			return nil, true, fmt.Errorf("usage: %s", dumpUsage)
+		default:
+			opts.path = f
+		}
+	}
+	if opts.path == "" {
+		return nil, true, fmt.Errorf("usage: %s", dumpUsage)
+	}
+	return opts, true, nil
+}
+
+// dumpPath returns the host path of the dump at path, which must stay
+// within allocDir
+func dumpPath(allocDir, path string) (string, error) {
+	rel := filepath.Clean(path)
+	if filepath.IsAbs(rel) || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("dump path %q must be relative to the alloc dir", path)
+	}
+	return filepath.Join(allocDir, rel), nil
+}
+
+// dumpMemory writes the linear memory of the task's newest instance to the
+// alloc dir. The memory of a running guest is copied by its own goroutine at
+// its next host call, or while it waits to be resumed if the task is paused,
+// failing if that doesn't happen within timeout.
+func (d *Driver) dumpMemory(h *TaskHandle, opts *dumpOptions, timeout time.Duration) (*dumpResult, error) {
+	path, err := dumpPath(h.taskConfig.AllocDir, opts.path)
+	if err != nil {
+		return nil, err
+	}
+	instance := d.instances.newest(h.taskConfig.ID)
+	if instance == nil {
+		return nil, fmt.Errorf("task has no running instance to dump")
+	}
+	if timeout <= 0 {
+		timeout = defaultDumpTimeout
+	}
+	data, size, err := instance.memory(opts.maxSize, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy the guest's memory: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dump dir: %v", err)
+	}
+	// an existing file may be an earlier dump still needed
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dump: %v", err)
+	}
+	defer f.Close()
+
+	result := &dumpResult{
+		Path:       opts.path,
+		MemorySize: size,
+		Truncated:  size > int64(len(data)),
+		Compressed: opts.compress,
+	}
+
+	var w io.Writer = f
+	var zw *gzip.Writer
+	if opts.compress {
+		zw = gzip.NewWriter(f)
+		w = zw
+	}
+	_, err = w.Write(data)
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to write dump: %v", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	result.Bytes = fi.Size()
+	d.recordDebugArtifact(h, debugMemoryDump, filepath.Clean(opts.path))
+	return result, nil
+}
+
+// execDumpMemory runs :dump-memory and returns its result as the command's
+// output
+func (d *Driver) execDumpMemory(h *TaskHandle, opts *dumpOptions, timeout time.Duration) (*drivers.ExecTaskResult, error) {
+	result, err := d.dumpMemory(h, opts, timeout)
+	if err != nil {
+		return &drivers.ExecTaskResult{
+			Stderr:     []byte(err.Error() + "\n"),
+			ExitResult: &drivers.ExitResult{ExitCode: 1},
+		}, nil
+	}
+
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return &drivers.ExecTaskResult{
+		Stdout:     append(out, '\n'),
+		ExitResult: &drivers.ExitResult{},
+	}, nil
+}
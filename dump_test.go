@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDumpCommand(t *testing.T) {
+	opts, ok, err := parseDumpCommand([]string{":dump-memory", "alloc/mem.bin"})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, &dumpOptions{path: "alloc/mem.bin", maxSize: defaultDumpMaxSize}, opts)
+
+	opts, ok, err = parseDumpCommand([]string{":dump-memory alloc/mem.gz --gzip --max-size=1MiB"})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, &dumpOptions{path: "alloc/mem.gz", compress: true, maxSize: 1 << 20}, opts)
+
+	_, ok, _ = parseDumpCommand([]string{":bench", "1"})
+	require.False(t, ok)
+
+	for _, cmd := range [][]string{
+		{":dump-memory"},
+		{":dump-memory", "a", "b"},
+		{":dump-memory", "a", "--zstd"},
+		{":dump-memory", "a", "--max-size=lots"},
+	} {
+		_, ok, err := parseDumpCommand(cmd)
+		require.True(t, ok)
+		require.Error(t, err, "%v", cmd)
+	}
+}
+
+func TestDumpPath(t *testing.T) {
+	path, err := dumpPath("/alloc", "alloc/dumps/mem.bin")
+	require.NoError(t, err)
+	require.Equal(t, "/alloc/alloc/dumps/mem.bin", path)
+
+	for _, p := range []string{"/etc/passwd", "..", "../other/mem.bin", "."} {
+		_, err := dumpPath("/alloc", p)
+		require.Error(t, err, p)
+	}
+}
+
+func TestExecTask_DumpMemory(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	allocDir := t.TempDir()
+	cfg := &drivers.TaskConfig{ID: "id", Name: "task", AllocDir: allocDir}
+	d.tasks.Set(cfg.ID, &TaskHandle{taskConfig: cfg})
+
+	// nothing to dump until the task has an instance
+	res, err := d.ExecTask(cfg.ID, []string{":dump-memory", "alloc/mem.bin"}, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 1, res.ExitResult.ExitCode)
+
+	memory := bytes.Repeat([]byte("wasm"), 1024)
+	release := d.instances.registerWithMemory(cfg.ID, func() {}, func() []byte { return memory })
+	defer release()
+
+	res, err = d.ExecTask(cfg.ID, []string{":dump-memory", "alloc/mem.bin"}, time.Minute)
+	require.NoError(t, err)
+	require.Zero(t, res.ExitResult.ExitCode, string(res.Stderr))
+	var result dumpResult
+	require.NoError(t, json.Unmarshal(res.Stdout, &result))
+	require.Equal(t, dumpResult{Path: "alloc/mem.bin", Bytes: 4096, MemorySize: 4096}, result)
+	dump, err := ioutil.ReadFile(filepath.Join(allocDir, "alloc", "mem.bin"))
+	require.NoError(t, err)
+	require.Equal(t, memory, dump)
+
+	// earlier dumps aren't overwritten
+	res, err = d.ExecTask(cfg.ID, []string{":dump-memory", "alloc/mem.bin"}, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 1, res.ExitResult.ExitCode)
+
+	res, err = d.ExecTask(cfg.ID, []string{":dump-memory", "alloc/mem.gz", "--gzip", "--max-size=1KiB"}, time.Minute)
+	require.NoError(t, err)
+	require.Zero(t, res.ExitResult.ExitCode, string(res.Stderr))
+	require.NoError(t, json.Unmarshal(res.Stdout, &result))
+	require.True(t, result.Truncated)
+	require.True(t, result.Compressed)
+
+	f, err := ioutil.ReadFile(filepath.Join(allocDir, "alloc", "mem.gz"))
+	require.NoError(t, err)
+	zr, err := gzip.NewReader(bytes.NewReader(f))
+	require.NoError(t, err)
+	dump, err = ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	require.Equal(t, memory[:1024], dump)
+
+	// the dumps are recorded for the debug artifact retention
+	index, err := loadDebugIndex(allocDir)
+	require.NoError(t, err)
+	require.Len(t, index, 2)
+	require.Equal(t, debugMemoryDump, index[0].Kind)
+}
+
+func TestStoreAccess_Do(t *testing.T) {
+	a := &storeAccess{}
+
+	// functions run right away while the guest isn't running
+	ran := false
+	require.NoError(t, a.do(func() { ran = true }, time.Second))
+	require.True(t, ran)
+
+	// and on the guest's goroutine at its next host call while it is
+	a.enter()
+	ran = false
+	done := make(chan error)
+	go func() { done <- a.do(func() { ran = true }, time.Minute) }()
+	require.Eventually(t, func() bool {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		return len(a.pending) == 1
+	}, time.Second, time.Millisecond)
+	a.hostCall()
+	require.NoError(t, <-done)
+	require.True(t, ran)
+
+	// guests making no host call in time can't be reached
+	err := a.do(func() { t.Fatal("ran after its timeout") }, 10*time.Millisecond)
+	require.EqualError(t, err, "the guest didn't make a host call within 10ms")
+	a.exit()
+	require.Empty(t, a.pending)
+}
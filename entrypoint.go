@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// entrypointResultSuffix names the file the results of a task's entrypoint
+// are written to, in the shared alloc dir so the other tasks of the
+// allocation can read them
+const entrypointResultSuffix = ".result.json"
+
+// entrypointResult is what the task's entrypoint returned
+type entrypointResult struct {
+	Entrypoint string        `json:"entrypoint"`
+	Results    []interface{} `json:"results"`
+}
+
+// entrypointResultPath returns where the results of the task's entrypoint
+// are written
+func entrypointResultPath(cfg *drivers.TaskConfig) string {
+	return filepath.Join(cfg.TaskDir().SharedAllocDir, cfg.Name+entrypointResultSuffix)
+}
+
+// taskEntrypoint returns the export the task's guest is started with
+func taskEntrypoint(driverConfig *TaskConfig) string {
+	if driverConfig.Entrypoint != "" {
+		return driverConfig.Entrypoint
+	}
+	return startExport
+}
+
+// entrypointArgs converts the task's call_args to the params of the module's
+// export name: numbers, or strings holding them, as i32, i64, f32 or f64
+func entrypointArgs(module *wasmtime.Module, name string, args []interface{}) ([]interface{}, error) {
+	var ft *wasmtime.FuncType
+	for _, e := range module.Exports() {
+		if e.Name() == name {
+			ft = e.Type().FuncType()
+		}
+	}
+	if ft == nil {
+		return nil, fmt.Errorf("module doesn't export function %q", name)
+	}
+	params := ft.Params()
+	if len(params) != len(args) {
+		return nil, fmt.Errorf("%q takes %d arguments, %d given in call_args", name, len(params), len(args))
+	}
+
+	result := make([]interface{}, len(args))
+	for i, arg := range args {
+		v, err := convertCallArg(arg, params[i].Kind())
+		if err != nil {
+			return nil, fmt.Errorf("invalid call_args[%d] %v: %v", i, arg, err)
+		}
+		result[i] = v
+	}
+	return result, nil
+}
+
+// convertCallArg converts a value of the task config to kind
+func convertCallArg(arg interface{}, kind wasmtime.ValKind) (interface{}, error) {
+	var s string
+	switch v := arg.(type) {
+	case string:
+		s = strings.TrimSpace(v)
+	case int, int64, uint64:
+		s = fmt.Sprint(v)
+	case float64:
+		// HCL numbers may be decoded as floats, which would print large
+		// integers in exponent form
+		if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+			s = strconv.FormatInt(int64(v), 10)
+		} else {
+			s = strconv.FormatFloat(v, 'g', -1, 64)
+		}
+	default:
+		return nil, fmt.Errorf("must be a number")
+	}
+
+	switch kind {
+	case wasmtime.KindI32:
+		n, err := strconv.ParseInt(s, 0, 32)
+		return int32(n), err
+	case wasmtime.KindI64:
+		return strconv.ParseInt(s, 0, 64)
+	case wasmtime.KindF32:
+		f, err := strconv.ParseFloat(s, 32)
+		return float32(f), err
+	case wasmtime.KindF64:
+		return strconv.ParseFloat(s, 64)
+	}
+	return nil, fmt.Errorf("params of type %s aren't supported", kind)
+}
+
+// entrypointResults returns the values returned by a call as a list
+func entrypointResults(v interface{}) []interface{} {
+	switch v := v.(type) {
+	case nil:
+		return []interface{}{}
+	case []wasmtime.Val:
+		results := make([]interface{}, len(v))
+		for i, val := range v {
+			results[i] = val.Get()
+		}
+		return results
+	}
+	return []interface{}{v}
+}
+
+// writeEntrypointResult writes what the task's entrypoint returned
+func writeEntrypointResult(cfg *drivers.TaskConfig, r *entrypointResult) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	path := entrypointResultPath(cfg)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// emitEntrypointResult sends an event with the results of the task's
+// entrypoint, if it returned. The result file is read rather than kept in
+// the handle, as the runner of a forked task writes it.
+func (d *Driver) emitEntrypointResult(cfg *drivers.TaskConfig) {
+	b, err := ioutil.ReadFile(entrypointResultPath(cfg))
+	if os.IsNotExist(err) {
+		return
+	}
+	var r entrypointResult
+	if err == nil {
+		err = json.Unmarshal(b, &r)
+	}
+	if err != nil {
+		d.logger.Warn("failed to read entrypoint result", "task_id", cfg.ID, "error", err)
+		return
+	}
+
+	results, _ := json.Marshal(r.Results)
+	err = d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:      cfg.ID,
+		AllocID:     cfg.AllocID,
+		TaskName:    cfg.Name,
+		Timestamp:   time.Now(),
+		Message:     fmt.Sprintf("Entrypoint %s returned %s", r.Entrypoint, results),
+		Annotations: map[string]string{"entrypoint": r.Entrypoint, "results": string(results)},
+	})
+	if err != nil {
+		d.logger.Warn("failed to emit entrypoint result event", "task_id", cfg.ID, "error", err)
+	}
+}
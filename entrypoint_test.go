@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+// computeWat exports a function with params and results of every type
+const computeWat = `
+(module
+  (memory (export "memory") 1)
+  (func (export "compute") (param i32 i64 f32 f64) (result i64 f64)
+    (i64.add (i64.extend_i32_s (local.get 0)) (local.get 1))
+    (f64.add (f64.promote_f32 (local.get 2)) (local.get 3)))
+)`
+
+func TestConvertCallArg(t *testing.T) {
+	for _, c := range []struct {
+		arg  interface{}
+		kind wasmtime.ValKind
+		want interface{}
+	}{
+		{int64(-3), wasmtime.KindI32, int32(-3)},
+		{"0x10", wasmtime.KindI32, int32(16)},
+		{float64(1 << 40), wasmtime.KindI64, int64(1 << 40)},
+		{uint64(7), wasmtime.KindI64, int64(7)},
+		{float64(0.5), wasmtime.KindF32, float32(0.5)},
+		{"2.25", wasmtime.KindF64, float64(2.25)},
+	} {
+		v, err := convertCallArg(c.arg, c.kind)
+		require.NoError(t, err, "%v", c.arg)
+		require.Equal(t, c.want, v)
+	}
+
+	for _, c := range []struct {
+		arg  interface{}
+		kind wasmtime.ValKind
+	}{
+		{"ten", wasmtime.KindI32},
+		{float64(0.5), wasmtime.KindI32},
+		{int64(1 << 40), wasmtime.KindI32},
+		{true, wasmtime.KindI32},
+		{int64(1), wasmtime.KindExternref},
+	} {
+		_, err := convertCallArg(c.arg, c.kind)
+		require.Error(t, err, "%v", c.arg)
+	}
+}
+
+func TestEntrypointArgs(t *testing.T) {
+	engine := wasmtime.NewEngine()
+	wasm, err := wasmtime.Wat2Wasm(computeWat)
+	require.NoError(t, err)
+	module, err := wasmtime.NewModule(engine, wasm)
+	require.NoError(t, err)
+
+	args, err := entrypointArgs(module, "compute", []interface{}{int64(1), "2", float64(0.5), float64(0.25)})
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{int32(1), int64(2), float32(0.5), float64(0.25)}, args)
+
+	_, err = entrypointArgs(module, "compute", []interface{}{int64(1)})
+	require.EqualError(t, err, `"compute" takes 4 arguments, 1 given in call_args`)
+	_, err = entrypointArgs(module, "memory", nil)
+	require.EqualError(t, err, `module doesn't export function "memory"`)
+}
+
+func TestStartTask_Entrypoint(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := startTestTask(t, d, computeWat, &TaskConfig{
+		Entrypoint: "compute",
+		CallArgs:   []interface{}{int64(40), "2", float64(1.5), float64(0.25)},
+	})
+	require.Zero(t, waitTestTask(t, d, cfg.ID).ExitCode)
+
+	b, err := ioutil.ReadFile(entrypointResultPath(cfg))
+	require.NoError(t, err)
+	var r entrypointResult
+	require.NoError(t, json.Unmarshal(b, &r))
+	require.Equal(t, "compute", r.Entrypoint)
+	require.Equal(t, []interface{}{float64(42), 1.75}, r.Results)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{File: "main.wasm", CallArgs: []interface{}{int64(1)}}))
+	_, _, err = d.StartTask(cfg)
+	require.EqualError(t, err, "call_args requires an entrypoint")
+
+	// the results of the last attempt are removed when the task starts
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{File: "main.wasm", Entrypoint: "missing"}))
+	_, _, err = d.StartTask(cfg)
+	require.Error(t, err)
+	require.NoFileExists(t, entrypointResultPath(cfg))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+// defaultEpochInterval is how often the epoch of engines is incremented if
+// the plugin config doesn't set epoch.interval
+const defaultEpochInterval = 10 * time.Millisecond
+
+// noEpochDeadline is the deadline of stores without one, in ticks
+const noEpochDeadline = math.MaxUint64 / 2
+
+// epochTicker increments the epoch of the registered engines every
+// interval. Guests are interrupted once their store's deadline, counted in
+// ticks, is reached: a shorter interval interrupts them closer to their
+// deadline at the cost of more wakeups on dense nodes.
+type epochTicker struct {
+	lock     sync.Mutex
+	interval time.Duration
+	engines  map[*wasmtime.Engine]int
+	reset    chan time.Duration
+}
+
+func newEpochTicker(interval time.Duration) *epochTicker {
+	return &epochTicker{
+		interval: interval,
+		engines:  map[*wasmtime.Engine]int{},
+		reset:    make(chan time.Duration, 1),
+	}
+}
+
+// add ticks the epoch of engine until the returned func is called
+func (t *epochTicker) add(engine *wasmtime.Engine) func() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.engines[engine]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.lock.Lock()
+			defer t.lock.Unlock()
+			if t.engines[engine]--; t.engines[engine] == 0 {
+				delete(t.engines, engine)
+			}
+		})
+	}
+}
+
+// SetInterval changes the interval of the ticks. Deadlines set before keep
+// their number of ticks.
+func (t *epochTicker) SetInterval(interval time.Duration) {
+	t.lock.Lock()
+	changed := interval != t.interval
+	t.interval = interval
+	t.lock.Unlock()
+
+	if changed {
+		select {
+		case <-t.reset:
+		default:
+		}
+		t.reset <- interval
+	}
+}
+
+// ticks returns the number of ticks to set as the epoch deadline of a
+// store interrupted after deadline, 0 for none
+func (t *epochTicker) ticks(deadline time.Duration) uint64 {
+	if deadline <= 0 {
+		return noEpochDeadline
+	}
+	t.lock.Lock()
+	interval := t.interval
+	t.lock.Unlock()
+
+	// rounded up, so guests get at least their deadline
+	n := uint64((deadline + interval - 1) / interval)
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
+func (t *epochTicker) tick() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for engine := range t.engines {
+		engine.IncrementEpoch()
+	}
+}
+
+// run ticks until ctx is done
+func (t *epochTicker) run(ctx context.Context) {
+	t.lock.Lock()
+	ticker := time.NewTicker(t.interval)
+	t.lock.Unlock()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case interval := <-t.reset:
+			ticker.Reset(interval)
+		case <-ticker.C:
+			t.tick()
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEpochTicker_Ticks(t *testing.T) {
+	ticker := newEpochTicker(10 * time.Millisecond)
+	require.Equal(t, uint64(noEpochDeadline), ticker.ticks(0))
+	require.Equal(t, uint64(1), ticker.ticks(time.Millisecond))
+	require.Equal(t, uint64(1), ticker.ticks(10*time.Millisecond))
+	require.Equal(t, uint64(3), ticker.ticks(25*time.Millisecond))
+
+	ticker.SetInterval(time.Second)
+	require.Equal(t, uint64(30), ticker.ticks(30*time.Second))
+}
+
+func TestEpochTicker_Interrupts(t *testing.T) {
+	config := wasmtime.NewConfig()
+	config.SetEpochInterruption(true)
+	config.SetConsumeFuel(true)
+	engine := wasmtime.NewEngineWithConfig(config)
+	wasm, err := wasmtime.Wat2Wasm(`(module (func (export "_start") (loop br 0)))`)
+	require.NoError(t, err)
+	module, err := wasmtime.NewModule(engine, wasm)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ticker := newEpochTicker(time.Millisecond)
+	go ticker.run(ctx)
+	defer ticker.add(engine)()
+
+	start := time.Now()
+	_, _, err = benchIteration(engine, module, nil, 1<<62, ticker.ticks(50*time.Millisecond))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "interrupt")
+	require.True(t, time.Since(start) >= 50*time.Millisecond)
+}
+
+func TestParsePluginConfig_Epoch(t *testing.T) {
+	settings, err := parsePluginConfig(&Config{Epoch: EpochConfig{Interval: "50ms", CallDeadline: "1s"}})
+	require.NoError(t, err)
+	require.Equal(t, 50*time.Millisecond, settings.epochInterval)
+	require.Equal(t, time.Second, settings.callDeadline)
+
+	_, err = parsePluginConfig(&Config{Epoch: EpochConfig{Interval: "often"}})
+	require.Error(t, err)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+// defaultFeatures are the proposals tasks may use if the plugin config
+// doesn't set compiler.features, the ones wasmtime enables by default
+var defaultFeatures = []string{"bulk_memory", "multi_value", "reference_types", "simd"}
+
+// allowedFeatures returns the proposals tasks may use, validating the names
+// of compiler.features
+func allowedFeatures(config PluginCompilerConfig) (map[string]bool, error) {
+	names := config.Features
+	if len(names) == 0 {
+		names = defaultFeatures
+	}
+
+	supported := supportedFeatures()
+	allowed := make(map[string]bool, len(names))
+	for _, name := range names {
+		ok, known := supported[name]
+		if !known {
+			return nil, fmt.Errorf("unknown feature %q", name)
+		} else if !ok {
+			return nil, fmt.Errorf("feature %q isn't supported by this build of wasmtime", name)
+		}
+		allowed[name] = true
+	}
+	return allowed, nil
+}
+
+// taskFeatures returns the proposals wasm uses, which are enabled for its
+// task, or an error naming the ones the plugin doesn't allow. Precompiled
+// modules can't be inspected, so they get every proposal the plugin allows
+// and must have been built with those.
+func taskFeatures(config PluginCompilerConfig, wasm []byte) ([]string, error) {
+	allowed, err := allowedFeatures(config)
+	if err != nil {
+		return nil, err
+	}
+	if isPrecompiledModule(wasm) {
+		features := make([]string, 0, len(allowed))
+		for name := range allowed {
+			features = append(features, name)
+		}
+		sort.Strings(features)
+		return features, nil
+	}
+	required, err := requiredFeatures(wasm)
+	if err != nil {
+		return nil, err
+	}
+
+	var denied []string
+	for _, name := range required {
+		if !allowed[name] {
+			denied = append(denied, name)
+		}
+	}
+	if len(denied) > 0 {
+		return nil, fmt.Errorf("module requires the %s proposal(s), add them to compiler.features in the plugin config to allow them", strings.Join(denied, ", "))
+	}
+	return required, nil
+}
+
+// taskEngineConfig returns an engine config enabling only features among
+// the proposals
+func taskEngineConfig(features []string) *wasmtime.Config {
+	cfg := wasmtime.NewConfig()
+	enableTaskFeatures(cfg, features)
+	return cfg
+}
+
+// enableTaskFeatures enables only features among the proposals of cfg. It
+// must be called after the strategy is set, as setting it resets the
+// compiler settings reference types depend on.
+func enableTaskFeatures(cfg *wasmtime.Config, features []string) {
+	enabled := make(map[string]bool, len(features))
+	for _, name := range features {
+		enabled[name] = true
+	}
+	for _, f := range wasmFeatures {
+		f.enable(cfg, enabled[f.name])
+	}
+}
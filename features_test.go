@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowedFeatures(t *testing.T) {
+	allowed, err := allowedFeatures(PluginCompilerConfig{})
+	require.NoError(t, err)
+	require.True(t, allowed["simd"])
+	require.False(t, allowed["threads"])
+
+	allowed, err = allowedFeatures(PluginCompilerConfig{Features: []string{"threads"}})
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"threads": true}, allowed)
+
+	_, err = allowedFeatures(PluginCompilerConfig{Features: []string{"teleport"}})
+	require.EqualError(t, err, `unknown feature "teleport"`)
+	_, err = allowedFeatures(PluginCompilerConfig{Features: []string{"gc"}})
+	require.Error(t, err)
+}
+
+func TestTaskFeatures(t *testing.T) {
+	wasm, err := wasmtime.Wat2Wasm(`(module (memory 1) (memory 1))`)
+	require.NoError(t, err)
+
+	_, err = taskFeatures(PluginCompilerConfig{}, wasm)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "multi_memory")
+	require.Contains(t, err.Error(), "compiler.features")
+
+	features, err := taskFeatures(PluginCompilerConfig{Features: []string{"multi_memory"}}, wasm)
+	require.NoError(t, err)
+	require.Equal(t, []string{"multi_memory"}, features)
+
+	// the engine only enables the features the module uses
+	engine := wasmtime.NewEngineWithConfig(taskEngineConfig(features))
+	require.NoError(t, wasmtime.ModuleValidate(engine, wasm))
+	simd, err := wasmtime.Wat2Wasm(`(module (func (result v128) (v128.const i64x2 0 0)))`)
+	require.NoError(t, err)
+	require.Error(t, wasmtime.ModuleValidate(engine, simd))
+
+	features, err = taskFeatures(PluginCompilerConfig{}, simd)
+	require.NoError(t, err)
+	require.Equal(t, []string{"simd"}, features)
+
+	// reference types survive setting the compiler strategy
+	externref, err := wasmtime.Wat2Wasm(`(module (func (param externref)))`)
+	require.NoError(t, err)
+	config, _, err := engineConfig(WasmTimeCompiler{}, []string{"bulk_memory", "reference_types"})
+	require.NoError(t, err)
+	_, err = wasmtime.NewModule(wasmtime.NewEngineWithConfig(config), externref)
+	require.NoError(t, err)
+
+	// precompiled modules get every feature the plugin allows
+	features, err = taskFeatures(PluginCompilerConfig{}, cwasmMagic)
+	require.NoError(t, err)
+	require.Equal(t, []string{"bulk_memory", "multi_value", "reference_types", "simd"}, features)
+}
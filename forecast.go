@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// forecastSection is the custom section in which a module declares the
+// resources it expects to need, as JSON, e.g.
+//
+//	{"memory": "64MiB", "fuel": 50000000}
+//
+// Modules pulled from images carry it along, as the image's module is what
+// the driver runs.
+const forecastSection = "nomad.resources"
+
+// resourceForecast is the memory and fuel a module expects to need. Zero
+// values aren't forecast.
+type resourceForecast struct {
+	// Memory is the peak size of the guest's linear memory in bytes
+	Memory uint64 `json:"memory,omitempty"`
+
+	// Fuel is the fuel consumed by a run of the guest
+	Fuel uint64 `json:"fuel,omitempty"`
+}
+
+// parseForecast parses the data of the forecast section
+func parseForecast(data []byte) (*resourceForecast, error) {
+	var section struct {
+		Memory string `json:"memory"`
+		Fuel   uint64 `json:"fuel"`
+	}
+	if err := json.Unmarshal(data, &section); err != nil {
+		return nil, fmt.Errorf("invalid %s section: %v", forecastSection, err)
+	}
+	f := &resourceForecast{Fuel: section.Fuel}
+	if section.Memory != "" {
+		memory, err := humanize.ParseBytes(section.Memory)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s section: invalid memory %q", forecastSection, section.Memory)
+		}
+		f.Memory = memory
+	}
+	return f, nil
+}
+
+// allocatedMemory returns the memory Nomad allocated to the task in bytes,
+// its memory_max if oversubscribed, 0 if unknown
+func allocatedMemory(cfg *drivers.TaskConfig) uint64 {
+	if cfg.Resources == nil || cfg.Resources.NomadResources == nil {
+		return 0
+	}
+	memory := cfg.Resources.NomadResources.Memory
+	if memory.MemoryMaxMB > memory.MemoryMB {
+		return uint64(memory.MemoryMaxMB) << 20
+	}
+	return uint64(memory.MemoryMB) << 20
+}
+
+// checkForecast returns how the task's resources and limits fall short of
+// the module's forecast, nil if they don't or it has none
+func checkForecast(cfg *drivers.TaskConfig, limits *taskLimits, f *resourceForecast) []string {
+	if f == nil {
+		return nil
+	}
+	var undersized []string
+	if memory := allocatedMemory(cfg); f.Memory != 0 && memory != 0 && f.Memory > memory {
+		undersized = append(undersized, fmt.Sprintf("the module forecasts %s of memory, the task is allocated %s",
+			humanize.IBytes(f.Memory), humanize.IBytes(memory)))
+	}
+	if f.Memory != 0 && limits.memory != 0 && f.Memory > limits.memory {
+		undersized = append(undersized, fmt.Sprintf("the module forecasts %s of memory, above the memory limit of %s",
+			humanize.IBytes(f.Memory), humanize.IBytes(limits.memory)))
+	}
+	if f.Fuel != 0 && limits.fuel != 0 && f.Fuel > limits.fuel {
+		undersized = append(undersized, fmt.Sprintf("the module forecasts %d fuel, above the fuel limit of %d", f.Fuel, limits.fuel))
+	}
+	return undersized
+}
+
+// emitUndersized sends an event telling the task is started with less than
+// its module forecasts
+func (d *Driver) emitUndersized(cfg *drivers.TaskConfig, undersized []string) {
+	err := d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:    cfg.ID,
+		AllocID:   cfg.AllocID,
+		TaskName:  cfg.Name,
+		Timestamp: time.Now(),
+		Message:   "Task is undersized: " + strings.Join(undersized, "; "),
+	})
+	if err != nil {
+		d.logger.Warn("failed to emit undersized task event", "task_id", cfg.ID, "error", err)
+	}
+}
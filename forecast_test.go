@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseForecast(t *testing.T) {
+	f, err := parseForecast([]byte(`{"memory": "64MiB", "fuel": 5000}`))
+	require.NoError(t, err)
+	require.Equal(t, &resourceForecast{Memory: 64 << 20, Fuel: 5000}, f)
+	f, err = parseForecast([]byte(`{}`))
+	require.NoError(t, err)
+	require.Equal(t, &resourceForecast{}, f)
+
+	for _, data := range []string{`{`, `{"memory": "lots"}`, `{"fuel": -1}`} {
+		_, err := parseForecast([]byte(data))
+		require.Error(t, err, data)
+	}
+}
+
+func TestReadModuleMetadata_Forecast(t *testing.T) {
+	wasm, err := wasmtime.Wat2Wasm(`(module)`)
+	require.NoError(t, err)
+	m, err := readModuleMetadata(append(wasm, customSection(forecastSection, []byte(`{"memory": "1MiB", "fuel": 100}`))...))
+	require.NoError(t, err)
+	require.Equal(t, &resourceForecast{Memory: 1 << 20, Fuel: 100}, m.Forecast)
+	require.Equal(t, "1.0 MiB", m.attributes()["module_forecast_memory"])
+	require.Equal(t, "100", m.attributes()["module_forecast_fuel"])
+
+	// unlike the producers, a malformed forecast fails the module
+	_, err = readModuleMetadata(append(wasm, customSection(forecastSection, []byte(`{`))...))
+	require.Error(t, err)
+}
+
+func TestCheckForecast(t *testing.T) {
+	cfg := &drivers.TaskConfig{Resources: &drivers.Resources{NomadResources: &structs.AllocatedTaskResources{
+		Memory: structs.AllocatedMemoryResources{MemoryMB: 64},
+	}}}
+	limits := &taskLimits{memory: 128 << 20, fuel: 1000}
+
+	require.Empty(t, checkForecast(cfg, limits, nil))
+	require.Empty(t, checkForecast(cfg, limits, &resourceForecast{Memory: 64 << 20, Fuel: 1000}))
+	require.Empty(t, checkForecast(&drivers.TaskConfig{}, &taskLimits{}, &resourceForecast{Memory: 1 << 30, Fuel: 1 << 40}))
+
+	require.Equal(t, []string{
+		"the module forecasts 256 MiB of memory, the task is allocated 64 MiB",
+		"the module forecasts 256 MiB of memory, above the memory limit of 128 MiB",
+		"the module forecasts 2000 fuel, above the fuel limit of 1000",
+	}, checkForecast(cfg, limits, &resourceForecast{Memory: 256 << 20, Fuel: 2000}))
+
+	// memory_max counts if the task is oversubscribed
+	cfg.Resources.NomadResources.Memory.MemoryMaxMB = 512
+	require.Len(t, checkForecast(cfg, limits, &resourceForecast{Memory: 256 << 20}), 1)
+}
+
+func TestStartTask_Forecast(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{
+		DataDir:        t.TempDir(),
+		Logging:        LoggingConfig{DisableCollection: true},
+		StrictForecast: true,
+	}))
+
+	wasm, err := wasmtime.Wat2Wasm(helloWat)
+	require.NoError(t, err)
+	cfg := newTestTask(t, append(wasm, customSection(forecastSection, []byte(`{"fuel": 1000000}`))...))
+
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{File: "main.wasm", Limits: TaskLimitsConfig{Fuel: 1000}}))
+	_, _, err = d.StartTask(cfg)
+	require.EqualError(t, err, "task is undersized for its module: the module forecasts 1000000 fuel, above the fuel limit of 1000")
+
+	// given the fuel it forecasts, the task starts
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{File: "main.wasm", Limits: TaskLimitsConfig{Fuel: 1000000}}))
+	_, _, err = d.StartTask(cfg)
+	require.NoError(t, err)
+	require.Equal(t, 3, waitTestTask(t, d, cfg.ID).ExitCode)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
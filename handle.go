@@ -2,15 +2,20 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/hashicorp/go-hclog"
 	plugin "github.com/hashicorp/go-plugin"
 	"github.com/hashicorp/nomad/client/stats"
 	"github.com/hashicorp/nomad/drivers/shared/executor"
 	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/opencontainers/go-digest"
+	"github.com/shirou/gopsutil/v3/process"
 )
 
 // TaskHandle should store all relevant runtime information
@@ -19,9 +24,10 @@ import (
 type TaskHandle struct {
 	logger hclog.Logger
 
-	totalCPUStats  *stats.CPUStats
-	userCPUStats   *stats.CPUStats
-	systemCPUStats *stats.CPUStats
+	// the CPU usage calculators, only used by the reactor's goroutine
+	totalCPUStats  *stats.CpuStats
+	userCPUStats   *stats.CpuStats
+	systemCPUStats *stats.CpuStats
 
 	collectionInterval time.Duration
 
@@ -31,58 +37,307 @@ type TaskHandle struct {
 	taskConfig  *drivers.TaskConfig
 	procState   drivers.TaskState
 	startedAt   time.Time
-	logPointer  time.Time
 	completedAt time.Time
 	exitResult  *drivers.ExitResult
 
 	exec         executor.Executor
 	pid          int
 	pluginClient *plugin.Client
+
+	// guest runs the module in the plugin, set unless the executor runs it
+	guest *guestTask
+
+	// preopens are the directories exposed to the guest
+	preopens []*preopen
+
+	// logStreams are where the task's output goes
+	logStreams *logStreams
+
+	// logPointer is how much of the spooled output was forwarded by
+	// logPumps
+	logPointer *logPointer
+	logPumps   *logPumps
+
+	// timings are the durations of the phases of the task's start
+	timings *startTimings
+
+	// metadata is how the task's module was built, compile how it was
+	// compiled
+	metadata *moduleMetadata
+	compile  *compileDiagnostics
+
+	// oom watches the OOM kills of the task's cgroup, oomCause is why the
+	// task ran out of memory if it did, as described by oomInfo
+	oom      *oomWatch
+	oomCause string
+	oomInfo  exitInfo
+
+	// pauser suspends the guest on SIGSTOP until SIGCONT
+	pauser *pauser
+
+	// serve is the listener of serve tasks
+	serve *serveServer
+
+	// history are the task's last invocations, returned by :history
+	history *invocationHistory
+
+	// restart is the task's attempt, updated with how it exited
+	restart *restartAttempt
+	trap    error
+
+	// cpuFuel meters the fuel of a guest in the plugin by the task's cpu, if
+	// not nil
+	cpuFuel *cpuFuel
+
+	// fuelConsumed is the fuel the guest consumed, once it exited in the
+	// plugin
+	fuelConsumed uint64
+
+	// notify is the webhook posted the task's exit summary, if set
+	notify *TaskNotifyConfig
+
+	// audit records the task's exit until releaseAudit is called once the
+	// task is destroyed, moduleDigest identifies what ran
+	audit        *auditLog
+	releaseAudit func()
+	moduleDigest digest.Digest
+
+	// precompiledDigest is the module's code precompiled for the client,
+	// used instead of compiling the module if set
+	precompiledDigest digest.Digest
 }
 
 func (h *TaskHandle) TaskStatus() *drivers.TaskStatus {
 	h.stateLock.RLock()
 	defer h.stateLock.RUnlock()
 
+	attrs := map[string]string{
+		"pid": strconv.Itoa(h.pid),
+	}
+	if h.timings != nil {
+		for k, v := range h.timings.attributes() {
+			attrs[k] = v
+		}
+	}
+	for k, v := range h.logStreams.attributes() {
+		attrs[k] = v
+	}
+	for k, v := range h.metadata.attributes() {
+		attrs[k] = v
+	}
+	for k, v := range h.compile.attributes() {
+		attrs[k] = v
+	}
+	if h.cpuFuel != nil {
+		attrs["fuel_consumed"] = strconv.FormatUint(h.cpuFuel.fuelConsumed(), 10)
+	}
+	if paused, since := h.pauser.isPaused(); paused {
+		attrs["paused_at"] = since.UTC().Format(time.RFC3339)
+	}
+	if h.serve != nil {
+		attrs["serve_ready"] = strconv.FormatBool(h.serve.isReady())
+		if h.serve.queue != nil {
+			attrs["serve_queued"] = strconv.Itoa(h.serve.queue.queued())
+		}
+	}
+	if h.restart != nil {
+		attrs["restart_attempt"] = strconv.Itoa(h.restart.Attempt)
+	}
+	if h.oomCause != "" {
+		attrs["oom_cause"] = h.oomCause
+	}
+
 	return &drivers.TaskStatus{
-		ID:          h.taskConfig.ID,
-		Name:        h.taskConfig.Name,
-		State:       h.procState,
-		StartedAt:   h.startedAt,
-		CompletedAt: h.completedAt,
-		ExitResult:  h.exitResult,
-		DriverAttributes: map[string]string{
-			"pid": strconv.Itoa(h.pid),
-		},
+		ID:               h.taskConfig.ID,
+		Name:             h.taskConfig.Name,
+		State:            h.procState,
+		StartedAt:        h.startedAt,
+		CompletedAt:      h.completedAt,
+		ExitResult:       h.exitResult,
+		DriverAttributes: attrs,
 	}
 }
 
+func (h *TaskHandle) state() drivers.TaskState {
+	h.stateLock.RLock()
+	defer h.stateLock.RUnlock()
+	return h.procState
+}
+
 func (h *TaskHandle) isRunning() bool {
 	h.stateLock.RLock()
 	defer h.stateLock.RUnlock()
 	return h.procState == drivers.TaskStateRunning
 }
 
+// exited returns the task's exit result, if it exited
+func (h *TaskHandle) exited() (*drivers.ExitResult, bool) {
+	h.stateLock.RLock()
+	defer h.stateLock.RUnlock()
+	if h.completedAt.IsZero() || h.exitResult == nil {
+		return nil, false
+	}
+	return h.exitResult.Copy(), true
+}
+
+// sample returns the resource usage of the task's process at now
+func (h *TaskHandle) sample(now time.Time) (*drivers.TaskResourceUsage, error) {
+	// a guest in the plugin has no process of its own, only its linear
+	// memory is its own
+	if h.guest != nil {
+		size, peak := h.guest.memoryUsage()
+		ms := &drivers.MemoryStats{RSS: size, MaxUsage: peak, Measured: []string{"RSS", "Max Usage"}}
+		cs := &drivers.CpuStats{}
+		if h.cpuFuel != nil {
+			cs = h.cpuFuel.usage(now)
+		}
+		return &drivers.TaskResourceUsage{
+			ResourceUsage: &drivers.ResourceUsage{MemoryStats: ms, CpuStats: cs},
+			Timestamp:     now.UTC().UnixNano(),
+		}, nil
+	}
+
+	h.stateLock.RLock()
+	pid := h.pid
+	h.stateLock.RUnlock()
+
+	p, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return nil, err
+	}
+	if h.totalCPUStats == nil {
+		h.totalCPUStats = stats.NewCpuStats()
+		h.userCPUStats = stats.NewCpuStats()
+		h.systemCPUStats = stats.NewCpuStats()
+	}
+
+	ms := &drivers.MemoryStats{}
+	if memInfo, err := p.MemoryInfo(); err == nil {
+		ms.RSS = memInfo.RSS
+		ms.Swap = memInfo.Swap
+		ms.Measured = []string{"RSS", "Swap"}
+	}
+
+	cs := &drivers.CpuStats{}
+	if times, err := p.Times(); err == nil {
+		cs.SystemMode = h.systemCPUStats.Percent(times.System * float64(time.Second))
+		cs.UserMode = h.userCPUStats.Percent(times.User * float64(time.Second))
+		cs.Percent = h.totalCPUStats.Percent(times.Total() * float64(time.Second))
+		cs.TotalTicks = h.totalCPUStats.TicksConsumed(cs.Percent)
+		cs.Measured = []string{"System Mode", "User Mode", "Percent"}
+	}
+
+	return &drivers.TaskResourceUsage{
+		ResourceUsage: &drivers.ResourceUsage{MemoryStats: ms, CpuStats: cs},
+		Timestamp:     now.UTC().UnixNano(),
+	}, nil
+}
+
 func (h *TaskHandle) run() {
 	h.stateLock.Lock()
 	if h.exitResult == nil {
 		h.exitResult = &drivers.ExitResult{}
 	}
+	if h.oom == nil && h.pid != 0 {
+		h.oom = watchOOM(h.pid)
+	}
 	h.stateLock.Unlock()
 
-	// TODO: wait for task to complete and update its state.
-	ps, err := h.exec.Wait(context.Background())
+	exit := h.wait()
 	h.stateLock.Lock()
 	defer h.stateLock.Unlock()
 
-	if err != nil {
-		h.exitResult.Err = err
+	if exit.err != nil {
+		h.exitResult.Err = exit.err
 		h.procState = drivers.TaskStateUnknown
 		h.completedAt = time.Now()
-		return
+	} else {
+		h.procState = drivers.TaskStateExited
+		h.exitResult.ExitCode = exit.exitCode
+		h.exitResult.Signal = exit.signal
+		h.completedAt = exit.time
+		h.classifyExit(exit.info)
+	}
+
+	h.recordExit()
+	if h.restart != nil {
+		if err := endAttempt(h.taskConfig.TaskDir().Dir, h.exitResult, h.trap); err != nil {
+			h.logger.Error("failed to record task exit for restarts", "task_id", h.taskConfig.ID, "error", err)
+		}
+	}
+}
+
+// wait blocks until the task's guest exits, in the plugin or run by the
+// executor, and returns how
+func (h *TaskHandle) wait() guestExit {
+	if h.guest != nil {
+		return h.guest.wait()
+	}
+	ps, err := h.exec.Wait(context.Background())
+	if err != nil {
+		return guestExit{err: err}
+	}
+	return guestExit{
+		exitCode: ps.ExitCode,
+		signal:   ps.Signal,
+		time:     ps.Time,
+		info:     exitInfo{signal: ps.Signal, cgroupOOMKill: h.oom.killed()},
+	}
+}
+
+// kill stops the task's guest at once, or the executor running it, and
+// waits for the guest to exit
+func (h *TaskHandle) kill() {
+	if h.guest != nil {
+		h.guest.shutdown(int(syscall.SIGKILL), guestKillTimeout)
+	}
+	if h.pluginClient != nil && !h.pluginClient.Exited() {
+		if err := h.exec.Shutdown("", 0); err != nil {
+			h.logger.Error("destroying executor failed", "err", err)
+		}
+
+		h.pluginClient.Kill()
+	}
+}
+
+// classifyExit sets the exit result as OOM killed if info shows the task ran
+// out of memory. Callers must hold stateLock.
+func (h *TaskHandle) classifyExit(info exitInfo) {
+	h.trap = info.trap
+	h.fuelConsumed = info.fuelConsumed
+	if used, err := memoryUsage(); err == nil {
+		info.hostMemoryUsed = used
+	}
+	if cause := classifyOOM(info); cause != "" {
+		h.exitResult.OOMKilled = true
+		if cause == oomGuest {
+			h.exitResult.Err = fmt.Errorf("memory limit exceeded: the guest's memory reached %s of its %s limit",
+				humanize.IBytes(info.memorySize), humanize.IBytes(info.memoryLimit))
+		}
+		h.oomCause = cause
+		h.oomInfo = info
+	}
+}
+
+// ranOutOfMemory returns why the task ran out of memory, if it did
+func (h *TaskHandle) ranOutOfMemory() (string, exitInfo) {
+	h.stateLock.RLock()
+	defer h.stateLock.RUnlock()
+	return h.oomCause, h.oomInfo
+}
+
+// recordExit writes the task's exit result to the audit log. Callers must
+// hold stateLock.
+func (h *TaskHandle) recordExit() {
+	r := newAuditRecord(auditEventExit, h.taskConfig, h.moduleDigest.String())
+	exitCode := h.exitResult.ExitCode
+	r.ExitCode = &exitCode
+	r.Signal = h.exitResult.Signal
+	if h.exitResult.Err != nil {
+		r.Error = h.exitResult.Err.Error()
+	}
+
+	if err := h.audit.record(r); err != nil {
+		h.logger.Error("failed to write audit log", "task_id", h.taskConfig.ID, "error", err)
 	}
-	h.procState = drivers.TaskStateExited
-	h.exitResult.ExitCode = ps.ExitCode
-	h.exitResult.Signal = ps.Signal
-	h.completedAt = ps.Time
 }
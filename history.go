@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// historyCommand is the exec command returning the task's recent
+	// invocations
+	historyCommand = ":history"
+
+	// historySize is how many invocations a task remembers
+	historySize = 256
+)
+
+// invocation kinds
+const (
+	invocationCall = "call"
+	invocationHTTP = "http"
+)
+
+// invocation outcomes
+const (
+	outcomeOK    = "ok"
+	outcomeError = "error"
+)
+
+// invocation is an entry of a task's history: a call of an export or an
+// HTTP request handled by the guest
+type invocation struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+
+	// Name is the export called, or the method and path of the request
+	Name       string  `json:"name"`
+	DurationMS float64 `json:"duration_ms"`
+	Outcome    string  `json:"outcome"`
+
+	// Status is the status of HTTP requests, Error why calls failed
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Cold   bool   `json:"cold,omitempty"`
+}
+
+// invocationHistory is a ring buffer of the last invocations of a task. A
+// nil history records nothing.
+type invocationHistory struct {
+	lock    sync.Mutex
+	entries []invocation
+	next    int
+	full    bool
+}
+
+func newInvocationHistory(size int) *invocationHistory {
+	return &invocationHistory{entries: make([]invocation, size)}
+}
+
+// add records inv, dropping the oldest invocation if the history is full
+func (h *invocationHistory) add(inv invocation) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.entries[h.next] = inv
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// recordCall records a call of export, which failed if err isn't nil
+func (h *invocationHistory) recordCall(export string, start time.Time, err error) {
+	inv := invocation{
+		Time:       start,
+		Kind:       invocationCall,
+		Name:       export,
+		DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+		Outcome:    outcomeOK,
+	}
+	if err != nil {
+		inv.Outcome, inv.Error = outcomeError, err.Error()
+	}
+	h.add(inv)
+}
+
+// last returns up to n of the latest invocations, oldest first, or all of
+// them if n is 0
+func (h *invocationHistory) last(n int) []invocation {
+	if h == nil {
+		return []invocation{}
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	entries := make([]invocation, 0, len(h.entries))
+	if h.full {
+		entries = append(entries, h.entries[h.next:]...)
+	}
+	entries = append(entries, h.entries[:h.next]...)
+	if n > 0 && n < len(entries) {
+		entries = entries[len(entries)-n:]
+	}
+	return entries
+}
+
+// handler records the requests handled by next. Responses of 5xx are
+// failures, as they are the server's fault.
+func (h *invocationHistory) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		req, r := withServeRequest(r)
+		rec := &recordingResponse{ResponseWriter: w}
+
+		defer func() {
+			status := rec.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			inv := invocation{
+				Time:       start,
+				Kind:       invocationHTTP,
+				Name:       r.Method + " " + r.URL.Path,
+				DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+				Outcome:    outcomeOK,
+				Status:     status,
+				Cold:       atomic.LoadUint32(&req.cold) == 1,
+			}
+			if status >= 500 {
+				inv.Outcome = outcomeError
+			}
+			h.add(inv)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+const historyUsage = historyCommand + " [N]"
+
+// parseHistoryCommand returns how many invocations a :history command asks
+// for, 0 for all of them
+func parseHistoryCommand(cmd []string) (int, bool, error) {
+	fields := strings.Fields(strings.Join(cmd, " "))
+	if len(fields) == 0 || fields[0] != historyCommand {
+		return 0, false, nil
+	}
+	switch len(fields) {
+	case 1:
+		return 0, true, nil
+	case 2:
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n <= 0 {
+			return 0, true, fmt.Errorf("invalid count %q", fields[1])
+		}
+		return n, true, nil
+	}
+	return 0, true, fmt.Errorf("usage: %s", historyUsage)
+}
+
+// execHistory returns the task's last n invocations as JSON
+func (d *Driver) execHistory(h *TaskHandle, n int) (*drivers.ExecTaskResult, error) {
+	out, err := json.MarshalIndent(h.history.last(n), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return &drivers.ExecTaskResult{
+		Stdout:     append(out, '\n'),
+		ExitResult: &drivers.ExitResult{},
+	}, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvocationHistory(t *testing.T) {
+	h := newInvocationHistory(3)
+	require.Equal(t, []invocation{}, h.last(0))
+
+	for i := 0; i < 5; i++ {
+		h.add(invocation{Name: strconv.Itoa(i)})
+	}
+	names := func(entries []invocation) []string {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		return names
+	}
+	require.Equal(t, []string{"2", "3", "4"}, names(h.last(0)))
+	require.Equal(t, []string{"3", "4"}, names(h.last(2)))
+	require.Equal(t, []string{"2", "3", "4"}, names(h.last(10)))
+
+	h.recordCall("_start", time.Now(), errors.New("trap"))
+	last := h.last(1)[0]
+	require.Equal(t, invocationCall, last.Kind)
+	require.Equal(t, outcomeError, last.Outcome)
+	require.Equal(t, "trap", last.Error)
+
+	// nil histories record nothing
+	var none *invocationHistory
+	none.add(invocation{})
+	require.Empty(t, none.last(0))
+}
+
+func TestInvocationHistory_Handler(t *testing.T) {
+	history := newInvocationHistory(8)
+	handler := history.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		markColdStart(r.Context())
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ok?q=1", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/fail", nil))
+
+	entries := history.last(0)
+	require.Len(t, entries, 2)
+	require.Equal(t, invocationHTTP, entries[0].Kind)
+	require.Equal(t, "GET /ok", entries[0].Name)
+	require.Equal(t, http.StatusOK, entries[0].Status)
+	require.Equal(t, outcomeOK, entries[0].Outcome)
+	require.True(t, entries[0].Cold)
+	require.Equal(t, "POST /fail", entries[1].Name)
+	require.Equal(t, outcomeError, entries[1].Outcome)
+}
+
+func TestParseHistoryCommand(t *testing.T) {
+	n, ok, err := parseHistoryCommand([]string{":history"})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, 0, n)
+
+	n, ok, err = parseHistoryCommand([]string{":history 10"})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, 10, n)
+
+	_, ok, _ = parseHistoryCommand([]string{":bench", "1"})
+	require.False(t, ok)
+
+	for _, cmd := range [][]string{{":history", "0"}, {":history", "x"}, {":history", "1", "2"}} {
+		_, ok, err := parseHistoryCommand(cmd)
+		require.True(t, ok)
+		require.Error(t, err)
+	}
+}
+
+func TestDriver_ExecTask_History(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := &drivers.TaskConfig{ID: "id", Name: "task"}
+	h := &TaskHandle{taskConfig: cfg, history: newInvocationHistory(historySize)}
+	d.tasks.Set(cfg.ID, h)
+	h.history.recordCall("_start", time.Now(), nil)
+	h.history.recordCall("_start", time.Now(), errors.New("trap"))
+
+	result, err := d.ExecTask(cfg.ID, []string{":history", "1"}, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, 0, result.ExitResult.ExitCode)
+	var entries []invocation
+	require.NoError(t, json.Unmarshal(result.Stdout, &entries))
+	require.Len(t, entries, 1)
+	require.Equal(t, "trap", entries[0].Error)
+}
+
+func TestServeServer_UseHistory(t *testing.T) {
+	supervisor := newServeSupervisor("task", 0, func() (serveInstance, error) { return &fakeInstance{id: 1}, nil }, hclog.NewNullLogger())
+	server := newServeServer("127.0.0.1:0", supervisor, nil, serveLimits{}, nil, nil, hclog.NewNullLogger())
+	history := newInvocationHistory(8)
+	server.useHistory(history)
+	require.NoError(t, server.Start(false))
+	defer server.Close()
+
+	resp, err := http.Get("http://" + server.Addr() + "/users")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	entries := history.last(0)
+	require.Len(t, entries, 1)
+	require.Equal(t, "GET /users", entries[0].Name)
+	require.True(t, entries[0].Cold)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+var (
+	// errGuestMemory is returned when a guest passes a pointer outside of
+	// its linear memory
+	errGuestMemory = errors.New("guest pointer out of bounds")
+
+	// errNoMemory is returned when a host function is called by a module
+	// that doesn't export its linear memory
+	errNoMemory = errors.New("guest does not export a memory")
+)
+
+// hostModule is a set of host functions made available to a guest under one
+// or more import namespaces. A hostModule is created per task and owns any
+// connections or state it needs on behalf of that task.
+type hostModule interface {
+	// Define registers the module's functions with linker
+	Define(linker *wasmtime.Linker) error
+
+	// Close releases the resources held for the task
+	Close() error
+}
+
+// newHostModules returns the host modules enabled for a task. Interfaces
+// configured for the whole plugin are only linked if the task's capabilities
+// allow them, while configuring a task level interface the capabilities
+// don't allow is an error.
+func (d *Driver) newHostModules(cfg *drivers.TaskConfig, driverConfig *TaskConfig) ([]hostModule, error) {
+	caps, err := newCapabilitySet(driverConfig.WASI.Capabilities)
+	if err != nil {
+		return nil, err
+	}
+	if d.config.ReadOnly {
+		caps = caps.without(readOnlyDeniedCapabilities...)
+	}
+	for name, configured := range map[string]bool{
+		capabilityKeyValue: driverConfig.KeyValue.Backend != "",
+		capabilitySecrets:  len(driverConfig.Secrets.Paths) != 0,
+		capabilitySQL:      driverConfig.SQL.Driver != "",
+		capabilityHTTP:     len(driverConfig.HTTP.AllowedHosts) != 0 || driverConfig.HTTP.TaskAPI,
+	} {
+		if configured && !caps.allows(name) {
+			return nil, fmt.Errorf("%s block requires the %q capability", name, name)
+		}
+	}
+
+	var hosts []hostModule
+
+	clock, err := newClockHost(driverConfig.WASI)
+	if err != nil {
+		return nil, err
+	}
+	if clock != nil {
+		hosts = append(hosts, clock)
+	}
+
+	if d.config.Crypto.Enabled && caps.allows(capabilityCrypto) {
+		h, err := newCryptoHost(d.config.Crypto.AllowedAlgorithms, d.config.Crypto.FIPSOnly)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+
+	if d.blobstore != nil && caps.allows(capabilityBlobstore) {
+		hosts = append(hosts, newBlobstoreHost(d.blobstore, taskKeyPrefix(cfg)))
+	}
+
+	if backend := driverConfig.KeyValue.Backend; backend != "" {
+		kv, ok := d.kvBackends[backend]
+		if !ok {
+			closeHostModules(hosts)
+			return nil, fmt.Errorf("keyvalue backend %q is not configured", backend)
+		}
+		hosts = append(hosts, newKeyvalueHost(kv, taskKeyPrefix(cfg), d.kvUsers.acquire()))
+	}
+
+	if len(driverConfig.Secrets.Paths) != 0 {
+		if d.vault == nil {
+			closeHostModules(hosts)
+			return nil, fmt.Errorf("vault is not configured")
+		}
+		h, err := newSecretsHost(d.vault, cfg.TaskDir().SecretsDir, driverConfig.Secrets.Paths, d.secretsCacheTTL)
+		if err != nil {
+			closeHostModules(hosts)
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+
+	if driverConfig.SQL.Driver != "" {
+		h, err := newSQLHost(driverConfig.SQL, cfg.TaskDir().Dir)
+		if err != nil {
+			closeHostModules(hosts)
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+
+	// Connect upstreams are reachable without an http block
+	httpConfigured := len(driverConfig.HTTP.AllowedHosts) != 0 || driverConfig.HTTP.TaskAPI
+	if httpConfigured || (len(connectUpstreams(cfg.Env)) != 0 && caps.allows(capabilityHTTP)) {
+		h, err := newHTTPHost(cfg, driverConfig.HTTP)
+		if err != nil {
+			closeHostModules(hosts)
+			return nil, err
+		}
+		h.allowedHosts = d.allowlists.get(cfg.ID, driverConfig.HTTP.AllowedHosts)
+		h.useMeter(d.quotas, cfg.Namespace)
+		if c := driverConfig.HTTP.Cache; c != nil {
+			key := taskKeyPrefix(cfg)
+			cache, err := d.httpCaches.acquire(key, *c)
+			if err != nil {
+				h.Close()
+				closeHostModules(hosts)
+				return nil, err
+			}
+			h.useCache(cache, func() { d.httpCaches.release(key, cache) })
+		}
+		hosts = append(hosts, h)
+	}
+
+	if len(d.config.Messaging.Servers) != 0 && caps.allows(capabilityMessaging) {
+		h, err := newMessagingHost(d.config.Messaging, cfg)
+		if err != nil {
+			closeHostModules(hosts)
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+
+	return hosts, nil
+}
+
+// taskKeyPrefix returns the prefix of the keys a task is confined to by host
+// modules backed by shared stores. It is derived from the task's identity
+// rather than its allocation so data outlives reschedules.
+func taskKeyPrefix(cfg *drivers.TaskConfig) string {
+	return path.Join(cfg.Namespace, cfg.JobName, cfg.TaskGroupName, cfg.Name) + "/"
+}
+
+// validRelativeKey reports whether a key given by a guest stays within its
+// prefix. Relative segments are rejected since some stores normalize paths.
+func validRelativeKey(key string) bool {
+	if strings.HasPrefix(key, "/") {
+		return false
+	}
+	for _, s := range strings.Split(key, "/") {
+		if s == "." || s == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// closeHostModules closes every module in hosts, returning the last error.
+func closeHostModules(hosts []hostModule) error {
+	var lastErr error
+	for _, h := range hosts {
+		if err := h.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// guestMemory gives host functions access to the linear memory of the
+// calling guest.
+type guestMemory struct {
+	data []byte
+}
+
+func newGuestMemory(caller *wasmtime.Caller) (*guestMemory, error) {
+	ext := caller.GetExport("memory")
+	if ext == nil || ext.Memory() == nil {
+		return nil, errNoMemory
+	}
+	return &guestMemory{data: ext.Memory().UnsafeData(caller)}, nil
+}
+
+// slice returns the guest memory in [ptr, ptr+size).
+func (m *guestMemory) slice(ptr, size int32) ([]byte, error) {
+	start, end := uint64(uint32(ptr)), uint64(uint32(ptr))+uint64(uint32(size))
+	if end > uint64(len(m.data)) {
+		return nil, errGuestMemory
+	}
+	return m.data[start:end], nil
+}
+
+// read returns a copy of the guest memory in [ptr, ptr+size).
+func (m *guestMemory) read(ptr, size int32) ([]byte, error) {
+	b, err := m.slice(ptr, size)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), b...), nil
+}
+
+func (m *guestMemory) readString(ptr, size int32) (string, error) {
+	b, err := m.slice(ptr, size)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (m *guestMemory) write(ptr int32, b []byte) error {
+	dst, err := m.slice(ptr, int32(len(b)))
+	if err != nil {
+		return err
+	}
+	copy(dst, b)
+	return nil
+}
+
+// writeBuffer stores the length of data at nPtr and copies data into the
+// guest buffer at [bufPtr, bufPtr+bufLen). It returns false, leaving the
+// buffer untouched, if data doesn't fit so the guest can retry with a buffer
+// of the stored length.
+func (m *guestMemory) writeBuffer(bufPtr, bufLen, nPtr int32, data []byte) (bool, error) {
+	if err := m.writeUint32(nPtr, uint32(len(data))); err != nil {
+		return false, err
+	}
+	if uint64(len(data)) > uint64(uint32(bufLen)) {
+		return false, nil
+	}
+	return true, m.write(bufPtr, data)
+}
+
+func (m *guestMemory) readUint32(ptr int32) (uint32, error) {
+	b, err := m.slice(ptr, 4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+func (m *guestMemory) writeUint32(ptr int32, v uint32) error {
+	b, err := m.slice(ptr, 4)
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(b, v)
+	return nil
+}
+
+func (m *guestMemory) readUint8(ptr int32) (uint8, error) {
+	b, err := m.slice(ptr, 1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// handleTable maps the opaque handles given to guests to host objects.
+// Handle 0 is never allocated so guests can use it as a null value.
+type handleTable struct {
+	lock  sync.Mutex
+	next  uint32
+	items map[uint32]interface{}
+
+	// max caps the number of live handles, or 0 for no limit
+	max int
+}
+
+func newHandleTable(max int) *handleTable {
+	return &handleTable{items: map[uint32]interface{}{}, max: max}
+}
+
+// insert stores v and returns its handle, or false if the table is full.
+func (t *handleTable) insert(v interface{}) (uint32, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.max > 0 && len(t.items) >= t.max {
+		return 0, false
+	}
+
+	for {
+		t.next++
+		if t.next == 0 {
+			continue
+		}
+		if _, ok := t.items[t.next]; !ok {
+			break
+		}
+	}
+	t.items[t.next] = v
+	return t.next, true
+}
+
+func (t *handleTable) get(h uint32) (interface{}, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	v, ok := t.items[h]
+	return v, ok
+}
+
+// remove deletes handle h, returning the object it referred to.
+func (t *handleTable) remove(h uint32) (interface{}, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	v, ok := t.items[h]
+	delete(t.items, h)
+	return v, ok
+}
+
+// clear removes every handle, returning the objects they referred to.
+func (t *handleTable) clear() []interface{} {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	items := make([]interface{}, 0, len(t.items))
+	for h, v := range t.items {
+		items = append(items, v)
+		delete(t.items, h)
+	}
+	return items
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+// blobstoreErrno is the error code returned by blobstore functions
+type blobstoreErrno int32
+
+const (
+	blobstoreSuccess      blobstoreErrno = 0
+	blobstoreGuestError   blobstoreErrno = 1
+	blobstoreNotFound     blobstoreErrno = 2
+	blobstoreAccessDenied blobstoreErrno = 3
+	blobstoreOverflow     blobstoreErrno = 4
+	blobstoreInvalidKey   blobstoreErrno = 5
+	blobstoreIOError      blobstoreErrno = 6
+)
+
+const (
+	// blobstoreModule is the import namespace of the blobstore functions
+	blobstoreModule = "wasi_ephemeral_blobstore"
+
+	// blobstoreTimeout bounds every request made on behalf of a guest
+	blobstoreTimeout = 30 * time.Second
+
+	// maxBlobstoreKey is the longest key accepted, including the task prefix
+	maxBlobstoreKey = 1024
+)
+
+// blobstoreHost exposes an S3 compatible bucket to a guest, confined to the
+// prefix returned by taskKeyPrefix. The component
+// model isn't available to core modules, so the wasi-blobstore container
+// operations are offered as plain functions. Keys are relative to the task
+// prefix and every function returns a blobstoreErrno:
+//
+//	get(key_ptr, key_len, offset: i64, buf_ptr, buf_len, n_ptr) -> errno
+//	put(key_ptr, key_len, data_ptr, data_len) -> errno
+//	delete(key_ptr, key_len) -> errno
+//	size(key_ptr, key_len, size_ptr) -> errno
+//	list(prefix_ptr, prefix_len, buf_ptr, buf_len, n_ptr) -> errno
+//
+// get reads an object in chunks, storing the number of bytes read at n_ptr
+// as a u32; 0 marks the end of the object. size stores a u64. list stores
+// matching keys separated by newlines; if they don't fit in the buffer it
+// returns overflow with the required length at n_ptr.
+type blobstoreHost struct {
+	client *s3Client
+	prefix string
+
+	// ctx is cancelled when the task is destroyed, aborting requests in
+	// flight
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newBlobstoreHost(client *s3Client, prefix string) *blobstoreHost {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &blobstoreHost{
+		client: client,
+		prefix: prefix,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (h *blobstoreHost) Close() error {
+	h.cancel()
+	return nil
+}
+
+func (h *blobstoreHost) Define(linker *wasmtime.Linker) error {
+	funcs := map[string]interface{}{
+		"get":    h.get,
+		"put":    h.put,
+		"delete": h.delete,
+		"size":   h.size,
+		"list":   h.list,
+	}
+	for name, f := range funcs {
+		if err := linker.FuncWrap(blobstoreModule, name, f); err != nil {
+			return fmt.Errorf("failed to define %s.%s: %v", blobstoreModule, name, err)
+		}
+	}
+	return nil
+}
+
+// blobstoreFunc adapts the body of a blobstore function so it can report
+// errnos, with guest memory errors mapped to guest_error.
+func blobstoreFunc(caller *wasmtime.Caller, f func(mem *guestMemory) blobstoreErrno) int32 {
+	mem, err := newGuestMemory(caller)
+	if err != nil {
+		return int32(blobstoreGuestError)
+	}
+	return int32(f(mem))
+}
+
+// key reads a key from the guest and returns it with the task prefix
+func (h *blobstoreHost) key(mem *guestMemory, ptr, size int32) (string, blobstoreErrno) {
+	key, err := mem.readString(ptr, size)
+	if err != nil {
+		return "", blobstoreGuestError
+	}
+	if key == "" || !h.validKey(key) {
+		return "", blobstoreInvalidKey
+	}
+	return h.prefix + key, blobstoreSuccess
+}
+
+func (h *blobstoreHost) validKey(key string) bool {
+	return len(h.prefix)+len(key) <= maxBlobstoreKey && validRelativeKey(key)
+}
+
+// errno maps a client error onto a blobstoreErrno
+func (h *blobstoreHost) errno(err error) blobstoreErrno {
+	switch {
+	case err == nil:
+		return blobstoreSuccess
+	case errors.Is(err, errS3NotFound):
+		return blobstoreNotFound
+	case errors.Is(err, errS3AccessDenied):
+		return blobstoreAccessDenied
+	}
+	return blobstoreIOError
+}
+
+func (h *blobstoreHost) get(caller *wasmtime.Caller, keyPtr, keyLen int32, offset int64, bufPtr, bufLen, nPtr int32) int32 {
+	return blobstoreFunc(caller, func(mem *guestMemory) blobstoreErrno {
+		key, errno := h.key(mem, keyPtr, keyLen)
+		if errno != blobstoreSuccess {
+			return errno
+		}
+		if offset < 0 {
+			return blobstoreGuestError
+		}
+		if _, err := mem.slice(bufPtr, bufLen); err != nil {
+			return blobstoreGuestError
+		}
+
+		ctx, cancel := context.WithTimeout(h.ctx, blobstoreTimeout)
+		defer cancel()
+
+		var data []byte
+		if bufLen > 0 {
+			var err error
+			if data, err = h.client.Get(ctx, key, offset, int(uint32(bufLen))); err != nil {
+				return h.errno(err)
+			}
+		}
+
+		if err := mem.write(bufPtr, data); err != nil {
+			return blobstoreGuestError
+		}
+		if err := mem.writeUint32(nPtr, uint32(len(data))); err != nil {
+			return blobstoreGuestError
+		}
+		return blobstoreSuccess
+	})
+}
+
+func (h *blobstoreHost) put(caller *wasmtime.Caller, keyPtr, keyLen, dataPtr, dataLen int32) int32 {
+	return blobstoreFunc(caller, func(mem *guestMemory) blobstoreErrno {
+		key, errno := h.key(mem, keyPtr, keyLen)
+		if errno != blobstoreSuccess {
+			return errno
+		}
+		data, err := mem.read(dataPtr, dataLen)
+		if err != nil {
+			return blobstoreGuestError
+		}
+
+		ctx, cancel := context.WithTimeout(h.ctx, blobstoreTimeout)
+		defer cancel()
+		return h.errno(h.client.Put(ctx, key, data))
+	})
+}
+
+func (h *blobstoreHost) delete(caller *wasmtime.Caller, keyPtr, keyLen int32) int32 {
+	return blobstoreFunc(caller, func(mem *guestMemory) blobstoreErrno {
+		key, errno := h.key(mem, keyPtr, keyLen)
+		if errno != blobstoreSuccess {
+			return errno
+		}
+
+		ctx, cancel := context.WithTimeout(h.ctx, blobstoreTimeout)
+		defer cancel()
+		return h.errno(h.client.Delete(ctx, key))
+	})
+}
+
+func (h *blobstoreHost) size(caller *wasmtime.Caller, keyPtr, keyLen, sizePtr int32) int32 {
+	return blobstoreFunc(caller, func(mem *guestMemory) blobstoreErrno {
+		key, errno := h.key(mem, keyPtr, keyLen)
+		if errno != blobstoreSuccess {
+			return errno
+		}
+
+		ctx, cancel := context.WithTimeout(h.ctx, blobstoreTimeout)
+		defer cancel()
+		size, err := h.client.Size(ctx, key)
+		if err != nil {
+			return h.errno(err)
+		}
+
+		b, err := mem.slice(sizePtr, 8)
+		if err != nil {
+			return blobstoreGuestError
+		}
+		binary.LittleEndian.PutUint64(b, uint64(size))
+		return blobstoreSuccess
+	})
+}
+
+func (h *blobstoreHost) list(caller *wasmtime.Caller, prefixPtr, prefixLen, bufPtr, bufLen, nPtr int32) int32 {
+	return blobstoreFunc(caller, func(mem *guestMemory) blobstoreErrno {
+		// unlike keys, the listing prefix may be empty
+		prefix, err := mem.readString(prefixPtr, prefixLen)
+		if err != nil {
+			return blobstoreGuestError
+		}
+		if !h.validKey(prefix) {
+			return blobstoreInvalidKey
+		}
+
+		ctx, cancel := context.WithTimeout(h.ctx, blobstoreTimeout)
+		defer cancel()
+		keys, err := h.client.List(ctx, h.prefix+prefix)
+		if err != nil {
+			return h.errno(err)
+		}
+		for i, k := range keys {
+			keys[i] = strings.TrimPrefix(k, h.prefix)
+		}
+
+		ok, err := mem.writeBuffer(bufPtr, bufLen, nPtr, []byte(strings.Join(keys, "\n")))
+		switch {
+		case err != nil:
+			return blobstoreGuestError
+		case !ok:
+			return blobstoreOverflow
+		}
+		return blobstoreSuccess
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+const blobstoreWat = `
+(module
+  (import "wasi_ephemeral_blobstore" "get"
+    (func $get (param i32 i32 i64 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_blobstore" "put"
+    (func $put (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_blobstore" "delete"
+    (func $delete (param i32 i32) (result i32)))
+  (import "wasi_ephemeral_blobstore" "size"
+    (func $size (param i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_blobstore" "list"
+    (func $list (param i32 i32 i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+  (data (i32.const 0) "state/counter")
+  (data (i32.const 16) "hello world")
+  (data (i32.const 32) "../escape")
+
+  (func (export "put") (result i32)
+    (call $put (i32.const 0) (i32.const 13) (i32.const 16) (i32.const 11)))
+  ;; reads 5 bytes at offset into [256, 261), with the count at 248
+  (func (export "get") (param $offset i64) (result i32)
+    (call $get (i32.const 0) (i32.const 13) (local.get $offset) (i32.const 256) (i32.const 5) (i32.const 248)))
+  (func (export "size") (result i32)
+    (call $size (i32.const 0) (i32.const 13) (i32.const 240)))
+  ;; lists every key into [512, 512+len), with the length at 248
+  (func (export "list") (param $len i32) (result i32)
+    (call $list (i32.const 0) (i32.const 0) (i32.const 512) (local.get $len) (i32.const 248)))
+  (func (export "delete") (result i32)
+    (call $delete (i32.const 0) (i32.const 13)))
+  (func (export "escape") (result i32)
+    (call $put (i32.const 32) (i32.const 9) (i32.const 16) (i32.const 11)))
+)`
+
+func TestBlobstoreHost(t *testing.T) {
+	s3, client := newFakeS3(t, "bucket")
+	s3.objects["default/other/group/task/secret"] = []byte("not yours")
+
+	prefix := taskKeyPrefix(&drivers.TaskConfig{
+		Namespace:     "default",
+		JobName:       "example",
+		TaskGroupName: "group",
+		Name:          "task",
+	})
+	require.Equal(t, "default/example/group/task/", prefix)
+
+	host := newBlobstoreHost(client, prefix)
+	defer host.Close()
+	store, instance := instantiate(t, blobstoreWat, host)
+
+	require.EqualValues(t, blobstoreSuccess, call(t, store, instance, "put"))
+	require.Equal(t, "hello world", string(s3.objects["default/example/group/task/state/counter"]))
+
+	require.EqualValues(t, blobstoreSuccess, call(t, store, instance, "get", int64(6)))
+	mem := memory(store, instance)
+	require.EqualValues(t, 5, binary.LittleEndian.Uint32(mem[248:]))
+	require.Equal(t, "world", string(mem[256:261]))
+
+	require.EqualValues(t, blobstoreSuccess, call(t, store, instance, "get", int64(11)))
+	require.Zero(t, binary.LittleEndian.Uint32(memory(store, instance)[248:]))
+
+	require.EqualValues(t, blobstoreSuccess, call(t, store, instance, "size"))
+	require.EqualValues(t, 11, binary.LittleEndian.Uint64(memory(store, instance)[240:]))
+
+	// keys outside of the task prefix aren't listed
+	require.EqualValues(t, blobstoreOverflow, call(t, store, instance, "list", int32(4)))
+	require.EqualValues(t, 13, binary.LittleEndian.Uint32(memory(store, instance)[248:]))
+	require.EqualValues(t, blobstoreSuccess, call(t, store, instance, "list", int32(64)))
+	require.Equal(t, "state/counter", string(memory(store, instance)[512:525]))
+
+	require.EqualValues(t, blobstoreInvalidKey, call(t, store, instance, "escape"))
+
+	require.EqualValues(t, blobstoreSuccess, call(t, store, instance, "delete"))
+	require.EqualValues(t, blobstoreNotFound, call(t, store, instance, "size"))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/stretchr/testify/require"
+)
+
+const clockWat = `
+(module
+  (import "wasi_snapshot_preview1" "clock_time_get" (func $now (param i32 i64 i32) (result i32)))
+  (memory (export "memory") 1)
+  (func (export "now") (param $id i32) (result i32)
+    (call $now (local.get $id) (i64.const 1) (i32.const 0)))
+)`
+
+func TestNewClockHost(t *testing.T) {
+	h, err := newClockHost(TaskWASIConfig{})
+	require.NoError(t, err)
+	require.Nil(t, h)
+
+	for _, config := range []TaskWASIConfig{
+		{ClockOffset: "yesterday"},
+		{FrozenTime: "2024-01-01"},
+		{ClockOffset: "1h", FrozenTime: "2024-01-01T00:00:00Z"},
+	} {
+		_, err := newClockHost(config)
+		require.Error(t, err, "%+v", config)
+	}
+}
+
+func TestClockHost(t *testing.T) {
+	now := func(h *clockHost, id int32) (int32, time.Time) {
+		store, instance := instantiate(t, clockWat, h)
+		errno := call(t, store, instance, "now", id)
+		return errno, time.Unix(0, int64(binary.LittleEndian.Uint64(memory(store, instance))))
+	}
+
+	frozen, err := newClockHost(TaskWASIConfig{FrozenTime: "2024-02-29T12:00:00Z"})
+	require.NoError(t, err)
+	errno, t1 := now(frozen, wasiClockRealtime)
+	require.Zero(t, errno)
+	require.Equal(t, "2024-02-29T12:00:00Z", t1.UTC().Format(time.RFC3339))
+	_, t2 := now(frozen, wasiClockMonotonic)
+	_, t3 := now(frozen, wasiClockMonotonic)
+	require.Equal(t, t2, t3)
+
+	shifted, err := newClockHost(TaskWASIConfig{ClockOffset: "-48h"})
+	require.NoError(t, err)
+	errno, t1 = now(shifted, wasiClockRealtime)
+	require.Zero(t, errno)
+	require.WithinDuration(t, time.Now().Add(-48*time.Hour), t1, time.Minute)
+
+	errno, _ = now(shifted, 7)
+	require.Equal(t, int32(wasiErrnoInval), errno)
+
+	// the clock replaces the one of WASI
+	_, err = linkHosts(wasmtime.NewEngine(), []hostModule{shifted})
+	require.NoError(t, err)
+}
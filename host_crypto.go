@@ -0,0 +1,1173 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"math/big"
+	"reflect"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+// cryptoErrno is the error code returned by wasi-crypto functions
+type cryptoErrno int32
+
+// wasi-crypto error codes, as defined by the witx specification
+const (
+	cryptoSuccess              cryptoErrno = 0
+	cryptoGuestError           cryptoErrno = 1
+	cryptoNotImplemented       cryptoErrno = 2
+	cryptoUnsupportedFeature   cryptoErrno = 3
+	cryptoProhibitedOperation  cryptoErrno = 4
+	cryptoUnsupportedEncoding  cryptoErrno = 5
+	cryptoUnsupportedAlgorithm cryptoErrno = 6
+	cryptoUnsupportedOption    cryptoErrno = 7
+	cryptoInvalidKey           cryptoErrno = 8
+	cryptoInvalidLength        cryptoErrno = 9
+	cryptoVerificationFailed   cryptoErrno = 10
+	cryptoRNGError             cryptoErrno = 11
+	cryptoAlgorithmFailure     cryptoErrno = 12
+	cryptoInvalidSignature     cryptoErrno = 13
+	cryptoClosed               cryptoErrno = 14
+	cryptoInvalidHandle        cryptoErrno = 15
+	cryptoOverflow             cryptoErrno = 16
+	cryptoInternalError        cryptoErrno = 17
+	cryptoTooManyHandles       cryptoErrno = 18
+	cryptoKeyNotSupported      cryptoErrno = 19
+	cryptoKeyRequired          cryptoErrno = 20
+	cryptoInvalidTag           cryptoErrno = 21
+	cryptoInvalidOperation     cryptoErrno = 22
+	cryptoIncompatibleKeys     cryptoErrno = 29
+)
+
+// wasi-crypto enums
+const (
+	algorithmTypeSignatures = 0
+
+	optSome = 0
+
+	keypairEncodingRaw   = 0
+	keypairEncodingPKCS8 = 1
+	keypairEncodingPEM   = 2
+
+	publickeyEncodingRaw           = 0
+	publickeyEncodingPKCS8         = 1
+	publickeyEncodingPEM           = 2
+	publickeyEncodingSEC           = 3
+	publickeyEncodingCompressedSEC = 4
+
+	signatureEncodingRaw = 0
+	signatureEncodingDER = 1
+)
+
+const (
+	// maxCryptoHandles bounds the number of objects a guest may hold open
+	maxCryptoHandles = 1024
+)
+
+// supported wasi-crypto algorithms
+const (
+	algEd25519    = "Ed25519"
+	algECDSAP256  = "ECDSA_P256_SHA256"
+	algECDSAP384  = "ECDSA_P384_SHA384"
+	algHMACSHA256 = "HMAC/SHA-256"
+	algHMACSHA512 = "HMAC/SHA-512"
+	algSHA256     = "SHA-256"
+	algSHA512     = "SHA-512"
+)
+
+// cryptoAlgorithms lists every supported algorithm and whether it is approved
+// for use in FIPS mode (FIPS 180-4, 186-4 and 198-1).
+var cryptoAlgorithms = map[string]bool{
+	algEd25519:    false,
+	algECDSAP256:  true,
+	algECDSAP384:  true,
+	algHMACSHA256: true,
+	algHMACSHA512: true,
+	algSHA256:     true,
+	algSHA512:     true,
+}
+
+// cryptoHost implements a subset of the wasi-crypto ephemeral API: signature
+// keypairs (Ed25519, ECDSA), HMAC and SHA-2 hashing. Objects are handed to
+// the guest as handles which are released when the task is destroyed.
+type cryptoHost struct {
+	// allowed is the set of algorithms the guest may use
+	allowed map[string]struct{}
+
+	handles *handleTable
+}
+
+// Crypto objects referenced by handles
+type (
+	cryptoOptions struct{}
+
+	cryptoArrayOutput struct {
+		data []byte
+		pos  int
+	}
+
+	cryptoKeypair struct {
+		alg  string
+		priv crypto.Signer
+	}
+
+	cryptoPublickey struct {
+		alg string
+		pub crypto.PublicKey
+	}
+
+	cryptoSignature struct {
+		alg string
+
+		// raw is the signature in its raw wasi-crypto encoding
+		raw []byte
+	}
+
+	cryptoSignatureState struct {
+		kp  *cryptoKeypair
+		msg bytes.Buffer
+	}
+
+	cryptoVerificationState struct {
+		pk  *cryptoPublickey
+		msg bytes.Buffer
+	}
+
+	cryptoSymmetricKey struct {
+		alg string
+		raw []byte
+	}
+
+	cryptoSymmetricState struct {
+		alg string
+		h   hash.Hash
+	}
+
+	cryptoSymmetricTag struct {
+		raw []byte
+	}
+)
+
+// newCryptoHost returns a wasi-crypto host restricted to the algorithms in
+// allowlist, or to all supported algorithms if it is empty. In FIPS mode
+// only FIPS approved algorithms can be allowed.
+func newCryptoHost(allowlist []string, fipsOnly bool) (*cryptoHost, error) {
+	h := &cryptoHost{
+		allowed: map[string]struct{}{},
+		handles: newHandleTable(maxCryptoHandles),
+	}
+
+	if len(allowlist) == 0 {
+		for alg, fips := range cryptoAlgorithms {
+			if fips || !fipsOnly {
+				h.allowed[alg] = struct{}{}
+			}
+		}
+		return h, nil
+	}
+
+	for _, alg := range allowlist {
+		fips, ok := cryptoAlgorithms[alg]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("unsupported crypto algorithm %q", alg)
+		case fipsOnly && !fips:
+			return nil, fmt.Errorf("crypto algorithm %q is not allowed in FIPS mode", alg)
+		}
+		h.allowed[alg] = struct{}{}
+	}
+	return h, nil
+}
+
+func (h *cryptoHost) Close() error {
+	h.handles.clear()
+	return nil
+}
+
+// checkAlgorithm returns the errno for using alg, which is success when the
+// algorithm is supported and allowed.
+func (h *cryptoHost) checkAlgorithm(alg string) cryptoErrno {
+	if _, ok := cryptoAlgorithms[alg]; !ok {
+		return cryptoUnsupportedAlgorithm
+	}
+	if _, ok := h.allowed[alg]; !ok {
+		return cryptoProhibitedOperation
+	}
+	return cryptoSuccess
+}
+
+// cryptoFunc adapts the body of a wasi-crypto function so it can report
+// errnos, with guest memory errors mapped to guest_error.
+func cryptoFunc(caller *wasmtime.Caller, f func(mem *guestMemory) cryptoErrno) int32 {
+	mem, err := newGuestMemory(caller)
+	if err != nil {
+		return int32(cryptoGuestError)
+	}
+	return int32(f(mem))
+}
+
+func (h *cryptoHost) insert(mem *guestMemory, resultPtr int32, v interface{}) cryptoErrno {
+	handle, ok := h.handles.insert(v)
+	if !ok {
+		return cryptoTooManyHandles
+	}
+	if err := mem.writeUint32(resultPtr, handle); err != nil {
+		h.handles.remove(handle)
+		return cryptoGuestError
+	}
+	return cryptoSuccess
+}
+
+func (h *cryptoHost) close(handle int32, v interface{}) cryptoErrno {
+	obj, ok := h.handles.get(uint32(handle))
+	if !ok {
+		return cryptoInvalidHandle
+	}
+	// the handle must refer to an object of the expected type
+	if reflect.TypeOf(obj) != reflect.TypeOf(v) {
+		return cryptoInvalidHandle
+	}
+	h.handles.remove(uint32(handle))
+	return cryptoSuccess
+}
+
+func (h *cryptoHost) output(mem *guestMemory, resultPtr int32, data []byte) cryptoErrno {
+	return h.insert(mem, resultPtr, &cryptoArrayOutput{data: data})
+}
+
+// checkOptions validates an optional options handle. Options are accepted
+// for compatibility but none are currently supported.
+func (h *cryptoHost) checkOptions(mem *guestMemory, ptr int32) cryptoErrno {
+	tag, err := mem.readUint8(ptr)
+	if err != nil {
+		return cryptoGuestError
+	}
+	if tag != optSome {
+		return cryptoSuccess
+	}
+	handle, err := mem.readUint32(ptr + 4)
+	if err != nil {
+		return cryptoGuestError
+	}
+	if obj, ok := h.handles.get(handle); !ok {
+		return cryptoInvalidHandle
+	} else if _, ok := obj.(*cryptoOptions); !ok {
+		return cryptoInvalidHandle
+	}
+	return cryptoSuccess
+}
+
+func (h *cryptoHost) Define(linker *wasmtime.Linker) error {
+	funcs := []struct {
+		module, name string
+		f            interface{}
+	}{
+		{"wasi_ephemeral_crypto_common", "array_output_len", h.arrayOutputLen},
+		{"wasi_ephemeral_crypto_common", "array_output_pull", h.arrayOutputPull},
+		{"wasi_ephemeral_crypto_common", "options_open", h.optionsOpen},
+		{"wasi_ephemeral_crypto_common", "options_close", h.optionsClose},
+
+		{"wasi_ephemeral_crypto_asymmetric_common", "keypair_generate", h.keypairGenerate},
+		{"wasi_ephemeral_crypto_asymmetric_common", "keypair_import", h.keypairImport},
+		{"wasi_ephemeral_crypto_asymmetric_common", "keypair_export", h.keypairExport},
+		{"wasi_ephemeral_crypto_asymmetric_common", "keypair_publickey", h.keypairPublickey},
+		{"wasi_ephemeral_crypto_asymmetric_common", "keypair_close", h.keypairClose},
+		{"wasi_ephemeral_crypto_asymmetric_common", "publickey_import", h.publickeyImport},
+		{"wasi_ephemeral_crypto_asymmetric_common", "publickey_export", h.publickeyExport},
+		{"wasi_ephemeral_crypto_asymmetric_common", "publickey_close", h.publickeyClose},
+
+		{"wasi_ephemeral_crypto_signatures", "signature_export", h.signatureExport},
+		{"wasi_ephemeral_crypto_signatures", "signature_import", h.signatureImport},
+		{"wasi_ephemeral_crypto_signatures", "signature_close", h.signatureClose},
+		{"wasi_ephemeral_crypto_signatures", "signature_state_open", h.signatureStateOpen},
+		{"wasi_ephemeral_crypto_signatures", "signature_state_update", h.signatureStateUpdate},
+		{"wasi_ephemeral_crypto_signatures", "signature_state_sign", h.signatureStateSign},
+		{"wasi_ephemeral_crypto_signatures", "signature_state_close", h.signatureStateClose},
+		{"wasi_ephemeral_crypto_signatures", "signature_verification_state_open", h.verificationStateOpen},
+		{"wasi_ephemeral_crypto_signatures", "signature_verification_state_update", h.verificationStateUpdate},
+		{"wasi_ephemeral_crypto_signatures", "signature_verification_state_verify", h.verificationStateVerify},
+		{"wasi_ephemeral_crypto_signatures", "signature_verification_state_close", h.verificationStateClose},
+
+		{"wasi_ephemeral_crypto_symmetric", "symmetric_key_generate", h.symmetricKeyGenerate},
+		{"wasi_ephemeral_crypto_symmetric", "symmetric_key_import", h.symmetricKeyImport},
+		{"wasi_ephemeral_crypto_symmetric", "symmetric_key_export", h.symmetricKeyExport},
+		{"wasi_ephemeral_crypto_symmetric", "symmetric_key_close", h.symmetricKeyClose},
+		{"wasi_ephemeral_crypto_symmetric", "symmetric_state_open", h.symmetricStateOpen},
+		{"wasi_ephemeral_crypto_symmetric", "symmetric_state_absorb", h.symmetricStateAbsorb},
+		{"wasi_ephemeral_crypto_symmetric", "symmetric_state_squeeze", h.symmetricStateSqueeze},
+		{"wasi_ephemeral_crypto_symmetric", "symmetric_state_squeeze_tag", h.symmetricStateSqueezeTag},
+		{"wasi_ephemeral_crypto_symmetric", "symmetric_state_close", h.symmetricStateClose},
+		{"wasi_ephemeral_crypto_symmetric", "symmetric_tag_len", h.symmetricTagLen},
+		{"wasi_ephemeral_crypto_symmetric", "symmetric_tag_pull", h.symmetricTagPull},
+		{"wasi_ephemeral_crypto_symmetric", "symmetric_tag_verify", h.symmetricTagVerify},
+		{"wasi_ephemeral_crypto_symmetric", "symmetric_tag_close", h.symmetricTagClose},
+	}
+
+	for _, f := range funcs {
+		if err := linker.FuncWrap(f.module, f.name, f.f); err != nil {
+			return fmt.Errorf("failed to define %s.%s: %v", f.module, f.name, err)
+		}
+	}
+	return nil
+}
+
+// common
+
+func (h *cryptoHost) arrayOutputLen(caller *wasmtime.Caller, handle, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		obj, ok := h.handles.get(uint32(handle))
+		out, isOut := obj.(*cryptoArrayOutput)
+		if !ok || !isOut {
+			return cryptoInvalidHandle
+		}
+		if err := mem.writeUint32(resultPtr, uint32(len(out.data)-out.pos)); err != nil {
+			return cryptoGuestError
+		}
+		return cryptoSuccess
+	})
+}
+
+func (h *cryptoHost) arrayOutputPull(caller *wasmtime.Caller, handle, buf, bufLen, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		obj, ok := h.handles.get(uint32(handle))
+		out, isOut := obj.(*cryptoArrayOutput)
+		if !ok || !isOut {
+			return cryptoInvalidHandle
+		}
+
+		dst, err := mem.slice(buf, bufLen)
+		if err != nil {
+			return cryptoGuestError
+		}
+		n := copy(dst, out.data[out.pos:])
+		out.pos += n
+		if err := mem.writeUint32(resultPtr, uint32(n)); err != nil {
+			return cryptoGuestError
+		}
+
+		// the output is consumed once fully pulled
+		if out.pos == len(out.data) {
+			h.handles.remove(uint32(handle))
+		}
+		return cryptoSuccess
+	})
+}
+
+func (h *cryptoHost) optionsOpen(caller *wasmtime.Caller, algorithmType, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		return h.insert(mem, resultPtr, &cryptoOptions{})
+	})
+}
+
+func (h *cryptoHost) optionsClose(handle int32) int32 {
+	return int32(h.close(handle, &cryptoOptions{}))
+}
+
+// asymmetric common
+
+func (h *cryptoHost) keypairGenerate(caller *wasmtime.Caller, algorithmType, algPtr, algLen, optionsPtr, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		alg, err := mem.readString(algPtr, algLen)
+		if err != nil {
+			return cryptoGuestError
+		}
+		if algorithmType != algorithmTypeSignatures {
+			return cryptoUnsupportedFeature
+		}
+		if errno := h.checkAlgorithm(alg); errno != cryptoSuccess {
+			return errno
+		}
+		if errno := h.checkOptions(mem, optionsPtr); errno != cryptoSuccess {
+			return errno
+		}
+
+		var priv crypto.Signer
+		switch alg {
+		case algEd25519:
+			_, priv, err = ed25519.GenerateKey(rand.Reader)
+		case algECDSAP256:
+			priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		case algECDSAP384:
+			priv, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		default:
+			return cryptoUnsupportedAlgorithm
+		}
+		if err != nil {
+			return cryptoRNGError
+		}
+		return h.insert(mem, resultPtr, &cryptoKeypair{alg: alg, priv: priv})
+	})
+}
+
+func (h *cryptoHost) keypairImport(caller *wasmtime.Caller, algorithmType, algPtr, algLen, encodedPtr, encodedLen, encoding, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		alg, err := mem.readString(algPtr, algLen)
+		if err != nil {
+			return cryptoGuestError
+		}
+		encoded, err := mem.read(encodedPtr, encodedLen)
+		if err != nil {
+			return cryptoGuestError
+		}
+		if algorithmType != algorithmTypeSignatures {
+			return cryptoUnsupportedFeature
+		}
+		if errno := h.checkAlgorithm(alg); errno != cryptoSuccess {
+			return errno
+		}
+
+		priv, errno := decodeKeypair(alg, encoded, encoding)
+		if errno != cryptoSuccess {
+			return errno
+		}
+		return h.insert(mem, resultPtr, &cryptoKeypair{alg: alg, priv: priv})
+	})
+}
+
+func (h *cryptoHost) keypairExport(caller *wasmtime.Caller, handle, encoding, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		obj, _ := h.handles.get(uint32(handle))
+		kp, ok := obj.(*cryptoKeypair)
+		if !ok {
+			return cryptoInvalidHandle
+		}
+
+		b, errno := encodeKeypair(kp, encoding)
+		if errno != cryptoSuccess {
+			return errno
+		}
+		return h.output(mem, resultPtr, b)
+	})
+}
+
+func (h *cryptoHost) keypairPublickey(caller *wasmtime.Caller, handle, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		obj, _ := h.handles.get(uint32(handle))
+		kp, ok := obj.(*cryptoKeypair)
+		if !ok {
+			return cryptoInvalidHandle
+		}
+		return h.insert(mem, resultPtr, &cryptoPublickey{alg: kp.alg, pub: kp.priv.Public()})
+	})
+}
+
+func (h *cryptoHost) keypairClose(handle int32) int32 {
+	return int32(h.close(handle, &cryptoKeypair{}))
+}
+
+func (h *cryptoHost) publickeyImport(caller *wasmtime.Caller, algorithmType, algPtr, algLen, encodedPtr, encodedLen, encoding, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		alg, err := mem.readString(algPtr, algLen)
+		if err != nil {
+			return cryptoGuestError
+		}
+		encoded, err := mem.read(encodedPtr, encodedLen)
+		if err != nil {
+			return cryptoGuestError
+		}
+		if algorithmType != algorithmTypeSignatures {
+			return cryptoUnsupportedFeature
+		}
+		if errno := h.checkAlgorithm(alg); errno != cryptoSuccess {
+			return errno
+		}
+
+		pub, errno := decodePublickey(alg, encoded, encoding)
+		if errno != cryptoSuccess {
+			return errno
+		}
+		return h.insert(mem, resultPtr, &cryptoPublickey{alg: alg, pub: pub})
+	})
+}
+
+func (h *cryptoHost) publickeyExport(caller *wasmtime.Caller, handle, encoding, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		obj, _ := h.handles.get(uint32(handle))
+		pk, ok := obj.(*cryptoPublickey)
+		if !ok {
+			return cryptoInvalidHandle
+		}
+
+		b, errno := encodePublickey(pk, encoding)
+		if errno != cryptoSuccess {
+			return errno
+		}
+		return h.output(mem, resultPtr, b)
+	})
+}
+
+func (h *cryptoHost) publickeyClose(handle int32) int32 {
+	return int32(h.close(handle, &cryptoPublickey{}))
+}
+
+// signatures
+
+func (h *cryptoHost) signatureExport(caller *wasmtime.Caller, handle, encoding, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		obj, _ := h.handles.get(uint32(handle))
+		sig, ok := obj.(*cryptoSignature)
+		if !ok {
+			return cryptoInvalidHandle
+		}
+
+		switch encoding {
+		case signatureEncodingRaw:
+			return h.output(mem, resultPtr, sig.raw)
+		case signatureEncodingDER:
+			if sig.alg == algEd25519 {
+				return cryptoUnsupportedEncoding
+			}
+			half := len(sig.raw) / 2
+			der, err := asn1.Marshal(struct{ R, S *big.Int }{
+				new(big.Int).SetBytes(sig.raw[:half]),
+				new(big.Int).SetBytes(sig.raw[half:]),
+			})
+			if err != nil {
+				return cryptoAlgorithmFailure
+			}
+			return h.output(mem, resultPtr, der)
+		}
+		return cryptoUnsupportedEncoding
+	})
+}
+
+func (h *cryptoHost) signatureImport(caller *wasmtime.Caller, algPtr, algLen, encodedPtr, encodedLen, encoding, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		alg, err := mem.readString(algPtr, algLen)
+		if err != nil {
+			return cryptoGuestError
+		}
+		encoded, err := mem.read(encodedPtr, encodedLen)
+		if err != nil {
+			return cryptoGuestError
+		}
+		if errno := h.checkAlgorithm(alg); errno != cryptoSuccess {
+			return errno
+		}
+
+		raw, errno := decodeSignature(alg, encoded, encoding)
+		if errno != cryptoSuccess {
+			return errno
+		}
+		return h.insert(mem, resultPtr, &cryptoSignature{alg: alg, raw: raw})
+	})
+}
+
+// decodeSignature returns the raw form of an encoded signature
+func decodeSignature(alg string, encoded []byte, encoding int32) ([]byte, cryptoErrno) {
+	size := signatureSize(alg)
+	if size == 0 {
+		return nil, cryptoUnsupportedAlgorithm
+	}
+
+	var raw []byte
+	switch {
+	case encoding == signatureEncodingRaw:
+		raw = encoded
+	case encoding == signatureEncodingDER && alg != algEd25519:
+		var sig struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(encoded, &sig); err != nil {
+			return nil, cryptoInvalidSignature
+		}
+		// each half holds one scalar, which FillBytes panics on overflowing
+		for _, n := range []*big.Int{sig.R, sig.S} {
+			if n.Sign() <= 0 || n.BitLen() > size*4 {
+				return nil, cryptoInvalidSignature
+			}
+		}
+		raw = make([]byte, size)
+		sig.R.FillBytes(raw[:size/2])
+		sig.S.FillBytes(raw[size/2:])
+	default:
+		return nil, cryptoUnsupportedEncoding
+	}
+
+	if len(raw) != size {
+		return nil, cryptoInvalidSignature
+	}
+	return raw, cryptoSuccess
+}
+
+func (h *cryptoHost) signatureClose(handle int32) int32 {
+	return int32(h.close(handle, &cryptoSignature{}))
+}
+
+func (h *cryptoHost) signatureStateOpen(caller *wasmtime.Caller, kpHandle, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		obj, _ := h.handles.get(uint32(kpHandle))
+		kp, ok := obj.(*cryptoKeypair)
+		if !ok {
+			return cryptoInvalidHandle
+		}
+		return h.insert(mem, resultPtr, &cryptoSignatureState{kp: kp})
+	})
+}
+
+func (h *cryptoHost) signatureStateUpdate(caller *wasmtime.Caller, handle, inputPtr, inputLen int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		obj, _ := h.handles.get(uint32(handle))
+		state, ok := obj.(*cryptoSignatureState)
+		if !ok {
+			return cryptoInvalidHandle
+		}
+		input, err := mem.slice(inputPtr, inputLen)
+		if err != nil {
+			return cryptoGuestError
+		}
+		state.msg.Write(input)
+		return cryptoSuccess
+	})
+}
+
+func (h *cryptoHost) signatureStateSign(caller *wasmtime.Caller, handle, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		obj, _ := h.handles.get(uint32(handle))
+		state, ok := obj.(*cryptoSignatureState)
+		if !ok {
+			return cryptoInvalidHandle
+		}
+
+		raw, err := sign(state.kp, state.msg.Bytes())
+		if err != nil {
+			return cryptoAlgorithmFailure
+		}
+		return h.insert(mem, resultPtr, &cryptoSignature{alg: state.kp.alg, raw: raw})
+	})
+}
+
+func (h *cryptoHost) signatureStateClose(handle int32) int32 {
+	return int32(h.close(handle, &cryptoSignatureState{}))
+}
+
+func (h *cryptoHost) verificationStateOpen(caller *wasmtime.Caller, pkHandle, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		obj, _ := h.handles.get(uint32(pkHandle))
+		pk, ok := obj.(*cryptoPublickey)
+		if !ok {
+			return cryptoInvalidHandle
+		}
+		return h.insert(mem, resultPtr, &cryptoVerificationState{pk: pk})
+	})
+}
+
+func (h *cryptoHost) verificationStateUpdate(caller *wasmtime.Caller, handle, inputPtr, inputLen int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		obj, _ := h.handles.get(uint32(handle))
+		state, ok := obj.(*cryptoVerificationState)
+		if !ok {
+			return cryptoInvalidHandle
+		}
+		input, err := mem.slice(inputPtr, inputLen)
+		if err != nil {
+			return cryptoGuestError
+		}
+		state.msg.Write(input)
+		return cryptoSuccess
+	})
+}
+
+func (h *cryptoHost) verificationStateVerify(handle, sigHandle int32) int32 {
+	obj, _ := h.handles.get(uint32(handle))
+	state, ok := obj.(*cryptoVerificationState)
+	if !ok {
+		return int32(cryptoInvalidHandle)
+	}
+	obj, _ = h.handles.get(uint32(sigHandle))
+	sig, ok := obj.(*cryptoSignature)
+	if !ok {
+		return int32(cryptoInvalidHandle)
+	}
+	if sig.alg != state.pk.alg {
+		return int32(cryptoInvalidSignature)
+	}
+
+	if !verify(state.pk, state.msg.Bytes(), sig.raw) {
+		return int32(cryptoVerificationFailed)
+	}
+	return int32(cryptoSuccess)
+}
+
+func (h *cryptoHost) verificationStateClose(handle int32) int32 {
+	return int32(h.close(handle, &cryptoVerificationState{}))
+}
+
+// symmetric
+
+func (h *cryptoHost) symmetricKeyGenerate(caller *wasmtime.Caller, algPtr, algLen, optionsPtr, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		alg, err := mem.readString(algPtr, algLen)
+		if err != nil {
+			return cryptoGuestError
+		}
+		if errno := h.checkAlgorithm(alg); errno != cryptoSuccess {
+			return errno
+		}
+		if errno := h.checkOptions(mem, optionsPtr); errno != cryptoSuccess {
+			return errno
+		}
+
+		size := hmacKeySize(alg)
+		if size == 0 {
+			return cryptoKeyNotSupported
+		}
+		raw := make([]byte, size)
+		if _, err := rand.Read(raw); err != nil {
+			return cryptoRNGError
+		}
+		return h.insert(mem, resultPtr, &cryptoSymmetricKey{alg: alg, raw: raw})
+	})
+}
+
+func (h *cryptoHost) symmetricKeyImport(caller *wasmtime.Caller, algPtr, algLen, rawPtr, rawLen, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		alg, err := mem.readString(algPtr, algLen)
+		if err != nil {
+			return cryptoGuestError
+		}
+		raw, err := mem.read(rawPtr, rawLen)
+		if err != nil {
+			return cryptoGuestError
+		}
+		if errno := h.checkAlgorithm(alg); errno != cryptoSuccess {
+			return errno
+		}
+		if hmacKeySize(alg) == 0 {
+			return cryptoKeyNotSupported
+		}
+		return h.insert(mem, resultPtr, &cryptoSymmetricKey{alg: alg, raw: raw})
+	})
+}
+
+func (h *cryptoHost) symmetricKeyExport(caller *wasmtime.Caller, handle, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		obj, _ := h.handles.get(uint32(handle))
+		key, ok := obj.(*cryptoSymmetricKey)
+		if !ok {
+			return cryptoInvalidHandle
+		}
+		return h.output(mem, resultPtr, append([]byte(nil), key.raw...))
+	})
+}
+
+func (h *cryptoHost) symmetricKeyClose(handle int32) int32 {
+	return int32(h.close(handle, &cryptoSymmetricKey{}))
+}
+
+func (h *cryptoHost) symmetricStateOpen(caller *wasmtime.Caller, algPtr, algLen, keyPtr, optionsPtr, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		alg, err := mem.readString(algPtr, algLen)
+		if err != nil {
+			return cryptoGuestError
+		}
+		if errno := h.checkAlgorithm(alg); errno != cryptoSuccess {
+			return errno
+		}
+		if errno := h.checkOptions(mem, optionsPtr); errno != cryptoSuccess {
+			return errno
+		}
+
+		tag, err := mem.readUint8(keyPtr)
+		if err != nil {
+			return cryptoGuestError
+		}
+		var key *cryptoSymmetricKey
+		if tag == optSome {
+			handle, err := mem.readUint32(keyPtr + 4)
+			if err != nil {
+				return cryptoGuestError
+			}
+			obj, _ := h.handles.get(handle)
+			var ok bool
+			if key, ok = obj.(*cryptoSymmetricKey); !ok {
+				return cryptoInvalidHandle
+			}
+			if key.alg != alg {
+				return cryptoInvalidKey
+			}
+		}
+
+		var state *cryptoSymmetricState
+		switch alg {
+		case algSHA256, algSHA512:
+			if key != nil {
+				return cryptoKeyNotSupported
+			}
+			state = &cryptoSymmetricState{alg: alg, h: newHash(alg)()}
+		case algHMACSHA256, algHMACSHA512:
+			if key == nil {
+				return cryptoKeyRequired
+			}
+			state = &cryptoSymmetricState{alg: alg, h: hmac.New(newHash(alg), key.raw)}
+		default:
+			return cryptoUnsupportedAlgorithm
+		}
+		return h.insert(mem, resultPtr, state)
+	})
+}
+
+func (h *cryptoHost) symmetricStateAbsorb(caller *wasmtime.Caller, handle, dataPtr, dataLen int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		obj, _ := h.handles.get(uint32(handle))
+		state, ok := obj.(*cryptoSymmetricState)
+		if !ok {
+			return cryptoInvalidHandle
+		}
+		data, err := mem.slice(dataPtr, dataLen)
+		if err != nil {
+			return cryptoGuestError
+		}
+		state.h.Write(data)
+		return cryptoSuccess
+	})
+}
+
+// symmetricStateSqueeze returns the digest of hash functions. The output may
+// be truncated but not extended.
+func (h *cryptoHost) symmetricStateSqueeze(caller *wasmtime.Caller, handle, outPtr, outLen int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		obj, _ := h.handles.get(uint32(handle))
+		state, ok := obj.(*cryptoSymmetricState)
+		if !ok {
+			return cryptoInvalidHandle
+		}
+		if state.alg != algSHA256 && state.alg != algSHA512 {
+			return cryptoInvalidOperation
+		}
+
+		sum := state.h.Sum(nil)
+		if int(uint32(outLen)) > len(sum) {
+			return cryptoInvalidLength
+		}
+		if err := mem.write(outPtr, sum[:outLen]); err != nil {
+			return cryptoGuestError
+		}
+		return cryptoSuccess
+	})
+}
+
+func (h *cryptoHost) symmetricStateSqueezeTag(caller *wasmtime.Caller, handle, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		obj, _ := h.handles.get(uint32(handle))
+		state, ok := obj.(*cryptoSymmetricState)
+		if !ok {
+			return cryptoInvalidHandle
+		}
+		if state.alg != algHMACSHA256 && state.alg != algHMACSHA512 {
+			return cryptoInvalidOperation
+		}
+		return h.insert(mem, resultPtr, &cryptoSymmetricTag{raw: state.h.Sum(nil)})
+	})
+}
+
+func (h *cryptoHost) symmetricStateClose(handle int32) int32 {
+	return int32(h.close(handle, &cryptoSymmetricState{}))
+}
+
+func (h *cryptoHost) symmetricTagLen(caller *wasmtime.Caller, handle, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		obj, _ := h.handles.get(uint32(handle))
+		tag, ok := obj.(*cryptoSymmetricTag)
+		if !ok {
+			return cryptoInvalidHandle
+		}
+		if err := mem.writeUint32(resultPtr, uint32(len(tag.raw))); err != nil {
+			return cryptoGuestError
+		}
+		return cryptoSuccess
+	})
+}
+
+// symmetricTagPull copies the tag into the guest buffer, which must be
+// exactly the size of the tag, and closes the tag.
+func (h *cryptoHost) symmetricTagPull(caller *wasmtime.Caller, handle, buf, bufLen, resultPtr int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		obj, _ := h.handles.get(uint32(handle))
+		tag, ok := obj.(*cryptoSymmetricTag)
+		if !ok {
+			return cryptoInvalidHandle
+		}
+		if int(uint32(bufLen)) < len(tag.raw) {
+			return cryptoOverflow
+		}
+		if int(uint32(bufLen)) > len(tag.raw) {
+			return cryptoInvalidLength
+		}
+		if err := mem.write(buf, tag.raw); err != nil {
+			return cryptoGuestError
+		}
+		if err := mem.writeUint32(resultPtr, uint32(len(tag.raw))); err != nil {
+			return cryptoGuestError
+		}
+		h.handles.remove(uint32(handle))
+		return cryptoSuccess
+	})
+}
+
+func (h *cryptoHost) symmetricTagVerify(caller *wasmtime.Caller, handle, expectedPtr, expectedLen int32) int32 {
+	return cryptoFunc(caller, func(mem *guestMemory) cryptoErrno {
+		obj, _ := h.handles.get(uint32(handle))
+		tag, ok := obj.(*cryptoSymmetricTag)
+		if !ok {
+			return cryptoInvalidHandle
+		}
+		expected, err := mem.slice(expectedPtr, expectedLen)
+		if err != nil {
+			return cryptoGuestError
+		}
+		if subtle.ConstantTimeCompare(tag.raw, expected) != 1 {
+			return cryptoInvalidTag
+		}
+		return cryptoSuccess
+	})
+}
+
+func (h *cryptoHost) symmetricTagClose(handle int32) int32 {
+	return int32(h.close(handle, &cryptoSymmetricTag{}))
+}
+
+// algorithm helpers
+
+// newHash returns the hash function used by alg
+func newHash(alg string) func() hash.Hash {
+	switch alg {
+	case algSHA512, algHMACSHA512:
+		return sha512.New
+	case algECDSAP384:
+		return sha512.New384
+	}
+	return sha256.New
+}
+
+// hmacKeySize returns the size of generated keys for alg, which is the size
+// of the underlying hash, or 0 if alg doesn't take a symmetric key.
+func hmacKeySize(alg string) int {
+	switch alg {
+	case algHMACSHA256:
+		return sha256.Size
+	case algHMACSHA512:
+		return sha512.Size
+	}
+	return 0
+}
+
+// signatureSize returns the size of a raw signature for alg
+func signatureSize(alg string) int {
+	switch alg {
+	case algEd25519:
+		return ed25519.SignatureSize
+	case algECDSAP256:
+		return 64
+	case algECDSAP384:
+		return 96
+	}
+	return 0
+}
+
+func curve(alg string) elliptic.Curve {
+	if alg == algECDSAP384 {
+		return elliptic.P384()
+	}
+	return elliptic.P256()
+}
+
+func sign(kp *cryptoKeypair, msg []byte) ([]byte, error) {
+	switch priv := kp.priv.(type) {
+	case ed25519.PrivateKey:
+		return ed25519.Sign(priv, msg), nil
+	case *ecdsa.PrivateKey:
+		h := newHash(kp.alg)()
+		h.Write(msg)
+		r, s, err := ecdsa.Sign(rand.Reader, priv, h.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		size := signatureSize(kp.alg)
+		raw := make([]byte, size)
+		r.FillBytes(raw[:size/2])
+		s.FillBytes(raw[size/2:])
+		return raw, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", kp.priv)
+}
+
+func verify(pk *cryptoPublickey, msg, raw []byte) bool {
+	switch pub := pk.pub.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, msg, raw)
+	case *ecdsa.PublicKey:
+		h := newHash(pk.alg)()
+		h.Write(msg)
+		half := len(raw) / 2
+		r := new(big.Int).SetBytes(raw[:half])
+		s := new(big.Int).SetBytes(raw[half:])
+		return ecdsa.Verify(pub, h.Sum(nil), r, s)
+	}
+	return false
+}
+
+func decodeKeypair(alg string, encoded []byte, encoding int32) (crypto.Signer, cryptoErrno) {
+	var der []byte
+	switch encoding {
+	case keypairEncodingRaw:
+		if alg == algEd25519 {
+			switch len(encoded) {
+			case ed25519.SeedSize:
+				return ed25519.NewKeyFromSeed(encoded), cryptoSuccess
+			case ed25519.PrivateKeySize:
+				return ed25519.PrivateKey(encoded), cryptoSuccess
+			}
+			return nil, cryptoInvalidKey
+		}
+
+		c := curve(alg)
+		d := new(big.Int).SetBytes(encoded)
+		if len(encoded) != (c.Params().BitSize+7)/8 || d.Sign() <= 0 || d.Cmp(c.Params().N) >= 0 {
+			return nil, cryptoInvalidKey
+		}
+		priv := &ecdsa.PrivateKey{D: d}
+		priv.Curve = c
+		priv.X, priv.Y = c.ScalarBaseMult(encoded)
+		return priv, cryptoSuccess
+	case keypairEncodingPEM:
+		block, _ := pem.Decode(encoded)
+		if block == nil {
+			return nil, cryptoInvalidKey
+		}
+		der = block.Bytes
+	case keypairEncodingPKCS8:
+		der = encoded
+	default:
+		return nil, cryptoUnsupportedEncoding
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, cryptoInvalidKey
+	}
+	switch priv := key.(type) {
+	case ed25519.PrivateKey:
+		if alg == algEd25519 {
+			return priv, cryptoSuccess
+		}
+	case *ecdsa.PrivateKey:
+		if priv.Curve == curve(alg) && alg != algEd25519 {
+			return priv, cryptoSuccess
+		}
+	}
+	return nil, cryptoIncompatibleKeys
+}
+
+func encodeKeypair(kp *cryptoKeypair, encoding int32) ([]byte, cryptoErrno) {
+	switch encoding {
+	case keypairEncodingRaw:
+		switch priv := kp.priv.(type) {
+		case ed25519.PrivateKey:
+			return priv.Seed(), cryptoSuccess
+		case *ecdsa.PrivateKey:
+			return priv.D.FillBytes(make([]byte, (priv.Curve.Params().BitSize+7)/8)), cryptoSuccess
+		}
+	case keypairEncodingPKCS8, keypairEncodingPEM:
+		der, err := x509.MarshalPKCS8PrivateKey(kp.priv)
+		if err != nil {
+			return nil, cryptoAlgorithmFailure
+		}
+		if encoding == keypairEncodingPEM {
+			return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), cryptoSuccess
+		}
+		return der, cryptoSuccess
+	}
+	return nil, cryptoUnsupportedEncoding
+}
+
+func decodePublickey(alg string, encoded []byte, encoding int32) (crypto.PublicKey, cryptoErrno) {
+	var der []byte
+	switch encoding {
+	case publickeyEncodingRaw, publickeyEncodingSEC, publickeyEncodingCompressedSEC:
+		if alg == algEd25519 {
+			if encoding != publickeyEncodingRaw || len(encoded) != ed25519.PublicKeySize {
+				return nil, cryptoInvalidKey
+			}
+			return ed25519.PublicKey(encoded), cryptoSuccess
+		}
+
+		c := curve(alg)
+		var x, y *big.Int
+		if encoding == publickeyEncodingCompressedSEC {
+			x, y = elliptic.UnmarshalCompressed(c, encoded)
+		} else {
+			x, y = elliptic.Unmarshal(c, encoded)
+		}
+		if x == nil {
+			return nil, cryptoInvalidKey
+		}
+		return &ecdsa.PublicKey{Curve: c, X: x, Y: y}, cryptoSuccess
+	case publickeyEncodingPEM:
+		block, _ := pem.Decode(encoded)
+		if block == nil {
+			return nil, cryptoInvalidKey
+		}
+		der = block.Bytes
+	case publickeyEncodingPKCS8:
+		der = encoded
+	default:
+		return nil, cryptoUnsupportedEncoding
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, cryptoInvalidKey
+	}
+	switch pub := key.(type) {
+	case ed25519.PublicKey:
+		if alg == algEd25519 {
+			return pub, cryptoSuccess
+		}
+	case *ecdsa.PublicKey:
+		if pub.Curve == curve(alg) && alg != algEd25519 {
+			return pub, cryptoSuccess
+		}
+	}
+	return nil, cryptoIncompatibleKeys
+}
+
+func encodePublickey(pk *cryptoPublickey, encoding int32) ([]byte, cryptoErrno) {
+	switch pub := pk.pub.(type) {
+	case ed25519.PublicKey:
+		if encoding == publickeyEncodingRaw {
+			return append([]byte(nil), pub...), cryptoSuccess
+		}
+	case *ecdsa.PublicKey:
+		switch encoding {
+		case publickeyEncodingRaw, publickeyEncodingSEC:
+			return elliptic.Marshal(pub.Curve, pub.X, pub.Y), cryptoSuccess
+		case publickeyEncodingCompressedSEC:
+			return elliptic.MarshalCompressed(pub.Curve, pub.X, pub.Y), cryptoSuccess
+		}
+	}
+
+	if encoding != publickeyEncodingPKCS8 && encoding != publickeyEncodingPEM {
+		return nil, cryptoUnsupportedEncoding
+	}
+	der, err := x509.MarshalPKIXPublicKey(pk.pub)
+	if err != nil {
+		return nil, cryptoAlgorithmFailure
+	}
+	if encoding == publickeyEncodingPEM {
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), cryptoSuccess
+	}
+	return der, cryptoSuccess
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const cryptoWat = `
+(module
+  (import "wasi_ephemeral_crypto_symmetric" "symmetric_key_import"
+    (func $key_import (param i32 i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_crypto_symmetric" "symmetric_state_open"
+    (func $state_open (param i32 i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_crypto_symmetric" "symmetric_state_absorb"
+    (func $absorb (param i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_crypto_symmetric" "symmetric_state_squeeze_tag"
+    (func $squeeze_tag (param i32 i32) (result i32)))
+  (import "wasi_ephemeral_crypto_symmetric" "symmetric_tag_pull"
+    (func $tag_pull (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_crypto_asymmetric_common" "keypair_generate"
+    (func $keypair_generate (param i32 i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_crypto_asymmetric_common" "keypair_publickey"
+    (func $keypair_publickey (param i32 i32) (result i32)))
+  (import "wasi_ephemeral_crypto_signatures" "signature_state_open"
+    (func $sig_open (param i32 i32) (result i32)))
+  (import "wasi_ephemeral_crypto_signatures" "signature_state_update"
+    (func $sig_update (param i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_crypto_signatures" "signature_state_sign"
+    (func $sig_sign (param i32 i32) (result i32)))
+  (import "wasi_ephemeral_crypto_signatures" "signature_verification_state_open"
+    (func $verify_open (param i32 i32) (result i32)))
+  (import "wasi_ephemeral_crypto_signatures" "signature_verification_state_update"
+    (func $verify_update (param i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_crypto_signatures" "signature_verification_state_verify"
+    (func $verify (param i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+  (data (i32.const 0) "HMAC/SHA-256")
+  (data (i32.const 16) "Ed25519")
+  (data (i32.const 32) "secret")
+  (data (i32.const 64) "hello")
+  ;; opt_options set to none
+  (data (i32.const 128) "\01")
+
+  ;; computes HMAC-SHA256("secret", "hello") into [256, 288)
+  (func (export "hmac") (result i32)
+    (local $errno i32)
+    (if (local.tee $errno (call $key_import (i32.const 0) (i32.const 12) (i32.const 32) (i32.const 6) (i32.const 200)))
+      (then (return (local.get $errno))))
+    ;; opt_symmetric_key set to some(key)
+    (i32.store8 (i32.const 136) (i32.const 0))
+    (i32.store (i32.const 140) (i32.load (i32.const 200)))
+    (if (local.tee $errno (call $state_open (i32.const 0) (i32.const 12) (i32.const 136) (i32.const 128) (i32.const 204)))
+      (then (return (local.get $errno))))
+    (if (local.tee $errno (call $absorb (i32.load (i32.const 204)) (i32.const 64) (i32.const 5)))
+      (then (return (local.get $errno))))
+    (if (local.tee $errno (call $squeeze_tag (i32.load (i32.const 204)) (i32.const 208)))
+      (then (return (local.get $errno))))
+    (call $tag_pull (i32.load (i32.const 208)) (i32.const 256) (i32.const 32) (i32.const 212)))
+
+  ;; signs and verifies "hello" with a fresh Ed25519 keypair
+  (func (export "sign") (result i32)
+    (local $errno i32)
+    (if (local.tee $errno (call $keypair_generate (i32.const 0) (i32.const 16) (i32.const 7) (i32.const 128) (i32.const 200)))
+      (then (return (local.get $errno))))
+    (if (local.tee $errno (call $sig_open (i32.load (i32.const 200)) (i32.const 204)))
+      (then (return (local.get $errno))))
+    (if (local.tee $errno (call $sig_update (i32.load (i32.const 204)) (i32.const 64) (i32.const 5)))
+      (then (return (local.get $errno))))
+    (if (local.tee $errno (call $sig_sign (i32.load (i32.const 204)) (i32.const 208)))
+      (then (return (local.get $errno))))
+    (if (local.tee $errno (call $keypair_publickey (i32.load (i32.const 200)) (i32.const 212)))
+      (then (return (local.get $errno))))
+    (if (local.tee $errno (call $verify_open (i32.load (i32.const 212)) (i32.const 216)))
+      (then (return (local.get $errno))))
+    (if (local.tee $errno (call $verify_update (i32.load (i32.const 216)) (i32.const 64) (i32.const 5)))
+      (then (return (local.get $errno))))
+    (call $verify (i32.load (i32.const 216)) (i32.load (i32.const 208))))
+)`
+
+func TestCryptoHost(t *testing.T) {
+	h, err := newCryptoHost(nil, false)
+	require.NoError(t, err)
+	defer h.Close()
+
+	store, instance := instantiate(t, cryptoWat, h)
+
+	require.Equal(t, int32(cryptoSuccess), call(t, store, instance, "hmac"))
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("hello"))
+	require.Equal(t, mac.Sum(nil), memory(store, instance)[256:288])
+
+	require.Equal(t, int32(cryptoSuccess), call(t, store, instance, "sign"))
+}
+
+func TestCryptoHost_Allowlist(t *testing.T) {
+	_, err := newCryptoHost([]string{"MD5"}, false)
+	require.Error(t, err)
+
+	_, err = newCryptoHost([]string{algEd25519}, true)
+	require.Error(t, err, "Ed25519 must be rejected in FIPS mode")
+
+	h, err := newCryptoHost(nil, true)
+	require.NoError(t, err)
+	defer h.Close()
+
+	store, instance := instantiate(t, cryptoWat, h)
+	require.Equal(t, int32(cryptoSuccess), call(t, store, instance, "hmac"))
+	require.Equal(t, int32(cryptoProhibitedOperation), call(t, store, instance, "sign"))
+}
+
+func TestDecodeSignature_DER(t *testing.T) {
+	der := func(r, s *big.Int) []byte {
+		encoded, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+		require.NoError(t, err)
+		return encoded
+	}
+
+	raw, errno := decodeSignature(algECDSAP256, der(big.NewInt(1), big.NewInt(2)), signatureEncodingDER)
+	require.Equal(t, cryptoSuccess, errno)
+	require.Len(t, raw, 64)
+
+	// scalars that don't fit their half of the raw signature
+	large := new(big.Int).Lsh(big.NewInt(1), 256)
+	for _, encoded := range [][]byte{
+		der(large, big.NewInt(1)),
+		der(big.NewInt(1), large),
+		der(big.NewInt(0), big.NewInt(1)),
+		der(big.NewInt(-1), big.NewInt(1)),
+	} {
+		_, errno := decodeSignature(algECDSAP256, encoded, signatureEncodingDER)
+		require.Equal(t, cryptoInvalidSignature, errno)
+	}
+}
+
+func TestDecodeKeypair_RawECDSA(t *testing.T) {
+	key := make([]byte, 32)
+	key[31] = 1
+	_, errno := decodeKeypair(algECDSAP256, key, keypairEncodingRaw)
+	require.Equal(t, cryptoSuccess, errno)
+
+	n := elliptic.P256().Params().N
+	for _, encoded := range [][]byte{
+		make([]byte, 32),
+		key[1:],
+		append([]byte{0}, key...),
+		n.Bytes(),
+		new(big.Int).Add(n, big.NewInt(1)).Bytes(),
+	} {
+		_, errno := decodeKeypair(algECDSAP256, encoded, keypairEncodingRaw)
+		require.Equal(t, cryptoInvalidKey, errno)
+	}
+}
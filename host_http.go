@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// httpErrno is the error code returned by http functions
+type httpErrno int32
+
+const (
+	httpSuccess        httpErrno = 0
+	httpGuestError     httpErrno = 1
+	httpInvalidRequest httpErrno = 2
+	httpDenied         httpErrno = 3
+	httpIOError        httpErrno = 4
+	httpOverflow       httpErrno = 5
+	httpBadHandle      httpErrno = 6
+	httpTooManyHandles httpErrno = 7
+)
+
+const (
+	// httpModule is the import namespace of the http functions
+	httpModule = "wasi_ephemeral_http"
+
+	// httpTimeout bounds every request made on behalf of a guest, including
+	// reading its response
+	httpTimeout = 30 * time.Second
+
+	// maxHTTPResponses caps the responses a guest may hold open
+	maxHTTPResponses = 16
+
+	// taskAPIHost is the virtual host guests reach the Nomad task API at
+	taskAPIHost = "nomad.task.api"
+
+	// taskAPISocket is the task API's unix socket in the task's secrets dir
+	taskAPISocket = "api.sock"
+)
+
+// errHostNotAllowed is returned for requests to hosts outside of
+// http.allowed_hosts, including after a redirect
+var errHostNotAllowed = errors.New("host not allowed")
+
+// httpResponse is a response held open for a guest
+type httpResponse struct {
+	resp   *http.Response
+	cancel context.CancelFunc
+}
+
+// httpHost lets a guest make outbound HTTP requests to the hosts allowed by
+// its task config and to its Connect upstreams:
+//
+//	request(method_ptr, method_len, url_ptr, url_len, headers_ptr, headers_len, body_ptr, body_len, handle_ptr) -> errno
+//	status(handle, status_ptr) -> errno
+//	headers(handle, buf_ptr, buf_len, n_ptr) -> errno
+//	body_read(handle, buf_ptr, buf_len, n_ptr) -> errno
+//	close(handle) -> errno
+//
+// Headers are passed as "Name: value" lines separated by "\n". headers
+// returns overflow with the required length at n_ptr if the buffer is too
+// small. body_read reads up to buf_len bytes of the body, storing 0 at n_ptr
+// at the end of it. Responses must be closed.
+//
+// With http.client_cert, the certificate is presented to the servers
+// requesting one. http.rewrite rules send the requests to a host to another
+// address, SNI or Host header.
+//
+// If enabled, requests to http://nomad.task.api are sent to the Nomad task
+// API over its unix socket, with the task's workload identity unless the
+// guest sets its own Authorization header.
+type httpHost struct {
+	client       *http.Client
+	allowedHosts *hostAllowlist
+	taskAPI      bool
+	taskConfig   *drivers.TaskConfig
+	responses    *handleTable
+
+	// upstreams are the host:port of the task's Connect upstreams, allowed
+	// whatever allowed_hosts
+	upstreams map[string]bool
+
+	// release drops the task's reference to its response cache
+	release func()
+
+	// ctx is cancelled when the task is destroyed, aborting requests in
+	// flight
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newHTTPHost(cfg *drivers.TaskConfig, config TaskHTTPConfig) (*httpHost, error) {
+	h := &httpHost{
+		allowedHosts: newHostAllowlist(config.AllowedHosts),
+		taskAPI:      config.TaskAPI,
+		taskConfig:   cfg,
+		responses:    newHandleTable(maxHTTPResponses),
+		upstreams:    map[string]bool{},
+	}
+	for _, u := range connectUpstreams(cfg.Env) {
+		for _, addr := range u.addrs() {
+			h.upstreams[addr] = true
+		}
+	}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+
+	rules, err := parseHTTPRewrites(config.Rewrite)
+	if err != nil {
+		return nil, err
+	}
+	transport := &taskAPITransport{next: newOutboundTransport(nil, rules)}
+	if config.ClientCert != nil {
+		c, err := newClientTLS(cfg.TaskDir().Dir, *config.ClientCert)
+		if err != nil {
+			return nil, err
+		}
+		transport.next = newClientTLSTransport(c, rules)
+	}
+	if config.TaskAPI {
+		transport.unix = newUnixTransport(filepath.Join(cfg.TaskDir().SecretsDir, taskAPISocket))
+	}
+	h.client = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if !h.allowedURL(req.URL) {
+				return errHostNotAllowed
+			}
+			return nil
+		},
+	}
+	return h, nil
+}
+
+func (h *httpHost) Close() error {
+	h.cancel()
+	for _, v := range h.responses.clear() {
+		r := v.(*httpResponse)
+		r.resp.Body.Close()
+		r.cancel()
+	}
+	h.client.CloseIdleConnections()
+	if h.release != nil {
+		h.release()
+	}
+	return nil
+}
+
+// useMeter counts the guest's traffic in the usage of its namespace,
+// throttled to the namespace's bandwidth quota. Responses from the cache
+// aren't counted if it's used after. It's a no-op without quotas.
+func (h *httpHost) useMeter(quotas *quotaTracker, namespace string) {
+	if quotas == nil {
+		return
+	}
+	transport := h.client.Transport.(*taskAPITransport)
+	transport.next = quotas.transport(namespace, transport.next)
+}
+
+// useCache answers the guest's cacheable requests from cache, calling
+// release when the host is closed
+func (h *httpHost) useCache(cache *httpCache, release func()) {
+	transport := h.client.Transport.(*taskAPITransport)
+	transport.next = &httpCacheTransport{next: transport.next, cache: cache}
+	h.release = release
+}
+
+func (h *httpHost) Define(linker *wasmtime.Linker) error {
+	for name, fn := range map[string]interface{}{
+		"request":   h.request,
+		"status":    h.status,
+		"headers":   h.headers,
+		"body_read": h.bodyRead,
+		"close":     h.close,
+	} {
+		if err := linker.FuncWrap(httpModule, name, fn); err != nil {
+			return fmt.Errorf("failed to define %s.%s: %v", httpModule, name, err)
+		}
+	}
+	return nil
+}
+
+// allowed reports whether the guest may connect to host
+func (h *httpHost) allowed(host string) bool {
+	host = strings.ToLower(host)
+	if host == taskAPIHost {
+		return h.taskAPI
+	}
+	return h.allowedHosts.allowed(host)
+}
+
+// hostAllowlist is the allowed_hosts of a task, which serve.reload_file
+// may change while its instances run
+type hostAllowlist struct {
+	lock  sync.RWMutex
+	hosts []string
+}
+
+func newHostAllowlist(hosts []string) *hostAllowlist {
+	return &hostAllowlist{hosts: hosts}
+}
+
+// allowed reports whether host is allowed. Entries starting with "*."
+// match any subdomain.
+func (l *hostAllowlist) allowed(host string) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	for _, allowed := range l.hosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed {
+			return true
+		}
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *hostAllowlist) set(hosts []string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.hosts = hosts
+}
+
+// taskAllowlists are the allowlists of the running tasks, shared by the
+// http hosts of their instances. The zero value is ready to use.
+type taskAllowlists struct {
+	lock  sync.Mutex
+	lists map[string]*hostAllowlist
+}
+
+// get returns the allowlist of the task, created with hosts if it has none
+func (t *taskAllowlists) get(taskID string, hosts []string) *hostAllowlist {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.lists == nil {
+		t.lists = map[string]*hostAllowlist{}
+	}
+	l, ok := t.lists[taskID]
+	if !ok {
+		l = newHostAllowlist(hosts)
+		t.lists[taskID] = l
+	}
+	return l
+}
+
+// remove drops the allowlist of a task once it's destroyed
+func (t *taskAllowlists) remove(taskID string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.lists, taskID)
+}
+
+// allowedURL reports whether the guest may send a request to u, whose host
+// is allowed or is the address of a Connect upstream
+func (h *httpHost) allowedURL(u *url.URL) bool {
+	return h.allowed(u.Hostname()) || h.upstreams[strings.ToLower(u.Host)]
+}
+
+// parseHeaders parses the "Name: value" lines passed by a guest
+func parseHeaders(b []byte) (http.Header, error) {
+	header := http.Header{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid header %q", line)
+		}
+		header.Add(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+	}
+	return header, scanner.Err()
+}
+
+// formatHeaders formats header as "Name: value" lines
+func formatHeaders(header http.Header) []byte {
+	var b bytes.Buffer
+	for name, values := range header {
+		for _, v := range values {
+			fmt.Fprintf(&b, "%s: %s\n", name, v)
+		}
+	}
+	return b.Bytes()
+}
+
+// newRequest builds a guest's request, returning httpDenied if its host
+// isn't allowed
+func (h *httpHost) newRequest(ctx context.Context, method, url string, header http.Header, body []byte) (*http.Request, httpErrno) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil || (req.URL.Scheme != "http" && req.URL.Scheme != "https") {
+		return nil, httpInvalidRequest
+	}
+	if !h.allowedURL(req.URL) {
+		return nil, httpDenied
+	}
+	req.Header = header
+
+	if strings.EqualFold(req.URL.Hostname(), taskAPIHost) && req.Header.Get("Authorization") == "" {
+		if token, err := workloadIdentity(h.taskConfig); err == nil {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	return req, httpSuccess
+}
+
+func (h *httpHost) request(caller *wasmtime.Caller, methodPtr, methodLen, urlPtr, urlLen, headersPtr, headersLen, bodyPtr, bodyLen, handlePtr int32) int32 {
+	mem, err := newGuestMemory(caller)
+	if err != nil {
+		return int32(httpGuestError)
+	}
+	method, err := mem.readString(methodPtr, methodLen)
+	if err != nil {
+		return int32(httpGuestError)
+	}
+	url, err := mem.readString(urlPtr, urlLen)
+	if err != nil {
+		return int32(httpGuestError)
+	}
+	rawHeaders, err := mem.read(headersPtr, headersLen)
+	if err != nil {
+		return int32(httpGuestError)
+	}
+	body, err := mem.read(bodyPtr, bodyLen)
+	if err != nil {
+		return int32(httpGuestError)
+	}
+	header, err := parseHeaders(rawHeaders)
+	if err != nil {
+		return int32(httpInvalidRequest)
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, httpTimeout)
+	req, errno := h.newRequest(ctx, method, url, header, body)
+	if errno != httpSuccess {
+		cancel()
+		return int32(errno)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		cancel()
+		if errors.Is(err, errHostNotAllowed) {
+			return int32(httpDenied)
+		}
+		return int32(httpIOError)
+	}
+
+	handle, ok := h.responses.insert(&httpResponse{resp: resp, cancel: cancel})
+	if !ok {
+		resp.Body.Close()
+		cancel()
+		return int32(httpTooManyHandles)
+	}
+	if err := mem.writeUint32(handlePtr, handle); err != nil {
+		h.closeResponse(handle)
+		return int32(httpGuestError)
+	}
+	return int32(httpSuccess)
+}
+
+func (h *httpHost) response(handle int32) (*httpResponse, bool) {
+	v, ok := h.responses.get(uint32(handle))
+	if !ok {
+		return nil, false
+	}
+	return v.(*httpResponse), true
+}
+
+func (h *httpHost) status(caller *wasmtime.Caller, handle, statusPtr int32) int32 {
+	r, ok := h.response(handle)
+	if !ok {
+		return int32(httpBadHandle)
+	}
+	mem, err := newGuestMemory(caller)
+	if err != nil {
+		return int32(httpGuestError)
+	}
+	if err := mem.writeUint32(statusPtr, uint32(r.resp.StatusCode)); err != nil {
+		return int32(httpGuestError)
+	}
+	return int32(httpSuccess)
+}
+
+func (h *httpHost) headers(caller *wasmtime.Caller, handle, bufPtr, bufLen, nPtr int32) int32 {
+	r, ok := h.response(handle)
+	if !ok {
+		return int32(httpBadHandle)
+	}
+	mem, err := newGuestMemory(caller)
+	if err != nil {
+		return int32(httpGuestError)
+	}
+	ok, err = mem.writeBuffer(bufPtr, bufLen, nPtr, formatHeaders(r.resp.Header))
+	switch {
+	case err != nil:
+		return int32(httpGuestError)
+	case !ok:
+		return int32(httpOverflow)
+	}
+	return int32(httpSuccess)
+}
+
+func (h *httpHost) bodyRead(caller *wasmtime.Caller, handle, bufPtr, bufLen, nPtr int32) int32 {
+	r, ok := h.response(handle)
+	if !ok {
+		return int32(httpBadHandle)
+	}
+	mem, err := newGuestMemory(caller)
+	if err != nil {
+		return int32(httpGuestError)
+	}
+	buf, err := mem.slice(bufPtr, bufLen)
+	if err != nil {
+		return int32(httpGuestError)
+	}
+
+	// fill the buffer unless the body ends, so n_ptr is only 0 at the end
+	n, err := io.ReadFull(r.resp.Body, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return int32(httpIOError)
+	}
+	if err := mem.writeUint32(nPtr, uint32(n)); err != nil {
+		return int32(httpGuestError)
+	}
+	return int32(httpSuccess)
+}
+
+func (h *httpHost) close(handle int32) int32 {
+	if !h.closeResponse(uint32(handle)) {
+		return int32(httpBadHandle)
+	}
+	return int32(httpSuccess)
+}
+
+func (h *httpHost) closeResponse(handle uint32) bool {
+	v, ok := h.responses.remove(handle)
+	if !ok {
+		return false
+	}
+	r := v.(*httpResponse)
+	r.resp.Body.Close()
+	r.cancel()
+	return true
+}
+
+// taskAPITransport sends requests for the task API's virtual host over its
+// unix socket, or fails them if unix is nil, and every other request with
+// next
+type taskAPITransport struct {
+	next roundTripCloser
+	unix *http.Transport
+}
+
+// roundTripCloser is a transport whose idle connections can be closed
+type roundTripCloser interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+// newUnixTransport returns a transport connecting to socket whatever the
+// address of the request
+func newUnixTransport(socket string) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+		MaxIdleConns:    1,
+		IdleConnTimeout: 30 * time.Second,
+	}
+}
+
+func (t *taskAPITransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.EqualFold(req.URL.Hostname(), taskAPIHost) {
+		return t.next.RoundTrip(req)
+	}
+	if t.unix == nil {
+		return nil, errHostNotAllowed
+	}
+	if req.URL.Scheme != "http" {
+		return nil, fmt.Errorf("the task API is only served over http")
+	}
+	return t.unix.RoundTrip(req)
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach both
+// transports
+func (t *taskAPITransport) CloseIdleConnections() {
+	t.next.CloseIdleConnections()
+	if t.unix != nil {
+		t.unix.CloseIdleConnections()
+	}
+}
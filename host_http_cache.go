@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/dustin/go-humanize"
+)
+
+// httpCacheEntry is a cached response
+type httpCacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+
+	// vary are the request headers named by the response's Vary header,
+	// which later requests must match
+	vary map[string]string
+
+	elem *list.Element
+}
+
+func (e *httpCacheEntry) size() uint64 {
+	return uint64(len(e.key) + len(e.body))
+}
+
+// httpCache caches the responses to idempotent outbound GETs, evicting the
+// least recently used ones beyond maxSize. A cache is shared by the tasks
+// of the same job, group and name, so the allocations of a job scaled out on
+// a node make one request where they would each make their own.
+type httpCache struct {
+	lock    sync.Mutex
+	maxSize uint64
+	ttl     time.Duration
+	size    uint64
+	entries map[string]*httpCacheEntry
+	lru     *list.List
+	now     func() time.Time
+
+	// refs are the tasks using the cache, guarded by the lock of httpCaches
+	refs int
+}
+
+func newHTTPCache(maxSize uint64, ttl time.Duration) *httpCache {
+	return &httpCache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		entries: map[string]*httpCacheEntry{},
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// cacheableRequest reports whether the response to req may be cached. The
+// responses to requests carrying credentials are specific to the guest.
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != "" {
+		return false
+	}
+	cc := strings.ToLower(req.Header.Get("Cache-Control"))
+	return !strings.Contains(cc, "no-cache") && !strings.Contains(cc, "no-store")
+}
+
+// responseTTL returns how long resp may be cached: the cache's ttl, capped
+// by the response's max-age
+func (c *httpCache) responseTTL(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("Vary") == "*" {
+		return 0, false
+	}
+	ttl := c.ttl
+	for _, directive := range strings.Split(strings.ToLower(resp.Header.Get("Cache-Control")), ",") {
+		directive = strings.TrimSpace(directive)
+		switch {
+		case directive == "no-store" || directive == "no-cache" || directive == "private":
+			return 0, false
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err != nil || seconds <= 0 {
+				return 0, false
+			}
+			if maxAge := time.Duration(seconds) * time.Second; maxAge < ttl {
+				ttl = maxAge
+			}
+		}
+	}
+	return ttl, true
+}
+
+// get returns the cached response to req
+func (c *httpCache) get(req *http.Request) (*http.Response, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[req.URL.String()]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(e.expires) {
+		c.removeLocked(e)
+		return nil, false
+	}
+	for name, value := range e.vary {
+		if req.Header.Get(name) != value {
+			return nil, false
+		}
+	}
+	c.lru.MoveToFront(e.elem)
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.status, http.StatusText(e.status)),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}, true
+}
+
+// put caches the response to req for ttl
+func (c *httpCache) put(req *http.Request, resp *http.Response, body []byte, ttl time.Duration) {
+	e := &httpCacheEntry{
+		key:     req.URL.String(),
+		status:  resp.StatusCode,
+		header:  resp.Header.Clone(),
+		body:    body,
+		expires: c.now().Add(ttl),
+		vary:    map[string]string{},
+	}
+	for _, names := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(names, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				e.vary[name] = req.Header.Get(name)
+			}
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e.size() > c.maxSize {
+		return
+	}
+	if old, ok := c.entries[e.key]; ok {
+		c.removeLocked(old)
+	}
+	for c.size+e.size() > c.maxSize {
+		c.removeLocked(c.lru.Back().Value.(*httpCacheEntry))
+	}
+	e.elem = c.lru.PushFront(e)
+	c.entries[e.key] = e
+	c.size += e.size()
+}
+
+func (c *httpCache) removeLocked(e *httpCacheEntry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.key)
+	c.size -= e.size()
+}
+
+// cachingBody buffers a response body while the guest reads it, caching
+// the response once read to the end. Bodies larger than the cache aren't
+// buffered past its size.
+type cachingBody struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	limit int
+	done  func([]byte)
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.done != nil {
+		if b.buf.Len()+n > b.limit {
+			b.done = nil
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && b.done != nil {
+		b.done(b.buf.Bytes())
+		b.done = nil
+	}
+	return n, err
+}
+
+// httpCacheTransport answers cacheable requests from cache, sending the
+// others and the misses with next
+type httpCacheTransport struct {
+	next  roundTripCloser
+	cache *httpCache
+}
+
+func (t *httpCacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !cacheableRequest(req) {
+		return t.next.RoundTrip(req)
+	}
+	if resp, ok := t.cache.get(req); ok {
+		metrics.IncrCounter([]string{"wasmtime", "http_cache", "hit"}, 1)
+		return resp, nil
+	}
+	metrics.IncrCounter([]string{"wasmtime", "http_cache", "miss"}, 1)
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if ttl, ok := t.cache.responseTTL(resp); ok {
+		resp.Body = &cachingBody{
+			ReadCloser: resp.Body,
+			limit:      int(t.cache.maxSize),
+			done: func(body []byte) {
+				t.cache.put(req, resp, body, ttl)
+			},
+		}
+	}
+	return resp, nil
+}
+
+func (t *httpCacheTransport) CloseIdleConnections() {
+	t.next.CloseIdleConnections()
+}
+
+// httpCaches are the response caches of the tasks, by taskKeyPrefix. The
+// zero value is ready to use.
+type httpCaches struct {
+	lock   sync.Mutex
+	caches map[string]*httpCache
+}
+
+// parseHTTPCache validates http.cache
+func parseHTTPCache(cfg TaskHTTPCacheConfig) (uint64, time.Duration, error) {
+	maxSize, err := humanize.ParseBytes(cfg.MaxSize)
+	if err != nil || maxSize == 0 {
+		return 0, 0, fmt.Errorf("invalid http cache max_size %q", cfg.MaxSize)
+	}
+	ttl, err := time.ParseDuration(cfg.TTL)
+	if err != nil || ttl <= 0 {
+		return 0, 0, fmt.Errorf("invalid http cache ttl %q", cfg.TTL)
+	}
+	return maxSize, ttl, nil
+}
+
+// acquire returns the cache shared by the tasks with key, created with the
+// settings of cfg by the first of them
+func (c *httpCaches) acquire(key string, cfg TaskHTTPCacheConfig) (*httpCache, error) {
+	maxSize, ttl, err := parseHTTPCache(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.caches == nil {
+		c.caches = map[string]*httpCache{}
+	}
+	cache, ok := c.caches[key]
+	if !ok {
+		cache = newHTTPCache(maxSize, ttl)
+		c.caches[key] = cache
+	}
+	cache.refs++
+	return cache, nil
+}
+
+// release drops the cache once no task with key uses it
+func (c *httpCaches) release(key string, cache *httpCache) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if cache.refs--; cache.refs == 0 && c.caches[key] == cache {
+		delete(c.caches, key)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPHost_Cache(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "private")
+		}
+		w.Write([]byte("response " + r.URL.Path))
+	}))
+	defer srv.Close()
+
+	d := &Driver{config: &Config{}, kvBackends: map[string]kvBackend{}}
+	driverConfig := &TaskConfig{HTTP: TaskHTTPConfig{
+		AllowedHosts: []string{"127.0.0.1"},
+		Cache:        &TaskHTTPCacheConfig{MaxSize: "1MiB", TTL: "1m"},
+	}}
+	task := func(alloc string) *httpHost {
+		cfg := &drivers.TaskConfig{AllocID: alloc, JobName: "job", Name: "task", AllocDir: t.TempDir()}
+		hosts, err := d.newHostModules(cfg, driverConfig)
+		require.NoError(t, err)
+		require.Len(t, hosts, 1)
+		return hosts[0].(*httpHost)
+	}
+
+	// the allocations of a job share the cache
+	first, second := task("a"), task("b")
+	for _, host := range []*httpHost{first, second, first} {
+		errno, status, body := httpGet(t, host, srv.URL+"/shared")
+		require.Equal(t, httpSuccess, errno)
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "response /shared", body)
+	}
+	require.EqualValues(t, 1, atomic.LoadInt32(&requests))
+
+	for i := 0; i < 2; i++ {
+		_, _, body := httpGet(t, first, srv.URL+"/private")
+		require.Equal(t, "response /private", body)
+	}
+	require.EqualValues(t, 3, atomic.LoadInt32(&requests))
+
+	// dropped with its last task
+	first.Close()
+	require.Len(t, d.httpCaches.caches, 1)
+	second.Close()
+	require.Empty(t, d.httpCaches.caches)
+
+	driverConfig.HTTP.Cache.TTL = "forever"
+	_, err := d.newHostModules(&drivers.TaskConfig{AllocDir: t.TempDir()}, driverConfig)
+	require.Error(t, err)
+}
+
+func TestHTTPCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cache := newHTTPCache(64, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	request := func(path string, header ...string) *http.Request {
+		req := &http.Request{Method: http.MethodGet, URL: &url.URL{Scheme: "http", Host: "h", Path: path}, Header: http.Header{}}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		return req
+	}
+	response := func(header ...string) *http.Response {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+		for i := 0; i+1 < len(header); i += 2 {
+			resp.Header.Set(header[i], header[i+1])
+		}
+		return resp
+	}
+
+	require.True(t, cacheableRequest(request("/")))
+	require.False(t, cacheableRequest(request("/", "Authorization", "Bearer x")))
+	require.False(t, cacheableRequest(request("/", "Cache-Control", "no-cache")))
+
+	ttl, ok := cache.responseTTL(response())
+	require.True(t, ok)
+	require.Equal(t, time.Minute, ttl)
+	ttl, ok = cache.responseTTL(response("Cache-Control", "public, max-age=10"))
+	require.True(t, ok)
+	require.Equal(t, 10*time.Second, ttl)
+	for _, header := range [][]string{
+		{"Cache-Control", "no-store"},
+		{"Set-Cookie", "a=b"},
+		{"Vary", "*"},
+	} {
+		_, ok := cache.responseTTL(response(header...))
+		require.False(t, ok, header)
+	}
+
+	// expired
+	cache.put(request("/a"), response(), []byte("a"), time.Second)
+	_, ok = cache.get(request("/a"))
+	require.True(t, ok)
+	now = now.Add(time.Second)
+	_, ok = cache.get(request("/a"))
+	require.False(t, ok)
+
+	// varied
+	cache.put(request("/v", "Accept", "text/plain"), response("Vary", "Accept"), []byte("v"), time.Minute)
+	_, ok = cache.get(request("/v", "Accept", "application/json"))
+	require.False(t, ok)
+	resp, ok := cache.get(request("/v", "Accept", "text/plain"))
+	require.True(t, ok)
+	require.Equal(t, int64(1), resp.ContentLength)
+
+	// the least recently used are evicted beyond the size
+	cache.put(request("/b"), response(), []byte(strings.Repeat("b", 40)), time.Minute)
+	cache.put(request("/c"), response(), []byte(strings.Repeat("c", 40)), time.Minute)
+	_, ok = cache.get(request("/b"))
+	require.False(t, ok)
+	_, ok = cache.get(request("/c"))
+	require.True(t, ok)
+	require.LessOrEqual(t, cache.size, cache.maxSize)
+
+	cache.put(request("/big"), response(), make([]byte, 100), time.Minute)
+	_, ok = cache.get(request("/big"))
+	require.False(t, ok)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+// httpRewrite is a parsed http.rewrite rule
+type httpRewrite struct {
+	// host is the hostname, and port if set, of the requests rewritten
+	host string
+	port string
+
+	address    string
+	sni        string
+	hostHeader string
+}
+
+// parseHTTPRewrites validates the http.rewrite rules
+func parseHTTPRewrites(rules []TaskHTTPRewriteConfig) ([]httpRewrite, error) {
+	parsed := make([]httpRewrite, 0, len(rules))
+	for _, r := range rules {
+		rule := httpRewrite{
+			host:       strings.ToLower(r.Host),
+			address:    r.Address,
+			sni:        r.SNI,
+			hostHeader: r.HostHeader,
+		}
+		if host, port, err := net.SplitHostPort(r.Host); err == nil {
+			rule.host, rule.port = strings.ToLower(host), port
+		}
+		if rule.host == "" {
+			return nil, fmt.Errorf("http rewrite rule has no host")
+		}
+		if r.Address != "" {
+			if _, _, err := net.SplitHostPort(r.Address); err != nil {
+				return nil, fmt.Errorf("invalid address %q for http rewrite of %s: %v", r.Address, r.Host, err)
+			}
+		}
+		if r.Address == "" && r.SNI == "" && r.HostHeader == "" {
+			return nil, fmt.Errorf("http rewrite of %s rewrites nothing, set address, sni or host_header", r.Host)
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+// matches reports whether the rule rewrites requests to req's host
+func (r *httpRewrite) matches(req *http.Request) bool {
+	if !strings.EqualFold(req.URL.Hostname(), r.host) {
+		return false
+	}
+	if r.port == "" {
+		return true
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return port == r.port
+}
+
+// rewriteTransport sends the requests matching a rewrite rule with a
+// transport of the rule's own, connecting to its address and naming its sni
+// in TLS handshakes, and every other request with next. The guest's URL
+// still decides which hosts are allowed.
+type rewriteTransport struct {
+	next  *http.Transport
+	rules []httpRewrite
+	rule  []*http.Transport
+}
+
+// newOutboundTransport returns the transport of a guest's requests, using
+// tlsConfig, nil for the defaults, and applying rules
+func newOutboundTransport(tlsConfig *tls.Config, rules []httpRewrite) roundTripCloser {
+	next := cleanhttp.DefaultPooledTransport()
+	next.TLSClientConfig = tlsConfig
+	if len(rules) == 0 {
+		return next
+	}
+
+	t := &rewriteTransport{next: next, rules: rules}
+	for _, r := range rules {
+		transport := cleanhttp.DefaultPooledTransport()
+		if tlsConfig != nil {
+			transport.TLSClientConfig = tlsConfig.Clone()
+		}
+		if r.sni != "" {
+			if transport.TLSClientConfig == nil {
+				transport.TLSClientConfig = &tls.Config{}
+			}
+			transport.TLSClientConfig.ServerName = r.sni
+		}
+		if address := r.address; address != "" {
+			dialer := &net.Dialer{}
+			transport.Proxy = nil
+			transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, address)
+			}
+		}
+		t.rule = append(t.rule, transport)
+	}
+	return t
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for i := range t.rules {
+		r := &t.rules[i]
+		if !r.matches(req) {
+			continue
+		}
+		if r.hostHeader != "" {
+			req = req.Clone(req.Context())
+			req.Host = r.hostHeader
+		}
+		return t.rule[i].RoundTrip(req)
+	}
+	return t.next.RoundTrip(req)
+}
+
+func (t *rewriteTransport) CloseIdleConnections() {
+	t.next.CloseIdleConnections()
+	for _, transport := range t.rule {
+		transport.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHTTPRewrites(t *testing.T) {
+	rules, err := parseHTTPRewrites([]TaskHTTPRewriteConfig{
+		{Host: "API.internal:8443", Address: "10.0.0.5:443"},
+		{Host: "api.internal", SNI: "api.prod"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []httpRewrite{
+		{host: "api.internal", port: "8443", address: "10.0.0.5:443"},
+		{host: "api.internal", sni: "api.prod"},
+	}, rules)
+
+	req := func(u string) *http.Request {
+		parsed, err := url.Parse(u)
+		require.NoError(t, err)
+		return &http.Request{URL: parsed}
+	}
+	require.True(t, rules[0].matches(req("https://api.internal:8443/")))
+	require.False(t, rules[0].matches(req("https://api.internal/")))
+	require.True(t, rules[1].matches(req("https://api.internal/")))
+	require.False(t, rules[1].matches(req("https://db.internal/")))
+
+	for _, invalid := range []TaskHTTPRewriteConfig{
+		{Address: "10.0.0.5:443"},
+		{Host: "api.internal", Address: "10.0.0.5"},
+		{Host: "api.internal"},
+	} {
+		_, err := parseHTTPRewrites([]TaskHTTPRewriteConfig{invalid})
+		require.Error(t, err, "%+v", invalid)
+	}
+}
+
+func TestHTTPHost_Rewrite(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer srv.Close()
+
+	cfg := &drivers.TaskConfig{Name: "task", AllocDir: t.TempDir()}
+	host, err := newHTTPHost(cfg, TaskHTTPConfig{
+		AllowedHosts: []string{"api.internal", "other.internal"},
+		Rewrite: []TaskHTTPRewriteConfig{
+			{Host: "api.internal", Address: srv.Listener.Addr().String()},
+			{Host: "other.internal", Address: srv.Listener.Addr().String(), HostHeader: "svc.example.com"},
+		},
+	})
+	require.NoError(t, err)
+	defer host.Close()
+
+	errno, _, body := httpGet(t, host, "http://api.internal/")
+	require.Equal(t, httpSuccess, errno)
+	require.Equal(t, "api.internal", body)
+	errno, _, body = httpGet(t, host, "http://other.internal/")
+	require.Equal(t, httpSuccess, errno)
+	require.Equal(t, "svc.example.com", body)
+}
+
+func TestHTTPHost_RewriteSNI(t *testing.T) {
+	// the test server's certificate is only valid for example.com and
+	// loopback
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.ServerName))
+	}))
+	defer srv.Close()
+
+	cfg := &drivers.TaskConfig{Name: "task", AllocDir: t.TempDir()}
+	require.NoError(t, os.MkdirAll(cfg.TaskDir().SecretsDir, 0700))
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	require.NoError(t, os.WriteFile(filepath.Join(cfg.TaskDir().SecretsDir, "ca.crt"), ca, 0600))
+	writeClientCert(t, cfg, "client", time.Now())
+
+	config := TaskHTTPConfig{
+		AllowedHosts: []string{"api.internal"},
+		ClientCert: &TaskHTTPClientCertConfig{
+			CertFile: "secrets/client.crt",
+			KeyFile:  "secrets/client.key",
+			CAFile:   "secrets/ca.crt",
+		},
+		Rewrite: []TaskHTTPRewriteConfig{{Host: "api.internal", Address: srv.Listener.Addr().String()}},
+	}
+	host, err := newHTTPHost(cfg, config)
+	require.NoError(t, err)
+	errno, _, _ := httpGet(t, host, "https://api.internal/")
+	require.Equal(t, httpIOError, errno, "the certificate isn't valid for api.internal")
+	host.Close()
+
+	config.Rewrite[0].SNI = "example.com"
+	host, err = newHTTPHost(cfg, config)
+	require.NoError(t, err)
+	defer host.Close()
+	errno, _, body := httpGet(t, host, "https://api.internal/")
+	require.Equal(t, httpSuccess, errno)
+	require.Equal(t, "example.com", body)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+const httpWat = `
+(module
+  (import "wasi_ephemeral_http" "request"
+    (func $request (param i32 i32 i32 i32 i32 i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_http" "status" (func $status (param i32 i32) (result i32)))
+  (import "wasi_ephemeral_http" "body_read" (func $body_read (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_http" "close" (func $close (param i32) (result i32)))
+
+  (memory (export "memory") 1)
+  (data (i32.const 0) "GET")
+  (data (i32.const 16) "X-Test: yes\n")
+
+  ;; requests the URL of length $len at 256, storing the handle at 100
+  (func (export "request") (param $len i32) (result i32)
+    (call $request (i32.const 0) (i32.const 3) (i32.const 256) (local.get $len)
+      (i32.const 16) (i32.const 12) (i32.const 0) (i32.const 0) (i32.const 100)))
+  ;; stores the status at 104
+  (func (export "status") (param $h i32) (result i32)
+    (call $status (local.get $h) (i32.const 104)))
+  ;; reads the body into [1024, 1536), with its length at 108
+  (func (export "body") (param $h i32) (result i32)
+    (call $body_read (local.get $h) (i32.const 1024) (i32.const 512) (i32.const 108)))
+  (func (export "close") (param $h i32) (result i32)
+    (call $close (local.get $h)))
+)`
+
+// httpGet makes the guest request url and returns the status and body
+func httpGet(t *testing.T, host *httpHost, url string) (httpErrno, int, string) {
+	store, instance := instantiate(t, httpWat, host)
+	copy(memory(store, instance)[256:], url)
+
+	if errno := httpErrno(call(t, store, instance, "request", int32(len(url)))); errno != httpSuccess {
+		return errno, 0, ""
+	}
+	handle := int32(binary.LittleEndian.Uint32(memory(store, instance)[100:]))
+	defer func() {
+		require.EqualValues(t, httpSuccess, call(t, store, instance, "close", handle))
+	}()
+
+	require.EqualValues(t, httpSuccess, call(t, store, instance, "status", handle))
+	status := int(binary.LittleEndian.Uint32(memory(store, instance)[104:]))
+	require.EqualValues(t, httpSuccess, call(t, store, instance, "body", handle))
+	mem := memory(store, instance)
+	return httpSuccess, status, string(mem[1024 : 1024+binary.LittleEndian.Uint32(mem[108:])])
+}
+
+func TestHTTPHost(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://denied.example.com/", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("header " + r.Header.Get("X-Test")))
+	}))
+	defer srv.Close()
+
+	cfg := &drivers.TaskConfig{Name: "task", AllocDir: t.TempDir()}
+	host, err := newHTTPHost(cfg, TaskHTTPConfig{AllowedHosts: []string{"127.0.0.1"}})
+	require.NoError(t, err)
+	defer host.Close()
+
+	errno, status, body := httpGet(t, host, srv.URL+"/")
+	require.Equal(t, httpSuccess, errno)
+	require.Equal(t, http.StatusTeapot, status)
+	require.Equal(t, "header yes", body)
+
+	errno, _, _ = httpGet(t, host, "http://example.com/")
+	require.Equal(t, httpDenied, errno)
+	errno, _, _ = httpGet(t, host, srv.URL+"/redirect")
+	require.Equal(t, httpDenied, errno, "redirects must stay within the allowed hosts")
+	errno, _, _ = httpGet(t, host, "http://"+taskAPIHost+"/v1/")
+	require.Equal(t, httpDenied, errno, "the task API must be enabled")
+	errno, _, _ = httpGet(t, host, "ftp://127.0.0.1/")
+	require.Equal(t, httpInvalidRequest, errno)
+}
+
+func TestHTTPHost_Allowed(t *testing.T) {
+	host := &httpHost{allowedHosts: newHostAllowlist([]string{"api.example.com", "*.internal"})}
+	require.True(t, host.allowed("api.example.com"))
+	require.True(t, host.allowed("API.example.com"))
+	require.True(t, host.allowed("db.internal"))
+	require.False(t, host.allowed("internal"))
+	require.False(t, host.allowed("example.com"))
+	require.False(t, host.allowed(taskAPIHost))
+}
+
+func TestHTTPHost_TaskAPI(t *testing.T) {
+	// unix socket paths are limited in length
+	allocDir, err := os.MkdirTemp("", "api")
+	require.NoError(t, err)
+	defer os.RemoveAll(allocDir)
+
+	cfg := &drivers.TaskConfig{
+		Name:     "t",
+		AllocDir: allocDir,
+		Env:      map[string]string{identityEnvVar: "jwt"},
+	}
+	require.NoError(t, os.MkdirAll(cfg.TaskDir().SecretsDir, 0700))
+	l, err := net.Listen("unix", filepath.Join(cfg.TaskDir().SecretsDir, taskAPISocket))
+	require.NoError(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path + " " + r.Header.Get("Authorization")))
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	host, err := newHTTPHost(cfg, TaskHTTPConfig{TaskAPI: true})
+	require.NoError(t, err)
+	defer host.Close()
+
+	errno, status, body := httpGet(t, host, "http://"+taskAPIHost+"/v1/agent/health")
+	require.Equal(t, httpSuccess, errno)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "/v1/agent/health Bearer jwt", body)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// clientTLS holds the client certificate and roots of http.client_cert. The
+// files are reloaded when their modification time changes, so certificates
+// rotated by a template are used on new connections without restarting the
+// task. A failed reload, such as a certificate rendered before its key,
+// keeps the previous files until the next connection.
+type clientTLS struct {
+	certFile, keyFile, caFile string
+
+	lock      sync.Mutex
+	cert      *tls.Certificate
+	certTime  time.Time
+	roots     *x509.CertPool
+	rootsTime time.Time
+}
+
+// newClientTLS loads the files of cfg, relative to taskDir
+func newClientTLS(taskDir string, cfg TaskHTTPClientCertConfig) (*clientTLS, error) {
+	c := &clientTLS{
+		certFile: resolveArtifactPath(taskDir, cfg.CertFile),
+		keyFile:  resolveArtifactPath(taskDir, cfg.KeyFile),
+	}
+	if cfg.CAFile != "" {
+		c.caFile = resolveArtifactPath(taskDir, cfg.CAFile)
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// latestModTime returns the latest modification time of paths
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload reads the files changed since they were last loaded
+func (c *clientTLS) reload() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	err := c.reloadCert()
+	if c.caFile != "" {
+		// the roots don't wait for a certificate mid-rotation
+		if rootsErr := c.reloadRoots(); err == nil {
+			err = rootsErr
+		}
+	}
+	return err
+}
+
+func (c *clientTLS) reloadCert() error {
+	modTime, err := latestModTime(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read client certificate: %v", err)
+	}
+	if c.cert != nil && modTime.Equal(c.certTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate: %v", err)
+	}
+	c.cert, c.certTime = &cert, modTime
+	return nil
+}
+
+func (c *clientTLS) reloadRoots() error {
+	modTime, err := latestModTime(c.caFile)
+	if err != nil {
+		return fmt.Errorf("failed to read ca_file: %v", err)
+	}
+	if c.roots != nil && modTime.Equal(c.rootsTime) {
+		return nil
+	}
+	pem, err := ioutil.ReadFile(c.caFile)
+	if err != nil {
+		return fmt.Errorf("failed to read ca_file: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in ca_file %q", c.caFile)
+	}
+	c.roots, c.rootsTime = roots, modTime
+	return nil
+}
+
+func (c *clientTLS) certificate() *tls.Certificate {
+	c.reload()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.cert
+}
+
+func (c *clientTLS) rootCAs() *x509.CertPool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.roots
+}
+
+// config returns the TLS config of outbound connections verifying servers
+// against roots, nil for the system roots
+func (c *clientTLS) config(roots *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    roots,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return c.certificate(), nil
+		},
+	}
+}
+
+// clientTLSTransport presents the client certificate of tls. The roots of a
+// transport's TLS config can't change once it's used, so it is replaced by
+// one verifying against the new roots when ca_file changes.
+type clientTLSTransport struct {
+	tls   *clientTLS
+	rules []httpRewrite
+
+	lock      sync.Mutex
+	roots     *x509.CertPool
+	transport roundTripCloser
+}
+
+func newClientTLSTransport(c *clientTLS, rules []httpRewrite) *clientTLSTransport {
+	t := &clientTLSTransport{tls: c, rules: rules, roots: c.rootCAs()}
+	t.transport = newOutboundTransport(c.config(t.roots), rules)
+	return t
+}
+
+func (t *clientTLSTransport) current() roundTripCloser {
+	t.tls.reload()
+	roots := t.tls.rootCAs()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if roots != t.roots {
+		t.transport.CloseIdleConnections()
+		t.roots = roots
+		t.transport = newOutboundTransport(t.tls.config(roots), t.rules)
+	}
+	return t.transport
+}
+
+func (t *clientTLSTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.current().RoundTrip(req)
+}
+
+func (t *clientTLSTransport) CloseIdleConnections() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.transport.CloseIdleConnections()
+}
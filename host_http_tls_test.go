@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+// writeClientCert writes a self-signed client certificate for name to the
+// task's secrets dir, dated modTime
+func writeClientCert(t *testing.T, cfg *drivers.TaskConfig, name string, modTime time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := cfg.TaskDir().SecretsDir
+	for file, block := range map[string]*pem.Block{
+		"client.crt": {Type: "CERTIFICATE", Bytes: der},
+		"client.key": {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		path := filepath.Join(dir, file)
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0600))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+}
+
+func TestHTTPHost_ClientCert(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// every request opens a new connection, presenting the current cert
+		w.Header().Set("Connection", "close")
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	cfg := &drivers.TaskConfig{Name: "task", AllocDir: t.TempDir()}
+	require.NoError(t, os.MkdirAll(cfg.TaskDir().SecretsDir, 0700))
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	require.NoError(t, os.WriteFile(filepath.Join(cfg.TaskDir().SecretsDir, "ca.crt"), ca, 0600))
+	writeClientCert(t, cfg, "first", time.Now().Add(-time.Minute))
+
+	config := TaskHTTPConfig{
+		AllowedHosts: []string{"127.0.0.1"},
+		ClientCert: &TaskHTTPClientCertConfig{
+			CertFile: "secrets/client.crt",
+			KeyFile:  "secrets/client.key",
+			CAFile:   "secrets/ca.crt",
+		},
+	}
+	host, err := newHTTPHost(cfg, config)
+	require.NoError(t, err)
+	defer host.Close()
+
+	errno, _, body := httpGet(t, host, srv.URL+"/")
+	require.Equal(t, httpSuccess, errno)
+	require.Equal(t, "first", body)
+
+	// rotated by a template
+	writeClientCert(t, cfg, "second", time.Now())
+	errno, _, body = httpGet(t, host, srv.URL+"/")
+	require.Equal(t, httpSuccess, errno)
+	require.Equal(t, "second", body)
+
+	// a key that doesn't match keeps the previous certificate
+	require.NoError(t, os.WriteFile(filepath.Join(cfg.TaskDir().SecretsDir, "client.key"), []byte("partial"), 0600))
+	errno, _, body = httpGet(t, host, srv.URL+"/")
+	require.Equal(t, httpSuccess, errno)
+	require.Equal(t, "second", body)
+
+	// servers must chain to the reloaded ca_file
+	caFile := filepath.Join(cfg.TaskDir().SecretsDir, "ca.crt")
+	crt, err := os.ReadFile(filepath.Join(cfg.TaskDir().SecretsDir, "client.crt"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(caFile, crt, 0600))
+	require.NoError(t, os.Chtimes(caFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+	errno, _, _ = httpGet(t, host, srv.URL+"/")
+	require.Equal(t, httpIOError, errno)
+
+	config.ClientCert.CertFile = "secrets/missing.crt"
+	_, err = newHTTPHost(cfg, config)
+	require.Error(t, err)
+}
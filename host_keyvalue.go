@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+// keyvalueErrno is the error code returned by keyvalue functions
+type keyvalueErrno int32
+
+const (
+	keyvalueSuccess    keyvalueErrno = 0
+	keyvalueGuestError keyvalueErrno = 1
+	keyvalueNotFound   keyvalueErrno = 2
+	keyvalueOverflow   keyvalueErrno = 3
+	keyvalueInvalidKey keyvalueErrno = 4
+	keyvalueIOError    keyvalueErrno = 5
+)
+
+const (
+	// keyvalueModule is the import namespace of the keyvalue functions
+	keyvalueModule = "wasi_ephemeral_keyvalue"
+
+	// keyvalueTimeout bounds every request made on behalf of a guest
+	keyvalueTimeout = 30 * time.Second
+)
+
+// keyvalueHost gives a guest access to the keys under its task's prefix of
+// a shared kvBackend. As with the blobstore, the wasi-keyvalue interfaces
+// are offered as plain functions:
+//
+//	get(key_ptr, key_len, buf_ptr, buf_len, n_ptr) -> errno
+//	set(key_ptr, key_len, value_ptr, value_len) -> errno
+//	delete(key_ptr, key_len) -> errno
+//	exists(key_ptr, key_len, result_ptr) -> errno
+//	keys(prefix_ptr, prefix_len, buf_ptr, buf_len, n_ptr) -> errno
+//
+// get and keys return overflow with the required length at n_ptr if the
+// buffer is too small; keys are separated by newlines. exists stores a u8
+// which is 1 if the key exists.
+type keyvalueHost struct {
+	backend kvBackend
+	prefix  string
+	release func()
+
+	// ctx is cancelled when the task is destroyed, aborting requests in
+	// flight
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newKeyvalueHost returns the keyvalue host of a task using backend, which
+// is shared with other tasks and used until release is called
+func newKeyvalueHost(backend kvBackend, prefix string, release func()) *keyvalueHost {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &keyvalueHost{
+		backend: backend,
+		prefix:  prefix,
+		release: release,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Close doesn't close the backend, which is shared with other tasks, but
+// releases it
+func (h *keyvalueHost) Close() error {
+	h.cancel()
+	h.release()
+	return nil
+}
+
+func (h *keyvalueHost) Define(linker *wasmtime.Linker) error {
+	funcs := map[string]interface{}{
+		"get":    h.get,
+		"set":    h.set,
+		"delete": h.delete,
+		"exists": h.exists,
+		"keys":   h.keys,
+	}
+	for name, f := range funcs {
+		if err := linker.FuncWrap(keyvalueModule, name, f); err != nil {
+			return fmt.Errorf("failed to define %s.%s: %v", keyvalueModule, name, err)
+		}
+	}
+	return nil
+}
+
+// keyvalueFunc adapts the body of a keyvalue function so it can report
+// errnos, with guest memory errors mapped to guest_error.
+func keyvalueFunc(caller *wasmtime.Caller, f func(mem *guestMemory) keyvalueErrno) int32 {
+	mem, err := newGuestMemory(caller)
+	if err != nil {
+		return int32(keyvalueGuestError)
+	}
+	return int32(f(mem))
+}
+
+// key reads a key from the guest and returns it with the task prefix
+func (h *keyvalueHost) key(mem *guestMemory, ptr, size int32) (string, keyvalueErrno) {
+	key, err := mem.readString(ptr, size)
+	if err != nil {
+		return "", keyvalueGuestError
+	}
+	if key == "" || !validRelativeKey(key) {
+		return "", keyvalueInvalidKey
+	}
+	return h.prefix + key, keyvalueSuccess
+}
+
+// errno maps a backend error onto a keyvalueErrno
+func (h *keyvalueHost) errno(err error) keyvalueErrno {
+	switch {
+	case err == nil:
+		return keyvalueSuccess
+	case errors.Is(err, errKVNotFound):
+		return keyvalueNotFound
+	}
+	return keyvalueIOError
+}
+
+func (h *keyvalueHost) output(mem *guestMemory, bufPtr, bufLen, nPtr int32, data []byte) keyvalueErrno {
+	ok, err := mem.writeBuffer(bufPtr, bufLen, nPtr, data)
+	switch {
+	case err != nil:
+		return keyvalueGuestError
+	case !ok:
+		return keyvalueOverflow
+	}
+	return keyvalueSuccess
+}
+
+func (h *keyvalueHost) get(caller *wasmtime.Caller, keyPtr, keyLen, bufPtr, bufLen, nPtr int32) int32 {
+	return keyvalueFunc(caller, func(mem *guestMemory) keyvalueErrno {
+		key, errno := h.key(mem, keyPtr, keyLen)
+		if errno != keyvalueSuccess {
+			return errno
+		}
+
+		ctx, cancel := context.WithTimeout(h.ctx, keyvalueTimeout)
+		defer cancel()
+		value, err := h.backend.Get(ctx, key)
+		if err != nil {
+			return h.errno(err)
+		}
+		return h.output(mem, bufPtr, bufLen, nPtr, value)
+	})
+}
+
+func (h *keyvalueHost) set(caller *wasmtime.Caller, keyPtr, keyLen, valuePtr, valueLen int32) int32 {
+	return keyvalueFunc(caller, func(mem *guestMemory) keyvalueErrno {
+		key, errno := h.key(mem, keyPtr, keyLen)
+		if errno != keyvalueSuccess {
+			return errno
+		}
+		value, err := mem.read(valuePtr, valueLen)
+		if err != nil {
+			return keyvalueGuestError
+		}
+
+		ctx, cancel := context.WithTimeout(h.ctx, keyvalueTimeout)
+		defer cancel()
+		return h.errno(h.backend.Set(ctx, key, value))
+	})
+}
+
+func (h *keyvalueHost) delete(caller *wasmtime.Caller, keyPtr, keyLen int32) int32 {
+	return keyvalueFunc(caller, func(mem *guestMemory) keyvalueErrno {
+		key, errno := h.key(mem, keyPtr, keyLen)
+		if errno != keyvalueSuccess {
+			return errno
+		}
+
+		ctx, cancel := context.WithTimeout(h.ctx, keyvalueTimeout)
+		defer cancel()
+		return h.errno(h.backend.Delete(ctx, key))
+	})
+}
+
+func (h *keyvalueHost) exists(caller *wasmtime.Caller, keyPtr, keyLen, resultPtr int32) int32 {
+	return keyvalueFunc(caller, func(mem *guestMemory) keyvalueErrno {
+		key, errno := h.key(mem, keyPtr, keyLen)
+		if errno != keyvalueSuccess {
+			return errno
+		}
+
+		ctx, cancel := context.WithTimeout(h.ctx, keyvalueTimeout)
+		defer cancel()
+		var exists byte = 1
+		if _, err := h.backend.Get(ctx, key); errors.Is(err, errKVNotFound) {
+			exists = 0
+		} else if err != nil {
+			return h.errno(err)
+		}
+
+		if err := mem.write(resultPtr, []byte{exists}); err != nil {
+			return keyvalueGuestError
+		}
+		return keyvalueSuccess
+	})
+}
+
+func (h *keyvalueHost) keys(caller *wasmtime.Caller, prefixPtr, prefixLen, bufPtr, bufLen, nPtr int32) int32 {
+	return keyvalueFunc(caller, func(mem *guestMemory) keyvalueErrno {
+		// unlike keys, the listing prefix may be empty
+		prefix, err := mem.readString(prefixPtr, prefixLen)
+		if err != nil {
+			return keyvalueGuestError
+		}
+		if !validRelativeKey(prefix) {
+			return keyvalueInvalidKey
+		}
+
+		ctx, cancel := context.WithTimeout(h.ctx, keyvalueTimeout)
+		defer cancel()
+		keys, err := h.backend.Keys(ctx, h.prefix+prefix)
+		if err != nil {
+			return h.errno(err)
+		}
+		for i, k := range keys {
+			keys[i] = strings.TrimPrefix(k, h.prefix)
+		}
+		sort.Strings(keys)
+		return h.output(mem, bufPtr, bufLen, nPtr, []byte(strings.Join(keys, "\n")))
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+const keyvalueWat = `
+(module
+  (import "wasi_ephemeral_keyvalue" "get"
+    (func $get (param i32 i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_keyvalue" "set"
+    (func $set (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_keyvalue" "delete"
+    (func $delete (param i32 i32) (result i32)))
+  (import "wasi_ephemeral_keyvalue" "exists"
+    (func $exists (param i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_keyvalue" "keys"
+    (func $keys (param i32 i32 i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+  (data (i32.const 0) "config/mode")
+  (data (i32.const 16) "active")
+  (data (i32.const 32) "../other/task/x")
+
+  (func (export "set") (result i32)
+    (call $set (i32.const 0) (i32.const 11) (i32.const 16) (i32.const 6)))
+  ;; reads the value into [256, ...), with its length at 100
+  (func (export "get") (param $len i32) (result i32)
+    (call $get (i32.const 0) (i32.const 11) (i32.const 256) (local.get $len) (i32.const 100)))
+  ;; stores whether the key exists at 104
+  (func (export "exists") (result i32)
+    (call $exists (i32.const 0) (i32.const 11) (i32.const 104)))
+  (func (export "keys") (result i32)
+    (call $keys (i32.const 0) (i32.const 0) (i32.const 512) (i32.const 64) (i32.const 100)))
+  (func (export "delete") (result i32)
+    (call $delete (i32.const 0) (i32.const 11)))
+  (func (export "escape") (result i32)
+    (call $get (i32.const 32) (i32.const 15) (i32.const 256) (i32.const 64) (i32.const 100)))
+)`
+
+func TestKeyvalueHost(t *testing.T) {
+	mr, kv := newTestRedisKV(t)
+	mr.Set("default/other/group/task/secret", "not yours")
+
+	d := &Driver{
+		config:     &Config{},
+		kvBackends: map[string]kvBackend{kvBackendRedis: kv},
+	}
+	cfg := &drivers.TaskConfig{Namespace: "default", JobName: "example", TaskGroupName: "group", Name: "task"}
+
+	_, err := d.newHostModules(cfg, &TaskConfig{KeyValue: TaskKeyValueConfig{Backend: kvBackendConsul}})
+	require.Error(t, err, "consul isn't configured")
+
+	hosts, err := d.newHostModules(cfg, &TaskConfig{KeyValue: TaskKeyValueConfig{Backend: kvBackendRedis}})
+	require.NoError(t, err)
+	require.Len(t, hosts, 1)
+	defer closeHostModules(hosts)
+	store, instance := instantiate(t, keyvalueWat, hosts...)
+
+	require.EqualValues(t, keyvalueNotFound, call(t, store, instance, "get", int32(64)))
+	require.EqualValues(t, keyvalueSuccess, call(t, store, instance, "set"))
+	v, err := mr.Get("default/example/group/task/config/mode")
+	require.NoError(t, err)
+	require.Equal(t, "active", v)
+
+	require.EqualValues(t, keyvalueOverflow, call(t, store, instance, "get", int32(2)))
+	require.EqualValues(t, keyvalueSuccess, call(t, store, instance, "get", int32(64)))
+	mem := memory(store, instance)
+	require.EqualValues(t, 6, binary.LittleEndian.Uint32(mem[100:]))
+	require.Equal(t, "active", string(mem[256:262]))
+
+	require.EqualValues(t, keyvalueSuccess, call(t, store, instance, "exists"))
+	require.EqualValues(t, 1, memory(store, instance)[104])
+
+	require.EqualValues(t, keyvalueSuccess, call(t, store, instance, "keys"))
+	mem = memory(store, instance)
+	require.Equal(t, "config/mode", string(mem[512:512+binary.LittleEndian.Uint32(mem[100:])]))
+
+	require.EqualValues(t, keyvalueInvalidKey, call(t, store, instance, "escape"))
+
+	require.EqualValues(t, keyvalueSuccess, call(t, store, instance, "delete"))
+	require.EqualValues(t, keyvalueSuccess, call(t, store, instance, "exists"))
+	require.EqualValues(t, 0, memory(store, instance)[104])
+}
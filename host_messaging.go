@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/nats-io/nats.go"
+)
+
+// messagingErrno is the error code returned by messaging functions
+type messagingErrno int32
+
+const (
+	messagingSuccess        messagingErrno = 0
+	messagingGuestError     messagingErrno = 1
+	messagingInvalidSubject messagingErrno = 2
+	messagingTimeout        messagingErrno = 3
+	messagingOverflow       messagingErrno = 4
+	messagingInvalidHandle  messagingErrno = 5
+	messagingTooManyHandles messagingErrno = 6
+	messagingIOError        messagingErrno = 7
+)
+
+const (
+	// messagingModule is the import namespace of the messaging functions
+	messagingModule = "wasi_ephemeral_messaging"
+
+	// maxMessagingHandles bounds the subscriptions and received messages a
+	// guest may hold open
+	maxMessagingHandles = 1024
+)
+
+// messagingPrefix returns the subject namespace a task is confined to. Each
+// part of the task's identity becomes a single subject token.
+func messagingPrefix(cfg *drivers.TaskConfig) string {
+	tokens := []string{cfg.Namespace, cfg.JobName, cfg.TaskGroupName, cfg.Name}
+	for i, t := range tokens {
+		tokens[i] = strings.Map(func(r rune) rune {
+			switch r {
+			case '.', '*', '>', ' ', '\t', '\r', '\n':
+				return '_'
+			}
+			return r
+		}, t)
+	}
+	return strings.Join(tokens, ".") + "."
+}
+
+// messagingHost gives a guest publish/subscribe access to NATS. As with the
+// blobstore, the wasi-messaging interfaces are offered as plain functions,
+// with subjects relative to the task's namespace:
+//
+//	publish(subject_ptr, subject_len, data_ptr, data_len) -> errno
+//	subscribe(subject_ptr, subject_len, sub_ptr) -> errno
+//	unsubscribe(sub) -> errno
+//	receive(sub, timeout_ms: i64, msg_ptr) -> errno
+//	message_subject(msg, buf_ptr, buf_len, n_ptr) -> errno
+//	message_data(msg, buf_ptr, buf_len, n_ptr) -> errno
+//	message_close(msg) -> errno
+//
+// Subscriptions may use wildcards. receive blocks for up to timeout_ms, or
+// until a message arrives if it is negative, and returns a message handle.
+// message_subject and message_data return overflow with the required length
+// at n_ptr if the buffer is too small.
+type messagingHost struct {
+	conn   *nats.Conn
+	prefix string
+
+	handles *handleTable
+
+	// ctx is cancelled when the task is destroyed, unblocking receives
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newMessagingHost connects to NATS on behalf of the task described by cfg.
+func newMessagingHost(config MessagingConfig, cfg *drivers.TaskConfig) (*messagingHost, error) {
+	opts := []nats.Option{
+		nats.Name("nomad-task-" + cfg.ID),
+		// tasks can run for a long time, so never give up reconnecting
+		nats.MaxReconnects(-1),
+	}
+	if config.CredentialsFile != "" {
+		opts = append(opts, nats.UserCredentials(config.CredentialsFile))
+	}
+	if config.Token != "" {
+		opts = append(opts, nats.Token(config.Token))
+	}
+	if config.Username != "" {
+		opts = append(opts, nats.UserInfo(config.Username, config.Password))
+	}
+
+	conn, err := nats.Connect(strings.Join(config.Servers, ","), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &messagingHost{
+		conn:    conn,
+		prefix:  messagingPrefix(cfg),
+		handles: newHandleTable(maxMessagingHandles),
+		ctx:     ctx,
+		cancel:  cancel,
+	}, nil
+}
+
+func (h *messagingHost) Close() error {
+	h.cancel()
+	h.handles.clear()
+	h.conn.Close()
+	return nil
+}
+
+func (h *messagingHost) Define(linker *wasmtime.Linker) error {
+	funcs := map[string]interface{}{
+		"publish":         h.publish,
+		"subscribe":       h.subscribe,
+		"unsubscribe":     h.unsubscribe,
+		"receive":         h.receive,
+		"message_subject": h.messageSubject,
+		"message_data":    h.messageData,
+		"message_close":   h.messageClose,
+	}
+	for name, f := range funcs {
+		if err := linker.FuncWrap(messagingModule, name, f); err != nil {
+			return fmt.Errorf("failed to define %s.%s: %v", messagingModule, name, err)
+		}
+	}
+	return nil
+}
+
+// messagingFunc adapts the body of a messaging function so it can report
+// errnos, with guest memory errors mapped to guest_error.
+func messagingFunc(caller *wasmtime.Caller, f func(mem *guestMemory) messagingErrno) int32 {
+	mem, err := newGuestMemory(caller)
+	if err != nil {
+		return int32(messagingGuestError)
+	}
+	return int32(f(mem))
+}
+
+// subject reads a subject from the guest and returns it within the task's
+// namespace. Wildcards are only accepted if wildcards is set.
+func (h *messagingHost) subject(mem *guestMemory, ptr, size int32, wildcards bool) (string, messagingErrno) {
+	subject, err := mem.readString(ptr, size)
+	if err != nil {
+		return "", messagingGuestError
+	}
+	if strings.ContainsAny(subject, " \t\r\n") {
+		return "", messagingInvalidSubject
+	}
+	for _, t := range strings.Split(subject, ".") {
+		if t == "" || (!wildcards && (t == "*" || t == ">")) {
+			return "", messagingInvalidSubject
+		}
+	}
+	return h.prefix + subject, messagingSuccess
+}
+
+func (h *messagingHost) insert(mem *guestMemory, resultPtr int32, v interface{}) messagingErrno {
+	handle, ok := h.handles.insert(v)
+	if !ok {
+		return messagingTooManyHandles
+	}
+	if err := mem.writeUint32(resultPtr, handle); err != nil {
+		h.handles.remove(handle)
+		return messagingGuestError
+	}
+	return messagingSuccess
+}
+
+func (h *messagingHost) subscription(handle int32) (*nats.Subscription, bool) {
+	v, ok := h.handles.get(uint32(handle))
+	if !ok {
+		return nil, false
+	}
+	sub, ok := v.(*nats.Subscription)
+	return sub, ok
+}
+
+func (h *messagingHost) message(handle int32) (*nats.Msg, bool) {
+	v, ok := h.handles.get(uint32(handle))
+	if !ok {
+		return nil, false
+	}
+	msg, ok := v.(*nats.Msg)
+	return msg, ok
+}
+
+func (h *messagingHost) publish(caller *wasmtime.Caller, subjectPtr, subjectLen, dataPtr, dataLen int32) int32 {
+	return messagingFunc(caller, func(mem *guestMemory) messagingErrno {
+		subject, errno := h.subject(mem, subjectPtr, subjectLen, false)
+		if errno != messagingSuccess {
+			return errno
+		}
+		data, err := mem.read(dataPtr, dataLen)
+		if err != nil {
+			return messagingGuestError
+		}
+		if err := h.conn.Publish(subject, data); err != nil {
+			return messagingIOError
+		}
+		return messagingSuccess
+	})
+}
+
+func (h *messagingHost) subscribe(caller *wasmtime.Caller, subjectPtr, subjectLen, subPtr int32) int32 {
+	return messagingFunc(caller, func(mem *guestMemory) messagingErrno {
+		subject, errno := h.subject(mem, subjectPtr, subjectLen, true)
+		if errno != messagingSuccess {
+			return errno
+		}
+		sub, err := h.conn.SubscribeSync(subject)
+		if err != nil {
+			return messagingIOError
+		}
+		// make sure the server has registered the subscription before the
+		// guest goes on to publish anything it expects to receive
+		if err := h.conn.Flush(); err != nil {
+			sub.Unsubscribe()
+			return messagingIOError
+		}
+		if errno := h.insert(mem, subPtr, sub); errno != messagingSuccess {
+			sub.Unsubscribe()
+			return errno
+		}
+		return messagingSuccess
+	})
+}
+
+func (h *messagingHost) unsubscribe(caller *wasmtime.Caller, handle int32) int32 {
+	sub, ok := h.subscription(handle)
+	if !ok {
+		return int32(messagingInvalidHandle)
+	}
+	h.handles.remove(uint32(handle))
+	if err := sub.Unsubscribe(); err != nil {
+		return int32(messagingIOError)
+	}
+	return int32(messagingSuccess)
+}
+
+func (h *messagingHost) receive(caller *wasmtime.Caller, handle int32, timeoutMs int64, msgPtr int32) int32 {
+	return messagingFunc(caller, func(mem *guestMemory) messagingErrno {
+		sub, ok := h.subscription(handle)
+		if !ok {
+			return messagingInvalidHandle
+		}
+
+		ctx, cancel := h.ctx, context.CancelFunc(func() {})
+		if timeoutMs >= 0 {
+			ctx, cancel = context.WithTimeout(h.ctx, time.Duration(timeoutMs)*time.Millisecond)
+		}
+		defer cancel()
+
+		msg, err := sub.NextMsgWithContext(ctx)
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			return messagingTimeout
+		case err != nil:
+			return messagingIOError
+		}
+		return h.insert(mem, msgPtr, msg)
+	})
+}
+
+func (h *messagingHost) messageSubject(caller *wasmtime.Caller, handle, bufPtr, bufLen, nPtr int32) int32 {
+	return messagingFunc(caller, func(mem *guestMemory) messagingErrno {
+		msg, ok := h.message(handle)
+		if !ok {
+			return messagingInvalidHandle
+		}
+		return h.output(mem, bufPtr, bufLen, nPtr, []byte(strings.TrimPrefix(msg.Subject, h.prefix)))
+	})
+}
+
+func (h *messagingHost) messageData(caller *wasmtime.Caller, handle, bufPtr, bufLen, nPtr int32) int32 {
+	return messagingFunc(caller, func(mem *guestMemory) messagingErrno {
+		msg, ok := h.message(handle)
+		if !ok {
+			return messagingInvalidHandle
+		}
+		return h.output(mem, bufPtr, bufLen, nPtr, msg.Data)
+	})
+}
+
+func (h *messagingHost) output(mem *guestMemory, bufPtr, bufLen, nPtr int32, data []byte) messagingErrno {
+	ok, err := mem.writeBuffer(bufPtr, bufLen, nPtr, data)
+	switch {
+	case err != nil:
+		return messagingGuestError
+	case !ok:
+		return messagingOverflow
+	}
+	return messagingSuccess
+}
+
+func (h *messagingHost) messageClose(caller *wasmtime.Caller, handle int32) int32 {
+	if _, ok := h.message(handle); !ok {
+		return int32(messagingInvalidHandle)
+	}
+	h.handles.remove(uint32(handle))
+	return int32(messagingSuccess)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNATS is a NATS server implementing just enough of the protocol for
+// publish and subscribe, and recording every published subject
+type fakeNATS struct {
+	ln net.Listener
+
+	lock      sync.Mutex
+	subs      map[string]map[net.Conn]string // subject -> conn -> sid
+	published []string
+}
+
+func newFakeNATS(t *testing.T) *fakeNATS {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	f := &fakeNATS{ln: ln, subs: map[string]map[net.Conn]string{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeNATS) url() string {
+	return "nats://" + f.ln.Addr().String()
+}
+
+func (f *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"version\":\"2.8.0\",\"proto\":1,\"max_payload\":1048576}\r\n")
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			fmt.Fprintf(conn, "PONG\r\n")
+		case "SUB":
+			f.lock.Lock()
+			if f.subs[args[1]] == nil {
+				f.subs[args[1]] = map[net.Conn]string{}
+			}
+			f.subs[args[1]][conn] = args[len(args)-1]
+			f.lock.Unlock()
+		case "PUB":
+			var size int
+			fmt.Sscan(args[len(args)-1], &size)
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			f.publish(args[1], payload[:size])
+		}
+	}
+}
+
+func (f *fakeNATS) publish(subject string, payload []byte) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.published = append(f.published, subject)
+	for pattern, conns := range f.subs {
+		if !natsMatch(pattern, subject) {
+			continue
+		}
+		for conn, sid := range conns {
+			fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", subject, sid, len(payload), payload)
+		}
+	}
+}
+
+// natsMatch reports whether subject matches pattern, which may contain the
+// * and > wildcards
+func natsMatch(pattern, subject string) bool {
+	p, s := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i, t := range p {
+		switch {
+		case t == ">":
+			return len(s) > i
+		case i >= len(s):
+			return false
+		case t != "*" && t != s[i]:
+			return false
+		}
+	}
+	return len(p) == len(s)
+}
+
+const messagingWat = `
+(module
+  (import "wasi_ephemeral_messaging" "publish"
+    (func $publish (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_messaging" "subscribe"
+    (func $subscribe (param i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_messaging" "receive"
+    (func $receive (param i32 i64 i32) (result i32)))
+  (import "wasi_ephemeral_messaging" "message_subject"
+    (func $message_subject (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_messaging" "message_data"
+    (func $message_data (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_messaging" "message_close"
+    (func $message_close (param i32) (result i32)))
+
+  (memory (export "memory") 1)
+  (data (i32.const 0) "events.*")
+  (data (i32.const 16) "events.created")
+  (data (i32.const 32) "hello")
+  (data (i32.const 48) "events.>")
+
+  (func (export "subscribe") (result i32)
+    (call $subscribe (i32.const 0) (i32.const 8) (i32.const 100)))
+  (func (export "publish") (result i32)
+    (call $publish (i32.const 16) (i32.const 14) (i32.const 32) (i32.const 5)))
+  (func (export "publish_wildcard") (result i32)
+    (call $publish (i32.const 48) (i32.const 8) (i32.const 32) (i32.const 5)))
+  (func (export "receive") (result i32)
+    (call $receive (i32.load (i32.const 100)) (i64.const 1000) (i32.const 104)))
+  ;; copies the subject to [256, ...) and the data to [512, ...), with their
+  ;; lengths at 108 and 112
+  (func (export "read") (param $len i32) (result i32)
+    (local $errno i32)
+    (if (local.tee $errno (call $message_subject (i32.load (i32.const 104)) (i32.const 256) (local.get $len) (i32.const 108)))
+      (then (return (local.get $errno))))
+    (if (local.tee $errno (call $message_data (i32.load (i32.const 104)) (i32.const 512) (local.get $len) (i32.const 112)))
+      (then (return (local.get $errno))))
+    (call $message_close (i32.load (i32.const 104))))
+)`
+
+func TestMessagingHost(t *testing.T) {
+	server := newFakeNATS(t)
+
+	cfg := &drivers.TaskConfig{
+		ID:            "task-id",
+		Namespace:     "default",
+		JobName:       "example.com",
+		TaskGroupName: "group",
+		Name:          "task",
+	}
+	require.Equal(t, "default.example_com.group.task.", messagingPrefix(cfg))
+
+	host, err := newMessagingHost(MessagingConfig{Servers: []string{server.url()}}, cfg)
+	require.NoError(t, err)
+	defer host.Close()
+	store, instance := instantiate(t, messagingWat, host)
+
+	require.EqualValues(t, messagingSuccess, call(t, store, instance, "subscribe"))
+	require.EqualValues(t, messagingInvalidSubject, call(t, store, instance, "publish_wildcard"))
+	require.EqualValues(t, messagingSuccess, call(t, store, instance, "publish"))
+
+	require.EqualValues(t, messagingSuccess, call(t, store, instance, "receive"))
+	require.EqualValues(t, messagingOverflow, call(t, store, instance, "read", int32(4)))
+	require.EqualValues(t, messagingSuccess, call(t, store, instance, "read", int32(64)))
+
+	mem := memory(store, instance)
+	require.EqualValues(t, 14, binary.LittleEndian.Uint32(mem[108:]))
+	require.Equal(t, "events.created", string(mem[256:270]))
+	require.EqualValues(t, 5, binary.LittleEndian.Uint32(mem[112:]))
+	require.Equal(t, "hello", string(mem[512:517]))
+
+	// the message handle was closed and nothing else is pending
+	require.EqualValues(t, messagingInvalidHandle, call(t, store, instance, "read", int32(64)))
+	require.EqualValues(t, messagingTimeout, call(t, store, instance, "receive"))
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	require.Equal(t, []string{"default.example_com.group.task.events.created"}, server.published)
+}
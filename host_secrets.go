@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	vault "github.com/hashicorp/vault/api"
+)
+
+// secretsErrno is the error code returned by secrets functions
+type secretsErrno int32
+
+const (
+	secretsSuccess      secretsErrno = 0
+	secretsGuestError   secretsErrno = 1
+	secretsNotFound     secretsErrno = 2
+	secretsAccessDenied secretsErrno = 3
+	secretsOverflow     secretsErrno = 4
+	secretsIOError      secretsErrno = 5
+)
+
+const (
+	// secretsModule is the import namespace of the secrets functions
+	secretsModule = "wasi_ephemeral_secrets"
+
+	// secretsTimeout bounds every request made on behalf of a guest
+	secretsTimeout = 30 * time.Second
+
+	// defaultSecretsCacheTTL is how long secrets without a lease are cached
+	// when the plugin config doesn't set vault.cache_ttl
+	defaultSecretsCacheTTL = 5 * time.Minute
+
+	// vaultTokenFile is the file in the task's secrets dir holding the
+	// task's Vault token
+	vaultTokenFile = "vault_token"
+)
+
+// newVaultClient returns the client shared by all tasks' secrets hosts. It
+// has no token; requests are made with the token of the calling task.
+func newVaultClient(cfg VaultConfig) (*vault.Client, error) {
+	config := vault.DefaultConfig()
+	if config.Error != nil {
+		return nil, config.Error
+	}
+	if cfg.Address != "" {
+		config.Address = cfg.Address
+	}
+	if cfg.CACert != "" {
+		if err := config.ConfigureTLS(&vault.TLSConfig{CACert: cfg.CACert}); err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := vault.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	client.ClearToken()
+	if cfg.Namespace != "" {
+		client.SetNamespace(cfg.Namespace)
+	}
+	return client, nil
+}
+
+// cachedSecret is the data of a secret and when it must be read again
+type cachedSecret struct {
+	data    map[string]interface{}
+	expires time.Time
+}
+
+// secretsHost lets a guest read secrets from Vault at runtime, using its
+// task's Vault token and restricted to the path prefixes allowed by the task
+// config:
+//
+//	get(path_ptr, path_len, field_ptr, field_len, buf_ptr, buf_len, n_ptr) -> errno
+//
+// get returns a single field of the secret, or the whole secret as a JSON
+// object if field is empty. Fields that aren't strings are JSON encoded.
+// KV version 2 secrets are unwrapped. get returns overflow with the required
+// length at n_ptr if the buffer is too small.
+//
+// Secrets are cached for their lease duration, or for the configured cache
+// TTL if they have none.
+type secretsHost struct {
+	client    *vault.Client
+	tokenFile string
+	paths     []string
+	ttl       time.Duration
+
+	lock  sync.Mutex
+	cache map[string]*cachedSecret
+
+	// now is overridden in tests
+	now func() time.Time
+
+	// ctx is cancelled when the task is destroyed, aborting requests in
+	// flight
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newSecretsHost returns a secrets host reading with the token found in
+// secretsDir.
+func newSecretsHost(client *vault.Client, secretsDir string, paths []string, ttl time.Duration) (*secretsHost, error) {
+	// headers hold the namespace
+	client, err := client.CloneWithHeaders()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vault client: %v", err)
+	}
+	client.ClearToken()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &secretsHost{
+		client:    client,
+		tokenFile: filepath.Join(secretsDir, vaultTokenFile),
+		paths:     paths,
+		ttl:       ttl,
+		cache:     map[string]*cachedSecret{},
+		now:       time.Now,
+		ctx:       ctx,
+		cancel:    cancel,
+	}, nil
+}
+
+func (h *secretsHost) Close() error {
+	h.cancel()
+	return nil
+}
+
+func (h *secretsHost) Define(linker *wasmtime.Linker) error {
+	if err := linker.FuncWrap(secretsModule, "get", h.get); err != nil {
+		return fmt.Errorf("failed to define %s.get: %v", secretsModule, err)
+	}
+	return nil
+}
+
+// allowed reports whether the task config allows reading path
+func (h *secretsHost) allowed(path string) bool {
+	if !validRelativeKey(path) {
+		return false
+	}
+	for _, p := range h.paths {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// read returns the data of the secret at path, from the cache if it hasn't
+// expired.
+func (h *secretsHost) read(path string) (map[string]interface{}, secretsErrno) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if c, ok := h.cache[path]; ok && h.now().Before(c.expires) {
+		return c.data, secretsSuccess
+	}
+
+	// the token is read every time since Nomad rewrites it when it's renewed
+	token, err := ioutil.ReadFile(h.tokenFile)
+	if os.IsNotExist(err) {
+		return nil, secretsAccessDenied
+	} else if err != nil {
+		return nil, secretsIOError
+	}
+	h.client.SetToken(strings.TrimSpace(string(token)))
+
+	ctx, cancel := context.WithTimeout(h.ctx, secretsTimeout)
+	defer cancel()
+	resp, err := h.client.RawRequestWithContext(ctx, h.client.NewRequest("GET", "/v1/"+path))
+	if resp != nil {
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return nil, secretsNotFound
+		case http.StatusForbidden:
+			return nil, secretsAccessDenied
+		}
+	}
+	if err != nil {
+		return nil, secretsIOError
+	}
+	secret, err := vault.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, secretsIOError
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, secretsNotFound
+	}
+
+	data := secret.Data
+	// KV version 2 nests the secret under data, next to its metadata
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+
+	ttl := h.ttl
+	if secret.LeaseDuration > 0 {
+		ttl = time.Duration(secret.LeaseDuration) * time.Second
+	}
+	h.cache[path] = &cachedSecret{data: data, expires: h.now().Add(ttl)}
+	return data, secretsSuccess
+}
+
+func (h *secretsHost) get(caller *wasmtime.Caller, pathPtr, pathLen, fieldPtr, fieldLen, bufPtr, bufLen, nPtr int32) int32 {
+	mem, err := newGuestMemory(caller)
+	if err != nil {
+		return int32(secretsGuestError)
+	}
+	path, err := mem.readString(pathPtr, pathLen)
+	if err != nil {
+		return int32(secretsGuestError)
+	}
+	field, err := mem.readString(fieldPtr, fieldLen)
+	if err != nil {
+		return int32(secretsGuestError)
+	}
+	if !h.allowed(path) {
+		return int32(secretsAccessDenied)
+	}
+
+	data, errno := h.read(path)
+	if errno != secretsSuccess {
+		return int32(errno)
+	}
+
+	var value interface{} = data
+	if field != "" {
+		var ok bool
+		if value, ok = data[field]; !ok {
+			return int32(secretsNotFound)
+		}
+	}
+	out, ok := value.(string)
+	if !ok {
+		b, err := json.Marshal(value)
+		if err != nil {
+			return int32(secretsIOError)
+		}
+		out = string(b)
+	}
+
+	ok, err = mem.writeBuffer(bufPtr, bufLen, nPtr, []byte(out))
+	switch {
+	case err != nil:
+		return int32(secretsGuestError)
+	case !ok:
+		return int32(secretsOverflow)
+	}
+	return int32(secretsSuccess)
+}
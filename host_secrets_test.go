@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const secretsWat = `
+(module
+  (import "wasi_ephemeral_secrets" "get"
+    (func $get (param i32 i32 i32 i32 i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+  (data (i32.const 0) "secret/data/app/db")
+  (data (i32.const 32) "password")
+  (data (i32.const 48) "secret/data/other")
+
+  ;; reads the field of length $field into [256, ...), with its length at 100
+  (func (export "get") (param $field i32) (result i32)
+    (call $get (i32.const 0) (i32.const 18) (i32.const 32) (local.get $field) (i32.const 256) (i32.const 64) (i32.const 100)))
+  (func (export "other") (result i32)
+    (call $get (i32.const 48) (i32.const 17) (i32.const 32) (i32.const 8) (i32.const 256) (i32.const 64) (i32.const 100)))
+)`
+
+func TestSecretsHost(t *testing.T) {
+	var reads int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "task-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/v1/secret/data/app/db" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&reads, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"data":     map[string]interface{}{"password": "hunter2"},
+				"metadata": map[string]interface{}{"version": 1},
+			},
+		})
+	}))
+	defer srv.Close()
+
+	client, err := newVaultClient(VaultConfig{Address: srv.URL})
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	host, err := newSecretsHost(client, dir, []string{"secret/data/app/"}, time.Minute)
+	require.NoError(t, err)
+	defer host.Close()
+	now := time.Now()
+	host.now = func() time.Time { return now }
+	store, instance := instantiate(t, secretsWat, host)
+
+	// without a Vault token nothing can be read
+	require.EqualValues(t, secretsAccessDenied, call(t, store, instance, "get", int32(8)))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, vaultTokenFile), []byte("task-token\n"), 0600))
+
+	require.EqualValues(t, secretsSuccess, call(t, store, instance, "get", int32(8)))
+	mem := memory(store, instance)
+	require.Equal(t, "hunter2", string(mem[256:256+binary.LittleEndian.Uint32(mem[100:])]))
+
+	require.EqualValues(t, secretsSuccess, call(t, store, instance, "get", int32(0)))
+	mem = memory(store, instance)
+	require.JSONEq(t, `{"password":"hunter2"}`, string(mem[256:256+binary.LittleEndian.Uint32(mem[100:])]))
+	require.EqualValues(t, 1, atomic.LoadInt32(&reads), "secret must be cached")
+
+	now = now.Add(2 * time.Minute)
+	require.EqualValues(t, secretsSuccess, call(t, store, instance, "get", int32(8)))
+	require.EqualValues(t, 2, atomic.LoadInt32(&reads), "expired secret must be read again")
+
+	// paths outside of the task config are denied before asking Vault
+	require.EqualValues(t, secretsAccessDenied, call(t, store, instance, "other"))
+}
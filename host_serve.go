@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+// serveErrno is the error code returned by serve functions
+type serveErrno int32
+
+const (
+	serveSuccess    serveErrno = 0
+	serveGuestError serveErrno = 1
+	serveOverflow   serveErrno = 2
+	serveBadHandle  serveErrno = 3
+	serveIOError    serveErrno = 4
+	serveInvalid    serveErrno = 5
+)
+
+const (
+	// serveModule is the import namespace of the serve functions
+	serveModule = "wasi_ephemeral_serve"
+
+	// serveExport is called with the handle of every request a serve task
+	// receives, unless a route names another export
+	serveExport = "handle_request"
+)
+
+// serveExchange is a request handed to a guest and its response
+type serveExchange struct {
+	w http.ResponseWriter
+	r *http.Request
+
+	lock        sync.Mutex
+	status      int
+	wroteHeader bool
+}
+
+// writeHeader sends the response's status, 200 unless the guest set one,
+// with the lock held
+func (e *serveExchange) writeHeaderLocked() {
+	if e.wroteHeader {
+		return
+	}
+	if e.status == 0 {
+		e.status = http.StatusOK
+	}
+	e.w.WriteHeader(e.status)
+	e.wroteHeader = true
+}
+
+// finish sends the status of a response the guest wrote no body for
+func (e *serveExchange) finish() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.writeHeaderLocked()
+}
+
+// fail answers with 500 if the guest stopped before sending its response,
+// returning false if it already started sending it
+func (e *serveExchange) fail() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.wroteHeader {
+		return false
+	}
+	e.wroteHeader = true
+	http.Error(e.w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	return true
+}
+
+// serveHost hands the requests of a serve task to a guest:
+//
+//	request_method(handle, buf_ptr, buf_len, n_ptr) -> errno
+//	request_uri(handle, buf_ptr, buf_len, n_ptr) -> errno
+//	request_headers(handle, buf_ptr, buf_len, n_ptr) -> errno
+//	request_body_read(handle, buf_ptr, buf_len, n_ptr) -> errno
+//	response_status(handle, status) -> errno
+//	response_header(handle, name_ptr, name_len, value_ptr, value_len) -> errno
+//	response_write(handle, buf_ptr, buf_len) -> errno
+//
+// The guest's handle_request export, or the export of the request's route,
+// is called with the handle of each request, whose response is complete
+// once it returns. Headers are passed as "Name: value" lines separated by
+// "\n", and the functions returning data store overflow with the required
+// length at n_ptr if the buffer is too small. request_body_read stores 0 at
+// n_ptr at the end of the body. The status and headers must be set before
+// the body is written.
+type serveHost struct {
+	requests *handleTable
+}
+
+func newServeHost() *serveHost {
+	return &serveHost{requests: newHandleTable(1)}
+}
+
+func (h *serveHost) Close() error {
+	h.requests.clear()
+	return nil
+}
+
+func (h *serveHost) Define(linker *wasmtime.Linker) error {
+	for name, fn := range map[string]interface{}{
+		"request_method":    h.requestMethod,
+		"request_uri":       h.requestURI,
+		"request_headers":   h.requestHeaders,
+		"request_body_read": h.requestBodyRead,
+		"response_status":   h.responseStatus,
+		"response_header":   h.responseHeader,
+		"response_write":    h.responseWrite,
+	} {
+		if err := linker.FuncWrap(serveModule, name, fn); err != nil {
+			return fmt.Errorf("failed to define %s.%s: %v", serveModule, name, err)
+		}
+	}
+	return nil
+}
+
+// serve hands r to the guest by calling call with its handle. The response
+// is answered with 500 if call fails before the guest sent it, while a
+// response cut short by the guest failing aborts the connection.
+func (h *serveHost) serve(w http.ResponseWriter, r *http.Request, call func(handle uint32) error) error {
+	e := &serveExchange{w: w, r: r}
+	handle, ok := h.requests.insert(e)
+	if !ok {
+		return fmt.Errorf("guest is already handling a request")
+	}
+	defer h.requests.remove(handle)
+
+	if err := call(handle); err != nil {
+		if !e.fail() {
+			panic(http.ErrAbortHandler)
+		}
+		return err
+	}
+	e.finish()
+	return nil
+}
+
+func (h *serveHost) exchange(handle int32) (*serveExchange, bool) {
+	v, ok := h.requests.get(uint32(handle))
+	if !ok {
+		return nil, false
+	}
+	return v.(*serveExchange), true
+}
+
+// output copies data to the guest's buffer
+func (h *serveHost) output(caller *wasmtime.Caller, bufPtr, bufLen, nPtr int32, data []byte) int32 {
+	mem, err := newGuestMemory(caller)
+	if err != nil {
+		return int32(serveGuestError)
+	}
+	ok, err := mem.writeBuffer(bufPtr, bufLen, nPtr, data)
+	switch {
+	case err != nil:
+		return int32(serveGuestError)
+	case !ok:
+		return int32(serveOverflow)
+	}
+	return int32(serveSuccess)
+}
+
+func (h *serveHost) requestMethod(caller *wasmtime.Caller, handle, bufPtr, bufLen, nPtr int32) int32 {
+	e, ok := h.exchange(handle)
+	if !ok {
+		return int32(serveBadHandle)
+	}
+	return h.output(caller, bufPtr, bufLen, nPtr, []byte(e.r.Method))
+}
+
+func (h *serveHost) requestURI(caller *wasmtime.Caller, handle, bufPtr, bufLen, nPtr int32) int32 {
+	e, ok := h.exchange(handle)
+	if !ok {
+		return int32(serveBadHandle)
+	}
+	return h.output(caller, bufPtr, bufLen, nPtr, []byte(e.r.URL.RequestURI()))
+}
+
+func (h *serveHost) requestHeaders(caller *wasmtime.Caller, handle, bufPtr, bufLen, nPtr int32) int32 {
+	e, ok := h.exchange(handle)
+	if !ok {
+		return int32(serveBadHandle)
+	}
+	header := e.r.Header.Clone()
+	if e.r.Host != "" {
+		header.Set("Host", e.r.Host)
+	}
+	return h.output(caller, bufPtr, bufLen, nPtr, formatHeaders(header))
+}
+
+func (h *serveHost) requestBodyRead(caller *wasmtime.Caller, handle, bufPtr, bufLen, nPtr int32) int32 {
+	e, ok := h.exchange(handle)
+	if !ok {
+		return int32(serveBadHandle)
+	}
+	mem, err := newGuestMemory(caller)
+	if err != nil {
+		return int32(serveGuestError)
+	}
+	buf, err := mem.slice(bufPtr, bufLen)
+	if err != nil {
+		return int32(serveGuestError)
+	}
+
+	n := 0
+	if e.r.Body != nil && len(buf) > 0 {
+		n, err = e.r.Body.Read(buf)
+		// a read returning data along with io.EOF ends with the next one
+		if err != nil && err != io.EOF && n == 0 {
+			return int32(serveIOError)
+		}
+	}
+	if err := mem.writeUint32(nPtr, uint32(n)); err != nil {
+		return int32(serveGuestError)
+	}
+	return int32(serveSuccess)
+}
+
+func (h *serveHost) responseStatus(handle, status int32) int32 {
+	e, ok := h.exchange(handle)
+	if !ok {
+		return int32(serveBadHandle)
+	}
+	if status < 100 || status > 999 {
+		return int32(serveInvalid)
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.wroteHeader {
+		return int32(serveInvalid)
+	}
+	e.status = int(status)
+	return int32(serveSuccess)
+}
+
+func (h *serveHost) responseHeader(caller *wasmtime.Caller, handle, namePtr, nameLen, valuePtr, valueLen int32) int32 {
+	e, ok := h.exchange(handle)
+	if !ok {
+		return int32(serveBadHandle)
+	}
+	mem, err := newGuestMemory(caller)
+	if err != nil {
+		return int32(serveGuestError)
+	}
+	name, err := mem.readString(namePtr, nameLen)
+	if err != nil {
+		return int32(serveGuestError)
+	}
+	value, err := mem.readString(valuePtr, valueLen)
+	if err != nil {
+		return int32(serveGuestError)
+	}
+	if name == "" {
+		return int32(serveInvalid)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.wroteHeader {
+		return int32(serveInvalid)
+	}
+	e.w.Header().Add(name, value)
+	return int32(serveSuccess)
+}
+
+func (h *serveHost) responseWrite(caller *wasmtime.Caller, handle, bufPtr, bufLen int32) int32 {
+	e, ok := h.exchange(handle)
+	if !ok {
+		return int32(serveBadHandle)
+	}
+	mem, err := newGuestMemory(caller)
+	if err != nil {
+		return int32(serveGuestError)
+	}
+	data, err := mem.slice(bufPtr, bufLen)
+	if err != nil {
+		return int32(serveGuestError)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.writeHeaderLocked()
+	if _, err := e.w.Write(data); err != nil {
+		return int32(serveIOError)
+	}
+	return int32(serveSuccess)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveMethodWat answers with 201, an X-Guest header and the request's
+// method
+const serveMethodWat = `
+(module
+  (import "wasi_ephemeral_serve" "request_method" (func $method (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_serve" "response_status" (func $status (param i32 i32) (result i32)))
+  (import "wasi_ephemeral_serve" "response_header" (func $header (param i32 i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_serve" "response_write" (func $write (param i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 0) "X-Guest")
+  (data (i32.const 8) "yes")
+  (func (export "handle_request") (param $h i32)
+    (drop (call $status (local.get $h) (i32.const 201)))
+    (drop (call $header (local.get $h) (i32.const 0) (i32.const 7) (i32.const 8) (i32.const 3)))
+    (drop (call $method (local.get $h) (i32.const 64) (i32.const 16) (i32.const 32)))
+    (drop (call $write (local.get $h) (i32.const 64) (i32.load (i32.const 32)))))
+)`
+
+// serveEchoWat answers with the request's URI and body, read two bytes at a
+// time
+const serveEchoWat = `
+(module
+  (import "wasi_ephemeral_serve" "request_uri" (func $uri (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_serve" "request_body_read" (func $body (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_serve" "response_status" (func $status (param i32 i32) (result i32)))
+  (import "wasi_ephemeral_serve" "response_write" (func $write (param i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (func (export "handle_request") (param $h i32) (local $n i32)
+    (drop (call $uri (local.get $h) (i32.const 100) (i32.const 100) (i32.const 0)))
+    (drop (call $write (local.get $h) (i32.const 100) (i32.load (i32.const 0))))
+    (block $done
+      (loop $read
+        (drop (call $body (local.get $h) (i32.const 300) (i32.const 2) (i32.const 0)))
+        (local.set $n (i32.load (i32.const 0)))
+        (br_if $done (i32.eqz (local.get $n)))
+        (drop (call $write (local.get $h) (i32.const 300) (local.get $n)))
+        (br $read))))
+  (func (export "uri_overflow") (param $h i32) (result i32)
+    (call $uri (local.get $h) (i32.const 100) (i32.const 2) (i32.const 0)))
+  (func (export "late_status") (param $h i32) (result i32)
+    (drop (call $write (local.get $h) (i32.const 100) (i32.const 0)))
+    (call $status (local.get $h) (i32.const 404)))
+  (func (export "trap") (param $h i32) unreachable)
+)`
+
+func TestServeHost(t *testing.T) {
+	host := newServeHost()
+	store, instance := instantiate(t, serveEchoWat, host)
+	export := func(name string) func(uint32) error {
+		return func(handle uint32) error {
+			_, err := instance.GetFunc(store, name).Call(store, int32(handle))
+			return err
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/path?q=1", strings.NewReader("ping"))
+	require.NoError(t, host.serve(rec, req, export("handle_request")))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "/path?q=1ping", rec.Body.String())
+
+	// the required length is stored if the buffer is too small
+	rec = httptest.NewRecorder()
+	require.NoError(t, host.serve(rec, req, func(handle uint32) error {
+		require.Equal(t, int32(serveOverflow), call(t, store, instance, "uri_overflow", int32(handle)))
+		return nil
+	}))
+	require.Equal(t, uint32(len("/path?q=1")), binary.LittleEndian.Uint32(memory(store, instance)[0:]))
+
+	// the status can't change once the body is written
+	rec = httptest.NewRecorder()
+	require.NoError(t, host.serve(rec, req, func(handle uint32) error {
+		require.Equal(t, int32(serveInvalid), call(t, store, instance, "late_status", int32(handle)))
+		return nil
+	}))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// a guest failing before answering gets a 500
+	rec = httptest.NewRecorder()
+	require.Error(t, host.serve(rec, req, export("trap")))
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	// handles are only valid while their request is served
+	require.Equal(t, int32(serveBadHandle), call(t, store, instance, "uri_overflow", int32(1)))
+}
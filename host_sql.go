@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+// sqlErrno is the error code returned by SQL functions
+type sqlErrno int32
+
+const (
+	sqlSuccess        sqlErrno = 0
+	sqlGuestError     sqlErrno = 1
+	sqlInvalidParams  sqlErrno = 2
+	sqlTimeout        sqlErrno = 3
+	sqlOverflow       sqlErrno = 4
+	sqlInvalidHandle  sqlErrno = 5
+	sqlTooManyHandles sqlErrno = 6
+	sqlQueryError     sqlErrno = 7
+)
+
+const (
+	// sqlModule is the import namespace of the SQL functions
+	sqlModule = "wasi_ephemeral_sql"
+
+	// maxSQLHandles bounds the result sets a guest may hold open
+	maxSQLHandles = 64
+
+	defaultSQLMaxOpenConns     = 4
+	defaultSQLStatementTimeout = 30 * time.Second
+)
+
+// sqlDrivers maps the drivers accepted in the task config to the name they
+// are registered with in database/sql
+var sqlDrivers = map[string]string{
+	"postgres": "postgres",
+	"mysql":    "mysql",
+}
+
+// sqlHost proxies a guest's queries to a connection pool owned by its task.
+// Parameters are passed as a JSON array and result sets are returned as a
+// JSON object of the form {"columns": [...], "rows": [[...], ...]}, with
+// binary values that aren't valid UTF-8 encoded as base64:
+//
+//	query(stmt_ptr, stmt_len, params_ptr, params_len, result_ptr) -> errno
+//	result_data(result, buf_ptr, buf_len, n_ptr) -> errno
+//	result_close(result) -> errno
+//	exec(stmt_ptr, stmt_len, params_ptr, params_len, affected_ptr) -> errno
+//
+// result_data returns overflow with the required length at n_ptr if the
+// buffer is too small. exec stores the number of rows affected as a u64.
+type sqlHost struct {
+	db      *sql.DB
+	timeout time.Duration
+
+	handles *handleTable
+
+	// ctx is cancelled when the task is destroyed, aborting statements in
+	// flight
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newSQLHost opens the connection pool described by cfg. Relative DSN files
+// are resolved against taskDir.
+func newSQLHost(cfg SQLConfig, taskDir string) (*sqlHost, error) {
+	driver, ok := sqlDrivers[cfg.Driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported sql driver %q", cfg.Driver)
+	}
+
+	dsn := cfg.DSN
+	if cfg.DSNFile != "" {
+		if dsn != "" {
+			return nil, fmt.Errorf("only one of sql dsn and dsn_file may be set")
+		}
+		b, err := ioutil.ReadFile(resolveArtifactPath(taskDir, cfg.DSNFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sql dsn_file: %v", err)
+		}
+		dsn = strings.TrimSpace(string(b))
+	}
+	if dsn == "" {
+		return nil, fmt.Errorf("sql dsn is required")
+	}
+
+	timeout := defaultSQLStatementTimeout
+	if cfg.StatementTimeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(cfg.StatementTimeout); err != nil {
+			return nil, fmt.Errorf("invalid sql statement_timeout %q: %v", cfg.StatementTimeout, err)
+		}
+	}
+
+	maxConns := cfg.MaxOpenConns
+	if maxConns <= 0 {
+		maxConns = defaultSQLMaxOpenConns
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sql connection pool: %v", err)
+	}
+	db.SetMaxOpenConns(maxConns)
+	db.SetMaxIdleConns(maxConns)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &sqlHost{
+		db:      db,
+		timeout: timeout,
+		handles: newHandleTable(maxSQLHandles),
+		ctx:     ctx,
+		cancel:  cancel,
+	}, nil
+}
+
+func (h *sqlHost) Close() error {
+	h.cancel()
+	h.handles.clear()
+	return h.db.Close()
+}
+
+func (h *sqlHost) Define(linker *wasmtime.Linker) error {
+	funcs := map[string]interface{}{
+		"query":        h.query,
+		"result_data":  h.resultData,
+		"result_close": h.resultClose,
+		"exec":         h.exec,
+	}
+	for name, f := range funcs {
+		if err := linker.FuncWrap(sqlModule, name, f); err != nil {
+			return fmt.Errorf("failed to define %s.%s: %v", sqlModule, name, err)
+		}
+	}
+	return nil
+}
+
+// sqlFunc adapts the body of a SQL function so it can report errnos, with
+// guest memory errors mapped to guest_error.
+func sqlFunc(caller *wasmtime.Caller, f func(mem *guestMemory) sqlErrno) int32 {
+	mem, err := newGuestMemory(caller)
+	if err != nil {
+		return int32(sqlGuestError)
+	}
+	return int32(f(mem))
+}
+
+// statement reads a statement and its JSON encoded parameters from the guest
+func (h *sqlHost) statement(mem *guestMemory, stmtPtr, stmtLen, paramsPtr, paramsLen int32) (string, []interface{}, sqlErrno) {
+	stmt, err := mem.readString(stmtPtr, stmtLen)
+	if err != nil {
+		return "", nil, sqlGuestError
+	}
+	raw, err := mem.slice(paramsPtr, paramsLen)
+	if err != nil {
+		return "", nil, sqlGuestError
+	}
+
+	var params []interface{}
+	if len(raw) != 0 {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		if err := dec.Decode(&params); err != nil {
+			return "", nil, sqlInvalidParams
+		}
+	}
+	for i, p := range params {
+		// database drivers don't accept json.Number
+		if n, ok := p.(json.Number); ok {
+			if v, err := n.Int64(); err == nil {
+				params[i] = v
+			} else if v, err := n.Float64(); err == nil {
+				params[i] = v
+			}
+		}
+	}
+	return stmt, params, sqlSuccess
+}
+
+// errno maps a database error onto a sqlErrno
+func (h *sqlHost) errno(err error) sqlErrno {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return sqlTimeout
+	}
+	return sqlQueryError
+}
+
+func (h *sqlHost) query(caller *wasmtime.Caller, stmtPtr, stmtLen, paramsPtr, paramsLen, resultPtr int32) int32 {
+	return sqlFunc(caller, func(mem *guestMemory) sqlErrno {
+		stmt, params, errno := h.statement(mem, stmtPtr, stmtLen, paramsPtr, paramsLen)
+		if errno != sqlSuccess {
+			return errno
+		}
+
+		ctx, cancel := context.WithTimeout(h.ctx, h.timeout)
+		defer cancel()
+		result, err := h.rows(ctx, stmt, params)
+		if err != nil {
+			return h.errno(err)
+		}
+
+		handle, ok := h.handles.insert(result)
+		if !ok {
+			return sqlTooManyHandles
+		}
+		if err := mem.writeUint32(resultPtr, handle); err != nil {
+			h.handles.remove(handle)
+			return sqlGuestError
+		}
+		return sqlSuccess
+	})
+}
+
+// rows runs a query and returns its JSON encoded result set
+func (h *sqlHost) rows(ctx context.Context, stmt string, params []interface{}) ([]byte, error) {
+	rows, err := h.db.QueryContext(ctx, stmt, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	result := struct {
+		Columns []string        `json:"columns"`
+		Rows    [][]interface{} `json:"rows"`
+	}{Columns: columns, Rows: [][]interface{}{}}
+
+	for rows.Next() {
+		row := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range row {
+			ptrs[i] = &row[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		for i, v := range row {
+			if b, ok := v.([]byte); ok && utf8.Valid(b) {
+				row[i] = string(b)
+			}
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(result)
+}
+
+func (h *sqlHost) resultData(caller *wasmtime.Caller, handle, bufPtr, bufLen, nPtr int32) int32 {
+	return sqlFunc(caller, func(mem *guestMemory) sqlErrno {
+		v, ok := h.handles.get(uint32(handle))
+		if !ok {
+			return sqlInvalidHandle
+		}
+		ok, err := mem.writeBuffer(bufPtr, bufLen, nPtr, v.([]byte))
+		switch {
+		case err != nil:
+			return sqlGuestError
+		case !ok:
+			return sqlOverflow
+		}
+		return sqlSuccess
+	})
+}
+
+func (h *sqlHost) resultClose(caller *wasmtime.Caller, handle int32) int32 {
+	if _, ok := h.handles.remove(uint32(handle)); !ok {
+		return int32(sqlInvalidHandle)
+	}
+	return int32(sqlSuccess)
+}
+
+func (h *sqlHost) exec(caller *wasmtime.Caller, stmtPtr, stmtLen, paramsPtr, paramsLen, affectedPtr int32) int32 {
+	return sqlFunc(caller, func(mem *guestMemory) sqlErrno {
+		stmt, params, errno := h.statement(mem, stmtPtr, stmtLen, paramsPtr, paramsLen)
+		if errno != sqlSuccess {
+			return errno
+		}
+
+		ctx, cancel := context.WithTimeout(h.ctx, h.timeout)
+		defer cancel()
+		res, err := h.db.ExecContext(ctx, stmt, params...)
+		if err != nil {
+			return h.errno(err)
+		}
+		// not every driver reports the rows affected
+		affected, _ := res.RowsAffected()
+
+		b, err := mem.slice(affectedPtr, 8)
+		if err != nil {
+			return sqlGuestError
+		}
+		binary.LittleEndian.PutUint64(b, uint64(affected))
+		return sqlSuccess
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSQLDriver answers every query with the statement, its DSN and its
+// arguments as a single row
+type fakeSQLDriver struct{}
+
+type fakeSQLConn struct{ dsn string }
+
+type fakeSQLStmt struct {
+	conn  *fakeSQLConn
+	query string
+}
+
+type fakeSQLRows struct {
+	values []driver.Value
+	done   bool
+}
+
+func init() {
+	sql.Register("fakesql", fakeSQLDriver{})
+	sqlDrivers["fake"] = "fakesql"
+}
+
+func (fakeSQLDriver) Open(dsn string) (driver.Conn, error) { return &fakeSQLConn{dsn: dsn}, nil }
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{conn: c, query: query}, nil
+}
+func (c *fakeSQLConn) Close() error              { return nil }
+func (c *fakeSQLConn) Begin() (driver.Tx, error) { return nil, fmt.Errorf("not supported") }
+
+func (s *fakeSQLStmt) Close() error  { return nil }
+func (s *fakeSQLStmt) NumInput() int { return -1 }
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(len(args)), nil
+}
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &fakeSQLRows{values: []driver.Value{[]byte(s.query), s.conn.dsn, fmt.Sprint(args)}}, nil
+}
+
+func (r *fakeSQLRows) Columns() []string { return []string{"query", "dsn", "args"} }
+func (r *fakeSQLRows) Close() error      { return nil }
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	copy(dest, r.values)
+	return nil
+}
+
+const sqlWat = `
+(module
+  (import "wasi_ephemeral_sql" "query"
+    (func $query (param i32 i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_sql" "result_data"
+    (func $result_data (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_sql" "result_close"
+    (func $result_close (param i32) (result i32)))
+  (import "wasi_ephemeral_sql" "exec"
+    (func $exec (param i32 i32 i32 i32 i32) (result i32)))
+
+  (memory (export "memory") 1)
+  (data (i32.const 0) "SELECT $1")
+  (data (i32.const 16) "[42, \"x\"]")
+  (data (i32.const 32) "[42")
+
+  ;; queries and copies the result to [512, ...), with its length at 104
+  (func (export "query") (param $len i32) (result i32)
+    (local $errno i32)
+    (if (local.tee $errno (call $query (i32.const 0) (i32.const 9) (i32.const 16) (i32.const 9) (i32.const 100)))
+      (then (return (local.get $errno))))
+    (if (local.tee $errno (call $result_data (i32.load (i32.const 100)) (i32.const 512) (local.get $len) (i32.const 104)))
+      (then (drop (call $result_close (i32.load (i32.const 100)))) (return (local.get $errno))))
+    (call $result_close (i32.load (i32.const 100))))
+  (func (export "exec") (result i32)
+    (call $exec (i32.const 0) (i32.const 9) (i32.const 16) (i32.const 9) (i32.const 112)))
+  (func (export "invalid") (result i32)
+    (call $exec (i32.const 0) (i32.const 9) (i32.const 32) (i32.const 3) (i32.const 112)))
+)`
+
+func TestSQLHost(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "secrets"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "secrets", "db"), []byte("user:pass@db\n"), 0600))
+
+	host, err := newSQLHost(SQLConfig{Driver: "fake", DSNFile: "secrets/db"}, dir)
+	require.NoError(t, err)
+	defer host.Close()
+	store, instance := instantiate(t, sqlWat, host)
+
+	require.EqualValues(t, sqlOverflow, call(t, store, instance, "query", int32(8)))
+	require.EqualValues(t, sqlSuccess, call(t, store, instance, "query", int32(1024)))
+
+	mem := memory(store, instance)
+	n := binary.LittleEndian.Uint32(mem[104:])
+	var result struct {
+		Columns []string
+		Rows    [][]interface{}
+	}
+	require.NoError(t, json.Unmarshal(mem[512:512+n], &result))
+	require.Equal(t, []string{"query", "dsn", "args"}, result.Columns)
+	require.Equal(t, [][]interface{}{{"SELECT $1", "user:pass@db", "[42 x]"}}, result.Rows)
+
+	require.EqualValues(t, sqlSuccess, call(t, store, instance, "exec"))
+	require.EqualValues(t, 2, binary.LittleEndian.Uint64(memory(store, instance)[112:]))
+	require.EqualValues(t, sqlInvalidParams, call(t, store, instance, "invalid"))
+}
+
+func TestSQLHost_Config(t *testing.T) {
+	_, err := newSQLHost(SQLConfig{Driver: "oracle", DSN: "x"}, "")
+	require.Error(t, err)
+
+	_, err = newSQLHost(SQLConfig{Driver: "postgres"}, "")
+	require.Error(t, err)
+
+	_, err = newSQLHost(SQLConfig{Driver: "postgres", DSN: "x", StatementTimeout: "soon"}, "")
+	require.Error(t, err)
+
+	host, err := newSQLHost(SQLConfig{Driver: "postgres", DSN: "postgres://localhost/db", MaxOpenConns: 2}, "")
+	require.NoError(t, err)
+	require.Equal(t, 2, host.db.Stats().MaxOpenConnections)
+	require.Equal(t, defaultSQLStatementTimeout, host.timeout)
+	require.NoError(t, host.Close())
+}
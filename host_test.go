@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/stretchr/testify/require"
+)
+
+// instantiate compiles wat and instantiates it with hosts defined
+func instantiate(t *testing.T, wat string, hosts ...hostModule) (*wasmtime.Store, *wasmtime.Instance) {
+	t.Helper()
+
+	wasm, err := wasmtime.Wat2Wasm(wat)
+	require.NoError(t, err)
+
+	engine := wasmtime.NewEngine()
+	module, err := wasmtime.NewModule(engine, wasm)
+	require.NoError(t, err)
+
+	linker := wasmtime.NewLinker(engine)
+	for _, h := range hosts {
+		require.NoError(t, h.Define(linker))
+	}
+
+	store := wasmtime.NewStore(engine)
+	instance, err := linker.Instantiate(store, module)
+	require.NoError(t, err)
+	return store, instance
+}
+
+// call invokes the export name of instance, which must return an i32
+func call(t *testing.T, store *wasmtime.Store, instance *wasmtime.Instance, name string, args ...interface{}) int32 {
+	t.Helper()
+
+	ret, err := instance.GetFunc(store, name).Call(store, args...)
+	require.NoError(t, err)
+	return ret.(int32)
+}
+
+// memory returns the exported memory of instance
+func memory(store *wasmtime.Store, instance *wasmtime.Instance) []byte {
+	return instance.GetExport(store, "memory").Memory().UnsafeData(store)
+}
+
+func TestHandleTable(t *testing.T) {
+	table := newHandleTable(2)
+
+	h1, ok := table.insert("a")
+	require.True(t, ok)
+	require.NotZero(t, h1)
+	h2, ok := table.insert("b")
+	require.True(t, ok)
+	require.NotEqual(t, h1, h2)
+
+	_, ok = table.insert("c")
+	require.False(t, ok, "table must be full")
+
+	v, ok := table.remove(h1)
+	require.True(t, ok)
+	require.Equal(t, "a", v)
+	_, ok = table.get(h1)
+	require.False(t, ok)
+
+	_, ok = table.insert("c")
+	require.True(t, ok)
+	require.Len(t, table.clear(), 2)
+}
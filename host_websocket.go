@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/gorilla/websocket"
+)
+
+// websocketErrno is the error code returned by websocket functions
+type websocketErrno int32
+
+const (
+	websocketSuccess    websocketErrno = 0
+	websocketGuestError websocketErrno = 1
+	websocketClosed     websocketErrno = 2
+	websocketOverflow   websocketErrno = 3
+	websocketBadHandle  websocketErrno = 4
+	websocketIOError    websocketErrno = 5
+	websocketInvalid    websocketErrno = 6
+)
+
+const (
+	// websocketModule is the import namespace of the websocket functions
+	websocketModule = "wasi_ephemeral_websocket"
+
+	// websocketExport is called with the handle of every WebSocket
+	// connection, which is closed once it returns
+	websocketExport = "websocket"
+
+	// maxWebSocketConns caps the connections a guest may hold open
+	maxWebSocketConns = 64
+)
+
+// websocketConn is a WebSocket connection bridged to a guest, as
+// implemented by *websocket.Conn
+type websocketConn interface {
+	ReadMessage() (int, []byte, error)
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
+// websocketStream is a connection held open for a guest. A message larger
+// than the guest's buffer is kept for its next recv.
+type websocketStream struct {
+	conn    websocketConn
+	lock    sync.Mutex
+	pending []byte
+	typ     int
+}
+
+// websocketHost bridges WebSocket connections to a guest:
+//
+//	recv(handle, buf_ptr, buf_len, n_ptr, type_ptr) -> errno
+//	send(handle, type, buf_ptr, buf_len) -> errno
+//	close(handle, code) -> errno
+//
+// recv blocks until a message arrives, storing its length at n_ptr and its
+// type, 1 for text or 2 for binary, at type_ptr. It returns overflow with
+// the required length at n_ptr if the buffer is too small, and closed once
+// the peer closes the connection. The guest's websocket export is called
+// with the handle of each connection.
+type websocketHost struct {
+	conns *handleTable
+}
+
+func newWebSocketHost() *websocketHost {
+	return &websocketHost{conns: newHandleTable(maxWebSocketConns)}
+}
+
+func (h *websocketHost) Close() error {
+	for _, v := range h.conns.clear() {
+		v.(*websocketStream).conn.Close()
+	}
+	return nil
+}
+
+func (h *websocketHost) Define(linker *wasmtime.Linker) error {
+	for name, fn := range map[string]interface{}{
+		"recv":  h.recv,
+		"send":  h.send,
+		"close": h.close,
+	} {
+		if err := linker.FuncWrap(websocketModule, name, fn); err != nil {
+			return fmt.Errorf("failed to define %s.%s: %v", websocketModule, name, err)
+		}
+	}
+	return nil
+}
+
+// serve hands conn to the guest by calling call with its handle, closing
+// it once call returns
+func (h *websocketHost) serve(conn websocketConn, call func(handle uint32) error) error {
+	handle, ok := h.conns.insert(&websocketStream{conn: conn})
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("guest holds too many WebSocket connections")
+	}
+	defer func() {
+		if _, ok := h.conns.remove(handle); ok {
+			conn.Close()
+		}
+	}()
+	return call(handle)
+}
+
+func (h *websocketHost) stream(handle int32) (*websocketStream, bool) {
+	v, ok := h.conns.get(uint32(handle))
+	if !ok {
+		return nil, false
+	}
+	return v.(*websocketStream), true
+}
+
+func (h *websocketHost) recv(caller *wasmtime.Caller, handle, bufPtr, bufLen, nPtr, typePtr int32) int32 {
+	s, ok := h.stream(handle)
+	if !ok {
+		return int32(websocketBadHandle)
+	}
+	mem, err := newGuestMemory(caller)
+	if err != nil {
+		return int32(websocketGuestError)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.pending == nil {
+		typ, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if _, ok := err.(*websocket.CloseError); ok {
+				return int32(websocketClosed)
+			}
+			return int32(websocketIOError)
+		}
+		if data == nil {
+			data = []byte{}
+		}
+		s.typ, s.pending = typ, data
+	}
+
+	ok, err = mem.writeBuffer(bufPtr, bufLen, nPtr, s.pending)
+	switch {
+	case err != nil:
+		return int32(websocketGuestError)
+	case !ok:
+		return int32(websocketOverflow)
+	}
+	if err := mem.writeUint32(typePtr, uint32(s.typ)); err != nil {
+		return int32(websocketGuestError)
+	}
+	s.pending = nil
+	return int32(websocketSuccess)
+}
+
+func (h *websocketHost) send(caller *wasmtime.Caller, handle, typ, bufPtr, bufLen int32) int32 {
+	s, ok := h.stream(handle)
+	if !ok {
+		return int32(websocketBadHandle)
+	}
+	if typ != websocket.TextMessage && typ != websocket.BinaryMessage {
+		return int32(websocketInvalid)
+	}
+	mem, err := newGuestMemory(caller)
+	if err != nil {
+		return int32(websocketGuestError)
+	}
+	data, err := mem.read(bufPtr, bufLen)
+	if err != nil {
+		return int32(websocketGuestError)
+	}
+	if err := s.conn.WriteMessage(int(typ), data); err != nil {
+		return int32(websocketIOError)
+	}
+	return int32(websocketSuccess)
+}
+
+func (h *websocketHost) close(handle, code int32) int32 {
+	v, ok := h.conns.remove(uint32(handle))
+	if !ok {
+		return int32(websocketBadHandle)
+	}
+	conn := v.(*websocketStream).conn
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(int(code), ""))
+	conn.Close()
+	return int32(websocketSuccess)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+const websocketWat = `
+(module
+  (import "wasi_ephemeral_websocket" "recv" (func $recv (param i32 i32 i32 i32 i32) (result i32)))
+  (import "wasi_ephemeral_websocket" "send" (func $send (param i32 i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+
+  ;; echoes messages of up to $len bytes until recv fails, returning its
+  ;; errno and leaving the length it stored at 8
+  (func (export "websocket") (param $h i32) (param $len i32) (result i32)
+    (local $errno i32)
+    (block $done
+      (loop $next
+        (local.set $errno
+          (call $recv (local.get $h) (i32.const 1024) (local.get $len) (i32.const 8) (i32.const 12)))
+        (br_if $done (local.get $errno))
+        (drop (call $send (local.get $h) (i32.load (i32.const 12)) (i32.const 1024) (i32.load (i32.const 8))))
+        (br $next)))
+    (local.get $errno))
+)`
+
+// fakeWebSocketConn replays messages, then reports the connection closed
+type fakeWebSocketConn struct {
+	messages [][]byte
+	sent     []string
+	closed   bool
+}
+
+func (c *fakeWebSocketConn) ReadMessage() (int, []byte, error) {
+	if len(c.messages) == 0 {
+		return 0, nil, &websocket.CloseError{Code: websocket.CloseNormalClosure}
+	}
+	m := c.messages[0]
+	c.messages = c.messages[1:]
+	return websocket.TextMessage, m, nil
+}
+
+func (c *fakeWebSocketConn) WriteMessage(typ int, data []byte) error {
+	if typ != websocket.TextMessage {
+		return errors.New("unexpected message type")
+	}
+	c.sent = append(c.sent, string(data))
+	return nil
+}
+
+func (c *fakeWebSocketConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestWebSocketHost(t *testing.T) {
+	host := newWebSocketHost()
+	store, instance := instantiate(t, websocketWat, host)
+
+	conn := &fakeWebSocketConn{messages: [][]byte{[]byte("hello"), []byte("world")}}
+	var errno int32
+	require.NoError(t, host.serve(conn, func(handle uint32) error {
+		errno = call(t, store, instance, "websocket", int32(handle), int32(512))
+		return nil
+	}))
+	require.Equal(t, int32(websocketClosed), errno)
+	require.Equal(t, []string{"hello", "world"}, conn.sent)
+	require.True(t, conn.closed)
+
+	// messages larger than the buffer are kept for the next recv
+	conn = &fakeWebSocketConn{messages: [][]byte{[]byte("too long")}}
+	require.NoError(t, host.serve(conn, func(handle uint32) error {
+		errno = call(t, store, instance, "websocket", int32(handle), int32(4))
+		require.Equal(t, int32(websocketOverflow), errno)
+		require.Equal(t, uint32(8), binary.LittleEndian.Uint32(memory(store, instance)[8:]))
+		errno = call(t, store, instance, "websocket", int32(handle), int32(8))
+		return nil
+	}))
+	require.Equal(t, int32(websocketClosed), errno)
+	require.Equal(t, []string{"too long"}, conn.sent)
+
+	require.Equal(t, int32(websocketBadHandle), call(t, store, instance, "websocket", int32(99), int32(8)))
+}
+
+// echoWebSocketInstance echoes the messages of WebSocket connections
+type echoWebSocketInstance struct {
+	fakeInstance
+}
+
+func (e *echoWebSocketInstance) ServeWebSocket(conn websocketConn) error {
+	for {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			return nil
+		}
+		if err := conn.WriteMessage(typ, []byte(strings.ToUpper(string(data)))); err != nil {
+			return err
+		}
+	}
+}
+
+func TestServeSupervisor_WebSocket(t *testing.T) {
+	var started int32
+	supervisor := newServeSupervisor("task", 0, func() (serveInstance, error) {
+		atomic.AddInt32(&started, 1)
+		return &echoWebSocketInstance{}, nil
+	}, hclog.NewNullLogger())
+	supervisor.enableWebSockets(16)
+	access, err := openAccessLog(TaskServeAccessLogConfig{Path: "access.log"}, t.TempDir(), nil)
+	require.NoError(t, err)
+	srv := httptest.NewServer(access.handler(newServeLimiter("task", serveLimits{requestTimeout: time.Minute}, supervisor)))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, "HELLO", string(data))
+	require.Equal(t, 1, supervisor.inflightRequests())
+
+	// each connection has an instance of its own
+	other, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	other.Close()
+	require.Equal(t, int32(2), atomic.LoadInt32(&started))
+
+	// messages are capped by the read limit
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, make([]byte, 32)))
+	_, _, err = conn.ReadMessage()
+	require.Error(t, err)
+	conn.Close()
+
+	// plain requests still reach the shared instance
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, int32(3), atomic.LoadInt32(&started))
+
+	require.NoError(t, supervisor.Close())
+	_, _, err = websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// callShimModule is the namespace the guest's memory is imported from
+	// by the call shim
+	callShimModule = "wasmtime_driver_calls"
+
+	// defaultSlowCallThreshold is the latency above which a host call is
+	// reported if host_calls.slow_threshold isn't set
+	defaultSlowCallThreshold = time.Second
+
+	// slowCallEventInterval is how often a slow call event is emitted for
+	// each function at most, so a slow backend doesn't flood the events
+	slowCallEventInterval = time.Minute
+)
+
+// hostCalls observes the calls of a task's guests to their imports, WASI's
+// and the driver's host modules alike: tracing them, measuring how long
+// they take, refilling the guest's fuel and holding them while the task is
+// paused. It's shared by the instances of the task.
+type hostCalls struct {
+	tracer *callTracer
+	stats  *callStats
+	fuel   *cpuFuel
+
+	// pauser is waited on before each call until stopped is done
+	pauser  *pauser
+	stopped context.Context
+	stop    context.CancelFunc
+
+	shimOnce sync.Once
+	shim     *callShim
+	shimErr  error
+}
+
+// newHostCalls returns the observer of the host calls of h's guests, nil if
+// neither pausable, traced, measured nor metered by their cpu
+func (d *Driver) newHostCalls(h *TaskHandle, driverConfig *TaskConfig) (*hostCalls, error) {
+	calls := &hostCalls{fuel: h.cpuFuel, pauser: h.pauser}
+	calls.stopped, calls.stop = context.WithCancel(context.Background())
+	if driverConfig.Trace != nil {
+		tracer, err := newCallTracer(h.taskConfig, *driverConfig.Trace, h.logger)
+		if err != nil {
+			return nil, err
+		}
+		calls.tracer = tracer
+	}
+	if driverConfig.HostCalls != nil {
+		stats, err := d.newCallStats(h, *driverConfig.HostCalls)
+		if err != nil {
+			calls.Close()
+			return nil, err
+		}
+		calls.stats = stats
+	}
+	if calls.pauser == nil && calls.tracer == nil && calls.stats == nil && calls.fuel == nil {
+		calls.stop()
+		return nil, nil
+	}
+	return calls, nil
+}
+
+// interrupt makes the calls waiting for the task to resume trap, as the
+// task is stopping
+func (c *hostCalls) interrupt() {
+	if c != nil {
+		c.stop()
+	}
+}
+
+// waitResumed blocks the call while the task is paused. The guest's store
+// is left to access meanwhile, so the memory of a paused guest can be
+// dumped.
+func (c *hostCalls) waitResumed(access *storeAccess) error {
+	if paused, _ := c.pauser.isPaused(); !paused {
+		return nil
+	}
+	defer access.yield()()
+	return c.pauser.wait(c.stopped)
+}
+
+// Close closes the trace file, if traced
+func (c *hostCalls) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.stop()
+	return c.tracer.Close()
+}
+
+// parseSlowCallThreshold returns the parsed host_calls.slow_threshold
+func parseSlowCallThreshold(config TaskHostCallsConfig) (time.Duration, error) {
+	if config.SlowThreshold == "" {
+		return defaultSlowCallThreshold, nil
+	}
+	threshold, err := time.ParseDuration(config.SlowThreshold)
+	if err != nil || threshold <= 0 {
+		return 0, fmt.Errorf("invalid host_calls slow_threshold %q", config.SlowThreshold)
+	}
+	return threshold, nil
+}
+
+// callStats samples the latency of each host function of a task as
+// metrics, and reports the calls slower than threshold
+type callStats struct {
+	labels    []metrics.Label
+	threshold time.Duration
+	slow      func(call string, elapsed time.Duration, suppressed int)
+
+	lock sync.Mutex
+	// reported is when a slow call of each function was last reported,
+	// suppressed how many weren't since
+	reported   map[string]time.Time
+	suppressed map[string]int
+	now        func() time.Time
+}
+
+// newCallStats returns the latency stats of h's host calls, which warn of
+// the slow ones and emit a rate limited event about them. The event is sent
+// in the background, not to hold up the guest on the eventer.
+func (d *Driver) newCallStats(h *TaskHandle, config TaskHostCallsConfig) (*callStats, error) {
+	threshold, err := parseSlowCallThreshold(config)
+	if err != nil {
+		return nil, err
+	}
+	cfg := h.taskConfig
+	return &callStats{
+		labels: []metrics.Label{
+			{Name: "job", Value: cfg.JobName},
+			{Name: "task_group", Value: cfg.TaskGroupName},
+			{Name: "task", Value: cfg.Name},
+		},
+		threshold: threshold,
+		slow: func(call string, elapsed time.Duration, suppressed int) {
+			h.logger.Warn("slow host call", "task_id", cfg.ID, "call", call, "duration", elapsed, "threshold", threshold)
+			go d.emitSlowCall(cfg, call, elapsed, threshold, suppressed)
+		},
+		reported:   map[string]time.Time{},
+		suppressed: map[string]int{},
+		now:        time.Now,
+	}, nil
+}
+
+// observe records a call of the function call that took elapsed
+func (s *callStats) observe(call string, elapsed time.Duration) {
+	labels := append([]metrics.Label{{Name: "function", Value: call}}, s.labels...)
+	metrics.AddSampleWithLabels([]string{"wasmtime", "host_call", "duration"},
+		float32(elapsed.Seconds()*1000), labels)
+	if elapsed < s.threshold {
+		return
+	}
+	metrics.IncrCounterWithLabels([]string{"wasmtime", "host_call", "slow"}, 1, labels)
+
+	s.lock.Lock()
+	now := s.now()
+	if last, ok := s.reported[call]; ok && now.Sub(last) < slowCallEventInterval {
+		s.suppressed[call]++
+		s.lock.Unlock()
+		return
+	}
+	suppressed := s.suppressed[call]
+	s.reported[call] = now
+	delete(s.suppressed, call)
+	s.lock.Unlock()
+	s.slow(call, elapsed, suppressed)
+}
+
+// emitSlowCall sends a "Slow host call" event for the task
+func (d *Driver) emitSlowCall(cfg *drivers.TaskConfig, call string, elapsed, threshold time.Duration, suppressed int) {
+	msg := fmt.Sprintf("Host call %s took %s, above the slow_threshold of %s", call, elapsed.Round(time.Millisecond), threshold)
+	if suppressed != 0 {
+		msg += fmt.Sprintf(" (%d more slow calls since the last report)", suppressed)
+	}
+	err := d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:    cfg.ID,
+		AllocID:   cfg.AllocID,
+		TaskName:  cfg.Name,
+		Timestamp: time.Now(),
+		Message:   msg,
+		Annotations: map[string]string{
+			"call":        call,
+			"duration_ms": fmt.Sprintf("%.3f", elapsed.Seconds()*1000),
+		},
+	})
+	if err != nil {
+		d.logger.Warn("failed to emit slow host call event", "task_id", cfg.ID, "error", err)
+	}
+}
+
+// shimmedImport is a function import of the module the shim forwards
+type shimmedImport struct {
+	module, name string
+	ty           *wasmtime.FuncType
+}
+
+// call returns the name calls of the import are recorded under
+func (i shimmedImport) call() string {
+	return i.module + "." + i.name
+}
+
+// callShim is a module forwarding the guest's imports, so they're called
+// with the guest's memory: WASI functions called from the host otherwise
+// find no memory to read their arguments from. Its exports are named after
+// the index of the import they call.
+type callShim struct {
+	module  *wasmtime.Module
+	imports []shimmedImport
+}
+
+// shimmedImports returns the function imports of module with numeric
+// signatures, which the shim can forward
+func shimmedImports(module *wasmtime.Module) []shimmedImport {
+	var imports []shimmedImport
+	for _, i := range module.Imports() {
+		ty := i.Type().FuncType()
+		if ty == nil || i.Name() == nil {
+			continue
+		}
+		numeric := true
+		for _, v := range append(ty.Params(), ty.Results()...) {
+			switch v.Kind() {
+			case wasmtime.KindI32, wasmtime.KindI64, wasmtime.KindF32, wasmtime.KindF64:
+			default:
+				numeric = false
+			}
+		}
+		if numeric {
+			imports = append(imports, shimmedImport{module: i.Module(), name: *i.Name(), ty: ty})
+		}
+	}
+	return imports
+}
+
+// getShim compiles the call shim of the task's module once
+func (c *hostCalls) getShim(engine *wasmtime.Engine, module *wasmtime.Module) (*callShim, error) {
+	c.shimOnce.Do(func() {
+		imports := shimmedImports(module)
+		var wat strings.Builder
+		fmt.Fprintf(&wat, "(module\n  (import %s \"memory\" (memory 0))\n", watString(callShimModule))
+		for i, imp := range imports {
+			fmt.Fprintf(&wat, "  (import %s %s (func $f%d%s))\n", watString(imp.module), watString(imp.name), i, watSignature(imp.ty))
+		}
+		wat.WriteString("  (export \"memory\" (memory 0))\n")
+		for i, imp := range imports {
+			fmt.Fprintf(&wat, "  (func (export \"f%d\")%s", i, watSignature(imp.ty))
+			for p := range imp.ty.Params() {
+				fmt.Fprintf(&wat, " local.get %d", p)
+			}
+			fmt.Fprintf(&wat, " call $f%d)\n", i)
+		}
+		wat.WriteString(")")
+
+		wasm, err := wasmtime.Wat2Wasm(wat.String())
+		if err == nil {
+			var m *wasmtime.Module
+			if m, err = wasmtime.NewModule(engine, wasm); err == nil {
+				c.shim = &callShim{module: m, imports: imports}
+			}
+		}
+		if err != nil {
+			c.shimErr = fmt.Errorf("failed to compile host call shim: %v", err)
+		}
+	})
+	return c.shim, c.shimErr
+}
+
+// watString quotes s in the text format, escaping every byte but printable
+// ASCII
+func watString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= 0x20 && c < 0x7f && c != '"' && c != '\\' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "\\%02x", c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// watSignature returns the params and results of ty in the text format
+func watSignature(ty *wasmtime.FuncType) string {
+	var s strings.Builder
+	for _, p := range ty.Params() {
+		s.WriteString(" (param " + p.Kind().String() + ")")
+	}
+	for _, r := range ty.Results() {
+		s.WriteString(" (result " + r.Kind().String() + ")")
+	}
+	return s.String()
+}
+
+// wrapImports replaces the imports of the module defined by linker with
+// functions observing their calls, which call the definitions they shadow
+// through the shim instantiated in store along with the guest. At each
+// call the size of the guest's memory is recorded in access and the
+// functions queued there run.
+func (c *hostCalls) wrapImports(store *wasmtime.Store, linker *wasmtime.Linker, engine *wasmtime.Engine, module *wasmtime.Module, access *storeAccess) error {
+	shim, err := c.getShim(engine, module)
+	if err != nil {
+		return err
+	}
+	imports := make([]wasmtime.AsExtern, 0, len(shim.imports)+1)
+	imports = append(imports, nil)
+	for _, imp := range shim.imports {
+		ext := linker.Get(store, imp.module, imp.name)
+		if ext == nil || ext.Func() == nil {
+			return fmt.Errorf("failed to wrap %s: not defined", imp.call())
+		}
+		imports = append(imports, ext.Func())
+	}
+
+	// the shim is instantiated by the first call, once the guest's memory
+	// exists
+	var instance *wasmtime.Instance
+	linker.AllowShadowing(true)
+	defer linker.AllowShadowing(false)
+	for i, imp := range shim.imports {
+		i, imp := i, imp
+		export := fmt.Sprintf("f%d", i)
+		direct := imports[i+1].(*wasmtime.Func)
+		err := linker.FuncNew(imp.module, imp.name, imp.ty, func(caller *wasmtime.Caller, args []wasmtime.Val) ([]wasmtime.Val, *wasmtime.Trap) {
+			if err := c.waitResumed(access); err != nil {
+				return nil, wasmtime.NewTrap("task stopped while paused")
+			}
+			if c.fuel != nil {
+				// the store is the one running the call
+				if err := c.fuel.refill(store); err != nil {
+					return nil, wasmtime.NewTrap(fmt.Sprintf("failed to refill fuel: %v", err))
+				}
+			}
+			access.hostCall()
+			fn := direct
+			if mem := caller.GetExport("memory"); mem != nil && mem.Memory() != nil {
+				access.setMemorySize(uint64(mem.Memory().DataSize(caller)))
+				if instance == nil {
+					imports[0] = mem.Memory()
+					shimInstance, err := wasmtime.NewInstance(caller, shim.module, imports)
+					if err != nil {
+						return nil, wasmtime.NewTrap(fmt.Sprintf("failed to instantiate host call shim: %v", err))
+					}
+					instance = shimInstance
+				}
+				fn = instance.GetFunc(caller, export)
+			}
+			return c.call(caller, imp, fn, args)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to wrap %s: %v", imp.call(), err)
+		}
+	}
+	return nil
+}
+
+// call calls fn with args on behalf of the import imp, measuring the call
+// and recording it if it's sampled
+func (c *hostCalls) call(caller *wasmtime.Caller, imp shimmedImport, fn *wasmtime.Func, args []wasmtime.Val) ([]wasmtime.Val, *wasmtime.Trap) {
+	params := make([]interface{}, len(args))
+	for i, a := range args {
+		params[i] = a
+	}
+	sampled := c.tracer != nil && c.tracer.sampled()
+	start := time.Now()
+	result, err := fn.Call(caller, params...)
+	elapsed := time.Since(start)
+
+	var results []wasmtime.Val
+	switch r := result.(type) {
+	case nil:
+	case []wasmtime.Val:
+		results = r
+	default:
+		results = []wasmtime.Val{wasmVal(r)}
+	}
+	if c.stats != nil {
+		c.stats.observe(imp.call(), elapsed)
+	}
+	if sampled {
+		r := &traceRecord{
+			Time:     start.UTC(),
+			Call:     imp.call(),
+			Args:     formatVals(args),
+			Results:  formatVals(results),
+			Duration: elapsed.Microseconds(),
+		}
+		if err != nil {
+			r.Error = strings.SplitN(err.Error(), "\n", 2)[0]
+		}
+		c.tracer.record(r)
+	}
+
+	if err != nil {
+		if trap, ok := err.(*wasmtime.Trap); ok {
+			return nil, trap
+		}
+		return nil, wasmtime.NewTrap(err.Error())
+	}
+	return results, nil
+}
+
+// wasmVal returns the value of a result of Func.Call
+func wasmVal(v interface{}) wasmtime.Val {
+	switch v := v.(type) {
+	case int32:
+		return wasmtime.ValI32(v)
+	case int64:
+		return wasmtime.ValI64(v)
+	case float32:
+		return wasmtime.ValF32(v)
+	case float64:
+		return wasmtime.ValF64(v)
+	}
+	return wasmtime.ValExternref(v)
+}
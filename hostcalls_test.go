@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSlowCallThreshold(t *testing.T) {
+	threshold, err := parseSlowCallThreshold(TaskHostCallsConfig{})
+	require.NoError(t, err)
+	require.Equal(t, defaultSlowCallThreshold, threshold)
+	threshold, err = parseSlowCallThreshold(TaskHostCallsConfig{SlowThreshold: "250ms"})
+	require.NoError(t, err)
+	require.Equal(t, 250*time.Millisecond, threshold)
+
+	for _, threshold := range []string{"slow", "0s", "-1s"} {
+		_, err := parseSlowCallThreshold(TaskHostCallsConfig{SlowThreshold: threshold})
+		require.Error(t, err, threshold)
+	}
+}
+
+func TestCallStats_RateLimit(t *testing.T) {
+	now := time.Unix(0, 0)
+	var reports []int
+	stats := &callStats{
+		threshold: 100 * time.Millisecond,
+		slow: func(call string, elapsed time.Duration, suppressed int) {
+			require.Equal(t, "env.lookup", call)
+			reports = append(reports, suppressed)
+		},
+		reported:   map[string]time.Time{},
+		suppressed: map[string]int{},
+		now:        func() time.Time { return now },
+	}
+
+	stats.observe("env.lookup", time.Millisecond)
+	require.Empty(t, reports)
+	stats.observe("env.lookup", time.Second)
+	require.Equal(t, []int{0}, reports)
+
+	// slow calls within the interval are counted in the next report
+	now = now.Add(time.Second)
+	stats.observe("env.lookup", time.Second)
+	stats.observe("env.lookup", time.Second)
+	require.Equal(t, []int{0}, reports)
+	now = now.Add(slowCallEventInterval)
+	stats.observe("env.lookup", time.Second)
+	require.Equal(t, []int{0, 2}, reports)
+}
+
+func TestStartTask_HostCallsSlow(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := d.TaskEvents(ctx)
+	require.NoError(t, err)
+
+	// events are drained while the task starts, so none is dropped
+	slow := make(chan *drivers.TaskEvent, 1)
+	go func() {
+		for e := range events {
+			if strings.HasPrefix(e.Message, "Host call wasi_snapshot_preview1.fd_write took") {
+				slow <- e
+				return
+			}
+		}
+	}()
+
+	cfg := startTestTask(t, d, helloWat, &TaskConfig{HostCalls: &TaskHostCallsConfig{SlowThreshold: "1ns"}})
+	require.Equal(t, 3, waitTestTask(t, d, cfg.ID).ExitCode)
+	defer d.DestroyTask(cfg.ID, true)
+
+	select {
+	case e := <-slow:
+		require.Equal(t, cfg.ID, e.TaskID)
+		require.Equal(t, "wasi_snapshot_preview1.fd_write", e.Annotations["call"])
+		require.Contains(t, e.Annotations, "duration_ms")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no slow host call event emitted")
+	}
+}
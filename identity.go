@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// identityEnvVar is where Nomad and the guest find the workload
+	// identity token
+	identityEnvVar = "NOMAD_TOKEN"
+
+	// identityFile is the token's file in the task's secrets dir, as
+	// written by Nomad, and in the guest's /secrets
+	identityFile = "nomad_token"
+
+	// identityDir holds the token exposed to the guest, under the task's
+	// secrets dir; the rest of the secrets dir, such as the Vault token,
+	// isn't exposed
+	identityDir = "wasmtime-identity"
+
+	// identityGuestPath is the guest path the token's dir is preopened at
+	identityGuestPath = "/secrets"
+)
+
+// workloadIdentity returns the task's workload identity token, from its
+// environment or its secrets dir
+func workloadIdentity(cfg *drivers.TaskConfig) (string, error) {
+	if token := cfg.Env[identityEnvVar]; token != "" {
+		return token, nil
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(cfg.TaskDir().SecretsDir, identityFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("task has no workload identity, add an identity block with env or file set to the task")
+		}
+		return "", fmt.Errorf("failed to read workload identity: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// identityPreopen writes the task's token to a dir of its own and returns
+// the preopen exposing it read-only, if identity.file is set
+func identityPreopen(cfg *drivers.TaskConfig, identity TaskIdentityConfig) (*preopen, error) {
+	if !identity.File {
+		return nil, nil
+	}
+	token, err := workloadIdentity(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(cfg.TaskDir().SecretsDir, identityDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create workload identity dir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, identityFile), []byte(token), 0400); err != nil {
+		return nil, fmt.Errorf("failed to write workload identity: %v", err)
+	}
+	return &preopen{HostPath: dir, GuestPath: identityGuestPath, Readonly: true}, nil
+}
+
+// guestEnv returns the guest's WASI environment. Later sources override
+// earlier ones: the variables of the task's environment matching
+// wasi.env_inherit, the addresses of the Connect upstreams, the restart
+// metadata of attempt, TZ and LANG for timezone and locale, all filtered by
+// wasi.env_allowlist and env_denylist, then env. The workload identity token
+// is only passed when identity.env is set, even if env_inherit matches it.
+func guestEnv(cfg *drivers.TaskConfig, driverConfig *TaskConfig, attempt *restartAttempt) (map[string]string, error) {
+	patterns, err := envInheritPatterns(driverConfig.WASI.EnvInherit)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := newEnvFilter(driverConfig.WASI)
+	if err != nil {
+		return nil, err
+	}
+	if driverConfig.WASI.EnvInherit == nil && len(filter.allow) != 0 {
+		patterns = []string{"*"}
+	}
+
+	env := map[string]string{}
+	for k, v := range cfg.Env {
+		if k != identityEnvVar && matchEnv(patterns, k) {
+			env[k] = v
+		}
+	}
+	for k, v := range upstreamEnv(connectUpstreams(cfg.Env)) {
+		env[k] = v
+	}
+	for k, v := range attempt.env() {
+		env[k] = v
+	}
+	for k, v := range localeEnv(driverConfig) {
+		env[k] = v
+	}
+	for k := range env {
+		if !filter.keeps(k) {
+			delete(env, k)
+		}
+	}
+	for k, v := range driverConfig.Env {
+		env[k] = v
+	}
+
+	if driverConfig.Identity.Env {
+		token, err := workloadIdentity(cfg)
+		if err != nil {
+			return nil, err
+		}
+		env[identityEnvVar] = token
+	}
+	return env, nil
+}
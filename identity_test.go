@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func identityTask(t *testing.T, env map[string]string) *drivers.TaskConfig {
+	cfg := &drivers.TaskConfig{Name: "task", AllocDir: t.TempDir(), Env: env}
+	require.NoError(t, os.MkdirAll(cfg.TaskDir().SecretsDir, 0700))
+	return cfg
+}
+
+func TestWorkloadIdentity(t *testing.T) {
+	cfg := identityTask(t, map[string]string{identityEnvVar: "from-env"})
+	token, err := workloadIdentity(cfg)
+	require.NoError(t, err)
+	require.Equal(t, "from-env", token)
+
+	cfg = identityTask(t, nil)
+	_, err = workloadIdentity(cfg)
+	require.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.TaskDir().SecretsDir, identityFile), []byte("from-file\n"), 0600))
+	token, err = workloadIdentity(cfg)
+	require.NoError(t, err)
+	require.Equal(t, "from-file", token)
+}
+
+func TestIdentityPreopen(t *testing.T) {
+	cfg := identityTask(t, map[string]string{identityEnvVar: "jwt"})
+
+	p, err := identityPreopen(cfg, TaskIdentityConfig{})
+	require.NoError(t, err)
+	require.Nil(t, p)
+
+	p, err = identityPreopen(cfg, TaskIdentityConfig{File: true})
+	require.NoError(t, err)
+	require.Equal(t, identityGuestPath, p.GuestPath)
+	require.True(t, p.Readonly)
+	data, err := ioutil.ReadFile(filepath.Join(p.HostPath, identityFile))
+	require.NoError(t, err)
+	require.Equal(t, "jwt", string(data))
+
+	// only the token is exposed, not the rest of the secrets dir
+	require.NotEqual(t, cfg.TaskDir().SecretsDir, p.HostPath)
+
+	_, err = identityPreopen(identityTask(t, nil), TaskIdentityConfig{File: true})
+	require.Error(t, err)
+}
+
+func TestGuestEnv(t *testing.T) {
+	cfg := identityTask(t, map[string]string{identityEnvVar: "jwt", "NOMAD_TASK_NAME": "task"})
+
+	env, err := guestEnv(cfg, &TaskConfig{Env: map[string]string{"A": "1"}}, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"A": "1"}, env)
+
+	// the token isn't inherited
+	env, err = guestEnv(cfg, &TaskConfig{WASI: TaskWASIConfig{EnvInherit: true}}, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"NOMAD_TASK_NAME": "task"}, env)
+
+	// even when matched by pattern
+	env, err = guestEnv(cfg, &TaskConfig{
+		Env:  map[string]string{"NOMAD_TASK_NAME": "override"},
+		WASI: TaskWASIConfig{EnvInherit: []interface{}{"NOMAD_*"}},
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"NOMAD_TASK_NAME": "override"}, env)
+
+	env, err = guestEnv(cfg, &TaskConfig{Identity: TaskIdentityConfig{Env: true}}, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{identityEnvVar: "jwt"}, env)
+
+	_, err = guestEnv(identityTask(t, nil), &TaskConfig{Identity: TaskIdentityConfig{Env: true}}, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+// importHints tell how to get the host functions of each namespace linked,
+// by namespace prefix
+var importHints = []struct {
+	prefix string
+	hint   string
+}{
+	{"wasi_snapshot_preview1", "not a WASI preview1 function"},
+	{"wasi_ephemeral_crypto", "set crypto.enabled in the plugin config and grant the crypto capability"},
+	{blobstoreModule, "configure blobstore in the plugin config and grant the blobstore capability"},
+	{keyvalueModule, "set keyvalue.backend in the task config"},
+	{secretsModule, "set secrets.paths in the task config"},
+	{sqlModule, "set sql.driver in the task config"},
+	{httpModule, "set http.allowed_hosts or http.task_api in the task config"},
+	{messagingModule, "configure messaging.servers in the plugin config and grant the messaging capability"},
+}
+
+// importHint returns how to satisfy an import from namespace. linked is
+// whether other imports from the namespace are satisfied, in which case it
+// must be a function the driver doesn't provide.
+func importHint(namespace string, linked bool) string {
+	if linked {
+		return "not provided by this version of the driver"
+	}
+	for _, h := range importHints {
+		if strings.HasPrefix(namespace, h.prefix) {
+			return h.hint
+		}
+	}
+	return "no host module provides this namespace"
+}
+
+// checkImports returns an error listing every import of module that linker
+// doesn't satisfy and what would satisfy it, so a task fails with one
+// actionable error rather than at the first unknown import
+func checkImports(store wasmtime.Storelike, linker *wasmtime.Linker, module *wasmtime.Module) error {
+	type unsatisfied struct {
+		namespace, name, typ string
+	}
+	var missing []unsatisfied
+	linked := map[string]bool{}
+	for _, i := range module.Imports() {
+		name := ""
+		if i.Name() != nil {
+			name = *i.Name()
+		}
+		if linker.Get(store, i.Module(), name) != nil {
+			linked[i.Module()] = true
+			continue
+		}
+		missing = append(missing, unsatisfied{i.Module(), name, externTypeString(i.Type())})
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	lines := make([]string, 0, len(missing))
+	for _, m := range missing {
+		lines = append(lines, fmt.Sprintf("%s.%s (%s): %s", m.namespace, m.name, m.typ, importHint(m.namespace, linked[m.namespace])))
+	}
+	return fmt.Errorf("module has %d unsatisfied imports:\n  %s", len(missing), strings.Join(lines, "\n  "))
+}
+
+// wasiNamespaces are the standard WASI namespaces, which strict_imports
+// always allows
+var wasiNamespaces = map[string]bool{
+	"wasi_snapshot_preview1": true,
+	"wasi_unstable":          true,
+}
+
+// validateImportPatterns checks the allowed_imports patterns
+func validateImportPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if !strings.Contains(p, ".") {
+			return fmt.Errorf("pattern %q isn't of the form namespace.name", p)
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// checkStrictImports returns an error listing the imports of wasm outside
+// the WASI namespaces that match none of the allowed patterns. It reads the
+// import section, so modules are refused before anything is compiled.
+func checkStrictImports(wasm []byte, allowed []string) error {
+	imports, err := wasmImports(wasm)
+	if err != nil {
+		return fmt.Errorf("invalid module: %v", err)
+	}
+	return checkAllowedImports(imports, allowed)
+}
+
+// checkAllowedImports is checkStrictImports for imports already read
+func checkAllowedImports(imports []moduleImport, allowed []string) error {
+	var denied []string
+	for _, i := range imports {
+		if wasiNamespaces[i.Module] || matchImport(i.Module+"."+i.Name, allowed) {
+			continue
+		}
+		denied = append(denied, fmt.Sprintf("%s.%s (%s)", i.Module, i.Name, i.Type))
+	}
+	if len(denied) > 0 {
+		return fmt.Errorf("strict_imports refuses %d imports outside WASI and allowed_imports:\n  %s", len(denied), strings.Join(denied, "\n  "))
+	}
+	return nil
+}
+
+// matchImport returns whether name, as namespace.name, matches a pattern
+func matchImport(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckImports(t *testing.T) {
+	engine := wasmtime.NewEngine()
+	linker, err := linkHosts(engine, nil)
+	require.NoError(t, err)
+
+	compile := func(wat string) *wasmtime.Module {
+		wasm, err := wasmtime.Wat2Wasm(wat)
+		require.NoError(t, err)
+		module, err := wasmtime.NewModule(engine, wasm)
+		require.NoError(t, err)
+		return module
+	}
+
+	module := compile(`(module
+	  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32))))`)
+	require.NoError(t, checkImports(wasmtime.NewStore(engine), linker, module))
+
+	module = compile(`(module
+	  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	  (import "wasi_snapshot_preview1" "proc_fork" (func))
+	  (import "wasi_ephemeral_keyvalue" "get" (func (param i32 i32) (result i32)))
+	  (import "wasi_ephemeral_crypto_common" "options_open" (func))
+	  (import "env" "memory" (memory 1)))`)
+	err = checkImports(wasmtime.NewStore(engine), linker, module)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "4 unsatisfied imports")
+	require.Contains(t, err.Error(), "wasi_snapshot_preview1.proc_fork (func): not provided by this version of the driver")
+	require.Contains(t, err.Error(), "wasi_ephemeral_keyvalue.get (func (param i32 i32) (result i32)): set keyvalue.backend in the task config")
+	require.Contains(t, err.Error(), "wasi_ephemeral_crypto_common.options_open (func): set crypto.enabled")
+	require.Contains(t, err.Error(), "env.memory (memory 1)")
+	require.Contains(t, err.Error(), "no host module provides this namespace")
+}
+
+func TestImportHint(t *testing.T) {
+	require.Equal(t, "not a WASI preview1 function", importHint("wasi_snapshot_preview1", false))
+	require.Contains(t, importHint(secretsModule, false), "secrets.paths")
+	require.Contains(t, importHint(secretsModule, true), "not provided")
+	require.Contains(t, importHint("wasi_ephemeral_crypto_symmetric", false), "crypto.enabled")
+}
+
+func TestCheckStrictImports(t *testing.T) {
+	wasm, err := wasmtime.Wat2Wasm(`(module
+	  (import "wasi_snapshot_preview1" "fd_write" (func (param i32 i32 i32 i32) (result i32)))
+	  (import "wasi_unstable" "proc_exit" (func (param i32)))
+	  (import "wasi_ephemeral_keyvalue" "get" (func (param i32 i32) (result i32)))
+	  (import "env" "memory" (memory 1)))`)
+	require.NoError(t, err)
+
+	err = checkStrictImports(wasm, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "2 imports")
+	require.Contains(t, err.Error(), "wasi_ephemeral_keyvalue.get (func)")
+	require.Contains(t, err.Error(), "env.memory (memory)")
+
+	err = checkStrictImports(wasm, []string{"wasi_ephemeral_keyvalue.*"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "1 imports")
+	require.NoError(t, checkStrictImports(wasm, []string{"wasi_ephemeral_keyvalue.*", "env.memory"}))
+}
+
+func TestValidateImportPatterns(t *testing.T) {
+	require.NoError(t, validateImportPatterns([]string{"wasi_ephemeral_http.*", "env.log"}))
+	require.Error(t, validateImportPatterns([]string{"env"}))
+	require.Error(t, validateImportPatterns([]string{"env.[log"}))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+// wasmFeature is a WebAssembly proposal the engine can enable
+type wasmFeature struct {
+	name   string
+	enable func(cfg *wasmtime.Config, enabled bool)
+
+	// probe is a module that only validates when the feature is supported
+	probe string
+}
+
+// wasmFeatures are the proposals supported by the engine, by the name
+// they're referred to in configs and attributes
+var wasmFeatures = []wasmFeature{
+	{"bulk_memory", (*wasmtime.Config).SetWasmBulkMemory,
+		`(module (memory 1) (func (memory.fill (i32.const 0) (i32.const 0) (i32.const 0))))`},
+	{"memory64", (*wasmtime.Config).SetWasmMemory64,
+		`(module (memory i64 1))`},
+	{"multi_memory", (*wasmtime.Config).SetWasmMultiMemory,
+		`(module (memory 1) (memory 1))`},
+	{"multi_value", (*wasmtime.Config).SetWasmMultiValue,
+		`(module (func (result i32 i32) (i32.const 0) (i32.const 0)))`},
+	{"reference_types", (*wasmtime.Config).SetWasmReferenceTypes,
+		`(module (func (param externref)))`},
+	{"simd", (*wasmtime.Config).SetWasmSIMD,
+		`(module (func (result v128) (v128.const i64x2 0 0)))`},
+	{"threads", (*wasmtime.Config).SetWasmThreads,
+		`(module (memory 1 1 shared))`},
+}
+
+// unsupportedFeatures are proposals the engine build has no support for at
+// all, reported so constraints on them fail at placement rather than at
+// runtime
+var unsupportedFeatures = []string{"component_model", "exceptions", "gc", "tail_call"}
+
+var (
+	engineFeaturesOnce sync.Once
+	engineFeatures     map[string]bool
+)
+
+// supportedFeatures returns whether the engine build supports each proposal,
+// by validating the probe of every feature with all of them enabled
+func supportedFeatures() map[string]bool {
+	engineFeaturesOnce.Do(func() {
+		engine := wasmtime.NewEngineWithConfig(featureConfig(nil))
+		engineFeatures = make(map[string]bool, len(wasmFeatures)+len(unsupportedFeatures))
+		for _, f := range wasmFeatures {
+			wasm, err := wasmtime.Wat2Wasm(f.probe)
+			engineFeatures[f.name] = err == nil && wasmtime.ModuleValidate(engine, wasm) == nil
+		}
+		for _, name := range unsupportedFeatures {
+			engineFeatures[name] = false
+		}
+	})
+	return engineFeatures
+}
+
+// featureConfig returns an engine config with every feature enabled but the
+// ones in disabled
+func featureConfig(disabled map[string]bool) *wasmtime.Config {
+	cfg := wasmtime.NewConfig()
+	for _, f := range wasmFeatures {
+		f.enable(cfg, !disabled[f.name])
+	}
+	return cfg
+}
+
+// withoutFeature returns the features to disable to turn off name. Reference
+// types and threads are disabled along with bulk memory, which they depend on.
+func withoutFeature(name string) map[string]bool {
+	disabled := map[string]bool{name: true}
+	if name == "bulk_memory" {
+		disabled["reference_types"] = true
+		disabled["threads"] = true
+	}
+	return disabled
+}
+
+// requiredFeatures returns the proposals wasm can't be validated without,
+// found by disabling them one at a time.
+func requiredFeatures(wasm []byte) ([]string, error) {
+	if err := wasmtime.ModuleValidate(wasmtime.NewEngineWithConfig(featureConfig(nil)), wasm); err != nil {
+		return nil, fmt.Errorf("invalid module: %v", err)
+	}
+
+	var required []string
+	for _, f := range wasmFeatures {
+		engine := wasmtime.NewEngineWithConfig(featureConfig(withoutFeature(f.name)))
+		if wasmtime.ModuleValidate(engine, wasm) != nil {
+			required = append(required, f.name)
+		}
+	}
+	return required, nil
+}
+
+// moduleImport is an import of a module
+type moduleImport struct {
+	Module string `json:"module"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+}
+
+// moduleExport is an export of a module
+type moduleExport struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// moduleInfo describes a module, as printed by -inspect-module
+type moduleInfo struct {
+	Imports          []moduleImport  `json:"imports"`
+	Exports          []moduleExport  `json:"exports"`
+	RequiredFeatures []string        `json:"required_features"`
+	Metadata         *moduleMetadata `json:"metadata"`
+}
+
+// inspectModule returns the imports, exports, required features and
+// metadata of wasm
+func inspectModule(wasm []byte) (*moduleInfo, error) {
+	features, err := requiredFeatures(wasm)
+	if err != nil {
+		return nil, err
+	}
+
+	module, err := wasmtime.NewModule(wasmtime.NewEngineWithConfig(featureConfig(nil)), wasm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile module: %v", err)
+	}
+	metadata, err := readModuleMetadata(wasm)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &moduleInfo{
+		Imports:          []moduleImport{},
+		Exports:          []moduleExport{},
+		RequiredFeatures: append([]string{}, features...),
+		Metadata:         metadata,
+	}
+	for _, i := range module.Imports() {
+		name := ""
+		if i.Name() != nil {
+			name = *i.Name()
+		}
+		info.Imports = append(info.Imports, moduleImport{
+			Module: i.Module(),
+			Name:   name,
+			Type:   externTypeString(i.Type()),
+		})
+	}
+	for _, e := range module.Exports() {
+		info.Exports = append(info.Exports, moduleExport{
+			Name: e.Name(),
+			Type: externTypeString(e.Type()),
+		})
+	}
+	sort.Slice(info.Exports, func(i, j int) bool { return info.Exports[i].Name < info.Exports[j].Name })
+	return info, nil
+}
+
+// externTypeString formats the type of an import or export in the text
+// format's syntax, e.g. "func (param i32) (result i32)"
+func externTypeString(t *wasmtime.ExternType) string {
+	switch {
+	case t.FuncType() != nil:
+		ft := t.FuncType()
+		s := "func"
+		if params := ft.Params(); len(params) != 0 {
+			s += " (param" + valTypesString(params) + ")"
+		}
+		if results := ft.Results(); len(results) != 0 {
+			s += " (result" + valTypesString(results) + ")"
+		}
+		return s
+	case t.MemoryType() != nil:
+		mt := t.MemoryType()
+		s := fmt.Sprintf("memory %d", mt.Minimum())
+		if ok, max := mt.Maximum(); ok {
+			s += fmt.Sprintf(" %d", max)
+		}
+		return s
+	case t.TableType() != nil:
+		tt := t.TableType()
+		return fmt.Sprintf("table %d %s", tt.Minimum(), tt.Element())
+	case t.GlobalType() != nil:
+		gt := t.GlobalType()
+		if gt.Mutable() {
+			return fmt.Sprintf("global (mut %s)", gt.Content())
+		}
+		return fmt.Sprintf("global %s", gt.Content())
+	}
+	return "unknown"
+}
+
+func valTypesString(types []*wasmtime.ValType) string {
+	var s string
+	for _, t := range types {
+		s += " " + t.String()
+	}
+	return s
+}
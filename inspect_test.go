@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectModule(t *testing.T) {
+	wasm, err := wasmtime.Wat2Wasm(`
+(module
+  (import "wasi_snapshot_preview1" "fd_write" (func (param i32 i32 i32 i32) (result i32)))
+  (memory (export "memory") 1 2)
+  (global (export "counter") (mut i32) (i32.const 0))
+  (func (export "_start")))`)
+	require.NoError(t, err)
+
+	info, err := inspectModule(wasm)
+	require.NoError(t, err)
+	require.Equal(t, []moduleImport{{
+		Module: "wasi_snapshot_preview1",
+		Name:   "fd_write",
+		Type:   "func (param i32 i32 i32 i32) (result i32)",
+	}}, info.Imports)
+	require.Equal(t, []moduleExport{
+		{Name: "_start", Type: "func"},
+		{Name: "counter", Type: "global (mut i32)"},
+		{Name: "memory", Type: "memory 1 2"},
+	}, info.Exports)
+	require.Empty(t, info.RequiredFeatures)
+
+	_, err = inspectModule([]byte("not wasm"))
+	require.Error(t, err)
+}
+
+func TestRequiredFeatures(t *testing.T) {
+	wasm, err := wasmtime.Wat2Wasm(`
+(module
+  (func (export "add") (param v128 v128) (result v128)
+    (i32x4.add (local.get 0) (local.get 1)))
+  (func (export "pair") (result i32 i32)
+    (i32.const 1) (i32.const 2)))`)
+	require.NoError(t, err)
+
+	features, err := requiredFeatures(wasm)
+	require.NoError(t, err)
+	require.Equal(t, []string{"multi_value", "simd"}, features)
+}
+
+func TestSupportedFeatures(t *testing.T) {
+	features := supportedFeatures()
+	for _, f := range wasmFeatures {
+		require.True(t, features[f.name], f.name)
+
+		// the probe must depend on the feature it checks
+		wasm, err := wasmtime.Wat2Wasm(f.probe)
+		require.NoError(t, err)
+		engine := wasmtime.NewEngineWithConfig(featureConfig(withoutFeature(f.name)))
+		require.Error(t, wasmtime.ModuleValidate(engine, wasm), f.name)
+	}
+	require.False(t, features["component_model"])
+}
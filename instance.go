@@ -0,0 +1,384 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	// startExport is the entrypoint of modules run to completion
+	startExport = "_start"
+
+	// initializeExport is called once after instantiation if exported, as
+	// for WASI reactors
+	initializeExport = "_initialize"
+
+	// unlimitedFuel is the fuel of guests without a fuel limit, as fuel is
+	// always consumed
+	unlimitedFuel = 1 << 62
+)
+
+// guestModule is a task's compiled module and what its instances are
+// created with
+type guestModule struct {
+	taskID string
+	engine *wasmtime.Engine
+	module *wasmtime.Module
+
+	// routes are the modules of the task's serve routes, by file
+	routes map[string]*wasmtime.Module
+
+	// argv and env are the guest's WASI arguments and environment, preopens
+	// the directories it sees, stdin the file it reads, if any, and output
+	// where it writes
+	argv     []string
+	env      map[string]string
+	preopens []*preopen
+	stdin    string
+	output   *guestOutput
+
+	// entrypoint is the export run to completion, called with callArgs
+	entrypoint string
+	callArgs   []interface{}
+
+	limits      *taskLimits
+	preallocate bool
+	instances   *instanceRegistry
+
+	// calls observes the calls of the module's imports, if pausable,
+	// traced, measured or refilling fuel
+	calls *hostCalls
+
+	// fuel meters the guest's fuel by its task's cpu, if not nil
+	fuel *cpuFuel
+}
+
+// wasiConfig returns the WASI config of a new instance
+func (m *guestModule) wasiConfig() (*wasmtime.WasiConfig, error) {
+	wasi := wasmtime.NewWasiConfig()
+	wasi.SetArgv(m.argv)
+
+	keys := make([]string, 0, len(m.env))
+	for k := range m.env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	values := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values = append(values, m.env[k])
+	}
+	wasi.SetEnv(keys, values)
+
+	for _, p := range m.preopens {
+		if err := wasi.PreopenDir(p.HostPath, p.GuestPath); err != nil {
+			return nil, fmt.Errorf("failed to preopen %q: %v", p.GuestPath, err)
+		}
+	}
+	if m.stdin != "" {
+		if err := wasi.SetStdinFile(m.stdin); err != nil {
+			return nil, fmt.Errorf("failed to set guest stdin: %v", err)
+		}
+	}
+	if err := m.output.configure(wasi); err != nil {
+		return nil, err
+	}
+	return wasi, nil
+}
+
+// link returns a linker defining WASI and the functions of hosts, failing
+// with every import of the module they don't satisfy
+func (m *guestModule) link(store wasmtime.Storelike, hosts []hostModule) (*wasmtime.Linker, error) {
+	linker, err := linkHosts(m.engine, hosts)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkImports(store, linker, m.module); err != nil {
+		return nil, err
+	}
+	return linker, nil
+}
+
+// closeOutput closes the output of the module's guests and its trace file,
+// once they stopped
+func (m *guestModule) closeOutput() {
+	m.output.close()
+	if err := m.calls.Close(); err != nil {
+		m.calls.tracer.logger.Warn("failed to close trace file", "task_id", m.taskID, "error", err)
+	}
+}
+
+// exports returns whether the module exports the function name
+func (m *guestModule) exports(name string) bool {
+	for _, e := range m.module.Exports() {
+		if e.Name() == name && e.Type().FuncType() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// guestInstance is an instance of a task's module in a store of its own,
+// with the host modules it's linked with
+type guestInstance struct {
+	store    *wasmtime.Store
+	instance *wasmtime.Instance
+	hosts    []hostModule
+	access   *storeAccess
+
+	closeOnce  sync.Once
+	unregister func()
+}
+
+// instantiate creates an instance linked with hosts, which it owns from then
+// on, and calls its _initialize export if it has one. The store's epoch
+// deadline is set to deadline ticks.
+func (m *guestModule) instantiate(hosts []hostModule, deadline uint64) (*guestInstance, error) {
+	wasi, err := m.wasiConfig()
+	if err != nil {
+		closeHostModules(hosts)
+		return nil, err
+	}
+	store := wasmtime.NewStore(m.engine)
+	store.SetWasi(wasi)
+	store.SetEpochDeadline(deadline)
+	fuel := uint64(unlimitedFuel)
+	if m.limits.fuel != 0 {
+		fuel = m.limits.fuel
+	} else if m.fuel != nil {
+		fuel = m.fuel.capacity
+	}
+	if err := store.AddFuel(fuel); err != nil {
+		closeHostModules(hosts)
+		return nil, err
+	}
+
+	linker, err := m.link(store, hosts)
+	if err != nil {
+		closeHostModules(hosts)
+		return nil, err
+	}
+	access := &storeAccess{}
+	if m.calls != nil {
+		if err := m.calls.wrapImports(store, linker, m.engine, m.module, access); err != nil {
+			closeHostModules(hosts)
+			return nil, err
+		}
+	}
+	instance, err := linker.Instantiate(store, m.module)
+	if err != nil {
+		closeHostModules(hosts)
+		return nil, fmt.Errorf("failed to instantiate module: %v", err)
+	}
+
+	i := &guestInstance{store: store, instance: instance, hosts: hosts, access: access}
+	// the engine is the task's own, so an orphaned store interrupts no
+	// other task's guests
+	forceClose := func() {
+		m.engine.IncrementEpoch()
+		closeHostModules(hosts)
+	}
+	if i.unregister, err = m.instances.registerLimited(m.taskID, m.limits.instances, forceClose, i.copyMemory, access.memorySize); err != nil {
+		closeHostModules(hosts)
+		return nil, err
+	}
+
+	if limit := m.limits.memory; limit != 0 {
+		if size := uint64(len(i.memory())); size > limit {
+			i.Close()
+			return nil, fmt.Errorf("module's initial memory of %s exceeds the memory limit of %s", humanize.IBytes(size), humanize.IBytes(limit))
+		}
+	}
+	if m.preallocate {
+		if _, err := preallocateMemory(store, instance, m.limits.memory); err != nil {
+			i.Close()
+			return nil, err
+		}
+	}
+	if init := instance.GetFunc(store, initializeExport); init != nil {
+		if _, err := i.call(initializeExport); err != nil {
+			i.Close()
+			return nil, fmt.Errorf("failed to initialize module: %v", err)
+		}
+	}
+	i.recordMemory()
+	return i, nil
+}
+
+// memory returns the instance's exported linear memory, nil if it exports
+// none. It must be called from the goroutine using the store.
+func (i *guestInstance) memory() []byte {
+	ext := i.instance.GetExport(i.store, "memory")
+	if ext == nil || ext.Memory() == nil {
+		return nil
+	}
+	return ext.Memory().UnsafeData(i.store)
+}
+
+// storeAccess is how goroutines other than the guest's get at its store,
+// which can't be used from two goroutines at once: the guest records the
+// size of its memory for them, and runs the functions they queue at its
+// next host call or once its export returns.
+type storeAccess struct {
+	size uint64
+
+	lock    sync.Mutex
+	running bool
+	pending []*storeTask
+}
+
+// storeTask is a function queued to run on the guest's goroutine
+type storeTask struct {
+	fn   func()
+	done chan struct{}
+}
+
+func (a *storeAccess) setMemorySize(size uint64) {
+	atomic.StoreUint64(&a.size, size)
+}
+
+// memorySize returns the size of the memory when it was last recorded: at
+// instantiation, host calls and the return of exports
+func (a *storeAccess) memorySize() uint64 {
+	return atomic.LoadUint64(&a.size)
+}
+
+// enter marks the guest as running in the store until exit
+func (a *storeAccess) enter() {
+	a.lock.Lock()
+	a.running = true
+	a.lock.Unlock()
+}
+
+// exit marks the guest as no longer running and runs the queued functions
+func (a *storeAccess) exit() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.running = false
+	a.runPending()
+}
+
+// yield lets other goroutines use the store while the guest waits in a host
+// call, running the queued functions, until the returned func is called
+func (a *storeAccess) yield() func() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	running := a.running
+	a.running = false
+	a.runPending()
+	return func() {
+		a.lock.Lock()
+		a.running = running
+		a.lock.Unlock()
+	}
+}
+
+// hostCall runs the queued functions from a host call of the guest
+func (a *storeAccess) hostCall() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.runPending()
+}
+
+func (a *storeAccess) runPending() {
+	for _, t := range a.pending {
+		t.fn()
+		close(t.done)
+	}
+	a.pending = nil
+}
+
+// do runs fn with the store: right away if the guest isn't running in it,
+// otherwise on the guest's goroutine, failing if it doesn't get to fn
+// within timeout.
+func (a *storeAccess) do(fn func(), timeout time.Duration) error {
+	a.lock.Lock()
+	if !a.running {
+		defer a.lock.Unlock()
+		fn()
+		return nil
+	}
+	t := &storeTask{fn: fn, done: make(chan struct{})}
+	a.pending = append(a.pending, t)
+	a.lock.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return nil
+	case <-timer.C:
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for n, p := range a.pending {
+		if p == t {
+			a.pending = append(a.pending[:n], a.pending[n+1:]...)
+			return fmt.Errorf("the guest didn't make a host call within %s", timeout)
+		}
+	}
+	// it ran while the lock was released
+	return nil
+}
+
+// recordMemory records the size of the instance's memory, from the
+// goroutine using the store
+func (i *guestInstance) recordMemory() {
+	i.access.setMemorySize(uint64(len(i.memory())))
+}
+
+// memorySize returns the recorded size of the instance's memory
+func (i *guestInstance) memorySize() uint64 {
+	return i.access.memorySize()
+}
+
+// copyMemory returns a copy of at most max bytes of the instance's memory
+// and its size, taken with the store while the guest doesn't use it
+func (i *guestInstance) copyMemory(max int64, timeout time.Duration) (data []byte, size int64, err error) {
+	err = i.access.do(func() {
+		data, size = copyPrefix(i.memory(), max)
+		// the memory is only valid while the store is alive
+		runtime.KeepAlive(i.store)
+	}, timeout)
+	return data, size, err
+}
+
+// copyPrefix returns a copy of at most max bytes of data and its size
+func copyPrefix(data []byte, max int64) ([]byte, int64) {
+	n := int64(len(data))
+	if n > max {
+		n = max
+	}
+	return append([]byte(nil), data[:n]...), int64(len(data))
+}
+
+// call calls the export name with args
+func (i *guestInstance) call(name string, args ...interface{}) (interface{}, error) {
+	fn := i.instance.GetFunc(i.store, name)
+	if fn == nil {
+		return nil, fmt.Errorf("module doesn't export %q", name)
+	}
+	i.access.enter()
+	results, err := fn.Call(i.store, args...)
+	i.recordMemory()
+	i.access.exit()
+	return results, err
+}
+
+// Close releases the host modules of the instance. The store is freed by
+// wasmtime once it's finalized.
+func (i *guestInstance) Close() error {
+	var err error
+	i.closeOnce.Do(func() {
+		i.unregister()
+		err = closeHostModules(i.hosts)
+	})
+	return err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/hashicorp/nomad/helper/args"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// interpolationEnv returns the variables available to ${...} references in
+// the task config: the task's environment, plus meta.<key>, node.datacenter
+// and node.region derived from it. References to anything else are left as
+// is: node attributes and the other node fields aren't passed to plugins,
+// the Nomad client resolves them in the task config before it gets here.
+func interpolationEnv(cfg *drivers.TaskConfig) map[string]string {
+	env := make(map[string]string, len(cfg.Env))
+	for k, v := range cfg.Env {
+		env[k] = v
+		if strings.HasPrefix(k, "NOMAD_META_") {
+			env["meta."+strings.TrimPrefix(k, "NOMAD_META_")] = v
+		}
+	}
+	if dc, ok := cfg.Env["NOMAD_DC"]; ok {
+		env["node.datacenter"] = dc
+	}
+	if region, ok := cfg.Env["NOMAD_REGION"]; ok {
+		env["node.region"] = region
+	}
+	return env
+}
+
+// interpolateTaskConfig replaces the ${...} references in every string field
+// of driverConfig. It is evaluated at StartTask so values reflect the
+// allocation being started.
+func interpolateTaskConfig(cfg *drivers.TaskConfig, driverConfig *TaskConfig) {
+	env := interpolationEnv(cfg)
+	replace := func(s *string) {
+		*s = args.ReplaceEnv(*s, env)
+	}
+
+	replace(&driverConfig.File)
+	replace(&driverConfig.Image)
+	replace(&driverConfig.ImagePath)
+	replace(&driverConfig.Stdin)
+	replace(&driverConfig.Entrypoint)
+	for i, arg := range driverConfig.CallArgs {
+		if s, ok := arg.(string); ok {
+			driverConfig.CallArgs[i] = args.ReplaceEnv(s, env)
+		}
+	}
+	if n := driverConfig.Notify; n != nil {
+		replace(&n.URL)
+	}
+	replace(&driverConfig.SQL.DSN)
+	replace(&driverConfig.SQL.DSNFile)
+	for i := range driverConfig.Secrets.Paths {
+		replace(&driverConfig.Secrets.Paths[i])
+	}
+	for i := range driverConfig.Args {
+		replace(&driverConfig.Args[i])
+	}
+	for k, v := range driverConfig.Env {
+		driverConfig.Env[k] = args.ReplaceEnv(v, env)
+	}
+	for k, v := range driverConfig.WASI.Preopens {
+		driverConfig.WASI.Preopens[k] = args.ReplaceEnv(v, env)
+	}
+	for i := range driverConfig.Mounts {
+		replace(&driverConfig.Mounts[i].HostPath)
+		replace(&driverConfig.Mounts[i].GuestPath)
+	}
+	replace(&driverConfig.Serve.ReloadFile)
+	for k, v := range driverConfig.Serve.Routes {
+		driverConfig.Serve.Routes[k] = args.ReplaceEnv(v, env)
+	}
+	for i := range driverConfig.HTTP.AllowedHosts {
+		replace(&driverConfig.HTTP.AllowedHosts[i])
+	}
+	for i := range driverConfig.HTTP.Rewrite {
+		replace(&driverConfig.HTTP.Rewrite[i].Address)
+	}
+	if c := driverConfig.HTTP.ClientCert; c != nil {
+		replace(&c.CertFile)
+		replace(&c.KeyFile)
+		replace(&c.CAFile)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterpolateTaskConfig(t *testing.T) {
+	cfg := &drivers.TaskConfig{
+		Env: map[string]string{
+			"NOMAD_TASK_NAME":   "web",
+			"NOMAD_DC":          "dc1",
+			"NOMAD_META_bucket": "releases",
+			"NOMAD_ALLOC_DIR":   "/alloc",
+		},
+	}
+
+	driverConfig := &TaskConfig{
+		File:       "${NOMAD_ALLOC_DIR}/${NOMAD_TASK_NAME}.wasm",
+		Image:      "registry.${node.datacenter}.example.com/${meta.bucket}/app",
+		ImagePath:  "/${attr.cpu.arch}/app.wasm",
+		SQL:        SQLConfig{DSNFile: "${NOMAD_SECRETS_DIR}/dsn"},
+		Secrets:    TaskSecretsConfig{Paths: []string{"secret/data/${NOMAD_TASK_NAME}/"}},
+		Args:       []string{"--name", "${NOMAD_TASK_NAME}"},
+		Stdin:      "local/${meta.bucket}.json",
+		Entrypoint: "handle_${meta.bucket}",
+		CallArgs:   []interface{}{"${NOMAD_DC}", 42},
+		Mounts:     []TaskMountConfig{{HostPath: "/srv/${meta.bucket}", GuestPath: "/${NOMAD_TASK_NAME}"}},
+		Env:        map[string]string{"DATA": "${NOMAD_ALLOC_DIR}/data"},
+		WASI:       TaskWASIConfig{Preopens: map[string]string{"/cache": "${meta.bucket}"}},
+		HTTP:       TaskHTTPConfig{AllowedHosts: []string{"${NOMAD_DC}.example.com"}},
+	}
+	interpolateTaskConfig(cfg, driverConfig)
+
+	require.Equal(t, "/alloc/web.wasm", driverConfig.File)
+	require.Equal(t, "registry.dc1.example.com/releases/app", driverConfig.Image)
+	require.Equal(t, []string{"secret/data/web/"}, driverConfig.Secrets.Paths)
+	require.Equal(t, []string{"--name", "web"}, driverConfig.Args)
+	require.Equal(t, "local/releases.json", driverConfig.Stdin)
+	require.Equal(t, "handle_releases", driverConfig.Entrypoint)
+	require.Equal(t, []interface{}{"dc1", 42}, driverConfig.CallArgs)
+	require.Equal(t, []TaskMountConfig{{HostPath: "/srv/releases", GuestPath: "/web"}}, driverConfig.Mounts)
+	require.EqualValues(t, map[string]string{"DATA": "/alloc/data"}, driverConfig.Env)
+	require.EqualValues(t, map[string]string{"/cache": "releases"}, driverConfig.WASI.Preopens)
+	require.Equal(t, []string{"dc1.example.com"}, driverConfig.HTTP.AllowedHosts)
+
+	// unknown references are left alone
+	require.Equal(t, "/${attr.cpu.arch}/app.wasm", driverConfig.ImagePath)
+	require.Equal(t, "${NOMAD_SECRETS_DIR}/dsn", driverConfig.SQL.DSNFile)
+}
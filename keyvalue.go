@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	consul "github.com/hashicorp/consul/api"
+)
+
+const (
+	kvBackendConsul = "consul"
+	kvBackendRedis  = "redis"
+)
+
+// errKVNotFound is returned by kvBackend.Get for missing keys
+var errKVNotFound = errors.New("key not found")
+
+// kvBackend is a store behind the keyvalue host functions. Backends are
+// shared by all tasks, which are isolated from each other by key prefixes.
+type kvBackend interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte) error
+	Delete(ctx context.Context, key string) error
+
+	// Keys returns every key starting with prefix
+	Keys(ctx context.Context, prefix string) ([]string, error)
+
+	Close() error
+}
+
+// newKVBackends returns the backends configured by cfg, keyed by name. Consul
+// is always available since its defaults come from the environment.
+func newKVBackends(cfg KeyValueConfig) (map[string]kvBackend, error) {
+	backends := map[string]kvBackend{}
+
+	c, err := newConsulKV(cfg.Consul)
+	if err != nil {
+		return nil, err
+	}
+	backends[kvBackendConsul] = c
+
+	if cfg.Redis.Address != "" {
+		r, err := newRedisKV(cfg.Redis)
+		if err != nil {
+			return nil, err
+		}
+		backends[kvBackendRedis] = r
+	}
+	return backends, nil
+}
+
+// closeKVBackends closes every backend in backends, returning the last error.
+func closeKVBackends(backends map[string]kvBackend) error {
+	var lastErr error
+	for _, b := range backends {
+		if err := b.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// consulKV stores keys in Consul KV
+type consulKV struct {
+	kv *consul.KV
+}
+
+func newConsulKV(cfg ConsulKVConfig) (*consulKV, error) {
+	config := consul.DefaultConfig()
+	if cfg.Address != "" {
+		config.Address = cfg.Address
+	}
+	if cfg.Token != "" {
+		config.Token = cfg.Token
+	}
+
+	client, err := consul.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consul client: %v", err)
+	}
+	return &consulKV{kv: client.KV()}, nil
+}
+
+func (c *consulKV) Get(ctx context.Context, key string) ([]byte, error) {
+	pair, _, err := c.kv.Get(key, (&consul.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil {
+		return nil, errKVNotFound
+	}
+	return pair.Value, nil
+}
+
+func (c *consulKV) Set(ctx context.Context, key string, value []byte) error {
+	_, err := c.kv.Put(&consul.KVPair{Key: key, Value: value}, (&consul.WriteOptions{}).WithContext(ctx))
+	return err
+}
+
+func (c *consulKV) Delete(ctx context.Context, key string) error {
+	_, err := c.kv.Delete(key, (&consul.WriteOptions{}).WithContext(ctx))
+	return err
+}
+
+func (c *consulKV) Keys(ctx context.Context, prefix string) ([]string, error) {
+	keys, _, err := c.kv.Keys(prefix, "", (&consul.QueryOptions{}).WithContext(ctx))
+	return keys, err
+}
+
+func (c *consulKV) Close() error {
+	return nil
+}
+
+// redisKV stores keys in Redis
+type redisKV struct {
+	client *redis.Client
+}
+
+func newRedisKV(cfg RedisKVConfig) (*redisKV, error) {
+	opts := &redis.Options{
+		Addr:     cfg.Address,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	}
+
+	if cfg.TLS {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if cfg.TLSCAFile != "" {
+			pem, err := ioutil.ReadFile(cfg.TLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read redis tls_ca_file: %v", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in redis tls_ca_file %q", cfg.TLSCAFile)
+			}
+			opts.TLSConfig.RootCAs = pool
+		}
+	}
+
+	return &redisKV{client: redis.NewClient(opts)}, nil
+}
+
+func (r *redisKV) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := r.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, errKVNotFound
+	}
+	return b, err
+}
+
+func (r *redisKV) Set(ctx context.Context, key string, value []byte) error {
+	return r.client.Set(ctx, key, value, 0).Err()
+}
+
+func (r *redisKV) Delete(ctx context.Context, key string) error {
+	return r.client.Del(ctx, key).Err()
+}
+
+func (r *redisKV) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	iter := r.client.Scan(ctx, 0, redisGlobEscape(prefix)+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+func (r *redisKV) Close() error {
+	return r.client.Close()
+}
+
+// redisGlobEscape escapes the characters of s that are special in a SCAN
+// MATCH pattern
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeConsul serves the subset of the Consul KV HTTP API used by
+// consulKV from memory
+func newFakeConsul(t *testing.T) *httptest.Server {
+	var lock sync.Mutex
+	kv := map[string][]byte{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		switch r.Method {
+		case http.MethodGet:
+			if _, ok := r.URL.Query()["keys"]; ok {
+				keys := []string{}
+				for k := range kv {
+					if strings.HasPrefix(k, key) {
+						keys = append(keys, k)
+					}
+				}
+				sort.Strings(keys)
+				json.NewEncoder(w).Encode(keys)
+				return
+			}
+			v, ok := kv[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode([]*consul.KVPair{{Key: key, Value: v}})
+		case http.MethodPut:
+			kv[key], _ = io.ReadAll(r.Body)
+			w.Write([]byte("true"))
+		case http.MethodDelete:
+			delete(kv, key)
+			w.Write([]byte("true"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestRedisKV(t *testing.T) (*miniredis.Miniredis, kvBackend) {
+	mr := miniredis.RunT(t)
+	kv, err := newRedisKV(RedisKVConfig{Address: mr.Addr()})
+	require.NoError(t, err)
+	t.Cleanup(func() { kv.Close() })
+	return mr, kv
+}
+
+func TestKVBackends(t *testing.T) {
+	srv := newFakeConsul(t)
+	_, redisKV := newTestRedisKV(t)
+
+	consulKV, err := newConsulKV(ConsulKVConfig{Address: strings.TrimPrefix(srv.URL, "http://")})
+	require.NoError(t, err)
+
+	for name, kv := range map[string]kvBackend{kvBackendConsul: consulKV, kvBackendRedis: redisKV} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			_, err := kv.Get(ctx, "a/missing")
+			require.ErrorIs(t, err, errKVNotFound)
+
+			require.NoError(t, kv.Set(ctx, "a/one", []byte("1")))
+			require.NoError(t, kv.Set(ctx, "a/two", []byte("2")))
+			require.NoError(t, kv.Set(ctx, "a*/three", []byte("3")))
+
+			v, err := kv.Get(ctx, "a/one")
+			require.NoError(t, err)
+			require.Equal(t, "1", string(v))
+
+			keys, err := kv.Keys(ctx, "a/")
+			require.NoError(t, err)
+			sort.Strings(keys)
+			require.Equal(t, []string{"a/one", "a/two"}, keys)
+
+			// glob characters in the prefix are literal
+			keys, err = kv.Keys(ctx, "a*/")
+			require.NoError(t, err)
+			require.Equal(t, []string{"a*/three"}, keys)
+
+			require.NoError(t, kv.Delete(ctx, "a/one"))
+			_, err = kv.Get(ctx, "a/one")
+			require.ErrorIs(t, err, errKVNotFound)
+		})
+	}
+}
+
+func TestNewKVBackends(t *testing.T) {
+	backends, err := newKVBackends(KeyValueConfig{})
+	require.NoError(t, err)
+	require.Contains(t, backends, kvBackendConsul)
+	require.NotContains(t, backends, kvBackendRedis)
+
+	_, err = newKVBackends(KeyValueConfig{Redis: RedisKVConfig{Address: "localhost:6379", TLS: true, TLSCAFile: "/nonexistent"}})
+	require.Error(t, err)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+const (
+	// defaultLeakSweepInterval is used when the plugin config doesn't set
+	// leak_detection.interval
+	defaultLeakSweepInterval = 5 * time.Minute
+
+	// leakGracePeriod is how old an instance must be before it's considered
+	// orphaned, since instances are created before their task is stored
+	leakGracePeriod = time.Minute
+)
+
+// liveInstance is a wasmtime store, with the instances and host modules
+// created in it, owned by a task
+type liveInstance struct {
+	id      uint64
+	taskID  string
+	created time.Time
+
+	// close interrupts the guest running in the store, if its epoch
+	// deadline is the next tick as for tasks run to completion, and closes
+	// its host modules. Wasmtime frees the store itself once it's no longer
+	// referenced, which the leaked handle may still prevent.
+	close func()
+
+	// memory returns a copy of at most max bytes of the linear memory of
+	// the store's instance and its size, if it can be dumped, failing if
+	// the store isn't free within timeout
+	memory func(max int64, timeout time.Duration) ([]byte, int64, error)
+
+	// memorySize returns the size of the memory as recorded by the guest,
+	// which the stats may read while it runs
+	memorySize func() uint64
+}
+
+// instanceRegistry tracks every live store so the ones outliving their task
+// can be found. Wasmtime only frees a store once it's unreachable and
+// finalized, which a handle leaked by a bug in the driver prevents.
+type instanceRegistry struct {
+	lock sync.Mutex
+	next uint64
+	live map[uint64]*liveInstance
+
+	// now is overridden in tests
+	now func() time.Time
+}
+
+func newInstanceRegistry() *instanceRegistry {
+	return &instanceRegistry{
+		live: map[uint64]*liveInstance{},
+		now:  time.Now,
+	}
+}
+
+// register records a store created for taskID, released with close. The
+// returned func must be called once the store is no longer used and may be
+// called more than once.
+func (r *instanceRegistry) register(taskID string, close func()) func() {
+	return r.registerWithMemory(taskID, close, nil)
+}
+
+// registerWithMemory is like register, with memory returning the linear
+// memory of the store's instance so it can be dumped. It must be safe to
+// read from any goroutine.
+func (r *instanceRegistry) registerWithMemory(taskID string, close func(), memory func() []byte) func() {
+	copyMemory := func(max int64, timeout time.Duration) ([]byte, int64, error) {
+		data, size := copyPrefix(memory(), max)
+		return data, size, nil
+	}
+	unregister, _ := r.registerLimited(taskID, 0, close, copyMemory, nil)
+	return unregister
+}
+
+// registerLimited records a store like register, with memory copying its
+// memory and size returning its recorded size, but fails if taskID already
+// has limit live stores, if set
+func (r *instanceRegistry) registerLimited(taskID string, limit int, close func(), memory func(max int64, timeout time.Duration) ([]byte, int64, error), size func() uint64) (func(), error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if limit != 0 {
+		n := 0
+		for _, i := range r.live {
+			if i.taskID == taskID {
+				n++
+			}
+		}
+		if n >= limit {
+			return nil, fmt.Errorf("task is at its max_instances of %d", limit)
+		}
+	}
+	r.next++
+	id := r.next
+	r.live[id] = &liveInstance{id: id, taskID: taskID, created: r.now(), close: close, memory: memory, memorySize: size}
+	return func() { r.remove(id) }, nil
+}
+
+// newest returns the most recently created store of taskID whose memory can
+// be dumped, or nil
+func (r *instanceRegistry) newest(taskID string) *liveInstance {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var newest *liveInstance
+	for _, i := range r.live {
+		if i.taskID == taskID && i.memory != nil && (newest == nil || i.id > newest.id) {
+			newest = i
+		}
+	}
+	return newest
+}
+
+// memorySize returns the total recorded size of the linear memories of the
+// stores of taskID
+func (r *instanceRegistry) memorySize(taskID string) uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var size uint64
+	for _, i := range r.live {
+		if i.taskID == taskID && i.memorySize != nil {
+			size += i.memorySize()
+		}
+	}
+	return size
+}
+
+func (r *instanceRegistry) remove(id uint64) *liveInstance {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	i := r.live[id]
+	delete(r.live, id)
+	return i
+}
+
+// count returns the number of live stores
+func (r *instanceRegistry) count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.live)
+}
+
+// orphans returns the stores older than the grace period whose task isn't
+// known according to taskExists.
+func (r *instanceRegistry) orphans(taskExists func(taskID string) bool) []*liveInstance {
+	r.lock.Lock()
+	var candidates []*liveInstance
+	for _, i := range r.live {
+		if r.now().Sub(i.created) >= leakGracePeriod {
+			candidates = append(candidates, i)
+		}
+	}
+	r.lock.Unlock()
+
+	// taskExists is called without the lock held since it may take the
+	// task store's
+	var orphans []*liveInstance
+	for _, i := range candidates {
+		if !taskExists(i.taskID) {
+			orphans = append(orphans, i)
+		}
+	}
+	return orphans
+}
+
+// sweepInstances logs and counts the stores whose task is gone, closing them
+// and dropping them from the registry if forceClose is set. It returns the
+// number of orphans found.
+func (d *Driver) sweepInstances(forceClose bool) int {
+	orphans := d.instances.orphans(func(taskID string) bool {
+		_, ok := d.tasks.Get(taskID)
+		return ok
+	})
+
+	for _, i := range orphans {
+		d.logger.Warn("found wasmtime store without a task", "task_id", i.taskID,
+			"age", d.instances.now().Sub(i.created).Round(time.Second), "force_close", forceClose)
+		if forceClose && d.instances.remove(i.id) != nil {
+			i.close()
+			metrics.IncrCounter([]string{"wasmtime", "instances", "closed"}, 1)
+		}
+	}
+
+	metrics.IncrCounter([]string{"wasmtime", "instances", "orphaned"}, float32(len(orphans)))
+	metrics.SetGauge([]string{"wasmtime", "instances", "live"}, float32(d.instances.count()))
+	return len(orphans)
+}
+
+// detectLeaks sweeps the live stores every interval until ctx is done
+func (d *Driver) detectLeaks(ctx context.Context, interval time.Duration, forceClose bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.sweepInstances(forceClose)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstanceRegistry_Sweep(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	now := time.Now()
+	d.instances.now = func() time.Time { return now }
+
+	var closed []string
+	closer := func(id string) func() {
+		return func() { closed = append(closed, id) }
+	}
+
+	d.tasks.Set("running", &TaskHandle{})
+	d.instances.register("running", closer("running"))
+	d.instances.register("gone", closer("gone"))
+	release := d.instances.register("released", closer("released"))
+	release()
+	release()
+	require.Equal(t, 2, d.instances.count())
+
+	// new stores may belong to tasks that are still starting
+	require.Zero(t, d.sweepInstances(true))
+
+	now = now.Add(leakGracePeriod)
+	d.instances.register("starting", closer("starting"))
+	require.Equal(t, 1, d.sweepInstances(false))
+	require.Empty(t, closed)
+	require.Equal(t, 3, d.instances.count())
+
+	require.Equal(t, 1, d.sweepInstances(true))
+	require.Equal(t, []string{"gone"}, closed)
+	require.Equal(t, 2, d.instances.count())
+	require.Zero(t, d.sweepInstances(true))
+}
+
+func TestInstanceRegistry_Config(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir()}))
+	require.NotNil(t, d.stopLeakDetection)
+
+	require.NoError(t, setConfig(t, d, &Config{
+		DataDir:       d.artifacts.dir,
+		LeakDetection: LeakDetectionConfig{Interval: "0"},
+	}))
+	require.Nil(t, d.stopLeakDetection)
+
+	require.Error(t, setConfig(t, d, &Config{
+		DataDir:       d.artifacts.dir,
+		LeakDetection: LeakDetectionConfig{Interval: "often"},
+	}))
+}
+
+func TestInstanceRegistry_RegisterLimited(t *testing.T) {
+	r := newInstanceRegistry()
+	release, err := r.registerLimited("task", 2, func() {}, nil, nil)
+	require.NoError(t, err)
+	_, err = r.registerLimited("task", 2, func() {}, nil, nil)
+	require.NoError(t, err)
+	_, err = r.registerLimited("other", 2, func() {}, nil, nil)
+	require.NoError(t, err)
+
+	_, err = r.registerLimited("task", 2, func() {}, nil, nil)
+	require.EqualError(t, err, "task is at its max_instances of 2")
+	require.Equal(t, 3, r.count())
+
+	release()
+	_, err = r.registerLimited("task", 2, func() {}, nil, nil)
+	require.NoError(t, err)
+	_, err = r.registerLimited("task", 0, func() {}, nil, nil)
+	require.NoError(t, err)
+}
+
+func TestInstanceRegistry_MemorySize(t *testing.T) {
+	r := newInstanceRegistry()
+	r.registerLimited("task", 0, func() {}, func(int64, time.Duration) ([]byte, int64, error) { panic("memory read from the stats") }, func() uint64 { return 2 * wasmPageSize })
+	r.registerLimited("task", 0, func() {}, nil, func() uint64 { return wasmPageSize })
+	r.registerLimited("other", 0, func() {}, nil, func() uint64 { return wasmPageSize })
+	r.register("task", func() {})
+	require.Equal(t, uint64(3*wasmPageSize), r.memorySize("task"))
+}
+
+func TestSweepInstances_InterruptsOrphanedGuest(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := startTestTask(t, d, loopWat, &TaskConfig{})
+	h, ok := d.tasks.Get(cfg.ID)
+	require.True(t, ok)
+
+	// the handle leaks: the task is gone but its guest keeps running
+	d.tasks.Delete(cfg.ID)
+	now := time.Now().Add(leakGracePeriod)
+	d.instances.now = func() time.Time { return now }
+	require.Equal(t, 1, d.sweepInstances(true))
+
+	select {
+	case <-h.guest.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("guest wasn't interrupted")
+	}
+	require.Zero(t, d.instances.count())
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// taskLimits are the parsed limits of a task. Zero values mean unlimited.
+type taskLimits struct {
+	// memory is the maximum size of the guest's linear memory in bytes
+	memory uint64
+
+	// fuel is the number of fuel units the guest may consume
+	fuel uint64
+
+	// deadline is how long the guest may run
+	deadline time.Duration
+
+	// tables is the number of tables the module may declare,
+	// tableElements the maximum size of each
+	tables        int
+	tableElements uint64
+
+	// instances is the number of instances the task may have at once
+	instances int
+}
+
+// capMemory lowers the memory limit to allocated, the memory Nomad allocated
+// to the task, unless it's unknown or the limit is already lower
+func (l *taskLimits) capMemory(allocated uint64) {
+	if allocated != 0 && (l.memory == 0 || allocated < l.memory) {
+		l.memory = allocated
+	}
+}
+
+func parseTaskLimits(cfg TaskLimitsConfig) (*taskLimits, error) {
+	var limits taskLimits
+
+	if cfg.Memory != "" {
+		memory, err := humanize.ParseBytes(cfg.Memory)
+		if err != nil {
+			return nil, fmt.Errorf("invalid memory limit %q: %v", cfg.Memory, err)
+		}
+		limits.memory = memory
+	}
+
+	if cfg.Fuel < 0 {
+		return nil, fmt.Errorf("invalid fuel limit %d: must not be negative", cfg.Fuel)
+	}
+	limits.fuel = uint64(cfg.Fuel)
+
+	if cfg.Deadline != "" {
+		deadline, err := time.ParseDuration(cfg.Deadline)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deadline %q: %v", cfg.Deadline, err)
+		}
+		if deadline < 0 {
+			return nil, fmt.Errorf("invalid deadline %q: must not be negative", cfg.Deadline)
+		}
+		limits.deadline = deadline
+	}
+
+	// wasmtime-go doesn't expose the stack limit of the engine, and a limit
+	// that isn't applied would only hide how deep guests may recurse
+	if cfg.MaxStackSize != "" {
+		return nil, fmt.Errorf("max_stack_size isn't supported by this version of wasmtime, remove it from the limits")
+	}
+	for _, n := range []struct {
+		name  string
+		value int64
+	}{
+		{"max_tables", int64(cfg.MaxTables)},
+		{"max_table_elements", cfg.MaxTableElements},
+		{"max_instances", int64(cfg.MaxInstances)},
+	} {
+		if n.value < 0 {
+			return nil, fmt.Errorf("invalid %s %d: must not be negative", n.name, n.value)
+		}
+	}
+	limits.tables = cfg.MaxTables
+	limits.tableElements = uint64(cfg.MaxTableElements)
+	limits.instances = cfg.MaxInstances
+
+	return &limits, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTaskLimits(t *testing.T) {
+	limits, err := parseTaskLimits(TaskLimitsConfig{})
+	require.NoError(t, err)
+	require.Equal(t, &taskLimits{}, limits)
+
+	limits, err = parseTaskLimits(TaskLimitsConfig{Memory: "64MiB", Fuel: 1000, Deadline: "1m"})
+	require.NoError(t, err)
+	require.Equal(t, &taskLimits{memory: 64 << 20, fuel: 1000, deadline: time.Minute}, limits)
+
+	limits, err = parseTaskLimits(TaskLimitsConfig{MaxTables: 2, MaxTableElements: 1000, MaxInstances: 4})
+	require.NoError(t, err)
+	require.Equal(t, &taskLimits{tables: 2, tableElements: 1000, instances: 4}, limits)
+
+	// the stack limit can't be applied by this version of wasmtime
+	_, err = parseTaskLimits(TaskLimitsConfig{MaxStackSize: "512KiB"})
+	require.EqualError(t, err, "max_stack_size isn't supported by this version of wasmtime, remove it from the limits")
+
+	for _, cfg := range []TaskLimitsConfig{
+		{Memory: "lots"},
+		{Fuel: -1},
+		{Deadline: "soon"},
+		{Deadline: "-1s"},
+		{MaxTables: -1},
+		{MaxTableElements: -1},
+		{MaxInstances: -1},
+	} {
+		_, err := parseTaskLimits(cfg)
+		require.Error(t, err, "%+v", cfg)
+	}
+}
+
+func TestTaskLimits_CapMemory(t *testing.T) {
+	limits := &taskLimits{}
+	limits.capMemory(0)
+	require.Zero(t, limits.memory)
+	limits.capMemory(64 << 20)
+	require.Equal(t, uint64(64<<20), limits.memory)
+	limits.capMemory(128 << 20)
+	require.Equal(t, uint64(64<<20), limits.memory)
+	limits.capMemory(32 << 20)
+	require.Equal(t, uint64(32<<20), limits.memory)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// zoneinfoDir is where the task's tzdata is copied to, in the task dir,
+	// and zoneinfoGuestPath where the guest sees it
+	zoneinfoDir       = ".zoneinfo"
+	zoneinfoGuestPath = "/usr/share/zoneinfo"
+)
+
+// hostZoneinfoDirs are where the host's tzdata is looked up
+var hostZoneinfoDirs = []string{"/usr/share/zoneinfo", "/usr/lib/zoneinfo", "/usr/share/lib/zoneinfo"}
+
+// localePattern matches POSIX locale names, e.g. "C", "en_US.UTF-8" or
+// "sr_RS@latin"
+var localePattern = regexp.MustCompile(`^(C|POSIX|[a-zA-Z]{2,3}(_[a-zA-Z]{2})?)(\.[a-zA-Z0-9-]+)?(@[a-zA-Z0-9]+)?$`)
+
+// validateLocale checks the task's locale, if set
+func validateLocale(locale string) error {
+	if locale != "" && !localePattern.MatchString(locale) {
+		return fmt.Errorf("invalid locale %q", locale)
+	}
+	return nil
+}
+
+// localeEnv returns the variables the guest learns its timezone and locale
+// from
+func localeEnv(driverConfig *TaskConfig) map[string]string {
+	env := map[string]string{}
+	if driverConfig.Timezone != "" {
+		env["TZ"] = driverConfig.Timezone
+	}
+	if driverConfig.Locale != "" {
+		env["LANG"] = driverConfig.Locale
+	}
+	return env
+}
+
+// hostZoneinfo returns the host's tzdata file of the IANA timezone name
+func hostZoneinfo(name string) (string, error) {
+	if name != path.Clean(name) || path.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("invalid timezone %q", name)
+	}
+	if _, err := time.LoadLocation(name); err != nil {
+		return "", fmt.Errorf("invalid timezone %q: %v", name, err)
+	}
+	for _, dir := range hostZoneinfoDirs {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if fi, err := os.Stat(file); err == nil && fi.Mode().IsRegular() {
+			return file, nil
+		}
+	}
+	return "", fmt.Errorf("timezone %q has no tzdata on the client", name)
+}
+
+// timezonePreopen copies the tzdata of the task's timezone, if set, to the
+// task dir and returns its preopen at /usr/share/zoneinfo, so the guest
+// only sees its own timezone
+func timezonePreopen(cfg *drivers.TaskConfig, timezone string) (*preopen, error) {
+	if timezone == "" {
+		return nil, nil
+	}
+	src, err := hostZoneinfo(timezone)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tzdata of %q: %v", timezone, err)
+	}
+
+	dir := filepath.Join(cfg.TaskDir().Dir, zoneinfoDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to clear tzdata dir: %v", err)
+	}
+	dst := filepath.Join(dir, filepath.FromSlash(timezone))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create tzdata dir: %v", err)
+	}
+	if err := ioutil.WriteFile(dst, data, 0444); err != nil {
+		return nil, fmt.Errorf("failed to copy tzdata of %q: %v", timezone, err)
+	}
+	return &preopen{HostPath: dir, GuestPath: zoneinfoGuestPath, Readonly: true}, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateLocale(t *testing.T) {
+	for _, locale := range []string{"", "C", "POSIX", "en_US.UTF-8", "fr_FR", "sr_RS@latin", "de"} {
+		require.NoError(t, validateLocale(locale), locale)
+	}
+	for _, locale := range []string{"en US", "en_US.UTF-8; rm", "../C"} {
+		require.Error(t, validateLocale(locale), locale)
+	}
+}
+
+func TestTimezonePreopen(t *testing.T) {
+	if _, err := hostZoneinfo("Europe/Paris"); err != nil {
+		t.Skip("no tzdata on the host")
+	}
+	cfg := &drivers.TaskConfig{AllocDir: t.TempDir(), Name: "task"}
+	require.NoError(t, os.MkdirAll(cfg.TaskDir().Dir, 0755))
+
+	p, err := timezonePreopen(cfg, "")
+	require.NoError(t, err)
+	require.Nil(t, p)
+
+	p, err = timezonePreopen(cfg, "Europe/Paris")
+	require.NoError(t, err)
+	require.Equal(t, zoneinfoGuestPath, p.GuestPath)
+	require.True(t, p.Readonly)
+	data, err := ioutil.ReadFile(filepath.Join(p.HostPath, "Europe", "Paris"))
+	require.NoError(t, err)
+	require.Equal(t, "TZif", string(data[:4]))
+
+	// only the task's own timezone is there after a restart changed it
+	p, err = timezonePreopen(cfg, "UTC")
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(p.HostPath, "UTC"))
+	require.NoDirExists(t, filepath.Join(p.HostPath, "Europe"))
+
+	for _, name := range []string{"Mars/Olympus", "../etc/passwd", "/etc/localtime", "Local"} {
+		_, err := timezonePreopen(cfg, name)
+		require.Error(t, err, name)
+	}
+}
+
+func TestGuestEnv_Locale(t *testing.T) {
+	cfg := &drivers.TaskConfig{}
+	env, err := guestEnv(cfg, &TaskConfig{Timezone: "Europe/Paris", Locale: "fr_FR.UTF-8"}, &restartAttempt{})
+	require.NoError(t, err)
+	require.Equal(t, "Europe/Paris", env["TZ"])
+	require.Equal(t, "fr_FR.UTF-8", env["LANG"])
+
+	// env overrides them
+	env, err = guestEnv(cfg, &TaskConfig{Locale: "fr_FR.UTF-8", Env: map[string]string{"LANG": "C"}}, &restartAttempt{})
+	require.NoError(t, err)
+	require.Equal(t, "C", env["LANG"])
+	require.NotContains(t, env, "TZ")
+}
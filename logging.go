@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+var _ drivers.InternalCapabilitiesDriver = (*Driver)(nil)
+
+// InternalCapabilities tells Nomad to skip its log collection when it's
+// disabled in the plugin config. Nomad only consults it for drivers built
+// into the client, so external log setups rely on the stream files below.
+func (d *Driver) InternalCapabilities() drivers.InternalCapabilities {
+	d.configLock.RLock()
+	defer d.configLock.RUnlock()
+	return drivers.InternalCapabilities{
+		DisableLogCollection: d.config.Logging.DisableCollection,
+	}
+}
+
+// logStreams are the files a task's output is written to
+type logStreams struct {
+	Stdout string
+	Stderr string
+
+	// Raw is set if the files are plain files read by an external log
+	// shipper rather than the FIFOs of Nomad's logmon
+	Raw bool
+
+	// MergeStderr is set if the guest's stderr goes to Stdout
+	MergeStderr bool
+
+	// StdoutSpool and StderrSpool are where the guest writes when its output
+	// goes to the FIFOs. The spools outlive the plugin, so output written
+	// while it's down is forwarded once the task is recovered.
+	StdoutSpool string
+	StderrSpool string
+}
+
+// spooled returns whether the output is spooled before reaching Nomad
+func (s *logStreams) spooled() bool {
+	return s != nil && !s.Raw && s.StdoutSpool != ""
+}
+
+// pointerPath returns where the log pointer of the spools is saved
+func (s *logStreams) pointerPath() string {
+	return filepath.Join(filepath.Dir(s.StdoutSpool), logPointerFile)
+}
+
+// attributes returns the stream paths as status attributes, so external
+// shippers can find them. The FIFOs are Nomad's business and not exposed.
+func (s *logStreams) attributes() map[string]string {
+	if s == nil || !s.Raw {
+		return nil
+	}
+	return map[string]string{
+		"log.stdout": s.Stdout,
+		"log.stderr": s.Stderr,
+	}
+}
+
+// taskLogStreams returns where the output of the task goes: the FIFOs read
+// by Nomad's logmon through spools in the task dir, or plain files created
+// for an external shipper if log collection is disabled.
+func taskLogStreams(config LoggingConfig, cfg *drivers.TaskConfig, mergeStderr bool) (*logStreams, error) {
+	if !config.DisableCollection {
+		stdout, stderr, err := logSpools(cfg.TaskDir().Dir)
+		if err != nil {
+			return nil, err
+		}
+		return &logStreams{
+			Stdout:      cfg.StdoutPath,
+			Stderr:      cfg.StderrPath,
+			StdoutSpool: stdout,
+			StderrSpool: stderr,
+			MergeStderr: mergeStderr,
+		}, nil
+	}
+
+	var dir string
+	if config.StreamDir != "" {
+		dir = filepath.Join(config.StreamDir, cfg.AllocID)
+	} else {
+		dir = cfg.TaskDir().LogDir
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log stream dir: %v", err)
+	}
+
+	streams := &logStreams{
+		Stdout:      filepath.Join(dir, cfg.Name+".stdout"),
+		Stderr:      filepath.Join(dir, cfg.Name+".stderr"),
+		Raw:         true,
+		MergeStderr: mergeStderr,
+	}
+	for _, path := range []string{streams.Stdout, streams.Stderr} {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create log stream: %v", err)
+		}
+		f.Close()
+	}
+	return streams, nil
+}
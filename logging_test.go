@@ -0,0 +1,67 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskLogStreams(t *testing.T) {
+	allocDir := t.TempDir()
+	cfg := &drivers.TaskConfig{
+		ID:         "id",
+		AllocID:    "alloc",
+		Name:       "task",
+		AllocDir:   allocDir,
+		StdoutPath: "/fifo/stdout",
+		StderrPath: "/fifo/stderr",
+	}
+
+	// Nomad's FIFOs by default
+	streams, err := taskLogStreams(LoggingConfig{}, cfg, false)
+	require.NoError(t, err)
+	spoolDir := filepath.Join(allocDir, "task", logSpoolDir)
+	require.Equal(t, &logStreams{
+		Stdout:      "/fifo/stdout",
+		Stderr:      "/fifo/stderr",
+		StdoutSpool: filepath.Join(spoolDir, "stdout"),
+		StderrSpool: filepath.Join(spoolDir, "stderr"),
+	}, streams)
+	require.True(t, streams.spooled())
+	require.FileExists(t, streams.StdoutSpool)
+	require.Empty(t, streams.attributes())
+
+	// files in the alloc's log dir when collection is disabled
+	streams, err = taskLogStreams(LoggingConfig{DisableCollection: true}, cfg, false)
+	require.NoError(t, err)
+	require.True(t, streams.Raw)
+	require.False(t, streams.spooled())
+	require.Equal(t, filepath.Join(allocDir, "alloc", "logs", "task.stdout"), streams.Stdout)
+	require.FileExists(t, streams.Stdout)
+	require.FileExists(t, streams.Stderr)
+
+	streamDir := t.TempDir()
+	streams, err = taskLogStreams(LoggingConfig{DisableCollection: true, StreamDir: streamDir}, cfg, false)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"log.stdout": filepath.Join(streamDir, "alloc", "task.stdout"),
+		"log.stderr": filepath.Join(streamDir, "alloc", "task.stderr"),
+	}, streams.attributes())
+
+	h := &TaskHandle{taskConfig: cfg, logStreams: streams}
+	require.Equal(t, streams.Stderr, h.TaskStatus().DriverAttributes["log.stderr"])
+}
+
+func TestDriver_InternalCapabilities(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.False(t, d.InternalCapabilities().DisableLogCollection)
+
+	require.NoError(t, setConfig(t, d, &Config{
+		DataDir: t.TempDir(),
+		Logging: LoggingConfig{DisableCollection: true},
+	}))
+	require.True(t, d.InternalCapabilities().DisableLogCollection)
+}
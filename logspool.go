@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/client/lib/fifo"
+)
+
+const (
+	// logSpoolDir is the directory, relative to the task dir, holding the
+	// output of the guest until it's forwarded to Nomad
+	logSpoolDir = ".wasmtime-logs"
+
+	// logPointerFile records how much of the spooled output was forwarded
+	logPointerFile = "pointer.json"
+
+	// logPumpInterval is how often the spools are checked for new output,
+	// and the pointer saved
+	logPumpInterval = 250 * time.Millisecond
+)
+
+// logSpoolMaxBacklog is how much output of each stream is kept until it's
+// forwarded. Past it, such as while logmon isn't reading, the oldest output
+// is dropped. It's overridden in tests.
+var logSpoolMaxBacklog int64 = 64 << 20
+
+// The streams of a task's output
+const (
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+)
+
+// logPointer is how much of each spool was written to Nomad's FIFOs. It's
+// persisted next to the spools, so after the plugin restarts the output
+// written in the meantime is forwarded rather than lost or repeated.
+type logPointer struct {
+	path string
+
+	lock      sync.Mutex
+	Stdout    int64     `json:"stdout"`
+	Stderr    int64     `json:"stderr"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// loadLogPointer reads the pointer saved at path, which is at the start of
+// the spools if it was never saved
+func loadLogPointer(path string) (*logPointer, error) {
+	p := &logPointer{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read log pointer: %v", err)
+	}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("failed to decode log pointer: %v", err)
+	}
+	return p, nil
+}
+
+func (p *logPointer) offset(stream string) int64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if stream == streamStderr {
+		return p.Stderr
+	}
+	return p.Stdout
+}
+
+func (p *logPointer) advance(stream string, n int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if stream == streamStderr {
+		p.Stderr += n
+	} else {
+		p.Stdout += n
+	}
+	p.UpdatedAt = time.Now()
+}
+
+// save writes the pointer atomically, so a crash leaves either the old or
+// the new pointer
+func (p *logPointer) save() error {
+	p.lock.Lock()
+	data, err := json.Marshal(p)
+	p.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := p.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
+
+// logSpools returns the spool files of the task in taskDir, creating them
+// if needed
+func logSpools(taskDir string) (stdout, stderr string, err error) {
+	dir := filepath.Join(taskDir, logSpoolDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", fmt.Errorf("failed to create log spool dir: %v", err)
+	}
+	stdout = filepath.Join(dir, streamStdout)
+	stderr = filepath.Join(dir, streamStderr)
+	for _, path := range []string{stdout, stderr} {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to create log spool: %v", err)
+		}
+		f.Close()
+	}
+	return stdout, stderr, nil
+}
+
+// logPumps forward the spooled output of a task to Nomad's FIFOs
+type logPumps struct {
+	pointer *logPointer
+	logger  hclog.Logger
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// openFIFO opens the writing end of a FIFO, overridden in tests
+var openFIFO = fifo.OpenWriter
+
+// startLogPumps starts forwarding the spools of streams from where pointer
+// is at
+func startLogPumps(streams *logStreams, pointer *logPointer, logger hclog.Logger) *logPumps {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &logPumps{pointer: pointer, logger: logger, cancel: cancel}
+	for stream, paths := range map[string][2]string{
+		streamStdout: {streams.StdoutSpool, streams.Stdout},
+		streamStderr: {streams.StderrSpool, streams.Stderr},
+	} {
+		p.wg.Add(1)
+		go func(stream, spool, dst string) {
+			defer p.wg.Done()
+			if err := p.pump(ctx, stream, spool, dst); err != nil {
+				logger.Error("failed to forward task output", "stream", stream, "error", err)
+			}
+		}(stream, paths[0], paths[1])
+	}
+	return p
+}
+
+// pump copies what's appended to spool to dst until ctx is done, then
+// forwards what's left and returns. The disk space of what was forwarded is
+// released whenever the pump catches up with the guest.
+func (p *logPumps) pump(ctx context.Context, stream, spool, dst string) error {
+	src, err := os.OpenFile(spool, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if _, err := src.Seek(p.pointer.offset(stream), io.SeekStart); err != nil {
+		return err
+	}
+	var released int64
+
+	w, err := openFIFO(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if w != nil {
+			w.Close()
+		}
+	}()
+	defer p.pointer.save()
+
+	buf := make([]byte, 32*1024)
+	stopping := false
+	for {
+		if err := p.dropBacklog(stream, src); err != nil {
+			return err
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			if w, err = p.forward(ctx, stream, w, dst, buf[:n]); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		// caught up with the guest
+		if stopping {
+			return nil
+		}
+		p.pointer.save()
+		if offset := p.pointer.offset(stream); offset != released {
+			if err := releaseSpool(src, offset); err != nil {
+				p.logger.Debug("failed to release forwarded task output", "stream", stream, "error", err)
+			}
+			released = offset
+		}
+		select {
+		case <-ctx.Done():
+			stopping = true
+		case <-time.After(logPumpInterval):
+		}
+	}
+}
+
+// dropBacklog skips the oldest output of the spool src, at the offset of
+// stream, if more than logSpoolMaxBacklog of it is left to forward
+func (p *logPumps) dropBacklog(stream string, src *os.File) error {
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	offset := p.pointer.offset(stream)
+	drop := fi.Size() - offset - logSpoolMaxBacklog
+	if drop <= 0 {
+		return nil
+	}
+	if _, err := src.Seek(offset+drop, io.SeekStart); err != nil {
+		return err
+	}
+	p.pointer.advance(stream, drop)
+	p.logger.Warn("dropped task output that wasn't forwarded in time", "stream", stream, "bytes", drop)
+	return nil
+}
+
+// forward writes b to the FIFO, advancing the pointer by what was written.
+// logmon reopens the FIFOs when it restarts or rotates its files, which
+// breaks the pipe, so the FIFO is reopened and the rest written again; what
+// isn't written before the pumps stop is forwarded once they're restarted.
+func (p *logPumps) forward(ctx context.Context, stream string, w io.WriteCloser, dst string, b []byte) (io.WriteCloser, error) {
+	for {
+		n, err := w.Write(b)
+		p.pointer.advance(stream, int64(n))
+		if err == nil {
+			return w, nil
+		}
+		b = b[n:]
+
+		w.Close()
+		if w, err = p.reopen(ctx, dst); err != nil {
+			return nil, fmt.Errorf("failed to reopen log FIFO: %v", err)
+		}
+	}
+}
+
+// reopen opens the FIFO at dst again once logmon reads it, giving up when
+// ctx is done
+func (p *logPumps) reopen(ctx context.Context, dst string) (io.WriteCloser, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(logPumpInterval):
+	}
+
+	type result struct {
+		w   io.WriteCloser
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		w, err := openFIFO(dst)
+		ch <- result{w, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.w, r.err
+	case <-ctx.Done():
+		// the FIFO is closed if it's opened after all
+		go func() {
+			if r := <-ch; r.err == nil {
+				r.w.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// stop forwards the output spooled so far and stops the pumps
+func (p *logPumps) stop() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+	p.wg.Wait()
+}
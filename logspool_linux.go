@@ -0,0 +1,17 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// releaseSpool frees the disk space of the first n bytes of the spool f,
+// which read as zeros afterwards. The offsets of the rest are kept, so the
+// guest's appends and the log pointer are unaffected.
+func releaseSpool(f *os.File, n int64) error {
+	return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, 0, n)
+}
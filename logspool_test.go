@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogPointer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), logPointerFile)
+
+	p, err := loadLogPointer(path)
+	require.NoError(t, err)
+	require.Zero(t, p.offset(streamStdout))
+
+	p.advance(streamStdout, 3)
+	p.advance(streamStderr, 5)
+	require.NoError(t, p.save())
+
+	p, err = loadLogPointer(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), p.offset(streamStdout))
+	require.Equal(t, int64(5), p.offset(streamStderr))
+	require.False(t, p.UpdatedAt.IsZero())
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+	_, err = loadLogPointer(path)
+	require.Error(t, err)
+}
+
+func TestLogPumps_Resume(t *testing.T) {
+	// plain files stand in for the FIFOs
+	orig := openFIFO
+	openFIFO = func(path string) (io.WriteCloser, error) {
+		return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	}
+	defer func() { openFIFO = orig }()
+
+	dir := t.TempDir()
+	stdout, stderr, err := logSpools(dir)
+	require.NoError(t, err)
+	streams := &logStreams{
+		Stdout:      filepath.Join(dir, "stdout.fifo"),
+		Stderr:      filepath.Join(dir, "stderr.fifo"),
+		StdoutSpool: stdout,
+		StderrSpool: stderr,
+	}
+	require.True(t, streams.spooled())
+
+	appendSpool := func(path, data string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+		require.NoError(t, err)
+		defer f.Close()
+		_, err = f.WriteString(data)
+		require.NoError(t, err)
+	}
+
+	pointer, err := loadLogPointer(streams.pointerPath())
+	require.NoError(t, err)
+	appendSpool(stdout, "before ")
+	pumps := startLogPumps(streams, pointer, hclog.NewNullLogger())
+	appendSpool(stderr, "oops ")
+	pumps.stop()
+
+	// output written while the plugin is down
+	appendSpool(stdout, "during ")
+	appendSpool(stderr, "again")
+
+	pointer, err = loadLogPointer(streams.pointerPath())
+	require.NoError(t, err)
+	require.Equal(t, int64(len("before ")), pointer.offset(streamStdout))
+	pumps = startLogPumps(streams, pointer, hclog.NewNullLogger())
+	appendSpool(stdout, "after")
+	pumps.stop()
+
+	out, err := ioutil.ReadFile(streams.Stdout)
+	require.NoError(t, err)
+	require.Equal(t, "before during after", string(out))
+	out, err = ioutil.ReadFile(streams.Stderr)
+	require.NoError(t, err)
+	require.Equal(t, "oops again", string(out))
+
+	// stopping twice is fine, as is stopping no pumps
+	pumps.stop()
+	(*logPumps)(nil).stop()
+}
+
+// brokenFIFO writes half of what it's given before its reader goes away
+type brokenFIFO struct {
+	io.Writer
+}
+
+func (f brokenFIFO) Write(b []byte) (int, error) {
+	n, _ := f.Writer.Write(b[:len(b)/2])
+	return n, errors.New("broken pipe")
+}
+
+func (f brokenFIFO) Close() error {
+	return nil
+}
+
+func TestLogPumps_ReopenFIFO(t *testing.T) {
+	dir := t.TempDir()
+	stdout, stderr, err := logSpools(dir)
+	require.NoError(t, err)
+	streams := &logStreams{
+		Stdout:      filepath.Join(dir, "stdout.fifo"),
+		Stderr:      filepath.Join(dir, "stderr.fifo"),
+		StdoutSpool: stdout,
+		StderrSpool: stderr,
+	}
+	require.NoError(t, ioutil.WriteFile(stdout, []byte("hello world"), 0600))
+
+	// the first FIFO breaks, as when logmon restarts
+	var opened int32
+	orig := openFIFO
+	openFIFO = func(path string) (io.WriteCloser, error) {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		if path == streams.Stdout && atomic.AddInt32(&opened, 1) < 3 {
+			return brokenFIFO{f}, nil
+		}
+		return f, nil
+	}
+	defer func() { openFIFO = orig }()
+
+	pointer, err := loadLogPointer(streams.pointerPath())
+	require.NoError(t, err)
+	pumps := startLogPumps(streams, pointer, hclog.NewNullLogger())
+	require.Eventually(t, func() bool {
+		return pointer.offset(streamStdout) == int64(len("hello world"))
+	}, 5*time.Second, 10*time.Millisecond)
+	pumps.stop()
+
+	out, err := ioutil.ReadFile(streams.Stdout)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(out))
+	require.Equal(t, int32(3), atomic.LoadInt32(&opened))
+}
+
+func TestLogPumps_Backlog(t *testing.T) {
+	orig := openFIFO
+	openFIFO = func(path string) (io.WriteCloser, error) {
+		return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	}
+	defer func() { openFIFO = orig }()
+	defer func(n int64) { logSpoolMaxBacklog = n }(logSpoolMaxBacklog)
+	logSpoolMaxBacklog = 4
+
+	dir := t.TempDir()
+	stdout, stderr, err := logSpools(dir)
+	require.NoError(t, err)
+	streams := &logStreams{
+		Stdout:      filepath.Join(dir, "stdout.fifo"),
+		Stderr:      filepath.Join(dir, "stderr.fifo"),
+		StdoutSpool: stdout,
+		StderrSpool: stderr,
+	}
+	require.NoError(t, ioutil.WriteFile(stdout, []byte("0123456789"), 0600))
+
+	// output past the backlog is dropped, oldest first
+	pointer, err := loadLogPointer(streams.pointerPath())
+	require.NoError(t, err)
+	pumps := startLogPumps(streams, pointer, hclog.NewNullLogger())
+	require.Eventually(t, func() bool {
+		return pointer.offset(streamStdout) == 10
+	}, 5*time.Second, 10*time.Millisecond)
+	pumps.stop()
+
+	out, err := ioutil.ReadFile(streams.Stdout)
+	require.NoError(t, err)
+	require.Equal(t, "6789", string(out))
+
+	// the forwarded output no longer takes space, keeping its offsets
+	spooled, err := ioutil.ReadFile(stdout)
+	require.NoError(t, err)
+	require.Len(t, spooled, 10)
+	if runtime.GOOS == "linux" {
+		require.Equal(t, make([]byte, 10), spooled)
+	}
+}
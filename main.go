@@ -1,17 +1,77 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
 	log "github.com/hashicorp/go-hclog"
 	_ "github.com/hashicorp/nomad/api"
 	"github.com/hashicorp/nomad/plugins"
 )
 
 func main() {
-	// Serve the plugin
-	plugins.Serve(factory)
+	version := flag.Bool("version", false, "print the plugin version and exit")
+	validateConfig := flag.String("validate-config", "", "validate the plugin stanza in the given HCL file and exit")
+	inspect := flag.String("inspect-module", "", "print the imports, exports, required features and metadata of the given module and exit")
+	runTask := flag.String("run-task", "", "run the task of the given runner spec, as the runner process of a forked task")
+	flag.Parse()
+
+	switch {
+	case *version:
+		fmt.Printf("%s %s\n", pluginName, pluginVersion)
+	case *validateConfig != "":
+		if err := runValidateConfig(*validateConfig); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case *runTask != "":
+		os.Exit(runRunner(*runTask))
+	case *inspect != "":
+		if err := runInspectModule(*inspect); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	default:
+		// Serve the plugin
+		plugins.Serve(factory)
+	}
 }
 
 // factory returns a new instance of a nomad driver plugin
 func factory(log log.Logger) interface{} {
 	return NewWasmtimeDriver(log)
 }
+
+// runValidateConfig validates the plugin config in path
+func runValidateConfig(path string) error {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if _, err := validatePluginConfig(src); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	fmt.Printf("%s: configuration is valid\n", path)
+	return nil
+}
+
+// runInspectModule prints the description of the module in path as JSON
+func runInspectModule(path string) error {
+	wasm, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	info, err := inspectModule(wasm)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	out, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// The main_loop of tasks
+const (
+	mainLoopOneshot = "oneshot"
+	mainLoopService = "service"
+)
+
+// mainLoopStartWindow is how long the guest of a service task is watched
+// for exiting before the task is started
+const mainLoopStartWindow = 500 * time.Millisecond
+
+// validateMainLoop checks the task's main_loop against the rest of its
+// config
+func validateMainLoop(driverConfig *TaskConfig) error {
+	switch driverConfig.MainLoop {
+	case "":
+	case mainLoopOneshot:
+		if servePortLabel(driverConfig.Serve) != "" {
+			return fmt.Errorf("main_loop %q runs the module to completion and can't be set with serve.port_label", mainLoopOneshot)
+		}
+	case mainLoopService:
+		if driverConfig.Entrypoint != "" {
+			return fmt.Errorf("main_loop %q can't be set with entrypoint, which returns once called", mainLoopService)
+		}
+	default:
+		return fmt.Errorf("invalid main_loop %q: must be %q or %q", driverConfig.MainLoop, mainLoopOneshot, mainLoopService)
+	}
+	return nil
+}
+
+// watchServiceStart waits up to window for the guest of a service task to
+// exit, returning an error if it did: a oneshot module run as a service
+// would otherwise go through its restarts exiting each time.
+func watchServiceStart(g *guestTask, window time.Duration) error {
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-g.done:
+	}
+
+	how := fmt.Sprintf("with exit code %d", g.exit.exitCode)
+	switch {
+	case g.exit.info.trap != nil:
+		how = fmt.Sprintf("trapping (%s)", trapSummary(g.exit.info.trap))
+	case g.exit.signal != 0:
+		how = fmt.Sprintf("on signal %d", g.exit.signal)
+	case g.exit.err != nil:
+		how = fmt.Sprintf("with error %v", g.exit.err)
+	}
+	return fmt.Errorf("module exited %s right after starting, but main_loop is %q: modules that exit by design need main_loop %q in a batch job",
+		how, mainLoopService, mainLoopOneshot)
+}
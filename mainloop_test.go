@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateMainLoop(t *testing.T) {
+	for _, c := range []*TaskConfig{
+		{},
+		{MainLoop: "oneshot", Entrypoint: "run"},
+		{MainLoop: "service", Serve: TaskServeConfig{PortLabel: "http"}},
+	} {
+		require.NoError(t, validateMainLoop(c), "%+v", c)
+	}
+	for _, c := range []*TaskConfig{
+		{MainLoop: "forever"},
+		{MainLoop: "oneshot", Serve: TaskServeConfig{PortLabel: "http"}},
+		{MainLoop: "service", Entrypoint: "run"},
+	} {
+		require.Error(t, validateMainLoop(c), "%+v", c)
+	}
+}
+
+func TestStartTask_ServiceMainLoop(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir(), Logging: LoggingConfig{DisableCollection: true}}))
+
+	// a module exiting right away fails to start
+	wasm, err := wasmtime.Wat2Wasm(helloWat)
+	require.NoError(t, err)
+	cfg := newTestTask(t, wasm)
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{File: "main.wasm", MainLoop: "service"}))
+	_, _, err = d.StartTask(cfg)
+	require.EqualError(t, err, `module exited with exit code 3 right after starting, but main_loop is "service": modules that exit by design need main_loop "oneshot" in a batch job`)
+	_, ok := d.tasks.Get(cfg.ID)
+	require.False(t, ok)
+	require.Zero(t, d.quotas.usage()[cfg.Namespace].Instances)
+
+	// while one running on starts
+	cfg = startTestTask(t, d, loopWat, &TaskConfig{MainLoop: "service"})
+	require.NoError(t, d.StopTask(cfg.ID, time.Second, "SIGTERM"))
+	waitTestTask(t, d, cfg.ID)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
+
+func TestStartTask_OneshotMainLoop(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := startTestTask(t, d, helloWat, &TaskConfig{MainLoop: "oneshot"})
+	res := waitTestTask(t, d, cfg.ID)
+	require.Equal(t, 3, res.ExitCode)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
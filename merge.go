@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+)
+
+// strategyAuto is the compiler strategy letting the plugin config decide
+const strategyAuto = "auto"
+
+// mergeTaskConfig layers the task config on top of the plugin config. The
+// plugin's limits, capabilities and compiler settings are defaults for what
+// the task leaves unset, and its limits and capabilities are also ceilings:
+//
+//   - a limit the task doesn't set is the plugin's limit, and a task may only
+//     lower a limit the plugin sets
+//   - a task without capabilities gets the plugin's, and a task may only
+//     drop capabilities the plugin grants. A plugin without capabilities
+//     doesn't restrict tasks.
+//   - the "auto" compiler strategy is the plugin's strategy, if it has one
+//   - the compilation cache is only used if both the plugin and task allow it
+//
+// driverConfig is updated in place and the resolved limits are returned.
+func mergeTaskConfig(config *Config, driverConfig *TaskConfig) (*taskLimits, error) {
+	ceiling, err := parseTaskLimits(config.Limits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid plugin limits: %v", err)
+	}
+	limits, err := parseTaskLimits(driverConfig.Limits)
+	if err != nil {
+		return nil, err
+	}
+
+	if limits.memory == 0 {
+		limits.memory = ceiling.memory
+		driverConfig.Limits.Memory = config.Limits.Memory
+	} else if ceiling.memory != 0 && limits.memory > ceiling.memory {
+		return nil, fmt.Errorf("memory limit %q exceeds the plugin limit %q", driverConfig.Limits.Memory, config.Limits.Memory)
+	}
+
+	if limits.fuel == 0 {
+		limits.fuel = ceiling.fuel
+		driverConfig.Limits.Fuel = config.Limits.Fuel
+	} else if ceiling.fuel != 0 && limits.fuel > ceiling.fuel {
+		return nil, fmt.Errorf("fuel limit %d exceeds the plugin limit %d", driverConfig.Limits.Fuel, config.Limits.Fuel)
+	}
+
+	if limits.deadline == 0 {
+		limits.deadline = ceiling.deadline
+		driverConfig.Limits.Deadline = config.Limits.Deadline
+	} else if ceiling.deadline != 0 && limits.deadline > ceiling.deadline {
+		return nil, fmt.Errorf("deadline %q exceeds the plugin deadline %q", driverConfig.Limits.Deadline, config.Limits.Deadline)
+	}
+
+	if limits.tables == 0 {
+		limits.tables = ceiling.tables
+		driverConfig.Limits.MaxTables = config.Limits.MaxTables
+	} else if ceiling.tables != 0 && limits.tables > ceiling.tables {
+		return nil, fmt.Errorf("max_tables %d exceeds the plugin limit %d", driverConfig.Limits.MaxTables, config.Limits.MaxTables)
+	}
+
+	if limits.tableElements == 0 {
+		limits.tableElements = ceiling.tableElements
+		driverConfig.Limits.MaxTableElements = config.Limits.MaxTableElements
+	} else if ceiling.tableElements != 0 && limits.tableElements > ceiling.tableElements {
+		return nil, fmt.Errorf("max_table_elements %d exceeds the plugin limit %d", driverConfig.Limits.MaxTableElements, config.Limits.MaxTableElements)
+	}
+
+	if limits.instances == 0 {
+		limits.instances = ceiling.instances
+		driverConfig.Limits.MaxInstances = config.Limits.MaxInstances
+	} else if ceiling.instances != 0 && limits.instances > ceiling.instances {
+		return nil, fmt.Errorf("max_instances %d exceeds the plugin limit %d", driverConfig.Limits.MaxInstances, config.Limits.MaxInstances)
+	}
+
+	allowed, err := newCapabilitySet(config.Capabilities)
+	if err != nil {
+		return nil, fmt.Errorf("invalid plugin capabilities: %v", err)
+	}
+	if len(driverConfig.WASI.Capabilities) == 0 {
+		driverConfig.WASI.Capabilities = append([]string(nil), config.Capabilities...)
+	}
+	for _, name := range driverConfig.WASI.Capabilities {
+		if !allowed.allows(name) {
+			return nil, fmt.Errorf("capability %q is not allowed by the plugin config", name)
+		}
+	}
+
+	if (driverConfig.Compiler.Strategy == "" || driverConfig.Compiler.Strategy == strategyAuto) && config.Compiler.Strategy != "" {
+		driverConfig.Compiler.Strategy = config.Compiler.Strategy
+	}
+	driverConfig.Compiler.Cache = driverConfig.Compiler.Cache && config.Compiler.Cache
+
+	return limits, nil
+}
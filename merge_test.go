@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeTaskConfig_Limits(t *testing.T) {
+	config := &Config{
+		Limits:   TaskLimitsConfig{Memory: "128MiB", Fuel: 1000, Deadline: "1m"},
+		Compiler: PluginCompilerConfig{Cache: true},
+	}
+
+	// unset limits are inherited
+	driverConfig := &TaskConfig{Compiler: WasmTimeCompiler{Cache: true}}
+	limits, err := mergeTaskConfig(config, driverConfig)
+	require.NoError(t, err)
+	require.Equal(t, &taskLimits{memory: 128 << 20, fuel: 1000, deadline: time.Minute}, limits)
+	require.Equal(t, config.Limits, driverConfig.Limits)
+
+	// limits may be lowered
+	driverConfig = &TaskConfig{Limits: TaskLimitsConfig{Memory: "64MiB", Deadline: "10s"}}
+	limits, err = mergeTaskConfig(config, driverConfig)
+	require.NoError(t, err)
+	require.Equal(t, &taskLimits{memory: 64 << 20, fuel: 1000, deadline: 10 * time.Second}, limits)
+
+	// but not raised
+	for _, l := range []TaskLimitsConfig{
+		{Memory: "256MiB"},
+		{Fuel: 1001},
+		{Deadline: "2m"},
+	} {
+		_, err := mergeTaskConfig(config, &TaskConfig{Limits: l})
+		require.Error(t, err, "%+v", l)
+	}
+
+	// plugins without limits don't restrict tasks
+	limits, err = mergeTaskConfig(&Config{}, &TaskConfig{Limits: TaskLimitsConfig{Fuel: 1 << 40}})
+	require.NoError(t, err)
+	require.Equal(t, &taskLimits{fuel: 1 << 40}, limits)
+
+	config = &Config{Limits: TaskLimitsConfig{MaxTables: 2, MaxTableElements: 1000, MaxInstances: 4}}
+	limits, err = mergeTaskConfig(config, &TaskConfig{Limits: TaskLimitsConfig{MaxTables: 1, MaxInstances: 2}})
+	require.NoError(t, err)
+	require.Equal(t, &taskLimits{tables: 1, tableElements: 1000, instances: 2}, limits)
+	for _, l := range []TaskLimitsConfig{
+		{MaxTables: 3},
+		{MaxTableElements: 1001},
+		{MaxInstances: 5},
+	} {
+		_, err := mergeTaskConfig(config, &TaskConfig{Limits: l})
+		require.Error(t, err, "%+v", l)
+	}
+
+	_, err = mergeTaskConfig(&Config{Limits: TaskLimitsConfig{Memory: "lots"}}, &TaskConfig{})
+	require.Error(t, err)
+}
+
+func TestMergeTaskConfig_Capabilities(t *testing.T) {
+	config := &Config{Capabilities: []string{capabilityWASI, capabilityKeyValue}}
+
+	driverConfig := &TaskConfig{}
+	_, err := mergeTaskConfig(config, driverConfig)
+	require.NoError(t, err)
+	require.Equal(t, []string{capabilityWASI, capabilityKeyValue}, driverConfig.WASI.Capabilities)
+
+	driverConfig = &TaskConfig{WASI: TaskWASIConfig{Capabilities: []string{capabilityWASI}}}
+	_, err = mergeTaskConfig(config, driverConfig)
+	require.NoError(t, err)
+	require.Equal(t, []string{capabilityWASI}, driverConfig.WASI.Capabilities)
+
+	driverConfig = &TaskConfig{WASI: TaskWASIConfig{Capabilities: []string{capabilityWASI, capabilitySQL}}}
+	_, err = mergeTaskConfig(config, driverConfig)
+	require.EqualError(t, err, `capability "sql" is not allowed by the plugin config`)
+
+	// plugins without capabilities don't restrict tasks
+	driverConfig = &TaskConfig{WASI: TaskWASIConfig{Capabilities: []string{capabilitySQL}}}
+	_, err = mergeTaskConfig(&Config{}, driverConfig)
+	require.NoError(t, err)
+	require.Equal(t, []string{capabilitySQL}, driverConfig.WASI.Capabilities)
+
+	driverConfig = &TaskConfig{}
+	_, err = mergeTaskConfig(&Config{}, driverConfig)
+	require.NoError(t, err)
+	require.Empty(t, driverConfig.WASI.Capabilities)
+}
+
+func TestMergeTaskConfig_Compiler(t *testing.T) {
+	cases := []struct {
+		name     string
+		plugin   PluginCompilerConfig
+		task     WasmTimeCompiler
+		expected WasmTimeCompiler
+	}{
+		{
+			name:     "auto uses plugin strategy",
+			plugin:   PluginCompilerConfig{Strategy: "cranelift", Cache: true},
+			task:     WasmTimeCompiler{Strategy: "auto", Cache: true},
+			expected: WasmTimeCompiler{Strategy: "cranelift", Cache: true},
+		},
+		{
+			name:     "task strategy wins",
+			plugin:   PluginCompilerConfig{Strategy: "cranelift", Cache: true},
+			task:     WasmTimeCompiler{Strategy: "lightbeam", Cache: true},
+			expected: WasmTimeCompiler{Strategy: "lightbeam", Cache: true},
+		},
+		{
+			name:     "auto without plugin strategy",
+			plugin:   PluginCompilerConfig{Cache: true},
+			task:     WasmTimeCompiler{Strategy: "auto", Cache: true},
+			expected: WasmTimeCompiler{Strategy: "auto", Cache: true},
+		},
+		{
+			name:     "task opts out of cache",
+			plugin:   PluginCompilerConfig{Cache: true},
+			task:     WasmTimeCompiler{Strategy: "auto"},
+			expected: WasmTimeCompiler{Strategy: "auto"},
+		},
+		{
+			name:     "plugin disables cache",
+			plugin:   PluginCompilerConfig{},
+			task:     WasmTimeCompiler{Strategy: "auto", Cache: true},
+			expected: WasmTimeCompiler{Strategy: "auto"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			driverConfig := &TaskConfig{Compiler: c.task}
+			_, err := mergeTaskConfig(&Config{Compiler: c.plugin}, driverConfig)
+			require.NoError(t, err)
+			require.Equal(t, c.expected, driverConfig.Compiler)
+		})
+	}
+}
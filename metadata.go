@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// producersSection is the custom section in which toolchains record what
+// built a module
+const producersSection = "producers"
+
+// producer is a tool or language recorded in the producers section
+type producer struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+func (p producer) String() string {
+	if p.Version == "" {
+		return p.Name
+	}
+	return p.Name + " " + p.Version
+}
+
+// moduleMetadata is what a module's custom sections tell of how it was
+// built, for operators inventorying what runs on their nodes
+type moduleMetadata struct {
+	Language    []producer `json:"language,omitempty"`
+	ProcessedBy []producer `json:"processed_by,omitempty"`
+	SDK         []producer `json:"sdk,omitempty"`
+
+	// CustomSections are the names of the module's custom sections
+	CustomSections []string `json:"custom_sections,omitempty"`
+
+	// Forecast is the resources the module declares it needs, if any
+	Forecast *resourceForecast `json:"forecast,omitempty"`
+}
+
+// readModuleMetadata returns the metadata of wasm. A malformed producers
+// section is ignored rather than failing the task, as it has no effect on
+// how the module runs, unlike a malformed forecast.
+func readModuleMetadata(wasm []byte) (*moduleMetadata, error) {
+	sections, err := wasmSections(wasm)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &moduleMetadata{}
+	seen := map[string]bool{}
+	for _, s := range sections {
+		if s.id != wasmCustomSection {
+			continue
+		}
+		if !seen[s.name] {
+			seen[s.name] = true
+			m.CustomSections = append(m.CustomSections, s.name)
+		}
+		switch s.name {
+		case producersSection:
+			m.readProducers(s.data)
+		case forecastSection:
+			if m.Forecast, err = parseForecast(s.data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Strings(m.CustomSections)
+	return m, nil
+}
+
+// readProducers reads the fields of the producers section in data
+func (m *moduleMetadata) readProducers(data []byte) {
+	r := &wasmReader{b: data}
+	fields, err := r.uleb()
+	if err != nil {
+		return
+	}
+	for i := uint64(0); i < fields; i++ {
+		field, err := r.name()
+		if err != nil {
+			return
+		}
+		n, err := r.uleb()
+		if err != nil {
+			return
+		}
+		var values []producer
+		for j := uint64(0); j < n; j++ {
+			var p producer
+			if p.Name, err = r.name(); err != nil {
+				return
+			}
+			if p.Version, err = r.name(); err != nil {
+				return
+			}
+			values = append(values, p)
+		}
+
+		switch field {
+		case "language":
+			m.Language = values
+		case "processed-by":
+			m.ProcessedBy = values
+		case "sdk":
+			m.SDK = values
+		}
+	}
+}
+
+func joinProducers(producers []producer) string {
+	s := make([]string, len(producers))
+	for i, p := range producers {
+		s[i] = p.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// attributes returns the metadata as task attributes, omitting what the
+// module doesn't record
+func (m *moduleMetadata) attributes() map[string]string {
+	attrs := map[string]string{}
+	if m == nil {
+		return attrs
+	}
+	if len(m.Language) != 0 {
+		attrs["module_language"] = joinProducers(m.Language)
+	}
+	if len(m.ProcessedBy) != 0 {
+		attrs["module_processed_by"] = joinProducers(m.ProcessedBy)
+	}
+	if len(m.SDK) != 0 {
+		attrs["module_sdk"] = joinProducers(m.SDK)
+	}
+	if len(m.CustomSections) != 0 {
+		attrs["module_custom_sections"] = strings.Join(m.CustomSections, ",")
+	}
+	if f := m.Forecast; f != nil && f.Memory != 0 {
+		attrs["module_forecast_memory"] = humanize.IBytes(f.Memory)
+	}
+	if f := m.Forecast; f != nil && f.Fuel != 0 {
+		attrs["module_forecast_fuel"] = strconv.FormatUint(f.Fuel, 10)
+	}
+	return attrs
+}
+
+// String describes the toolchain that built the module
+func (m *moduleMetadata) String() string {
+	var parts []string
+	if len(m.Language) != 0 {
+		parts = append(parts, joinProducers(m.Language))
+	}
+	if len(m.ProcessedBy) != 0 {
+		parts = append(parts, "processed by "+joinProducers(m.ProcessedBy))
+	}
+	if len(m.SDK) != 0 {
+		parts = append(parts, "SDK "+joinProducers(m.SDK))
+	}
+	if len(parts) == 0 {
+		return "no producers recorded"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// emitModuleMetadata sends an event describing how the task's module was
+// built
+func (d *Driver) emitModuleMetadata(cfg *drivers.TaskConfig, m *moduleMetadata) {
+	err := d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:      cfg.ID,
+		AllocID:     cfg.AllocID,
+		TaskName:    cfg.Name,
+		Timestamp:   time.Now(),
+		Message:     fmt.Sprintf("Module built with %s", m),
+		Annotations: m.attributes(),
+	})
+	if err != nil {
+		d.logger.Warn("failed to emit module metadata", "task_id", cfg.ID, "error", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/stretchr/testify/require"
+)
+
+// customSection encodes a custom section named name holding data
+func customSection(name string, data []byte) []byte {
+	payload := append([]byte{byte(len(name))}, name...)
+	payload = append(payload, data...)
+	return append([]byte{wasmCustomSection, byte(len(payload))}, payload...)
+}
+
+// producersData encodes a producers section, each field being its name
+// followed by name and version pairs
+func producersData(fields [][]string) []byte {
+	b := []byte{byte(len(fields))}
+	for _, f := range fields {
+		b = append(b, byte(len(f[0])))
+		b = append(b, f[0]...)
+		b = append(b, byte((len(f)-1)/2))
+		for _, s := range f[1:] {
+			b = append(b, byte(len(s)))
+			b = append(b, s...)
+		}
+	}
+	return b
+}
+
+func TestReadModuleMetadata(t *testing.T) {
+	wasm, err := wasmtime.Wat2Wasm(`(module)`)
+	require.NoError(t, err)
+	wasm = append(wasm, customSection(producersSection, producersData([][]string{
+		{"language", "Rust", ""},
+		{"processed-by", "rustc", "1.70.0", "wasm-bindgen", "0.2.87"},
+	}))...)
+	wasm = append(wasm, customSection("target_features", []byte{0})...)
+
+	m, err := readModuleMetadata(wasm)
+	require.NoError(t, err)
+	require.Equal(t, []producer{{Name: "Rust"}}, m.Language)
+	require.Equal(t, []producer{{"rustc", "1.70.0"}, {"wasm-bindgen", "0.2.87"}}, m.ProcessedBy)
+	require.Empty(t, m.SDK)
+	require.Equal(t, []string{"producers", "target_features"}, m.CustomSections)
+
+	require.Equal(t, map[string]string{
+		"module_language":        "Rust",
+		"module_processed_by":    "rustc 1.70.0, wasm-bindgen 0.2.87",
+		"module_custom_sections": "producers,target_features",
+	}, m.attributes())
+	require.Equal(t, "Rust, processed by rustc 1.70.0, wasm-bindgen 0.2.87", m.String())
+
+	// malformed producers are ignored
+	wasm, err = wasmtime.Wat2Wasm(`(module)`)
+	require.NoError(t, err)
+	wasm = append(wasm, customSection(producersSection, []byte{5, 3})...)
+	m, err = readModuleMetadata(wasm)
+	require.NoError(t, err)
+	require.Empty(t, m.Language)
+	require.Equal(t, "no producers recorded", m.String())
+
+	require.Empty(t, (*moduleMetadata)(nil).attributes())
+}
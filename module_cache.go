@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/opencontainers/go-digest"
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+// defaultMemoryPressureInterval is used when the plugin config doesn't set
+// memory_pressure.interval
+const defaultMemoryPressureInterval = 30 * time.Second
+
+// moduleCacheKey identifies a compiled module by the engine config it was
+// compiled with, as named by engineKey, and the digest of its bytes
+type moduleCacheKey struct {
+	engine string
+	digest digest.Digest
+}
+
+// compiledModule is the code of a compiled module, as serialized, and how
+// it was compiled
+type compiledModule struct {
+	code []byte
+
+	// precompiled is set if the code is precompiled code that was used
+	// rather than compiling the module
+	precompiled bool
+	warnings    []string
+}
+
+// cachedModule is a compiled module and the tasks using it
+type cachedModule struct {
+	compiled *compiledModule
+	users    int
+	lastUsed time.Time
+}
+
+// moduleCache shares compiled modules between the tasks running the same
+// module with the same compiler config. Each task deserializes the code into
+// an engine of its own, as tasks are interrupted through their engine's
+// epoch. The code of modules no task uses is kept until memory pressure
+// evicts it, and recompiled when needed again.
+type moduleCache struct {
+	lock    sync.Mutex
+	modules map[moduleCacheKey]*cachedModule
+
+	// tasks are the modules used by each task
+	tasks map[string]*cachedModule
+
+	// evicted are the modules evicted so far, so compiling them again is
+	// counted as a recompile
+	evicted map[moduleCacheKey]struct{}
+
+	// now is overridden in tests
+	now func() time.Time
+}
+
+func newModuleCache() *moduleCache {
+	return &moduleCache{
+		modules: map[moduleCacheKey]*cachedModule{},
+		tasks:   map[string]*cachedModule{},
+		evicted: map[moduleCacheKey]struct{}{},
+		now:     time.Now,
+	}
+}
+
+// Acquire returns the module with digest d compiled with the engine config
+// named engine for taskID, calling compile if it isn't cached. Compiling
+// doesn't hold up the other tasks; of tasks compiling the same module at
+// once, the code of the first one done is shared. The module is used by the
+// task until it's released.
+func (c *moduleCache) Acquire(taskID, engine string, d digest.Digest, compile func() (*compiledModule, error)) (*compiledModule, error) {
+	key := moduleCacheKey{engine: engine, digest: d}
+
+	var compiled *compiledModule
+	for {
+		c.lock.Lock()
+		m, ok := c.modules[key]
+		if !ok && compiled != nil {
+			if _, ok := c.evicted[key]; ok {
+				delete(c.evicted, key)
+				metrics.IncrCounter([]string{"wasmtime", "modules", "recompiled"}, 1)
+			}
+			m = &cachedModule{compiled: compiled}
+			c.modules[key] = m
+		}
+		if m != nil {
+			c.releaseLocked(taskID)
+			m.users++
+			m.lastUsed = c.now()
+			c.tasks[taskID] = m
+			c.lock.Unlock()
+			return m.compiled, nil
+		}
+		c.lock.Unlock()
+
+		start := time.Now()
+		var err error
+		if compiled, err = compile(); err != nil {
+			return nil, err
+		}
+		metrics.MeasureSince([]string{"wasmtime", "modules", "compile"}, start)
+	}
+}
+
+// Release drops the modules used by taskID, its own and those of its serve
+// routes, so they may be evicted
+func (c *moduleCache) Release(taskID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.releaseLocked(taskID)
+	for user := range c.tasks {
+		if strings.HasPrefix(user, taskID+routeUserSeparator) {
+			c.releaseLocked(user)
+		}
+	}
+}
+
+// routeUserSeparator separates the task ID from the module in the users of
+// the modules of serve routes, which no task ID contains
+const routeUserSeparator = "\x00"
+
+// routeUser is the user the module file of a serve route of taskID is
+// acquired by
+func routeUser(taskID, file string) string {
+	return taskID + routeUserSeparator + file
+}
+
+func (c *moduleCache) releaseLocked(taskID string) {
+	if m, ok := c.tasks[taskID]; ok {
+		m.users--
+		m.lastUsed = c.now()
+		delete(c.tasks, taskID)
+	}
+}
+
+// deserializeModule returns the module deserialized from precompiled, or
+// nil if it isn't usable by engine
+func deserializeModule(engine *wasmtime.Engine, precompiled []byte) *wasmtime.Module {
+	module, err := wasmtime.NewModuleDeserialize(engine, precompiled)
+	if err != nil {
+		metrics.IncrCounter([]string{"wasmtime", "modules", "precompiled_rejected"}, 1)
+		return nil
+	}
+	metrics.IncrCounter([]string{"wasmtime", "modules", "precompiled"}, 1)
+	return module
+}
+
+// EvictIdle drops the modules no task uses and returns how many were
+// evicted.
+func (c *moduleCache) EvictIdle() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var evicted int
+	for key, m := range c.modules {
+		if m.users != 0 {
+			continue
+		}
+		delete(c.modules, key)
+		c.evicted[key] = struct{}{}
+		evicted++
+	}
+	metrics.IncrCounter([]string{"wasmtime", "modules", "evicted"}, float32(evicted))
+	return evicted
+}
+
+// Len returns the number of compiled modules cached
+func (c *moduleCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.modules)
+}
+
+// memoryUsage returns the percentage of the node's memory in use
+var memoryUsage = func() (float64, error) {
+	v, err := mem.VirtualMemory()
+	if err != nil {
+		return 0, err
+	}
+	return v.UsedPercent, nil
+}
+
+// relieveMemoryPressure evicts the idle modules if the node's memory usage
+// is at or above watermark percent.
+func (d *Driver) relieveMemoryPressure(watermark float64) {
+	used, err := memoryUsage()
+	if err != nil {
+		d.logger.Warn("failed to read memory usage", "error", err)
+		return
+	}
+	metrics.SetGauge([]string{"wasmtime", "node", "memory_used_percent"}, float32(used))
+	if used < watermark {
+		return
+	}
+
+	if n := d.modules.EvictIdle(); n != 0 {
+		d.logger.Info("evicted idle compiled modules under memory pressure",
+			"modules", n, "memory_used_percent", used, "watermark", watermark)
+	}
+}
+
+// watchMemoryPressure checks the node's memory usage every interval until
+// ctx is done
+func (d *Driver) watchMemoryPressure(ctx context.Context, interval time.Duration, watermark float64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.relieveMemoryPressure(watermark)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModuleCache(t *testing.T) {
+	d := digest.FromString("module")
+	var compiles int
+	compile := func() (*compiledModule, error) {
+		compiles++
+		return &compiledModule{code: []byte("code")}, nil
+	}
+
+	cache := newModuleCache()
+	m1, err := cache.Acquire("a", "speed", d, compile)
+	require.NoError(t, err)
+	m2, err := cache.Acquire("b", "speed", d, compile)
+	require.NoError(t, err)
+	require.Same(t, m1, m2)
+	require.Equal(t, 1, compiles)
+
+	// modules compiled with another engine config aren't shared
+	_, err = cache.Acquire("c", "none", d, compile)
+	require.NoError(t, err)
+	require.Equal(t, 2, compiles)
+	require.Equal(t, 2, cache.Len())
+	cache.Release("c")
+
+	// modules in use aren't evicted
+	cache.Release("a")
+	cache.Release("a")
+	require.Equal(t, 1, cache.EvictIdle())
+	require.Equal(t, 1, cache.Len())
+
+	cache.Release("b")
+	require.Equal(t, 1, cache.EvictIdle())
+	require.Zero(t, cache.Len())
+
+	// evicted modules are recompiled on demand
+	m3, err := cache.Acquire("a", "speed", d, compile)
+	require.NoError(t, err)
+	require.NotSame(t, m1, m3)
+	require.Equal(t, 3, compiles)
+
+	// a task acquiring another module releases the one it used
+	_, err = cache.Acquire("a", "speed", digest.FromString("other"), compile)
+	require.NoError(t, err)
+	require.Equal(t, 1, cache.EvictIdle())
+	cache.Release("a")
+
+	_, err = cache.Acquire("a", "speed", digest.FromString("invalid"), func() (*compiledModule, error) {
+		return nil, fmt.Errorf("not wasm")
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, cache.Len())
+}
+
+func TestCompileModule_Shared(t *testing.T) {
+	wasm, err := wasmtime.Wat2Wasm(`(module (func (export "run")))`)
+	require.NoError(t, err)
+	cache := newModuleCache()
+	key := engineKey(speed, nil)
+
+	// tasks get engines of their own, as they're interrupted through them,
+	// with the code compiled once
+	config, diag, err := engineConfig(speed, nil)
+	require.NoError(t, err)
+	e1, m1, err := compileModule(cache, "a", key, config, wasm, nil, &taskLimits{}, diag)
+	require.NoError(t, err)
+	config, diag, err = engineConfig(speed, nil)
+	require.NoError(t, err)
+	e2, m2, err := compileModule(cache, "b", key, config, wasm, nil, &taskLimits{}, diag)
+	require.NoError(t, err)
+	require.NotSame(t, e1, e2)
+	require.NotSame(t, m1, m2)
+	require.Len(t, m2.Exports(), 1)
+	require.NotZero(t, diag.CodeSize)
+	require.Equal(t, 1, cache.Len())
+
+	// and compiled again for another compiler config
+	config, diag, err = engineConfig(speed, nil)
+	require.NoError(t, err)
+	_, _, err = compileModule(cache, "c", engineKey(WasmTimeCompiler{}, nil), config, wasm, nil, &taskLimits{}, diag)
+	require.NoError(t, err)
+	require.Equal(t, 2, cache.Len())
+}
+
+func TestEngineKey(t *testing.T) {
+	require.Equal(t, engineKey(WasmTimeCompiler{}, nil), engineKey(WasmTimeCompiler{Strategy: strategyAuto}, nil))
+	require.Equal(t, engineKey(speed, []string{"simd", "bulk_memory"}), engineKey(speed, []string{"bulk_memory", "simd"}))
+	require.NotEqual(t, engineKey(speed, nil), engineKey(WasmTimeCompiler{}, nil))
+	require.NotEqual(t, engineKey(speed, nil), engineKey(speed, []string{"simd"}))
+}
+
+func TestModuleCache_MemoryPressure(t *testing.T) {
+	defer func(f func() (float64, error)) { memoryUsage = f }(memoryUsage)
+	used := 50.0
+	memoryUsage = func() (float64, error) { return used, nil }
+
+	wasm, err := wasmtime.Wat2Wasm(`(module)`)
+	require.NoError(t, err)
+
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	config, diag, err := engineConfig(speed, nil)
+	require.NoError(t, err)
+	_, _, err = compileModule(d.modules, "id", engineKey(speed, nil), config, wasm, nil, &taskLimits{}, diag)
+	require.NoError(t, err)
+	d.modules.Release("id")
+
+	d.relieveMemoryPressure(90)
+	require.Equal(t, 1, d.modules.Len())
+
+	used = 95
+	d.relieveMemoryPressure(90)
+	require.Zero(t, d.modules.Len())
+
+	for _, w := range []float64{-1, 101} {
+		require.Error(t, setConfig(t, d, &Config{
+			DataDir:        t.TempDir(),
+			MemoryPressure: MemoryPressureConfig{Watermark: w},
+		}))
+	}
+	require.NoError(t, setConfig(t, d, &Config{
+		DataDir:        t.TempDir(),
+		MemoryPressure: MemoryPressureConfig{Watermark: 90},
+	}))
+	require.NotNil(t, d.stopMemoryPressureWatch)
+}
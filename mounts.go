@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// mountStagingDir is the directory, relative to the task dir, under which
+	// host mounts are bind mounted before being preopened for the guest
+	mountStagingDir = ".wasmtime-mounts"
+
+	// mountPollInterval is how often a mount source is checked while waiting
+	// for it to become available
+	mountPollInterval = 100 * time.Millisecond
+)
+
+// preopen is a host directory exposed to the guest as a WASI preopen.
+type preopen struct {
+	// HostPath is the directory handed to wasmtime. For staged mounts this is
+	// the bind mount under the task dir rather than the original source.
+	HostPath string
+
+	// GuestPath is the path the guest sees the directory under
+	GuestPath string
+
+	// Readonly is set when the guest must not be able to modify the directory
+	Readonly bool
+
+	// Staged is set when HostPath is a bind mount owned by the driver which
+	// must be unmounted and removed when the task is destroyed.
+	Staged bool
+}
+
+// taskMounts returns the mount blocks of a task as mounts to stage. Host
+// paths must be absolute and, once symlinks are resolved, within allowed.
+func taskMounts(mounts []TaskMountConfig, allowed []string) ([]*drivers.MountConfig, error) {
+	result := make([]*drivers.MountConfig, 0, len(mounts))
+	for _, m := range mounts {
+		if !filepath.IsAbs(m.HostPath) {
+			return nil, fmt.Errorf("mount host_path %q must be absolute", m.HostPath)
+		}
+		if !path.IsAbs(m.GuestPath) {
+			return nil, fmt.Errorf("mount guest_path %q must be absolute", m.GuestPath)
+		}
+		host, err := filepath.EvalSymlinks(m.HostPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve mount host_path %q: %v", m.HostPath, err)
+		}
+		if !withinPaths(host, allowed) {
+			return nil, fmt.Errorf("mount host_path %q isn't in the plugin's allowed_host_paths", m.HostPath)
+		}
+		result = append(result, &drivers.MountConfig{HostPath: host, TaskPath: m.GuestPath, Readonly: m.Readonly})
+	}
+	return result, nil
+}
+
+// withinPaths returns whether p is one of dirs or under one of them
+func withinPaths(p string, dirs []string) bool {
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// stageMounts turns the mounts Nomad passed in the task config (host volumes,
+// CSI volumes, ...) and the task's own mounts into preopens. Each mount is
+// bind mounted into the task dir so read-only volumes can be enforced by the
+// kernel, given that WASI preopens carry no rights of their own. If staging
+// fails with an error, any mount that was already staged is cleaned up
+// again. Each source is waited for up to timeout.
+func (d *Driver) stageMounts(cfg *drivers.TaskConfig, mounts []*drivers.MountConfig, timeout time.Duration) ([]*preopen, error) {
+	all := append(append([]*drivers.MountConfig(nil), cfg.Mounts...), mounts...)
+	preopens := make([]*preopen, 0, len(all))
+	for i, m := range all {
+		p, err := d.stageMount(cfg, i, m, timeout)
+		if err != nil {
+			d.unstageMounts(preopens)
+			return nil, err
+		}
+		preopens = append(preopens, p)
+	}
+	return preopens, nil
+}
+
+func (d *Driver) stageMount(cfg *drivers.TaskConfig, idx int, m *drivers.MountConfig, timeout time.Duration) (*preopen, error) {
+	if m.TaskPath == "" {
+		return nil, fmt.Errorf("mount %q has no task path", m.HostPath)
+	}
+
+	if err := waitForMountSource(m.HostPath, timeout); err != nil {
+		return nil, err
+	}
+
+	p := &preopen{
+		HostPath:  m.HostPath,
+		GuestPath: m.TaskPath,
+		Readonly:  m.Readonly,
+	}
+
+	target := filepath.Join(cfg.TaskDir().Dir, mountStagingDir, strconv.Itoa(idx))
+	if err := os.MkdirAll(target, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create staging dir for mount %q: %v", m.TaskPath, err)
+	}
+
+	if err := bindMount(m.HostPath, target, m.Readonly); err != nil {
+		os.Remove(target)
+
+		// Without the bind mount a read-only volume would be writable by
+		// the guest, so refuse to continue instead of silently widening
+		// its rights.
+		if m.Readonly {
+			return nil, fmt.Errorf("failed to stage read-only mount %q at %q: %v", m.HostPath, m.TaskPath, err)
+		}
+
+		d.logger.Debug("failed to stage mount, preopening source directly",
+			"host_path", m.HostPath, "task_path", m.TaskPath, "error", err)
+		return p, nil
+	}
+
+	p.HostPath = target
+	p.Staged = true
+	return p, nil
+}
+
+// unstageMounts unmounts and removes any staged mount in preopens. Errors are
+// logged so that a single stuck mount doesn't prevent cleaning up the others.
+func (d *Driver) unstageMounts(preopens []*preopen) {
+	for _, p := range preopens {
+		if !p.Staged {
+			continue
+		}
+
+		if err := unmount(p.HostPath); err != nil {
+			d.logger.Error("failed to unmount staged mount", "path", p.HostPath, "error", err)
+			continue
+		}
+
+		if err := os.Remove(p.HostPath); err != nil && !os.IsNotExist(err) {
+			d.logger.Error("failed to remove staged mount", "path", p.HostPath, "error", err)
+		}
+	}
+}
+
+// waitForMountSource blocks until path exists and is a directory. CSI volumes
+// are published by the node plugin asynchronously, so the source may briefly
+// be missing when the task starts.
+func waitForMountSource(path string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		fi, err := os.Stat(path)
+		switch {
+		case err == nil && !fi.IsDir():
+			return fmt.Errorf("mount source %q is not a directory", path)
+		case err == nil:
+			return nil
+		case !os.IsNotExist(err):
+			return fmt.Errorf("failed to stat mount source %q: %v", path, err)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for mount source %q to become available", timeout, path)
+		}
+		time.Sleep(mountPollInterval)
+	}
+}
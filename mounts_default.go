@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// bindMount is not supported outside of Linux; writable mounts are preopened
+// from their source instead.
+func bindMount(source, target string, readonly bool) error {
+	return errors.New("bind mounts are not supported on this platform")
+}
+
+func unmount(target string) error {
+	return nil
+}
@@ -0,0 +1,120 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindMount bind mounts source, and the mounts under it, onto target,
+// remounting each read-only if requested. The read-only flag is ignored by
+// the kernel on the initial bind, and a remount only changes the mount it's
+// made on, hence the separate remount of target and of every submount.
+// A read-only target is made private, so mounts made under source once it's
+// bound don't propagate to it writable.
+func bindMount(source, target string, readonly bool) error {
+	if err := unix.Mount(source, target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return err
+	}
+
+	if !readonly {
+		return nil
+	}
+
+	if err := remountReadonly(target); err != nil {
+		unix.Unmount(target, unix.MNT_DETACH)
+		return err
+	}
+	return nil
+}
+
+// remountReadonly makes the mount at target and the mounts under it
+// private and read-only
+func remountReadonly(target string) error {
+	if err := unix.Mount("", target, "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to make %q private: %v", target, err)
+	}
+	points, err := mountPoints(target)
+	if err != nil {
+		return err
+	}
+	flags := uintptr(unix.MS_REMOUNT | unix.MS_BIND | unix.MS_RDONLY)
+	for _, p := range points {
+		if err := unix.Mount("", p, "", flags, ""); err != nil {
+			return fmt.Errorf("failed to remount %q read-only: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// mountPoints returns target and the mount points under it, as listed in
+// /proc/self/mountinfo, parents first
+func mountPoints(target string) ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mounts: %v", err)
+	}
+	defer f.Close()
+
+	target = filepath.Clean(target)
+	points := []string{target}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		p, err := unescapeMountPoint(fields[4])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read mounts: %v", err)
+		}
+		if strings.HasPrefix(p, target+"/") {
+			points = append(points, p)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read mounts: %v", err)
+	}
+	return points, nil
+}
+
+// unescapeMountPoint decodes the octal escapes of the spaces, tabs,
+// newlines and backslashes of a mount point in mountinfo
+func unescapeMountPoint(p string) (string, error) {
+	if !strings.Contains(p, `\`) {
+		return p, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] != '\\' || i+4 > len(p) {
+			b.WriteByte(p[i])
+			continue
+		}
+		c, err := strconv.ParseUint(p[i+1:i+4], 8, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid mount point %q", p)
+		}
+		b.WriteByte(byte(c))
+		i += 3
+	}
+	return b.String(), nil
+}
+
+// unmount lazily detaches the mount at target so a guest still holding open
+// files doesn't make the cleanup fail.
+func unmount(target string) error {
+	err := unix.Unmount(target, unix.MNT_DETACH)
+	if err == unix.EINVAL {
+		// not a mount point anymore
+		return nil
+	}
+	return err
+}
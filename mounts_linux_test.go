@@ -0,0 +1,48 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestBindMount_ReadonlySubmounts(t *testing.T) {
+	source := t.TempDir()
+	nested := filepath.Join(source, "nested")
+	require.NoError(t, os.Mkdir(nested, 0755))
+	if err := unix.Mount("tmpfs", nested, "tmpfs", 0, ""); err != nil {
+		t.Skipf("can't mount: %v", err)
+	}
+	defer unix.Unmount(nested, unix.MNT_DETACH)
+
+	target := t.TempDir()
+	require.NoError(t, bindMount(source, target, true))
+	defer unmount(target)
+
+	// the mount under source is read-only in target too
+	for _, dir := range []string{target, filepath.Join(target, "nested")} {
+		err := os.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+		require.Error(t, err, dir)
+		require.ErrorIs(t, err, unix.EROFS)
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(nested, "file"), nil, 0644))
+}
+
+func TestUnescapeMountPoint(t *testing.T) {
+	p, err := unescapeMountPoint(`/alloc/my\040volume\134x`)
+	require.NoError(t, err)
+	require.Equal(t, `/alloc/my volume\x`, p)
+
+	p, err = unescapeMountPoint(`/alloc/dir\`)
+	require.NoError(t, err)
+	require.Equal(t, `/alloc/dir\`, p)
+
+	_, err = unescapeMountPoint(`/alloc/\9xy`)
+	require.Error(t, err)
+}
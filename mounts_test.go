@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMounts_WaitForMountSource(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("available", func(t *testing.T) {
+		require.NoError(t, waitForMountSource(dir, time.Second))
+	})
+
+	t.Run("appears while waiting", func(t *testing.T) {
+		path := filepath.Join(dir, "late")
+		go func() {
+			time.Sleep(2 * mountPollInterval)
+			os.Mkdir(path, 0755)
+		}()
+		require.NoError(t, waitForMountSource(path, 5*time.Second))
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		err := waitForMountSource(filepath.Join(dir, "missing"), mountPollInterval)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "timed out")
+	})
+
+	t.Run("not a directory", func(t *testing.T) {
+		path := filepath.Join(dir, "file")
+		require.NoError(t, os.WriteFile(path, nil, 0644))
+		err := waitForMountSource(path, time.Second)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "not a directory")
+	})
+}
+
+func TestTaskMounts(t *testing.T) {
+	allowed := t.TempDir()
+	dir := filepath.Join(allowed, "data")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	outside := t.TempDir()
+	link := filepath.Join(allowed, "escape")
+	require.NoError(t, os.Symlink(outside, link))
+
+	mounts, err := taskMounts([]TaskMountConfig{
+		{HostPath: dir, GuestPath: "/data", Readonly: true},
+		{HostPath: allowed + "/", GuestPath: "/all"},
+	}, []string{allowed})
+	require.NoError(t, err)
+	require.Len(t, mounts, 2)
+	require.Equal(t, dir, mounts[0].HostPath)
+	require.Equal(t, "/data", mounts[0].TaskPath)
+	require.True(t, mounts[0].Readonly)
+
+	for _, m := range []TaskMountConfig{
+		{HostPath: "data", GuestPath: "/data"},
+		{HostPath: dir, GuestPath: "data"},
+		{HostPath: outside, GuestPath: "/data"},
+		{HostPath: link, GuestPath: "/data"},
+		{HostPath: allowed + "-other", GuestPath: "/data"},
+	} {
+		_, err := taskMounts([]TaskMountConfig{m}, []string{allowed})
+		require.Error(t, err, "%+v", m)
+	}
+
+	// nothing may be mounted unless the plugin allows it
+	_, err = taskMounts([]TaskMountConfig{{HostPath: dir, GuestPath: "/data"}}, nil)
+	require.Error(t, err)
+	require.True(t, withinPaths(dir, []string{"/"}))
+}
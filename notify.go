@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// defaultNotifyTimeout bounds the exit notification if notify.timeout isn't
+// set
+const defaultNotifyTimeout = 10 * time.Second
+
+// exitSummary is what is posted to the task's notify.url when it exits
+type exitSummary struct {
+	TaskID    string `json:"task_id"`
+	AllocID   string `json:"alloc_id"`
+	JobName   string `json:"job_name,omitempty"`
+	TaskGroup string `json:"task_group,omitempty"`
+	TaskName  string `json:"task_name"`
+
+	ExitCode  int    `json:"exit_code"`
+	Signal    int    `json:"signal,omitempty"`
+	OOMKilled bool   `json:"oom_killed,omitempty"`
+	Trap      string `json:"trap,omitempty"`
+	Error     string `json:"error,omitempty"`
+
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Duration   string    `json:"duration"`
+
+	// FuelConsumed is only known of guests run in the plugin
+	FuelConsumed uint64 `json:"fuel_consumed,omitempty"`
+}
+
+// parseNotify checks the task's notify block and returns how long its
+// request may take
+func parseNotify(config *TaskNotifyConfig) (time.Duration, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return 0, fmt.Errorf("invalid notify.url %q: %v", config.URL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return 0, fmt.Errorf("invalid notify.url %q: must be an http or https URL", config.URL)
+	}
+	if config.Timeout == "" {
+		return defaultNotifyTimeout, nil
+	}
+	timeout, err := time.ParseDuration(config.Timeout)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid notify.timeout %q", config.Timeout)
+	}
+	return timeout, nil
+}
+
+// exitSummary returns the summary of the exited task
+func (h *TaskHandle) exitSummary() *exitSummary {
+	h.stateLock.RLock()
+	defer h.stateLock.RUnlock()
+
+	s := &exitSummary{
+		TaskID:       h.taskConfig.ID,
+		AllocID:      h.taskConfig.AllocID,
+		JobName:      h.taskConfig.JobName,
+		TaskGroup:    h.taskConfig.TaskGroupName,
+		TaskName:     h.taskConfig.Name,
+		ExitCode:     h.exitResult.ExitCode,
+		Signal:       h.exitResult.Signal,
+		OOMKilled:    h.exitResult.OOMKilled,
+		StartedAt:    h.startedAt.UTC(),
+		FinishedAt:   h.completedAt.UTC(),
+		Duration:     h.completedAt.Sub(h.startedAt).String(),
+		FuelConsumed: h.fuelConsumed,
+	}
+	if h.trap != nil {
+		s.Trap = h.trap.Error()
+	}
+	if h.exitResult.Err != nil {
+		s.Error = h.exitResult.Err.Error()
+	}
+	return s
+}
+
+// notifyExit posts the summary of h's exit to its notify.url, if set.
+// Failures are only logged, the task's exit result doesn't depend on them.
+func (d *Driver) notifyExit(h *TaskHandle) {
+	if h.notify == nil {
+		return
+	}
+	timeout, err := parseNotify(h.notify)
+	if err != nil {
+		h.logger.Warn("failed to notify task exit", "task_id", h.taskConfig.ID, "error", err)
+		return
+	}
+	body, err := json.Marshal(h.exitSummary())
+	if err != nil {
+		h.logger.Warn("failed to encode task exit", "task_id", h.taskConfig.ID, "error", err)
+		return
+	}
+
+	d.configLock.RLock()
+	client := d.httpClient
+	d.configLock.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.notify.URL, bytes.NewReader(body))
+	if err != nil {
+		h.logger.Warn("failed to notify task exit", "task_id", h.taskConfig.ID, "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		h.logger.Warn("failed to notify task exit", "task_id", h.taskConfig.ID, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		h.logger.Warn("failed to notify task exit", "task_id", h.taskConfig.ID, "status", resp.Status)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+const trapWat = `
+(module
+  (memory (export "memory") 1)
+  (func (export "_start") unreachable)
+)`
+
+func TestParseNotify(t *testing.T) {
+	timeout, err := parseNotify(&TaskNotifyConfig{URL: "https://example.com/hook"})
+	require.NoError(t, err)
+	require.Equal(t, defaultNotifyTimeout, timeout)
+	timeout, err = parseNotify(&TaskNotifyConfig{URL: "http://10.0.0.1:8080/", Timeout: "2s"})
+	require.NoError(t, err)
+	require.Equal(t, 2*time.Second, timeout)
+
+	for _, config := range []TaskNotifyConfig{
+		{URL: ""},
+		{URL: "ftp://example.com/hook"},
+		{URL: "/hook"},
+		{URL: "https://example.com", Timeout: "soon"},
+		{URL: "https://example.com", Timeout: "-1s"},
+	} {
+		_, err := parseNotify(&config)
+		require.Error(t, err, "%+v", config)
+	}
+}
+
+// notifyServer returns a webhook and the exit summaries posted to it
+func notifyServer(t *testing.T) (string, <-chan exitSummary) {
+	summaries := make(chan exitSummary, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var s exitSummary
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected %s request of %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			t.Errorf("failed to decode exit summary: %v", err)
+		}
+		summaries <- s
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, summaries
+}
+
+// waitSummary returns the exit summary posted to the webhook
+func waitSummary(t *testing.T, summaries <-chan exitSummary) exitSummary {
+	t.Helper()
+	select {
+	case s := <-summaries:
+		return s
+	case <-time.After(10 * time.Second):
+		t.Fatal("task exit wasn't notified")
+		return exitSummary{}
+	}
+}
+
+func TestStartTask_Notify(t *testing.T) {
+	url, summaries := notifyServer(t)
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := startTestTask(t, d, helloWat, &TaskConfig{Notify: &TaskNotifyConfig{URL: url}})
+
+	res := waitTestTask(t, d, cfg.ID)
+	require.Equal(t, 3, res.ExitCode)
+	s := waitSummary(t, summaries)
+	require.Equal(t, cfg.ID, s.TaskID)
+	require.Equal(t, cfg.AllocID, s.AllocID)
+	require.Equal(t, 3, s.ExitCode)
+	require.Empty(t, s.Trap)
+	require.NotZero(t, s.FuelConsumed)
+	require.False(t, s.FinishedAt.Before(s.StartedAt))
+	_, err := time.ParseDuration(s.Duration)
+	require.NoError(t, err)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
+
+func TestStartTask_NotifyTrap(t *testing.T) {
+	url, summaries := notifyServer(t)
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := startTestTask(t, d, trapWat, &TaskConfig{Notify: &TaskNotifyConfig{URL: url}})
+
+	res := waitTestTask(t, d, cfg.ID)
+	require.Equal(t, 1, res.ExitCode)
+	s := waitSummary(t, summaries)
+	require.Equal(t, 1, s.ExitCode)
+	require.Contains(t, s.Trap, "unreachable")
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
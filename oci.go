@@ -0,0 +1,411 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// defaultRegistry is used for image references without a registry host
+	defaultRegistry = "registry-1.docker.io"
+
+	// docker media types which registries still commonly serve
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// whiteoutPrefix marks files deleted by an upper layer
+	whiteoutPrefix = ".wh."
+)
+
+// imageRef is a parsed container image reference
+type imageRef struct {
+	Registry   string
+	Repository string
+
+	// Reference is either a tag or a digest
+	Reference string
+}
+
+var bearerParamRe = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// parseImageRef parses references such as "alpine", "ghcr.io/org/app:v1" or
+// "registry:5000/app@sha256:...", applying the same defaults as docker.
+func parseImageRef(ref string) (*imageRef, error) {
+	if ref == "" {
+		return nil, fmt.Errorf("empty image reference")
+	}
+
+	r := &imageRef{Registry: defaultRegistry}
+	name := ref
+	if i := strings.IndexRune(name, '/'); i != -1 {
+		host := name[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			r.Registry = host
+			name = name[i+1:]
+		}
+	}
+	if r.Registry == "docker.io" || r.Registry == "index.docker.io" {
+		r.Registry = defaultRegistry
+	}
+
+	if i := strings.Index(name, "@"); i != -1 {
+		r.Reference = name[i+1:]
+		name = name[:i]
+		if _, err := digest.Parse(r.Reference); err != nil {
+			return nil, fmt.Errorf("invalid digest in image reference %q: %v", ref, err)
+		}
+	} else if i := strings.LastIndex(name, ":"); i != -1 {
+		r.Reference = name[i+1:]
+		name = name[:i]
+	} else {
+		r.Reference = "latest"
+	}
+
+	if name == "" {
+		return nil, fmt.Errorf("invalid image reference %q", ref)
+	}
+	if r.Registry == defaultRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	r.Repository = name
+	return r, nil
+}
+
+func (r *imageRef) String() string {
+	sep := ":"
+	if strings.Contains(r.Reference, ":") {
+		sep = "@"
+	}
+	return r.Registry + "/" + r.Repository + sep + r.Reference
+}
+
+// imageSource returns the source of the file at filePath in image, as
+// recorded in the artifact store. Only images pinned by digest have one, as
+// the file behind a tag can change.
+func imageSource(image, filePath string) (string, bool) {
+	ref, err := parseImageRef(image)
+	if err != nil || !strings.Contains(ref.Reference, ":") {
+		return "", false
+	}
+	return ref.String() + "//" + strings.TrimPrefix(path.Clean("/"+filePath), "/"), true
+}
+
+// registryClient is a minimal OCI distribution client, supporting just
+// enough of the protocol to fetch manifests and blobs anonymously.
+type registryClient struct {
+	client *http.Client
+
+	// limiter throttles blob downloads
+	limiter *downloadLimiter
+
+	// token is the bearer token obtained for the current repository, if the
+	// registry requires one
+	token string
+}
+
+func newRegistryClient(client *http.Client, limiter *downloadLimiter) *registryClient {
+	return &registryClient{
+		client:  client,
+		limiter: limiter,
+	}
+}
+
+// extractImageFile pulls the layers of image from the top down until it finds
+// filePath and returns its contents. Only the layers above and including the
+// one holding the file are downloaded.
+func (c *registryClient) extractImageFile(ctx context.Context, image, filePath string, maxSize int64) ([]byte, error) {
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed waiting for a download slot: %v", err)
+	}
+	defer release()
+
+	manifest, err := c.fetchManifest(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	target := strings.TrimPrefix(path.Clean("/"+filePath), "/")
+	for i := len(manifest.Layers) - 1; i >= 0; i-- {
+		b, found, deleted, err := c.searchLayer(ctx, ref, manifest.Layers[i], target, maxSize)
+		if err != nil {
+			return nil, err
+		}
+		if deleted {
+			break
+		}
+		if found {
+			return b, nil
+		}
+	}
+
+	return nil, fmt.Errorf("file %q not found in image %s", filePath, ref)
+}
+
+// fetchManifest resolves ref to an image manifest, selecting the platform
+// specific manifest if ref points to an index.
+func (c *registryClient) fetchManifest(ctx context.Context, ref *imageRef) (*specs.Manifest, error) {
+	accept := []string{
+		specs.MediaTypeImageManifest,
+		specs.MediaTypeImageIndex,
+		mediaTypeDockerManifest,
+		mediaTypeDockerManifestList,
+	}
+
+	resp, err := c.get(ctx, ref, "manifests/"+ref.Reference, accept)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest for %s: %v", ref, err)
+	}
+	// manifests pulled by digest, as from an index, must match it
+	if d, err := digest.Parse(ref.Reference); err == nil && d.Algorithm().FromBytes(body) != d {
+		return nil, fmt.Errorf("manifest for %s doesn't match its digest", ref)
+	}
+
+	mediaType := resp.Header.Get("Content-Type")
+	switch mediaType {
+	case specs.MediaTypeImageIndex, mediaTypeDockerManifestList:
+		var index specs.Index
+		if err := json.Unmarshal(body, &index); err != nil {
+			return nil, fmt.Errorf("failed to decode image index for %s: %v", ref, err)
+		}
+
+		desc, err := selectPlatform(index.Manifests)
+		if err != nil {
+			return nil, fmt.Errorf("image %s: %v", ref, err)
+		}
+		platformRef := *ref
+		platformRef.Reference = desc.Digest.String()
+		return c.fetchManifest(ctx, &platformRef)
+	}
+
+	var manifest specs.Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest for %s: %v", ref, err)
+	}
+	return &manifest, nil
+}
+
+// selectPlatform picks the manifest to use from an index, preferring wasm
+// specific images over ones built for the client's own platform.
+func selectPlatform(manifests []specs.Descriptor) (*specs.Descriptor, error) {
+	var native *specs.Descriptor
+	for i := range manifests {
+		p := manifests[i].Platform
+		if p == nil {
+			continue
+		}
+		if p.Architecture == "wasm" {
+			return &manifests[i], nil
+		}
+		if native == nil && p.OS == runtime.GOOS && p.Architecture == runtime.GOARCH {
+			native = &manifests[i]
+		}
+	}
+	if native == nil {
+		return nil, fmt.Errorf("no manifest for wasm or %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+	return native, nil
+}
+
+// searchLayer streams a layer looking for target. deleted is set if the layer
+// contains a whiteout for target, meaning lower layers must not be searched.
+// The rest of the layer is read once the search ends, so the whole blob is
+// checked against its digest before the result is used.
+func (c *registryClient) searchLayer(ctx context.Context, ref *imageRef, layer specs.Descriptor, target string, maxSize int64) (b []byte, found, deleted bool, err error) {
+	if err := layer.Digest.Validate(); err != nil {
+		return nil, false, false, fmt.Errorf("invalid layer digest %q: %v", layer.Digest, err)
+	}
+	resp, err := c.get(ctx, ref, "blobs/"+layer.Digest.String(), nil)
+	if err != nil {
+		return nil, false, false, err
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	if layer.Size > 0 {
+		body = io.LimitReader(body, layer.Size)
+	}
+	verifier := layer.Digest.Verifier()
+	r := io.TeeReader(c.limiter.reader(ctx, body), verifier)
+	if b, found, deleted, err = findInLayer(r, ref, layer, target, maxSize); err != nil {
+		return nil, false, false, err
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, false, false, fmt.Errorf("failed to read layer %s: %v", layer.Digest, err)
+	}
+	if !verifier.Verified() {
+		return nil, false, false, fmt.Errorf("layer %s of image %s doesn't match its digest", layer.Digest, ref)
+	}
+	return b, found, deleted, nil
+}
+
+// findInLayer looks for target in the layer read from r, as searchLayer
+func findInLayer(r io.Reader, ref *imageRef, layer specs.Descriptor, target string, maxSize int64) (b []byte, found, deleted bool, err error) {
+	switch {
+	case strings.HasSuffix(layer.MediaType, "+zstd"):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, false, false, fmt.Errorf("failed to decompress layer %s: %v", layer.Digest, err)
+		}
+		defer zr.Close()
+		r = zr
+	case strings.HasSuffix(layer.MediaType, "+gzip") || layer.MediaType == mediaTypeDockerLayer:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, false, false, fmt.Errorf("failed to decompress layer %s: %v", layer.Digest, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	whiteout := path.Join(path.Dir(target), whiteoutPrefix+path.Base(target))
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, false, false, nil
+		}
+		if err != nil {
+			return nil, false, false, fmt.Errorf("failed to read layer %s: %v", layer.Digest, err)
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		switch {
+		case name == whiteout:
+			return nil, false, true, nil
+		case name != target:
+			continue
+		case hdr.Typeflag != tar.TypeReg:
+			return nil, false, false, fmt.Errorf("%q in image %s is not a regular file", target, ref)
+		case hdr.Size > maxSize:
+			return nil, false, false, fmt.Errorf("%q in image %s exceeds max_decompressed_size of %d bytes", target, ref, maxSize)
+		}
+
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, false, false, fmt.Errorf("failed to extract %q from layer %s: %v", target, layer.Digest, err)
+		}
+		return b, true, false, nil
+	}
+}
+
+// get issues a GET against the registry API of ref's repository, fetching a
+// bearer token first if the registry challenges the request.
+func (c *registryClient) get(ctx context.Context, ref *imageRef, suffix string, accept []string) (*http.Response, error) {
+	u := fmt.Sprintf("https://%s/v2/%s/%s", ref.Registry, ref.Repository, suffix)
+
+	do := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range accept {
+			req.Header.Add("Accept", a)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		return c.client.Do(req)
+	}
+
+	resp, err := do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %v", u, err)
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		if err := c.authenticate(ctx, challenge); err != nil {
+			return nil, fmt.Errorf("failed to authenticate to %s: %v", ref.Registry, err)
+		}
+		if resp, err = do(); err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %v", u, err)
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to fetch %s: unexpected status %s", u, resp.Status)
+	}
+	return resp, nil
+}
+
+// authenticate obtains an anonymous bearer token as described by a
+// `WWW-Authenticate: Bearer realm=...,service=...,scope=...` challenge.
+func (c *registryClient) authenticate(ctx context.Context, challenge string) error {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return fmt.Errorf("unsupported auth challenge %q", challenge)
+	}
+
+	params := map[string]string{}
+	for _, m := range bearerParamRe.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	realm, ok := params["realm"]
+	if !ok {
+		return fmt.Errorf("auth challenge %q has no realm", challenge)
+	}
+
+	q := url.Values{}
+	for _, k := range []string{"service", "scope"} {
+		if v, ok := params[k]; ok {
+			q.Set(k, v)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token request failed: %s", resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("failed to decode token response: %v", err)
+	}
+
+	c.token = token.Token
+	if c.token == "" {
+		c.token = token.AccessToken
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOCI_ParseImageRef(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected imageRef
+	}{
+		{"alpine", imageRef{defaultRegistry, "library/alpine", "latest"}},
+		{"docker.io/org/app:v1", imageRef{defaultRegistry, "org/app", "v1"}},
+		{"ghcr.io/org/app", imageRef{"ghcr.io", "org/app", "latest"}},
+		{"localhost:5000/app:dev", imageRef{"localhost:5000", "app", "dev"}},
+		{
+			"ghcr.io/org/app@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			imageRef{"ghcr.io", "org/app", "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.input, func(t *testing.T) {
+			ref, err := parseImageRef(c.input)
+			require.NoError(t, err)
+			require.Equal(t, c.expected, *ref)
+		})
+	}
+
+	_, err := parseImageRef("app@sha256:nope")
+	require.Error(t, err)
+}
+
+// layer builds a gzipped tar layer from name/content pairs
+func layer(t *testing.T, files ...string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for i := 0; i < len(files); i += 2 {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     files[i],
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(files[i+1])),
+		}))
+		tw.Write([]byte(files[i+1]))
+	}
+	tw.Close()
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestOCI_ExtractImageFile(t *testing.T) {
+	layers := [][]byte{
+		layer(t, "app.wasm", "old", "lib.wasm", "lib"),
+		layer(t, "./app.wasm", "new", ".wh.lib.wasm", ""),
+		layer(t, "etc/config", "cfg"),
+	}
+
+	blobs := map[string][]byte{}
+	manifest := specs.Manifest{}
+	for _, l := range layers {
+		d := digest.FromBytes(l)
+		blobs[d.String()] = l
+		manifest.Layers = append(manifest.Layers, specs.Descriptor{
+			MediaType: specs.MediaTypeImageLayerGzip,
+			Digest:    d,
+			Size:      int64(len(l)),
+		})
+	}
+
+	var fetched []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v2/app/manifests/"):
+			w.Header().Set("Content-Type", specs.MediaTypeImageManifest)
+			json.NewEncoder(w).Encode(manifest)
+		case strings.HasPrefix(r.URL.Path, "/v2/app/blobs/"):
+			d := strings.TrimPrefix(r.URL.Path, "/v2/app/blobs/")
+			fetched = append(fetched, d)
+			w.Write(blobs[d])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	image := strings.TrimPrefix(srv.URL, "https://") + "/app:latest"
+	c := newRegistryClient(srv.Client(), newDownloadLimiter(1, 0))
+
+	b, err := c.extractImageFile(context.Background(), image, "/app.wasm", 1024)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(b))
+	require.Len(t, fetched, 2, "lower layers must not be pulled")
+
+	_, err = c.extractImageFile(context.Background(), image, "/lib.wasm", 1024)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not found")
+
+	_, err = c.extractImageFile(context.Background(), image, "/app.wasm", 2)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "max_decompressed_size")
+
+	// blobs are checked against their digest, even past the file found
+	top := manifest.Layers[2].Digest.String()
+	blobs[top] = layer(t, "app.wasm", "evil")
+	_, err = c.extractImageFile(context.Background(), image, "/app.wasm", 1024)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "doesn't match its digest")
+
+	// and so are manifests pulled by digest
+	_, err = c.extractImageFile(context.Background(), strings.TrimPrefix(srv.URL, "https://")+"/app@"+digest.FromString("other").String(), "/app.wasm", 1024)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "manifest for")
+	require.Contains(t, err.Error(), "doesn't match its digest")
+}
+
+func TestOCI_ImageSource(t *testing.T) {
+	source, ok := imageSource("ghcr.io/org/app@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", "/app.wasm")
+	require.True(t, ok)
+	require.Equal(t, "ghcr.io/org/app@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef//app.wasm", source)
+
+	// tags can move, so their files aren't cached
+	_, ok = imageSource("ghcr.io/org/app:v1", "/app.wasm")
+	require.False(t, ok)
+	_, ok = imageSource("", "/app.wasm")
+	require.False(t, ok)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// The causes of a task running out of memory
+const (
+	// oomGuest is the guest hitting the memory limit of its linear memory
+	oomGuest = "guest"
+
+	// oomCgroup is the kernel killing the task's process for exceeding the
+	// memory limit of its cgroup
+	oomCgroup = "cgroup"
+
+	// oomHost is the kernel killing the task's process because the node ran
+	// out of memory
+	oomHost = "host"
+)
+
+const (
+	// wasmPageSize is the size of a page of linear memory
+	wasmPageSize = 64 * 1024
+
+	// hostOOMWatermark is the percentage of the node's memory in use above
+	// which a task killed by SIGKILL is assumed to be a victim of the
+	// kernel's OOM killer
+	hostOOMWatermark = 90.0
+)
+
+// exitInfo is what is known about how a task exited, to tell whether it ran
+// out of memory
+type exitInfo struct {
+	// trap is the error the guest stopped with, if it ran in process
+	trap error
+
+	// exitCode is the code the guest exited with, if it ran in process
+	exitCode int
+
+	// memorySize is the size of the guest's linear memory when it stopped,
+	// memoryLimit is its limit or 0 if unlimited
+	memorySize  uint64
+	memoryLimit uint64
+
+	// signal is the signal that killed the task's process, if any
+	signal int
+
+	// cgroupOOMKill is whether the task's cgroup recorded an OOM kill since
+	// the task started
+	cgroupOOMKill bool
+
+	// hostMemoryUsed is the percentage of the node's memory in use when the
+	// task exited
+	hostMemoryUsed float64
+
+	// fuelConsumed is the fuel the guest consumed, if it ran in process
+	fuelConsumed uint64
+}
+
+// classifyOOM returns whether the task ran out of memory and why, or "" if
+// it didn't. A guest trapping or exiting with an error with less than a page
+// of its memory limit left is assumed to have failed to grow its memory.
+func classifyOOM(info exitInfo) string {
+	switch {
+	case (info.trap != nil || info.exitCode != 0) && info.memoryLimit != 0 && info.memorySize+wasmPageSize > info.memoryLimit:
+		return oomGuest
+	case info.signal != int(syscall.SIGKILL):
+		return ""
+	case info.cgroupOOMKill:
+		return oomCgroup
+	case info.hostMemoryUsed >= hostOOMWatermark:
+		return oomHost
+	}
+	return ""
+}
+
+// oomMessage describes an OOM of the given cause in a task event
+func oomMessage(cause string, info exitInfo) string {
+	switch cause {
+	case oomGuest:
+		return fmt.Sprintf("Guest exceeded its memory limit of %s", humanize.IBytes(info.memoryLimit))
+	case oomCgroup:
+		return "Task was OOM killed for exceeding the memory limit of its cgroup"
+	case oomHost:
+		return fmt.Sprintf("Task was OOM killed while the node was out of memory (%.0f%% in use)", info.hostMemoryUsed)
+	}
+	return ""
+}
+
+// oomWatch tracks the OOM kills of a task's cgroup, so they can be told apart
+// from other SIGKILLs once the task exits
+type oomWatch struct {
+	cgroup string
+	kills  uint64
+}
+
+// watchOOM records the OOM kill count of pid's cgroup. It returns nil if the
+// count can't be read, in which case cgroup OOM kills aren't detected.
+func watchOOM(pid int) *oomWatch {
+	cgroup, err := processCgroup(pid)
+	if err != nil {
+		return nil
+	}
+	kills, err := cgroupOOMKills(cgroup)
+	if err != nil {
+		return nil
+	}
+	return &oomWatch{cgroup: cgroup, kills: kills}
+}
+
+// killed returns whether the cgroup recorded an OOM kill since the watch
+// started
+func (w *oomWatch) killed() bool {
+	if w == nil {
+		return false
+	}
+	kills, err := cgroupOOMKills(w.cgroup)
+	return err == nil && kills > w.kills
+}
+
+// emitOOM sends an event describing why the task ran out of memory
+func (d *Driver) emitOOM(cfg *drivers.TaskConfig, cause string, info exitInfo) {
+	err := d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:      cfg.ID,
+		AllocID:     cfg.AllocID,
+		TaskName:    cfg.Name,
+		Timestamp:   time.Now(),
+		Message:     oomMessage(cause, info),
+		Annotations: map[string]string{"oom_cause": cause},
+	})
+	if err != nil {
+		d.logger.Warn("failed to emit OOM event", "task_id", cfg.ID, "error", err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// processCgroup is not supported outside of Linux, so OOM kills are only
+// attributed to the host
+func processCgroup(pid int) (string, error) {
+	return "", errors.New("cgroups are only supported on linux")
+}
+
+func cgroupOOMKills(cgroup string) (uint64, error) {
+	return 0, errors.New("cgroups are only supported on linux")
+}
@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup filesystems are mounted
+var cgroupRoot = "/sys/fs/cgroup"
+
+// processCgroup returns the path of pid's memory cgroup under cgroupRoot,
+// for either cgroups v1 or v2
+func processCgroup(pid int) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	return parseProcCgroup(data)
+}
+
+// parseProcCgroup returns the memory cgroup listed in the content of a
+// /proc/<pid>/cgroup file
+func parseProcCgroup(data []byte) (string, error) {
+	var unified string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			unified = filepath.Join(cgroupRoot, parts[2])
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			if controller == "memory" {
+				return filepath.Join(cgroupRoot, "memory", parts[2]), nil
+			}
+		}
+	}
+	if unified == "" {
+		return "", fmt.Errorf("no memory cgroup")
+	}
+	return unified, nil
+}
+
+// cgroupOOMKills returns the number of processes of cgroup killed by the
+// OOM killer, from memory.events on cgroups v2 or memory.oom_control on v1
+func cgroupOOMKills(cgroup string) (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(cgroup, "memory.events"))
+	if err != nil {
+		data, err = ioutil.ReadFile(filepath.Join(cgroup, "memory.oom_control"))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("no oom_kill counter in %s", cgroup)
+}
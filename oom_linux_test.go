@@ -0,0 +1,46 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProcCgroup(t *testing.T) {
+	cgroup, err := parseProcCgroup([]byte("0::/nomad.slice/alloc.scope\n"))
+	require.NoError(t, err)
+	require.Equal(t, "/sys/fs/cgroup/nomad.slice/alloc.scope", cgroup)
+
+	cgroup, err = parseProcCgroup([]byte("12:cpu,cpuacct:/nomad/a\n4:memory:/nomad/a\n0::/\n"))
+	require.NoError(t, err)
+	require.Equal(t, "/sys/fs/cgroup/memory/nomad/a", cgroup)
+
+	_, err = parseProcCgroup([]byte("1:name=systemd:/\n"))
+	require.Error(t, err)
+}
+
+func TestOOMWatch(t *testing.T) {
+	v2 := t.TempDir()
+	events := filepath.Join(v2, "memory.events")
+	require.NoError(t, ioutil.WriteFile(events, []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n"), 0644))
+
+	w := &oomWatch{cgroup: v2}
+	w.kills, _ = cgroupOOMKills(v2)
+	require.False(t, w.killed())
+	require.NoError(t, ioutil.WriteFile(events, []byte("oom 2\noom_kill 2\n"), 0644))
+	require.True(t, w.killed())
+
+	v1 := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(v1, "memory.oom_control"), []byte("oom_kill_disable 0\nunder_oom 0\noom_kill 4\n"), 0644))
+	kills, err := cgroupOOMKills(v1)
+	require.NoError(t, err)
+	require.EqualValues(t, 4, kills)
+
+	var missing *oomWatch
+	require.False(t, missing.killed())
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyOOM(t *testing.T) {
+	sigkill := int(syscall.SIGKILL)
+	trap := errors.New("wasm trap: wasm `unreachable` instruction executed")
+
+	cases := []struct {
+		name     string
+		info     exitInfo
+		expected string
+	}{
+		{"clean exit", exitInfo{}, ""},
+		{"guest at its limit", exitInfo{trap: trap, memorySize: 16 * wasmPageSize, memoryLimit: 16 * wasmPageSize}, oomGuest},
+		{"guest failing at its limit", exitInfo{exitCode: 1, memorySize: 16 * wasmPageSize, memoryLimit: 16 * wasmPageSize}, oomGuest},
+		{"guest below its limit", exitInfo{trap: trap, memorySize: 2 * wasmPageSize, memoryLimit: 16 * wasmPageSize}, ""},
+		{"guest without limit", exitInfo{trap: trap, memorySize: 16 * wasmPageSize}, ""},
+		{"cgroup", exitInfo{signal: sigkill, cgroupOOMKill: true, hostMemoryUsed: 99}, oomCgroup},
+		{"host", exitInfo{signal: sigkill, hostMemoryUsed: 95}, oomHost},
+		{"sigkill", exitInfo{signal: sigkill, hostMemoryUsed: 50}, ""},
+		{"sigterm", exitInfo{signal: int(syscall.SIGTERM), cgroupOOMKill: true}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.expected, classifyOOM(c.info))
+		})
+	}
+
+	require.Equal(t, "Guest exceeded its memory limit of 1.0 MiB",
+		oomMessage(oomGuest, exitInfo{memoryLimit: 16 * wasmPageSize}))
+}
+
+func TestTaskHandle_ClassifyExit(t *testing.T) {
+	defer func(f func() (float64, error)) { memoryUsage = f }(memoryUsage)
+	memoryUsage = func() (float64, error) { return 97, nil }
+
+	h := reactorTask("a")
+	h.classifyExit(exitInfo{signal: int(syscall.SIGKILL)})
+	require.True(t, h.exitResult.OOMKilled)
+
+	cause, info := h.ranOutOfMemory()
+	require.Equal(t, oomHost, cause)
+	require.Equal(t, 97.0, info.hostMemoryUsed)
+	require.Equal(t, oomHost, h.TaskStatus().DriverAttributes["oom_cause"])
+}
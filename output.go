@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+// outputDrainTimeout is how long the pipes of a guest's output are read
+// after they were last found with data, once the task is done
+const outputDrainTimeout = 50 * time.Millisecond
+
+// guestOutput carries what the guests of a task write to stdout and stderr
+// to its log streams, the spools or the files of an external shipper.
+// wasmtime truncates the files it's given, which would drop what earlier
+// instances and attempts wrote, so guests write to pipes instead and the
+// output is appended to the streams.
+type guestOutput struct {
+	stdout *outputPipe
+	stderr *outputPipe
+}
+
+// openGuestOutput starts carrying the output of guests to streams
+func openGuestOutput(streams *logStreams) (*guestOutput, error) {
+	stdout, stderr := streams.Stdout, streams.Stderr
+	if streams.spooled() {
+		stdout, stderr = streams.StdoutSpool, streams.StderrSpool
+	}
+	o := &guestOutput{}
+	var err error
+	if o.stdout, err = openOutputPipe(stdout); err != nil {
+		return nil, err
+	}
+	if streams.MergeStderr {
+		o.stderr = o.stdout
+		return o, nil
+	}
+	if o.stderr, err = openOutputPipe(stderr); err != nil {
+		o.stdout.close()
+		return nil, err
+	}
+	return o, nil
+}
+
+// configure makes the guest of wasi write to the pipes
+func (o *guestOutput) configure(wasi *wasmtime.WasiConfig) error {
+	if err := wasi.SetStdoutFile(o.stdout.path()); err != nil {
+		return fmt.Errorf("failed to set guest stdout: %v", err)
+	}
+	if err := wasi.SetStderrFile(o.stderr.path()); err != nil {
+		return fmt.Errorf("failed to set guest stderr: %v", err)
+	}
+	return nil
+}
+
+// close appends what's left in the pipes to the streams and closes them.
+// It must only be called once the guests stopped writing.
+func (o *guestOutput) close() {
+	if o == nil {
+		return
+	}
+	o.stdout.close()
+	if o.stderr != o.stdout {
+		o.stderr.close()
+	}
+}
+
+// outputPipe copies what's written to its pipe to the end of a file. The
+// file is opened again if it was renamed or removed by a log rotation, so the
+// output isn't written to a file no shipper reads anymore.
+type outputPipe struct {
+	r, w    *os.File
+	fd      uintptr
+	dst     *os.File
+	dstPath string
+
+	draining int32
+	done     chan struct{}
+}
+
+func openOutputPipe(path string) (*outputPipe, error) {
+	dst, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log stream: %v", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		dst.Close()
+		return nil, fmt.Errorf("failed to create output pipe: %v", err)
+	}
+	p := &outputPipe{r: r, w: w, dst: dst, dstPath: path, done: make(chan struct{})}
+
+	// Fd would switch the pipe to blocking mode
+	conn, err := w.SyscallConn()
+	if err == nil {
+		err = conn.Control(func(fd uintptr) { p.fd = fd })
+	}
+	if err != nil {
+		r.Close()
+		w.Close()
+		dst.Close()
+		return nil, fmt.Errorf("failed to create output pipe: %v", err)
+	}
+
+	go p.copy()
+	return p, nil
+}
+
+// path is where guests open the pipe, each with a descriptor of its own
+func (p *outputPipe) path() string {
+	return fmt.Sprintf("/dev/fd/%d", p.fd)
+}
+
+func (p *outputPipe) copy() {
+	defer close(p.done)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := p.r.Read(buf)
+		if n > 0 {
+			p.write(buf[:n])
+			if atomic.LoadInt32(&p.draining) == 1 {
+				p.r.SetReadDeadline(time.Now().Add(outputDrainTimeout))
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// write appends b to the file, opening it again first if it was rotated
+func (p *outputPipe) write(b []byte) {
+	if rotated(p.dst, p.dstPath) {
+		if dst, err := os.OpenFile(p.dstPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600); err == nil {
+			p.dst.Close()
+			p.dst = dst
+		}
+	}
+	p.dst.Write(b)
+}
+
+// rotated returns whether path no longer names the open file f
+func rotated(f *os.File, path string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	return err != nil || !os.SameFile(fi, current)
+}
+
+// close copies what's left in the pipe. The descriptors of guests are only
+// closed once their stores are finalized, so rather than waiting for the end
+// of the pipe it's read until it stays empty for outputDrainTimeout.
+func (p *outputPipe) close() {
+	p.w.Close()
+	atomic.StoreInt32(&p.draining, 1)
+	p.r.SetReadDeadline(time.Now().Add(outputDrainTimeout))
+	<-p.done
+	p.r.Close()
+	p.dst.Close()
+}
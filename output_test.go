@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutputPipe_Rotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "task.stdout")
+	p, err := openOutputPipe(path)
+	require.NoError(t, err)
+
+	contents := func(path string) string {
+		b, _ := ioutil.ReadFile(path)
+		return string(b)
+	}
+	_, err = p.w.WriteString("before\n")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return contents(path) == "before\n" }, time.Second, 10*time.Millisecond)
+
+	// a shipper rotating the file by renaming it
+	require.NoError(t, os.Rename(path, path+".1"))
+	_, err = p.w.WriteString("after\n")
+	require.NoError(t, err)
+	p.close()
+
+	require.Equal(t, "before\n", contents(path+".1"))
+	require.Equal(t, "after\n", contents(path))
+}
+
+func TestGuestOutput_MergeStderr(t *testing.T) {
+	dir := t.TempDir()
+	streams := &logStreams{
+		Stdout:      filepath.Join(dir, "task.stdout"),
+		Stderr:      filepath.Join(dir, "task.stderr"),
+		Raw:         true,
+		MergeStderr: true,
+	}
+	o, err := openGuestOutput(streams)
+	require.NoError(t, err)
+	require.Equal(t, o.stdout.path(), o.stderr.path())
+
+	_, err = o.stderr.w.WriteString("oops\n")
+	require.NoError(t, err)
+	o.close()
+
+	out, err := ioutil.ReadFile(streams.Stdout)
+	require.NoError(t, err)
+	require.Equal(t, "oops\n", string(out))
+	require.NoFileExists(t, streams.Stderr)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul-template/signals"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// The signals pausing and resuming a task
+const (
+	signalStop = "SIGSTOP"
+	signalTstp = "SIGTSTP"
+	signalCont = "SIGCONT"
+)
+
+// pauser suspends a guest cooperatively. wasmtime-go traps when an epoch
+// deadline is reached rather than yielding to the host, so a trapped guest
+// can't be resumed; instead in-process guests wait on the pauser at each
+// call of an import, all of which hostCalls wraps, and between invocations,
+// keeping their instance intact. A guest computing without calling an import
+// only stops at its next call. Guests run by an executor are stopped with
+// SIGSTOP as well.
+type pauser struct {
+	lock     sync.Mutex
+	paused   bool
+	since    time.Time
+	resumeCh chan struct{}
+}
+
+func newPauser() *pauser {
+	return &pauser{}
+}
+
+// pause suspends the guest, returning false if it already was
+func (p *pauser) pause() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.paused {
+		return false
+	}
+	p.paused = true
+	p.since = time.Now()
+	p.resumeCh = make(chan struct{})
+	return true
+}
+
+// resume lets the guest carry on, returning how long it was paused or false
+// if it wasn't
+func (p *pauser) resume() (time.Duration, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.paused {
+		return 0, false
+	}
+	p.paused = false
+	close(p.resumeCh)
+	return time.Since(p.since), true
+}
+
+// isPaused returns whether the guest is paused, and since when
+func (p *pauser) isPaused() (bool, time.Time) {
+	if p == nil {
+		return false, time.Time{}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.paused, p.since
+}
+
+// wait blocks while the guest is paused, or until ctx is done
+func (p *pauser) wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	p.lock.Lock()
+	paused, ch := p.paused, p.resumeCh
+	p.lock.Unlock()
+	if !paused {
+		return nil
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isPauseSignal returns whether signal pauses or resumes a task, and which
+func isPauseSignal(signal string) (pause, ok bool) {
+	switch signal {
+	case signalStop, signalTstp:
+		return true, true
+	case signalCont:
+		return false, true
+	}
+	return false, false
+}
+
+// pauseTask pauses or resumes h and emits an event saying so. Signals
+// matching h's state are ignored.
+func (d *Driver) pauseTask(h *TaskHandle, pause bool) error {
+	var message string
+	if pause {
+		if !h.pauser.pause() {
+			return nil
+		}
+		message = "Task paused"
+	} else {
+		paused, ok := h.pauser.resume()
+		if !ok {
+			return nil
+		}
+		message = fmt.Sprintf("Task resumed after %s", paused.Round(time.Millisecond))
+	}
+
+	if h.exec != nil {
+		name := signalCont
+		if pause {
+			name = signalStop
+		}
+		sig, ok := signals.SignalLookup[name]
+		if !ok {
+			return fmt.Errorf("%s is not supported on this platform", name)
+		}
+		if err := h.exec.Signal(sig); err != nil {
+			return fmt.Errorf("failed to signal task: %v", err)
+		}
+	}
+
+	err := d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:      h.taskConfig.ID,
+		AllocID:     h.taskConfig.AllocID,
+		TaskName:    h.taskConfig.Name,
+		Timestamp:   time.Now(),
+		Message:     message,
+		Annotations: map[string]string{"paused": fmt.Sprint(pause)},
+	})
+	if err != nil {
+		d.logger.Warn("failed to emit pause event", "task_id", h.taskConfig.ID, "error", err)
+	}
+	return nil
+}
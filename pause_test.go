@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPauser(t *testing.T) {
+	p := newPauser()
+	require.NoError(t, p.wait(context.Background()))
+
+	require.True(t, p.pause())
+	require.False(t, p.pause())
+	paused, since := p.isPaused()
+	require.True(t, paused)
+	require.False(t, since.IsZero())
+
+	// waiters are held until the guest resumes
+	done := make(chan error, 1)
+	go func() { done <- p.wait(context.Background()) }()
+	select {
+	case <-done:
+		t.Fatal("wait returned while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, ok := p.resume()
+	require.True(t, ok)
+	require.NoError(t, <-done)
+
+	_, ok = p.resume()
+	require.False(t, ok)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.pause()
+	require.Error(t, p.wait(ctx))
+
+	// tasks without a pauser never pause
+	require.NoError(t, (*pauser)(nil).wait(ctx))
+}
+
+func TestDriver_PauseTask(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := &drivers.TaskConfig{ID: "id", AllocID: "alloc", Name: "task"}
+	h := &TaskHandle{taskConfig: cfg, pauser: newPauser()}
+	d.tasks.Set(cfg.ID, h)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := d.TaskEvents(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, d.SignalTask(cfg.ID, signalStop))
+	require.Contains(t, h.TaskStatus().DriverAttributes, "paused_at")
+	select {
+	case e := <-events:
+		require.Equal(t, "Task paused", e.Message)
+		require.Equal(t, "true", e.Annotations["paused"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event emitted")
+	}
+
+	// pausing a paused task is a no-op
+	require.NoError(t, d.SignalTask(cfg.ID, signalTstp))
+
+	require.NoError(t, d.SignalTask(cfg.ID, signalCont))
+	require.NotContains(t, h.TaskStatus().DriverAttributes, "paused_at")
+	select {
+	case e := <-events:
+		require.Contains(t, e.Message, "Task resumed after")
+		require.Equal(t, "false", e.Annotations["paused"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event emitted")
+	}
+}
+
+// tickWat writes a byte to stdout every millisecond
+const tickWat = `
+(module
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "poll_oneoff" (func $poll_oneoff (param i32 i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  ;; a relative clock subscription: tag 0, clock 1, timeout 1ms
+  (data (i32.const 24) "\40\42\0f\00\00\00\00\00")
+  (data (i32.const 200) "x")
+  (func (export "_start")
+    (i32.store (i32.const 16) (i32.const 1))
+    (i32.store (i32.const 192) (i32.const 200))
+    (i32.store (i32.const 196) (i32.const 1))
+    (loop $tick
+      (drop (call $poll_oneoff (i32.const 0) (i32.const 64) (i32.const 1) (i32.const 128)))
+      (drop (call $fd_write (i32.const 1) (i32.const 192) (i32.const 1) (i32.const 184)))
+      (br $tick)))
+)`
+
+func TestPauseTask_HoldsRunningGuest(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := startTestTask(t, d, tickWat, &TaskConfig{})
+	stdout := filepath.Join(cfg.TaskDir().LogDir, "task.stdout")
+	written := func() int64 {
+		fi, err := os.Stat(stdout)
+		require.NoError(t, err)
+		return fi.Size()
+	}
+	require.Eventually(t, func() bool { return written() > 0 }, 5*time.Second, time.Millisecond)
+
+	require.NoError(t, d.SignalTask(cfg.ID, signalStop))
+	// the call in progress completes
+	time.Sleep(50 * time.Millisecond)
+	paused := written()
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, paused, written(), "paused guest made progress")
+
+	require.NoError(t, d.SignalTask(cfg.ID, signalCont))
+	require.Eventually(t, func() bool { return written() > paused }, 5*time.Second, time.Millisecond)
+
+	// stopping a paused guest doesn't wait for it to be resumed
+	require.NoError(t, d.SignalTask(cfg.ID, signalStop))
+	require.NoError(t, d.StopTask(cfg.ID, time.Second, "SIGTERM"))
+	res := waitTestTask(t, d, cfg.ID)
+	require.NotZero(t, res.Signal)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
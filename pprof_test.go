@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPProf(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir()}))
+	require.Nil(t, d.pprofServer)
+
+	require.NoError(t, setConfig(t, d, &Config{
+		DataDir: d.artifacts.dir,
+		PProf:   PProfConfig{Address: "127.0.0.1:0"},
+	}))
+	defer d.pprofServer.Close()
+
+	resp, err := http.Get("http://" + d.pprofServer.Addr().String() + "/debug/pprof/goroutine?debug=1")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "goroutine profile")
+
+	// the status listener doesn't serve profiles
+	require.NoError(t, setConfig(t, d, &Config{
+		DataDir: d.artifacts.dir,
+		PProf:   PProfConfig{Address: "127.0.0.1:0"},
+		Status:  StatusConfig{Address: "127.0.0.1:0"},
+	}))
+	defer d.statusServer.Close()
+	resp, err = http.Get("http://" + d.statusServer.Addr().String() + "/debug/pprof/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
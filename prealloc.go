@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+// preallocateMemory grows the exported memory of instance to its maximum,
+// the smaller of the memory's declared maximum and limit, and touches every
+// page so the host commits them up front instead of faulting them in under
+// load. It returns the size of the memory in bytes.
+func preallocateMemory(store wasmtime.Storelike, instance *wasmtime.Instance, limit uint64) (uint64, error) {
+	ext := instance.GetExport(store, "memory")
+	if ext == nil || ext.Memory() == nil {
+		return 0, errNoMemory
+	}
+	mem := ext.Memory()
+
+	pages := limit / wasmPageSize
+	if ok, max := mem.Type(store).Maximum(); ok && (pages == 0 || max < pages) {
+		pages = max
+	}
+	if pages == 0 {
+		return 0, fmt.Errorf("preallocate_memory requires a memory limit or a module declaring its maximum memory")
+	}
+
+	if size := mem.Size(store); size < pages {
+		if _, err := mem.Grow(store, pages-size); err != nil {
+			return 0, fmt.Errorf("failed to preallocate %d pages: %v", pages, err)
+		}
+	}
+
+	// a plain read and write back of the same byte is optimised away, while
+	// an atomic add of zero always writes the page
+	data := mem.UnsafeData(store)
+	for i := 0; i+4 <= len(data); i += os.Getpagesize() {
+		atomic.AddUint32((*uint32)(unsafe.Pointer(&data[i])), 0)
+	}
+	return uint64(len(data)), nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreallocateMemory(t *testing.T) {
+	// grown to the declared maximum, keeping the data
+	store, instance := instantiate(t, `(module
+	  (memory (export "memory") 1 4)
+	  (data (i32.const 0) "hello"))`)
+	size, err := preallocateMemory(store, instance, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4*wasmPageSize), size)
+	require.Equal(t, "hello", string(memory(store, instance)[:5]))
+
+	// the limit caps the maximum
+	store, instance = instantiate(t, `(module (memory (export "memory") 1 4))`)
+	size, err = preallocateMemory(store, instance, 2*wasmPageSize)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2*wasmPageSize), size)
+
+	store, instance = instantiate(t, `(module (memory (export "memory") 1))`)
+	size, err = preallocateMemory(store, instance, 3*wasmPageSize)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3*wasmPageSize), size)
+
+	// unbounded memories can't be preallocated
+	_, err = preallocateMemory(store, instance, 0)
+	require.Error(t, err)
+
+	store, instance = instantiate(t, `(module)`)
+	_, err = preallocateMemory(store, instance, wasmPageSize)
+	require.Equal(t, errNoMemory, err)
+}
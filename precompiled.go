@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/dustin/go-humanize"
+)
+
+// cwasmMagic starts the precompiled modules wasmtime serializes, which are
+// ELF objects whatever the target
+var cwasmMagic = []byte("\x7fELF")
+
+// isPrecompiledModule returns whether b is code precompiled by wasmtime, as
+// built by `wasmtime compile`, rather than a module
+func isPrecompiledModule(b []byte) bool {
+	return bytes.HasPrefix(b, cwasmMagic)
+}
+
+// loadPrecompiledModule deserializes the precompiled module cwasm with an
+// engine with config, which must be the one it was built with. Unlike the
+// precompiled code of a bundle, there's no module to compile instead, so
+// code built for another target, wasmtime version or set of features is an
+// error telling how to build it.
+func loadPrecompiledModule(config *wasmtime.Config, cwasm []byte) (*wasmtime.Engine, *wasmtime.Module, error) {
+	engine := wasmtime.NewEngineWithConfig(config)
+	module, err := deserializePrecompiled(engine, cwasm)
+	if err != nil {
+		return nil, nil, err
+	}
+	return engine, module, nil
+}
+
+// deserializePrecompiled is like loadPrecompiledModule, with an existing
+// engine
+func deserializePrecompiled(engine *wasmtime.Engine, cwasm []byte) (*wasmtime.Module, error) {
+	module, err := wasmtime.NewModuleDeserialize(engine, cwasm)
+	if err != nil {
+		return nil, fmt.Errorf("precompiled module can't run on this client: %v; it must be built by the plugin's version of wasmtime for %s, with fuel, epoch interruption and the proposals of the plugin's compiler.features enabled", err, hostTriple())
+	}
+	return module, nil
+}
+
+// precompiledImports returns the imports of the precompiled module
+func precompiledImports(module *wasmtime.Module) []moduleImport {
+	var imports []moduleImport
+	for _, i := range module.Imports() {
+		name := ""
+		if i.Name() != nil {
+			name = *i.Name()
+		}
+		imports = append(imports, moduleImport{Module: i.Module(), Name: name, Type: externKind(i.Type())})
+	}
+	return imports
+}
+
+// externKind returns the kind of an import or export, as wasmImports names
+// them
+func externKind(t *wasmtime.ExternType) string {
+	switch {
+	case t.FuncType() != nil:
+		return "func"
+	case t.TableType() != nil:
+		return "table"
+	case t.MemoryType() != nil:
+		return "memory"
+	case t.GlobalType() != nil:
+		return "global"
+	}
+	return "unknown"
+}
+
+// checkPrecompiledLimits fails if the exported memories and tables of the
+// precompiled module may grow past the task's limits, or it exports more
+// tables than max_tables. Its declarations can't be rewritten like a
+// module's, so a limit it doesn't declare itself can't be applied. The
+// memories and tables it doesn't export can't be seen.
+func checkPrecompiledLimits(module *wasmtime.Module, limits *taskLimits) error {
+	tables := 0
+	for _, e := range module.Exports() {
+		if mt := e.Type().MemoryType(); mt != nil && limits.memory != 0 {
+			if ok, max := mt.Maximum(); !ok || max*wasmPageSize > limits.memory {
+				return fmt.Errorf("the precompiled module's memory %q may grow past the memory limit of %s, it must declare a maximum within it", e.Name(), humanize.IBytes(limits.memory))
+			}
+		}
+		if tt := e.Type().TableType(); tt != nil {
+			tables++
+			if ok, max := tt.Maximum(); limits.tableElements != 0 && (!ok || uint64(max) > limits.tableElements) {
+				return fmt.Errorf("the precompiled module's table %q may grow past the max_table_elements of %d, it must declare a maximum within it", e.Name(), limits.tableElements)
+			}
+		}
+	}
+	if limits.tables != 0 && tables > limits.tables {
+		return fmt.Errorf("precompiled module exports %d tables, above the max_tables of %d", tables, limits.tables)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+// testPrecompiledConfig returns the engine config of a precompiled task of
+// a plugin with the default features
+func testPrecompiledConfig(t *testing.T) *wasmtime.Config {
+	t.Helper()
+	features, err := taskFeatures(PluginCompilerConfig{}, cwasmMagic)
+	require.NoError(t, err)
+	config, _, err := engineConfig(WasmTimeCompiler{}, features)
+	require.NoError(t, err)
+	return config
+}
+
+// testPrecompiled returns wat precompiled for a task of a plugin with the
+// default features
+func testPrecompiled(t *testing.T, wat string) []byte {
+	t.Helper()
+	wasm, err := wasmtime.Wat2Wasm(wat)
+	require.NoError(t, err)
+	module, err := wasmtime.NewModule(wasmtime.NewEngineWithConfig(testPrecompiledConfig(t)), wasm)
+	require.NoError(t, err)
+	cwasm, err := module.Serialize()
+	require.NoError(t, err)
+	require.True(t, isPrecompiledModule(cwasm))
+	return cwasm
+}
+
+func TestStartTask_Precompiled(t *testing.T) {
+	cwasm := testPrecompiled(t, helloWat)
+	start := func(t *testing.T, d *Driver, cwasm []byte) error {
+		cfg := newTestTask(t, cwasm)
+		require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{File: "main.wasm"}))
+		_, _, err := d.StartTask(cfg)
+		return err
+	}
+
+	t.Run("not allowed", func(t *testing.T) {
+		d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+		require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir(), Logging: LoggingConfig{DisableCollection: true}}))
+		err := start(t, d, cwasm)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "allow_precompiled")
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+		require.NoError(t, setConfig(t, d, &Config{
+			DataDir:  t.TempDir(),
+			Logging:  LoggingConfig{DisableCollection: true},
+			Compiler: PluginCompilerConfig{AllowPrecompiled: true},
+		}))
+		require.NoError(t, start(t, d, cwasm))
+		res := waitTestTask(t, d, "id")
+		require.Equal(t, 3, res.ExitCode)
+
+		h, ok := d.tasks.Get("id")
+		require.True(t, ok)
+		require.True(t, h.compile.Precompiled)
+		require.Equal(t, h.moduleDigest, h.precompiledDigest)
+		require.NoError(t, d.DestroyTask("id", false))
+	})
+
+	t.Run("built for another engine", func(t *testing.T) {
+		d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+		require.NoError(t, setConfig(t, d, &Config{
+			DataDir:  t.TempDir(),
+			Logging:  LoggingConfig{DisableCollection: true},
+			Compiler: PluginCompilerConfig{AllowPrecompiled: true},
+		}))
+
+		// without fuel and epoch interruption
+		wasm, err := wasmtime.Wat2Wasm(helloWat)
+		require.NoError(t, err)
+		module, err := wasmtime.NewModule(wasmtime.NewEngine(), wasm)
+		require.NoError(t, err)
+		other, err := module.Serialize()
+		require.NoError(t, err)
+
+		err = start(t, d, other)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "precompiled module can't run on this client")
+		require.Contains(t, err.Error(), hostTriple())
+	})
+
+	t.Run("memory without a maximum", func(t *testing.T) {
+		d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+		require.NoError(t, setConfig(t, d, &Config{
+			DataDir:  t.TempDir(),
+			Logging:  LoggingConfig{DisableCollection: true},
+			Compiler: PluginCompilerConfig{AllowPrecompiled: true},
+		}))
+
+		// the guest could grow past the task's memory
+		cfg := newTestTask(t, cwasm)
+		cfg.Resources = &drivers.Resources{NomadResources: &structs.AllocatedTaskResources{
+			Memory: structs.AllocatedMemoryResources{MemoryMB: 1},
+		}}
+		require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{File: "main.wasm"}))
+		_, _, err := d.StartTask(cfg)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "may grow past the memory limit of 1.0 MiB")
+		require.Empty(t, d.modules.tasks)
+	})
+
+	t.Run("table over max_table_elements", func(t *testing.T) {
+		d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+		require.NoError(t, setConfig(t, d, &Config{
+			DataDir:  t.TempDir(),
+			Logging:  LoggingConfig{DisableCollection: true},
+			Compiler: PluginCompilerConfig{AllowPrecompiled: true},
+			Limits:   TaskLimitsConfig{MaxTableElements: 10},
+		}))
+		err := start(t, d, testPrecompiled(t, `(module (table (export "table") 1 funcref) (func (export "_start")))`))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "may grow past the max_table_elements of 10")
+	})
+}
+
+func TestCheckAllowedImports_Precompiled(t *testing.T) {
+	_, module, err := loadPrecompiledModule(testPrecompiledConfig(t), testPrecompiled(t, `(module (import "env" "f" (func)) (import "env" "m" (memory 1)))`))
+	require.NoError(t, err)
+
+	imports := precompiledImports(module)
+	require.Equal(t, []moduleImport{{Module: "env", Name: "f", Type: "func"}, {Module: "env", Name: "m", Type: "memory"}}, imports)
+	require.NoError(t, checkAllowedImports(imports, []string{"env.*"}))
+	require.Error(t, checkAllowedImports(imports, []string{"env.f"}))
+}
+
+func TestCheckPrecompiledLimits(t *testing.T) {
+	_, module, err := loadPrecompiledModule(testPrecompiledConfig(t), testPrecompiled(t, `(module (memory (export "memory") 1) (table (export "table") 1 funcref))`))
+	require.NoError(t, err)
+
+	require.NoError(t, checkPrecompiledLimits(module, &taskLimits{}))
+	err = checkPrecompiledLimits(module, &taskLimits{memory: 4 * wasmPageSize})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `memory "memory"`)
+	err = checkPrecompiledLimits(module, &taskLimits{tableElements: 10})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `table "table"`)
+
+	_, module, err = loadPrecompiledModule(testPrecompiledConfig(t), testPrecompiled(t, `(module (memory (export "memory") 1 8) (table (export "a") 1 5 funcref) (table (export "b") 1 5 funcref))`))
+	require.NoError(t, err)
+	require.NoError(t, checkPrecompiledLimits(module, &taskLimits{memory: 8 * wasmPageSize, tableElements: 10, tables: 2}))
+	require.Error(t, checkPrecompiledLimits(module, &taskLimits{memory: 4 * wasmPageSize}))
+	require.EqualError(t, checkPrecompiledLimits(module, &taskLimits{tables: 1}), "precompiled module exports 2 tables, above the max_tables of 1")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/opencontainers/go-digest"
+)
+
+// Defaults of the quarantine block
+const (
+	defaultQuarantineWindow   = 10 * time.Minute
+	defaultQuarantineCooldown = 30 * time.Minute
+)
+
+// quarantinePolicy is when a module is quarantined: after failures
+// failures within window, for cooldown. Zero failures disables it.
+type quarantinePolicy struct {
+	failures int
+	window   time.Duration
+	cooldown time.Duration
+}
+
+// parseQuarantine parses the quarantine block of the plugin config
+func parseQuarantine(config QuarantineConfig) (quarantinePolicy, error) {
+	p := quarantinePolicy{
+		failures: config.Failures,
+		window:   defaultQuarantineWindow,
+		cooldown: defaultQuarantineCooldown,
+	}
+	if config.Failures < 0 {
+		return p, fmt.Errorf("invalid failures %d: must not be negative", config.Failures)
+	}
+	if config.Window != "" {
+		window, err := time.ParseDuration(config.Window)
+		if err != nil || window <= 0 {
+			return p, fmt.Errorf("invalid window %q", config.Window)
+		}
+		p.window = window
+	}
+	if config.Cooldown != "" {
+		cooldown, err := time.ParseDuration(config.Cooldown)
+		if err != nil || cooldown <= 0 {
+			return p, fmt.Errorf("invalid cooldown %q", config.Cooldown)
+		}
+		p.cooldown = cooldown
+	}
+	return p, nil
+}
+
+// quarantineError is returned when starting a task with a quarantined
+// module, so the allocation is rescheduled rather than restarted here
+type quarantineError struct {
+	digest digest.Digest
+	until  time.Time
+}
+
+func (e *quarantineError) Error() string {
+	return fmt.Sprintf("module %s is quarantined on this node until %s after repeated failures", e.digest, e.until.Format(time.RFC3339))
+}
+
+// moduleQuarantine tracks the recent failures of the tasks of each module
+// digest, and the digests refused until their cooldown ends. It's kept in
+// memory, so a plugin restart lifts every quarantine.
+type moduleQuarantine struct {
+	lock     sync.Mutex
+	policy   quarantinePolicy
+	failures map[digest.Digest][]time.Time
+	until    map[digest.Digest]time.Time
+
+	// now is overridden in tests
+	now func() time.Time
+}
+
+func newModuleQuarantine() *moduleQuarantine {
+	return &moduleQuarantine{
+		failures: map[digest.Digest][]time.Time{},
+		until:    map[digest.Digest]time.Time{},
+		now:      time.Now,
+	}
+}
+
+// SetPolicy sets the policy applied to failures from now on
+func (q *moduleQuarantine) SetPolicy(p quarantinePolicy) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.policy = p
+}
+
+// check returns an error if d is quarantined
+func (q *moduleQuarantine) check(d digest.Digest) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	until, ok := q.until[d]
+	if !ok {
+		return nil
+	}
+	if !q.now().Before(until) {
+		delete(q.until, d)
+		return nil
+	}
+	return &quarantineError{digest: d, until: until}
+}
+
+// failed records a failure of a task of d, returning until when d is
+// quarantined if that failure crossed the threshold
+func (q *moduleQuarantine) failed(d digest.Digest) (time.Time, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.policy.failures == 0 || d == "" {
+		return time.Time{}, false
+	}
+
+	now := q.now()
+	recent := []time.Time{now}
+	for _, t := range q.failures[d] {
+		if now.Sub(t) < q.policy.window {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) < q.policy.failures {
+		q.failures[d] = recent
+		return time.Time{}, false
+	}
+
+	delete(q.failures, d)
+	until := now.Add(q.policy.cooldown)
+	q.until[d] = until
+	return until, true
+}
+
+// failedExit returns whether an exit counts as a failure of the module:
+// an error, an OOM kill or a non-zero exit code. Exits on a signal are
+// left out, as they're mostly the task being stopped.
+func failedExit(res *drivers.ExitResult) bool {
+	return res.Err != nil || res.OOMKilled || (res.ExitCode != 0 && res.Signal == 0)
+}
+
+// recordFailure counts the exit of h against its module, emitting an event
+// if the module is quarantined for it
+func (d *Driver) recordFailure(h *TaskHandle) {
+	res, ok := h.exited()
+	if !ok || !failedExit(res) {
+		return
+	}
+	until, quarantined := d.quarantine.failed(h.moduleDigest)
+	if !quarantined {
+		return
+	}
+
+	cfg := h.taskConfig
+	d.logger.Warn("quarantined module after repeated failures", "task_id", cfg.ID, "digest", h.moduleDigest, "until", until)
+	err := d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:    cfg.ID,
+		AllocID:   cfg.AllocID,
+		TaskName:  cfg.Name,
+		Timestamp: time.Now(),
+		Message:   fmt.Sprintf("Module quarantined on this node until %s after repeated failures", until.Format(time.RFC3339)),
+		Annotations: map[string]string{
+			"digest":           h.moduleDigest.String(),
+			"quarantine_until": until.Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		d.logger.Warn("failed to emit quarantine event", "task_id", cfg.ID, "error", err)
+	}
+}
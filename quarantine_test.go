@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQuarantine(t *testing.T) {
+	p, err := parseQuarantine(QuarantineConfig{})
+	require.NoError(t, err)
+	require.Equal(t, quarantinePolicy{window: defaultQuarantineWindow, cooldown: defaultQuarantineCooldown}, p)
+
+	p, err = parseQuarantine(QuarantineConfig{Failures: 3, Window: "1m", Cooldown: "1h"})
+	require.NoError(t, err)
+	require.Equal(t, quarantinePolicy{failures: 3, window: time.Minute, cooldown: time.Hour}, p)
+
+	for _, config := range []QuarantineConfig{
+		{Failures: -1},
+		{Window: "0"},
+		{Cooldown: "soon"},
+	} {
+		_, err := parseQuarantine(config)
+		require.Error(t, err, "%+v", config)
+	}
+}
+
+func TestModuleQuarantine(t *testing.T) {
+	now := time.Now()
+	q := newModuleQuarantine()
+	q.now = func() time.Time { return now }
+	d := digest.FromString("module")
+
+	// disabled by default
+	_, quarantined := q.failed(d)
+	require.False(t, quarantined)
+
+	q.SetPolicy(quarantinePolicy{failures: 3, window: time.Minute, cooldown: time.Hour})
+	_, quarantined = q.failed(d)
+	require.False(t, quarantined)
+
+	// failures out of the window don't count
+	now = now.Add(2 * time.Minute)
+	_, quarantined = q.failed(d)
+	require.False(t, quarantined)
+	_, quarantined = q.failed(d)
+	require.False(t, quarantined)
+	require.NoError(t, q.check(d))
+
+	until, quarantined := q.failed(d)
+	require.True(t, quarantined)
+	require.Equal(t, now.Add(time.Hour), until)
+	var qerr *quarantineError
+	require.True(t, errors.As(q.check(d), &qerr))
+	require.NoError(t, q.check(digest.FromString("other")))
+
+	now = until
+	require.NoError(t, q.check(d))
+}
+
+func TestFailedExit(t *testing.T) {
+	require.False(t, failedExit(&drivers.ExitResult{}))
+	require.False(t, failedExit(&drivers.ExitResult{ExitCode: 130, Signal: 2}))
+	require.True(t, failedExit(&drivers.ExitResult{ExitCode: 1}))
+	require.True(t, failedExit(&drivers.ExitResult{OOMKilled: true}))
+	require.True(t, failedExit(&drivers.ExitResult{Err: errors.New("lost")}))
+}
+
+func TestStartTask_Quarantined(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := startTestTask(t, d, helloWat, &TaskConfig{})
+	require.Equal(t, 3, waitTestTask(t, d, cfg.ID).ExitCode)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+
+	// the next failure quarantines the module
+	d.quarantine.SetPolicy(quarantinePolicy{failures: 1, window: time.Minute, cooldown: time.Hour})
+	_, _, err := d.StartTask(cfg)
+	require.NoError(t, err)
+	require.Equal(t, 3, waitTestTask(t, d, cfg.ID).ExitCode)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+
+	_, _, err = d.StartTask(cfg)
+	var qerr *quarantineError
+	require.True(t, errors.As(err, &qerr), "%v", err)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dustin/go-humanize"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/time/rate"
+)
+
+// defaultNamespaceQuota is the label of the namespace_quota block applying
+// to the namespaces without one of their own
+const defaultNamespaceQuota = "*"
+
+// namespaceQuota is the parsed quota of a namespace. Zero values are
+// unlimited.
+type namespaceQuota struct {
+	instances int
+	code      int64
+	cache     int64
+	bandwidth uint64
+}
+
+// parseNamespaceQuotas checks the namespace_quota blocks of the plugin
+// config
+func parseNamespaceQuotas(config map[string]NamespaceQuotaConfig) (map[string]namespaceQuota, error) {
+	quotas := map[string]namespaceQuota{}
+	for namespace, c := range config {
+		if c.MaxInstances < 0 {
+			return nil, fmt.Errorf("invalid namespace_quota %q max_instances %d: must not be negative", namespace, c.MaxInstances)
+		}
+		var code, cache uint64
+		q := namespaceQuota{instances: c.MaxInstances}
+		for _, size := range []struct {
+			name  string
+			value string
+			dst   *uint64
+		}{
+			{"compiled_code", c.CompiledCode, &code},
+			{"cache", c.Cache, &cache},
+			{"bandwidth", c.Bandwidth, &q.bandwidth},
+		} {
+			if size.value == "" {
+				continue
+			}
+			b, err := humanize.ParseBytes(size.value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid namespace_quota %q %s %q: %v", namespace, size.name, size.value, err)
+			}
+			*size.dst = b
+		}
+		q.code, q.cache = int64(code), int64(cache)
+		quotas[namespace] = q
+	}
+	return quotas, nil
+}
+
+// quotaError is returned by StartTask when the task's namespace is out of
+// its share of the node. It's wrapped as recoverable like a capacityError,
+// as the namespace's other tasks stopping frees its quota.
+type quotaError struct {
+	namespace string
+	resource  string
+	requested int64
+	used      int64
+	limit     int64
+}
+
+func (e *quotaError) Error() string {
+	format := func(v int64) string { return humanize.IBytes(uint64(v)) }
+	if e.resource == "instances" {
+		format = func(v int64) string { return strconv.FormatInt(v, 10) }
+	}
+	return fmt.Sprintf("namespace %q is out of its %s quota: the task needs %s, %s of %s are in use",
+		e.namespace, e.resource, format(e.requested), format(e.used), format(e.limit))
+}
+
+// taskUsage is what a task counts against its namespace's quota: an
+// instance, its compiled code and the artifacts it keeps in the cache
+type taskUsage struct {
+	namespace string
+	code      int64
+	artifacts map[digest.Digest]int64
+}
+
+// recoveredUsage returns the usage of a recovered task, sizing its
+// artifacts from the store
+func (d *Driver) recoveredUsage(h *TaskHandle) *taskUsage {
+	u := &taskUsage{namespace: h.taskConfig.Namespace, artifacts: map[digest.Digest]int64{}}
+	if h.compile != nil {
+		u.code = h.compile.CodeSize
+	}
+	for _, dgst := range []digest.Digest{h.moduleDigest, h.precompiledDigest} {
+		if dgst == "" {
+			continue
+		}
+		if fi, err := os.Stat(d.artifacts.Path(dgst)); err == nil {
+			u.artifacts[dgst] = fi.Size()
+		}
+	}
+	return u
+}
+
+// namespaceUsage is what the tasks of a namespace use on the node
+type namespaceUsage struct {
+	Instances     int    `json:"instances"`
+	CompiledCode  int64  `json:"compiled_code"`
+	Cache         int64  `json:"cache"`
+	OutboundBytes uint64 `json:"outbound_bytes"`
+}
+
+// quotaTracker totals what the tasks of each namespace use and holds them to
+// the quotas of the plugin config
+type quotaTracker struct {
+	lock     sync.Mutex
+	quotas   map[string]namespaceQuota
+	tasks    map[string]*taskUsage
+	outbound map[string]*uint64
+	limiters map[string]*rate.Limiter
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{
+		quotas:   map[string]namespaceQuota{},
+		tasks:    map[string]*taskUsage{},
+		outbound: map[string]*uint64{},
+		limiters: map[string]*rate.Limiter{},
+	}
+}
+
+// SetQuotas sets the quotas of the namespaces. Running tasks are kept even
+// if their namespace is over a lowered quota.
+func (q *quotaTracker) SetQuotas(quotas map[string]namespaceQuota) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.quotas = quotas
+	for namespace, limiter := range q.limiters {
+		bandwidth := q.quotaLocked(namespace).bandwidth
+		if bandwidth == 0 {
+			limiter.SetLimit(rate.Inf)
+			continue
+		}
+		limiter.SetLimit(rate.Limit(bandwidth))
+		limiter.SetBurst(bandwidthBurst(bandwidth))
+	}
+}
+
+// quotaLocked returns the quota of namespace, the default one if it has
+// none
+func (q *quotaTracker) quotaLocked(namespace string) namespaceQuota {
+	if quota, ok := q.quotas[namespace]; ok {
+		return quota
+	}
+	return q.quotas[defaultNamespaceQuota]
+}
+
+// usageLocked totals the usage of the tasks of namespace, counting the
+// artifacts shared by several tasks once
+func (q *quotaTracker) usageLocked(namespace string) namespaceUsage {
+	var usage namespaceUsage
+	artifacts := map[digest.Digest]bool{}
+	for _, u := range q.tasks {
+		if u.namespace != namespace {
+			continue
+		}
+		usage.Instances++
+		usage.CompiledCode += u.code
+		for d, size := range u.artifacts {
+			if !artifacts[d] {
+				artifacts[d] = true
+				usage.Cache += size
+			}
+		}
+	}
+	if n, ok := q.outbound[namespace]; ok {
+		usage.OutboundBytes = atomic.LoadUint64(n)
+	}
+	return usage
+}
+
+// reserve accounts for the usage of the task, or returns a quotaError if
+// its namespace doesn't have enough of its quota left
+func (q *quotaTracker) reserve(taskID string, u *taskUsage) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	quota := q.quotaLocked(u.namespace)
+	used := q.usageLocked(u.namespace)
+	if quota.instances != 0 && used.Instances+1 > quota.instances {
+		return &quotaError{namespace: u.namespace, resource: "instances", requested: 1, used: int64(used.Instances), limit: int64(quota.instances)}
+	}
+	if quota.code != 0 && used.CompiledCode+u.code > quota.code {
+		return &quotaError{namespace: u.namespace, resource: "compiled code", requested: u.code, used: used.CompiledCode, limit: quota.code}
+	}
+	if quota.cache != 0 {
+		var cache int64
+		for d, size := range u.artifacts {
+			if !q.cachedLocked(u.namespace, d) {
+				cache += size
+			}
+		}
+		if used.Cache+cache > quota.cache {
+			return &quotaError{namespace: u.namespace, resource: "cache", requested: cache, used: used.Cache, limit: quota.cache}
+		}
+	}
+	q.tasks[taskID] = u
+	return nil
+}
+
+// cachedLocked returns whether a task of namespace already keeps the
+// artifact d
+func (q *quotaTracker) cachedLocked(namespace string, d digest.Digest) bool {
+	for _, u := range q.tasks {
+		if _, ok := u.artifacts[d]; ok && u.namespace == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// restore accounts for the usage of a recovered task, regardless of the
+// quota as the task already runs
+func (q *quotaTracker) restore(taskID string, u *taskUsage) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.tasks[taskID] = u
+}
+
+// release frees the usage of the task
+func (q *quotaTracker) release(taskID string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.tasks, taskID)
+}
+
+// usage returns the usage of every namespace with a task running or having
+// sent traffic
+func (q *quotaTracker) usage() map[string]namespaceUsage {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	namespaces := map[string]bool{}
+	for _, u := range q.tasks {
+		namespaces[u.namespace] = true
+	}
+	for namespace := range q.outbound {
+		namespaces[namespace] = true
+	}
+	usage := map[string]namespaceUsage{}
+	for namespace := range namespaces {
+		usage[namespace] = q.usageLocked(namespace)
+	}
+	return usage
+}
+
+// bandwidthBurst is the burst of a limiter of bandwidth bytes per second
+func bandwidthBurst(bandwidth uint64) int {
+	if bandwidth < maxThrottledRead {
+		return int(bandwidth)
+	}
+	return maxThrottledRead
+}
+
+// meter returns the counter of the outbound bytes of namespace and the
+// limiter its traffic shares
+func (q *quotaTracker) meter(namespace string) (*uint64, *rate.Limiter) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	n, ok := q.outbound[namespace]
+	if !ok {
+		n = new(uint64)
+		q.outbound[namespace] = n
+	}
+	limiter, ok := q.limiters[namespace]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Inf, maxThrottledRead)
+		if bandwidth := q.quotaLocked(namespace).bandwidth; bandwidth != 0 {
+			limiter = rate.NewLimiter(rate.Limit(bandwidth), bandwidthBurst(bandwidth))
+		}
+		q.limiters[namespace] = limiter
+	}
+	return n, limiter
+}
+
+// transport returns next counting the bytes of the requests and responses
+// of namespace's guests, throttled to its bandwidth quota
+func (q *quotaTracker) transport(namespace string, next roundTripCloser) *meteredTransport {
+	n, limiter := q.meter(namespace)
+	return &meteredTransport{next: next, bytes: n, limiter: limiter}
+}
+
+// meteredTransport counts the bytes sent and received through it, sharing
+// limiter with the other transports of the namespace
+type meteredTransport struct {
+	next    roundTripCloser
+	bytes   *uint64
+	limiter *rate.Limiter
+}
+
+func (t *meteredTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if req.Body != nil {
+		req.Body = &meteredBody{ReadCloser: req.Body, r: &throttledReader{ctx: ctx, r: req.Body, limiter: t.limiter}, bytes: t.bytes}
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &meteredBody{ReadCloser: resp.Body, r: &throttledReader{ctx: ctx, r: resp.Body, limiter: t.limiter}, bytes: t.bytes}
+	return resp, nil
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach the
+// transport wrapped
+func (t *meteredTransport) CloseIdleConnections() {
+	t.next.CloseIdleConnections()
+}
+
+// meteredBody is a body read through a throttled reader, counting its bytes
+type meteredBody struct {
+	io.ReadCloser
+	r     io.Reader
+	bytes *uint64
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	atomic.AddUint64(b.bytes, uint64(n))
+	return n, err
+}
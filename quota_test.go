@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_ParseNamespaceQuota(t *testing.T) {
+	var config Config
+	hclutils.NewConfigParser(configSpec).ParseHCL(t, `config {
+  namespace_quota "team-a" {
+    max_instances = 4
+    compiled_code = "64MiB"
+  }
+  namespace_quota "*" {
+    bandwidth = "1MB"
+  }
+}`, &config)
+	require.Equal(t, map[string]NamespaceQuotaConfig{
+		"team-a": {MaxInstances: 4, CompiledCode: "64MiB"},
+		"*":      {Bandwidth: "1MB"},
+	}, config.NamespaceQuotas)
+}
+
+func TestParseNamespaceQuotas(t *testing.T) {
+	quotas, err := parseNamespaceQuotas(map[string]NamespaceQuotaConfig{
+		"team-a": {MaxInstances: 4, CompiledCode: "64MiB", Cache: "1GiB", Bandwidth: "10MB"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]namespaceQuota{
+		"team-a": {instances: 4, code: 64 << 20, cache: 1 << 30, bandwidth: 10e6},
+	}, quotas)
+
+	for _, config := range []NamespaceQuotaConfig{
+		{MaxInstances: -1},
+		{CompiledCode: "lots"},
+		{Cache: "-1"},
+		{Bandwidth: "fast"},
+	} {
+		_, err := parseNamespaceQuotas(map[string]NamespaceQuotaConfig{"team-a": config})
+		require.Error(t, err, "%+v", config)
+	}
+}
+
+func TestQuotaTracker(t *testing.T) {
+	q := newQuotaTracker()
+	q.SetQuotas(map[string]namespaceQuota{
+		"team-a":              {instances: 2, code: 100, cache: 1000},
+		defaultNamespaceQuota: {instances: 1},
+	})
+	module := digest.FromString("module")
+
+	require.NoError(t, q.reserve("a1", &taskUsage{namespace: "team-a", code: 60, artifacts: map[digest.Digest]int64{module: 800}}))
+	err := q.reserve("a2", &taskUsage{namespace: "team-a", code: 60})
+	require.EqualError(t, err, `namespace "team-a" is out of its compiled code quota: the task needs 60 B, 60 B of 100 B are in use`)
+
+	// the artifacts a namespace already keeps aren't counted twice
+	require.NoError(t, q.reserve("a2", &taskUsage{namespace: "team-a", code: 40, artifacts: map[digest.Digest]int64{module: 800}}))
+	require.Equal(t, namespaceUsage{Instances: 2, CompiledCode: 100, Cache: 800}, q.usage()["team-a"])
+	err = q.reserve("a3", &taskUsage{namespace: "team-a"})
+	require.EqualError(t, err, `namespace "team-a" is out of its instances quota: the task needs 1, 2 of 2 are in use`)
+	q.release("a1")
+	q.release("a2")
+	err = q.reserve("a3", &taskUsage{namespace: "team-a", artifacts: map[digest.Digest]int64{module: 2000}})
+	require.EqualError(t, err, `namespace "team-a" is out of its cache quota: the task needs 2.0 KiB, 0 B of 1000 B are in use`)
+
+	// the default quota applies to the other namespaces, its own to each
+	require.NoError(t, q.reserve("b1", &taskUsage{namespace: "team-b"}))
+	require.Error(t, q.reserve("b2", &taskUsage{namespace: "team-b"}))
+	require.NoError(t, q.reserve("c1", &taskUsage{namespace: "team-c"}))
+
+	// recovered tasks are counted over the quota
+	q.restore("b2", &taskUsage{namespace: "team-b"})
+	require.Equal(t, 2, q.usage()["team-b"].Instances)
+}
+
+func TestQuotaTracker_Transport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(append(body, strings.Repeat("x", 4000)...))
+	}))
+	defer srv.Close()
+
+	q := newQuotaTracker()
+	q.SetQuotas(map[string]namespaceQuota{"team-a": {bandwidth: 8000}})
+	client := &http.Client{Transport: q.transport("team-a", &http.Transport{})}
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		resp, err := client.Post(srv.URL, "text/plain", strings.NewReader(strings.Repeat("y", 1000)))
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Len(t, body, 5000)
+	}
+
+	// 12000 bytes went through at 8000 a second, past the burst of 8000
+	require.Equal(t, uint64(12000), q.usage()["team-a"].OutboundBytes)
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestStartTask_NamespaceQuota(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{
+		DataDir:         t.TempDir(),
+		Logging:         LoggingConfig{DisableCollection: true},
+		NamespaceQuotas: map[string]NamespaceQuotaConfig{"team-a": {MaxInstances: 1}},
+	}))
+	wasm, err := wasmtime.Wat2Wasm(helloWat)
+	require.NoError(t, err)
+
+	cfg := newTestTask(t, wasm)
+	cfg.Namespace = "team-a"
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{File: "main.wasm"}))
+	_, _, err = d.StartTask(cfg)
+	require.NoError(t, err)
+	require.Equal(t, 1, d.status().Namespaces["team-a"].Instances)
+
+	other := newTestTask(t, wasm)
+	other.ID, other.Namespace = "other", "team-a"
+	require.NoError(t, other.EncodeConcreteDriverConfig(&TaskConfig{File: "main.wasm"}))
+	_, _, err = d.StartTask(other)
+	require.Error(t, err)
+	require.True(t, structs.IsRecoverable(err))
+	require.Contains(t, err.Error(), `namespace "team-a" is out of its instances quota`)
+
+	// the quota is freed once the task is destroyed
+	require.Equal(t, 3, waitTestTask(t, d, cfg.ID).ExitCode)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+	_, _, err = d.StartTask(other)
+	require.NoError(t, err)
+	require.Equal(t, 3, waitTestTask(t, d, other.ID).ExitCode)
+	require.NoError(t, d.DestroyTask(other.ID, false))
+}
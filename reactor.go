@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// defaultStatsMinInterval is the default of stats_min_interval, the
+// shortest interval stats are sampled at
+const defaultStatsMinInterval = time.Second
+
+// reactor multiplexes the waits and stats subscriptions of every task on a
+// single goroutine, instead of the driver spawning goroutines per task and
+// per Nomad request. Exit results are delivered when the task's run loop
+// reports the exit.
+//
+// Stats are collected in one pass per tick, the tick being the minimum stats
+// interval: every task with a subscription due is sampled once and the
+// sample is sent to all of its subscriptions. Intervals Nomad requests below
+// the minimum are clamped to it.
+type reactor struct {
+	// reset wakes up the run loop when the minimum interval changes
+	reset chan struct{}
+
+	lock        sync.Mutex
+	minInterval time.Duration
+	waiters     map[*TaskHandle][]*exitWaiter
+	subs        []*statsSubscription
+}
+
+// exitWaiter is a WaitTask call waiting for its task to exit
+type exitWaiter struct {
+	ctx context.Context
+	ch  chan *drivers.ExitResult
+}
+
+// statsSubscription is a TaskStats call receiving samples every interval,
+// as requested by Nomad
+type statsSubscription struct {
+	ctx      context.Context
+	handle   *TaskHandle
+	interval time.Duration
+	next     time.Time
+	ch       chan *drivers.TaskResourceUsage
+}
+
+func newReactor(minInterval time.Duration) *reactor {
+	return &reactor{
+		reset:       make(chan struct{}, 1),
+		minInterval: minInterval,
+		waiters:     map[*TaskHandle][]*exitWaiter{},
+	}
+}
+
+// setMinInterval changes the minimum stats interval, which is also the
+// reactor's tick
+func (r *reactor) setMinInterval(d time.Duration) {
+	r.lock.Lock()
+	changed := r.minInterval != d
+	r.minInterval = d
+	r.lock.Unlock()
+
+	if changed {
+		select {
+		case r.reset <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *reactor) getMinInterval() time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.minInterval
+}
+
+// wait returns a channel receiving h's exit result once it exits. The
+// channel is buffered so delivering never blocks the reactor.
+func (r *reactor) wait(ctx context.Context, h *TaskHandle) <-chan *drivers.ExitResult {
+	ch := make(chan *drivers.ExitResult, 1)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// the task may have exited before the call, in which case exited was
+	// already called or is waiting for the lock
+	if result, ok := h.exited(); ok {
+		ch <- result
+		close(ch)
+		return ch
+	}
+	r.waiters[h] = append(r.waiters[h], &exitWaiter{ctx: ctx, ch: ch})
+	return ch
+}
+
+// exited delivers h's exit result to its waiters. It must be called once h's
+// state is updated with the result.
+func (r *reactor) exited(h *TaskHandle) {
+	result, ok := h.exited()
+	if !ok {
+		return
+	}
+
+	r.lock.Lock()
+	waiters := r.waiters[h]
+	delete(r.waiters, h)
+	r.lock.Unlock()
+
+	for _, w := range waiters {
+		if w.ctx.Err() == nil {
+			w.ch <- result
+		}
+		close(w.ch)
+	}
+}
+
+// stats returns a channel receiving h's resource usage every interval,
+// until ctx is done. Samples the receiver is too slow for are dropped.
+func (r *reactor) stats(ctx context.Context, h *TaskHandle, interval time.Duration) <-chan *drivers.TaskResourceUsage {
+	sub := &statsSubscription{
+		ctx:      ctx,
+		handle:   h,
+		interval: interval,
+		next:     time.Now(),
+		ch:       make(chan *drivers.TaskResourceUsage, 1),
+	}
+
+	r.lock.Lock()
+	r.subs = append(r.subs, sub)
+	r.lock.Unlock()
+	return sub.ch
+}
+
+// run drives the reactor until ctx is done, then closes every channel it
+// handed out
+func (r *reactor) run(ctx context.Context) {
+	ticker := time.NewTicker(r.getMinInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.close()
+			return
+		case <-r.reset:
+			ticker.Reset(r.getMinInterval())
+		case now := <-ticker.C:
+			r.poll(now)
+		}
+	}
+}
+
+// poll prunes the waiters and subscriptions whose context is done and
+// samples the stats of every subscription due at now. Subscriptions are due
+// within half a tick of their next sample, so ticker jitter doesn't make
+// them skip a tick.
+func (r *reactor) poll(now time.Time) {
+	r.lock.Lock()
+	minInterval := r.minInterval
+	for h, waiters := range r.waiters {
+		live := waiters[:0]
+		for _, w := range waiters {
+			if w.ctx.Err() != nil {
+				close(w.ch)
+				continue
+			}
+			live = append(live, w)
+		}
+		if len(live) == 0 {
+			delete(r.waiters, h)
+		} else {
+			r.waiters[h] = live
+		}
+	}
+
+	// the subscriptions due, by task
+	var handles []*TaskHandle
+	due := map[*TaskHandle][]*statsSubscription{}
+	live := r.subs[:0]
+	for _, sub := range r.subs {
+		if sub.ctx.Err() != nil {
+			close(sub.ch)
+			continue
+		}
+		live = append(live, sub)
+		if now.Add(minInterval / 2).Before(sub.next) {
+			continue
+		}
+		interval := sub.interval
+		if interval < minInterval {
+			interval = minInterval
+		}
+		sub.next = now.Add(interval)
+		if _, ok := due[sub.handle]; !ok {
+			handles = append(handles, sub.handle)
+		}
+		due[sub.handle] = append(due[sub.handle], sub)
+	}
+	for i := len(live); i < len(r.subs); i++ {
+		r.subs[i] = nil
+	}
+	r.subs = live
+	r.lock.Unlock()
+
+	// sampling happens outside the lock, as it reads the process table
+	for _, h := range handles {
+		usage, err := h.sample(now)
+		if err != nil {
+			h.logger.Trace("failed to sample task stats", "task_id", h.taskConfig.ID, "error", err)
+			continue
+		}
+
+		for _, sub := range due[h] {
+			// replace the pending sample, if any, with the fresh one
+			select {
+			case <-sub.ch:
+			default:
+			}
+			sub.ch <- usage
+		}
+	}
+}
+
+// close closes the channels of every waiter and subscription
+func (r *reactor) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for h, waiters := range r.waiters {
+		for _, w := range waiters {
+			close(w.ch)
+		}
+		delete(r.waiters, h)
+	}
+	for _, sub := range r.subs {
+		close(sub.ch)
+	}
+	r.subs = nil
+}
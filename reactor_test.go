@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func reactorTask(id string) *TaskHandle {
+	return &TaskHandle{
+		logger:     hclog.NewNullLogger(),
+		taskConfig: &drivers.TaskConfig{ID: id},
+		procState:  drivers.TaskStateRunning,
+		exitResult: &drivers.ExitResult{},
+	}
+}
+
+// exit marks h as exited with code and notifies r
+func exit(r *reactor, h *TaskHandle, code int) {
+	h.stateLock.Lock()
+	h.procState = drivers.TaskStateExited
+	h.exitResult.ExitCode = code
+	h.completedAt = time.Now()
+	h.stateLock.Unlock()
+	r.exited(h)
+}
+
+func TestReactor_Wait(t *testing.T) {
+	r := newReactor(time.Hour)
+	h := reactorTask("a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first := r.wait(ctx, h)
+	second := r.wait(ctx, h)
+
+	exit(r, h, 3)
+	for _, ch := range []<-chan *drivers.ExitResult{first, second} {
+		result, ok := <-ch
+		require.True(t, ok)
+		require.Equal(t, 3, result.ExitCode)
+		_, ok = <-ch
+		require.False(t, ok)
+	}
+
+	// waiting on a task that already exited returns immediately
+	result := <-r.wait(ctx, h)
+	require.Equal(t, 3, result.ExitCode)
+	require.Empty(t, r.waiters)
+}
+
+func TestReactor_WaitCanceled(t *testing.T) {
+	r := newReactor(time.Hour)
+	h := reactorTask("a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := r.wait(ctx, h)
+	cancel()
+
+	r.poll(time.Now())
+	_, ok := <-ch
+	require.False(t, ok)
+	require.Empty(t, r.waiters)
+}
+
+func TestReactor_Stats(t *testing.T) {
+	r := newReactor(10 * time.Millisecond)
+	h := reactorTask("a")
+	h.pid = os.Getpid()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := r.stats(ctx, h, time.Millisecond)
+
+	now := time.Now()
+	r.poll(now)
+	usage := <-ch
+	require.NotZero(t, usage.ResourceUsage.MemoryStats.RSS)
+	require.Equal(t, now.UTC().UnixNano(), usage.Timestamp)
+
+	// not due yet, the interval is clamped to the minimum
+	r.poll(now.Add(time.Millisecond))
+	select {
+	case <-ch:
+		t.Fatal("sampled before the interval elapsed")
+	default:
+	}
+
+	// a slow receiver only gets the latest sample
+	r.poll(now.Add(20 * time.Millisecond))
+	r.poll(now.Add(40 * time.Millisecond))
+	usage = <-ch
+	require.Equal(t, now.Add(40*time.Millisecond).UTC().UnixNano(), usage.Timestamp)
+
+	cancel()
+	r.poll(now.Add(60 * time.Millisecond))
+	_, ok := <-ch
+	require.False(t, ok)
+	require.Empty(t, r.subs)
+}
+
+func TestReactor_StatsBatched(t *testing.T) {
+	r := newReactor(10 * time.Millisecond)
+	h := reactorTask("a")
+	h.pid = os.Getpid()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fast := r.stats(ctx, h, 10*time.Millisecond)
+	slow := r.stats(ctx, h, 30*time.Millisecond)
+
+	// both subscriptions get the same sample
+	now := time.Now()
+	r.poll(now)
+	require.Same(t, <-fast, <-slow)
+
+	r.poll(now.Add(10 * time.Millisecond))
+	require.Len(t, fast, 1)
+	require.Len(t, slow, 0)
+
+	// due within half a tick
+	r.poll(now.Add(25 * time.Millisecond))
+	require.Len(t, slow, 1)
+
+	// the new minimum applies from the next sample on
+	r.setMinInterval(time.Second)
+	require.Len(t, r.reset, 1)
+	<-fast
+	r.poll(now.Add(40 * time.Millisecond))
+	<-fast
+	r.poll(now.Add(60 * time.Millisecond))
+	require.Len(t, fast, 0)
+}
+
+func TestReactor_Close(t *testing.T) {
+	r := newReactor(time.Millisecond)
+	h := reactorTask("a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wait := r.wait(context.Background(), h)
+	stats := r.stats(context.Background(), h, time.Hour)
+
+	done := make(chan struct{})
+	go func() {
+		r.run(ctx)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	_, ok := <-wait
+	require.False(t, ok)
+	for range stats {
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// readOnlyDeniedCapabilities are the host interfaces a read-only driver
+// doesn't link: they reach services off the node or persist what the guest
+// writes.
+var readOnlyDeniedCapabilities = []string{
+	capabilityBlobstore,
+	capabilityMessaging,
+	capabilityKeyValue,
+	capabilitySQL,
+	capabilitySecrets,
+	capabilityHTTP,
+}
+
+// checkReadOnly refuses a task a read-only driver can't run: one given a
+// writable directory or configuring a host interface it denies. Preopens of
+// the task dir are writable, as WASI preopens carry no rights of their own.
+func checkReadOnly(driverConfig *TaskConfig, mounts []*drivers.MountConfig, preopens []*preopen) error {
+	for _, m := range mounts {
+		if !m.Readonly {
+			return fmt.Errorf("read-only driver refuses writable mount %q", m.TaskPath)
+		}
+	}
+	for _, p := range preopens {
+		if !p.Readonly {
+			return fmt.Errorf("read-only driver refuses writable preopen %q", p.GuestPath)
+		}
+	}
+	for name, configured := range map[string]bool{
+		capabilityKeyValue: driverConfig.KeyValue.Backend != "",
+		capabilitySecrets:  len(driverConfig.Secrets.Paths) != 0,
+		capabilitySQL:      driverConfig.SQL.Driver != "",
+		capabilityHTTP:     len(driverConfig.HTTP.AllowedHosts) != 0 || driverConfig.HTTP.TaskAPI,
+	} {
+		if configured {
+			return fmt.Errorf("read-only driver refuses the %s block", name)
+		}
+	}
+	return nil
+}
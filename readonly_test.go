@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapabilitySet_Without(t *testing.T) {
+	var all capabilitySet
+	set := all.without(readOnlyDeniedCapabilities...)
+	require.True(t, set.allows(capabilityWASI))
+	require.True(t, set.allows(capabilityCrypto))
+	require.False(t, set.allows(capabilityHTTP))
+
+	// nothing is granted back
+	some, err := newCapabilitySet([]string{capabilityWASI, capabilitySQL})
+	require.NoError(t, err)
+	set = some.without(capabilitySQL)
+	require.True(t, set.allows(capabilityWASI))
+	require.False(t, set.allows(capabilitySQL))
+	require.False(t, set.allows(capabilityCrypto))
+}
+
+func TestCheckReadOnly(t *testing.T) {
+	readonly := []*drivers.MountConfig{{HostPath: "/data", TaskPath: "/data", Readonly: true}}
+	preopens := []*preopen{{HostPath: "/tz", GuestPath: zoneinfoGuestPath, Readonly: true}}
+	require.NoError(t, checkReadOnly(&TaskConfig{}, readonly, preopens))
+
+	err := checkReadOnly(&TaskConfig{}, []*drivers.MountConfig{{HostPath: "/data", TaskPath: "/data"}}, nil)
+	require.EqualError(t, err, `read-only driver refuses writable mount "/data"`)
+	err = checkReadOnly(&TaskConfig{}, nil, []*preopen{{HostPath: "/alloc/task/out", GuestPath: "/out"}})
+	require.EqualError(t, err, `read-only driver refuses writable preopen "/out"`)
+	err = checkReadOnly(&TaskConfig{HTTP: TaskHTTPConfig{AllowedHosts: []string{"example.com"}}}, nil, nil)
+	require.EqualError(t, err, "read-only driver refuses the http block")
+}
+
+func TestStartTask_ReadOnly(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{
+		DataDir:  t.TempDir(),
+		ReadOnly: true,
+		Logging:  LoggingConfig{DisableCollection: true},
+	}))
+	require.Equal(t, pstructs.NewBoolAttribute(true), d.buildFingerprint().Attributes["driver.wasmtime.read_only"])
+
+	cfg := &drivers.TaskConfig{ID: "id", AllocID: "alloc", Name: "task", AllocDir: t.TempDir()}
+	taskDir := cfg.TaskDir()
+	for _, dir := range []string{taskDir.Dir, taskDir.LogDir, filepath.Join(taskDir.Dir, "out")} {
+		require.NoError(t, os.MkdirAll(dir, 0755))
+	}
+	wasm, err := wasmtime.Wat2Wasm(helloWat)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(taskDir.Dir, "main.wasm"), wasm, 0644))
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{
+		File: "main.wasm",
+		WASI: TaskWASIConfig{Preopens: map[string]string{"/out": "out"}},
+	}))
+
+	_, _, err = d.StartTask(cfg)
+	require.EqualError(t, err, `read-only driver refuses writable preopen "/out"`)
+}
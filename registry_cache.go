@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// registryCacheDigestHeader carries the digest of the artifacts served by
+// the registry cache, which peers check what they fetch against
+const registryCacheDigestHeader = "Docker-Content-Digest"
+
+// parseRegistryPeers checks the peers of the registry_cache block
+func parseRegistryPeers(peers []string) ([]*url.URL, error) {
+	urls := make([]*url.URL, 0, len(peers))
+	for _, peer := range peers {
+		u, err := url.Parse(peer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry_cache peer %q: %v", peer, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid registry_cache peer %q: must be an http or https URL", peer)
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// registryCacheHandler serves the artifact store to co-located tooling and
+// the drivers of other nodes, so modules already pulled aren't pulled from
+// their registry again:
+//
+//	GET /v1/artifacts               the artifacts stored, as JSON
+//	GET /v1/artifacts/<digest>      the artifact with digest
+//	GET /v1/sources?source=<image>  the module pulled from a pinned image
+func (d *Driver) registryCacheHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/artifacts", func(w http.ResponseWriter, r *http.Request) {
+		store := d.registryCacheStore(w, r)
+		if store == nil {
+			return
+		}
+		writeJSON(w, http.StatusOK, store.List())
+	})
+	mux.HandleFunc("/v1/artifacts/", func(w http.ResponseWriter, r *http.Request) {
+		store := d.registryCacheStore(w, r)
+		if store == nil {
+			return
+		}
+		dgst, err := digest.Parse(strings.TrimPrefix(r.URL.Path, "/v1/artifacts/"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid digest: %v", err)})
+			return
+		}
+		serveArtifact(w, r, store, dgst)
+	})
+	mux.HandleFunc("/v1/sources", func(w http.ResponseWriter, r *http.Request) {
+		store := d.registryCacheStore(w, r)
+		if store == nil {
+			return
+		}
+		source := r.URL.Query().Get("source")
+		dgst, ok := store.Lookup(source)
+		if source == "" || !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "source not cached"})
+			return
+		}
+		serveArtifact(w, r, store, dgst)
+	})
+	return mux
+}
+
+// registryCacheStore returns the artifact store for a request to the
+// registry cache, or replies with an error and returns nil
+func (d *Driver) registryCacheStore(w http.ResponseWriter, r *http.Request) *artifactStore {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return nil
+	}
+	d.configLock.RLock()
+	store := d.artifacts
+	d.configLock.RUnlock()
+	if store == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "driver not configured"})
+	}
+	return store
+}
+
+// serveArtifact replies with the artifact dgst, supporting range requests
+func serveArtifact(w http.ResponseWriter, r *http.Request, store *artifactStore, dgst digest.Digest) {
+	f, err := store.Open(dgst)
+	if os.IsNotExist(err) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "artifact not found"})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", `"`+dgst.String()+`"`)
+	w.Header().Set(registryCacheDigestHeader, dgst.String())
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// fetchFromPeers returns the module pulled from the pinned image source by
+// the first peer having it in its registry cache
+func (d *Driver) fetchFromPeers(ctx context.Context, src *moduleSource, source string) ([]byte, bool) {
+	for _, peer := range src.peers {
+		b, err := d.fetchFromPeer(ctx, src, peer, source)
+		if err != nil {
+			d.logger.Warn("failed to fetch module from registry cache peer", "peer", peer.Redacted(), "source", source, "error", err)
+			continue
+		}
+		if b != nil {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// fetchFromPeer returns the module pulled from source by peer, nil if it
+// doesn't have it. The module is checked against the digest the peer
+// serves it with; peers are trusted to have pulled it from source, but not
+// with precompiled code, which wasmtime loads without validating it.
+func (d *Driver) fetchFromPeer(ctx context.Context, src *moduleSource, peer *url.URL, source string) ([]byte, error) {
+	u := *peer
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/sources"
+	u.RawQuery = url.Values{"source": {source}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := src.downloads.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	resp, err := src.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	expected, err := digest.Parse(resp.Header.Get(registryCacheDigestHeader))
+	if err != nil || expected.Algorithm() != digest.Canonical {
+		return nil, fmt.Errorf("invalid %s %q", registryCacheDigestHeader, resp.Header.Get(registryCacheDigestHeader))
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(src.downloads.reader(ctx, resp.Body), src.maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > src.maxDecompressedSize {
+		return nil, fmt.Errorf("module exceeds max_decompressed_size of %d bytes", src.maxDecompressedSize)
+	}
+	if actual := digest.Canonical.FromBytes(b); actual != expected {
+		return nil, fmt.Errorf("module digest %s doesn't match %s", actual, expected)
+	}
+	if isPrecompiledModule(b) {
+		return nil, fmt.Errorf("peer served precompiled code, which is only pulled from the registry")
+	}
+	if isBundle(b) {
+		bundle, err := unbundleModule(b)
+		if err != nil {
+			return nil, err
+		}
+		if bundle.precompiled != nil {
+			return nil, fmt.Errorf("peer served a bundle with precompiled code, which is only pulled from the registry")
+		}
+	}
+	return b, nil
+}
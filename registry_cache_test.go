@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+const testImageSource = "registry.example.com/app@sha256:0000000000000000000000000000000000000000000000000000000000000000#main.wasm"
+
+func TestParseRegistryPeers(t *testing.T) {
+	peers, err := parseRegistryPeers([]string{"http://10.0.0.2:4650", "https://cache.example.com/nomad/"})
+	require.NoError(t, err)
+	require.Len(t, peers, 2)
+	require.Equal(t, "cache.example.com", peers[1].Host)
+
+	for _, peer := range []string{"10.0.0.2:4650", "ftp://cache", "http://", "http://[::1"} {
+		_, err := parseRegistryPeers([]string{peer})
+		require.Error(t, err, peer)
+	}
+}
+
+func TestRegistryCache_Listener(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{
+		DataDir:       t.TempDir(),
+		RegistryCache: RegistryCacheConfig{Address: "127.0.0.1:0"},
+	}))
+	defer d.registryCache.Close()
+
+	module := []byte("\x00asm\x01\x00\x00\x00")
+	dgst, err := d.artifacts.Put("a", module)
+	require.NoError(t, err)
+	require.NoError(t, d.artifacts.Remember(testImageSource, module))
+	base := "http://" + d.registryCache.Addr().String()
+
+	var list []artifactInfo
+	require.Equal(t, http.StatusOK, getJSON(t, http.DefaultClient, base+"/v1/artifacts", &list))
+	require.Len(t, list, 1)
+	require.Equal(t, dgst, list[0].Digest)
+	require.Equal(t, int64(len(module)), list[0].Size)
+	require.Equal(t, []string{testImageSource}, list[0].Sources)
+	require.Equal(t, 1, list[0].Refs)
+
+	for _, path := range []string{"/v1/artifacts/" + dgst.String(), "/v1/sources?source=" + url.QueryEscape(testImageSource)} {
+		resp, err := http.Get(base + path)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, path)
+		require.Equal(t, dgst.String(), resp.Header.Get(registryCacheDigestHeader))
+		require.Equal(t, module, body)
+	}
+
+	var reply map[string]string
+	require.Equal(t, http.StatusNotFound, getJSON(t, http.DefaultClient, base+"/v1/artifacts/"+digest.FromString("other").String(), &reply))
+	require.Equal(t, http.StatusNotFound, getJSON(t, http.DefaultClient, base+"/v1/sources?source=other", &reply))
+	require.Equal(t, http.StatusBadRequest, getJSON(t, http.DefaultClient, base+"/v1/artifacts/sha256:nope", &reply))
+	resp, err := http.Post(base+"/v1/artifacts", "application/json", strings.NewReader("{}"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	// removing the address closes the listener
+	require.NoError(t, setConfig(t, d, &Config{DataDir: d.artifacts.dir}))
+	require.Nil(t, d.registryCache)
+	_, err = http.Get(base + "/v1/artifacts")
+	require.Error(t, err)
+}
+
+func TestRegistryCache_FetchFromPeers(t *testing.T) {
+	peer := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, peer, &Config{DataDir: t.TempDir()}))
+	module := []byte("\x00asm\x01\x00\x00\x00")
+	require.NoError(t, peer.artifacts.Remember(testImageSource, module))
+	srv := httptest.NewServer(peer.registryCacheHandler())
+	defer srv.Close()
+
+	tampered := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(registryCacheDigestHeader, digest.FromBytes(module).String())
+		w.Write([]byte("\x00asm\x02\x00\x00\x00"))
+	}))
+	defer tampered.Close()
+	empty := httptest.NewServer(http.NotFoundHandler())
+	defer empty.Close()
+
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{
+		DataDir:       t.TempDir(),
+		RegistryCache: RegistryCacheConfig{Peers: []string{empty.URL, tampered.URL, srv.URL}},
+	}))
+
+	// the first peer doesn't have the module, the second serves a corrupt one
+	b, ok := d.fetchFromPeers(context.Background(), d.moduleSource(), testImageSource)
+	require.True(t, ok)
+	require.Equal(t, module, b)
+
+	_, ok = d.fetchFromPeers(context.Background(), d.moduleSource(), "registry.example.com/other@sha256:00#main.wasm")
+	require.False(t, ok)
+
+	// precompiled code is only loaded from the registry
+	cwasm := append(append([]byte(nil), cwasmMagic...), "code"...)
+	bundle := testBundle(t, &bundleManifest{Module: "main.wasm", Precompiled: map[string]string{hostTriple(): "main.cwasm"}},
+		map[string][]byte{"main.wasm": module, "main.cwasm": cwasm})
+	peerURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	for source, b := range map[string][]byte{"cwasm": cwasm, "bundle": bundle} {
+		source = "registry.example.com/" + source + "@sha256:00#main.wasm"
+		require.NoError(t, peer.artifacts.Remember(source, b))
+		_, err := d.fetchFromPeer(context.Background(), d.moduleSource(), peerURL, source)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "precompiled code")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// restartFile keeps the task's attempts, in its task dir which lives as
+	// long as the allocation, across restarts
+	restartFile = ".wasmtime-restart.json"
+
+	// The variables telling the guest how its previous attempt went
+	restartAttemptEnvVar  = "NOMAD_RESTART_ATTEMPT"
+	restartPrevExitEnvVar = "NOMAD_RESTART_PREVIOUS_EXIT"
+	restartLastTrapEnvVar = "NOMAD_RESTART_LAST_TRAP"
+
+	// maxTrapSummary is the length trap messages are cut to
+	maxTrapSummary = 256
+)
+
+// restartAttempt is an attempt at running a task, and how the attempts
+// before it ended
+type restartAttempt struct {
+	// Attempt is 0 on the first start of the task in its allocation
+	Attempt int `json:"attempt"`
+
+	// PreviousExit is how the previous attempt exited, such as
+	// "exit_code=1" or "oom_killed"
+	PreviousExit string `json:"previous_exit,omitempty"`
+
+	// LastTrap is the summary of the last trap of any previous attempt
+	LastTrap string `json:"last_trap,omitempty"`
+}
+
+// beginAttempt records an attempt at starting the task in taskDir and
+// returns it
+func beginAttempt(taskDir string) (*restartAttempt, error) {
+	a, ok, err := loadAttempt(taskDir)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		a.Attempt++
+	}
+	if err := a.save(taskDir); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// endAttempt records how the current attempt of the task in taskDir exited
+func endAttempt(taskDir string, result *drivers.ExitResult, trap error) error {
+	a, _, err := loadAttempt(taskDir)
+	if err != nil {
+		return err
+	}
+	a.PreviousExit = exitReason(result)
+	if trap != nil {
+		a.LastTrap = trapSummary(trap)
+	}
+	return a.save(taskDir)
+}
+
+func loadAttempt(taskDir string) (*restartAttempt, bool, error) {
+	a := &restartAttempt{}
+	data, err := ioutil.ReadFile(filepath.Join(taskDir, restartFile))
+	if os.IsNotExist(err) {
+		return a, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("failed to read restart state: %v", err)
+	}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, false, fmt.Errorf("failed to decode restart state: %v", err)
+	}
+	return a, true, nil
+}
+
+func (a *restartAttempt) save(taskDir string) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(taskDir, restartFile), data, 0600); err != nil {
+		return fmt.Errorf("failed to write restart state: %v", err)
+	}
+	return nil
+}
+
+// env returns the variables describing the attempt to the guest
+func (a *restartAttempt) env() map[string]string {
+	if a == nil {
+		return nil
+	}
+	env := map[string]string{restartAttemptEnvVar: strconv.Itoa(a.Attempt)}
+	if a.PreviousExit != "" {
+		env[restartPrevExitEnvVar] = a.PreviousExit
+	}
+	if a.LastTrap != "" {
+		env[restartLastTrapEnvVar] = a.LastTrap
+	}
+	return env
+}
+
+// exitReason summarises an exit result
+func exitReason(result *drivers.ExitResult) string {
+	switch {
+	case result == nil:
+		return "unknown"
+	case result.OOMKilled:
+		return "oom_killed"
+	case result.Err != nil:
+		return "error"
+	case result.Signal != 0:
+		return fmt.Sprintf("signal=%d", result.Signal)
+	}
+	return fmt.Sprintf("exit_code=%d", result.ExitCode)
+}
+
+// trapSummary returns the first line of a trap's message, cut to
+// maxTrapSummary bytes as the backtrace following it can be long
+func trapSummary(trap error) string {
+	s := strings.TrimSpace(trap.Error())
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	if len(s) > maxTrapSummary {
+		s = s[:maxTrapSummary]
+	}
+	return s
+}
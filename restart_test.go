@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestartAttempts(t *testing.T) {
+	dir := t.TempDir()
+
+	a, err := beginAttempt(dir)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{restartAttemptEnvVar: "0"}, a.env())
+
+	trap := errors.New("wasm trap: out of bounds memory access\nwasm backtrace:\n  0: 0x2a - <unknown>!f")
+	require.NoError(t, endAttempt(dir, &drivers.ExitResult{ExitCode: 134}, trap))
+
+	a, err = beginAttempt(dir)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		restartAttemptEnvVar:  "1",
+		restartPrevExitEnvVar: "exit_code=134",
+		restartLastTrapEnvVar: "wasm trap: out of bounds memory access",
+	}, a.env())
+
+	// the last trap is kept through attempts exiting without one
+	require.NoError(t, endAttempt(dir, &drivers.ExitResult{OOMKilled: true}, nil))
+	a, err = beginAttempt(dir)
+	require.NoError(t, err)
+	require.Equal(t, 2, a.Attempt)
+	require.Equal(t, "oom_killed", a.PreviousExit)
+	require.Equal(t, "wasm trap: out of bounds memory access", a.LastTrap)
+
+	require.Nil(t, (*restartAttempt)(nil).env())
+}
+
+func TestExitReason(t *testing.T) {
+	require.Equal(t, "exit_code=0", exitReason(&drivers.ExitResult{}))
+	require.Equal(t, "signal=9", exitReason(&drivers.ExitResult{Signal: 9}))
+	require.Equal(t, "error", exitReason(&drivers.ExitResult{Err: errors.New("lost")}))
+	require.Equal(t, "unknown", exitReason(nil))
+
+	require.Len(t, trapSummary(errors.New(strings.Repeat("x", 1000))), maxTrapSummary)
+}
+
+func TestGuestEnv_Restart(t *testing.T) {
+	cfg := identityTask(t, nil)
+	attempt := &restartAttempt{Attempt: 3, PreviousExit: "exit_code=1"}
+
+	env, err := guestEnv(cfg, &TaskConfig{Env: map[string]string{"A": "1"}}, attempt)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"A":                   "1",
+		restartAttemptEnvVar:  "3",
+		restartPrevExitEnvVar: "exit_code=1",
+	}, env)
+}
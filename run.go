@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/consul-template/signals"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// guestKillTimeout is how long a destroyed task's guest is given to
+// return from a host call once interrupted
+const guestKillTimeout = 5 * time.Second
+
+// guestExit is how a guest running in process exited
+type guestExit struct {
+	exitCode int
+	signal   int
+	err      error
+	info     exitInfo
+	time     time.Time
+}
+
+// guestTask is a task whose guest runs in the plugin: its module run to
+// completion, or the instances of a serve task, which exits once stopped
+type guestTask struct {
+	done chan struct{}
+	exit guestExit
+
+	// interrupt makes the guest exit, memorySize returns the size of its
+	// linear memories
+	interrupt  func()
+	memorySize func() uint64
+
+	lock       sync.Mutex
+	signal     int
+	finished   bool
+	memoryPeak uint64
+}
+
+func newGuestTask() *guestTask {
+	return &guestTask{done: make(chan struct{})}
+}
+
+// wait blocks until the guest exited and returns how
+func (g *guestTask) wait() guestExit {
+	<-g.done
+	return g.exit
+}
+
+// stop makes the guest exit as if killed by signal
+func (g *guestTask) stop(signal int) {
+	g.lock.Lock()
+	if g.signal == 0 {
+		g.signal = signal
+	}
+	g.lock.Unlock()
+	g.interrupt()
+}
+
+// shutdown stops the guest with signal and waits for it to exit, up to
+// timeout. The epoch interrupt only traps a guest running its own code: one
+// still blocked in a host call past the timeout is reported killed by
+// SIGKILL, its goroutine left to return from the call. It returns whether
+// the guest had to be killed.
+func (g *guestTask) shutdown(signal int, timeout time.Duration) bool {
+	g.stop(signal)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-g.done:
+		return false
+	case <-timer.C:
+	}
+	g.finish(guestExit{signal: int(syscall.SIGKILL)})
+	return true
+}
+
+// memoryUsage returns the size of the guest's linear memories and the
+// largest size they were seen at, their size at exit once the guest exited
+func (g *guestTask) memoryUsage() (size, peak uint64) {
+	g.lock.Lock()
+	if g.finished {
+		defer g.lock.Unlock()
+		return g.exit.info.memorySize, g.memoryPeak
+	}
+	g.lock.Unlock()
+
+	size = g.memorySize()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if size > g.memoryPeak {
+		g.memoryPeak = size
+	}
+	return size, g.memoryPeak
+}
+
+// stopped returns the signal the guest was stopped with, 0 if it wasn't
+func (g *guestTask) stopped() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.signal
+}
+
+// finish records how the guest exited, unless it already did
+func (g *guestTask) finish(exit guestExit) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.finished {
+		return
+	}
+	g.finished = true
+	if exit.info.memorySize > g.memoryPeak {
+		g.memoryPeak = exit.info.memorySize
+	}
+	if exit.time.IsZero() {
+		exit.time = time.Now()
+	}
+	g.exit = exit
+	close(g.done)
+}
+
+// stopSignal returns the number of the signal a task is stopped with,
+// SIGTERM if it's unknown
+func stopSignal(signal string) int {
+	if s, ok := signals.SignalLookup[signal].(syscall.Signal); ok {
+		return int(s)
+	}
+	return int(syscall.SIGTERM)
+}
+
+// guestArgv returns the guest's WASI arguments: the module's name, then the
+// task's args
+func guestArgv(cfg *drivers.TaskConfig, driverConfig *TaskConfig) []string {
+	name := cfg.Name
+	if driverConfig.File != "" {
+		name = filepath.Base(driverConfig.File)
+	}
+	return append([]string{name}, driverConfig.Args...)
+}
+
+// runGuest calls the entrypoint of instance, once resumed if the task is
+// paused, until it returns, the guest exits or it's interrupted by the task
+// stopping or reaching deadline, if not 0. The module's engine must be the
+// task's own and not ticked, as the interrupts increment its epoch.
+func (d *Driver) runGuest(h *TaskHandle, m *guestModule, instance *guestInstance, deadline time.Duration) *guestTask {
+	ctx, cancel := context.WithCancel(context.Background())
+	g := newGuestTask()
+	g.interrupt = func() {
+		cancel()
+		m.calls.interrupt()
+		m.engine.IncrementEpoch()
+	}
+	g.memorySize = instance.memorySize
+
+	go func() {
+		defer cancel()
+		exit := d.callStart(ctx, h, m, instance, deadline, g)
+		exit.info.fuelConsumed, _ = instance.store.FuelConsumed()
+		if m.fuel != nil {
+			m.fuel.setConsumed(exit.info.fuelConsumed)
+		}
+		instance.Close()
+		m.closeOutput()
+		g.finish(exit)
+	}()
+	return g
+}
+
+// callStart runs the entrypoint for runGuest and returns how the guest exited
+func (d *Driver) callStart(ctx context.Context, h *TaskHandle, m *guestModule, instance *guestInstance, deadline time.Duration, g *guestTask) guestExit {
+	if err := h.pauser.wait(ctx); err != nil {
+		return guestExit{signal: g.stopped()}
+	}
+
+	var timedOut int32
+	if deadline > 0 {
+		timer := time.AfterFunc(deadline, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			m.engine.IncrementEpoch()
+		})
+		defer timer.Stop()
+	}
+
+	start := time.Now()
+	results, err := instance.call(m.entrypoint, m.callArgs...)
+	code, exited := 0, false
+	if err != nil {
+		code, exited = exitCode(err)
+	}
+	if exited && code == 0 {
+		err = nil
+	}
+	h.history.recordCall(m.entrypoint, start, err)
+
+	switch {
+	case err == nil:
+		if m.entrypoint != startExport && !exited {
+			r := &entrypointResult{Entrypoint: m.entrypoint, Results: entrypointResults(results)}
+			if err := writeEntrypointResult(h.taskConfig, r); err != nil {
+				h.logger.Error("failed to write entrypoint result", "task_id", h.taskConfig.ID, "error", err)
+			}
+		}
+		return guestExit{}
+	case exited:
+		return guestExit{
+			exitCode: code,
+			info: exitInfo{
+				exitCode:    code,
+				memorySize:  instance.memorySize(),
+				memoryLimit: m.limits.memory,
+			},
+		}
+	case g.stopped() != 0:
+		return guestExit{signal: g.stopped()}
+	case atomic.LoadInt32(&timedOut) == 1:
+		err = fmt.Errorf("guest exceeded its deadline of %s: %v", deadline, err)
+	case m.fuel != nil && isFuelExhaustion(err):
+		err = fmt.Errorf("guest used up the fuel of its %d MHz of cpu: %v", m.fuel.mhz, err)
+	}
+	h.logger.Warn("guest trapped", "task_id", h.taskConfig.ID, "error", err)
+	return guestExit{
+		exitCode: 1,
+		info: exitInfo{
+			trap:        err,
+			memorySize:  instance.memorySize(),
+			memoryLimit: m.limits.memory,
+		},
+	}
+}
+
+// startGuest runs the task's module in the plugin: to completion, or as the
+// handler of the requests of a serve task. The config lock must be held.
+func (d *Driver) startGuest(h *TaskHandle, driverConfig *TaskConfig, m *guestModule) error {
+	output, err := openGuestOutput(h.logStreams)
+	if err != nil {
+		return err
+	}
+	m.output = output
+
+	// serve tasks have their fuel limit given back to each call instead
+	if servePortLabel(driverConfig.Serve) == "" && m.limits.fuel == 0 {
+		h.cpuFuel = newCPUFuel(d.cpuFuel, h.taskConfig)
+		m.fuel = h.cpuFuel
+	}
+	if m.calls, err = d.newHostCalls(h, driverConfig); err != nil {
+		output.close()
+		return err
+	}
+
+	linkStart := time.Now()
+	hosts, err := d.newHostModules(h.taskConfig, driverConfig)
+	if err != nil {
+		m.closeOutput()
+		return err
+	}
+	h.timings.measure(startPhaseLink, linkStart)
+
+	if servePortLabel(driverConfig.Serve) != "" {
+		g, server, err := d.serveGuest(h, driverConfig, m, hosts)
+		if err != nil {
+			m.closeOutput()
+			return err
+		}
+		h.guest, h.serve = g, server
+		return nil
+	}
+
+	m.entrypoint = taskEntrypoint(driverConfig)
+	if m.entrypoint != startExport {
+		if m.callArgs, err = entrypointArgs(m.module, m.entrypoint, driverConfig.CallArgs); err != nil {
+			closeHostModules(hosts)
+			m.closeOutput()
+			return err
+		}
+	} else if !m.exports(startExport) {
+		closeHostModules(hosts)
+		m.closeOutput()
+		return fmt.Errorf("module doesn't export %q, set serve.port_label to handle requests with it instead", startExport)
+	}
+	instantiateStart := time.Now()
+	instance, err := m.instantiate(hosts, 1)
+	if err != nil {
+		m.closeOutput()
+		return err
+	}
+	h.timings.measure(startPhaseInstantiate, instantiateStart)
+
+	// the task's deadline bounds its only call
+	deadline := m.limits.deadline
+	if d.callDeadline > 0 && (deadline == 0 || d.callDeadline < deadline) {
+		deadline = d.callDeadline
+	}
+	h.guest = d.runGuest(h, m, instance, deadline)
+	return nil
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+// helloWat writes "hello" to stdout and exits with code 3
+const helloWat = `
+(module
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 16) "hello\n")
+  (func (export "_start")
+    (i32.store (i32.const 0) (i32.const 16))
+    (i32.store (i32.const 4) (i32.const 6))
+    (drop (call $fd_write (i32.const 1) (i32.const 0) (i32.const 1) (i32.const 8)))
+    (call $exit (i32.const 3)))
+)`
+
+// loopWat never returns
+const loopWat = `
+(module
+  (memory (export "memory") 1)
+  (func (export "_start") (loop $loop (br $loop)))
+)`
+
+// growWat grows its memory a page at a time until it can't
+const growWat = `
+(module
+  (memory (export "memory") 1)
+  (func (export "_start")
+    (loop $grow
+      (if (i32.eq (memory.grow (i32.const 1)) (i32.const -1)) (then unreachable))
+      (br $grow)))
+)`
+
+// sleepWat blocks in poll_oneoff for a minute
+const sleepWat = `
+(module
+  (import "wasi_snapshot_preview1" "poll_oneoff" (func $poll_oneoff (param i32 i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  ;; a relative clock subscription: tag 0, clock 1, timeout 60s
+  (data (i32.const 24) "\00\58\47\f8\0d\00\00\00")
+  (func (export "_start")
+    (i32.store (i32.const 16) (i32.const 1))
+    (drop (call $poll_oneoff (i32.const 0) (i32.const 64) (i32.const 1) (i32.const 128))))
+)`
+
+// catWat copies up to 64 bytes of stdin to stdout
+const catWat = `
+(module
+  (import "wasi_snapshot_preview1" "fd_read" (func $fd_read (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (param i32 i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (func (export "_start")
+    (i32.store (i32.const 0) (i32.const 16))
+    (i32.store (i32.const 4) (i32.const 64))
+    (drop (call $fd_read (i32.const 0) (i32.const 0) (i32.const 1) (i32.const 8)))
+    (i32.store (i32.const 4) (i32.load (i32.const 8)))
+    (drop (call $fd_write (i32.const 1) (i32.const 0) (i32.const 1) (i32.const 8))))
+)`
+
+// argvWat writes its NUL separated WASI arguments to stdout
+const argvWat = `
+(module
+  (import "wasi_snapshot_preview1" "args_sizes_get" (func $sizes (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "args_get" (func $args (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (param i32 i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (func (export "_start")
+    (drop (call $sizes (i32.const 0) (i32.const 4)))
+    (drop (call $args (i32.const 64) (i32.const 1024)))
+    (i32.store (i32.const 16) (i32.const 1024))
+    (i32.store (i32.const 20) (i32.load (i32.const 4)))
+    (drop (call $fd_write (i32.const 1) (i32.const 16) (i32.const 1) (i32.const 24))))
+)`
+
+// startTestTask starts a task running wat in process with d configured to
+// write its output to plain files, and returns its config
+func startTestTask(t *testing.T, d *Driver, wat string, driverConfig *TaskConfig) *drivers.TaskConfig {
+	t.Helper()
+	require.NoError(t, setConfig(t, d, &Config{
+		DataDir: t.TempDir(),
+		Logging: LoggingConfig{DisableCollection: true},
+	}))
+
+	wasm, err := wasmtime.Wat2Wasm(wat)
+	require.NoError(t, err)
+	cfg := newTestTask(t, wasm)
+	driverConfig.File = "main.wasm"
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(driverConfig))
+	_, _, err = d.StartTask(cfg)
+	require.NoError(t, err)
+	return cfg
+}
+
+// newTestTask returns the config of a task whose dir holds wasm as
+// main.wasm
+func newTestTask(t *testing.T, wasm []byte) *drivers.TaskConfig {
+	t.Helper()
+	cfg := &drivers.TaskConfig{ID: "id", AllocID: "alloc", Name: "task", AllocDir: t.TempDir()}
+	taskDir := cfg.TaskDir()
+	for _, dir := range []string{taskDir.Dir, taskDir.LogDir, taskDir.SecretsDir} {
+		require.NoError(t, os.MkdirAll(dir, 0755))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(taskDir.Dir, "main.wasm"), wasm, 0644))
+	return cfg
+}
+
+// waitTestTask returns the exit result of the task id
+func waitTestTask(t *testing.T, d *Driver, id string) *drivers.ExitResult {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ch, err := d.WaitTask(ctx, id)
+	require.NoError(t, err)
+	select {
+	case res := <-ch:
+		return res
+	case <-ctx.Done():
+		t.Fatal("task didn't exit")
+		return nil
+	}
+}
+
+func TestStartTask_RunsInProcess(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := startTestTask(t, d, helloWat, &TaskConfig{})
+
+	res := waitTestTask(t, d, cfg.ID)
+	require.Equal(t, 3, res.ExitCode)
+	require.Zero(t, res.Signal)
+
+	stdout, err := ioutil.ReadFile(filepath.Join(cfg.TaskDir().LogDir, "task.stdout"))
+	require.NoError(t, err)
+	require.Equal(t, "hello\n", string(stdout))
+
+	status, err := d.InspectTask(cfg.ID)
+	require.NoError(t, err)
+	require.Equal(t, drivers.TaskStateExited, status.State)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
+
+func TestStartTask_Trap(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := startTestTask(t, d, `(module (func (export "_start") unreachable))`, &TaskConfig{})
+
+	res := waitTestTask(t, d, cfg.ID)
+	require.Equal(t, 1, res.ExitCode)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
+
+func TestStartTask_Deadline(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := startTestTask(t, d, loopWat, &TaskConfig{Limits: TaskLimitsConfig{Deadline: "50ms"}})
+
+	res := waitTestTask(t, d, cfg.ID)
+	require.Equal(t, 1, res.ExitCode)
+	require.Zero(t, res.Signal)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
+
+func TestStopTask_InterruptsGuest(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := startTestTask(t, d, loopWat, &TaskConfig{})
+
+	require.NoError(t, d.StopTask(cfg.ID, time.Second, "SIGINT"))
+	res := waitTestTask(t, d, cfg.ID)
+	require.Equal(t, int(syscall.SIGINT), res.Signal)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
+
+func TestStopTask_InterruptsBeforeTimeout(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := startTestTask(t, d, loopWat, &TaskConfig{})
+
+	start := time.Now()
+	require.NoError(t, d.StopTask(cfg.ID, time.Minute, "SIGTERM"))
+	require.Less(t, time.Since(start), 10*time.Second)
+	res := waitTestTask(t, d, cfg.ID)
+	require.Equal(t, int(syscall.SIGTERM), res.Signal)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
+
+func TestStopTask_KillsBlockedGuest(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := startTestTask(t, d, sleepWat, &TaskConfig{})
+
+	// the guest is in its host call, past the epoch checks
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	require.NoError(t, d.StopTask(cfg.ID, 200*time.Millisecond, "SIGTERM"))
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	require.Less(t, time.Since(start), 10*time.Second)
+	res := waitTestTask(t, d, cfg.ID)
+	require.Equal(t, int(syscall.SIGKILL), res.Signal)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
+
+func TestStartTask_NoStartExport(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir(), Logging: LoggingConfig{DisableCollection: true}}))
+
+	cfg := &drivers.TaskConfig{ID: "id", AllocID: "alloc", Name: "task", AllocDir: t.TempDir()}
+	require.NoError(t, os.MkdirAll(cfg.TaskDir().Dir, 0755))
+	wasm, err := wasmtime.Wat2Wasm(`(module)`)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.TaskDir().Dir, "main.wasm"), wasm, 0644))
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{File: "main.wasm"}))
+
+	_, _, err = d.StartTask(cfg)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `module doesn't export "_start"`)
+	_, ok := d.tasks.Get(cfg.ID)
+	require.False(t, ok)
+}
+
+func TestStartTask_Serve(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir(), Logging: LoggingConfig{DisableCollection: true}}))
+
+	cfg := &drivers.TaskConfig{
+		ID: "id", AllocID: "alloc", Name: "task", AllocDir: t.TempDir(),
+		Env: map[string]string{"NOMAD_ADDR_http": addr},
+	}
+	require.NoError(t, os.MkdirAll(cfg.TaskDir().Dir, 0755))
+	wasm, err := wasmtime.Wat2Wasm(serveMethodWat)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.TaskDir().Dir, "main.wasm"), wasm, 0644))
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{File: "main.wasm", Serve: TaskServeConfig{PortLabel: "http"}}))
+
+	_, network, err := d.StartTask(cfg)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", network.IP)
+	require.Equal(t, addr, net.JoinHostPort(network.IP, strconv.Itoa(network.PortMap["http"])))
+
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		resp, err = http.Get("http://" + addr + "/")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "yes", resp.Header.Get("X-Guest"))
+	require.Equal(t, "GET", string(body))
+
+	require.NoError(t, d.StopTask(cfg.ID, time.Second, "SIGTERM"))
+	res := waitTestTask(t, d, cfg.ID)
+	require.Equal(t, int(syscall.SIGTERM), res.Signal)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
+
+func TestStartTask_ServeRouteLimits(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir(), Logging: LoggingConfig{DisableCollection: true}}))
+
+	main, err := wasmtime.Wat2Wasm(serveMethodWat)
+	require.NoError(t, err)
+	tables, err := wasmtime.Wat2Wasm(`(module (table 1 funcref) (table 1 funcref))`)
+	require.NoError(t, err)
+	cfg := newTestTask(t, main)
+	cfg.Env = map[string]string{"NOMAD_ADDR_http": "127.0.0.1:0"}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.TaskDir().Dir, "tables.wasm"), tables, 0644))
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{
+		File:   "main.wasm",
+		Serve:  TaskServeConfig{PortLabel: "http", Routes: map[string]string{"/tables": "tables.wasm"}},
+		Limits: TaskLimitsConfig{MaxTables: 1},
+	}))
+
+	// a route module is held to the task's limits when it starts
+	_, _, err = d.StartTask(cfg)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "tables.wasm")
+	_, ok := d.tasks.Get(cfg.ID)
+	require.False(t, ok)
+	require.Empty(t, d.modules.tasks)
+}
+
+func TestStartTask_MountWaitReleasesConfigLock(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir(), MountTimeout: "2s", Logging: LoggingConfig{DisableCollection: true}}))
+
+	wasm, err := wasmtime.Wat2Wasm(helloWat)
+	require.NoError(t, err)
+	cfg := newTestTask(t, wasm)
+	cfg.Mounts = []*drivers.MountConfig{{HostPath: filepath.Join(t.TempDir(), "missing"), TaskPath: "/data"}}
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{File: "main.wasm"}))
+
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := d.StartTask(cfg)
+		errs <- err
+	}()
+
+	// the config can change while the task waits for its mount source
+	time.Sleep(500 * time.Millisecond)
+	locked := make(chan struct{})
+	go func() {
+		d.configLock.Lock()
+		d.configLock.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("config lock held while waiting for a mount source")
+	}
+
+	err = <-errs
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "timed out")
+}
+
+func TestStartTask_Stdin(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+
+	// the module itself is the only file in the task dir
+	cfg := startTestTask(t, d, catWat, &TaskConfig{Stdin: "main.wasm"})
+	res := waitTestTask(t, d, cfg.ID)
+	require.Zero(t, res.ExitCode)
+
+	stdout, err := ioutil.ReadFile(filepath.Join(cfg.TaskDir().LogDir, "task.stdout"))
+	require.NoError(t, err)
+	wasm, err := ioutil.ReadFile(filepath.Join(cfg.TaskDir().Dir, "main.wasm"))
+	require.NoError(t, err)
+	require.Equal(t, wasm[:len(stdout)], stdout)
+	require.Equal(t, "\x00asm", string(stdout[:4]))
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
+
+func TestStartTask_Args(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := startTestTask(t, d, argvWat, &TaskConfig{Args: []string{"--name", "web", ""}})
+	require.Zero(t, waitTestTask(t, d, cfg.ID).ExitCode)
+
+	stdout, err := ioutil.ReadFile(filepath.Join(cfg.TaskDir().LogDir, "task.stdout"))
+	require.NoError(t, err)
+	require.Equal(t, "main.wasm\x00--name\x00web\x00\x00", string(stdout))
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
+
+func TestStartTask_MemoryAllocation(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir(), Logging: LoggingConfig{DisableCollection: true}}))
+
+	wasm, err := wasmtime.Wat2Wasm(growWat)
+	require.NoError(t, err)
+	cfg := newTestTask(t, wasm)
+	cfg.Resources = &drivers.Resources{NomadResources: &structs.AllocatedTaskResources{
+		Memory: structs.AllocatedMemoryResources{MemoryMB: 1},
+	}}
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{File: "main.wasm"}))
+	_, _, err = d.StartTask(cfg)
+	require.NoError(t, err)
+
+	res := waitTestTask(t, d, cfg.ID)
+	require.Equal(t, 1, res.ExitCode)
+	require.True(t, res.OOMKilled)
+	require.EqualError(t, res.Err, "memory limit exceeded: the guest's memory reached 1.0 MiB of its 1.0 MiB limit")
+
+	h, ok := d.tasks.Get(cfg.ID)
+	require.True(t, ok)
+	_, peak := h.guest.memoryUsage()
+	require.Equal(t, uint64(1<<20), peak)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
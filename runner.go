@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/drivers/shared/executor"
+	"github.com/hashicorp/nomad/plugins/base"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
+)
+
+const (
+	// executionModeInProcess runs guests in the plugin, executionModeForked
+	// in a runner process of their own for each task
+	executionModeInProcess = "in_process"
+	executionModeForked    = "forked"
+
+	// runnerSpecFile is where the runner of a task finds its spec, in the
+	// task dir. The runner deletes it once read, as it holds the plugin
+	// config.
+	runnerSpecFile = ".wasmtime-runner"
+
+	// runnerLogFile collects the logs of a task's runner, executorLogFile
+	// those of the executor supervising it, both in the task dir
+	runnerLogFile   = "wasmtime-runner.log"
+	executorLogFile = "executor.out"
+
+	// runnerHardenedEnv is set when a runner executes itself again once
+	// hardened
+	runnerHardenedEnv = "NOMAD_DRIVER_WASMTIME_RUNNER_HARDENED"
+
+	// defaultRunnerUmask is the umask of runners unless runner.umask is set
+	defaultRunnerUmask = 0077
+
+	// runnerDrainTimeout bounds the drain of a serve task's requests once
+	// its runner is told to stop. The executor kills the runner at the
+	// task's kill timeout anyway.
+	runnerDrainTimeout = time.Minute
+)
+
+// runnerSpec is what the runner process of a task needs to run it, as
+// prepared by StartTask
+type runnerSpec struct {
+	Config       *Config
+	Task         *drivers.TaskConfig
+	DriverConfig *TaskConfig
+
+	// Module and Precompiled are the paths of the module and its
+	// precompiled code, if any, in the artifact store
+	Module      string
+	Precompiled string
+
+	Features   []string
+	Env        map[string]string
+	Preopens   []*preopen
+	LogStreams *logStreams
+}
+
+// launchRunner starts the runner of the task of h, supervised by an
+// executor, and records how to reattach to it in state
+func (d *Driver) launchRunner(h *TaskHandle, spec *runnerSpec, state *TaskState) error {
+	cfg := h.taskConfig
+	bin, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the plugin binary: %v", err)
+	}
+
+	var b []byte
+	if err := base.MsgPackEncode(&b, spec); err != nil {
+		return fmt.Errorf("failed to encode runner spec: %v", err)
+	}
+	specPath := filepath.Join(cfg.TaskDir().Dir, runnerSpecFile)
+	if err := ioutil.WriteFile(specPath, b, 0600); err != nil {
+		return fmt.Errorf("failed to write runner spec: %v", err)
+	}
+
+	executorConfig := &executor.ExecutorConfig{
+		LogFile:  filepath.Join(cfg.TaskDir().Dir, executorLogFile),
+		LogLevel: "debug",
+	}
+	exec, pluginClient, err := executor.CreateExecutor(d.logger.With("task_id", cfg.ID), d.nomadConfig, executorConfig)
+	if err != nil {
+		os.Remove(specPath)
+		return fmt.Errorf("failed to create executor: %v", err)
+	}
+
+	// the executor only opens existing files, as it's given FIFOs by Nomad
+	runnerLog := filepath.Join(cfg.TaskDir().Dir, runnerLogFile)
+	f, err := os.OpenFile(runnerLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		pluginClient.Kill()
+		os.Remove(specPath)
+		return fmt.Errorf("failed to create runner log: %v", err)
+	}
+	f.Close()
+	ps, err := exec.Launch(&executor.ExecCommand{
+		Cmd:        bin,
+		Args:       []string{"-run-task", specPath},
+		StdoutPath: runnerLog,
+		StderrPath: runnerLog,
+		TaskDir:    cfg.TaskDir().Dir,
+	})
+	if err != nil {
+		pluginClient.Kill()
+		os.Remove(specPath)
+		return fmt.Errorf("failed to launch runner: %v", err)
+	}
+
+	h.exec, h.pluginClient = exec, pluginClient
+	state.ReattachConfig = pstructs.ReattachConfigFromGoPlugin(pluginClient.ReattachConfig())
+	state.Pid = ps.Pid
+	return nil
+}
+
+// parseUmask parses the octal runner.umask
+func parseUmask(umask string) (int, error) {
+	if umask == "" {
+		return defaultRunnerUmask, nil
+	}
+	mask, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil || mask > 0777 {
+		return 0, fmt.Errorf("invalid runner umask %q: must be octal permission bits", umask)
+	}
+	return int(mask), nil
+}
+
+// configureRunner applies config to the driver of a runner process, which
+// only runs its task: the listeners, stores and background jobs SetConfig
+// starts are the plugin's
+func (d *Driver) configureRunner(config *Config) error {
+	settings, err := parsePluginConfig(config)
+	if err != nil {
+		return err
+	}
+	kvBackends, err := newKVBackends(config.KeyValue)
+	if err != nil {
+		return fmt.Errorf("invalid keyvalue config: %v", err)
+	}
+
+	d.configLock.Lock()
+	defer d.configLock.Unlock()
+	d.logger.SetLevel(settings.logLevel)
+	d.config = config
+	d.kvBackends = kvBackends
+	d.epochs.SetInterval(settings.epochInterval)
+	d.callDeadline = settings.callDeadline
+	d.cpuFuel = settings.cpuFuel
+	d.maxDecompressedSize = settings.maxDecompressedSize
+	d.httpClient = settings.httpClient
+	d.blobstore = settings.blobstore
+	d.vault = settings.vault
+	d.secretsCacheTTL = settings.secretsCacheTTL
+	return nil
+}
+
+// runRunner runs the task of the spec at path until it exits, returning
+// the runner's exit code. A guest stopped by a signal kills the runner
+// with it, so the executor reports the signal.
+func runRunner(path string) int {
+	logger := hclog.New(&hclog.LoggerOptions{Name: pluginName + ".runner", Output: os.Stderr})
+
+	b, err := ioutil.ReadFile(path)
+	var spec runnerSpec
+	if err == nil {
+		err = base.MsgPackDecode(b, &spec)
+	}
+	if err != nil {
+		logger.Error("failed to read runner spec", "path", path, "error", err)
+		return 1
+	}
+
+	// the ulimits are set before hardening, as raising them may take
+	// capabilities, and again once executed, as the Go runtime raises the
+	// soft nofile limit when it starts
+	ulimits, err := parseUlimits(spec.DriverConfig.Ulimit)
+	if err == nil {
+		err = setUlimits(ulimits)
+	}
+	if err != nil {
+		logger.Error("failed to set ulimits", "error", err)
+		return 1
+	}
+
+	// the spec is read again once hardened, as the runner executes itself
+	// again to drop the descriptors it inherited
+	if os.Getenv(runnerHardenedEnv) == "" {
+		if err := hardenRunner(spec.Config.Runner); err != nil {
+			logger.Error("failed to harden runner", "error", err)
+			return 1
+		}
+		if !spec.Config.Runner.KeepInheritedFDs {
+			if err := reexecRunner(); err != nil {
+				logger.Error("failed to close inherited descriptors", "error", err)
+				return 1
+			}
+		}
+	}
+	os.Remove(path)
+
+	// stop signals are only acted on once the guest started
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	d := NewWasmtimeDriver(logger).(*Driver)
+	h, err := d.startRunnerTask(&spec)
+	if err != nil {
+		logger.Error("failed to start task", "task_id", spec.Task.ID, "error", err)
+		return 1
+	}
+
+	exited := make(chan guestExit, 1)
+	go func() { exited <- h.guest.wait() }()
+	for {
+		select {
+		case exit := <-exited:
+			if exit.err != nil {
+				logger.Error("task failed", "task_id", spec.Task.ID, "error", exit.err)
+				return 1
+			}
+			if exit.signal != 0 {
+				sig := syscall.Signal(exit.signal)
+				signal.Reset(sig)
+				syscall.Kill(os.Getpid(), sig)
+				// the signal may be delivered to another thread
+				time.Sleep(time.Second)
+				return 128 + exit.signal
+			}
+			return exit.exitCode
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if h.serve != nil && spec.DriverConfig.Serve.ReloadFile != "" {
+					if err := d.reloadServe(h, spec.DriverConfig); err != nil {
+						logger.Error("failed to reload serve settings", "task_id", spec.Task.ID, "error", err)
+					}
+				}
+				continue
+			}
+			if h.guest.stopped() != 0 {
+				continue
+			}
+			if h.serve != nil {
+				if err := d.drainServe(h, runnerDrainTimeout); err != nil {
+					logger.Warn("failed to drain serve listener", "task_id", spec.Task.ID, "error", err)
+				}
+			}
+			h.guest.stop(int(sig.(syscall.Signal)))
+		}
+	}
+}
+
+// startRunnerTask configures d with the plugin config of spec and starts its
+// task's guest
+func (d *Driver) startRunnerTask(spec *runnerSpec) (*TaskHandle, error) {
+	if err := d.configureRunner(spec.Config); err != nil {
+		return nil, err
+	}
+	d.configLock.RLock()
+	defer d.configLock.RUnlock()
+
+	// the driver config is passed decoded, as a TaskConfig's raw config
+	// doesn't survive encoding
+	cfg := spec.Task
+	if err := cfg.EncodeConcreteDriverConfig(spec.DriverConfig); err != nil {
+		return nil, err
+	}
+
+	timings := newStartTimings(cfg)
+	wasm, err := ioutil.ReadFile(spec.Module)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read module: %v", err)
+	}
+	var precompiled []byte
+	if spec.Precompiled != "" {
+		if precompiled, err = ioutil.ReadFile(spec.Precompiled); err != nil {
+			return nil, fmt.Errorf("failed to read precompiled module: %v", err)
+		}
+	}
+
+	limits, err := mergeTaskConfig(d.config, spec.DriverConfig)
+	if err != nil {
+		return nil, err
+	}
+	limits.capMemory(allocatedMemory(cfg))
+	logLevel, err := parseTaskLogLevel(spec.DriverConfig.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	engineCfg, compiled, err := engineConfig(spec.DriverConfig.Compiler, spec.Features)
+	if err != nil {
+		return nil, err
+	}
+	compileStart := time.Now()
+	key := engineKey(spec.DriverConfig.Compiler, spec.Features)
+	engine, module, err := compileModule(d.modules, cfg.ID, key, engineCfg, wasm, precompiled, limits, compiled)
+	if err != nil {
+		return nil, err
+	}
+	var routes map[string]*wasmtime.Module
+	if servePortLabel(spec.DriverConfig.Serve) != "" {
+		wasms, _, err := readRouteModules(cfg, spec.DriverConfig, d.config, spec.Features, d.maxDecompressedSize)
+		if err != nil {
+			return nil, err
+		}
+		if routes, err = compileRouteModules(d.modules, cfg.ID, key, engine, wasms, limits, compiled); err != nil {
+			return nil, err
+		}
+	}
+	timings.measure(startPhaseCompile, compileStart)
+	logger := d.taskLogger(logLevel)
+	logCompileDiagnostics(logger, cfg.ID, compiled)
+
+	h := &TaskHandle{
+		taskConfig: cfg,
+		procState:  drivers.TaskStateRunning,
+		startedAt:  time.Now(),
+		exitResult: &drivers.ExitResult{},
+		preopens:   spec.Preopens,
+		logStreams: spec.LogStreams,
+		timings:    timings,
+		compile:    compiled,
+		pauser:     newPauser(),
+		history:    newInvocationHistory(historySize),
+		logger:     logger,
+	}
+	stdin, err := guestStdin(cfg.TaskDir().Dir, spec.DriverConfig.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	m := &guestModule{
+		taskID:      cfg.ID,
+		engine:      engine,
+		module:      module,
+		routes:      routes,
+		argv:        guestArgv(cfg, spec.DriverConfig),
+		env:         spec.Env,
+		preopens:    spec.Preopens,
+		stdin:       stdin,
+		limits:      limits,
+		preallocate: spec.DriverConfig.PreallocateMemory,
+		instances:   d.instances,
+	}
+	if err := d.startGuest(h, spec.DriverConfig, m); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
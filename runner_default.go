@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// hardenRunner only validates the runner config outside of Linux.
+func hardenRunner(config RunnerConfig) error {
+	_, err := parseUmask(config.Umask)
+	return err
+}
+
+// setUlimits is not supported outside of Linux
+func setUlimits(ulimits map[string]ulimit) error {
+	if len(ulimits) != 0 {
+		return errors.New("ulimits are not supported on this platform")
+	}
+	return nil
+}
+
+// reexecRunner is a no-op outside of Linux.
+func reexecRunner() error {
+	return nil
+}
@@ -0,0 +1,77 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// hardenRunner sets no_new_privs, clears the ambient capabilities and sets
+// the umask of the runner, unless relaxed by the plugin config. They are
+// kept across the runner's exec of itself.
+func hardenRunner(config RunnerConfig) error {
+	if !config.AllowNewPrivileges {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("failed to set no_new_privs: %v", err)
+		}
+	}
+	if !config.KeepAmbientCapabilities {
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+			return fmt.Errorf("failed to clear ambient capabilities: %v", err)
+		}
+	}
+	umask, err := parseUmask(config.Umask)
+	if err != nil {
+		return err
+	}
+	unix.Umask(umask)
+	return nil
+}
+
+// ulimitResources are the resources of the ulimits
+var ulimitResources = map[string]int{
+	ulimitNofile: unix.RLIMIT_NOFILE,
+	ulimitNproc:  unix.RLIMIT_NPROC,
+	ulimitCore:   unix.RLIMIT_CORE,
+}
+
+// setUlimits sets the resource limits of the runner, which its guest's host
+// functions are subject to
+func setUlimits(ulimits map[string]ulimit) error {
+	for name, l := range ulimits {
+		limit := &unix.Rlimit{Cur: l.soft, Max: l.hard}
+		if err := unix.Setrlimit(ulimitResources[name], limit); err != nil {
+			return fmt.Errorf("failed to set ulimit %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// reexecRunner executes the runner again with every descriptor but stdio
+// closed, so the guest can't reach those it inherited from the executor. It
+// only returns on failure.
+func reexecRunner() error {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return fmt.Errorf("failed to list descriptors: %v", err)
+	}
+	for _, fd := range fds {
+		if n, err := strconv.Atoi(fd.Name()); err == nil && n > 2 {
+			unix.CloseOnExec(n)
+		}
+	}
+
+	bin, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find runner binary: %v", err)
+	}
+	env := append(os.Environ(), runnerHardenedEnv+"=1")
+	return syscall.Exec(bin, os.Args, env)
+}
@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartTask_ForkedHardened(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg, handle := startForkedTask(t, d, loopWat, &TaskConfig{})
+	defer d.DestroyTask(cfg.ID, true)
+
+	var state TaskState
+	require.NoError(t, handle.GetDriverState(&state))
+	path := fmt.Sprintf("/proc/%d/status", state.Pid)
+
+	// the runner is hardened once it executed itself again
+	require.Eventually(t, func() bool {
+		b, err := ioutil.ReadFile(path)
+		return err == nil && strings.Contains(string(b), "NoNewPrivs:\t1")
+	}, 5*time.Second, 50*time.Millisecond)
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(b), "CapAmb:\t0000000000000000")
+	require.Contains(t, string(b), "Umask:\t0077")
+
+	require.NoError(t, d.StopTask(cfg.ID, 5*time.Second, "SIGINT"))
+	waitTestTask(t, d, cfg.ID)
+}
+
+func TestStartTask_ForkedUlimits(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg, handle := startForkedTask(t, d, loopWat, &TaskConfig{
+		Ulimit: map[string]string{ulimitNofile: "256:512", ulimitCore: "0"},
+	})
+	defer d.DestroyTask(cfg.ID, true)
+
+	var state TaskState
+	require.NoError(t, handle.GetDriverState(&state))
+	var limits string
+	require.Eventually(t, func() bool {
+		b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/limits", state.Pid))
+		limits = string(b)
+		return err == nil && regexp.MustCompile(`Max open files +256 +512 `).MatchString(limits)
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Regexp(t, `Max core file size +0 +0 `, limits)
+
+	require.NoError(t, d.StopTask(cfg.ID, 5*time.Second, "SIGINT"))
+	waitTestTask(t, d, cfg.ID)
+}
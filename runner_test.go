@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMain makes the test binary act as the runner of forked tasks, as
+// the plugin binary does
+func TestMain(m *testing.M) {
+	if len(os.Args) == 3 && os.Args[1] == "-run-task" {
+		os.Exit(runRunner(os.Args[2]))
+	}
+	os.Exit(m.Run())
+}
+
+// startForkedTask starts a task running wat in a runner process
+func startForkedTask(t *testing.T, d *Driver, wat string, driverConfig *TaskConfig) (*drivers.TaskConfig, *drivers.TaskHandle) {
+	t.Helper()
+	require.NoError(t, setConfig(t, d, &Config{
+		DataDir:       t.TempDir(),
+		ExecutionMode: executionModeForked,
+		Logging:       LoggingConfig{DisableCollection: true},
+	}))
+
+	cfg := &drivers.TaskConfig{ID: "id", AllocID: "alloc", Name: "task", AllocDir: t.TempDir()}
+	taskDir := cfg.TaskDir()
+	for _, dir := range []string{taskDir.Dir, taskDir.LogDir, taskDir.SecretsDir} {
+		require.NoError(t, os.MkdirAll(dir, 0755))
+	}
+	wasm, err := wasmtime.Wat2Wasm(wat)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(taskDir.Dir, "main.wasm"), wasm, 0644))
+	driverConfig.File = "main.wasm"
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(driverConfig))
+
+	handle, _, err := d.StartTask(cfg)
+	require.NoError(t, err)
+	return cfg, handle
+}
+
+func TestParsePluginConfig_ExecutionMode(t *testing.T) {
+	for _, mode := range []string{"", executionModeInProcess, executionModeForked} {
+		_, err := parsePluginConfig(&Config{ExecutionMode: mode})
+		require.NoError(t, err, mode)
+	}
+	_, err := parsePluginConfig(&Config{ExecutionMode: "threaded"})
+	require.Error(t, err)
+}
+
+func TestStartTask_Forked(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg, handle := startForkedTask(t, d, helloWat, &TaskConfig{})
+
+	var state TaskState
+	require.NoError(t, handle.GetDriverState(&state))
+	require.NotNil(t, state.ReattachConfig)
+	require.NotZero(t, state.Pid)
+
+	res := waitTestTask(t, d, cfg.ID)
+	require.Equal(t, 3, res.ExitCode)
+	stdout, err := ioutil.ReadFile(filepath.Join(cfg.TaskDir().LogDir, "task.stdout"))
+	require.NoError(t, err)
+	require.Equal(t, "hello\n", string(stdout))
+
+	// the spec holding the plugin config doesn't outlive the runner's start
+	require.NoFileExists(t, filepath.Join(cfg.TaskDir().Dir, runnerSpecFile))
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
+
+func TestRecoverTask_Forked(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg, handle := startForkedTask(t, d, loopWat, &TaskConfig{})
+
+	// a restarted plugin reattaches to the runner, which kept running
+	restarted := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, restarted, d.config))
+	require.NoError(t, restarted.RecoverTask(handle))
+	status, err := restarted.InspectTask(cfg.ID)
+	require.NoError(t, err)
+	require.Equal(t, drivers.TaskStateRunning, status.State)
+
+	require.NoError(t, restarted.StopTask(cfg.ID, 5*time.Second, "SIGINT"))
+	res := waitTestTask(t, restarted, cfg.ID)
+	require.Equal(t, int(syscall.SIGINT), res.Signal)
+	require.NoError(t, restarted.DestroyTask(cfg.ID, false))
+	require.NoError(t, d.DestroyTask(cfg.ID, true))
+}
+
+func TestRecoverTask_InPluginUnstagesMounts(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{
+		DataDir: t.TempDir(),
+		Logging: LoggingConfig{DisableCollection: true},
+	}))
+	wasm, err := wasmtime.Wat2Wasm(loopWat)
+	require.NoError(t, err)
+	cfg := newTestTask(t, wasm)
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{File: "main.wasm"}))
+	handle, _, err := d.StartTask(cfg)
+	require.NoError(t, err)
+	defer d.DestroyTask(cfg.ID, true)
+
+	// the guest stopped with the plugin, so its staged mounts aren't
+	// anyone's to clean up once recovering it fails
+	staged := filepath.Join(cfg.TaskDir().Dir, mountStagingDir, "0")
+	require.NoError(t, os.MkdirAll(staged, 0700))
+	var state TaskState
+	require.NoError(t, handle.GetDriverState(&state))
+	state.Preopens = append(state.Preopens, &preopen{HostPath: staged, GuestPath: "/data", Staged: true})
+	require.NoError(t, handle.SetDriverState(&state))
+
+	restarted := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, restarted, d.config))
+	require.Error(t, restarted.RecoverTask(handle))
+	require.NoDirExists(t, staged)
+}
+
+func TestParseUmask(t *testing.T) {
+	mask, err := parseUmask("")
+	require.NoError(t, err)
+	require.Equal(t, 0077, mask)
+	mask, err = parseUmask("027")
+	require.NoError(t, err)
+	require.Equal(t, 0027, mask)
+
+	for _, umask := range []string{"8", "1777", "-1", "rwx"} {
+		_, err := parseUmask(umask)
+		require.Error(t, err, umask)
+	}
+	_, err = parsePluginConfig(&Config{Runner: RunnerConfig{Umask: "999"}})
+	require.Error(t, err)
+}
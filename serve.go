@@ -0,0 +1,603 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// errServeClosed is returned for requests received after the task stopped
+var errServeClosed = errors.New("task is stopped")
+
+// servePortLabel returns the label of the serve task's port, "" if the task
+// doesn't serve
+func servePortLabel(c TaskServeConfig) string {
+	if c.PortLabel != "" {
+		return c.PortLabel
+	}
+	return c.Port
+}
+
+// validateServePort checks that at most one of serve.port_label or its
+// former name serve.port is set
+func validateServePort(c TaskServeConfig) error {
+	if c.PortLabel != "" && c.Port != "" && c.PortLabel != c.Port {
+		return fmt.Errorf("only one of serve.port_label or serve.port may be set")
+	}
+	return nil
+}
+
+// serveNetwork returns the driver network of a serve task, which maps the
+// port labelled port to the address its listener binds, so services and
+// checks using address_mode "driver" reach it
+func serveNetwork(cfg *drivers.TaskConfig, port string) (*drivers.DriverNetwork, error) {
+	addr, err := serveAddress(cfg, port)
+	if err != nil {
+		return nil, err
+	}
+	host, portNum, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q of serve port %q: %v", addr, port, err)
+	}
+	n, err := strconv.Atoi(portNum)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q of serve port %q: %v", addr, port, err)
+	}
+	return &drivers.DriverNetwork{
+		PortMap:       map[string]int{port: n},
+		IP:            host,
+		AutoAdvertise: true,
+	}, nil
+}
+
+// serveAddress returns the address of the task's port labelled port, as
+// Nomad exposes it in the task's environment.
+func serveAddress(cfg *drivers.TaskConfig, port string) (string, error) {
+	name := "NOMAD_ADDR_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, port)
+
+	addr, ok := cfg.Env[name]
+	if !ok || addr == "" {
+		return "", fmt.Errorf("serve port %q is not a port of the task", port)
+	}
+	return addr, nil
+}
+
+// parseServeIdleTimeout returns the parsed serve.idle_timeout, or 0 if
+// instances are never unloaded.
+func parseServeIdleTimeout(cfg TaskServeConfig) (time.Duration, error) {
+	if cfg.IdleTimeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(cfg.IdleTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid serve idle_timeout %q: %v", cfg.IdleTimeout, err)
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("invalid serve idle_timeout %q: must not be negative", cfg.IdleTimeout)
+	}
+	return timeout, nil
+}
+
+// serveInstance is an instance of a serve task's module handling requests
+type serveInstance interface {
+	http.Handler
+	Close() error
+}
+
+// websocketInstance is implemented by the instances able to handle
+// WebSocket connections. ServeWebSocket returns once the guest is done with
+// conn.
+type websocketInstance interface {
+	serveInstance
+	ServeWebSocket(conn websocketConn) error
+}
+
+// serveStats counts the cold starts of a serve task
+type serveStats struct {
+	ColdStarts     uint64
+	LastColdStart  time.Duration
+	TotalColdStart time.Duration
+}
+
+// serveSupervisor owns the instance of a serve task. The instance is only
+// started by the first request and, with an idle timeout, torn down once no
+// request arrived for that long, while the task's listener keeps accepting
+// connections for the next cold start. start creates instances from the
+// compiled module and linker kept by the task, so a cold start only pays for
+// instantiation.
+type serveSupervisor struct {
+	taskID      string
+	start       func() (serveInstance, error)
+	idleTimeout time.Duration
+	logger      hclog.Logger
+
+	lock     sync.Mutex
+	instance serveInstance
+	inflight int
+	closed   bool
+	stats    serveStats
+
+	// idle unloads the instance when it fires, unless a request arrived
+	// since it was armed, which changes generation
+	idle       *time.Timer
+	generation uint64
+
+	// upgrader is set if WebSocket connections are bridged to the guest,
+	// each with an instance of its own held in websockets
+	upgrader   *websocket.Upgrader
+	readLimit  int64
+	websockets map[serveInstance]struct{}
+}
+
+func newServeSupervisor(taskID string, idleTimeout time.Duration, start func() (serveInstance, error), logger hclog.Logger) *serveSupervisor {
+	return &serveSupervisor{
+		taskID:      taskID,
+		start:       start,
+		idleTimeout: idleTimeout,
+		logger:      logger,
+	}
+}
+
+// enableWebSockets bridges the WebSocket connections to the guest,
+// failing messages larger than readLimit unless 0
+func (s *serveSupervisor) enableWebSockets(readLimit int64) {
+	s.upgrader = &websocket.Upgrader{}
+	s.readLimit = readLimit
+	s.websockets = map[serveInstance]struct{}{}
+}
+
+func (s *serveSupervisor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.upgrader != nil && websocket.IsWebSocketUpgrade(r) {
+		s.serveWebSocket(w, r)
+		return
+	}
+
+	instance, cold, err := s.acquire()
+	if cold {
+		markColdStart(r.Context())
+	}
+	if err != nil {
+		s.logger.Error("failed to start instance", "task_id", s.taskID, "error", err)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer s.release()
+	instance.ServeHTTP(w, r)
+}
+
+// acquire returns the running instance, starting one if there's none, and
+// whether it did. Requests arriving during a cold start wait for it to
+// complete.
+func (s *serveSupervisor) acquire() (serveInstance, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil, false, errServeClosed
+	}
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+	s.generation++
+
+	cold := s.instance == nil
+	if cold {
+		if err := s.startInstance(); err != nil {
+			return nil, true, err
+		}
+	}
+
+	s.inflight++
+	return s.instance, cold, nil
+}
+
+// serveWebSocket upgrades the connection and hands it to an instance of
+// its own, so a long-lived connection doesn't hold the instance serving
+// requests. The connection counts as a request in flight until it closes.
+func (s *serveSupervisor) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+	s.generation++
+	s.inflight++
+	s.lock.Unlock()
+	defer s.release()
+
+	markColdStart(r.Context())
+	instance, err := s.start()
+	if err != nil {
+		s.logger.Error("failed to start instance", "task_id", s.taskID, "error", err)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	if !s.trackWebSocket(instance) {
+		instance.Close()
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer s.untrackWebSocket(instance)
+
+	ws, ok := instance.(websocketInstance)
+	if !ok {
+		http.Error(w, "module doesn't handle WebSocket connections", http.StatusNotImplemented)
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader answered the request
+		return
+	}
+	if s.readLimit > 0 {
+		conn.SetReadLimit(s.readLimit)
+	}
+
+	metrics.IncrCounterWithLabels([]string{"wasmtime", "serve", "websocket_connections"}, 1,
+		[]metrics.Label{{Name: "task_id", Value: s.taskID}})
+	if err := ws.ServeWebSocket(conn); err != nil {
+		s.logger.Warn("WebSocket connection failed", "task_id", s.taskID, "error", err)
+	}
+}
+
+// trackWebSocket records the instance of a WebSocket connection, so it's
+// closed along with the supervisor. It returns false if it's closed.
+func (s *serveSupervisor) trackWebSocket(instance serveInstance) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false
+	}
+	s.websockets[instance] = struct{}{}
+	return true
+}
+
+// untrackWebSocket closes the instance of a WebSocket connection, unless
+// the supervisor already did
+func (s *serveSupervisor) untrackWebSocket(instance serveInstance) {
+	s.lock.Lock()
+	_, ok := s.websockets[instance]
+	delete(s.websockets, instance)
+	s.lock.Unlock()
+
+	if ok {
+		instance.Close()
+	}
+}
+
+// startInstance starts the instance, with the lock held
+func (s *serveSupervisor) startInstance() error {
+	start := time.Now()
+	instance, err := s.start()
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+
+	s.instance = instance
+	s.stats.ColdStarts++
+	s.stats.LastColdStart = elapsed
+	s.stats.TotalColdStart += elapsed
+	metrics.IncrCounterWithLabels([]string{"wasmtime", "serve", "cold_starts"}, 1,
+		[]metrics.Label{{Name: "task_id", Value: s.taskID}})
+	metrics.AddSampleWithLabels([]string{"wasmtime", "serve", "cold_start"},
+		float32(elapsed.Milliseconds()), []metrics.Label{{Name: "task_id", Value: s.taskID}})
+	s.logger.Debug("cold started instance", "task_id", s.taskID, "duration", elapsed)
+	return nil
+}
+
+// prewarm starts the instance ahead of the first request. The instance is
+// kept until requests arrive, the idle timeout only applies after them.
+func (s *serveSupervisor) prewarm() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return errServeClosed
+	}
+	if s.instance != nil {
+		return nil
+	}
+	return s.startInstance()
+}
+
+// release ends a request, arming the idle timer if it was the last one
+func (s *serveSupervisor) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.inflight--
+	if s.inflight != 0 || s.idleTimeout == 0 || s.closed {
+		return
+	}
+	generation := s.generation
+	s.idle = time.AfterFunc(s.idleTimeout, func() { s.unload(generation) })
+}
+
+// unload tears down the instance if no request arrived since generation
+func (s *serveSupervisor) unload(generation uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if generation != s.generation || s.inflight != 0 || s.instance == nil {
+		return
+	}
+	if err := s.instance.Close(); err != nil {
+		s.logger.Warn("failed to close idle instance", "task_id", s.taskID, "error", err)
+	}
+	s.instance = nil
+	s.idle = nil
+	s.logger.Debug("unloaded idle instance", "task_id", s.taskID, "idle_timeout", s.idleTimeout)
+}
+
+// inflightRequests returns the number of requests being handled
+func (s *serveSupervisor) inflightRequests() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.inflight
+}
+
+// Stats returns the cold starts so far
+func (s *serveSupervisor) Stats() serveStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stats
+}
+
+// Close tears down the instances and rejects later requests
+func (s *serveSupervisor) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+	for instance := range s.websockets {
+		instance.Close()
+		delete(s.websockets, instance)
+	}
+	if s.instance == nil {
+		return nil
+	}
+	err := s.instance.Close()
+	s.instance = nil
+	return err
+}
+
+// serveServer is the listener of a serve task, handing its requests to the
+// supervisor
+type serveServer struct {
+	addr       string
+	supervisor *serveSupervisor
+	router     *serveRouter
+	logger     hclog.Logger
+
+	server   *http.Server
+	listener net.Listener
+	ready    int32
+
+	limiter *serveLimiter
+
+	// queue is set with serve.max_concurrent_requests
+	queue *serveQueue
+
+	access *accessLog
+}
+
+// newServeServer returns the listener of a serve task at addr, handing the
+// requests under the routes' prefixes to their supervisors and the others
+// to supervisor, and logging them to access unless nil. The requests under
+// the prefixes of static, if set, are served from its directory instead.
+func newServeServer(addr string, supervisor *serveSupervisor, routes []serveRoute, limits serveLimits, static *serveStatic, access *accessLog, logger hclog.Logger) *serveServer {
+	s := &serveServer{
+		addr:       addr,
+		supervisor: supervisor,
+		router:     &serveRouter{fallback: supervisor, routes: routes},
+		logger:     logger,
+		access:     access,
+	}
+	s.limiter = newServeLimiter(supervisor.taskID, limits, s.router)
+	var handler http.Handler = s.limiter
+	if limits.maxConcurrent > 0 {
+		s.queue = newServeQueue(supervisor.taskID, limits, handler)
+		handler = s.queue
+	}
+	// static files take no slot of the queue
+	if static != nil {
+		handler = newStaticFiles(supervisor.taskID, static, handler)
+	}
+	if access != nil {
+		handler = access.handler(handler)
+	}
+	s.server = &http.Server{
+		Handler:        handler,
+		MaxHeaderBytes: limits.maxHeaderBytes,
+	}
+	return s
+}
+
+// useHistory records the requests of the server in history. It must be
+// called before Start.
+func (s *serveServer) useHistory(history *invocationHistory) {
+	s.server.Handler = history.handler(s.server.Handler)
+}
+
+// setLimits changes the limits of the requests received from now on. The
+// queue can be resized but not added or removed, as it wraps the
+// listener's handler.
+func (s *serveServer) setLimits(limits serveLimits) error {
+	if (limits.maxConcurrent > 0) != (s.queue != nil) {
+		return fmt.Errorf("serve max_concurrent_requests can't be set or unset by a reload, only changed")
+	}
+	s.limiter.setLimits(limits)
+	if s.queue != nil {
+		s.queue.setLimits(limits)
+	}
+	return nil
+}
+
+// Start opens the listener. With warm, the instance is started first and
+// the port only accepts connections once it can answer right away: Nomad's
+// checks on the port then keep failing until the new allocation is ready,
+// so an update gated on them stops the old allocation only after that.
+func (s *serveServer) Start(warm bool) error {
+	if warm {
+		start := time.Now()
+		for _, supervisor := range s.router.supervisors() {
+			if err := supervisor.prewarm(); err != nil {
+				return fmt.Errorf("failed to prewarm instance: %v", err)
+			}
+		}
+		s.logger.Info("prewarmed instance", "task_id", s.supervisor.taskID, "duration", time.Since(start))
+	}
+
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", s.addr, err)
+	}
+	s.listener = l
+	atomic.StoreInt32(&s.ready, 1)
+
+	go func() {
+		if err := s.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			s.logger.Error("serve listener failed", "task_id", s.supervisor.taskID, "error", err)
+		}
+	}()
+	return nil
+}
+
+// isReady returns whether the listener accepts connections
+func (s *serveServer) isReady() bool {
+	return s != nil && atomic.LoadInt32(&s.ready) == 1
+}
+
+// Addr returns the address listened on, once started
+func (s *serveServer) Addr() string {
+	if s.listener == nil {
+		return s.addr
+	}
+	return s.listener.Addr().String()
+}
+
+// inflightRequests returns the number of requests being handled by any
+// route
+func (s *serveServer) inflightRequests() int {
+	inflight := 0
+	for _, supervisor := range s.router.supervisors() {
+		inflight += supervisor.inflightRequests()
+	}
+	return inflight
+}
+
+// closeSupervisors closes the instances of every route
+func (s *serveServer) closeSupervisors() error {
+	var err error
+	for _, supervisor := range s.router.supervisors() {
+		if cerr := supervisor.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Close closes the listener and the instances
+func (s *serveServer) Close() error {
+	atomic.StoreInt32(&s.ready, 0)
+	err := s.server.Close()
+	if cerr := s.closeSupervisors(); err == nil {
+		err = cerr
+	}
+	s.access.Close()
+	return err
+}
+
+// Drain stops accepting connections and waits up to timeout for the
+// requests in flight to complete before closing the instances. It returns
+// whether they all completed; those still running at the timeout have their
+// connections closed.
+func (s *serveServer) Drain(timeout time.Duration) (bool, error) {
+	atomic.StoreInt32(&s.ready, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	drained := true
+	err := s.server.Shutdown(ctx)
+	if err == context.DeadlineExceeded {
+		drained = false
+		err = s.server.Close()
+	}
+	if cerr := s.closeSupervisors(); err == nil {
+		err = cerr
+	}
+	s.access.Close()
+	return drained, err
+}
+
+// drainServe drains the listener of a serve task being stopped, with events
+// marking the start and end of the drain
+func (d *Driver) drainServe(h *TaskHandle, timeout time.Duration) error {
+	cfg := h.taskConfig
+	inflight := h.serve.inflightRequests()
+	d.emitServeEvent(cfg, fmt.Sprintf("Draining %d in-flight requests", inflight), map[string]string{
+		"inflight": strconv.Itoa(inflight),
+		"timeout":  timeout.String(),
+	})
+
+	start := time.Now()
+	drained, err := h.serve.Drain(timeout)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if drained {
+		d.emitServeEvent(cfg, fmt.Sprintf("Drain complete after %s", elapsed), map[string]string{
+			"duration": elapsed.String(),
+		})
+	} else {
+		d.emitServeEvent(cfg, fmt.Sprintf("Drain timed out after %s, remaining requests were aborted", elapsed), map[string]string{
+			"duration": elapsed.String(),
+			"aborted":  "true",
+		})
+		metrics.IncrCounterWithLabels([]string{"wasmtime", "serve", "drain_timeouts"}, 1,
+			[]metrics.Label{{Name: "task_id", Value: cfg.ID}})
+	}
+	return err
+}
+
+// emitServeEvent sends an event about the listener of a serve task
+func (d *Driver) emitServeEvent(cfg *drivers.TaskConfig, message string, annotations map[string]string) {
+	err := d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:      cfg.ID,
+		AllocID:     cfg.AllocID,
+		TaskName:    cfg.Name,
+		Timestamp:   time.Now(),
+		Message:     message,
+		Annotations: annotations,
+	})
+	if err != nil {
+		d.logger.Warn("failed to emit serve event", "task_id", cfg.ID, "error", err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// accessLogCommon is the Common Log Format, followed by the latency and
+	// whether the request hit a cold instance
+	accessLogCommon = "common"
+
+	// accessLogJSON logs a JSON object per request
+	accessLogJSON = "json"
+)
+
+// serveRequestKey is the context key of the serveRequest of a request
+type serveRequestKey struct{}
+
+// serveRequest is what the supervisor tells the access log about a request
+type serveRequest struct {
+	// cold is set atomically, as the guest may still be running when a
+	// timed out request is logged
+	cold uint32
+}
+
+// withServeRequest returns the serveRequest of r, along with r carrying it
+// if it had none yet, so the handlers logging r all see the same
+func withServeRequest(r *http.Request) (*serveRequest, *http.Request) {
+	if req, ok := r.Context().Value(serveRequestKey{}).(*serveRequest); ok {
+		return req, r
+	}
+	req := &serveRequest{}
+	return req, r.WithContext(context.WithValue(r.Context(), serveRequestKey{}, req))
+}
+
+// markColdStart records that the request started the instance, if it's
+// logged
+func markColdStart(ctx context.Context) {
+	if req, ok := ctx.Value(serveRequestKey{}).(*serveRequest); ok {
+		atomic.StoreUint32(&req.cold, 1)
+	}
+}
+
+// accessLogPath returns where the access log is written: the file
+// serve.access_log.path, relative to the task dir, or the task's stdout
+func accessLogPath(cfg TaskServeAccessLogConfig, taskDir string, streams *logStreams) (string, error) {
+	if cfg.Path != "" {
+		return resolveArtifactPath(taskDir, cfg.Path), nil
+	}
+	if streams == nil {
+		return "", fmt.Errorf("task has no stdout to write the access log to")
+	}
+	if streams.spooled() {
+		return streams.StdoutSpool, nil
+	}
+	return streams.Stdout, nil
+}
+
+// validateAccessLog checks serve.access_log
+func validateAccessLog(cfg TaskServeAccessLogConfig) error {
+	switch cfg.Format {
+	case "", accessLogCommon, accessLogJSON:
+		return nil
+	}
+	return fmt.Errorf("invalid serve access_log format %q, must be %q or %q", cfg.Format, accessLogCommon, accessLogJSON)
+}
+
+// accessLog writes a line per request of a serve task
+type accessLog struct {
+	format string
+	now    func() time.Time
+
+	lock sync.Mutex
+	w    io.Writer
+	file *os.File
+}
+
+// openAccessLog opens the access log configured by cfg for appending
+func openAccessLog(cfg TaskServeAccessLogConfig, taskDir string, streams *logStreams) (*accessLog, error) {
+	if err := validateAccessLog(cfg); err != nil {
+		return nil, err
+	}
+	path, err := accessLogPath(cfg, taskDir, streams)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create access log dir: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access log: %v", err)
+	}
+
+	format := cfg.Format
+	if format == "" {
+		format = accessLogCommon
+	}
+	return &accessLog{format: format, now: time.Now, w: f, file: f}, nil
+}
+
+// accessEntry is a logged request
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS float64   `json:"duration_ms"`
+	Cold       bool      `json:"cold"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+// line formats e in the log's format
+func (a *accessLog) line(e *accessEntry) []byte {
+	if a.format == accessLogJSON {
+		b, _ := json.Marshal(e)
+		return append(b, '\n')
+	}
+
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+	instance := "warm"
+	if e.Cold {
+		instance = "cold"
+	}
+	return []byte(fmt.Sprintf("%s - - [%s] %q %d %s %.3fms %s\n",
+		e.RemoteAddr, e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method+" "+e.URI+" "+e.Proto,
+		e.Status, bytes, e.DurationMS, instance))
+}
+
+// handler logs the requests handled by next
+func (a *accessLog) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := a.now()
+		req, r := withServeRequest(r)
+		rec := &recordingResponse{ResponseWriter: w}
+
+		// logged even if the response is aborted
+		defer func() {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			status := rec.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			a.write(&accessEntry{
+				Time:       start,
+				RemoteAddr: host,
+				Method:     r.Method,
+				URI:        r.RequestURI,
+				Proto:      r.Proto,
+				Status:     status,
+				Bytes:      rec.written,
+				DurationMS: float64(a.now().Sub(start).Microseconds()) / 1000,
+				Cold:       atomic.LoadUint32(&req.cold) == 1,
+				UserAgent:  r.UserAgent(),
+			})
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+func (a *accessLog) write(e *accessEntry) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.w != nil {
+		a.w.Write(a.line(e))
+	}
+}
+
+// Close closes the log's file
+func (a *accessLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.w = nil
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// recordingResponse records the status and size of a response
+type recordingResponse struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (r *recordingResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Hijack lets WebSocket connections be upgraded
+func (r *recordingResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection can't be hijacked")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (r *recordingResponse) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.written += int64(n)
+	return n, err
+}
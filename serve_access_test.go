@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLogPath(t *testing.T) {
+	path, err := accessLogPath(TaskServeAccessLogConfig{Path: "local/access.log"}, "/task", nil)
+	require.NoError(t, err)
+	require.Equal(t, "/task/local/access.log", path)
+
+	path, err = accessLogPath(TaskServeAccessLogConfig{}, "/task", &logStreams{Stdout: "/fifo", StdoutSpool: "/spool"})
+	require.NoError(t, err)
+	require.Equal(t, "/spool", path)
+	path, err = accessLogPath(TaskServeAccessLogConfig{}, "/task", &logStreams{Stdout: "/raw", Raw: true})
+	require.NoError(t, err)
+	require.Equal(t, "/raw", path)
+
+	require.Error(t, validateAccessLog(TaskServeAccessLogConfig{Format: "apache"}))
+}
+
+func TestServeServer_AccessLog(t *testing.T) {
+	for _, format := range []string{accessLogCommon, accessLogJSON} {
+		dir := t.TempDir()
+		access, err := openAccessLog(TaskServeAccessLogConfig{Format: format, Path: "access.log"}, dir, nil)
+		require.NoError(t, err)
+
+		instance := &fakeInstance{id: 1}
+		supervisor := newServeSupervisor("task", 0, func() (serveInstance, error) { return instance, nil }, hclog.NewNullLogger())
+		server := newServeServer("127.0.0.1:0", supervisor, nil, serveLimits{}, nil, access, hclog.NewNullLogger())
+		require.NoError(t, server.Start(false))
+
+		for i := 0; i < 2; i++ {
+			resp, err := http.Get("http://" + server.Addr() + "/path?q=1")
+			require.NoError(t, err)
+			resp.Body.Close()
+		}
+		require.NoError(t, server.Close())
+
+		b, err := ioutil.ReadFile(filepath.Join(dir, "access.log"))
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		require.Len(t, lines, 2)
+
+		if format == accessLogCommon {
+			common := regexp.MustCompile(`^127\.0\.0\.1 - - \[[^\]]+\] "GET /path\?q=1 HTTP/1\.1" 200 - [0-9.]+ms (cold|warm)$`)
+			require.Regexp(t, common, lines[0])
+			require.True(t, strings.HasSuffix(lines[0], " cold"), lines[0])
+			require.True(t, strings.HasSuffix(lines[1], " warm"), lines[1])
+			continue
+		}
+		var entries [2]accessEntry
+		for i, line := range lines {
+			require.NoError(t, json.Unmarshal([]byte(line), &entries[i]))
+		}
+		require.Equal(t, "GET", entries[0].Method)
+		require.Equal(t, "/path?q=1", entries[0].URI)
+		require.Equal(t, http.StatusOK, entries[0].Status)
+		require.Equal(t, "127.0.0.1", entries[0].RemoteAddr)
+		require.True(t, entries[0].Cold)
+		require.False(t, entries[1].Cold)
+	}
+
+	// the log file isn't created for an invalid format
+	dir := t.TempDir()
+	_, err := openAccessLog(TaskServeAccessLogConfig{Format: "xml", Path: "access.log"}, dir, nil)
+	require.Error(t, err)
+	_, err = os.Stat(filepath.Join(dir, "access.log"))
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/go-hclog"
+)
+
+// guestServeInstance is an instance of a serve task's module, handing the
+// requests to its export through the serve host functions and the
+// WebSocket connections to its websocket export. A store runs one call at a
+// time, so requests wait for the one in flight.
+type guestServeInstance struct {
+	*guestInstance
+	taskID string
+	export string
+	logger hclog.Logger
+
+	serve     *serveHost
+	websocket *websocketHost
+	pauser    *pauser
+
+	// ticks is the epoch deadline of requests, websocketTicks of WebSocket
+	// connections, to which the request limits don't apply
+	ticks          uint64
+	websocketTicks uint64
+
+	// fuel is given back to the guest before each call, 0 if unlimited
+	fuel uint64
+
+	lock   sync.Mutex
+	closed int32
+}
+
+func (i *guestServeInstance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := i.pauser.wait(r.Context()); err != nil {
+		return
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if atomic.LoadInt32(&i.closed) == 1 {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	err := i.serve.serve(w, r, func(handle uint32) error {
+		if err := i.prepareCall(i.ticks); err != nil {
+			return err
+		}
+		_, err := i.call(i.export, int32(handle))
+		return err
+	})
+	if err != nil {
+		i.logger.Warn("guest failed to handle request", "task_id", i.taskID, "export", i.export, "error", err)
+	}
+}
+
+func (i *guestServeInstance) ServeWebSocket(conn websocketConn) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if atomic.LoadInt32(&i.closed) == 1 {
+		conn.Close()
+		return errServeClosed
+	}
+
+	return i.websocket.serve(conn, func(handle uint32) error {
+		if err := i.prepareCall(i.websocketTicks); err != nil {
+			return err
+		}
+		_, err := i.call(websocketExport, int32(handle))
+		return err
+	})
+}
+
+// prepareCall sets the epoch deadline of the next call and refills the
+// guest's fuel, so the fuel limit applies to each call
+func (i *guestServeInstance) prepareCall(ticks uint64) error {
+	i.store.SetEpochDeadline(ticks)
+	if i.fuel == 0 {
+		return nil
+	}
+	remaining, err := i.store.ConsumeFuel(0)
+	if err != nil {
+		return err
+	}
+	if remaining < i.fuel {
+		return i.store.AddFuel(i.fuel - remaining)
+	}
+	return nil
+}
+
+// Close closes the instance's WebSocket connections and releases it once
+// the call in flight, if any, returns. It doesn't wait for that, as a guest
+// without a deadline may never return.
+func (i *guestServeInstance) Close() error {
+	atomic.StoreInt32(&i.closed, 1)
+	i.websocket.Close()
+	go func() {
+		i.lock.Lock()
+		defer i.lock.Unlock()
+		i.guestInstance.Close()
+	}()
+	return nil
+}
+
+// newServeInstance creates an instance of m linked with hosts and the serve
+// host functions, handling requests with export
+func (d *Driver) newServeInstance(h *TaskHandle, m *guestModule, hosts []hostModule, export string, deadlines serveDeadlines) (*guestServeInstance, error) {
+	serve, websocket := newServeHost(), newWebSocketHost()
+	instance, err := m.instantiate(append(hosts, serve, websocket), deadlines.requests)
+	if err != nil {
+		return nil, err
+	}
+	return &guestServeInstance{
+		guestInstance:  instance,
+		taskID:         h.taskConfig.ID,
+		export:         export,
+		logger:         h.logger,
+		serve:          serve,
+		websocket:      websocket,
+		pauser:         h.pauser,
+		ticks:          deadlines.requests,
+		websocketTicks: deadlines.websockets,
+		fuel:           m.limits.fuel,
+	}, nil
+}
+
+// serveDeadlines are the epoch deadlines of the calls of serve instances
+type serveDeadlines struct {
+	requests   uint64
+	websockets uint64
+}
+
+// serveGuest starts the listener of a serve task, whose instances are
+// created from m when needed, each with host modules of its own. hosts are
+// only used to check the imports of the task's modules up front and are
+// closed. The returned guest exits once stopped, or if the listener fails
+// to start.
+func (d *Driver) serveGuest(h *TaskHandle, driverConfig *TaskConfig, m *guestModule, hosts []hostModule) (*guestTask, *serveServer, error) {
+	defer closeHostModules(hosts)
+	cfg := h.taskConfig
+	serveConfig := driverConfig.Serve
+
+	addr, err := serveAddress(cfg, servePortLabel(serveConfig))
+	if err != nil {
+		return nil, nil, err
+	}
+	idleTimeout, err := parseServeIdleTimeout(serveConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	limits, err := parseServeLimits(serveConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	targets, err := parseServeRoutes(serveConfig.Routes)
+	if err != nil {
+		return nil, nil, err
+	}
+	static, err := parseServeStatic(cfg.TaskDir().Dir, serveConfig, driverConfig.WASI.Preopens)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// requests are interrupted at the call deadline or their timeout,
+	// WebSocket connections only at the call deadline
+	deadline := d.callDeadline
+	if limits.requestTimeout > 0 && (deadline == 0 || limits.requestTimeout < deadline) {
+		deadline = limits.requestTimeout
+	}
+	deadlines := serveDeadlines{
+		requests:   d.epochs.ticks(deadline),
+		websockets: d.epochs.ticks(d.callDeadline),
+	}
+
+	checkHosts := append(hosts, newServeHost(), newWebSocketHost())
+	check := func(m *guestModule, export string) error {
+		if _, err := m.link(wasmtime.NewStore(m.engine), checkHosts); err != nil {
+			return err
+		}
+		if !m.exports(export) && !serveConfig.WebSocket {
+			return fmt.Errorf("module doesn't export %q to handle requests", export)
+		}
+		return nil
+	}
+	supervisor := func(m *guestModule, export string) *serveSupervisor {
+		start := func() (serveInstance, error) {
+			d.configLock.RLock()
+			hosts, err := d.newHostModules(cfg, driverConfig)
+			d.configLock.RUnlock()
+			if err != nil {
+				return nil, err
+			}
+			return d.newServeInstance(h, m, hosts, export, deadlines)
+		}
+		s := newServeSupervisor(cfg.ID, idleTimeout, start, h.logger)
+		if serveConfig.WebSocket {
+			s.enableWebSockets(limits.maxRequestBody)
+		}
+		return s
+	}
+
+	if err := check(m, serveExport); err != nil {
+		return nil, nil, err
+	}
+	routes := make([]serveRoute, 0, len(targets))
+	for _, t := range targets {
+		route, export := m, serveExport
+		if t.module != "" {
+			if route, err = routeModule(m, t.module); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			export = t.export
+		}
+		if err := check(route, export); err != nil {
+			return nil, nil, fmt.Errorf("serve route %q: %v", t.prefix, err)
+		}
+		routes = append(routes, serveRoute{prefix: t.prefix, supervisor: supervisor(route, export)})
+	}
+
+	var access *accessLog
+	if serveConfig.AccessLog != nil {
+		if access, err = openAccessLog(*serveConfig.AccessLog, cfg.TaskDir().Dir, h.logStreams); err != nil {
+			return nil, nil, err
+		}
+	}
+	server := newServeServer(addr, supervisor(m, serveExport), routes, limits, static, access, h.logger)
+	server.useHistory(h.history)
+
+	stopTicking := d.epochs.add(m.engine)
+	g := newGuestTask()
+	g.memorySize = func() uint64 { return d.instances.memorySize(cfg.ID) }
+	var once sync.Once
+	shutdown := func(exit guestExit) {
+		once.Do(func() {
+			server.Close()
+			stopTicking()
+			m.closeOutput()
+			g.finish(exit)
+		})
+	}
+	g.interrupt = func() {
+		m.calls.interrupt()
+		shutdown(guestExit{signal: g.stopped()})
+	}
+
+	// prewarming creates host modules, which takes the config lock held by
+	// StartTask
+	go func() {
+		if err := server.Start(serveConfig.Warm); err != nil {
+			h.logger.Error("failed to start serve listener", "task_id", cfg.ID, "error", err)
+			shutdown(guestExit{err: err})
+		}
+	}()
+	return g, server, nil
+}
+
+// routeModule returns the task's module running the module file of a serve
+// route instead, as compiled with its engine by compileRouteModules
+func routeModule(m *guestModule, file string) (*guestModule, error) {
+	module, ok := m.routes[file]
+	if !ok {
+		return nil, fmt.Errorf("serve route module %q wasn't compiled", file)
+	}
+	route := *m
+	route.module = module
+	return &route, nil
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/dustin/go-humanize"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// errRequestBodyTooLarge is returned to guests reading a request body
+	// past serve.max_request_body
+	errRequestBodyTooLarge = errors.New("request body too large")
+
+	// errResponseTooLarge is returned to guests writing a response past
+	// serve.max_response_size
+	errResponseTooLarge = errors.New("response too large")
+
+	// errResponseClosed is returned to guests writing a response after the
+	// request timed out
+	errResponseClosed = errors.New("request timed out")
+)
+
+// serveLimits bound the requests of a serve task. Zero values don't apply.
+type serveLimits struct {
+	maxRequestBody  int64
+	maxResponseSize int64
+	maxHeaderBytes  int
+	requestTimeout  time.Duration
+
+	// maxConcurrent requests are handed to the guest at once, up to
+	// queueSize more wait for up to queueTimeout
+	maxConcurrent int
+	queueSize     int
+	queueTimeout  time.Duration
+}
+
+// parseServeLimits returns the limits of the serve block
+func parseServeLimits(cfg TaskServeConfig) (serveLimits, error) {
+	var limits serveLimits
+	for _, size := range []struct {
+		name  string
+		value string
+		dst   *int64
+	}{
+		{"max_request_body", cfg.MaxRequestBody, &limits.maxRequestBody},
+		{"max_response_size", cfg.MaxResponseSize, &limits.maxResponseSize},
+	} {
+		if size.value == "" {
+			continue
+		}
+		n, err := humanize.ParseBytes(size.value)
+		if err != nil || n == 0 {
+			return serveLimits{}, fmt.Errorf("invalid serve %s %q", size.name, size.value)
+		}
+		*size.dst = int64(n)
+	}
+	if cfg.MaxHeaderSize != "" {
+		n, err := humanize.ParseBytes(cfg.MaxHeaderSize)
+		if err != nil || n == 0 || n > 1<<30 {
+			return serveLimits{}, fmt.Errorf("invalid serve max_header_size %q", cfg.MaxHeaderSize)
+		}
+		limits.maxHeaderBytes = int(n)
+	}
+	if cfg.RequestTimeout != "" {
+		timeout, err := time.ParseDuration(cfg.RequestTimeout)
+		if err != nil || timeout <= 0 {
+			return serveLimits{}, fmt.Errorf("invalid serve request_timeout %q", cfg.RequestTimeout)
+		}
+		limits.requestTimeout = timeout
+	}
+
+	if cfg.MaxConcurrentRequests < 0 {
+		return serveLimits{}, fmt.Errorf("invalid serve max_concurrent_requests %d", cfg.MaxConcurrentRequests)
+	}
+	if cfg.QueueSize < 0 {
+		return serveLimits{}, fmt.Errorf("invalid serve queue_size %d", cfg.QueueSize)
+	}
+	limits.maxConcurrent, limits.queueSize = cfg.MaxConcurrentRequests, cfg.QueueSize
+	if cfg.QueueTimeout != "" {
+		timeout, err := time.ParseDuration(cfg.QueueTimeout)
+		if err != nil || timeout <= 0 {
+			return serveLimits{}, fmt.Errorf("invalid serve queue_timeout %q", cfg.QueueTimeout)
+		}
+		limits.queueTimeout = timeout
+	}
+	if limits.maxConcurrent == 0 && (limits.queueSize != 0 || limits.queueTimeout != 0) {
+		return serveLimits{}, fmt.Errorf("serve queue_size and queue_timeout require max_concurrent_requests")
+	}
+	return limits, nil
+}
+
+// headerSize returns the size of the request line and headers of r, as
+// counted against http.Server.MaxHeaderBytes
+func headerSize(r *http.Request) int {
+	size := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4
+	for name, values := range r.Header {
+		for _, v := range values {
+			size += len(name) + len(v) + 4
+		}
+	}
+	return size
+}
+
+// serveLimiter enforces the limits of a serve task in front of its
+// supervisor. Violations fail the request with 413, 431, 502 or 504, or
+// abort its connection if the response was already sent, and are counted by
+// limit.
+type serveLimiter struct {
+	taskID string
+	next   http.Handler
+
+	// lock guards limits, which serve.reload_file may change
+	lock   sync.RWMutex
+	limits serveLimits
+}
+
+func newServeLimiter(taskID string, limits serveLimits, next http.Handler) *serveLimiter {
+	return &serveLimiter{taskID: taskID, limits: limits, next: next}
+}
+
+// current returns the limits of new requests
+func (l *serveLimiter) current() serveLimits {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.limits
+}
+
+// setLimits changes the limits of the requests received from now on
+func (l *serveLimiter) setLimits(limits serveLimits) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limits = limits
+}
+
+func (l *serveLimiter) violation(limit string) {
+	metrics.IncrCounterWithLabels([]string{"wasmtime", "serve", "limit_violations"}, 1, []metrics.Label{
+		{Name: "task_id", Value: l.taskID},
+		{Name: "limit", Value: limit},
+	})
+}
+
+func (l *serveLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	limits := l.current()
+	if max := limits.maxHeaderBytes; max > 0 && headerSize(r) > max {
+		l.violation("header_size")
+		http.Error(w, http.StatusText(http.StatusRequestHeaderFieldsTooLarge), http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+	if max := limits.maxRequestBody; max > 0 && r.ContentLength > max {
+		l.violation("request_body")
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// the other limits are per request, not per WebSocket connection
+	if websocket.IsWebSocketUpgrade(r) {
+		l.next.ServeHTTP(w, r)
+		return
+	}
+
+	resp := &limitedResponse{w: w, header: http.Header{}, limiter: l, maxSize: limits.maxResponseSize}
+	var body *limitedBody
+	if max := limits.maxRequestBody; max > 0 && r.Body != nil {
+		body = &limitedBody{ReadCloser: r.Body, remaining: max, limiter: l}
+		r.Body = body
+	}
+
+	if limits.requestTimeout == 0 {
+		l.next.ServeHTTP(resp, r)
+		resp.finish(body)
+		return
+	}
+
+	// the guest's context is only cancelled once its response is closed, so
+	// it can't send one past the timeout
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	timer := time.NewTimer(limits.requestTimeout)
+	defer timer.Stop()
+	r = r.WithContext(ctx)
+	done := make(chan interface{}, 1)
+	go func() {
+		defer func() { done <- recover() }()
+		l.next.ServeHTTP(resp, r)
+	}()
+
+	select {
+	case p := <-done:
+		if p != nil {
+			panic(p)
+		}
+		resp.finish(body)
+	case <-ctx.Done():
+		// the client went away
+		resp.close()
+	case <-timer.C:
+		l.violation("request_timeout")
+		resp.timeout()
+	}
+}
+
+// limitedBody fails reads past the maximum request body
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  int32
+	limiter   *serveLimiter
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errRequestBodyTooLarge
+	}
+	// read one byte more than allowed to tell a body of exactly the
+	// maximum size from a larger one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = -1
+		atomic.StoreInt32(&b.exceeded, 1)
+		b.limiter.violation("request_body")
+		return n, errRequestBodyTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// limitedResponse holds back the status of a response until its body is
+// written, so a response exceeding the maximum size or timing out before
+// can still be answered with an error status
+type limitedResponse struct {
+	w       http.ResponseWriter
+	header  http.Header
+	limiter *serveLimiter
+	maxSize int64
+
+	lock    sync.Mutex
+	status  int
+	sent    bool
+	written int64
+	closed  bool
+
+	// aborted is set if the response must be cut short after its status
+	// was sent
+	aborted bool
+}
+
+func (r *limitedResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *limitedResponse) WriteHeader(status int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+// sendLocked sends the held back status, with the lock held
+func (r *limitedResponse) sendLocked() {
+	if r.sent {
+		return
+	}
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	header := r.w.Header()
+	for name, values := range r.header {
+		header[name] = values
+	}
+	r.w.WriteHeader(r.status)
+	r.sent = true
+}
+
+// failLocked answers with status instead of the guest's response, or
+// aborts it if already sent
+func (r *limitedResponse) failLocked(status int) {
+	r.closed = true
+	if r.sent {
+		r.aborted = true
+		return
+	}
+	r.sent = true
+	http.Error(r.w, http.StatusText(status), status)
+}
+
+func (r *limitedResponse) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return 0, errResponseClosed
+	}
+	if max := r.maxSize; max > 0 && r.written+int64(len(p)) > max {
+		r.limiter.violation("response_size")
+		r.failLocked(http.StatusBadGateway)
+		return 0, errResponseTooLarge
+	}
+	r.sendLocked()
+	n, err := r.w.Write(p)
+	r.written += int64(n)
+	return n, err
+}
+
+// finish completes the response once the guest returned. A request body
+// exceeding the maximum fails the request unless the response was sent.
+func (r *limitedResponse) finish(body *limitedBody) {
+	r.lock.Lock()
+	if body != nil && atomic.LoadInt32(&body.exceeded) == 1 && !r.sent {
+		r.failLocked(http.StatusRequestEntityTooLarge)
+	}
+	if !r.closed {
+		r.sendLocked()
+	}
+	r.closed = true
+	aborted := r.aborted
+	r.lock.Unlock()
+
+	if aborted {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// timeout fails the response of a guest still running at the request
+// timeout. Its later writes are discarded.
+func (r *limitedResponse) timeout() {
+	r.lock.Lock()
+	r.failLocked(http.StatusGatewayTimeout)
+	aborted := r.aborted
+	r.lock.Unlock()
+
+	if aborted {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// close discards the later writes of the guest
+func (r *limitedResponse) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+}
+
+// serveQueue hands at most maxConcurrent requests to next at once. Up to
+// queueSize more wait for a slot, for up to queueTimeout, while the others
+// are rejected with 503 rather than piling up in the guest.
+type serveQueue struct {
+	taskID  string
+	waiting int32
+	next    http.Handler
+
+	// lock guards the slots and limits, which serve.reload_file may change
+	lock   sync.Mutex
+	limits serveLimits
+	active int
+
+	// released is closed, and replaced, whenever a slot may have freed up
+	released chan struct{}
+}
+
+func newServeQueue(taskID string, limits serveLimits, next http.Handler) *serveQueue {
+	return &serveQueue{
+		taskID:   taskID,
+		limits:   limits,
+		next:     next,
+		released: make(chan struct{}),
+	}
+}
+
+// setLimits changes the limits of the queue. Requests beyond a lowered
+// maximum complete, but no others are handed to next until they did.
+func (q *serveQueue) setLimits(limits serveLimits) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.limits = limits
+	q.notifyLocked()
+}
+
+// notifyLocked wakes up the requests waiting for a slot, with the lock
+// held
+func (q *serveQueue) notifyLocked() {
+	close(q.released)
+	q.released = make(chan struct{})
+}
+
+// acquire takes a slot if one is free. Otherwise it returns the limits and
+// a channel closed once one may be.
+func (q *serveQueue) acquire() (bool, serveLimits, <-chan struct{}) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.active < q.limits.maxConcurrent {
+		q.active++
+		return true, q.limits, nil
+	}
+	return false, q.limits, q.released
+}
+
+func (q *serveQueue) release() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.active--
+	q.notifyLocked()
+}
+
+func (q *serveQueue) reject(w http.ResponseWriter, reason string) {
+	metrics.IncrCounterWithLabels([]string{"wasmtime", "serve", "rejected"}, 1, []metrics.Label{
+		{Name: "task_id", Value: q.taskID},
+		{Name: "reason", Value: reason},
+	})
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+// wait waits for a slot, returning whether one was taken
+func (q *serveQueue) wait(w http.ResponseWriter, r *http.Request) bool {
+	ok, limits, released := q.acquire()
+	if ok {
+		return true
+	}
+
+	if int(atomic.AddInt32(&q.waiting, 1)) > limits.queueSize {
+		atomic.AddInt32(&q.waiting, -1)
+		q.reject(w, "queue_full")
+		return false
+	}
+	defer atomic.AddInt32(&q.waiting, -1)
+
+	var timeout <-chan time.Time
+	if limits.queueTimeout > 0 {
+		timer := time.NewTimer(limits.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	start := time.Now()
+	for {
+		select {
+		case <-released:
+		case <-timeout:
+			q.reject(w, "queue_timeout")
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+		if ok, _, released = q.acquire(); ok {
+			metrics.AddSampleWithLabels([]string{"wasmtime", "serve", "queue_wait"},
+				float32(time.Since(start).Milliseconds()), []metrics.Label{{Name: "task_id", Value: q.taskID}})
+			return true
+		}
+	}
+}
+
+func (q *serveQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !q.wait(w, r) {
+		return
+	}
+	defer q.release()
+	q.next.ServeHTTP(w, r)
+}
+
+// queued returns the number of requests waiting for a slot
+func (q *serveQueue) queued() int {
+	return int(atomic.LoadInt32(&q.waiting))
+}
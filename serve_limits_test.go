@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseServeLimits(t *testing.T) {
+	limits, err := parseServeLimits(TaskServeConfig{
+		MaxRequestBody:  "1KiB",
+		MaxResponseSize: "2KiB",
+		MaxHeaderSize:   "512B",
+		RequestTimeout:  "5s",
+
+		MaxConcurrentRequests: 4,
+		QueueSize:             8,
+		QueueTimeout:          "1s",
+	})
+	require.NoError(t, err)
+	require.Equal(t, serveLimits{
+		maxRequestBody:  1024,
+		maxResponseSize: 2048,
+		maxHeaderBytes:  512,
+		requestTimeout:  5 * time.Second,
+		maxConcurrent:   4,
+		queueSize:       8,
+		queueTimeout:    time.Second,
+	}, limits)
+
+	limits, err = parseServeLimits(TaskServeConfig{})
+	require.NoError(t, err)
+	require.Equal(t, serveLimits{}, limits)
+
+	for _, cfg := range []TaskServeConfig{
+		{MaxRequestBody: "lots"},
+		{MaxResponseSize: "0"},
+		{MaxHeaderSize: "2GiB"},
+		{RequestTimeout: "-1s"},
+		{MaxConcurrentRequests: -1},
+		{QueueSize: 8},
+	} {
+		_, err := parseServeLimits(cfg)
+		require.Error(t, err, "%+v", cfg)
+	}
+}
+
+func TestServeLimiter(t *testing.T) {
+	limits := serveLimits{
+		maxRequestBody:  8,
+		maxResponseSize: 8,
+		maxHeaderBytes:  1024,
+		requestTimeout:  100 * time.Millisecond,
+	}
+	srv := httptest.NewServer(newServeLimiter("task", limits, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/echo":
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write(body)
+		case "/large":
+			w.Write([]byte("0123456789"))
+		case "/partial":
+			w.Write([]byte("0123"))
+			w.Write([]byte("456789"))
+		case "/slow":
+			<-r.Context().Done()
+			w.Write([]byte("late"))
+		}
+	})))
+	defer srv.Close()
+
+	do := func(method, path, body string, header ...string) (*http.Response, string, error) {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		return resp, string(b), err
+	}
+
+	resp, body, err := do("POST", "/echo", "12345678")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "12345678", body)
+
+	resp, _, err = do("POST", "/echo", "123456789")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// a body without a length is only caught while the guest reads it
+	req, err := http.NewRequest("POST", srv.URL+"/echo", io.MultiReader(strings.NewReader("12345"), strings.NewReader("6789")))
+	require.NoError(t, err)
+	req.ContentLength = -1
+	r, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	r.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, r.StatusCode)
+
+	resp, _, err = do("GET", "/echo", "", "X-Large", strings.Repeat("x", 2048))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+
+	resp, _, err = do("GET", "/large", "")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	// cut short once the status is sent
+	_, _, err = do("GET", "/partial", "")
+	require.Error(t, err)
+
+	start := time.Now()
+	resp, _, err = do("GET", "/slow", "")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestServeQueue(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 4)
+	queue := newServeQueue("task", serveLimits{maxConcurrent: 1, queueSize: 1, queueTimeout: 50 * time.Millisecond},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+		}))
+	srv := httptest.NewServer(queue)
+	defer srv.Close()
+
+	status := make(chan int, 3)
+	get := func() {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}
+
+	// the first request takes the slot, the second waits in the queue and
+	// the third is rejected
+	go get()
+	<-started
+	go get()
+	require.Eventually(t, func() bool { return queue.queued() == 1 }, time.Second, time.Millisecond)
+	go get()
+	require.Equal(t, http.StatusServiceUnavailable, <-status)
+
+	// the queued request times out
+	require.Equal(t, http.StatusServiceUnavailable, <-status)
+	require.Equal(t, 0, queue.queued())
+
+	close(release)
+	require.Equal(t, http.StatusOK, <-status)
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
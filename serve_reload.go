@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// serveReloadFile are the settings of serve.reload_file, usually rendered by
+// a template with change_mode = "signal" and change_signal = "SIGHUP". The
+// settings it sets override those of the task config, the others keep their
+// value from it.
+type serveReloadFile struct {
+	MaxConcurrentRequests *int      `json:"max_concurrent_requests"`
+	QueueSize             *int      `json:"queue_size"`
+	QueueTimeout          *string   `json:"queue_timeout"`
+	RequestTimeout        *string   `json:"request_timeout"`
+	MaxRequestBody        *string   `json:"max_request_body"`
+	MaxResponseSize       *string   `json:"max_response_size"`
+	AllowedHosts          *[]string `json:"allowed_hosts"`
+}
+
+// loadServeReload reads the reload file at path and returns the limits and
+// allowed hosts of the task config with its settings applied
+func loadServeReload(path string, driverConfig *TaskConfig) (serveLimits, []string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return serveLimits{}, nil, fmt.Errorf("failed to read serve reload file: %v", err)
+	}
+	var file serveReloadFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return serveLimits{}, nil, fmt.Errorf("invalid serve reload file: %v", err)
+	}
+
+	cfg := driverConfig.Serve
+	if file.MaxConcurrentRequests != nil {
+		cfg.MaxConcurrentRequests = *file.MaxConcurrentRequests
+	}
+	if file.QueueSize != nil {
+		cfg.QueueSize = *file.QueueSize
+	}
+	for _, s := range []struct {
+		value *string
+		dst   *string
+	}{
+		{file.QueueTimeout, &cfg.QueueTimeout},
+		{file.RequestTimeout, &cfg.RequestTimeout},
+		{file.MaxRequestBody, &cfg.MaxRequestBody},
+		{file.MaxResponseSize, &cfg.MaxResponseSize},
+	} {
+		if s.value != nil {
+			*s.dst = *s.value
+		}
+	}
+	limits, err := parseServeLimits(cfg)
+	if err != nil {
+		return serveLimits{}, nil, err
+	}
+
+	hosts := driverConfig.HTTP.AllowedHosts
+	if file.AllowedHosts != nil {
+		// the http host is only linked for tasks allowing hosts from the
+		// start
+		if len(hosts) == 0 && !driverConfig.HTTP.TaskAPI {
+			return serveLimits{}, nil, fmt.Errorf("allowed_hosts can only be reloaded for tasks with an http block")
+		}
+		hosts = *file.AllowedHosts
+	}
+	return limits, hosts, nil
+}
+
+// reloadServe applies the settings of serve.reload_file to a running serve
+// task, without restarting its listener or instances
+func (d *Driver) reloadServe(h *TaskHandle, driverConfig *TaskConfig) error {
+	path := resolveArtifactPath(h.taskConfig.TaskDir().Dir, driverConfig.Serve.ReloadFile)
+	limits, hosts, err := loadServeReload(path, driverConfig)
+	if err != nil {
+		return err
+	}
+	if err := h.serve.setLimits(limits); err != nil {
+		return err
+	}
+	d.allowlists.get(h.taskConfig.ID, hosts).set(hosts)
+	h.logger.Info("reloaded serve settings", "task_id", h.taskConfig.ID, "path", driverConfig.Serve.ReloadFile)
+	return nil
+}
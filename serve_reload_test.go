@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadServeReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "serve.json")
+	driverConfig := &TaskConfig{
+		Serve: TaskServeConfig{MaxConcurrentRequests: 4, QueueSize: 8, RequestTimeout: "10s"},
+		HTTP:  TaskHTTPConfig{AllowedHosts: []string{"api.example.com"}},
+	}
+	load := func(content string) (serveLimits, []string, error) {
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+		return loadServeReload(path, driverConfig)
+	}
+
+	// unset settings keep their value from the task config
+	limits, hosts, err := load(`{"max_concurrent_requests": 16, "request_timeout": "1m"}`)
+	require.NoError(t, err)
+	require.Equal(t, serveLimits{maxConcurrent: 16, queueSize: 8, requestTimeout: time.Minute}, limits)
+	require.Equal(t, []string{"api.example.com"}, hosts)
+
+	limits, hosts, err = load(`{"allowed_hosts": ["*.internal"], "queue_timeout": "1s", "max_request_body": "1KiB"}`)
+	require.NoError(t, err)
+	require.Equal(t, serveLimits{maxConcurrent: 4, queueSize: 8, queueTimeout: time.Second, requestTimeout: 10 * time.Second, maxRequestBody: 1024}, limits)
+	require.Equal(t, []string{"*.internal"}, hosts)
+
+	for _, content := range []string{
+		`{"max_concurrent_requests": "many"}`,
+		`{"request_timeout": "soon"}`,
+		`{"max_header_size": "1KiB"}`,
+		`not json`,
+	} {
+		_, _, err := load(content)
+		require.Error(t, err, content)
+	}
+
+	driverConfig.HTTP = TaskHTTPConfig{}
+	_, _, err = load(`{"allowed_hosts": ["api.example.com"]}`)
+	require.Error(t, err)
+
+	_, _, err = loadServeReload(filepath.Join(t.TempDir(), "missing.json"), driverConfig)
+	require.Error(t, err)
+}
+
+func TestServeServer_SetLimits(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	supervisor := newServeSupervisor("task", 0, func() (serveInstance, error) {
+		return &slowInstance{started: started, release: release}, nil
+	}, hclog.NewNullLogger())
+	server := newServeServer("127.0.0.1:0", supervisor, nil, serveLimits{maxConcurrent: 1, queueSize: 1}, nil, nil, hclog.NewNullLogger())
+	require.NoError(t, server.Start(false))
+	defer server.Close()
+
+	status := make(chan int, 2)
+	get := func() {
+		resp, err := http.Get("http://" + server.Addr() + "/")
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}
+	go get()
+	<-started
+	go get()
+	require.Eventually(t, func() bool { return server.queue.queued() == 1 }, time.Second, time.Millisecond)
+
+	// raising the maximum lets the queued request in
+	require.NoError(t, server.setLimits(serveLimits{maxConcurrent: 2, queueSize: 1}))
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("queued request wasn't handled")
+	}
+	require.Equal(t, 0, server.queue.queued())
+	close(release)
+	require.Equal(t, http.StatusNoContent, <-status)
+	require.Equal(t, http.StatusNoContent, <-status)
+
+	// the queue can't be removed
+	require.Error(t, server.setLimits(serveLimits{}))
+}
+
+func TestDriver_SignalTask_ReloadServe(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := &drivers.TaskConfig{ID: "id", AllocID: "alloc", Name: "task", AllocDir: t.TempDir()}
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{
+		Serve: TaskServeConfig{Port: "http", RequestTimeout: "10s", ReloadFile: "local/serve.json"},
+		HTTP:  TaskHTTPConfig{AllowedHosts: []string{"api.example.com"}},
+	}))
+	path := filepath.Join(cfg.TaskDir().Dir, "local", "serve.json")
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"request_timeout": "1s", "allowed_hosts": ["*.internal"]}`), 0644))
+
+	supervisor := newServeSupervisor(cfg.ID, 0, func() (serveInstance, error) { return &fakeInstance{}, nil }, hclog.NewNullLogger())
+	server := newServeServer("127.0.0.1:0", supervisor, nil, serveLimits{requestTimeout: 10 * time.Second}, nil, nil, hclog.NewNullLogger())
+	d.tasks.Set(cfg.ID, &TaskHandle{taskConfig: cfg, serve: server, logger: hclog.NewNullLogger()})
+	allowlist := d.allowlists.get(cfg.ID, []string{"api.example.com"})
+
+	require.NoError(t, d.SignalTask(cfg.ID, "SIGHUP"))
+	require.Equal(t, time.Second, server.limiter.current().requestTimeout)
+	require.True(t, allowlist.allowed("db.internal"))
+	require.False(t, allowlist.allowed("api.example.com"))
+
+	// a broken file keeps the settings in place
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"request_timeout": "never"}`), 0644))
+	require.Error(t, d.SignalTask(cfg.ID, "SIGHUP"))
+	require.Equal(t, time.Second, server.limiter.current().requestTimeout)
+}
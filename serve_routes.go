@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// serveRouteTarget is what a prefix of serve.routes is dispatched to: a
+// module of its own, relative to the task dir, or an export of the task's
+// module handling the requests instead of the default entrypoint
+type serveRouteTarget struct {
+	prefix string
+	module string
+	export string
+}
+
+// parseServeRoutes returns the targets of serve.routes, longest prefix
+// first. Targets ending in .wasm are modules, others name exports.
+func parseServeRoutes(routes map[string]string) ([]serveRouteTarget, error) {
+	targets := make([]serveRouteTarget, 0, len(routes))
+	for prefix, target := range routes {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("serve route %q must start with /", prefix)
+		}
+		if target == "" {
+			return nil, fmt.Errorf("serve route %q has no target", prefix)
+		}
+		t := serveRouteTarget{prefix: strings.TrimSuffix(prefix, "/")}
+		if strings.HasSuffix(target, ".wasm") {
+			t.module = target
+		} else {
+			t.export = target
+		}
+		targets = append(targets, t)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if len(targets[i].prefix) != len(targets[j].prefix) {
+			return len(targets[i].prefix) > len(targets[j].prefix)
+		}
+		return targets[i].prefix < targets[j].prefix
+	})
+	return targets, nil
+}
+
+// matchesPrefix reports whether path is prefix or below it, so "/api"
+// matches "/api/users" but not "/apis"
+func matchesPrefix(path, prefix string) bool {
+	if prefix == "" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// serveRoute hands the requests under prefix to the instances of its own
+// supervisor
+type serveRoute struct {
+	prefix     string
+	supervisor *serveSupervisor
+}
+
+// serveRouter dispatches requests to the supervisor of the longest
+// matching route, or to the task's own. Paths reach the guest unchanged.
+type serveRouter struct {
+	fallback *serveSupervisor
+	routes   []serveRoute
+}
+
+// route returns the supervisor handling path
+func (r *serveRouter) route(path string) *serveSupervisor {
+	for _, route := range r.routes {
+		if matchesPrefix(path, route.prefix) {
+			return route.supervisor
+		}
+	}
+	return r.fallback
+}
+
+func (r *serveRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.route(req.URL.Path).ServeHTTP(w, req)
+}
+
+// supervisors returns the task's supervisor followed by those of the
+// routes
+func (r *serveRouter) supervisors() []*serveSupervisor {
+	supervisors := []*serveSupervisor{r.fallback}
+	for _, route := range r.routes {
+		supervisors = append(supervisors, route.supervisor)
+	}
+	return supervisors
+}
+
+// readRouteModules returns the module files of the serve routes of
+// driverConfig, read from the task dir and held to the checks of the task's
+// module, along with features extended with the proposals they require. As
+// they're compiled with the task's engine, they can't be precompiled.
+func readRouteModules(cfg *drivers.TaskConfig, driverConfig *TaskConfig, config *Config, features []string, maxSize int64) (map[string][]byte, []string, error) {
+	targets, err := parseServeRoutes(driverConfig.Serve.Routes)
+	if err != nil {
+		return nil, nil, err
+	}
+	routes := map[string][]byte{}
+	enabled := map[string]bool{}
+	for _, f := range features {
+		enabled[f] = true
+	}
+	for _, t := range targets {
+		if t.module == "" || routes[t.module] != nil {
+			continue
+		}
+		wasm, err := readArtifact(resolveArtifactPath(cfg.TaskDir().Dir, t.module), maxSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isPrecompiledModule(wasm) {
+			return nil, nil, fmt.Errorf("serve route module %q is precompiled, route modules must be compiled with the task's", t.module)
+		}
+		if err := validateModule(wasm); err != nil {
+			return nil, nil, fmt.Errorf("invalid module %q: %v", t.module, err)
+		}
+		if config.StrictImports {
+			if err := checkStrictImports(wasm, config.AllowedImports); err != nil {
+				return nil, nil, fmt.Errorf("serve route module %q: %v", t.module, err)
+			}
+		}
+		required, err := taskFeatures(config.Compiler, wasm)
+		if err != nil {
+			return nil, nil, fmt.Errorf("serve route module %q: %v", t.module, err)
+		}
+		for _, f := range required {
+			enabled[f] = true
+		}
+		routes[t.module] = wasm
+	}
+
+	features = make([]string, 0, len(enabled))
+	for f := range enabled {
+		features = append(features, f)
+	}
+	sort.Strings(features)
+	return routes, features, nil
+}
+
+// compileRouteModules compiles the route modules with the task's engine,
+// capped at its limits like its own module and shared through modules, and
+// adds their code size to diag
+func compileRouteModules(modules *moduleCache, taskID, key string, engine *wasmtime.Engine, routes map[string][]byte, limits *taskLimits, diag *compileDiagnostics) (map[string]*wasmtime.Module, error) {
+	compiled := make(map[string]*wasmtime.Module, len(routes))
+	for file, wasm := range routes {
+		routeDiag := &compileDiagnostics{}
+		module, err := compileWithEngine(modules, routeUser(taskID, file), key, engine, wasm, nil, limits, routeDiag)
+		if err != nil {
+			return nil, fmt.Errorf("serve route module %q: %v", file, err)
+		}
+		compiled[file] = module
+		diag.CodeSize += routeDiag.CodeSize
+	}
+	return compiled, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseServeRoutes(t *testing.T) {
+	targets, err := parseServeRoutes(map[string]string{
+		"/api":       "api.wasm",
+		"/api/v2/":   "local/v2.wasm",
+		"/admin":     "handle_admin",
+		"/":          "handle_root",
+		"/api/users": "users.wasm",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []serveRouteTarget{
+		{prefix: "/api/users", module: "users.wasm"},
+		{prefix: "/api/v2", module: "local/v2.wasm"},
+		{prefix: "/admin", export: "handle_admin"},
+		{prefix: "/api", module: "api.wasm"},
+		{prefix: "", export: "handle_root"},
+	}, targets)
+
+	_, err = parseServeRoutes(map[string]string{"api": "api.wasm"})
+	require.Error(t, err)
+	_, err = parseServeRoutes(map[string]string{"/api": ""})
+	require.Error(t, err)
+
+	require.True(t, matchesPrefix("/api", "/api"))
+	require.True(t, matchesPrefix("/api/users", "/api"))
+	require.False(t, matchesPrefix("/apis", "/api"))
+	require.True(t, matchesPrefix("/anything", ""))
+}
+
+func TestServeServer_Routes(t *testing.T) {
+	supervisor := func(id int) *serveSupervisor {
+		instance := &fakeInstance{id: id}
+		return newServeSupervisor("task", 0, func() (serveInstance, error) { return instance, nil }, hclog.NewNullLogger())
+	}
+	routes := []serveRoute{
+		{prefix: "/api/v2", supervisor: supervisor(3)},
+		{prefix: "/api", supervisor: supervisor(2)},
+	}
+	server := newServeServer("127.0.0.1:0", supervisor(1), routes, serveLimits{}, nil, nil, hclog.NewNullLogger())
+	require.NoError(t, server.Start(true))
+	defer server.Close()
+
+	// every route is prewarmed
+	for _, s := range server.router.supervisors() {
+		require.Equal(t, uint64(1), s.Stats().ColdStarts)
+	}
+
+	for path, instance := range map[string]string{
+		"/":            "1",
+		"/apis":        "1",
+		"/api":         "2",
+		"/api/users":   "2",
+		"/api/v2/user": "3",
+	} {
+		resp, err := http.Get("http://" + server.Addr() + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, instance, resp.Header.Get("X-Instance"), path)
+	}
+	require.Equal(t, 0, server.inflightRequests())
+}
+
+func TestReadRouteModules(t *testing.T) {
+	api, err := wasmtime.Wat2Wasm(`(module (func (export "handle")))`)
+	require.NoError(t, err)
+	evil, err := wasmtime.Wat2Wasm(`(module (import "env" "evil" (func)))`)
+	require.NoError(t, err)
+	cfg := newTestTask(t, api)
+	dir := cfg.TaskDir().Dir
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "api.wasm"), api, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "evil.wasm"), evil, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "app.wasm"), append([]byte("\x7fELF"), api...), 0644))
+
+	config := &Config{StrictImports: true, AllowedImports: []string{"wasi_snapshot_preview1.*"}}
+	driverConfig := &TaskConfig{Serve: TaskServeConfig{Routes: map[string]string{"/api": "api.wasm", "/": "handle"}}}
+	routes, features, err := readRouteModules(cfg, driverConfig, config, []string{"simd"}, 1<<20)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"api.wasm": api}, routes)
+	require.Equal(t, []string{"simd"}, features)
+
+	// route modules are held to the strict imports of the task's
+	driverConfig.Serve.Routes["/evil"] = "evil.wasm"
+	_, _, err = readRouteModules(cfg, driverConfig, config, nil, 1<<20)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "evil.wasm")
+
+	driverConfig.Serve.Routes = map[string]string{"/app": "app.wasm"}
+	_, _, err = readRouteModules(cfg, driverConfig, config, nil, 1<<20)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "precompiled")
+}
+
+func TestCompileRouteModules(t *testing.T) {
+	api, err := wasmtime.Wat2Wasm(`(module (memory (export "memory") 1))`)
+	require.NoError(t, err)
+	tables, err := wasmtime.Wat2Wasm(`(module (table 1 funcref) (table 1 funcref))`)
+	require.NoError(t, err)
+	engine := wasmtime.NewEngine()
+	modules := newModuleCache()
+
+	// the limits of the task's module cap its route modules
+	diag := &compileDiagnostics{CodeSize: 1}
+	routes, err := compileRouteModules(modules, "id", "key", engine, map[string][]byte{"api.wasm": api}, &taskLimits{memory: 2 * wasmPageSize}, diag)
+	require.NoError(t, err)
+	memory := routes["api.wasm"].Exports()[0].Type().MemoryType()
+	present, max := memory.Maximum()
+	require.True(t, present)
+	require.Equal(t, uint64(2), max)
+	require.Greater(t, diag.CodeSize, int64(1))
+
+	_, err = compileRouteModules(modules, "id", "key", engine, map[string][]byte{"tables.wasm": tables}, &taskLimits{tables: 1}, &compileDiagnostics{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "tables.wasm")
+
+	// releasing the task releases its route modules
+	modules.Release("id")
+	require.Empty(t, modules.tasks)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// serveStatic is the directory, and the prefixes, of serve.static_dir
+type serveStatic struct {
+	root     string
+	prefixes []string
+}
+
+// parseServeStatic returns the static files of serve.static_dir, the guest
+// path of one of the task's preopens, or nil if it's unset
+func parseServeStatic(taskDir string, cfg TaskServeConfig, preopens map[string]string) (*serveStatic, error) {
+	if cfg.StaticDir == "" {
+		if len(cfg.StaticPrefixes) > 0 {
+			return nil, fmt.Errorf("serve.static_prefixes requires serve.static_dir")
+		}
+		return nil, nil
+	}
+	host, ok := preopens[cfg.StaticDir]
+	if !ok {
+		return nil, fmt.Errorf("serve.static_dir %q isn't the guest path of a preopen", cfg.StaticDir)
+	}
+	if len(cfg.StaticPrefixes) == 0 {
+		return nil, fmt.Errorf("serve.static_dir requires serve.static_prefixes")
+	}
+
+	static := &serveStatic{root: filepath.Join(taskDir, filepath.Clean(host))}
+	for _, prefix := range cfg.StaticPrefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("serve static prefix %q must start with /", prefix)
+		}
+		static.prefixes = append(static.prefixes, strings.TrimSuffix(prefix, "/"))
+	}
+	return static, nil
+}
+
+// staticFiles serves the requests under the prefixes of static from its
+// directory, without involving the guest, and the others with next
+type staticFiles struct {
+	taskID string
+	static *serveStatic
+	files  http.Handler
+	next   http.Handler
+}
+
+func newStaticFiles(taskID string, static *serveStatic, next http.Handler) *staticFiles {
+	return &staticFiles{
+		taskID: taskID,
+		static: static,
+		files:  http.FileServer(staticFS{static.root}),
+		next:   next,
+	}
+}
+
+func (s *staticFiles) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, prefix := range s.static.prefixes {
+		if matchesPrefix(r.URL.Path, prefix) {
+			metrics.IncrCounterWithLabels([]string{"wasmtime", "serve", "static_requests"}, 1, []metrics.Label{
+				{Name: "task_id", Value: s.taskID},
+			})
+			s.files.ServeHTTP(w, r)
+			return
+		}
+	}
+	s.next.ServeHTTP(w, r)
+}
+
+// staticFS opens the files below root. The guest may write to the preopen,
+// so symlinks are only followed as long as they stay below root, and
+// directories are only served through their index.html, never listed.
+type staticFS struct {
+	root string
+}
+
+func (fs staticFS) Open(name string) (http.File, error) {
+	host := filepath.Join(fs.root, filepath.FromSlash(path.Clean("/"+name)))
+	resolved, err := filepath.EvalSymlinks(host)
+	if err != nil {
+		return nil, err
+	}
+	root, err := filepath.EvalSymlinks(fs.root)
+	if err != nil {
+		return nil, err
+	}
+	if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return nil, os.ErrNotExist
+	}
+
+	f, err := os.Open(resolved)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		index, err := fs.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
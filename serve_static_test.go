@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseServeStatic(t *testing.T) {
+	preopens := map[string]string{"/public": "local/public"}
+	static, err := parseServeStatic("/task", TaskServeConfig{
+		StaticDir:      "/public",
+		StaticPrefixes: []string{"/assets/", "/index.html"},
+	}, preopens)
+	require.NoError(t, err)
+	require.Equal(t, &serveStatic{
+		root:     "/task/local/public",
+		prefixes: []string{"/assets", "/index.html"},
+	}, static)
+
+	static, err = parseServeStatic("/task", TaskServeConfig{}, preopens)
+	require.NoError(t, err)
+	require.Nil(t, static)
+
+	for _, cfg := range []TaskServeConfig{
+		{StaticDir: "/other", StaticPrefixes: []string{"/"}},
+		{StaticDir: "/public"},
+		{StaticDir: "/public", StaticPrefixes: []string{"assets"}},
+		{StaticPrefixes: []string{"/"}},
+	} {
+		_, err := parseServeStatic("/task", cfg, preopens)
+		require.Error(t, err, "%+v", cfg)
+	}
+}
+
+func TestStaticFiles(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "assets", "empty"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "assets", "app.js"), []byte("app"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "assets", "index.html"), []byte("index"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "assets", "secret")))
+	require.NoError(t, os.Symlink("app.js", filepath.Join(root, "assets", "alias.js")))
+
+	guest := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("guest"))
+	})
+	handler := newStaticFiles("task", &serveStatic{root: root, prefixes: []string{"/assets"}}, guest)
+
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, body := get("/assets/app.js")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "app", body)
+	_, body = get("/assets/alias.js")
+	require.Equal(t, "app", body)
+	_, body = get("/assets/")
+	require.Equal(t, "index", body)
+
+	// the guest doesn't see the misses under the prefixes
+	code, _ = get("/assets/missing.js")
+	require.Equal(t, http.StatusNotFound, code)
+
+	// symlinks can't escape the directory, which are never listed
+	code, _ = get("/assets/secret")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = get("/assets/empty/")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = get("/assets/../../" + filepath.Base(outside) + "/secret")
+	require.Equal(t, http.StatusNotFound, code)
+
+	_, body = get("/api/users")
+	require.Equal(t, "guest", body)
+	_, body = get("/assetsx")
+	require.Equal(t, "guest", body)
+}
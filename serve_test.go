@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeInstance answers every request with its number
+type fakeInstance struct {
+	id     int
+	lock   sync.Mutex
+	closed bool
+}
+
+func (f *fakeInstance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Instance", string(rune('0'+f.id)))
+}
+
+func (f *fakeInstance) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *fakeInstance) isClosed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.closed
+}
+
+func TestServeAddress(t *testing.T) {
+	cfg := &drivers.TaskConfig{Env: map[string]string{"NOMAD_ADDR_my_http": "10.0.0.1:8080"}}
+
+	addr, err := serveAddress(cfg, "my-http")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1:8080", addr)
+
+	_, err = serveAddress(cfg, "grpc")
+	require.Error(t, err)
+}
+
+func TestServeNetwork(t *testing.T) {
+	cfg := &drivers.TaskConfig{Env: map[string]string{"NOMAD_ADDR_http": "10.0.0.1:8080"}}
+
+	network, err := serveNetwork(cfg, "http")
+	require.NoError(t, err)
+	require.Equal(t, &drivers.DriverNetwork{PortMap: map[string]int{"http": 8080}, IP: "10.0.0.1", AutoAdvertise: true}, network)
+
+	_, err = serveNetwork(cfg, "grpc")
+	require.Error(t, err)
+
+	require.Equal(t, "http", servePortLabel(TaskServeConfig{Port: "http"}))
+	require.Equal(t, "web", servePortLabel(TaskServeConfig{PortLabel: "web"}))
+	require.NoError(t, validateServePort(TaskServeConfig{PortLabel: "http", Port: "http"}))
+	require.Error(t, validateServePort(TaskServeConfig{PortLabel: "http", Port: "web"}))
+}
+
+func TestParseServeIdleTimeout(t *testing.T) {
+	timeout, err := parseServeIdleTimeout(TaskServeConfig{})
+	require.NoError(t, err)
+	require.Zero(t, timeout)
+
+	timeout, err = parseServeIdleTimeout(TaskServeConfig{IdleTimeout: "5m"})
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Minute, timeout)
+
+	for _, v := range []string{"soon", "-1s"} {
+		_, err := parseServeIdleTimeout(TaskServeConfig{IdleTimeout: v})
+		require.Error(t, err, v)
+	}
+}
+
+func TestServeSupervisor_IdleUnload(t *testing.T) {
+	var lock sync.Mutex
+	var instances []*fakeInstance
+	start := func() (serveInstance, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		i := &fakeInstance{id: len(instances) + 1}
+		instances = append(instances, i)
+		return i, nil
+	}
+
+	s := newServeSupervisor("task", 50*time.Millisecond, start, hclog.NewNullLogger())
+	serve := func() string {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Header().Get("X-Instance")
+	}
+
+	// nothing runs until the first request
+	require.Zero(t, s.Stats().ColdStarts)
+	require.Equal(t, "1", serve())
+	require.Equal(t, "1", serve())
+	require.EqualValues(t, 1, s.Stats().ColdStarts)
+
+	require.Eventually(t, instances[0].isClosed, time.Second, 10*time.Millisecond)
+
+	// the next request cold starts a new instance
+	require.Equal(t, "2", serve())
+	stats := s.Stats()
+	require.EqualValues(t, 2, stats.ColdStarts)
+	require.GreaterOrEqual(t, stats.TotalColdStart, stats.LastColdStart)
+
+	require.NoError(t, s.Close())
+	require.True(t, instances[1].isClosed())
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestServeSupervisor_NoIdleTimeout(t *testing.T) {
+	instance := &fakeInstance{id: 1}
+	s := newServeSupervisor("task", 0, func() (serveInstance, error) { return instance, nil }, hclog.NewNullLogger())
+	defer s.Close()
+
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	time.Sleep(50 * time.Millisecond)
+	require.False(t, instance.isClosed())
+}
+
+func TestServeSupervisor_StartFailure(t *testing.T) {
+	fail := true
+	s := newServeSupervisor("task", 0, func() (serveInstance, error) {
+		if fail {
+			return nil, errors.New("boom")
+		}
+		return &fakeInstance{id: 1}, nil
+	}, hclog.NewNullLogger())
+	defer s.Close()
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Zero(t, s.Stats().ColdStarts)
+
+	// failed cold starts are retried by the next request
+	fail = false
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, "1", w.Header().Get("X-Instance"))
+}
+
+func TestServeSupervisor_Prewarm(t *testing.T) {
+	instance := &fakeInstance{id: 1}
+	s := newServeSupervisor("task", 20*time.Millisecond, func() (serveInstance, error) { return instance, nil }, hclog.NewNullLogger())
+
+	require.NoError(t, s.prewarm())
+	require.EqualValues(t, 1, s.Stats().ColdStarts)
+
+	// the prewarmed instance waits for requests past the idle timeout
+	time.Sleep(50 * time.Millisecond)
+	require.False(t, instance.isClosed())
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, "1", w.Header().Get("X-Instance"))
+	require.EqualValues(t, 1, s.Stats().ColdStarts)
+	require.Eventually(t, instance.isClosed, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, s.Close())
+	require.Equal(t, errServeClosed, s.prewarm())
+}
+
+func TestServeServer(t *testing.T) {
+	instance := &fakeInstance{id: 1}
+	var started int
+	supervisor := newServeSupervisor("task", 0, func() (serveInstance, error) {
+		started++
+		return instance, nil
+	}, hclog.NewNullLogger())
+
+	server := newServeServer("127.0.0.1:0", supervisor, nil, serveLimits{}, nil, nil, hclog.NewNullLogger())
+	require.False(t, server.isReady())
+	require.NoError(t, server.Start(true))
+	require.True(t, server.isReady())
+	require.Equal(t, 1, started)
+
+	resp, err := http.Get("http://" + server.Addr() + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "1", resp.Header.Get("X-Instance"))
+	require.Equal(t, 1, started)
+
+	require.NoError(t, server.Close())
+	require.False(t, server.isReady())
+	require.True(t, instance.isClosed())
+	_, err = http.Get("http://" + server.Addr() + "/")
+	require.Error(t, err)
+
+	// a failed prewarm doesn't open the port
+	supervisor = newServeSupervisor("task", 0, func() (serveInstance, error) {
+		return nil, errors.New("boom")
+	}, hclog.NewNullLogger())
+	server = newServeServer("127.0.0.1:0", supervisor, nil, serveLimits{}, nil, nil, hclog.NewNullLogger())
+	require.Error(t, server.Start(true))
+	require.False(t, server.isReady())
+}
+
+// slowInstance answers requests once release is closed
+type slowInstance struct {
+	fakeInstance
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowInstance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.started <- struct{}{}
+	select {
+	case <-s.release:
+	case <-r.Context().Done():
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestDriver_StopTaskDrainsServe(t *testing.T) {
+	for _, complete := range []bool{true, false} {
+		d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+		instance := &slowInstance{started: make(chan struct{}), release: make(chan struct{})}
+		supervisor := newServeSupervisor("id", 0, func() (serveInstance, error) { return instance, nil }, hclog.NewNullLogger())
+		server := newServeServer("127.0.0.1:0", supervisor, nil, serveLimits{}, nil, nil, hclog.NewNullLogger())
+		require.NoError(t, server.Start(false))
+
+		cfg := &drivers.TaskConfig{ID: "id", AllocID: "alloc", Name: "task"}
+		h := &TaskHandle{taskConfig: cfg, serve: server}
+		d.tasks.Set(cfg.ID, h)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		events, err := d.TaskEvents(ctx)
+		require.NoError(t, err)
+
+		status := make(chan int, 1)
+		go func() {
+			resp, err := http.Get("http://" + server.Addr() + "/")
+			if err != nil {
+				status <- 0
+				return
+			}
+			resp.Body.Close()
+			status <- resp.StatusCode
+		}()
+		<-instance.started
+
+		if complete {
+			time.AfterFunc(50*time.Millisecond, func() { close(instance.release) })
+		}
+		stopped := make(chan error, 1)
+		go func() { stopped <- d.StopTask(cfg.ID, 500*time.Millisecond, "SIGTERM") }()
+
+		e := <-events
+		require.Equal(t, "Draining 1 in-flight requests", e.Message)
+		e = <-events
+		require.NoError(t, <-stopped)
+		require.False(t, server.isReady())
+		require.True(t, instance.isClosed())
+		if complete {
+			require.Contains(t, e.Message, "Drain complete after")
+			require.Equal(t, http.StatusNoContent, <-status)
+		} else {
+			require.Contains(t, e.Message, "Drain timed out after")
+			require.Equal(t, "true", e.Annotations["aborted"])
+			require.Zero(t, <-status)
+		}
+		cancel()
+	}
+}
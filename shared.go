@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+)
+
+// sharedCloser closes what SetConfig replaced and tasks still use, such as
+// keyvalue backends and audit logs, once the last task is done with it
+type sharedCloser struct {
+	lock  sync.Mutex
+	users int
+
+	// close is set once the resource was replaced
+	close func()
+}
+
+// acquire records a user of the resource until the returned func is called.
+// A nil sharedCloser tracks nothing.
+func (s *sharedCloser) acquire() func() {
+	if s == nil {
+		return func() {}
+	}
+	s.lock.Lock()
+	s.users++
+	s.lock.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.lock.Lock()
+			s.users--
+			close := s.close
+			if s.users != 0 {
+				close = nil
+			}
+			s.lock.Unlock()
+			if close != nil {
+				close()
+			}
+		})
+	}
+}
+
+// retire calls close once the resource has no users, which may be now
+func (s *sharedCloser) retire(close func()) {
+	s.lock.Lock()
+	if s.users != 0 {
+		s.close = close
+		s.lock.Unlock()
+		return
+	}
+	s.lock.Unlock()
+	close()
+}
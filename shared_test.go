@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedCloser(t *testing.T) {
+	var closed int
+	s := &sharedCloser{}
+	release1 := s.acquire()
+	release2 := s.acquire()
+
+	// retired resources are closed once their last user releases them
+	s.retire(func() { closed++ })
+	release1()
+	release1()
+	require.Zero(t, closed)
+	release2()
+	require.Equal(t, 1, closed)
+
+	// or right away if they have none
+	(&sharedCloser{}).retire(func() { closed++ })
+	require.Equal(t, 2, closed)
+
+	(*sharedCloser)(nil).acquire()()
+}
+
+func TestDriver_SetConfigKeepsAuditLog(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	config := &Config{
+		DataDir: t.TempDir(),
+		Logging: LoggingConfig{DisableCollection: true},
+		Audit:   AuditConfig{File: filepath.Join(t.TempDir(), "audit.log")},
+	}
+	require.NoError(t, setConfig(t, d, config))
+	wasm, err := wasmtime.Wat2Wasm(helloWat)
+	require.NoError(t, err)
+	cfg := newTestTask(t, wasm)
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{File: "main.wasm"}))
+	_, _, err = d.StartTask(cfg)
+	require.NoError(t, err)
+	audit := d.audit
+
+	// the task's exit is recorded to the audit log it started with, which
+	// is closed once the task is destroyed
+	config.Audit.File = filepath.Join(t.TempDir(), "audit.log")
+	require.NoError(t, setConfig(t, d, config))
+	require.NotSame(t, audit, d.audit)
+	waitTestTask(t, d, cfg.ID)
+	require.NotEmpty(t, audit.writers)
+
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+	require.Empty(t, audit.writers)
+}
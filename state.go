@@ -1,36 +1,87 @@
 package main
 
 import (
+	"hash/fnv"
 	"sync"
 )
 
+// taskStoreShards is the number of shards of a taskStore. Tasks are spread
+// across them by ID so concurrent lookups of different tasks rarely contend
+// on the same lock.
+const taskStoreShards = 64
+
 // taskStore provides a mechanism to store and retrieve
 // task handles given a string identifier. The ID should
 // be unique per task
 type taskStore struct {
-	store map[string]*TaskHandle
+	shards [taskStoreShards]taskStoreShard
+}
+
+type taskStoreShard struct {
 	lock  sync.RWMutex
+	store map[string]*TaskHandle
 }
 
 func newTaskStore() *taskStore {
-	return &taskStore{store: map[string]*TaskHandle{}}
+	ts := &taskStore{}
+	for i := range ts.shards {
+		ts.shards[i].store = map[string]*TaskHandle{}
+	}
+	return ts
+}
+
+// shard returns the shard holding id
+func (ts *taskStore) shard(id string) *taskStoreShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &ts.shards[h.Sum32()%taskStoreShards]
 }
 
 func (ts *taskStore) Set(id string, handle *TaskHandle) {
-	ts.lock.Lock()
-	defer ts.lock.Unlock()
-	ts.store[id] = handle
+	s := ts.shard(id)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.store[id] = handle
 }
 
 func (ts *taskStore) Get(id string) (*TaskHandle, bool) {
-	ts.lock.RLock()
-	defer ts.lock.RUnlock()
-	t, ok := ts.store[id]
+	s := ts.shard(id)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	t, ok := s.store[id]
 	return t, ok
 }
 
 func (ts *taskStore) Delete(id string) {
-	ts.lock.Lock()
-	defer ts.lock.Unlock()
-	delete(ts.store, id)
+	s := ts.shard(id)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.store, id)
+}
+
+// Len returns the number of tasks in the store
+func (ts *taskStore) Len() int {
+	n := 0
+	for i := range ts.shards {
+		s := &ts.shards[i]
+		s.lock.RLock()
+		n += len(s.store)
+		s.lock.RUnlock()
+	}
+	return n
+}
+
+// List returns every handle in the store. Shards are locked one at a time,
+// so tasks set or deleted while listing may or may not be returned.
+func (ts *taskStore) List() []*TaskHandle {
+	var handles []*TaskHandle
+	for i := range ts.shards {
+		s := &ts.shards[i]
+		s.lock.RLock()
+		for _, h := range s.store {
+			handles = append(handles, h)
+		}
+		s.lock.RUnlock()
+	}
+	return handles
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskStore(t *testing.T) {
+	ts := newTaskStore()
+	require.Zero(t, ts.Len())
+	require.Empty(t, ts.List())
+
+	handles := map[string]*TaskHandle{}
+	for i := 0; i < 1000; i++ {
+		id := strconv.Itoa(i)
+		handles[id] = &TaskHandle{}
+		ts.Set(id, handles[id])
+	}
+	require.Equal(t, 1000, ts.Len())
+	require.Len(t, ts.List(), 1000)
+
+	h, ok := ts.Get("42")
+	require.True(t, ok)
+	require.Same(t, handles["42"], h)
+
+	ts.Delete("42")
+	_, ok = ts.Get("42")
+	require.False(t, ok)
+	require.Equal(t, 999, ts.Len())
+}
+
+func TestTaskStore_Concurrent(t *testing.T) {
+	ts := newTaskStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id := strconv.Itoa(i*100 + j)
+				ts.Set(id, &TaskHandle{})
+				if _, ok := ts.Get(id); !ok {
+					t.Errorf("task %s not found after being set", id)
+				}
+				ts.List()
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, 1600, ts.Len())
+}
+
+// benchmarkTaskStore fills a store with tasks ids and looks them up in
+// parallel, setting one every writeEvery lookups
+func benchmarkTaskStore(b *testing.B, tasks, writeEvery int) {
+	ts := newTaskStore()
+	ids := make([]string, tasks)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+		ts.Set(ids[i], &TaskHandle{})
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			id := ids[i%len(ids)]
+			if writeEvery != 0 && i%writeEvery == 0 {
+				ts.Set(id, &TaskHandle{})
+			} else {
+				ts.Get(id)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkTaskStore_Get(b *testing.B) {
+	benchmarkTaskStore(b, 5000, 0)
+}
+
+func BenchmarkTaskStore_GetSet(b *testing.B) {
+	benchmarkTaskStore(b, 5000, 10)
+}
+
+func BenchmarkTaskStore_List(b *testing.B) {
+	ts := newTaskStore()
+	for i := 0; i < 5000; i++ {
+		ts.Set(strconv.Itoa(i), &TaskHandle{})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ts.List()
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// unixSocketPrefix marks listener addresses that are unix sockets
+const unixSocketPrefix = "unix://"
+
+// httpListener serves an HTTP handler for the driver on a TCP address or a
+// unix socket until it's closed.
+type httpListener struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+func newHTTPListener(address string, handler http.Handler) (*httpListener, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, unixSocketPrefix) {
+		network = "unix"
+		address = strings.TrimPrefix(address, unixSocketPrefix)
+
+		// a socket left behind by a previous driver process
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go server.Serve(l)
+	return &httpListener{listener: l, server: server}, nil
+}
+
+// Addr returns the address the listener is bound to
+func (l *httpListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Close stops the listener without waiting for requests in flight, which may
+// be blocked on the driver.
+func (l *httpListener) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.server.Close()
+}
+
+// driverStatus is the JSON document served by the status listener
+type driverStatus struct {
+	Version string `json:"version"`
+	Uptime  string `json:"uptime"`
+
+	// Tasks is the number of tasks in each state
+	Tasks map[string]int `json:"tasks"`
+
+	// Instances is the number of live wasmtime stores
+	Instances int `json:"instances"`
+
+	// CompiledModules is the number of compiled modules cached
+	CompiledModules int `json:"compiled_modules"`
+
+	Artifacts artifactStoreStats `json:"artifacts"`
+	Downloads downloadStatus     `json:"downloads"`
+
+	// Namespaces is what the tasks of each namespace use, against its
+	// namespace_quota
+	Namespaces map[string]namespaceUsage `json:"namespaces"`
+
+	// KeyValueBackends are the backends tasks may select
+	KeyValueBackends []string `json:"keyvalue_backends"`
+
+	Audit     bool `json:"audit"`
+	Blobstore bool `json:"blobstore"`
+	Messaging bool `json:"messaging"`
+}
+
+type downloadStatus struct {
+	Active    int    `json:"active"`
+	Limit     int    `json:"limit"`
+	Bandwidth uint64 `json:"bandwidth"`
+}
+
+// status reports the driver's internals
+func (d *Driver) status() *driverStatus {
+	d.configLock.RLock()
+	defer d.configLock.RUnlock()
+
+	limit, bandwidth := d.downloads.limits()
+	status := &driverStatus{
+		Version:         pluginVersion,
+		Uptime:          time.Since(d.startedAt).Round(time.Second).String(),
+		Tasks:           map[string]int{},
+		Instances:       d.instances.count(),
+		CompiledModules: d.modules.Len(),
+		Namespaces:      d.quotas.usage(),
+		Downloads: downloadStatus{
+			Active:    d.downloads.active(),
+			Limit:     limit,
+			Bandwidth: bandwidth,
+		},
+		KeyValueBackends: []string{},
+		Audit:            d.audit != nil,
+		Blobstore:        d.blobstore != nil,
+		Messaging:        len(d.config.Messaging.Servers) != 0,
+	}
+	for _, h := range d.tasks.List() {
+		status.Tasks[string(h.state())]++
+	}
+	if d.artifacts != nil {
+		status.Artifacts = d.artifacts.Stats()
+	}
+	for name := range d.kvBackends {
+		status.KeyValueBackends = append(status.KeyValueBackends, name)
+	}
+	sort.Strings(status.KeyValueBackends)
+	return status
+}
+
+// statusHandler serves the driver's liveness at /health, its status at
+// /status and its metrics in the Prometheus format at /metrics, so monitors
+// can probe the plugin without going through Nomad.
+func (d *Driver) statusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		health := "ok"
+		if d.ctx.Err() != nil {
+			status = http.StatusServiceUnavailable
+			health = "shutting down"
+		}
+		writeJSON(w, status, map[string]string{"status": health})
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.status())
+	})
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func getJSON(t *testing.T, client *http.Client, url string, v interface{}) int {
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	return resp.StatusCode
+}
+
+func TestStatus_TCP(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{
+		DataDir:                t.TempDir(),
+		MaxConcurrentDownloads: 3,
+		Status:                 StatusConfig{Address: "127.0.0.1:0"},
+	}))
+	defer d.statusServer.Close()
+
+	d.tasks.Set("a", &TaskHandle{procState: drivers.TaskStateRunning})
+	d.tasks.Set("b", &TaskHandle{procState: drivers.TaskStateRunning})
+	d.tasks.Set("c", &TaskHandle{procState: drivers.TaskStateExited})
+	_, err := d.artifacts.Put("a", []byte("\x00asm\x01\x00\x00\x00"))
+	require.NoError(t, err)
+
+	url := "http://" + d.statusServer.Addr().String()
+
+	var health map[string]string
+	require.Equal(t, http.StatusOK, getJSON(t, http.DefaultClient, url+"/health", &health))
+	require.Equal(t, "ok", health["status"])
+
+	var status driverStatus
+	require.Equal(t, http.StatusOK, getJSON(t, http.DefaultClient, url+"/status", &status))
+	require.Equal(t, pluginVersion, status.Version)
+	require.Equal(t, map[string]int{"running": 2, "exited": 1}, status.Tasks)
+	require.Equal(t, artifactStoreStats{Artifacts: 1, Tasks: 1, Bytes: 8}, status.Artifacts)
+	require.Equal(t, downloadStatus{Limit: 3}, status.Downloads)
+	require.Equal(t, []string{kvBackendConsul}, status.KeyValueBackends)
+	require.False(t, status.Blobstore)
+
+	d.signalShutdown()
+	require.Equal(t, http.StatusServiceUnavailable, getJSON(t, http.DefaultClient, url+"/health", &health))
+}
+
+func TestStatus_UnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "status.sock")
+	// a stale socket is replaced
+	require.NoError(t, ioutil.WriteFile(socket, nil, 0600))
+
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{
+		DataDir: t.TempDir(),
+		Status:  StatusConfig{Address: unixSocketPrefix + socket},
+	}))
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	var health map[string]string
+	require.Equal(t, http.StatusOK, getJSON(t, client, "http://driver/health", &health))
+
+	// removing the block closes the listener
+	require.NoError(t, setConfig(t, d, &Config{DataDir: d.artifacts.dir}))
+	require.Nil(t, d.statusServer)
+	_, err := client.Get("http://driver/health")
+	require.Error(t, err)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// levelLogger filters the messages of a logger at a level of its own, so
+// the driver's log_level can be raised for a single task while the logger
+// it wraps logs everything. The loggers derived from it share its level.
+type levelLogger struct {
+	hclog.Logger
+	level *int32
+
+	// driver is the driver's logger if this is a task's, whose level
+	// applies when it's more verbose than the task's
+	driver *levelLogger
+}
+
+// newLevelLogger returns logger filtered at level. logger is set to log
+// everything, along with the loggers sharing its level.
+func newLevelLogger(logger hclog.Logger, level hclog.Level) *levelLogger {
+	logger.SetLevel(hclog.Trace)
+	l := int32(level)
+	return &levelLogger{Logger: logger, level: &l}
+}
+
+// parseTaskLogLevel parses the task's log_level, hclog.NoLevel if unset
+func parseTaskLogLevel(level string) (hclog.Level, error) {
+	if level == "" {
+		return hclog.NoLevel, nil
+	}
+	l := hclog.LevelFromString(level)
+	if l == hclog.NoLevel || l == hclog.Off {
+		return hclog.NoLevel, fmt.Errorf("invalid log_level %q", level)
+	}
+	return l, nil
+}
+
+// taskLogger returns the logger of a task logging at level, or above if the
+// driver's level is more verbose. It's the driver's logger if level is
+// hclog.NoLevel.
+func (d *Driver) taskLogger(level hclog.Level) hclog.Logger {
+	driver, ok := d.logger.(*levelLogger)
+	if !ok || level == hclog.NoLevel {
+		return d.logger
+	}
+	task := newLevelLogger(driver.Logger, level)
+	task.driver = driver
+	return task
+}
+
+func (l *levelLogger) enabled(level hclog.Level) bool {
+	min := hclog.Level(atomic.LoadInt32(l.level))
+	if l.driver != nil {
+		if driver := hclog.Level(atomic.LoadInt32(l.driver.level)); driver < min {
+			min = driver
+		}
+	}
+	return min != hclog.Off && level >= min
+}
+
+func (l *levelLogger) derive(logger hclog.Logger) hclog.Logger {
+	return &levelLogger{Logger: logger, level: l.level, driver: l.driver}
+}
+
+func (l *levelLogger) Log(level hclog.Level, msg string, args ...interface{}) {
+	if l.enabled(level) {
+		l.Logger.Log(level, msg, args...)
+	}
+}
+
+func (l *levelLogger) Trace(msg string, args ...interface{}) { l.Log(hclog.Trace, msg, args...) }
+func (l *levelLogger) Debug(msg string, args ...interface{}) { l.Log(hclog.Debug, msg, args...) }
+func (l *levelLogger) Info(msg string, args ...interface{})  { l.Log(hclog.Info, msg, args...) }
+func (l *levelLogger) Warn(msg string, args ...interface{})  { l.Log(hclog.Warn, msg, args...) }
+func (l *levelLogger) Error(msg string, args ...interface{}) { l.Log(hclog.Error, msg, args...) }
+
+func (l *levelLogger) IsTrace() bool { return l.enabled(hclog.Trace) && l.Logger.IsTrace() }
+func (l *levelLogger) IsDebug() bool { return l.enabled(hclog.Debug) && l.Logger.IsDebug() }
+func (l *levelLogger) IsInfo() bool  { return l.enabled(hclog.Info) && l.Logger.IsInfo() }
+func (l *levelLogger) IsWarn() bool  { return l.enabled(hclog.Warn) && l.Logger.IsWarn() }
+func (l *levelLogger) IsError() bool { return l.enabled(hclog.Error) && l.Logger.IsError() }
+
+func (l *levelLogger) With(args ...interface{}) hclog.Logger {
+	return l.derive(l.Logger.With(args...))
+}
+
+func (l *levelLogger) Named(name string) hclog.Logger {
+	return l.derive(l.Logger.Named(name))
+}
+
+func (l *levelLogger) ResetNamed(name string) hclog.Logger {
+	return l.derive(l.Logger.ResetNamed(name))
+}
+
+// SetLevel sets the level of l and the loggers derived from it, leaving the
+// wrapped logger's
+func (l *levelLogger) SetLevel(level hclog.Level) {
+	atomic.StoreInt32(l.level, int32(level))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTaskLogLevel(t *testing.T) {
+	level, err := parseTaskLogLevel("")
+	require.NoError(t, err)
+	require.Equal(t, hclog.NoLevel, level)
+	level, err = parseTaskLogLevel("TRACE")
+	require.NoError(t, err)
+	require.Equal(t, hclog.Trace, level)
+
+	for _, level := range []string{"verbose", "off"} {
+		_, err := parseTaskLogLevel(level)
+		require.Error(t, err, level)
+	}
+}
+
+func TestTaskLogger(t *testing.T) {
+	var out bytes.Buffer
+	d := NewWasmtimeDriver(hclog.New(&hclog.LoggerOptions{Output: &out, Level: hclog.Error})).(*Driver)
+	d.logger.SetLevel(hclog.Info)
+
+	require.Same(t, d.logger, d.taskLogger(hclog.NoLevel))
+	d.logger.Debug("driver debug")
+	require.NotContains(t, out.String(), "driver debug")
+
+	// the task logs at its more verbose level, the driver's still applies to
+	// other messages
+	logger := d.taskLogger(hclog.Debug).With("task_id", "id")
+	require.True(t, logger.IsDebug())
+	require.False(t, logger.IsTrace())
+	logger.Debug("task debug")
+	logger.Trace("task trace")
+	require.Contains(t, out.String(), "task debug")
+	require.NotContains(t, out.String(), "task trace")
+	require.False(t, d.logger.IsDebug())
+
+	// a more verbose driver isn't silenced by the task's level
+	quiet := d.taskLogger(hclog.Error)
+	quiet.Info("task info")
+	require.Contains(t, out.String(), "task info")
+	d.logger.SetLevel(hclog.Trace)
+	logger.Trace("task trace after reload")
+	require.Contains(t, out.String(), "task trace after reload")
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/dustin/go-humanize"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// defaultTraceMaxFileSize caps the trace file if trace.max_file_size isn't
+// set
+const defaultTraceMaxFileSize = 10 * 1024 * 1024
+
+// traceSettings are the parsed trace block of a task
+type traceSettings struct {
+	sampleRate  float64
+	maxFileSize int64
+}
+
+// parseTrace checks the task's trace block
+func parseTrace(config TaskTraceConfig) (traceSettings, error) {
+	settings := traceSettings{sampleRate: config.SampleRate, maxFileSize: defaultTraceMaxFileSize}
+	if settings.sampleRate < 0 || settings.sampleRate > 1 {
+		return traceSettings{}, fmt.Errorf("invalid trace sample_rate %v: must be between 0 and 1", config.SampleRate)
+	}
+	if settings.sampleRate == 0 {
+		settings.sampleRate = 1
+	}
+	if config.MaxFileSize != "" {
+		size, err := humanize.ParseBytes(config.MaxFileSize)
+		if err != nil || size == 0 {
+			return traceSettings{}, fmt.Errorf("invalid trace max_file_size %q", config.MaxFileSize)
+		}
+		settings.maxFileSize = int64(size)
+	}
+	return settings, nil
+}
+
+// traceFilePath returns the trace file of the task, next to its logs
+func traceFilePath(cfg *drivers.TaskConfig) string {
+	return filepath.Join(cfg.TaskDir().LogDir, cfg.Name+".trace")
+}
+
+// traceRecord is a line of the trace file
+type traceRecord struct {
+	Time     time.Time `json:"time"`
+	Call     string    `json:"call,omitempty"`
+	Args     string    `json:"args,omitempty"`
+	Results  string    `json:"results,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Duration int64     `json:"duration_us"`
+
+	// Truncated ends the file once it reached its maximum size
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// callTracer records a sample of the host calls of a task's guests to its
+// trace file, as JSON lines, until the file reaches its maximum size
+type callTracer struct {
+	logger hclog.Logger
+
+	lock      sync.Mutex
+	file      *os.File
+	size      int64
+	settings  traceSettings
+	rand      *rand.Rand
+	truncated bool
+}
+
+// newCallTracer opens the task's trace file, appending to the one of its
+// previous attempts
+func newCallTracer(cfg *drivers.TaskConfig, config TaskTraceConfig, logger hclog.Logger) (*callTracer, error) {
+	settings, err := parseTrace(config)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(traceFilePath(cfg), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace file: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open trace file: %v", err)
+	}
+	return &callTracer{
+		logger:    logger,
+		file:      f,
+		size:      fi.Size(),
+		settings:  settings,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		truncated: fi.Size() >= settings.maxFileSize,
+	}, nil
+}
+
+// sampled returns whether the next call is recorded
+func (t *callTracer) sampled() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return !t.truncated && (t.settings.sampleRate >= 1 || t.rand.Float64() < t.settings.sampleRate)
+}
+
+// record writes r to the trace file, or ends it if r doesn't fit
+func (t *callTracer) record(r *traceRecord) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.truncated {
+		return
+	}
+	if t.size+int64(len(b)) > t.settings.maxFileSize {
+		t.truncated = true
+		b, _ = json.Marshal(&traceRecord{Time: r.Time, Truncated: true})
+		b = append(b, '\n')
+	}
+	n, err := t.file.Write(b)
+	t.size += int64(n)
+	if err != nil {
+		t.truncated = true
+		t.logger.Warn("failed to write trace file, stopped tracing", "error", err)
+	}
+}
+
+// Close closes the trace file
+func (t *callTracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.file.Close()
+}
+
+// formatVals summarizes the arguments or results of a call
+func formatVals(vals []wasmtime.Val) string {
+	s := make([]string, len(vals))
+	for i, v := range vals {
+		s[i] = fmt.Sprint(v.Get())
+	}
+	return strings.Join(s, ", ")
+}
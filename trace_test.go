@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+// readTrace returns the records of the task's trace file
+func readTrace(t *testing.T, cfg *drivers.TaskConfig) []traceRecord {
+	t.Helper()
+	f, err := os.Open(traceFilePath(cfg))
+	require.NoError(t, err)
+	defer f.Close()
+
+	var records []traceRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r traceRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &r))
+		records = append(records, r)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func TestParseTrace(t *testing.T) {
+	settings, err := parseTrace(TaskTraceConfig{})
+	require.NoError(t, err)
+	require.Equal(t, traceSettings{sampleRate: 1, maxFileSize: defaultTraceMaxFileSize}, settings)
+	settings, err = parseTrace(TaskTraceConfig{SampleRate: 0.25, MaxFileSize: "1MiB"})
+	require.NoError(t, err)
+	require.Equal(t, traceSettings{sampleRate: 0.25, maxFileSize: 1 << 20}, settings)
+
+	for _, config := range []TaskTraceConfig{
+		{SampleRate: -0.5},
+		{SampleRate: 2},
+		{MaxFileSize: "big"},
+		{MaxFileSize: "0"},
+	} {
+		_, err := parseTrace(config)
+		require.Error(t, err, "%+v", config)
+	}
+}
+
+func TestStartTask_Trace(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := startTestTask(t, d, helloWat, &TaskConfig{Trace: &TaskTraceConfig{}})
+
+	// the traced guest behaves as it would otherwise
+	require.Equal(t, 3, waitTestTask(t, d, cfg.ID).ExitCode)
+	stdout, err := ioutil.ReadFile(filepath.Join(cfg.TaskDir().LogDir, "task.stdout"))
+	require.NoError(t, err)
+	require.Equal(t, "hello\n", string(stdout))
+
+	records := readTrace(t, cfg)
+	require.Len(t, records, 2)
+	require.Equal(t, "wasi_snapshot_preview1.fd_write", records[0].Call)
+	require.Equal(t, "1, 0, 1, 8", records[0].Args)
+	require.Equal(t, "0", records[0].Results)
+	require.Empty(t, records[0].Error)
+	require.Equal(t, "wasi_snapshot_preview1.proc_exit", records[1].Call)
+	require.Equal(t, "3", records[1].Args)
+	require.Contains(t, records[1].Error, "exit status 3")
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
+
+func TestStartTask_TraceMaxFileSize(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	cfg := startTestTask(t, d, helloWat, &TaskConfig{Trace: &TaskTraceConfig{MaxFileSize: "200B"}})
+	require.Equal(t, 3, waitTestTask(t, d, cfg.ID).ExitCode)
+
+	records := readTrace(t, cfg)
+	require.Len(t, records, 2)
+	require.Equal(t, "wasi_snapshot_preview1.fd_write", records[0].Call)
+	require.True(t, records[1].Truncated)
+	require.NoError(t, d.DestroyTask(cfg.ID, false))
+}
+
+func TestCallTracer_Sampling(t *testing.T) {
+	cfg := &drivers.TaskConfig{AllocDir: t.TempDir(), Name: "task"}
+	require.NoError(t, os.MkdirAll(cfg.TaskDir().LogDir, 0755))
+
+	tracer, err := newCallTracer(cfg, TaskTraceConfig{SampleRate: 0.1}, hclog.NewNullLogger())
+	require.NoError(t, err)
+	defer tracer.Close()
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		if tracer.sampled() {
+			sampled++
+		}
+	}
+	require.InDelta(t, 1000, sampled, 300)
+}
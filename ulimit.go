@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The resources a forked task may set the ulimit of
+const (
+	ulimitNofile = "nofile"
+	ulimitNproc  = "nproc"
+	ulimitCore   = "core"
+)
+
+// ulimitUnlimited lifts a limit
+const ulimitUnlimited = math.MaxUint64
+
+// ulimit is the soft and hard limit of a resource
+type ulimit struct {
+	soft uint64
+	hard uint64
+}
+
+// parseUlimits parses the task's ulimit map. Values are a single limit set
+// as both the soft and the hard limit, or "soft:hard", where either may be
+// "unlimited".
+func parseUlimits(ulimits map[string]string) (map[string]ulimit, error) {
+	names := make([]string, 0, len(ulimits))
+	for name := range ulimits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make(map[string]ulimit, len(ulimits))
+	for _, name := range names {
+		switch name {
+		case ulimitNofile, ulimitNproc, ulimitCore:
+		default:
+			return nil, fmt.Errorf("unknown ulimit %q: must be %q, %q or %q", name, ulimitNofile, ulimitNproc, ulimitCore)
+		}
+
+		value := ulimits[name]
+		soft, hard := value, value
+		if i := strings.IndexByte(value, ':'); i >= 0 {
+			soft, hard = value[:i], value[i+1:]
+		}
+		l := ulimit{}
+		var err error
+		if l.soft, err = parseUlimitValue(soft); err == nil {
+			l.hard, err = parseUlimitValue(hard)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid ulimit %s %q: %v", name, value, err)
+		}
+		if l.soft > l.hard {
+			return nil, fmt.Errorf("invalid ulimit %s %q: soft limit exceeds hard limit", name, value)
+		}
+		result[name] = l
+	}
+	return result, nil
+}
+
+func parseUlimitValue(s string) (uint64, error) {
+	if s == "unlimited" {
+		return ulimitUnlimited, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
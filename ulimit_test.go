@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUlimits(t *testing.T) {
+	ulimits, err := parseUlimits(map[string]string{
+		ulimitNofile: "1024:4096",
+		ulimitNproc:  "64",
+		ulimitCore:   "0:unlimited",
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]ulimit{
+		ulimitNofile: {soft: 1024, hard: 4096},
+		ulimitNproc:  {soft: 64, hard: 64},
+		ulimitCore:   {soft: 0, hard: ulimitUnlimited},
+	}, ulimits)
+
+	for _, bad := range []map[string]string{
+		{"stack": "1"},
+		{ulimitNofile: "many"},
+		{ulimitNofile: "4096:1024"},
+		{ulimitCore: "unlimited:0"},
+		{ulimitNproc: "1:2:3"},
+	} {
+		_, err := parseUlimits(bad)
+		require.Error(t, err, "%v", bad)
+	}
+}
+
+func TestStartTask_UlimitInProcess(t *testing.T) {
+	d := NewWasmtimeDriver(hclog.NewNullLogger()).(*Driver)
+	require.NoError(t, setConfig(t, d, &Config{DataDir: t.TempDir()}))
+
+	cfg := &drivers.TaskConfig{ID: "id", AllocID: "alloc", Name: "task", AllocDir: t.TempDir()}
+	require.NoError(t, os.MkdirAll(cfg.TaskDir().Dir, 0755))
+	wasm, err := wasmtime.Wat2Wasm(helloWat)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.TaskDir().Dir, "main.wasm"), wasm, 0644))
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{
+		File:   "main.wasm",
+		Ulimit: map[string]string{ulimitCore: "0"},
+	}))
+
+	// the plugin's own limits aren't the task's to set
+	_, _, err = d.StartTask(cfg)
+	require.EqualError(t, err, `ulimit requires the "forked" execution_mode`)
+}
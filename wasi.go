@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Capabilities that can be granted to a guest with wasi.capabilities
+const (
+	capabilityWASI      = "wasi"
+	capabilityCrypto    = "crypto"
+	capabilityBlobstore = "blobstore"
+	capabilityMessaging = "messaging"
+	capabilityKeyValue  = "keyvalue"
+	capabilitySQL       = "sql"
+	capabilitySecrets   = "secrets"
+	capabilityHTTP      = "http"
+)
+
+var knownCapabilities = map[string]struct{}{
+	capabilityWASI:      {},
+	capabilityCrypto:    {},
+	capabilityBlobstore: {},
+	capabilityMessaging: {},
+	capabilityKeyValue:  {},
+	capabilitySQL:       {},
+	capabilitySecrets:   {},
+	capabilityHTTP:      {},
+}
+
+// capabilitySet is the set of host interfaces a task may link. A nil set
+// allows every interface.
+type capabilitySet map[string]struct{}
+
+func newCapabilitySet(names []string) (capabilitySet, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	set := capabilitySet{}
+	for _, name := range names {
+		if _, ok := knownCapabilities[name]; !ok {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+		set[name] = struct{}{}
+	}
+	return set, nil
+}
+
+func (c capabilitySet) allows(name string) bool {
+	if c == nil {
+		return true
+	}
+	_, ok := c[name]
+	return ok
+}
+
+// without returns the set with names denied
+func (c capabilitySet) without(names ...string) capabilitySet {
+	set := capabilitySet{}
+	for name := range knownCapabilities {
+		if c.allows(name) {
+			set[name] = struct{}{}
+		}
+	}
+	for _, name := range names {
+		delete(set, name)
+	}
+	return set
+}
+
+// envInheritPatterns returns the glob patterns naming the variables of the
+// task's environment inherited by the guest, per wasi.env_inherit: none if
+// unset or false, all of them if true.
+func envInheritPatterns(v interface{}) ([]string, error) {
+	var patterns []string
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		if !v {
+			return nil, nil
+		}
+		return []string{"*"}, nil
+	case string:
+		patterns = []string{v}
+	case []string:
+		patterns = v
+	case []interface{}:
+		for _, p := range v {
+			s, ok := p.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid env_inherit pattern %v: must be a string", p)
+			}
+			patterns = append(patterns, s)
+		}
+	default:
+		return nil, fmt.Errorf("invalid env_inherit %v: must be a bool or a list of patterns", v)
+	}
+
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid env_inherit pattern %q: %v", p, err)
+		}
+	}
+	return patterns, nil
+}
+
+// envFilter keeps the variables matching allow, if set, and not deny
+type envFilter struct {
+	allow []string
+	deny  []string
+}
+
+func newEnvFilter(config TaskWASIConfig) (*envFilter, error) {
+	for _, p := range append(append([]string(nil), config.EnvAllowlist...), config.EnvDenylist...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid env filter pattern %q: %v", p, err)
+		}
+	}
+	return &envFilter{allow: config.EnvAllowlist, deny: config.EnvDenylist}, nil
+}
+
+func (f *envFilter) keeps(name string) bool {
+	if len(f.allow) != 0 && !matchEnv(f.allow, name) {
+		return false
+	}
+	return !matchEnv(f.deny, name)
+}
+
+// matchEnv returns whether the variable name matches any of patterns
+func matchEnv(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// guestStdin returns the file in taskDir the guest reads as its stdin, if
+// any. Like preopens it must be within the task dir.
+func guestStdin(taskDir, stdin string) (string, error) {
+	if stdin == "" {
+		return "", nil
+	}
+	rel := filepath.Clean(stdin)
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("stdin %q must be relative to the task dir", stdin)
+	}
+
+	path := filepath.Join(taskDir, rel)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat stdin %q: %v", stdin, err)
+	}
+	if fi.IsDir() {
+		return "", fmt.Errorf("stdin %q is a directory", stdin)
+	}
+	return path, nil
+}
+
+// wasiPreopens returns the preopens for the directories of the task dir
+// listed in wasi.preopens, sorted by guest path. Host paths outside of the
+// task dir are rejected; host directories are exposed with mounts instead.
+func wasiPreopens(taskDir string, preopens map[string]string) ([]*preopen, error) {
+	guestPaths := make([]string, 0, len(preopens))
+	for guest := range preopens {
+		guestPaths = append(guestPaths, guest)
+	}
+	sort.Strings(guestPaths)
+
+	result := make([]*preopen, 0, len(preopens))
+	for _, guest := range guestPaths {
+		host := preopens[guest]
+		if guest == "" {
+			return nil, fmt.Errorf("preopen of %q has no guest path", host)
+		}
+
+		rel := filepath.Clean(host)
+		if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("preopen %q must be relative to the task dir", host)
+		}
+
+		path := filepath.Join(taskDir, rel)
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat preopen %q: %v", host, err)
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("preopen %q is not a directory", host)
+		}
+
+		result = append(result, &preopen{HostPath: path, GuestPath: guest})
+	}
+	return result, nil
+}
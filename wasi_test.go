@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWASIPreopens(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "local", "data"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "local", "file"), nil, 0600))
+
+	preopens, err := wasiPreopens(dir, map[string]string{
+		"/data": "local/data",
+		"/":     ".",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []*preopen{
+		{HostPath: dir, GuestPath: "/"},
+		{HostPath: filepath.Join(dir, "local", "data"), GuestPath: "/data"},
+	}, preopens)
+
+	for _, host := range []string{"/etc", "../other", "local/../../other", "local/file", "missing"} {
+		_, err := wasiPreopens(dir, map[string]string{"/x": host})
+		require.Error(t, err, host)
+	}
+}
+
+func TestGuestStdin(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "local"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "local", "payload"), nil, 0600))
+
+	path, err := guestStdin(dir, "")
+	require.NoError(t, err)
+	require.Empty(t, path)
+	path, err = guestStdin(dir, "local/payload")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "local", "payload"), path)
+
+	for _, stdin := range []string{"/etc/passwd", "../payload", "local", "local/missing"} {
+		_, err := guestStdin(dir, stdin)
+		require.Error(t, err, stdin)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	_, err := newCapabilitySet([]string{"wasi", "telepathy"})
+	require.Error(t, err)
+
+	d := &Driver{
+		config:     &Config{Crypto: CryptoConfig{Enabled: true}},
+		kvBackends: map[string]kvBackend{},
+	}
+	cfg := &drivers.TaskConfig{}
+
+	// plugin level interfaces are only linked when granted
+	hosts, err := d.newHostModules(cfg, &TaskConfig{})
+	require.NoError(t, err)
+	require.Len(t, hosts, 1)
+
+	hosts, err = d.newHostModules(cfg, &TaskConfig{WASI: TaskWASIConfig{Capabilities: []string{capabilityWASI}}})
+	require.NoError(t, err)
+	require.Empty(t, hosts)
+
+	// task level interfaces must be granted
+	_, err = d.newHostModules(cfg, &TaskConfig{
+		WASI:     TaskWASIConfig{Capabilities: []string{capabilityWASI}},
+		KeyValue: TaskKeyValueConfig{Backend: kvBackendConsul},
+	})
+	require.EqualError(t, err, `keyvalue block requires the "keyvalue" capability`)
+}
+
+func TestEnvInheritPatterns(t *testing.T) {
+	for _, v := range []interface{}{nil, false} {
+		patterns, err := envInheritPatterns(v)
+		require.NoError(t, err)
+		require.Empty(t, patterns)
+	}
+
+	patterns, err := envInheritPatterns(true)
+	require.NoError(t, err)
+	require.True(t, matchEnv(patterns, "ANYTHING"))
+
+	// lists decoded from HCL hold interfaces
+	patterns, err = envInheritPatterns([]interface{}{"APP_*", "LANG"})
+	require.NoError(t, err)
+	require.True(t, matchEnv(patterns, "APP_PORT"))
+	require.True(t, matchEnv(patterns, "LANG"))
+	require.False(t, matchEnv(patterns, "LANGUAGE"))
+	require.False(t, matchEnv(patterns, "NOMAD_ALLOC_ID"))
+
+	for _, v := range []interface{}{[]interface{}{1}, "[", 3} {
+		_, err := envInheritPatterns(v)
+		require.Error(t, err, "%v", v)
+	}
+}
+
+func TestGuestEnv_Filter(t *testing.T) {
+	cfg := &drivers.TaskConfig{Env: map[string]string{
+		"NOMAD_ALLOC_ID":         "alloc",
+		"NOMAD_TASK_NAME":        "task",
+		"NOMAD_TOKEN":            "secret",
+		"APP_MODE":               "prod",
+		"NOMAD_UPSTREAM_ADDR_db": "127.0.0.1:5432",
+	}}
+
+	// the allowlist alone inherits what it matches
+	env, err := guestEnv(cfg, &TaskConfig{WASI: TaskWASIConfig{
+		EnvAllowlist: []string{"NOMAD_*"},
+		EnvDenylist:  []string{"NOMAD_TOKEN"},
+	}}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "alloc", env["NOMAD_ALLOC_ID"])
+	require.Equal(t, "task", env["NOMAD_TASK_NAME"])
+	require.Equal(t, "127.0.0.1:5432", env["NOMAD_UPSTREAM_ADDR_db"])
+	require.NotContains(t, env, "NOMAD_TOKEN")
+	require.NotContains(t, env, "APP_MODE")
+
+	// the denylist composes with env_inherit, but not with env
+	env, err = guestEnv(cfg, &TaskConfig{
+		WASI: TaskWASIConfig{EnvInherit: true, EnvDenylist: []string{"NOMAD_*"}},
+		Env:  map[string]string{"NOMAD_JOB": "explicit"},
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"APP_MODE": "prod", "NOMAD_JOB": "explicit"}, env)
+
+	_, err = guestEnv(cfg, &TaskConfig{WASI: TaskWASIConfig{EnvDenylist: []string{"["}}}, nil)
+	require.Error(t, err)
+}
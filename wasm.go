@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// WebAssembly section ids
+const (
+	wasmCustomSection = 0
+	wasmImportSection = 2
+	wasmTableSection  = 4
+	wasmMemorySection = 5
+)
+
+var errWasmTruncated = errors.New("truncated module")
+
+// wasmSection is a section of a module in the binary format
+type wasmSection struct {
+	id byte
+
+	// name is the name of custom sections
+	name string
+	data []byte
+}
+
+// wasmReader reads the primitives of the binary format
+type wasmReader struct {
+	b []byte
+}
+
+func (r *wasmReader) byte() (byte, error) {
+	if len(r.b) == 0 {
+		return 0, errWasmTruncated
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c, nil
+}
+
+func (r *wasmReader) uleb() (uint64, error) {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		return 0, errWasmTruncated
+	}
+	r.b = r.b[n:]
+	return v, nil
+}
+
+func (r *wasmReader) bytes() ([]byte, error) {
+	n, err := r.uleb()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(r.b)) < n {
+		return nil, errWasmTruncated
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b, nil
+}
+
+func (r *wasmReader) name() (string, error) {
+	b, err := r.bytes()
+	return string(b), err
+}
+
+// limits skips the limits of a table or memory type
+func (r *wasmReader) limits() error {
+	flags, err := r.byte()
+	if err != nil {
+		return err
+	}
+	if _, err := r.uleb(); err != nil {
+		return err
+	}
+	if flags&1 != 0 {
+		_, err = r.uleb()
+	}
+	return err
+}
+
+// wasmSections splits the module wasm into its sections, without validating
+// them, for the checks made before the module is compiled
+func wasmSections(wasm []byte) ([]wasmSection, error) {
+	if err := validateModule(wasm); err != nil {
+		return nil, err
+	}
+	if len(wasm) < 8 {
+		return nil, errWasmTruncated
+	}
+
+	var sections []wasmSection
+	r := &wasmReader{b: wasm[8:]}
+	for len(r.b) > 0 {
+		id, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		section := wasmSection{id: id, data: data}
+		if id == wasmCustomSection {
+			body := &wasmReader{b: data}
+			if section.name, err = body.name(); err != nil {
+				return nil, err
+			}
+			section.data = body.b
+		}
+		sections = append(sections, section)
+	}
+	return sections, nil
+}
+
+// wasmImports returns the imports declared by wasm, with their kind as
+// type. Unlike inspectModule it doesn't compile the module.
+func wasmImports(wasm []byte) ([]moduleImport, error) {
+	sections, err := wasmSections(wasm)
+	if err != nil {
+		return nil, err
+	}
+
+	var imports []moduleImport
+	for _, s := range sections {
+		if s.id != wasmImportSection {
+			continue
+		}
+		r := &wasmReader{b: s.data}
+		n, err := r.uleb()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < n; i++ {
+			imp, err := r.importEntry()
+			if err != nil {
+				return nil, fmt.Errorf("invalid import section: %v", err)
+			}
+			imports = append(imports, imp)
+		}
+	}
+	return imports, nil
+}
+
+// importEntry reads an entry of the import section
+func (r *wasmReader) importEntry() (moduleImport, error) {
+	var imp moduleImport
+	var err error
+	if imp.Module, err = r.name(); err != nil {
+		return imp, err
+	}
+	if imp.Name, err = r.name(); err != nil {
+		return imp, err
+	}
+	kind, err := r.byte()
+	if err != nil {
+		return imp, err
+	}
+
+	switch kind {
+	case 0:
+		imp.Type = "func"
+		_, err = r.uleb()
+	case 1:
+		imp.Type = "table"
+		if _, err = r.byte(); err == nil {
+			err = r.limits()
+		}
+	case 2:
+		imp.Type = "memory"
+		err = r.limits()
+	case 3:
+		imp.Type = "global"
+		if _, err = r.byte(); err == nil {
+			_, err = r.byte()
+		}
+	case 4:
+		imp.Type = "tag"
+		if _, err = r.byte(); err == nil {
+			_, err = r.uleb()
+		}
+	default:
+		err = fmt.Errorf("unknown import kind %d", kind)
+	}
+	return imp, err
+}
+
+// limitModule returns wasm with the maximum of the memories and tables it
+// defines lowered to the task's limits, and whether any was. wasmtime-go
+// doesn't expose the store's resource limiter, so a capped declaration is
+// what keeps memory.grow and table.grow from going past a limit: they fail,
+// as they would past the module's own maximum. Memories initially over the
+// limit are left for instantiation to refuse, while tables over theirs, or
+// more tables than max_tables, fail here. Imported memories and tables
+// aren't the module's to cap.
+func limitModule(wasm []byte, limits *taskLimits) ([]byte, bool, error) {
+	if limits.memory == 0 && limits.tables == 0 && limits.tableElements == 0 {
+		return wasm, false, nil
+	}
+	if err := validateModule(wasm); err != nil {
+		return nil, false, err
+	}
+	if len(wasm) < 8 {
+		return nil, false, errWasmTruncated
+	}
+
+	out := append([]byte(nil), wasm[:8]...)
+	capped := false
+	tables := 0
+	r := &wasmReader{b: wasm[8:]}
+	for len(r.b) > 0 {
+		start := r.b
+		id, err := r.byte()
+		if err != nil {
+			return nil, false, err
+		}
+		data, err := r.bytes()
+		if err != nil {
+			return nil, false, err
+		}
+
+		var body []byte
+		changed := false
+		switch {
+		case id == wasmImportSection:
+			n, err := importedTables(data)
+			if err != nil {
+				return nil, false, fmt.Errorf("invalid import section: %v", err)
+			}
+			tables += n
+		case id == wasmTableSection:
+			var n int
+			if body, n, changed, err = limitTableSection(data, limits.tableElements); err != nil {
+				return nil, false, err
+			}
+			tables += n
+		case id == wasmMemorySection && limits.memory != 0:
+			if body, changed, err = limitMemorySection(data, limits.memory/wasmPageSize); err != nil {
+				return nil, false, fmt.Errorf("invalid memory section: %v", err)
+			}
+		}
+		if !changed {
+			out = append(out, start[:len(start)-len(r.b)]...)
+			continue
+		}
+		capped = true
+		out = append(out, id)
+		out = appendUleb(out, uint64(len(body)))
+		out = append(out, body...)
+	}
+	if limits.tables != 0 && tables > limits.tables {
+		return nil, false, fmt.Errorf("module declares %d tables, above the max_tables of %d", tables, limits.tables)
+	}
+	if !capped {
+		return wasm, false, nil
+	}
+	return out, true, nil
+}
+
+// importedTables returns the number of tables the import section data
+// imports
+func importedTables(data []byte) (int, error) {
+	r := &wasmReader{b: data}
+	n, err := r.uleb()
+	if err != nil {
+		return 0, err
+	}
+	tables := 0
+	for i := uint64(0); i < n; i++ {
+		imp, err := r.importEntry()
+		if err != nil {
+			return 0, err
+		}
+		if imp.Type == "table" {
+			tables++
+		}
+	}
+	return tables, nil
+}
+
+// limitTableSection rewrites the table types of the table section data with
+// a maximum of at most elements, if set, and returns its number of tables
+func limitTableSection(data []byte, elements uint64) ([]byte, int, bool, error) {
+	r := &wasmReader{b: data}
+	n, err := r.uleb()
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("invalid table section: %v", err)
+	}
+	out := appendUleb(nil, n)
+	changed := false
+	for i := uint64(0); i < n; i++ {
+		elemType, err := r.byte()
+		if err != nil {
+			return nil, 0, false, fmt.Errorf("invalid table section: %v", err)
+		}
+		l, err := r.limitsType()
+		if err != nil {
+			return nil, 0, false, fmt.Errorf("invalid table section: %v", err)
+		}
+		if elements != 0 {
+			if l.min > elements {
+				return nil, 0, false, fmt.Errorf("table %d's initial size of %d elements exceeds the max_table_elements of %d", i, l.min, elements)
+			}
+			changed = l.lower(elements) || changed
+		}
+		out = append(out, elemType)
+		out = l.append(out)
+	}
+	if len(r.b) != 0 {
+		return nil, 0, false, errors.New("invalid table section: trailing data")
+	}
+	return out, int(n), changed, nil
+}
+
+// limitMemorySection rewrites the memory types of the memory section data
+// with a maximum of at most pages
+func limitMemorySection(data []byte, pages uint64) ([]byte, bool, error) {
+	r := &wasmReader{b: data}
+	n, err := r.uleb()
+	if err != nil {
+		return nil, false, err
+	}
+	out := appendUleb(nil, n)
+	changed := false
+	for i := uint64(0); i < n; i++ {
+		l, err := r.limitsType()
+		if err != nil {
+			return nil, false, err
+		}
+		if l.min <= pages {
+			changed = l.lower(pages) || changed
+		}
+		out = l.append(out)
+	}
+	if len(r.b) != 0 {
+		return nil, false, errors.New("trailing data")
+	}
+	return out, changed, nil
+}
+
+// wasmLimits are the limits of a table or memory type
+type wasmLimits struct {
+	flags    byte
+	min, max uint64
+}
+
+func (l *wasmLimits) hasMax() bool {
+	return l.flags&1 != 0
+}
+
+// lower sets the maximum to max unless it's already lower, returning
+// whether it changed
+func (l *wasmLimits) lower(max uint64) bool {
+	if l.hasMax() && l.max <= max {
+		return false
+	}
+	l.flags |= 1
+	l.max = max
+	return true
+}
+
+func (l *wasmLimits) append(b []byte) []byte {
+	b = append(b, l.flags)
+	b = appendUleb(b, l.min)
+	if l.hasMax() {
+		b = appendUleb(b, l.max)
+	}
+	return b
+}
+
+// limitsType reads the limits of a table or memory type
+func (r *wasmReader) limitsType() (*wasmLimits, error) {
+	flags, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	l := &wasmLimits{flags: flags}
+	if l.min, err = r.uleb(); err != nil {
+		return nil, err
+	}
+	if l.hasMax() {
+		if l.max, err = r.uleb(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func appendUleb(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWasmImports(t *testing.T) {
+	wasm, err := wasmtime.Wat2Wasm(`(module
+	  (import "wasi_snapshot_preview1" "proc_exit" (func (param i32)))
+	  (import "env" "table" (table 1 2 funcref))
+	  (import "env" "memory" (memory 1 4))
+	  (import "env" "counter" (global (mut i32)))
+	  (import "env" "log" (func (param i32 i32))))`)
+	require.NoError(t, err)
+
+	imports, err := wasmImports(wasm)
+	require.NoError(t, err)
+	require.Equal(t, []moduleImport{
+		{Module: "wasi_snapshot_preview1", Name: "proc_exit", Type: "func"},
+		{Module: "env", Name: "table", Type: "table"},
+		{Module: "env", Name: "memory", Type: "memory"},
+		{Module: "env", Name: "counter", Type: "global"},
+		{Module: "env", Name: "log", Type: "func"},
+	}, imports)
+
+	imports, err = wasmImports(wasm[:len(wasm)-3])
+	require.Error(t, err)
+	require.Nil(t, imports)
+
+	_, err = wasmImports([]byte("not wasm"))
+	require.Error(t, err)
+}
+
+func TestWasmSections(t *testing.T) {
+	wasm, err := wasmtime.Wat2Wasm(`(module (func (export "run")))`)
+	require.NoError(t, err)
+	// a custom section named "meta" holding "hi"
+	wasm = append(wasm, wasmCustomSection, 7, 4, 'm', 'e', 't', 'a', 'h', 'i')
+
+	sections, err := wasmSections(wasm)
+	require.NoError(t, err)
+	custom := sections[len(sections)-1]
+	require.Equal(t, byte(wasmCustomSection), custom.id)
+	require.Equal(t, "meta", custom.name)
+	require.Equal(t, []byte("hi"), custom.data)
+}
+
+func TestLimitModule_Memories(t *testing.T) {
+	maximum := func(wasm []byte) (bool, uint64) {
+		module, err := wasmtime.NewModule(wasmtime.NewEngine(), wasm)
+		require.NoError(t, err)
+		for _, e := range module.Exports() {
+			if mt := e.Type().MemoryType(); mt != nil {
+				return mt.Maximum()
+			}
+		}
+		t.Fatal("no memory exported")
+		return false, 0
+	}
+
+	cases := []struct {
+		name     string
+		wat      string
+		capped   bool
+		maximum  uint64
+		hasLimit bool
+	}{
+		{"unbounded", `(module (memory (export "memory") 1) (func (export "_start")))`, true, 4, true},
+		{"above the limit", `(module (memory (export "memory") 1 100))`, true, 4, true},
+		{"below the limit", `(module (memory (export "memory") 1 2))`, false, 2, true},
+		{"initially above the limit", `(module (memory (export "memory") 8))`, false, 0, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			wasm, err := wasmtime.Wat2Wasm(c.wat)
+			require.NoError(t, err)
+			limited, capped, err := limitModule(wasm, &taskLimits{memory: 4*wasmPageSize + 100})
+			require.NoError(t, err)
+			require.Equal(t, c.capped, capped)
+			ok, max := maximum(limited)
+			require.Equal(t, c.hasLimit, ok)
+			require.Equal(t, c.maximum, max)
+		})
+	}
+
+	wasm, err := wasmtime.Wat2Wasm(`(module (memory (export "memory") 1))`)
+	require.NoError(t, err)
+	limited, capped, err := limitModule(wasm, &taskLimits{})
+	require.NoError(t, err)
+	require.False(t, capped)
+	require.Equal(t, wasm, limited)
+	_, _, err = limitModule(wasm[:len(wasm)-1], &taskLimits{memory: wasmPageSize})
+	require.Error(t, err)
+}
+
+func TestLimitModule_Tables(t *testing.T) {
+	maximum := func(wasm []byte) (bool, uint64) {
+		module, err := wasmtime.NewModule(wasmtime.NewEngine(), wasm)
+		require.NoError(t, err)
+		for _, e := range module.Exports() {
+			if tt := e.Type().TableType(); tt != nil {
+				ok, max := tt.Maximum()
+				return ok, uint64(max)
+			}
+		}
+		t.Fatal("no table exported")
+		return false, 0
+	}
+
+	limits := &taskLimits{tables: 2, tableElements: 100}
+	cases := []struct {
+		name    string
+		wat     string
+		capped  bool
+		maximum uint64
+	}{
+		{"unbounded", `(module (table (export "table") 1 funcref))`, true, 100},
+		{"above the limit", `(module (table (export "table") 1 1000 funcref))`, true, 100},
+		{"below the limit", `(module (table (export "table") 1 10 funcref))`, false, 10},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			wasm, err := wasmtime.Wat2Wasm(c.wat)
+			require.NoError(t, err)
+			limited, capped, err := limitModule(wasm, limits)
+			require.NoError(t, err)
+			require.Equal(t, c.capped, capped)
+			ok, max := maximum(limited)
+			require.True(t, ok)
+			require.Equal(t, c.maximum, max)
+		})
+	}
+
+	for _, wat := range []string{
+		`(module (table 101 funcref))`,
+		`(module (import "env" "t" (table 1 funcref)) (table 1 funcref) (table 1 externref))`,
+	} {
+		wasm, err := wasmtime.Wat2Wasm(wat)
+		require.NoError(t, err)
+		_, _, err = limitModule(wasm, limits)
+		require.Error(t, err, wat)
+	}
+}